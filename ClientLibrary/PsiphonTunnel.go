@@ -1,6 +1,16 @@
 package main
 
-// #include <stdlib.h>
+/*
+#include <stdlib.h>
+
+// PsiphonNoticeCallback receives each notice as a null-terminated JSON
+// string. The string is freed once the callback returns.
+typedef void (*PsiphonNoticeCallback)(char *noticeJSON);
+
+static inline void invokeNoticeCallback(PsiphonNoticeCallback callback, char *noticeJSON) {
+	callback(noticeJSON);
+}
+*/
 import "C"
 
 import (
@@ -38,12 +48,43 @@ type startResult struct {
 	SocksProxyPort int             `json:"socks_proxy_port,omitempty"`
 }
 
+type statusResult struct {
+	State          string   `json:"state"`
+	ActiveTunnels  int      `json:"active_tunnels"`
+	TunnelRegions  []string `json:"tunnel_regions,omitempty"`
+	EgressRegion   string   `json:"egress_region,omitempty"`
+	LastError      string   `json:"last_error,omitempty"`
+	UptimeSeconds  float64  `json:"uptime_seconds"`
+	BytesSent      int64    `json:"bytes_sent"`
+	BytesReceived  int64    `json:"bytes_received"`
+	HttpProxyPort  int      `json:"http_proxy_port,omitempty"`
+	SocksProxyPort int      `json:"socks_proxy_port,omitempty"`
+}
+
+type feedbackResult struct {
+	Code        feedbackResultCode `json:"result_code"`
+	ErrorString string             `json:"error,omitempty"`
+}
+
+type feedbackResultCode int
+
+const (
+	feedbackResultCodeSuccess feedbackResultCode = iota
+	feedbackResultCodeError
+)
+
 type psiphonTunnel struct {
 	controllerWaitGroup sync.WaitGroup
 	controllerCtx       context.Context
 	stopController      context.CancelFunc
 	httpProxyPort       int
 	socksProxyPort      int
+
+	// mutex guards controller and noticeCallback, which are accessed by the
+	// functions which may be called while Start is running.
+	mutex          sync.Mutex
+	controller     *psiphon.Controller
+	noticeCallback C.PsiphonNoticeCallback
 }
 
 var tunnel psiphonTunnel
@@ -51,6 +92,30 @@ var tunnel psiphonTunnel
 // Memory managed by PsiphonTunnel which is allocated in Start and freed in Stop
 var managedStartResult *C.char
 
+// Memory managed by PsiphonTunnel which is allocated in GetStatus and
+// SendFeedback, and freed in the next call to the same function or in Stop
+var managedStatusResult *C.char
+var managedFeedbackResult *C.char
+
+//export SetNoticeCallback
+// SetNoticeCallback sets a function which is called with each notice, as a
+// null-terminated JSON string, while Psiphon is running. The notice format
+// is described in
+// https://godoc.org/github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon#SetNoticeWriter.
+//
+// The notice string is freed once the callback returns, so the callback must
+// copy any data it retains. The callback is invoked on a thread created by
+// PsiphonTunnel, one notice at a time, and must not block or call Start or
+// Stop. Call SetNoticeCallback with NULL to stop receiving notices.
+//
+// SetNoticeCallback may be called before Start, to receive notices emitted
+// while starting, and at any time while Psiphon is running.
+func SetNoticeCallback(callback C.PsiphonNoticeCallback) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.noticeCallback = callback
+}
+
 //export Start
 //
 // ******************************* WARNING ********************************
@@ -143,8 +208,6 @@ func Start(configJSON, embeddedServerEntryList, clientPlatform, networkID string
 
 	// Setup signals
 
-	connected := make(chan bool)
-
 	testError := make(chan error)
 
 	// Set up notice handling
@@ -163,20 +226,21 @@ func Start(configJSON, embeddedServerEntryList, clientPlatform, networkID string
 				}
 			}
 
+			tunnel.mutex.Lock()
 			if event.NoticeType == "ListeningHttpProxyPort" {
 				port := event.Data["port"].(float64)
 				tunnel.httpProxyPort = int(port)
 			} else if event.NoticeType == "ListeningSocksProxyPort" {
 				port := event.Data["port"].(float64)
 				tunnel.socksProxyPort = int(port)
-			} else if event.NoticeType == "Tunnels" {
-				count := event.Data["count"].(float64)
-				if count > 0 {
-					select {
-					case connected <- true:
-					default:
-					}
-				}
+			}
+			noticeCallback := tunnel.noticeCallback
+			tunnel.mutex.Unlock()
+
+			if noticeCallback != nil {
+				noticeJSON := C.CString(string(notice))
+				C.invokeNoticeCallback(noticeCallback, noticeJSON)
+				C.free(unsafe.Pointer(noticeJSON))
 			}
 		}))
 
@@ -209,8 +273,18 @@ func Start(configJSON, embeddedServerEntryList, clientPlatform, networkID string
 		return startErrorJson(err)
 	}
 
+	// Subscribe before running the controller so that no state transition
+	// is missed.
+
+	stateTransitions, unsubscribe := controller.SubscribeStateTransitions()
+	defer unsubscribe()
+
 	tunnel.controllerCtx, tunnel.stopController = context.WithCancel(context.Background())
 
+	tunnel.mutex.Lock()
+	tunnel.controller = controller
+	tunnel.mutex.Unlock()
+
 	// Set start time
 
 	startTime := time.Now()
@@ -239,23 +313,33 @@ func Start(configJSON, embeddedServerEntryList, clientPlatform, networkID string
 
 	// Wait for an active tunnel, timeout or error
 
-	select {
-	case <-connected:
-		result.Code = startResultCodeSuccess
-		result.BootstrapTime = secondsBeforeNow(startTime)
-		result.HttpProxyPort = tunnel.httpProxyPort
-		result.SocksProxyPort = tunnel.socksProxyPort
-	case <-timeoutSignal.Done():
-		result.Code = startResultCodeTimeout
-		err = timeoutSignal.Err()
-		if err != nil {
-			result.ErrorString = fmt.Sprintf("Timeout occured before Psiphon connected: %s", err.Error())
+waitLoop:
+	for {
+		select {
+		case transition := <-stateTransitions:
+			if transition.To != psiphon.CONTROLLER_STATE_CONNECTED &&
+				transition.To != psiphon.CONTROLLER_STATE_DEGRADED {
+				continue
+			}
+			result.Code = startResultCodeSuccess
+			result.BootstrapTime = secondsBeforeNow(startTime)
+			tunnel.mutex.Lock()
+			result.HttpProxyPort = tunnel.httpProxyPort
+			result.SocksProxyPort = tunnel.socksProxyPort
+			tunnel.mutex.Unlock()
+		case <-timeoutSignal.Done():
+			result.Code = startResultCodeTimeout
+			err = timeoutSignal.Err()
+			if err != nil {
+				result.ErrorString = fmt.Sprintf("Timeout occured before Psiphon connected: %s", err.Error())
+			}
+			tunnel.stopController()
+		case err := <-testError:
+			result.Code = startResultCodeOtherError
+			result.ErrorString = err.Error()
+			tunnel.stopController()
 		}
-		tunnel.stopController()
-	case err := <-testError:
-		result.Code = startResultCodeOtherError
-		result.ErrorString = err.Error()
-		tunnel.stopController()
+		break waitLoop
 	}
 
 	// Free previous result
@@ -274,6 +358,8 @@ func Start(configJSON, embeddedServerEntryList, clientPlatform, networkID string
 // controller is not left running.
 func Stop() {
 	freeManagedStartResult()
+	freeManagedString(&managedStatusResult)
+	freeManagedString(&managedFeedbackResult)
 
 	if tunnel.stopController != nil {
 		tunnel.stopController()
@@ -281,9 +367,172 @@ func Stop() {
 
 	tunnel.controllerWaitGroup.Wait()
 
+	tunnel.mutex.Lock()
+	tunnel.controller = nil
+	tunnel.httpProxyPort = 0
+	tunnel.socksProxyPort = 0
+	tunnel.mutex.Unlock()
+
 	psiphon.CloseDataStore()
 }
 
+//export GetStatus
+//
+// ******************************* WARNING ********************************
+// The underlying memory referenced by the return value of GetStatus is
+// managed by PsiphonTunnel and attempting to free it explicitly will cause
+// the program to crash. This memory is freed in the next call to GetStatus
+// or once Stop is called.
+// ************************************************************************
+//
+// GetStatus returns the current status, serialized as a JSON string in the
+// form of a null-terminated buffer of C chars:
+//   {
+//     "state": <"stopped", "establishing", "connected", "degraded", or "stopping">,
+//     "active_tunnels": <active_tunnel_count>,
+//     "tunnel_regions": [<server_region_of_each_active_tunnel>],
+//     "egress_region": <selected_egress_region>,
+//     "last_error": <most_recent_tunnel_error>,
+//     "uptime_seconds": <time_since_start>,
+//     "bytes_sent": <total_tunneled_bytes_sent>,
+//     "bytes_received": <total_tunneled_bytes_received>,
+//     "http_proxy_port": <http_proxy_port_num>,
+//     "socks_proxy_port": <socks_proxy_port_num>
+//   }
+//
+// When Psiphon is not running, only "state" is meaningful.
+func GetStatus() *C.char {
+
+	result := statusResult{State: psiphon.CONTROLLER_STATE_STOPPED}
+
+	tunnel.mutex.Lock()
+	controller := tunnel.controller
+	result.HttpProxyPort = tunnel.httpProxyPort
+	result.SocksProxyPort = tunnel.socksProxyPort
+	tunnel.mutex.Unlock()
+
+	if controller != nil {
+		status := controller.Status()
+		result.State = status.State
+		result.ActiveTunnels = status.ActiveTunnels
+		result.TunnelRegions = status.TunnelRegions
+		result.EgressRegion = status.EgressRegion
+		result.LastError = status.LastError
+		result.UptimeSeconds = status.Uptime.Seconds()
+		result.BytesSent = status.BytesSent
+		result.BytesReceived = status.BytesReceived
+	}
+
+	freeManagedString(&managedStatusResult)
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		managedStatusResult = C.CString(fmt.Sprintf("{\"state\":\"%s\"}", psiphon.CONTROLLER_STATE_STOPPED))
+	} else {
+		managedStatusResult = C.CString(string(resultJSON))
+	}
+
+	return managedStatusResult
+}
+
+//export SetEgressRegion
+// SetEgressRegion changes the egress region, a two letter country code, or
+// "" for the best performing region. Only those active tunnels that don't
+// match the new region are replaced. SetEgressRegion has no effect when
+// Psiphon is not running; to select a region at startup, set EgressRegion in
+// the config passed to Start.
+func SetEgressRegion(region string) {
+
+	tunnel.mutex.Lock()
+	controller := tunnel.controller
+	tunnel.mutex.Unlock()
+
+	if controller != nil {
+		// Ensure region is on the Go heap
+		controller.SetEgressRegion(deepCopy(region))
+	}
+}
+
+//export ReconnectTunnel
+// ReconnectTunnel initiates a reconnect of the current tunnel, for example
+// after the host network changes. ReconnectTunnel returns immediately and
+// has no effect when Psiphon is not running.
+func ReconnectTunnel() {
+
+	tunnel.mutex.Lock()
+	controller := tunnel.controller
+	tunnel.mutex.Unlock()
+
+	if controller != nil {
+		controller.TerminateNextActiveTunnel()
+	}
+}
+
+//export SendFeedback
+//
+// ******************************* WARNING ********************************
+// The underlying memory referenced by the return value of SendFeedback is
+// managed by PsiphonTunnel and attempting to free it explicitly will cause
+// the program to crash. This memory is freed in the next call to
+// SendFeedback or once Stop is called.
+// ************************************************************************
+//
+// SendFeedback uploads a diagnostic feedback package, including the user's
+// comment, through the running tunnel, or untunneled when no tunnel is
+// active. The config passed to Start must include FeedbackUploadURLs and
+// FeedbackEncryptionPublicKey. SendFeedback blocks until the upload
+// succeeds, fails, or timeout seconds elapse, and must be called between
+// Start and Stop.
+//
+// SendFeedback returns a result serialized as a JSON string in the form of a
+// null-terminated buffer of C chars:
+//   On success:
+//   {
+//     "result_code": 0
+//   }
+//
+//   On error:
+//   {
+//     "result_code": 1,
+//     "error": <error message>
+//   }
+func SendFeedback(comment string, timeout int64) *C.char {
+
+	// Ensure comment is on the Go heap
+	comment = deepCopy(comment)
+
+	tunnel.mutex.Lock()
+	controller := tunnel.controller
+	tunnel.mutex.Unlock()
+
+	var result feedbackResult
+
+	if controller == nil {
+		result.Code = feedbackResultCodeError
+		result.ErrorString = "Psiphon is not running"
+	} else {
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(), time.Duration(timeout)*time.Second)
+		err := controller.SendFeedback(ctx, comment)
+		cancelFunc()
+		if err != nil {
+			result.Code = feedbackResultCodeError
+			result.ErrorString = err.Error()
+		}
+	}
+
+	freeManagedString(&managedFeedbackResult)
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		managedFeedbackResult = C.CString(fmt.Sprintf("{\"result_code\":%d, \"error\": \"%s\"}", feedbackResultCodeError, err.Error()))
+	} else {
+		managedFeedbackResult = C.CString(string(resultJSON))
+	}
+
+	return managedFeedbackResult
+}
+
 // secondsBeforeNow returns the delta seconds of the current time subtract startTime.
 func secondsBeforeNow(startTime time.Time) float64 {
 	delta := time.Now().Sub(startTime)
@@ -325,12 +574,17 @@ func deepCopy(s string) string {
 
 // freeManagedStartResult frees the memory on the heap pointed to by managedStartResult.
 func freeManagedStartResult() {
-	if managedStartResult != nil {
-		managedMemory := unsafe.Pointer(managedStartResult)
+	freeManagedString(&managedStartResult)
+}
+
+// freeManagedString frees the memory on the heap pointed to by managedString.
+func freeManagedString(managedString **C.char) {
+	if *managedString != nil {
+		managedMemory := unsafe.Pointer(*managedString)
 		if managedMemory != nil {
 			C.free(managedMemory)
 		}
-		managedStartResult = nil
+		*managedString = nil
 	}
 }
 
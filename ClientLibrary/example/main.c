@@ -25,6 +25,12 @@ char *read_file(char *filename) {
     return buffer;
 }
 
+// notice_callback is called with each notice. The notice memory is freed
+// once the callback returns.
+void notice_callback(char *notice_json) {
+    printf("Notice: %s\n", notice_json);
+}
+
 int main(int argc, char *argv[]) {
     
     // load config
@@ -64,6 +70,9 @@ int main(int argc, char *argv[]) {
     // set timout
     long long timeout = 60;
 
+    // receive notices
+    SetNoticeCallback(notice_callback);
+
     // connect 5 times
     for (int i = 0; i < 5; i++) {
         // start will return once Psiphon connects or does not connect for timeout seconds
@@ -72,6 +81,10 @@ int main(int argc, char *argv[]) {
         // print results
         printf("Result: %s\n", result);
 
+        // The underlying memory of `status` is managed by PsiphonTunnel
+        char *status = GetStatus();
+        printf("Status: %s\n", status);
+
         // The underlying memory of `result` is managed by PsiphonTunnel and is freed in Stop
         Stop();
     }
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+// controllerRunner runs the controller, and implements psiphon.ControlHost
+// so that tunneling may also be stopped and started through the control
+// API while the process keeps running.
+type controllerRunner struct {
+	shutdownTimeout  time.Duration
+	systemStopSignal chan os.Signal
+
+	// stoppedByController is signaled when Run returns without a stop
+	// request, such as when the local proxies fail to start.
+	stoppedByController chan struct{}
+
+	// lifecycleMutex serializes start and stop, so that a new controller
+	// isn't started while the previous controller is still stopping.
+	lifecycleMutex sync.Mutex
+
+	mutex          sync.Mutex
+	config         *psiphon.Config
+	controller     *psiphon.Controller
+	stopController context.CancelFunc
+	runWaitGroup   *sync.WaitGroup
+}
+
+func newControllerRunner(
+	config *psiphon.Config,
+	shutdownTimeout time.Duration,
+	systemStopSignal chan os.Signal) *controllerRunner {
+
+	return &controllerRunner{
+		shutdownTimeout:     shutdownTimeout,
+		systemStopSignal:    systemStopSignal,
+		stoppedByController: make(chan struct{}, 1),
+		config:              config,
+	}
+}
+
+func (runner *controllerRunner) StartTunneling() error {
+
+	runner.lifecycleMutex.Lock()
+	defer runner.lifecycleMutex.Unlock()
+
+	return runner.startTunneling()
+}
+
+func (runner *controllerRunner) startTunneling() error {
+
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	if runner.controller != nil {
+		return nil
+	}
+
+	controller, err := psiphon.NewController(runner.config)
+	if err != nil {
+		return err
+	}
+
+	controllerCtx, stopController := context.WithCancel(context.Background())
+
+	runWaitGroup := new(sync.WaitGroup)
+	runWaitGroup.Add(1)
+	go func() {
+		defer runWaitGroup.Done()
+		controller.Run(controllerCtx)
+		stopController()
+
+		// When the controller is still current, no stop was requested.
+		runner.mutex.Lock()
+		stoppedByController := runner.controller == controller
+		if stoppedByController {
+			runner.controller = nil
+			runner.stopController = nil
+			runner.runWaitGroup = nil
+		}
+		runner.mutex.Unlock()
+
+		if stoppedByController {
+			select {
+			case runner.stoppedByController <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	runner.controller = controller
+	runner.stopController = stopController
+	runner.runWaitGroup = runWaitGroup
+
+	return nil
+}
+
+func (runner *controllerRunner) StopTunneling() error {
+
+	runner.lifecycleMutex.Lock()
+	defer runner.lifecycleMutex.Unlock()
+
+	runner.stopTunneling()
+	return nil
+}
+
+func (runner *controllerRunner) stopTunneling() {
+
+	runner.mutex.Lock()
+	controller := runner.controller
+	stopController := runner.stopController
+	runWaitGroup := runner.runWaitGroup
+	runner.controller = nil
+	runner.stopController = nil
+	runner.runWaitGroup = nil
+	runner.mutex.Unlock()
+
+	if controller == nil {
+		return
+	}
+
+	if runner.shutdownTimeout > 0 {
+		// Stop accepting new connections and wait for in-flight
+		// connections before closing tunnels. A second signal skips the
+		// wait.
+		shutdownCtx, cancelShutdown := context.WithTimeout(
+			context.Background(), runner.shutdownTimeout)
+		go func() {
+			select {
+			case <-runner.systemStopSignal:
+				cancelShutdown()
+			case <-shutdownCtx.Done():
+			}
+		}()
+		err := controller.Shutdown(shutdownCtx)
+		cancelShutdown()
+		if err != nil {
+			psiphon.NoticeAlert("graceful shutdown incomplete: %s", err)
+		}
+	}
+
+	stopController()
+	runWaitGroup.Wait()
+}
+
+// restartTunneling replaces the config. When tunneling is running, it's
+// restarted with the new config.
+func (runner *controllerRunner) restartTunneling(config *psiphon.Config) error {
+
+	runner.lifecycleMutex.Lock()
+	defer runner.lifecycleMutex.Unlock()
+
+	runner.mutex.Lock()
+	isRunning := runner.controller != nil
+	runner.config = config
+	runner.mutex.Unlock()
+
+	if !isRunning {
+		return nil
+	}
+
+	runner.stopTunneling()
+	return runner.startTunneling()
+}
+
+func (runner *controllerRunner) GetController() *psiphon.Controller {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	return runner.controller
+}
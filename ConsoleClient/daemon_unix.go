@@ -0,0 +1,94 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// daemonProcessEnvironmentVariable marks the detached child process started
+// by daemonize, so that the child doesn't itself daemonize.
+const daemonProcessEnvironmentVariable = "PSIPHON_CONSOLE_CLIENT_DAEMON"
+
+func daemonSupported() bool {
+	return true
+}
+
+func isDaemonProcess() bool {
+	return os.Getenv(daemonProcessEnvironmentVariable) == "1"
+}
+
+// daemonize starts a copy of this process, with the same command line
+// arguments, in a new session detached from the controlling terminal. The
+// child's standard input and output are redirected to the null device, so
+// notices should be directed to a file using -notices or -rotating. The
+// caller, the original process, is expected to exit once daemonize returns.
+func daemonize() error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonProcessEnvironmentVariable+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("started daemon process %d\n", cmd.Process.Pid)
+
+	return cmd.Process.Release()
+}
+
+// notifyDaemonSignals relays SIGTERM to stop, SIGHUP to reload, and SIGUSR1
+// to rotate.
+func notifyDaemonSignals(stop, reload, rotate chan<- os.Signal) {
+	signal.Notify(stop, syscall.SIGTERM)
+	signal.Notify(reload, syscall.SIGHUP)
+	signal.Notify(rotate, syscall.SIGUSR1)
+}
+
+func serviceSupported() bool {
+	return false
+}
+
+func startService(_ string) (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("operation is not supported")
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func daemonSupported() bool {
+	return false
+}
+
+func isDaemonProcess() bool {
+	return false
+}
+
+func daemonize() error {
+	return errors.New("operation is not supported")
+}
+
+// notifyDaemonSignals is a noop on Windows, where there are no reload or
+// rotate signals. Run as a service with -service to be stopped by the
+// service control manager.
+func notifyDaemonSignals(_, _, _ chan<- os.Signal) {
+}
+
+func serviceSupported() bool {
+	return true
+}
+
+var procRegisterServiceCtrlHandlerExW = windows.NewLazySystemDLL(
+	"advapi32.dll").NewProc("RegisterServiceCtrlHandlerExW")
+
+// startService connects this process to the Windows service control manager
+// as the named service, which must be registered with the SERVICE_WIN32_OWN_PROCESS
+// type. startService must be called soon after the process starts, as the
+// service control manager waits only a limited time for the connection.
+//
+// The returned channel is closed when the service control manager requests
+// that the service stop. The returned function must be called once the
+// process is ready to exit; it reports that the service has stopped.
+func startService(serviceName string) (<-chan struct{}, func(), error) {
+
+	name, err := syscall.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stopRequested := make(chan struct{})
+	stopOnce := new(sync.Once)
+	serviceStopped := make(chan struct{})
+	dispatcherResult := make(chan error, 2)
+
+	var statusHandle windows.Handle
+	var statusMutex sync.Mutex
+	status := windows.SERVICE_STATUS{
+		ServiceType: windows.SERVICE_WIN32_OWN_PROCESS,
+	}
+
+	setStatus := func(state, controlsAccepted uint32) {
+		statusMutex.Lock()
+		defer statusMutex.Unlock()
+		status.CurrentState = state
+		status.ControlsAccepted = controlsAccepted
+		_ = windows.SetServiceStatus(statusHandle, &status)
+	}
+
+	// The callbacks are invoked on threads created by the service control
+	// dispatcher.
+
+	handler := syscall.NewCallback(
+		func(control, _, _, _ uintptr) uintptr {
+			switch control {
+			case windows.SERVICE_CONTROL_STOP, windows.SERVICE_CONTROL_SHUTDOWN:
+				setStatus(windows.SERVICE_STOP_PENDING, 0)
+				stopOnce.Do(func() { close(stopRequested) })
+			case windows.SERVICE_CONTROL_INTERROGATE:
+				statusMutex.Lock()
+				_ = windows.SetServiceStatus(statusHandle, &status)
+				statusMutex.Unlock()
+			}
+			return uintptr(windows.NO_ERROR)
+		})
+
+	serviceMain := syscall.NewCallback(
+		func(_, _ uintptr) uintptr {
+			handle, _, err := procRegisterServiceCtrlHandlerExW.Call(
+				uintptr(unsafe.Pointer(name)), handler, 0)
+			if handle == 0 {
+				dispatcherResult <- err
+				return 0
+			}
+			statusMutex.Lock()
+			statusHandle = windows.Handle(handle)
+			statusMutex.Unlock()
+
+			setStatus(
+				windows.SERVICE_RUNNING,
+				windows.SERVICE_ACCEPT_STOP|windows.SERVICE_ACCEPT_SHUTDOWN)
+			dispatcherResult <- nil
+
+			<-serviceStopped
+			setStatus(windows.SERVICE_STOPPED, 0)
+			return 0
+		})
+
+	dispatcherDone := make(chan struct{})
+	go func() {
+		defer close(dispatcherDone)
+
+		// StartServiceCtrlDispatcher blocks until the service stops.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		serviceTable := []windows.SERVICE_TABLE_ENTRY{
+			{ServiceName: name, ServiceProc: serviceMain},
+			{ServiceName: nil, ServiceProc: 0},
+		}
+		err := windows.StartServiceCtrlDispatcher(&serviceTable[0])
+		if err != nil {
+			dispatcherResult <- err
+		}
+	}()
+
+	err = <-dispatcherResult
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reportStopped := func() {
+		close(serviceStopped)
+		<-dispatcherDone
+	}
+
+	return stopRequested, reportStopped, nil
+}
@@ -21,16 +21,17 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -48,6 +49,9 @@ func main() {
 	var embeddedServerEntryListFilename string
 	flag.StringVar(&embeddedServerEntryListFilename, "serverList", "", "embedded server entry list input file")
 
+	var bridgeLinesFilename string
+	flag.StringVar(&bridgeLinesFilename, "bridgeLines", "", "import server entries from Tor-style bridge lines input file")
+
 	var formatNotices bool
 	flag.BoolVar(&formatNotices, "formatNotices", false, "emit notices in human-readable format")
 
@@ -59,13 +63,16 @@ func main() {
 	flag.BoolVar(&versionDetails, "v", false, "print build information and exit")
 
 	var tunDevice, tunBindInterface, tunPrimaryDNS, tunSecondaryDNS string
+	var tunConfigure bool
 	if tun.IsSupported() {
 
 		// When tunDevice is specified, a packet tunnel is run and packets are relayed between
 		// the specified tun device and the server.
 		//
-		// The tun device is expected to exist and should be configured with an IP address and
-		// routing.
+		// The tun device is created if it doesn't exist. When tunConfigure is set, the tun
+		// device is configured with an IP address, MTU, and routing, using the PacketTunnel
+		// config file parameters; otherwise the tun device is expected to be configured with
+		// an IP address and routing.
 		//
 		// The tunBindInterface/tunPrimaryDNS/tunSecondaryDNS parameters are used to bypass any
 		// tun device routing when connecting to Psiphon servers.
@@ -76,6 +83,7 @@ func main() {
 		// Packet tunnel mode is supported only on certains platforms.
 
 		flag.StringVar(&tunDevice, "tunDevice", "", "run packet tunnel for specified tun device")
+		flag.BoolVar(&tunConfigure, "tunConfigure", false, "configure tun device addresses and routing")
 		flag.StringVar(&tunBindInterface, "tunBindInterface", tun.DEFAULT_PUBLIC_INTERFACE_NAME, "bypass tun device via specified interface")
 		flag.StringVar(&tunPrimaryDNS, "tunPrimaryDNS", "8.8.8.8", "primary DNS resolver for bypass")
 		flag.StringVar(&tunSecondaryDNS, "tunSecondaryDNS", "8.8.4.4", "secondary DNS resolver for bypass")
@@ -96,6 +104,60 @@ func main() {
 	var rotatingSyncFrequency int
 	flag.IntVar(&rotatingSyncFrequency, "rotatingSyncFrequency", 100, "rotating notices file sync frequency")
 
+	var rotatingMaxFiles int
+	flag.IntVar(&rotatingMaxFiles, "rotatingMaxFiles", 1, "number of older rotated notices files to retain")
+
+	var rotatingMaxAgeSeconds int
+	flag.IntVar(&rotatingMaxAgeSeconds, "rotatingMaxAge", 0, "seconds after which older rotated notices files are deleted (0 for no limit)")
+
+	var rotatingCompress bool
+	flag.BoolVar(&rotatingCompress, "rotatingCompress", false, "gzip compress older rotated notices files")
+
+	var shutdownTimeoutSeconds int
+	flag.IntVar(&shutdownTimeoutSeconds, "shutdownTimeout", 0, "seconds to wait for in-flight connections on shutdown")
+
+	// When socketActivation is set, the local proxies use listeners passed in
+	// by systemd or launchd, named "socks" and "http", in place of binding
+	// their own ports.
+
+	var socketActivation bool
+	flag.BoolVar(&socketActivation, "socketActivation", false, "use local proxy listeners passed in by systemd or launchd")
+
+	// When controlSocketFilename is specified, a local control API is served
+	// on a unix domain socket at that path. See psiphon.ControlServer.
+
+	var controlSocketFilename string
+	flag.StringVar(&controlSocketFilename, "controlSocket", "", "serve control API on specified unix socket")
+
+	// When selfUpdate is set, downloaded client upgrades are authenticated and
+	// installed in place of this executable, which is then restarted. See
+	// selfUpdater.
+
+	var selfUpdate bool
+	flag.BoolVar(&selfUpdate, "selfUpdate", false, "install downloaded upgrades and restart")
+
+	var pidFilename string
+	flag.StringVar(&pidFilename, "pidFile", "", "process ID output file")
+
+	// When runDaemon is set, the client detaches from the terminal and runs in
+	// the background. While running, SIGHUP reloads the configuration file and
+	// restarts tunneling, and SIGUSR1 rotates the notices files.
+	//
+	// When serviceName is specified, the client runs as the named Windows
+	// service, and stops when requested by the service control manager.
+	//
+	// In both modes, notices should be directed to files.
+
+	var runDaemon bool
+	if daemonSupported() {
+		flag.BoolVar(&runDaemon, "daemon", false, "run in the background")
+	}
+
+	var serviceName string
+	if serviceSupported() {
+		flag.StringVar(&serviceName, "service", "", "run as the specified Windows service")
+	}
+
 	flag.Parse()
 
 	if versionDetails {
@@ -129,26 +191,65 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Initialize notice output
-
-	var noticeWriter io.Writer
-	noticeWriter = os.Stderr
+	if selfUpdate && serviceName != "" {
+		fmt.Printf("self-update is not supported in service mode\n")
+		os.Exit(1)
+	}
 
-	if noticeFilename != "" {
-		noticeFile, err := os.OpenFile(noticeFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if runDaemon && !isDaemonProcess() {
+		err := daemonize()
 		if err != nil {
-			fmt.Printf("error opening notice file: %s\n", err)
+			fmt.Printf("error starting daemon: %s\n", err)
 			os.Exit(1)
 		}
-		defer noticeFile.Close()
-		noticeWriter = noticeFile
+		os.Exit(0)
 	}
 
-	if formatNotices {
-		noticeWriter = psiphon.NewNoticeConsoleRewriter(noticeWriter)
+	// Initialize notice output
+
+	// openNoticeFile is also used to reopen the notice file after it's
+	// rotated by an external tool, such as logrotate.
+
+	var noticeFile *os.File
+	openNoticeFile := func() error {
+		var noticeWriter io.Writer
+		noticeWriter = os.Stderr
+
+		var newNoticeFile *os.File
+		if noticeFilename != "" {
+			var err error
+			newNoticeFile, err = os.OpenFile(noticeFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			noticeWriter = newNoticeFile
+		}
+
+		if formatNotices {
+			noticeWriter = psiphon.NewNoticeConsoleRewriter(noticeWriter)
+		}
+		psiphon.SetNoticeWriter(noticeWriter)
+
+		if noticeFile != nil {
+			noticeFile.Close()
+		}
+		noticeFile = newNoticeFile
+
+		return nil
 	}
-	psiphon.SetNoticeWriter(noticeWriter)
-	err := psiphon.SetNoticeFiles(
+
+	err := openNoticeFile()
+	if err != nil {
+		fmt.Printf("error opening notice file: %s\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if noticeFile != nil {
+			noticeFile.Close()
+		}
+	}()
+
+	err = psiphon.SetNoticeFiles(
 		homepageFilename,
 		rotatingFilename,
 		rotatingFileSize,
@@ -158,6 +259,67 @@ func main() {
 		os.Exit(1)
 	}
 
+	psiphon.SetNoticeFileRotation(
+		rotatingMaxFiles,
+		time.Duration(rotatingMaxAgeSeconds)*time.Second,
+		rotatingCompress)
+
+	// restartForUpgrade and rollbackForUpgrade are deferred first so that
+	// they run last, after all other cleanup, as the restarted process
+	// replaces this process.
+
+	var updater *selfUpdater
+	restartForUpgrade := false
+	rollbackForUpgrade := false
+	defer func() {
+		if rollbackForUpgrade {
+			rollbackSelfUpdate()
+			os.Exit(1)
+		}
+		if restartForUpgrade {
+			psiphon.NoticeInfo("restarting with installed upgrade")
+			err := updater.restart()
+			if err != nil {
+				psiphon.NoticeError("error restarting with installed upgrade: %s", err)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	if selfUpdate {
+		updater, err = newSelfUpdater()
+		if err != nil {
+			psiphon.SetEmitDiagnosticNotices(true)
+			psiphon.NoticeError("error initializing self-update: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	// Connect to the service control manager before any potentially slow
+	// initialization.
+
+	var serviceStopRequested <-chan struct{}
+	if serviceName != "" {
+		var reportServiceStopped func()
+		serviceStopRequested, reportServiceStopped, err = startService(serviceName)
+		if err != nil {
+			psiphon.SetEmitDiagnosticNotices(true)
+			psiphon.NoticeError("error starting service: %s", err)
+			os.Exit(1)
+		}
+		defer reportServiceStopped()
+	}
+
+	if pidFilename != "" {
+		err = ioutil.WriteFile(pidFilename, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+		if err != nil {
+			psiphon.SetEmitDiagnosticNotices(true)
+			psiphon.NoticeError("error writing pid file: %s", err)
+			os.Exit(1)
+		}
+		defer os.Remove(pidFilename)
+	}
+
 	// Handle required config file parameter
 
 	// EmitDiagnosticNotices is set by LoadConfig; force to true
@@ -168,42 +330,70 @@ func main() {
 		psiphon.NoticeError("configuration file is required")
 		os.Exit(1)
 	}
-	configFileContents, err := ioutil.ReadFile(configFilename)
-	if err != nil {
-		psiphon.SetEmitDiagnosticNotices(true)
-		psiphon.NoticeError("error loading configuration file: %s", err)
-		os.Exit(1)
-	}
-	config, err := psiphon.LoadConfig(configFileContents)
-	if err != nil {
-		psiphon.SetEmitDiagnosticNotices(true)
-		psiphon.NoticeError("error processing configuration file: %s", err)
-		os.Exit(1)
-	}
 
-	if interfaceName != "" {
-		config.ListenInterface = interfaceName
-	}
+	// Activated listeners are retained across config reloads.
 
-	// Configure packet tunnel, including updating the config.
-
-	if tun.IsSupported() && tunDevice != "" {
-		tunDeviceFile, err := configurePacketTunnel(
-			config, tunDevice, tunBindInterface, tunPrimaryDNS, tunSecondaryDNS)
+	var activatedListeners map[string]net.Listener
+	if socketActivation {
+		activatedListeners, err = psiphon.GetActivatedListeners()
 		if err != nil {
 			psiphon.SetEmitDiagnosticNotices(true)
-			psiphon.NoticeError("error configuring packet tunnel: %s", err)
+			psiphon.NoticeError("error getting activated listeners: %s", err)
 			os.Exit(1)
 		}
-		defer tunDeviceFile.Close()
 	}
 
-	// All config fields should be set before calling Commit.
+	// loadConfig is also used to reload the config file on SIGHUP.
+
+	loadConfig := func() (*psiphon.Config, error) {
+
+		configFileContents, err := ioutil.ReadFile(configFilename)
+		if err != nil {
+			return nil, fmt.Errorf("error loading configuration file: %s", err)
+		}
+		config, err := psiphon.LoadConfig(configFileContents)
+		if err != nil {
+			return nil, fmt.Errorf("error processing configuration file: %s", err)
+		}
+
+		if interfaceName != "" {
+			config.ListenInterface = interfaceName
+		}
+
+		config.LocalSocksProxyListener = activatedListeners[psiphon.SOCKET_ACTIVATION_SOCKS_PROXY_NAME]
+		config.LocalHttpProxyListener = activatedListeners[psiphon.SOCKET_ACTIVATION_HTTP_PROXY_NAME]
+
+		// Configure packet tunnel, including updating the config.
+
+		if tun.IsSupported() && tunDevice != "" {
+			config.PacketTunnelTunDeviceName = tunDevice
+			config.PacketTunnelConfigureTunDevice = tunConfigure
+			config.PacketTunnelBypassInterfaceName = tunBindInterface
+			config.PacketTunnelBypassDNSServers = []string{tunPrimaryDNS, tunSecondaryDNS}
+		}
+
+		if updater != nil {
+			err = updater.configure(config)
+			if err != nil {
+				return nil, fmt.Errorf("error configuring self-update: %s", err)
+			}
+		}
+
+		// All config fields should be set before calling Commit.
 
-	err = config.Commit()
+		err = config.Commit()
+		if err != nil {
+			return nil, fmt.Errorf("error loading configuration file: %s", err)
+		}
+
+		return config, nil
+	}
+
+	config, err := loadConfig()
 	if err != nil {
 		psiphon.SetEmitDiagnosticNotices(true)
-		psiphon.NoticeError("error loading configuration file: %s", err)
+		psiphon.NoticeError("%s", err)
+		rollbackSelfUpdate()
 		os.Exit(1)
 	}
 
@@ -265,82 +455,122 @@ func main() {
 		}
 	}
 
+	// Handle optional bridge lines file parameter. Unlike the embedded server
+	// list, bridge lines are imported before starting the controller, as
+	// these are typically the operator's only configured servers.
+	if bridgeLinesFilename != "" {
+		bridgeLines, err := ioutil.ReadFile(bridgeLinesFilename)
+		if err != nil {
+			psiphon.NoticeError("error loading bridge lines file: %s", err)
+		} else {
+			_, err = psiphon.ImportBridgeLines(config, string(bridgeLines))
+			if err != nil {
+				psiphon.NoticeError("error importing bridge lines: %s", err)
+			}
+		}
+	}
+
 	// Run Psiphon
 
-	controller, err := psiphon.NewController(config)
-	if err != nil {
-		psiphon.NoticeError("error creating controller: %s", err)
-		os.Exit(1)
-	}
+	systemStopSignal := make(chan os.Signal, 1)
+	signal.Notify(systemStopSignal, os.Interrupt, os.Kill)
 
-	controllerCtx, stopController := context.WithCancel(context.Background())
-	defer stopController()
+	reloadSignal := make(chan os.Signal, 1)
+	rotateSignal := make(chan os.Signal, 1)
+	notifyDaemonSignals(systemStopSignal, reloadSignal, rotateSignal)
 
-	controllerWaitGroup := new(sync.WaitGroup)
-	controllerWaitGroup.Add(1)
 	go func() {
-		defer controllerWaitGroup.Done()
-		controller.Run(controllerCtx)
-
-		// Signal the <-controllerCtx.Done() case below. If the <-systemStopSignal
-		// case already called stopController, this is a noop.
-		stopController()
+		for range rotateSignal {
+			psiphon.NoticeInfo("rotating notice files")
+			err := openNoticeFile()
+			if err != nil {
+				psiphon.NoticeError("error reopening notice file: %s", err)
+			}
+			err = psiphon.RotateNoticeFiles()
+			if err != nil {
+				psiphon.NoticeError("error rotating notice files: %s", err)
+			}
+		}
 	}()
 
-	systemStopSignal := make(chan os.Signal, 1)
-	signal.Notify(systemStopSignal, os.Interrupt, os.Kill)
+	runner := newControllerRunner(
+		config,
+		time.Duration(shutdownTimeoutSeconds)*time.Second,
+		systemStopSignal)
 
-	// Wait for an OS signal or a Run stop signal, then stop Psiphon and exit
-
-	select {
-	case <-systemStopSignal:
-		psiphon.NoticeInfo("shutdown by system")
-		stopController()
-		controllerWaitGroup.Wait()
-	case <-controllerCtx.Done():
-		psiphon.NoticeInfo("shutdown by controller")
+	upgradeDownloaded := make(chan struct{}, 1)
+	if updater != nil {
+		stopWatching := updater.watchUpgradeDownloaded(upgradeDownloaded)
+		defer stopWatching()
 	}
-}
 
-func configurePacketTunnel(
-	config *psiphon.Config,
-	tunDevice, tunBindInterface, tunPrimaryDNS, tunSecondaryDNS string) (*os.File, error) {
+	// When started by a self-update, the self-update is confirmed once a
+	// tunnel is established, and rolled back if none is established in time.
+	selfUpdateFailed := make(chan struct{}, 1)
+	stopWatchingSelfUpdate := watchSelfUpdateConfirmation(selfUpdateFailed)
+	defer stopWatchingSelfUpdate()
 
-	file, _, err := tun.OpenTunDevice(tunDevice)
+	err = runner.StartTunneling()
 	if err != nil {
-		return nil, common.ContextError(err)
+		psiphon.NoticeError("error creating controller: %s", err)
+		rollbackSelfUpdate()
+		os.Exit(1)
 	}
 
-	provider := &tunProvider{
-		bindInterface: tunBindInterface,
-		primaryDNS:    tunPrimaryDNS,
-		secondaryDNS:  tunSecondaryDNS,
+	if controlSocketFilename != "" {
+		listener, err := psiphon.ListenControlSocket(controlSocketFilename)
+		if err != nil {
+			psiphon.NoticeError("error listening on control socket: %s", err)
+			os.Exit(1)
+		}
+		controlServer := psiphon.NewControlServer(runner, listener)
+		defer controlServer.Close()
 	}
 
-	config.PacketTunnelTunFileDescriptor = int(file.Fd())
-	config.DeviceBinder = provider
-	config.DnsServerGetter = provider
-
-	return file, nil
-}
-
-type tunProvider struct {
-	bindInterface string
-	primaryDNS    string
-	secondaryDNS  string
-}
-
-// BindToDevice implements the psiphon.DeviceBinder interface.
-func (p *tunProvider) BindToDevice(fileDescriptor int) (string, error) {
-	return p.bindInterface, tun.BindToDevice(fileDescriptor, p.bindInterface)
-}
-
-// GetPrimaryDnsServer implements the psiphon.DnsServerGetter interface.
-func (p *tunProvider) GetPrimaryDnsServer() string {
-	return p.primaryDNS
-}
+	// Wait for an OS signal or a Run stop signal, then stop Psiphon and exit
 
-// GetSecondaryDnsServer implements the psiphon.DnsServerGetter interface.
-func (p *tunProvider) GetSecondaryDnsServer() string {
-	return p.secondaryDNS
+	for {
+		select {
+		case <-systemStopSignal:
+			psiphon.NoticeInfo("shutdown by system")
+			runner.StopTunneling()
+			return
+		case <-serviceStopRequested:
+			psiphon.NoticeInfo("shutdown by service control manager")
+			runner.StopTunneling()
+			return
+		case <-reloadSignal:
+			newConfig, err := loadConfig()
+			if err != nil {
+				// Keep running with the current config.
+				psiphon.NoticeError("error reloading configuration: %s", err)
+				continue
+			}
+			psiphon.NoticeInfo("restarting with reloaded configuration")
+			err = runner.restartTunneling(newConfig)
+			if err != nil {
+				psiphon.NoticeError("error creating controller: %s", err)
+				os.Exit(1)
+			}
+		case <-upgradeDownloaded:
+			err := updater.install()
+			if err != nil {
+				// Keep running the current executable.
+				psiphon.NoticeError("error installing upgrade: %s", err)
+				continue
+			}
+			psiphon.NoticeInfo("shutdown to restart with installed upgrade")
+			runner.StopTunneling()
+			restartForUpgrade = true
+			return
+		case <-selfUpdateFailed:
+			psiphon.NoticeError("self-update failed to establish a tunnel")
+			runner.StopTunneling()
+			rollbackForUpgrade = true
+			return
+		case <-runner.stoppedByController:
+			psiphon.NoticeInfo("shutdown by controller")
+			return
+		}
+	}
 }
@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+// selfUpdateBackupEnvironmentVariable is set, to the filename of the backup
+// of the previous executable, in the process started after a self-update,
+// so that the process may roll back when it fails to start.
+const selfUpdateBackupEnvironmentVariable = "PSIPHON_CONSOLE_CLIENT_SELF_UPDATE_BACKUP"
+
+const selfUpdateCheckTimeout = 30 * time.Second
+
+// selfUpdateConfirmTimeout is how long the executable started by a
+// self-update has to establish a tunnel before the self-update is rolled
+// back.
+const selfUpdateConfirmTimeout = 5 * time.Minute
+
+// selfUpdater installs downloaded client upgrades in place of the running
+// executable.
+//
+// Upgrades are authenticated: self-update requires
+// UpgradeDownloadSignaturePublicKey, so that the upgrade is verified against
+// a signed manifest as it's downloaded, and DownloadUpgrade only emits
+// ClientUpgradeDownloaded for a complete, verified upgrade.
+//
+// The previous executable is retained, as <executable>.old, until the new
+// executable establishes its first tunnel. When the new executable fails to
+// load its config or start tunneling, or doesn't establish a tunnel within
+// selfUpdateConfirmTimeout, the previous executable is restored and
+// restarted, and the failed upgrade is retained as <executable>.failed so
+// that the same upgrade isn't installed again.
+type selfUpdater struct {
+	executable      string
+	upgradeFilename string
+}
+
+func newSelfUpdater() (*selfUpdater, error) {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return nil, err
+	}
+
+	return &selfUpdater{executable: executable}, nil
+}
+
+// configure checks that config supports self-update and sets the running
+// executable as the upgrade patch base, when no other base is configured.
+// configure must be called before config.Commit.
+func (updater *selfUpdater) configure(config *psiphon.Config) error {
+
+	if config.UpgradeDownloadSignaturePublicKey == "" {
+		return errors.New("self-update requires UpgradeDownloadSignaturePublicKey")
+	}
+
+	if config.UpgradeDownloadFilename == "" {
+		return errors.New("self-update requires UpgradeDownloadFilename")
+	}
+
+	if config.UpgradeDownloadPatchBaseFilename == "" {
+		config.UpgradeDownloadPatchBaseFilename = updater.executable
+	}
+
+	updater.upgradeFilename = config.UpgradeDownloadFilename
+
+	return nil
+}
+
+// watchUpgradeDownloaded signals upgradeDownloaded when a
+// ClientUpgradeDownloaded notice is emitted. The returned function stops
+// watching.
+func (updater *selfUpdater) watchUpgradeDownloaded(
+	upgradeDownloaded chan<- struct{}) func() {
+
+	notices, unsubscribe := psiphon.SubscribeNotices()
+
+	go func() {
+		for notice := range notices {
+			noticeType, _, err := psiphon.GetNotice(notice)
+			if err != nil || noticeType != "ClientUpgradeDownloaded" {
+				continue
+			}
+			select {
+			case upgradeDownloaded <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return unsubscribe
+}
+
+// install replaces the running executable with the downloaded upgrade. The
+// upgrade is first checked by running it with -version. When install
+// returns nil, the caller should shut down and call restart.
+func (updater *selfUpdater) install() error {
+
+	failedFilename := updater.executable + ".failed"
+	backupFilename := updater.executable + ".old"
+	newFilename := updater.executable + ".new"
+
+	if previousDigest, err := fileDigest(failedFilename); err == nil {
+		digest, err := fileDigest(updater.upgradeFilename)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(digest, previousDigest) {
+			return errors.New("upgrade previously failed to start")
+		}
+	}
+
+	fileInfo, err := os.Stat(updater.executable)
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(updater.upgradeFilename, newFilename, fileInfo.Mode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newFilename)
+
+	err = checkExecutable(newFilename)
+	if err != nil {
+		return fmt.Errorf("upgrade check failed: %s", err)
+	}
+
+	// The running executable is renamed, rather than overwritten, which is
+	// permitted on Windows.
+
+	os.Remove(backupFilename)
+
+	err = os.Rename(updater.executable, backupFilename)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(newFilename, updater.executable)
+	if err != nil {
+		os.Rename(backupFilename, updater.executable)
+		return err
+	}
+
+	os.Remove(updater.upgradeFilename)
+	os.Remove(failedFilename)
+
+	return nil
+}
+
+// restart starts the installed executable with the same arguments. The
+// caller should exit when restart returns nil.
+func (updater *selfUpdater) restart() error {
+	return restartExecutable(
+		updater.executable,
+		selfUpdateBackupEnvironmentVariable+"="+updater.executable+".old")
+}
+
+// watchSelfUpdateConfirmation confirms a self-update when the first tunnel
+// is established, as indicated by a Tunnels notice with a count > 0.
+// selfUpdateFailed is signaled when no tunnel is established within
+// selfUpdateConfirmTimeout. watchSelfUpdateConfirmation is a noop when the
+// process wasn't started by a self-update. The returned function stops
+// watching.
+func watchSelfUpdateConfirmation(selfUpdateFailed chan<- struct{}) func() {
+
+	if os.Getenv(selfUpdateBackupEnvironmentVariable) == "" {
+		return func() {}
+	}
+
+	notices, unsubscribe := psiphon.SubscribeNotices()
+
+	go func() {
+		defer unsubscribe()
+
+		timer := time.NewTimer(selfUpdateConfirmTimeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case notice, ok := <-notices:
+				if !ok {
+					return
+				}
+				noticeType, payload, err := psiphon.GetNotice(notice)
+				if err != nil || noticeType != "Tunnels" {
+					continue
+				}
+				count, ok := payload["count"].(float64)
+				if ok && count > 0 {
+					confirmSelfUpdate()
+					return
+				}
+			case <-timer.C:
+				select {
+				case selfUpdateFailed <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	return unsubscribe
+}
+
+// confirmSelfUpdate deletes the previous executable once the new executable
+// has established a tunnel. confirmSelfUpdate is a noop when the process
+// wasn't started by a self-update.
+func confirmSelfUpdate() {
+
+	backupFilename := os.Getenv(selfUpdateBackupEnvironmentVariable)
+	if backupFilename == "" {
+		return
+	}
+	os.Unsetenv(selfUpdateBackupEnvironmentVariable)
+
+	err := os.Remove(backupFilename)
+	if err != nil && !os.IsNotExist(err) {
+		psiphon.NoticeAlert("remove previous executable failed: %s", err)
+	}
+
+	psiphon.NoticeInfo("self-update completed")
+}
+
+// rollbackSelfUpdate restores and restarts the previous executable when the
+// process was started by a self-update. rollbackSelfUpdate returns only
+// when the process wasn't started by a self-update, or the rollback fails.
+func rollbackSelfUpdate() {
+
+	backupFilename := os.Getenv(selfUpdateBackupEnvironmentVariable)
+	if backupFilename == "" {
+		return
+	}
+	os.Unsetenv(selfUpdateBackupEnvironmentVariable)
+
+	psiphon.NoticeAlert("self-update failed to start: rolling back")
+
+	err := func() error {
+
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		executable, err = filepath.EvalSymlinks(executable)
+		if err != nil {
+			return err
+		}
+
+		failedFilename := executable + ".failed"
+
+		os.Remove(failedFilename)
+
+		err = os.Rename(executable, failedFilename)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(backupFilename, executable)
+		if err != nil {
+			return err
+		}
+
+		return restartExecutable(executable)
+	}()
+
+	if err != nil {
+		psiphon.NoticeError("self-update rollback failed: %s", err)
+		return
+	}
+
+	os.Exit(0)
+}
+
+// checkExecutable runs filename with -version, which verifies that it's a
+// valid executable for this platform.
+func checkExecutable(filename string) error {
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), selfUpdateCheckTimeout)
+	defer cancelFunc()
+
+	output, err := exec.CommandContext(ctx, filename, "-version").Output()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Contains(output, []byte("Psiphon Console Client")) {
+		return errors.New("unexpected version output")
+	}
+
+	return nil
+}
+
+func copyFile(sourceFilename, destinationFilename string, mode os.FileMode) error {
+
+	source, err := os.Open(sourceFilename)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(
+		destinationFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	if err == nil {
+		err = destination.Sync()
+	}
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func fileDigest(filename string) ([]byte, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,35 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartExecutable replaces this process with executable, run with the same
+// arguments, and with the additional environment variables. The process ID
+// is retained, which is expected by service managers and pid files.
+func restartExecutable(executable string, environment ...string) error {
+	return syscall.Exec(
+		executable, os.Args, append(os.Environ(), environment...))
+}
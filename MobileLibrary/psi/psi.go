@@ -28,9 +28,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -48,6 +51,15 @@ type PsiphonProvider interface {
 	GetNetworkID() string
 }
 
+// PsiphonFlowApplicationProvider is an optional host callback which
+// identifies the application that owns a packet tunnel flow, as in
+// psiphon.FlowApplicationGetter. Android VPN apps may implement this with
+// ConnectivityManager.getConnectionOwnerUid. This is separate from
+// PsiphonProvider so that existing providers need not implement it.
+type PsiphonFlowApplicationProvider interface {
+	GetFlowApplication(protocol, localAddress, remoteAddress string) string
+}
+
 func SetNoticeFiles(
 	homepageFilename,
 	rotatingFilename string,
@@ -61,6 +73,20 @@ func SetNoticeFiles(
 		rotatingSyncFrequency)
 }
 
+// SetNoticeFileRotation configures retention of older rotated notice files.
+// maxAgeSeconds is in seconds, as gomobile doesn't support time.Duration.
+// See psiphon.SetNoticeFileRotation.
+func SetNoticeFileRotation(
+	maxFiles,
+	maxAgeSeconds int,
+	compress bool) {
+
+	psiphon.SetNoticeFileRotation(
+		maxFiles,
+		time.Duration(maxAgeSeconds)*time.Second,
+		compress)
+}
+
 func NoticeUserLog(message string) {
 	psiphon.NoticeUserLog(message)
 }
@@ -70,6 +96,43 @@ var controller *psiphon.Controller
 var controllerCtx context.Context
 var stopController context.CancelFunc
 var controllerWaitGroup *sync.WaitGroup
+var flowApplicationProvider PsiphonFlowApplicationProvider
+var excludedApplications []string
+
+// SetFlowApplicationProvider sets the flow application provider used by
+// the next Start. Set nil to clear.
+func SetFlowApplicationProvider(provider PsiphonFlowApplicationProvider) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if provider == nil {
+		flowApplicationProvider = nil
+		return
+	}
+	flowApplicationProvider = newMutexFlowApplicationProvider(provider)
+}
+
+// SetPacketTunnelExcludedApplications sets the applications whose packet
+// tunnel traffic is dropped instead of tunneled, implementing per-app split
+// tunneling. Applications are identified by the values returned by the
+// PsiphonFlowApplicationProvider, which must be set. The list applies
+// immediately to a running Controller, and to subsequent Starts, where it
+// replaces any PacketTunnelExcludedApplications in the config.
+//
+// The input applications is a space-delimited list. This is a workaround
+// for gobind type limitations.
+func SetPacketTunnelExcludedApplications(applications string) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	excludedApplications = strings.Fields(applications)
+
+	if controller != nil {
+		controller.SetPacketTunnelExcludedApplications(excludedApplications)
+	}
+}
 
 func Start(
 	configJson,
@@ -108,17 +171,20 @@ func Start(
 
 	config.NetworkConnectivityChecker = provider
 
-	config.NetworkIDGetter = provider
-
-	if useDeviceBinder {
-		config.DeviceBinder = provider
-		config.DnsServerGetter = provider
-	}
+	config.HostNetworkProvider = newMobileHostNetworkProvider(provider, useDeviceBinder)
 
 	if useIPv6Synthesizer {
 		config.IPv6Synthesizer = provider
 	}
 
+	if flowApplicationProvider != nil {
+		config.FlowApplicationGetter = flowApplicationProvider
+	}
+
+	if excludedApplications != nil {
+		config.PacketTunnelExcludedApplications = excludedApplications
+	}
+
 	// All config fields should be set before calling Commit.
 
 	err = config.Commit()
@@ -213,6 +279,196 @@ func SetDynamicConfig(newSponsorID, newAuthorizationsList string) {
 	}
 }
 
+// SetEgressRegion changes the egress region, replacing only those active
+// tunnels that don't match the new region. SetEgressRegion has no effect if
+// no Controller is started.
+func SetEgressRegion(region string) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.SetEgressRegion(region)
+	}
+}
+
+// SetHostConditions reports host device and network conditions, which are
+// used to throttle tunnel establishment when the device is on battery or in
+// doze mode and to skip upgrade checks on metered networks.
+// SetHostConditions has no effect if no Controller is started.
+func SetHostConditions(onBattery, isMeteredNetwork, isDozeMode bool) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.SetHostConditions(
+			psiphon.HostConditions{
+				OnBattery:        onBattery,
+				IsMeteredNetwork: isMeteredNetwork,
+				IsDozeMode:       isDozeMode,
+			})
+	}
+}
+
+// GetBytesTransferredTotals returns a JSON array of the persistent bytes
+// transferred totals, per day and region, as psiphon.BytesTransferredTotal
+// objects. Returns "" if no Controller is started, as the data store is
+// only open while running.
+func GetBytesTransferredTotals() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	totals, err := psiphon.GetBytesTransferredTotals()
+	if err != nil {
+		return ""
+	}
+
+	totalsJSON, err := json.Marshal(totals)
+	if err != nil {
+		return ""
+	}
+	return string(totalsJSON)
+}
+
+// GetOSLProgress returns a JSON array of the client's progress towards
+// unlocking each OSL, as osl.OSLProgress objects. Returns "" if no
+// Controller is started, as the data store is only open while running.
+func GetOSLProgress() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	progress, err := controller.GetOSLProgress()
+	if err != nil {
+		return ""
+	}
+
+	progressJSON, err := json.Marshal(progress)
+	if err != nil {
+		return ""
+	}
+	return string(progressJSON)
+}
+
+// DirectCheck performs the specified HTTP request both through the tunnel
+// and directly, untunneled, and returns the comparative results as a JSON
+// psiphon.DirectCheckResult object, for "is this site blocked locally?"
+// diagnostics. Returns "" if no Controller is started or the check cannot be
+// performed. DirectCheck blocks until both requests complete or time out, so
+// it should not be called from a UI thread.
+func DirectCheck(method, url string) string {
+
+	// The controller mutex isn't held during the check, so that Stop isn't
+	// blocked; the check is interrupted when the controller is stopped.
+
+	controllerMutex.Lock()
+	checkController := controller
+	checkCtx := controllerCtx
+	controllerMutex.Unlock()
+
+	if checkController == nil {
+		return ""
+	}
+
+	result, err := checkController.DirectCheck(checkCtx, method, url)
+	if err != nil {
+		return ""
+	}
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return ""
+	}
+	return string(resultJSON)
+}
+
+// GetPacketTunnelFlowStats returns a JSON array of the active packet tunnel
+// flows, sorted by bytes transferred, descending. Returns "" if no
+// Controller is started or flow tracking is not enabled; see
+// PacketTunnelTrackFlows.
+func GetPacketTunnelFlowStats() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	flowStats := controller.GetPacketTunnelFlowStats()
+	if flowStats == nil {
+		return ""
+	}
+
+	flows := make([]map[string]interface{}, len(flowStats))
+	for i, flow := range flowStats {
+		flows[i] = map[string]interface{}{
+			"protocol":        flow.Protocol,
+			"localAddress":    net.JoinHostPort(flow.LocalIPAddress.String(), strconv.Itoa(flow.LocalPort)),
+			"remoteAddress":   net.JoinHostPort(flow.RemoteIPAddress.String(), strconv.Itoa(flow.RemotePort)),
+			"application":     flow.Application,
+			"bytesUp":         flow.BytesUp,
+			"bytesDown":       flow.BytesDown,
+			"packetsUp":       flow.PacketsUp,
+			"packetsDown":     flow.PacketsDown,
+			"ageSeconds":      int64(flow.Age / time.Second),
+			"idleTimeSeconds": int64(flow.IdleTime / time.Second),
+		}
+	}
+
+	flowsJSON, err := json.Marshal(flows)
+	if err != nil {
+		return ""
+	}
+	return string(flowsJSON)
+}
+
+// GetPacketTunnelApplicationStats returns a JSON array of the total packet
+// tunnel bytes transferred per application, since Start, sorted by bytes
+// transferred, descending. Traffic from unidentified applications is
+// totalled under the application "". Returns "" if no Controller is started
+// or flow tracking is not enabled.
+func GetPacketTunnelApplicationStats() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	applicationStats := controller.GetPacketTunnelApplicationStats()
+	if applicationStats == nil {
+		return ""
+	}
+
+	applications := make([]map[string]interface{}, len(applicationStats))
+	for i, application := range applicationStats {
+		applications[i] = map[string]interface{}{
+			"application": application.Application,
+			"bytesUp":     application.BytesUp,
+			"bytesDown":   application.BytesDown,
+			"flows":       application.Flows,
+		}
+	}
+
+	applicationsJSON, err := json.Marshal(applications)
+	if err != nil {
+		return ""
+	}
+	return string(applicationsJSON)
+}
+
 // Encrypt and upload feedback.
 func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer, uploadPath, uploadServerHeaders string) error {
 	return psiphon.SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer, uploadPath, uploadServerHeaders)
@@ -332,3 +588,72 @@ func (p *mutexPsiphonProvider) GetNetworkID() string {
 	defer p.Unlock()
 	return p.p.GetNetworkID()
 }
+
+type mutexFlowApplicationProvider struct {
+	sync.Mutex
+	p PsiphonFlowApplicationProvider
+}
+
+func newMutexFlowApplicationProvider(
+	p PsiphonFlowApplicationProvider) *mutexFlowApplicationProvider {
+
+	return &mutexFlowApplicationProvider{p: p}
+}
+
+func (p *mutexFlowApplicationProvider) GetFlowApplication(
+	protocol, localAddress, remoteAddress string) string {
+
+	p.Lock()
+	defer p.Unlock()
+	return p.p.GetFlowApplication(protocol, localAddress, remoteAddress)
+}
+
+// mobileHostNetworkProvider implements psiphon.HostNetworkProvider for
+// Android and iOS using the PsiphonProvider host callbacks. Socket binding
+// is enabled when the host app routes the whole device through a VPN, and
+// so passes useDeviceBinder to Start.
+type mobileHostNetworkProvider struct {
+	p            PsiphonProvider
+	bindsSockets bool
+}
+
+func newMobileHostNetworkProvider(
+	p PsiphonProvider, bindsSockets bool) *mobileHostNetworkProvider {
+
+	return &mobileHostNetworkProvider{p: p, bindsSockets: bindsSockets}
+}
+
+// GetActiveInterface returns the network type, such as "WIFI" or "MOBILE",
+// which is the non-PII prefix of the network ID.
+func (p *mobileHostNetworkProvider) GetActiveInterface() string {
+	networkID := p.p.GetNetworkID()
+	index := strings.Index(networkID, "-")
+	if index != -1 {
+		networkID = networkID[:index]
+	}
+	return networkID
+}
+
+func (p *mobileHostNetworkProvider) BindsSockets() bool {
+	return p.bindsSockets
+}
+
+func (p *mobileHostNetworkProvider) BindToNetwork(fileDescriptor int) (string, error) {
+	return p.p.BindToDevice(fileDescriptor)
+}
+
+func (p *mobileHostNetworkProvider) GetDNSServers() []string {
+	var DNSServers []string
+	for _, DNSServer := range []string{
+		p.p.GetPrimaryDnsServer(), p.p.GetSecondaryDnsServer()} {
+
+		if DNSServer != "" {
+			DNSServers = append(DNSServers, DNSServer)
+		}
+	}
+	return DNSServers
+}
+
+func (p *mobileHostNetworkProvider) GetNetworkID() string {
+	return p.p.GetNetworkID()
+}
@@ -0,0 +1,216 @@
+//go:build darwin || linux
+// +build darwin linux
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// blackholeDNSServer is an unroutable address, in TEST-NET-1, which is
+// substituted for the DNS servers during a DNSFailure fault, so that
+// resolves time out rather than failing immediately.
+const blackholeDNSServer = "192.0.2.1"
+
+// faultInjector applies faults to a running controller.
+//
+// Network loss and DNS failure are injected via the library DeviceBinder and
+// DnsServerGetter callbacks, which the controller invokes for every socket
+// and every resolve. Since these callbacks are only supported on platforms
+// with socket device binding, the soak test is limited to those platforms.
+type faultInjector struct {
+	primaryDNSServer   string
+	secondaryDNSServer string
+
+	mutex        sync.Mutex
+	controller   *psiphon.Controller
+	activeFaults map[string]int
+}
+
+func newFaultInjector(primaryDNSServer, secondaryDNSServer string) *faultInjector {
+	return &faultInjector{
+		primaryDNSServer:   primaryDNSServer,
+		secondaryDNSServer: secondaryDNSServer,
+		activeFaults:       make(map[string]int),
+	}
+}
+
+// setController sets the controller targeted by TerminateTunnel faults.
+func (injector *faultInjector) setController(controller *psiphon.Controller) {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	injector.controller = controller
+}
+
+func (injector *faultInjector) isActive(faultType string) bool {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	return injector.activeFaults[faultType] > 0
+}
+
+// getActiveFaults returns a description of all faults currently in effect,
+// for logging.
+func (injector *faultInjector) getActiveFaults() string {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	var faults []string
+	for faultType, count := range injector.activeFaults {
+		if count > 0 {
+			faults = append(faults, faultType)
+		}
+	}
+	if len(faults) == 0 {
+		return "None"
+	}
+	sort.Strings(faults)
+	return strings.Join(faults, "+")
+}
+
+// BindToDevice implements psiphon.DeviceBinder. No binding is performed;
+// during a NetworkLoss fault, all new sockets fail.
+func (injector *faultInjector) BindToDevice(fileDescriptor int) (string, error) {
+	if injector.isActive(FAULT_NETWORK_LOSS) {
+		return "", common.ContextError(syscall.ENETUNREACH)
+	}
+	return "", nil
+}
+
+// GetPrimaryDnsServer implements psiphon.DnsServerGetter.
+func (injector *faultInjector) GetPrimaryDnsServer() string {
+	if injector.isActive(FAULT_DNS_FAILURE) {
+		return blackholeDNSServer
+	}
+	return injector.primaryDNSServer
+}
+
+// GetSecondaryDnsServer implements psiphon.DnsServerGetter.
+func (injector *faultInjector) GetSecondaryDnsServer() string {
+	if injector.isActive(FAULT_DNS_FAILURE) {
+		return blackholeDNSServer
+	}
+	return injector.secondaryDNSServer
+}
+
+// inject applies the specified fault, blocking until the fault duration
+// has elapsed or ctx is done.
+func (injector *faultInjector) inject(
+	ctx context.Context, faultType string, duration time.Duration) {
+
+	psiphon.NoticeInfo("soak test: inject %s fault for %s", faultType, duration)
+
+	switch faultType {
+
+	case FAULT_TERMINATE_TUNNEL:
+		injector.terminateActiveTunnel()
+
+	case FAULT_SUSPEND_PROCESS:
+		err := suspendProcess(duration)
+		if err != nil {
+			psiphon.NoticeAlert("soak test: suspend process failed: %s", err)
+		}
+
+	case FAULT_NETWORK_LOSS, FAULT_DNS_FAILURE:
+
+		injector.mutex.Lock()
+		injector.activeFaults[faultType]++
+		injector.mutex.Unlock()
+
+		// Network loss only impacts new sockets. Existing tunnel connections
+		// would, on a real network, fail liveness checks; terminate the
+		// active tunnel so that reestablishment is attempted while the fault
+		// is in effect.
+		if faultType == FAULT_NETWORK_LOSS {
+			injector.terminateActiveTunnel()
+		}
+
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		injector.mutex.Lock()
+		injector.activeFaults[faultType]--
+		injector.mutex.Unlock()
+	}
+
+	psiphon.NoticeInfo("soak test: end %s fault", faultType)
+}
+
+func (injector *faultInjector) terminateActiveTunnel() {
+	injector.mutex.Lock()
+	controller := injector.controller
+	injector.mutex.Unlock()
+
+	if controller != nil {
+		controller.TerminateNextActiveTunnel()
+	}
+}
+
+// suspendProcess stops this process with SIGSTOP for the specified
+// duration, simulating an OS freezing a backgrounded app. A stopped process
+// cannot resume itself, so a helper process is first launched to send
+// SIGCONT once the duration has elapsed.
+func suspendProcess(duration time.Duration) error {
+
+	pid := os.Getpid()
+
+	resumer := exec.Command(
+		"/bin/sh",
+		"-c",
+		fmt.Sprintf("sleep %d; kill -CONT %d", int(duration/time.Second), pid))
+
+	err := resumer.Start()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = syscall.Kill(pid, syscall.SIGSTOP)
+	if err != nil {
+		// Don't leave the helper to send a stray SIGCONT.
+		resumer.Process.Kill()
+		resumer.Wait()
+		return common.ContextError(err)
+	}
+
+	// Execution continues here after SIGCONT.
+
+	err = resumer.Wait()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,369 @@
+//go:build darwin || linux
+// +build darwin linux
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+// SoakTest is a long-haul soak test which runs a controller for hours while
+// injecting faults on a schedule. Memory statistics are sampled periodically
+// and each tunnel establishment latency is recorded; both are logged to CSV
+// files for offline analysis of memory growth and recovery times.
+//
+// Example:
+//
+//   SoakTest -config psiphon.config -schedule schedule.json -duration 12h
+//
+// See README.md for the schedule file format.
+
+func main() {
+
+	var configFilename string
+	flag.StringVar(&configFilename, "config", "", "configuration input file")
+
+	var scheduleFilename string
+	flag.StringVar(&scheduleFilename, "schedule", "", "fault injection schedule input file")
+
+	var duration time.Duration
+	flag.DurationVar(&duration, "duration", 12*time.Hour, "soak test duration")
+
+	var memStatsPeriod time.Duration
+	flag.DurationVar(&memStatsPeriod, "memStatsPeriod", time.Minute, "memory statistics sampling period")
+
+	var memStatsFilename string
+	flag.StringVar(&memStatsFilename, "memStats", "memstats.csv", "memory statistics CSV output file")
+
+	var establishmentsFilename string
+	flag.StringVar(&establishmentsFilename, "establishments", "establishments.csv", "establishment latencies CSV output file")
+
+	var noticeFilename string
+	flag.StringVar(&noticeFilename, "notices", "", "notices output file (defaults to stderr)")
+
+	var primaryDNSServer string
+	flag.StringVar(&primaryDNSServer, "primaryDNS", "8.8.8.8", "primary DNS resolver")
+
+	var secondaryDNSServer string
+	flag.StringVar(&secondaryDNSServer, "secondaryDNS", "8.8.4.4", "secondary DNS resolver")
+
+	flag.Parse()
+
+	err := runSoakTest(
+		configFilename,
+		scheduleFilename,
+		duration,
+		memStatsPeriod,
+		memStatsFilename,
+		establishmentsFilename,
+		noticeFilename,
+		primaryDNSServer,
+		secondaryDNSServer)
+	if err != nil {
+		fmt.Printf("soak test failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runSoakTest(
+	configFilename string,
+	scheduleFilename string,
+	duration time.Duration,
+	memStatsPeriod time.Duration,
+	memStatsFilename string,
+	establishmentsFilename string,
+	noticeFilename string,
+	primaryDNSServer string,
+	secondaryDNSServer string) error {
+
+	if configFilename == "" {
+		return fmt.Errorf("configuration file is required")
+	}
+
+	schedule := &Schedule{}
+	if scheduleFilename != "" {
+		var err error
+		schedule, err = LoadSchedule(scheduleFilename)
+		if err != nil {
+			return fmt.Errorf("error loading schedule file: %s", err)
+		}
+	}
+
+	noticeFile := os.Stderr
+	if noticeFilename != "" {
+		var err error
+		noticeFile, err = os.OpenFile(
+			noticeFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("error opening notice file: %s", err)
+		}
+		defer noticeFile.Close()
+	}
+
+	memStatsLog, err := newCSVLog(
+		memStatsFilename,
+		[]string{
+			"Timestamp",
+			"ElapsedSeconds",
+			"ActiveFaults",
+			"Tunnels",
+			"NumGoroutine",
+			"HeapAlloc",
+			"HeapInuse",
+			"HeapSys",
+			"HeapReleased",
+			"Sys",
+			"TotalAlloc",
+			"NumGC",
+			"PauseTotalNs",
+		})
+	if err != nil {
+		return fmt.Errorf("error opening memory statistics file: %s", err)
+	}
+	defer memStatsLog.close()
+
+	establishmentsLog, err := newCSVLog(
+		establishmentsFilename,
+		[]string{
+			"Timestamp",
+			"ElapsedSeconds",
+			"ActiveFaults",
+			"ServerIPAddress",
+			"Protocol",
+			"LatencyMilliseconds",
+		})
+	if err != nil {
+		return fmt.Errorf("error opening establishments file: %s", err)
+	}
+	defer establishmentsLog.close()
+
+	configJSON, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return fmt.Errorf("error loading configuration file: %s", err)
+	}
+
+	config, err := psiphon.LoadConfig(configJSON)
+	if err != nil {
+		return fmt.Errorf("error processing configuration file: %s", err)
+	}
+
+	injector := newFaultInjector(primaryDNSServer, secondaryDNSServer)
+	config.DeviceBinder = injector
+	config.DnsServerGetter = injector
+
+	err = config.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing configuration file: %s", err)
+	}
+
+	startTime := time.Now()
+
+	elapsedSeconds := func(now time.Time) string {
+		return strconv.FormatInt(int64(now.Sub(startTime)/time.Second), 10)
+	}
+
+	// Establishment latency is the time from losing all tunnels, or from
+	// the start of the test, until the next active tunnel.
+
+	var establishmentMutex sync.Mutex
+	establishmentStart := startTime
+	tunnels := 0
+
+	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
+		func(notice []byte) {
+
+			noticeFile.Write(append(notice, '\n'))
+
+			noticeType, payload, err := psiphon.GetNotice(notice)
+			if err != nil {
+				return
+			}
+
+			establishmentMutex.Lock()
+			defer establishmentMutex.Unlock()
+
+			switch noticeType {
+
+			case "Tunnels":
+				count := int(payload["count"].(float64))
+				if count == 0 && tunnels > 0 {
+					establishmentStart = time.Now()
+				}
+				tunnels = count
+
+			case "ActiveTunnel":
+				if establishmentStart.IsZero() {
+					// Additional tunnels in the tunnel pool.
+					return
+				}
+				now := time.Now()
+				ipAddress, _ := payload["ipAddress"].(string)
+				protocol, _ := payload["protocol"].(string)
+				establishmentsLog.write(
+					now.UTC().Format(time.RFC3339),
+					elapsedSeconds(now),
+					injector.getActiveFaults(),
+					ipAddress,
+					protocol,
+					strconv.FormatInt(int64(now.Sub(establishmentStart)/time.Millisecond), 10))
+				establishmentStart = time.Time{}
+			}
+		}))
+
+	psiphon.NoticeBuildInfo()
+
+	err = psiphon.OpenDataStore(config)
+	if err != nil {
+		return fmt.Errorf("error initializing datastore: %s", err)
+	}
+	defer psiphon.CloseDataStore()
+
+	controller, err := psiphon.NewController(config)
+	if err != nil {
+		return fmt.Errorf("error creating controller: %s", err)
+	}
+	injector.setController(controller)
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), duration)
+	defer cancelFunc()
+
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		controller.Run(ctx)
+
+		// Stop the soak test if the controller stops.
+		cancelFunc()
+	}()
+
+	for _, fault := range schedule.Faults {
+		waitGroup.Add(1)
+		go func(fault *ScheduledFault) {
+			defer waitGroup.Done()
+			fault.run(ctx, startTime, injector)
+		}(fault)
+	}
+
+	systemStopSignal := make(chan os.Signal, 1)
+	signal.Notify(systemStopSignal, os.Interrupt)
+
+	ticker := time.NewTicker(memStatsPeriod)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			establishmentMutex.Lock()
+			currentTunnels := tunnels
+			establishmentMutex.Unlock()
+
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			now := time.Now()
+			memStatsLog.write(
+				now.UTC().Format(time.RFC3339),
+				elapsedSeconds(now),
+				injector.getActiveFaults(),
+				strconv.Itoa(currentTunnels),
+				strconv.Itoa(runtime.NumGoroutine()),
+				strconv.FormatUint(m.HeapAlloc, 10),
+				strconv.FormatUint(m.HeapInuse, 10),
+				strconv.FormatUint(m.HeapSys, 10),
+				strconv.FormatUint(m.HeapReleased, 10),
+				strconv.FormatUint(m.Sys, 10),
+				strconv.FormatUint(m.TotalAlloc, 10),
+				strconv.FormatUint(uint64(m.NumGC), 10),
+				strconv.FormatUint(m.PauseTotalNs, 10))
+
+		case <-systemStopSignal:
+			psiphon.NoticeInfo("soak test: shutdown by system")
+			cancelFunc()
+			break loop
+
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	waitGroup.Wait()
+
+	return nil
+}
+
+// csvLog is a CSV output file which is flushed after each record, so that
+// results are preserved if the soak test is interrupted.
+type csvLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVLog(filename string, header []string) (*csvLog, error) {
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &csvLog{
+		file:   file,
+		writer: csv.NewWriter(file),
+	}
+
+	log.write(header...)
+	err = log.writer.Error()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (log *csvLog) write(record ...string) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.writer.Write(record)
+	log.writer.Flush()
+}
+
+func (log *csvLog) close() {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.writer.Flush()
+	log.file.Close()
+}
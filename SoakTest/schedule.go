@@ -0,0 +1,144 @@
+//go:build darwin || linux
+// +build darwin linux
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	FAULT_NETWORK_LOSS     = "NetworkLoss"
+	FAULT_DNS_FAILURE      = "DNSFailure"
+	FAULT_TERMINATE_TUNNEL = "TerminateTunnel"
+	FAULT_SUSPEND_PROCESS  = "SuspendProcess"
+)
+
+// Schedule is the fault injection schedule, loaded from a JSON schedule
+// file.
+type Schedule struct {
+	Faults []*ScheduledFault
+}
+
+// ScheduledFault specifies one fault to inject.
+//
+// The fault is first injected StartSeconds after the soak test begins and,
+// when PeriodSeconds is > 0, is repeated every PeriodSeconds. NetworkLoss,
+// DNSFailure, and SuspendProcess faults remain in effect for DurationSeconds;
+// TerminateTunnel is instantaneous and ignores DurationSeconds.
+type ScheduledFault struct {
+	Type            string
+	StartSeconds    int
+	DurationSeconds int
+	PeriodSeconds   int
+}
+
+// LoadSchedule reads and validates a schedule file.
+func LoadSchedule(filename string) (*Schedule, error) {
+
+	scheduleJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var schedule Schedule
+	err = json.Unmarshal(scheduleJSON, &schedule)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	for i, fault := range schedule.Faults {
+		err := fault.validate()
+		if err != nil {
+			return nil, common.ContextError(fmt.Errorf("fault %d: %s", i, err))
+		}
+	}
+
+	return &schedule, nil
+}
+
+func (fault *ScheduledFault) validate() error {
+
+	switch fault.Type {
+	case FAULT_NETWORK_LOSS, FAULT_DNS_FAILURE, FAULT_SUSPEND_PROCESS:
+		if fault.DurationSeconds <= 0 {
+			return fmt.Errorf("%s requires DurationSeconds", fault.Type)
+		}
+	case FAULT_TERMINATE_TUNNEL:
+	default:
+		return fmt.Errorf("unknown fault type: %s", fault.Type)
+	}
+
+	if fault.StartSeconds < 0 || fault.PeriodSeconds < 0 {
+		return fmt.Errorf("invalid StartSeconds or PeriodSeconds")
+	}
+
+	// Overlapping repeats of the same fault are not supported.
+	if fault.PeriodSeconds > 0 && fault.PeriodSeconds < fault.DurationSeconds {
+		return fmt.Errorf("PeriodSeconds is less than DurationSeconds")
+	}
+
+	return nil
+}
+
+// run injects the scheduled fault, and any repeats, until ctx is done.
+// Times are relative to startTime.
+func (fault *ScheduledFault) run(
+	ctx context.Context, startTime time.Time, injector *faultInjector) {
+
+	next := startTime.Add(time.Duration(fault.StartSeconds) * time.Second)
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		injector.inject(
+			ctx, fault.Type, time.Duration(fault.DurationSeconds)*time.Second)
+
+		if fault.PeriodSeconds == 0 {
+			return
+		}
+
+		// Repeats are scheduled relative to the start time, not the end of
+		// the previous injection, so that the schedule doesn't drift. A
+		// repeat that would have occurred while the process was suspended
+		// is skipped.
+		period := time.Duration(fault.PeriodSeconds) * time.Second
+		now := time.Now()
+		for !next.After(now) {
+			next = next.Add(period)
+		}
+		timer.Reset(time.Until(next))
+	}
+}
@@ -25,20 +25,29 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
 
-// LookupIP resolves a hostname.
+// LookupIP resolves a hostname. When UntunneledDNSResolvers are
+// configured, those encrypted resolvers are also used, and plaintext answers
+// are checked for poisoning. See validatedLookupIP.
 func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
 
 	if config.DeviceBinder != nil {
 		return nil, common.ContextError(errors.New("LookupIP with DeviceBinder not supported on this platform"))
 	}
 
+	return validatedLookupIP(ctx, host, config, plaintextLookupIP)
+}
+
+func plaintextLookupIP(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, []time.Duration, error) {
+
 	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, nil, common.ContextError(err)
 	}
 
 	ips := make([]net.IP, len(addrs))
@@ -46,5 +55,5 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 		ips[i] = addr.IP
 	}
 
-	return ips, nil
+	return ips, nil, nil
 }
@@ -58,13 +58,21 @@ func NewTCPDialer(config *DialConfig) Dialer {
 func DialTCP(
 	ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
 
+	dial := tcpDial
+	if config.UpstreamProxyURL != "" {
+		dial = proxiedTcpDial
+	}
+
 	var conn net.Conn
 	var err error
 
-	if config.UpstreamProxyURL != "" {
-		conn, err = proxiedTcpDial(ctx, addr, config)
+	if config.NetworkEmulator != nil {
+		conn, err = config.NetworkEmulator.WrapDialer(
+			func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dial(ctx, addr, config)
+			})(ctx, "tcp", addr)
 	} else {
-		conn, err = tcpDial(ctx, addr, config)
+		conn, err = dial(ctx, addr, config)
 	}
 
 	if err != nil {
@@ -79,6 +87,19 @@ func DialTCP(
 			config.ResolvedIPCallback(ipAddress)
 		}
 	}
+
+	if config.dialCapture != nil {
+		conn = config.dialCapture.wrapConn(conn)
+	}
+
+	if config.FirstFlightCallback != nil {
+		conn = newFirstFlightConn(conn, config.FirstFlightCallback)
+	}
+
+	if config.TrafficShapingProfile != nil {
+		conn = newShapedConn(conn, config.TrafficShapingProfile)
+	}
+
 	return conn, nil
 }
 
@@ -110,9 +131,10 @@ func proxiedTcpDial(
 
 	upstreamDialer := upstreamproxy.NewProxyDialFunc(
 		&upstreamproxy.UpstreamProxyConfig{
-			ForwardDialFunc: dialer,
-			ProxyURIString:  config.UpstreamProxyURL,
-			CustomHeaders:   config.CustomHeaders,
+			ForwardDialFunc:        dialer,
+			ProxyURIString:         config.UpstreamProxyURL,
+			ChainedProxyURIStrings: config.UpstreamProxyChainURLs,
+			CustomHeaders:          config.CustomHeaders,
 		})
 
 	type upstreamDialResult struct {
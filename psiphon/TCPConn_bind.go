@@ -1,4 +1,4 @@
-// +build !windows
+// +build !windows,!js
 
 /*
  * Copyright (c) 2015, Psiphon Inc.
@@ -136,6 +136,13 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 
 		setAdditionalSocketOptions(socketFD)
 
+		if config.TCPMaxSegmentSize > 0 {
+			// Failure to set the MSS is not fatal; the dial proceeds with the
+			// system default MSS.
+			_ = syscall.SetsockoptInt(
+				socketFD, syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, config.TCPMaxSegmentSize)
+		}
+
 		if config.DeviceBinder != nil {
 			_, err = config.DeviceBinder.BindToDevice(socketFD)
 			if err != nil {
@@ -209,6 +216,10 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 				err = errors.New("interrupted")
 			}
 
+			if err == nil {
+				err = getSocketConnectError(socketFD)
+			}
+
 			resultChannel <- err
 		}()
 
@@ -264,3 +275,20 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 
 	return nil, lastErr
 }
+
+// getSocketConnectError returns the result of a non-blocking connect on
+// socketFD. A writable socket indicates only that the connect has completed;
+// SO_ERROR reports whether it failed, for example with "connection refused".
+// Without this check, a failed connect is reported as a successful dial and
+// the failure surfaces only on the first read or write.
+func getSocketConnectError(socketFD int) error {
+	soError, err := syscall.GetsockoptInt(
+		socketFD, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if soError != 0 {
+		return syscall.Errno(soError)
+	}
+	return nil
+}
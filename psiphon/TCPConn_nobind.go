@@ -1,4 +1,4 @@
-// +build windows
+// +build windows js
 
 /*
  * Copyright (c) 2015, Psiphon Inc.
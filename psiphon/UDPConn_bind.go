@@ -1,4 +1,4 @@
-// +build !windows
+// +build !windows,!js
 
 /*
  * Copyright (c) 2018, Psiphon Inc.
@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -62,3 +63,36 @@ func newUDPConn(domain int, config *DialConfig) (net.PacketConn, error) {
 
 	return conn, nil
 }
+
+// dialUDP dials a connected UDP conn to addr, which must be an IP address.
+// The UDP socket is bound using the DialConfig DeviceBinder. Unlike
+// NewUDPConn, no DNS resolution is performed and no other DialConfig
+// options apply.
+func dialUDP(
+	ctx context.Context, network, addr string, config *DialConfig) (net.Conn, error) {
+
+	dialer := &net.Dialer{}
+
+	if config.DeviceBinder != nil {
+		dialer.Control = func(_, _ string, rawConn syscall.RawConn) error {
+			var bindErr error
+			err := rawConn.Control(func(socketFD uintptr) {
+				bindErr = bindToDeviceCallWrapper(config.DeviceBinder, int(socketFD))
+			})
+			if err == nil {
+				err = bindErr
+			}
+			if err != nil {
+				return common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
+			}
+			return nil
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
@@ -1,4 +1,4 @@
-// +build windows
+// +build windows js
 
 /*
  * Copyright (c) 2018, Psiphon Inc.
@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"context"
 	"errors"
 	"net"
 	"syscall"
@@ -43,3 +44,20 @@ func newUDPConn(domain int, config *DialConfig) (net.PacketConn, error) {
 
 	return net.ListenUDP(network, nil)
 }
+
+func dialUDP(
+	ctx context.Context, network, addr string, config *DialConfig) (net.Conn, error) {
+
+	if config.DeviceBinder != nil {
+		return nil, common.ContextError(errors.New("dialUDP with DeviceBinder not supported on this platform"))
+	}
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
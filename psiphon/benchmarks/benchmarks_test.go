@@ -0,0 +1,418 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package benchmarks
+
+import (
+	"bytes"
+	"context"
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
+)
+
+// These benchmarks cover client hot paths which are sensitive to CPU and
+// allocation overhead on mobile devices. Run with:
+//
+//   go test -run xxx -bench . -benchmem ./psiphon/benchmarks
+//
+// All benchmarks call ReportAllocs so that allocation counts are reported
+// even without -benchmem.
+
+const (
+	benchmarkServerEntryCount = 1000
+	benchmarkMeekPayloadSize  = 65536
+	benchmarkMeekStreamSize   = 1048576
+)
+
+var benchmarkConfig *psiphon.Config
+
+func TestMain(m *testing.M) {
+	psiphon.SetNoticeWriter(ioutil.Discard)
+
+	dataRootDir, err := ioutil.TempDir("", "psiphon-benchmarks")
+	if err != nil {
+		fmt.Printf("TempDir failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	exitCode := func() int {
+		defer os.RemoveAll(dataRootDir)
+
+		benchmarkConfig, err = psiphon.LoadConfig([]byte(`
+		{
+			"ClientPlatform" : "Windows",
+			"ClientVersion" : "0",
+			"SponsorId" : "0",
+			"PropagationChannelId" : "0",
+			"DisableRemoteServerListFetcher" : true
+		}`))
+		if err != nil {
+			fmt.Printf("LoadConfig failed: %s\n", err)
+			return 1
+		}
+		benchmarkConfig.DataStoreDirectory = dataRootDir
+		err = benchmarkConfig.Commit()
+		if err != nil {
+			fmt.Printf("Commit failed: %s\n", err)
+			return 1
+		}
+
+		err = psiphon.OpenDataStore(benchmarkConfig)
+		if err != nil {
+			fmt.Printf("OpenDataStore failed: %s\n", err)
+			return 1
+		}
+		defer psiphon.CloseDataStore()
+
+		for i := 0; i < benchmarkServerEntryCount; i++ {
+			err = psiphon.StoreServerEntry(makeServerEntryFields(i), false)
+			if err != nil {
+				fmt.Printf("StoreServerEntry failed: %s\n", err)
+				return 1
+			}
+		}
+
+		return m.Run()
+	}()
+
+	os.Exit(exitCode)
+}
+
+func makeServerEntryFields(index int) protocol.ServerEntryFields {
+	return protocol.ServerEntryFields{
+		"ipAddress":            fmt.Sprintf("10.%d.%d.%d", (index>>16)&0xff, (index>>8)&0xff, index&0xff),
+		"sshPort":              22,
+		"sshObfuscatedPort":    443,
+		"meekServerPort":       80,
+		"configurationVersion": 1,
+		"capabilities":         []string{"SSH", "OSSH", "UNFRONTED-MEEK"},
+		"region":               "US",
+	}
+}
+
+// BenchmarkEstablishmentCandidates measures iterating over all stored server
+// entries, as performed by each establishment round.
+func BenchmarkEstablishmentCandidates(b *testing.B) {
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+
+		_, iterator, err := psiphon.NewServerEntryIterator(benchmarkConfig)
+		if err != nil {
+			b.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+
+		count := 0
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				b.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			count++
+		}
+
+		iterator.Close()
+
+		if count != benchmarkServerEntryCount {
+			b.Fatalf("unexpected candidate count: %d", count)
+		}
+	}
+}
+
+// BenchmarkNotices measures emitting common notices. Output is discarded, so
+// this covers formatting and serialization overhead only. Diagnostic notices
+// are enabled, as otherwise diagnostic notices such as Info are dropped
+// before serialization.
+func BenchmarkNotices(b *testing.B) {
+
+	psiphon.SetEmitDiagnosticNotices(true)
+	defer psiphon.SetEmitDiagnosticNotices(false)
+
+	b.Run("NoticeInfo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			psiphon.NoticeInfo("benchmark notice %d", i)
+		}
+	})
+
+	b.Run("NoticeAlert", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			psiphon.NoticeAlert("benchmark alert %d", i)
+		}
+	})
+
+	b.Run("NoticeBytesTransferred", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			psiphon.NoticeBytesTransferred("10.0.0.1", int64(i), int64(i))
+		}
+	})
+}
+
+// BenchmarkServerEntryDecode measures decoding individual and streamed
+// encoded server entries, as received in remote server lists.
+func BenchmarkServerEntryDecode(b *testing.B) {
+
+	var encodedServerEntries []string
+	var encodedServerEntryList bytes.Buffer
+	for i := 0; i < benchmarkServerEntryCount; i++ {
+		encodedServerEntry, err := protocol.EncodeServerEntryFields(makeServerEntryFields(i))
+		if err != nil {
+			b.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		encodedServerEntryList.WriteString(encodedServerEntry + "\n")
+	}
+	encodedServerEntryListBytes := encodedServerEntryList.Bytes()
+
+	timestamp := common.GetCurrentTimestamp()
+
+	b.Run("DecodeServerEntryFields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := protocol.DecodeServerEntryFields(
+				encodedServerEntries[i%len(encodedServerEntries)],
+				timestamp,
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			if err != nil {
+				b.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+		}
+	})
+
+	b.Run("StreamingNext", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(encodedServerEntryListBytes)))
+		for i := 0; i < b.N; i++ {
+			decoder := protocol.NewStreamingServerEntryDecoder(
+				bytes.NewReader(encodedServerEntryListBytes),
+				timestamp,
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			for {
+				serverEntryFields, err := decoder.Next()
+				if err != nil {
+					b.Fatalf("Next failed: %s", err)
+				}
+				if serverEntryFields == nil {
+					break
+				}
+			}
+		}
+	})
+
+	b.Run("StreamingNextBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(encodedServerEntryListBytes)))
+		for i := 0; i < b.N; i++ {
+			decoder := protocol.NewStreamingServerEntryDecoder(
+				bytes.NewReader(encodedServerEntryListBytes),
+				timestamp,
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			for {
+				batch, err := decoder.NextBatch(100)
+				if err != nil {
+					b.Fatalf("NextBatch failed: %s", err)
+				}
+				if len(batch) == 0 {
+					break
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkMeekFraming measures round trips of payloads through a meek
+// client and server over loopback, including meek request framing, cookie
+// obfuscation, and buffering.
+func BenchmarkMeekFraming(b *testing.B) {
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		b.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(32)
+	if err != nil {
+		b.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	support := &server.SupportServices{
+		Config: &server.Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &server.TrafficRulesSet{},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// The server echoes all received data back to the client. Server-side
+	// meek conns aren't closed by the client closing, so they're tracked and
+	// explicitly closed on shutdown.
+
+	echoWaitGroup := new(sync.WaitGroup)
+	echoConnsMutex := new(sync.Mutex)
+	var echoConns []net.Conn
+
+	clientHandler := func(_ string, conn net.Conn) {
+		echoConnsMutex.Lock()
+		echoConns = append(echoConns, conn)
+		echoConnsMutex.Unlock()
+		echoWaitGroup.Add(1)
+		go func() {
+			defer echoWaitGroup.Done()
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+
+	stopBroadcast := make(chan struct{})
+
+	meekServer, err := server.NewMeekServer(
+		support,
+		listener,
+		false,
+		false,
+		false,
+		clientHandler,
+		stopBroadcast)
+	if err != nil {
+		b.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		meekServer.Run()
+	}()
+
+	defer func() {
+		listener.Close()
+		close(stopBroadcast)
+		serverWaitGroup.Wait()
+		echoConnsMutex.Lock()
+		for _, conn := range echoConns {
+			conn.Close()
+		}
+		echoConnsMutex.Unlock()
+		echoWaitGroup.Wait()
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		b.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   listener.Addr().String(),
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		b.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	// The meek server skips a request payload that matches the immediately
+	// preceding payload, assuming a client retry, as real payloads are OSSH
+	// ciphertext. So payloads are taken from a random stream which doesn't
+	// repeat within any one request.
+
+	streamData := make([]byte, benchmarkMeekStreamSize+benchmarkMeekPayloadSize)
+	_, err = crypto_rand.Read(streamData)
+	if err != nil {
+		b.Fatalf("rand.Read failed: %s", err)
+	}
+	payload := func(i int) []byte {
+		offset := (i * benchmarkMeekPayloadSize) % benchmarkMeekStreamSize
+		return streamData[offset : offset+benchmarkMeekPayloadSize]
+	}
+	received := make([]byte, benchmarkMeekPayloadSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMeekPayloadSize)
+	b.ResetTimer()
+
+	// Payloads are streamed upstream by a writer goroutine while the echoed
+	// downstream payloads are read and verified.
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			_, err := clientConn.Write(payload(i))
+			if err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	for i := 0; i < b.N; i++ {
+
+		_, err := io.ReadFull(clientConn, received)
+		if err != nil {
+			b.Fatalf("ReadFull failed: %s", err)
+		}
+
+		if !bytes.Equal(payload(i), received) {
+			b.Fatalf("unexpected echo payload")
+		}
+	}
+
+	err = <-writeErr
+	if err != nil {
+		b.Fatalf("Write failed: %s", err)
+	}
+
+	b.StopTimer()
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	BLOCKING_EVENT_STAGE_CONNECT   = "connect"
+	BLOCKING_EVENT_STAGE_HANDSHAKE = "handshake"
+
+	BLOCKING_EVENT_CONNECT_REFUSED          = "CONNECT_REFUSED"
+	BLOCKING_EVENT_CONNECT_RESET            = "CONNECT_RESET"
+	BLOCKING_EVENT_CONNECT_TIMEOUT          = "CONNECT_TIMEOUT"
+	BLOCKING_EVENT_RESET_AFTER_CLIENT_HELLO = "RESET_AFTER_CLIENT_HELLO"
+	BLOCKING_EVENT_RESET_AFTER_CONNECT      = "RESET_AFTER_CONNECT"
+	BLOCKING_EVENT_CLOSED_AFTER_CONNECT     = "CLOSED_AFTER_CONNECT"
+	BLOCKING_EVENT_HANDSHAKE_TIMEOUT        = "HANDSHAKE_TIMEOUT"
+	BLOCKING_EVENT_DNS_FAILURE              = "DNS_FAILURE"
+	BLOCKING_EVENT_DNS_POISONING            = "DNS_POISONING"
+)
+
+// classifyDialFailure classifies a tunnel dial failure by the pattern of
+// network errors typical of different blocking techniques. stage is
+// BLOCKING_EVENT_STAGE_CONNECT for failures establishing the base transport
+// connection -- which, for HTTPS meek, includes the TLS handshake -- and
+// BLOCKING_EVENT_STAGE_HANDSHAKE for failures after the transport is
+// connected, during the obfuscation and SSH handshakes. resolvedIPAddress
+// is the address the dial hostname resolved to, if any.
+//
+// Returns "" when the failure doesn't match a blocking pattern, including
+// when the dial was canceled.
+//
+// Classification is heuristic: network errors, server outages, and
+// blocking may all produce the same errors.
+func classifyDialFailure(
+	stage, tunnelProtocol string, err error, resolvedIPAddress string) string {
+
+	if resolvedIPAddress != "" {
+		IP := net.ParseIP(resolvedIPAddress)
+		if IP != nil && isBogonIP(IP) {
+			// Resolvers injecting responses commonly return local, private,
+			// or unspecified addresses for blocked domains.
+			return BLOCKING_EVENT_DNS_POISONING
+		}
+	}
+
+	message := err.Error()
+
+	switch {
+
+	case strings.Contains(message, "context canceled"):
+		return ""
+
+	case strings.Contains(message, "no such host"):
+		return BLOCKING_EVENT_DNS_FAILURE
+
+	case strings.Contains(message, "connection refused"):
+		return BLOCKING_EVENT_CONNECT_REFUSED
+
+	case strings.Contains(message, "connection reset"):
+		if stage == BLOCKING_EVENT_STAGE_HANDSHAKE {
+			return BLOCKING_EVENT_RESET_AFTER_CONNECT
+		}
+		if protocol.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
+			// For HTTPS meek, a reset during the connect stage is most
+			// likely a reset in response to the TLS ClientHello, which
+			// indicates SNI or TLS fingerprint based blocking.
+			return BLOCKING_EVENT_RESET_AFTER_CLIENT_HELLO
+		}
+		return BLOCKING_EVENT_CONNECT_RESET
+
+	case strings.Contains(message, "timeout") ||
+		strings.Contains(message, "deadline exceeded"):
+		if stage == BLOCKING_EVENT_STAGE_HANDSHAKE {
+			return BLOCKING_EVENT_HANDSHAKE_TIMEOUT
+		}
+		// For direct TCP protocols, a connect timeout indicates that
+		// packets, such as the TCP SYN or its response, were dropped.
+		return BLOCKING_EVENT_CONNECT_TIMEOUT
+
+	case strings.Contains(message, "EOF") && stage == BLOCKING_EVENT_STAGE_HANDSHAKE:
+		return BLOCKING_EVENT_CLOSED_AFTER_CONNECT
+	}
+
+	return ""
+}
+
+func isBogonIP(IP net.IP) bool {
+	if IP.IsUnspecified() || IP.IsLoopback() ||
+		IP.IsLinkLocalUnicast() || IP.IsMulticast() {
+		return true
+	}
+	for _, private := range privateNetworks {
+		if private.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, CIDR := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(CIDR)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// blockingEventCounts records the number of blocking events, by network ID
+// and classification, since the last tactics request on that network. The
+// counts are sent with tactics requests, so that tactics may respond to the
+// blocking observed by the client.
+var blockingEventCounts struct {
+	mutex  sync.Mutex
+	counts map[string]map[string]int
+}
+
+// reportDialFailure classifies a tunnel dial failure and, when the failure
+// matches a blocking pattern, emits a BlockingEvent notice and records the
+// event for the next tactics request.
+func reportDialFailure(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string,
+	stage string,
+	dialStats *DialStats,
+	err error) {
+
+	// The resolved IP address is only checked for poisoning when the dial
+	// address is a domain name.
+	resolvedIPAddress := ""
+	host, _, splitErr := net.SplitHostPort(dialStats.MeekDialAddress)
+	if splitErr == nil && net.ParseIP(host) == nil {
+		resolvedIPAddress, _ = dialStats.MeekResolvedIPAddress.Load().(string)
+	}
+
+	classification := classifyDialFailure(stage, tunnelProtocol, err, resolvedIPAddress)
+	if classification == "" {
+		return
+	}
+
+	NoticeBlockingEvent(
+		serverEntry.Region, tunnelProtocol, stage, classification)
+
+	networkID := getNetworkIDKey(config)
+
+	blockingEventCounts.mutex.Lock()
+	defer blockingEventCounts.mutex.Unlock()
+
+	if blockingEventCounts.counts == nil {
+		blockingEventCounts.counts = make(map[string]map[string]int)
+	}
+	counts, ok := blockingEventCounts.counts[networkID]
+	if !ok {
+		counts = make(map[string]int)
+		blockingEventCounts.counts[networkID] = counts
+	}
+	counts[classification] += 1
+}
+
+// takeBlockingEventSummary returns, and resets, the blocking event counts
+// for the specified network ID, formatted as a sorted, comma-delimited list
+// of classification:count pairs. Returns "" when there are no events.
+func takeBlockingEventSummary(networkID string) string {
+
+	blockingEventCounts.mutex.Lock()
+	counts := blockingEventCounts.counts[networkID]
+	delete(blockingEventCounts.counts, networkID)
+	blockingEventCounts.mutex.Unlock()
+
+	summary := make([]string, 0, len(counts))
+	for classification, count := range counts {
+		summary = append(summary, fmt.Sprintf("%s:%d", classification, count))
+	}
+	sort.Strings(summary)
+
+	return strings.Join(summary, ",")
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestClassifyDialFailure(t *testing.T) {
+
+	testCases := []struct {
+		stage             string
+		tunnelProtocol    string
+		err               string
+		resolvedIPAddress string
+		expected          string
+	}{
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"dial tcp: connection refused", "", BLOCKING_EVENT_CONNECT_REFUSED},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"read: connection reset by peer", "", BLOCKING_EVENT_CONNECT_RESET},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+			"read: connection reset by peer", "", BLOCKING_EVENT_RESET_AFTER_CLIENT_HELLO},
+		{BLOCKING_EVENT_STAGE_HANDSHAKE, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"read: connection reset by peer", "", BLOCKING_EVENT_RESET_AFTER_CONNECT},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"dial tcp: i/o timeout", "", BLOCKING_EVENT_CONNECT_TIMEOUT},
+		{BLOCKING_EVENT_STAGE_HANDSHAKE, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"read: i/o timeout", "", BLOCKING_EVENT_HANDSHAKE_TIMEOUT},
+		{BLOCKING_EVENT_STAGE_HANDSHAKE, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"EOF", "", BLOCKING_EVENT_CLOSED_AFTER_CONNECT},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"EOF", "", ""},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			"lookup x: no such host", "", BLOCKING_EVENT_DNS_FAILURE},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			"dial tcp: i/o timeout", "127.0.0.1", BLOCKING_EVENT_DNS_POISONING},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			"dial tcp: i/o timeout", "8.8.8.8", BLOCKING_EVENT_CONNECT_TIMEOUT},
+		{BLOCKING_EVENT_STAGE_CONNECT, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			"context canceled", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		classification := classifyDialFailure(
+			testCase.stage,
+			testCase.tunnelProtocol,
+			errors.New(testCase.err),
+			testCase.resolvedIPAddress)
+		if classification != testCase.expected {
+			t.Fatalf(
+				"unexpected classification for %s/%s/%s: %s",
+				testCase.stage, testCase.tunnelProtocol, testCase.err, classification)
+		}
+	}
+}
+
+func TestBlockingEventSummary(t *testing.T) {
+
+	config := &Config{}
+
+	serverEntry := &protocol.ServerEntry{Region: "US"}
+	dialStats := &DialStats{}
+
+	for i := 0; i < 2; i++ {
+		reportDialFailure(
+			config, serverEntry, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			BLOCKING_EVENT_STAGE_CONNECT, dialStats,
+			errors.New("dial tcp: connection refused"))
+	}
+	reportDialFailure(
+		config, serverEntry, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		BLOCKING_EVENT_STAGE_HANDSHAKE, dialStats, errors.New("EOF"))
+	reportDialFailure(
+		config, serverEntry, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		BLOCKING_EVENT_STAGE_CONNECT, dialStats, errors.New("context canceled"))
+
+	networkID := getNetworkIDKey(config)
+
+	summary := takeBlockingEventSummary(networkID)
+	expected := "CLOSED_AFTER_CONNECT:1,CONNECT_REFUSED:2"
+	if summary != expected {
+		t.Fatalf("unexpected summary: %s", summary)
+	}
+
+	summary = takeBlockingEventSummary(networkID)
+	if summary != "" {
+		t.Fatalf("unexpected summary after take: %s", summary)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPersistentBytesTransferred(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-bytes-transferred-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfig := &Config{DataStoreDirectory: testDataDirName}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	additions := []struct {
+		day      string
+		region   string
+		sent     int64
+		received int64
+	}{
+		{"2019-01-01", "US", 100, 1000},
+		{"2019-01-02", "CA", 1, 2},
+		{"2019-01-02", "US", 10, 20},
+		{"2019-01-02", "US", 30, 40},
+	}
+
+	for _, addition := range additions {
+		_, err := AddBytesTransferred(
+			addition.day, addition.region, addition.sent, addition.received)
+		if err != nil {
+			t.Fatalf("AddBytesTransferred failed: %s", err)
+		}
+	}
+
+	// Totals persist across datastore reopens, as with controller restarts.
+
+	CloseDataStore()
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	totals, err := GetBytesTransferredTotals()
+	if err != nil {
+		t.Fatalf("GetBytesTransferredTotals failed: %s", err)
+	}
+
+	expected := []BytesTransferredTotal{
+		{"2019-01-01", "US", 100, 1000},
+		{"2019-01-02", "CA", 1, 2},
+		{"2019-01-02", "US", 40, 60},
+	}
+
+	if len(totals) != len(expected) {
+		t.Fatalf("unexpected totals count: %d", len(totals))
+	}
+	for i, total := range totals {
+		if *total != expected[i] {
+			t.Fatalf("unexpected total: %+v", total)
+		}
+	}
+
+	// Totals older than the retention period are deleted.
+
+	_, err = AddBytesTransferred("2019-04-02", "US", 1, 1)
+	if err != nil {
+		t.Fatalf("AddBytesTransferred failed: %s", err)
+	}
+
+	totals, err = GetBytesTransferredTotals()
+	if err != nil {
+		t.Fatalf("GetBytesTransferredTotals failed: %s", err)
+	}
+	if len(totals) != 3 || totals[0].Day != "2019-01-02" {
+		t.Fatalf("unexpected totals after retention: %+v", totals)
+	}
+}
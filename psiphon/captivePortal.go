@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// captivePortalProbeResult is the result of requesting a captive portal
+// probe URL. A probe URL returns an empty 204 No Content response when
+// there's no captive portal. A captive portal typically intercepts the
+// request and either redirects to the portal login page or serves the login
+// page directly.
+type captivePortalProbeResult struct {
+	probeURL        string
+	isCaptivePortal bool
+	portalURL       string
+	date            time.Time
+	err             error
+}
+
+// makeCaptivePortalProbeClient returns an untunneled http.Client for
+// requesting captive portal probe URLs. Redirects are not followed, so that
+// portal redirects are observed. Connections are not reused, as a
+// connection established while a portal is intercepting traffic may
+// continue to be intercepted after the portal is cleared.
+func makeCaptivePortalProbeClient(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig) (*http.Client, error) {
+
+	httpClient, err := MakeUntunneledHTTPClient(
+		ctx, config, untunneledDialConfig, nil, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return httpClient, nil
+}
+
+// probeCaptivePortal requests the probe URL and classifies the response.
+// A 204 response indicates no captive portal. A redirect indicates a
+// captive portal, with the portal URL taken from the redirect location.
+// Any other 2xx response indicates a captive portal serving its page in
+// place of the probe response, with the probe URL used as the portal URL.
+// Other responses, and request failures, are inconclusive and are reported
+// as errors.
+//
+// The response Date header, when present, is also reported.
+func probeCaptivePortal(
+	ctx context.Context,
+	httpClient *http.Client,
+	probeURL string,
+	userAgent string) *captivePortalProbeResult {
+
+	result := &captivePortalProbeResult{probeURL: probeURL}
+
+	request, err := http.NewRequest("GET", probeURL, nil)
+	if err != nil {
+		result.err = common.ContextError(err)
+		return result
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", userAgent)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		result.err = common.ContextError(FilterUrlError(err))
+		return result
+	}
+	response.Body.Close()
+
+	if date, err := http.ParseTime(response.Header.Get("Date")); err == nil {
+		result.date = date
+	}
+
+	switch {
+
+	case response.StatusCode == http.StatusNoContent:
+
+	case response.StatusCode >= 300 && response.StatusCode < 400:
+		location, err := response.Location()
+		if err != nil {
+			result.err = common.ContextError(err)
+			return result
+		}
+		result.isCaptivePortal = true
+		result.portalURL = location.String()
+
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		result.isCaptivePortal = true
+		result.portalURL = probeURL
+
+	default:
+		result.err = common.ContextError(
+			fmt.Errorf("unexpected probe response status: %d", response.StatusCode))
+	}
+
+	return result
+}
+
+// checkCaptivePortal concurrently requests all probe URLs, each with the
+// specified timeout. A captive portal is indicated when at least one probe
+// is intercepted and no probe receives a genuine 204 response. Probes that
+// fail or time out don't contradict a captive portal, as portals commonly
+// drop traffic other than HTTP requests they can intercept.
+//
+// The returned portal URL is from the first intercepted probe, in probe URL
+// order.
+func checkCaptivePortal(
+	ctx context.Context,
+	httpClient *http.Client,
+	probeURLs []string,
+	userAgent string,
+	timeout time.Duration) (bool, string) {
+
+	results := make([]*captivePortalProbeResult, len(probeURLs))
+
+	waitGroup := new(sync.WaitGroup)
+	for i, probeURL := range probeURLs {
+		waitGroup.Add(1)
+		go func(i int, probeURL string) {
+			defer waitGroup.Done()
+			probeCtx, cancelFunc := context.WithTimeout(ctx, timeout)
+			defer cancelFunc()
+			results[i] = probeCaptivePortal(probeCtx, httpClient, probeURL, userAgent)
+		}(i, probeURL)
+	}
+	waitGroup.Wait()
+
+	isCaptivePortal := false
+	portalURL := ""
+
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		if !result.isCaptivePortal {
+			return false, ""
+		}
+		if !isCaptivePortal {
+			isCaptivePortal = true
+			portalURL = result.portalURL
+		}
+	}
+
+	return isCaptivePortal, portalURL
+}
+
+// captivePortalCheckResult is the result of a background captive portal
+// check started by startCaptivePortalCheck.
+type captivePortalCheckResult struct {
+	isCaptivePortal bool
+	portalURL       string
+}
+
+// startCaptivePortalCheck checks for a captive portal in a background
+// goroutine, so that establishment isn't stalled waiting for probe
+// responses; probes to blackholed probe URLs don't complete until the probe
+// timeout. The returned channel receives the check result. When captive
+// portal detection is disabled, the result, with no captive portal, is
+// available immediately.
+func (controller *Controller) startCaptivePortalCheck(
+	ctx context.Context) <-chan *captivePortalCheckResult {
+
+	resultChannel := make(chan *captivePortalCheckResult, 1)
+
+	go func() {
+		isCaptivePortal, portalURL := controller.probeForCaptivePortal(ctx)
+		resultChannel <- &captivePortalCheckResult{
+			isCaptivePortal: isCaptivePortal,
+			portalURL:       portalURL,
+		}
+	}()
+
+	return resultChannel
+}
+
+// probeForCaptivePortal checks for a captive portal using the current
+// captive portal parameters, and returns the portal URL when a captive
+// portal is detected.
+//
+// Probes use a generic User-Agent, as the probes are plaintext.
+func (controller *Controller) probeForCaptivePortal(
+	ctx context.Context) (bool, string) {
+
+	p := controller.config.clientParameters.Get()
+	enabled := p.Bool(parameters.CaptivePortalDetection)
+	probeURLs := p.Strings(parameters.CaptivePortalProbeURLs)
+	timeout := p.Duration(parameters.CaptivePortalProbeTimeout)
+	p = nil
+
+	if !enabled || len(probeURLs) == 0 {
+		return false, ""
+	}
+
+	httpClient, err := makeCaptivePortalProbeClient(
+		ctx, controller.config, controller.untunneledDialConfig)
+	if err != nil {
+		NoticeAlert("failed to make captive portal probe client: %s", err)
+		return false, ""
+	}
+
+	return checkCaptivePortal(
+		ctx, httpClient, probeURLs, pickUserAgent(), timeout)
+}
+
+// waitForCaptivePortalCleared pauses until a detected captive portal is no
+// longer detected. While a captive portal intercepts traffic, establishment
+// attempts are futile, so the caller should not attempt to connect until
+// waitForCaptivePortalCleared returns.
+//
+// A CaptivePortal notice is emitted on entry, with the portal URL the user
+// may open to sign in, and again when the portal is cleared.
+//
+// waitForCaptivePortalCleared returns false when ctx is done before the
+// portal is cleared.
+func (controller *Controller) waitForCaptivePortalCleared(
+	ctx context.Context, portalURL string) bool {
+
+	NoticeCaptivePortal(true, portalURL)
+
+	for {
+
+		period := controller.config.clientParameters.Get().Duration(
+			parameters.CaptivePortalProbePeriod)
+
+		timer := controller.config.clock.NewTimer(period)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+		timer.Stop()
+
+		isCaptivePortal, nextPortalURL := controller.probeForCaptivePortal(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		if !isCaptivePortal {
+			break
+		}
+
+		// Some portals redirect to a per-session URL, so report changes.
+		if nextPortalURL != portalURL {
+			portalURL = nextPortalURL
+			NoticeCaptivePortal(true, portalURL)
+		}
+	}
+
+	NoticeCaptivePortal(false, "")
+
+	return true
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestCheckCaptivePortal(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			switch request.URL.Path {
+			case "/generate_204":
+				responseWriter.WriteHeader(http.StatusNoContent)
+			case "/redirect":
+				http.Redirect(responseWriter, request, "http://portal.example/login", http.StatusFound)
+			default:
+				http.Error(responseWriter, "", http.StatusInternalServerError)
+			}
+		}))
+	defer server.Close()
+
+	httpClient := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	testCases := []struct {
+		probePaths      []string
+		isCaptivePortal bool
+		portalURL       string
+	}{
+		{[]string{"/generate_204"}, false, ""},
+		{[]string{"/error"}, false, ""},
+		{[]string{"/redirect", "/generate_204"}, false, ""},
+		{[]string{"/error", "/redirect"}, true, "http://portal.example/login"},
+	}
+
+	for _, testCase := range testCases {
+
+		var probeURLs []string
+		for _, path := range testCase.probePaths {
+			probeURLs = append(probeURLs, server.URL+path)
+		}
+
+		isCaptivePortal, portalURL := checkCaptivePortal(
+			context.Background(), httpClient, probeURLs, "", 5*time.Second)
+
+		if isCaptivePortal != testCase.isCaptivePortal ||
+			portalURL != testCase.portalURL {
+
+			t.Fatalf("unexpected result for %v: %v %s",
+				testCase.probePaths, isCaptivePortal, portalURL)
+		}
+	}
+}
+
+func TestWaitForCaptivePortal(t *testing.T) {
+
+	var notices bytes.Buffer
+	SetNoticeWriter(&notices)
+	defer SetNoticeWriter(os.Stderr)
+
+	var portalCleared int32
+	var probeCount int32
+	blockProbes := make(chan struct{})
+	userAgents := make(chan string, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&probeCount, 1)
+			select {
+			case userAgents <- request.Header.Get("User-Agent"):
+			default:
+			}
+			if request.URL.Path == "/blackhole" {
+				<-blockProbes
+				return
+			}
+			if atomic.LoadInt32(&portalCleared) == 0 {
+				http.Redirect(responseWriter, request, "http://portal.example/login", http.StatusFound)
+				return
+			}
+			responseWriter.WriteHeader(http.StatusNoContent)
+		}))
+	defer server.Close()
+	defer close(blockProbes)
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	setProbeParameters := func(detection bool, path string) {
+		_, err := clientParameters.Set("", false, map[string]interface{}{
+			parameters.CaptivePortalDetection: detection,
+			parameters.CaptivePortalProbeURLs: []string{server.URL + path},
+		})
+		if err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+	}
+
+	clock := common.NewSimulatedClock()
+
+	controller := &Controller{
+		config: &Config{
+			clientParameters: clientParameters,
+			clock:            clock,
+		},
+		untunneledDialConfig: &DialConfig{
+			ClientParameters: clientParameters,
+		},
+	}
+
+	// Detection is disabled by default, and no probes are made.
+
+	result := <-controller.startCaptivePortalCheck(context.Background())
+	if result.isCaptivePortal || atomic.LoadInt32(&probeCount) != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// A blackholed probe doesn't block the caller.
+
+	setProbeParameters(true, "/blackhole")
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	resultChannel := controller.startCaptivePortalCheck(ctx)
+	select {
+	case result := <-resultChannel:
+		t.Fatalf("unexpected result: %+v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancelFunc()
+	result = <-resultChannel
+	if result.isCaptivePortal {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// Probes don't identify Psiphon.
+
+	userAgent := <-userAgents
+	if strings.Contains(strings.ToLower(userAgent), "psiphon") {
+		t.Fatalf("unexpected User-Agent: %s", userAgent)
+	}
+
+	// The portal is detected.
+
+	setProbeParameters(true, "/generate_204")
+
+	result = <-controller.startCaptivePortalCheck(context.Background())
+	if !result.isCaptivePortal ||
+		result.portalURL != "http://portal.example/login" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// The probe is repeated after a pause until the portal is cleared.
+
+	waitResult := make(chan bool, 1)
+	go func() {
+		waitResult <- controller.waitForCaptivePortalCleared(
+			context.Background(), result.portalURL)
+	}()
+
+	if !clock.WaitForPendingTimers(1, 10*time.Second) {
+		t.Fatalf("captive portal not probed")
+	}
+	clock.AdvanceToNextTimer()
+
+	if !clock.WaitForPendingTimers(1, 10*time.Second) {
+		t.Fatalf("captive portal not probed again")
+	}
+
+	atomic.StoreInt32(&portalCleared, 1)
+	clock.AdvanceToNextTimer()
+
+	select {
+	case ok := <-waitResult:
+		if !ok {
+			t.Fatalf("unexpected result")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("captive portal wait not ended")
+	}
+
+	var captivePortalNotices []map[string]interface{}
+	for _, line := range strings.Split(notices.String(), "\n") {
+		var notice struct {
+			NoticeType string
+			Data       map[string]interface{}
+		}
+		if json.Unmarshal([]byte(line), &notice) == nil &&
+			notice.NoticeType == "CaptivePortal" {
+			captivePortalNotices = append(captivePortalNotices, notice.Data)
+		}
+	}
+
+	if len(captivePortalNotices) != 2 ||
+		captivePortalNotices[0]["isCaptivePortal"] != true ||
+		captivePortalNotices[0]["portalURL"] != "http://portal.example/login" ||
+		captivePortalNotices[1]["isCaptivePortal"] != false {
+
+		t.Fatalf("unexpected notices: %v", captivePortalNotices)
+	}
+}
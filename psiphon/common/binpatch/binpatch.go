@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package binpatch implements a simple binary delta format, used to
+// download client upgrades as a patch against the currently installed
+// client.
+//
+// A patch is the magic value "PSIPATCH" followed by a sequence of
+// operations, each starting with a single op code byte:
+//
+//   - opCopy, followed by uvarint offset and length values, copies length
+//     bytes from the base file, starting at offset, to the output.
+//
+//   - opInsert, followed by a uvarint length value and length bytes, copies
+//     those bytes to the output.
+//
+// - opEnd terminates the patch.
+//
+// Patches are not authenticated; callers must verify the patch or its
+// output.
+package binpatch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	patchMagic = "PSIPATCH"
+
+	opEnd    = 0
+	opCopy   = 1
+	opInsert = 2
+
+	// DEFAULT_BLOCK_SIZE is the Generate block size which is used when the
+	// specified block size is <= 0.
+	DEFAULT_BLOCK_SIZE = 64
+)
+
+// Generate creates a patch which transforms base into target.
+//
+// Generate finds regions of target which appear, at any offset, in base,
+// by matching blockSize aligned blocks of base using a rolling hash of
+// target. Smaller block sizes find more matches, at the cost of more
+// memory. Generate is intended for release tooling and holds base and
+// target in memory.
+func Generate(base, target []byte, blockSize int) []byte {
+
+	if blockSize <= 0 {
+		blockSize = DEFAULT_BLOCK_SIZE
+	}
+
+	var patch bytes.Buffer
+	patch.WriteString(patchMagic)
+
+	blocks := make(map[uint64][]int)
+	for offset := 0; offset+blockSize <= len(base); offset += blockSize {
+		hash := rollingHash(base[offset : offset+blockSize])
+		blocks[hash] = append(blocks[hash], offset)
+	}
+
+	// rollingPower is rollingPrime^(blockSize-1), for removing the leading
+	// byte from the rolling hash.
+	rollingPower := uint64(1)
+	for i := 0; i < blockSize-1; i++ {
+		rollingPower *= rollingPrime
+	}
+
+	insertStart := 0
+	i := 0
+	var hash uint64
+	if len(target) >= blockSize {
+		hash = rollingHash(target[:blockSize])
+	}
+
+	for i+blockSize <= len(target) {
+
+		matchOffset, matchLength := -1, 0
+		for _, offset := range blocks[hash] {
+			if !bytes.Equal(base[offset:offset+blockSize], target[i:i+blockSize]) {
+				continue
+			}
+			length := blockSize
+			for offset+length < len(base) &&
+				i+length < len(target) &&
+				base[offset+length] == target[i+length] {
+				length++
+			}
+			if length > matchLength {
+				matchOffset, matchLength = offset, length
+			}
+		}
+
+		if matchOffset == -1 {
+			if i+blockSize < len(target) {
+				hash = (hash-uint64(target[i])*rollingPower)*rollingPrime +
+					uint64(target[i+blockSize])
+			}
+			i++
+			continue
+		}
+
+		writeInsert(&patch, target[insertStart:i])
+		writeUvarints(&patch, opCopy, uint64(matchOffset), uint64(matchLength))
+
+		i += matchLength
+		insertStart = i
+		if i+blockSize <= len(target) {
+			hash = rollingHash(target[i : i+blockSize])
+		}
+	}
+
+	writeInsert(&patch, target[insertStart:])
+	patch.WriteByte(opEnd)
+
+	return patch.Bytes()
+}
+
+const rollingPrime = 1099511628211
+
+func rollingHash(block []byte) uint64 {
+	var hash uint64
+	for _, b := range block {
+		hash = hash*rollingPrime + uint64(b)
+	}
+	return hash
+}
+
+func writeInsert(patch *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	writeUvarints(patch, opInsert, uint64(len(data)))
+	patch.Write(data)
+}
+
+func writeUvarints(patch *bytes.Buffer, op byte, values ...uint64) {
+	patch.WriteByte(op)
+	var buffer [binary.MaxVarintLen64]byte
+	for _, value := range values {
+		n := binary.PutUvarint(buffer[:], value)
+		patch.Write(buffer[:n])
+	}
+}
+
+// Apply applies patch to base, writing the result to output. Apply streams
+// the patch and output, and reads only the required regions of base.
+func Apply(base io.ReaderAt, patch io.Reader, output io.Writer) error {
+
+	reader := bufio.NewReader(patch)
+
+	magic := make([]byte, len(patchMagic))
+	_, err := io.ReadFull(reader, magic)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if string(magic) != patchMagic {
+		return common.ContextError(errors.New("invalid patch magic"))
+	}
+
+	for {
+
+		op, err := reader.ReadByte()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		switch op {
+
+		case opEnd:
+			return nil
+
+		case opCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if offset > 1<<62 || length > 1<<62 {
+				return common.ContextError(errors.New("invalid copy range"))
+			}
+			n, err := io.Copy(
+				output, io.NewSectionReader(base, int64(offset), int64(length)))
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if n != int64(length) {
+				return common.ContextError(errors.New("copy range exceeds base"))
+			}
+
+		case opInsert:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if length > 1<<62 {
+				return common.ContextError(errors.New("invalid insert length"))
+			}
+			_, err = io.CopyN(output, reader, int64(length))
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+		default:
+			return common.ContextError(fmt.Errorf("invalid patch op: %d", op))
+		}
+	}
+}
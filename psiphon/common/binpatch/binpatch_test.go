@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package binpatch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestBinPatch(t *testing.T) {
+
+	base := make([]byte, 1<<16)
+	rand.Read(base)
+
+	// The target shifts, replaces, and appends regions of the base.
+
+	var target []byte
+	target = append(target, []byte("prefix")...)
+	target = append(target, base[1000:20000]...)
+	insert := make([]byte, 500)
+	rand.Read(insert)
+	target = append(target, insert...)
+	target = append(target, base[30000:]...)
+	target = append(target, base[:100]...)
+
+	testCases := []struct {
+		description string
+		base        []byte
+		target      []byte
+	}{
+		{"modified", base, target},
+		{"identical", base, base},
+		{"empty base", nil, target},
+		{"empty target", base, nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			patch := Generate(testCase.base, testCase.target, 0)
+
+			if len(testCase.base) > 0 && len(testCase.target) > 0 &&
+				len(patch) > len(testCase.target)/2 {
+				t.Fatalf("unexpected patch size: %d", len(patch))
+			}
+
+			var output bytes.Buffer
+			err := Apply(bytes.NewReader(testCase.base), bytes.NewReader(patch), &output)
+			if err != nil {
+				t.Fatalf("Apply failed: %s", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), testCase.target) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+
+	// Patches which are truncated or reference data beyond the base fail.
+
+	patch := Generate(base, target, 0)
+
+	err := Apply(bytes.NewReader(base), bytes.NewReader(patch[:len(patch)-1]), &bytes.Buffer{})
+	if err == nil {
+		t.Fatalf("unexpected Apply success with truncated patch")
+	}
+
+	err = Apply(bytes.NewReader(base[:20000]), bytes.NewReader(patch), &bytes.Buffer{})
+	if err == nil {
+		t.Fatalf("unexpected Apply success with truncated base")
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// Clock provides the current monotonic time and timers. Components with
+// long timers, such as retry and backoff periods, use a Clock so that tests
+// may substitute a SimulatedClock and verify hours of timer behavior without
+// waiting.
+type Clock interface {
+	Now() monotime.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the Clock equivalent of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock that uses the system monotonic time and standard
+// timers.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() monotime.Time {
+	return monotime.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{timer: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// SimulatedClock is a Clock where time advances only when Advance is called.
+// Timers fire, in deadline order, when Advance moves the simulated time
+// to or past their deadlines.
+type SimulatedClock struct {
+	mutex         sync.Mutex
+	now           monotime.Time
+	timers        []*simulatedTimer
+	timersChanged chan struct{}
+}
+
+// NewSimulatedClock creates a new SimulatedClock.
+func NewSimulatedClock() *SimulatedClock {
+	return &SimulatedClock{
+		// Start at a non-zero time, as some callers use a zero time to
+		// indicate "not set".
+		now:           monotime.Time(1),
+		timersChanged: make(chan struct{}),
+	}
+}
+
+// Now returns the current simulated time.
+func (clock *SimulatedClock) Now() monotime.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+// NewTimer creates a timer that fires when the simulated time has advanced
+// by d. A timer with d <= 0 fires immediately.
+func (clock *SimulatedClock) NewTimer(d time.Duration) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	timer := &simulatedTimer{
+		clock:    clock,
+		c:        make(chan time.Time, 1),
+		deadline: clock.now.Add(d),
+	}
+
+	if d <= 0 {
+		timer.fire()
+		return timer
+	}
+
+	clock.timers = append(clock.timers, timer)
+	clock.signalTimersChanged()
+
+	return timer
+}
+
+// Advance moves the simulated time forward by d, firing all timers with
+// deadlines that are reached.
+func (clock *SimulatedClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	sort.SliceStable(clock.timers, func(i, j int) bool {
+		return clock.timers[i].deadline.Before(clock.timers[j].deadline)
+	})
+
+	pending := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if !timer.deadline.After(clock.now) {
+			timer.fire()
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	clock.timers = pending
+	clock.signalTimersChanged()
+}
+
+// AdvanceToNextTimer moves the simulated time forward to the earliest
+// pending timer deadline, firing that timer, and returns the duration
+// advanced. When there are no pending timers, time is not advanced and
+// AdvanceToNextTimer returns 0.
+func (clock *SimulatedClock) AdvanceToNextTimer() time.Duration {
+	clock.mutex.Lock()
+	var d time.Duration
+	if len(clock.timers) > 0 {
+		next := clock.timers[0].deadline
+		for _, timer := range clock.timers[1:] {
+			if timer.deadline.Before(next) {
+				next = timer.deadline
+			}
+		}
+		d = next.Sub(clock.now)
+	}
+	clock.mutex.Unlock()
+
+	if d > 0 {
+		clock.Advance(d)
+	}
+	return d
+}
+
+// PendingTimers returns the number of timers that have not yet fired and
+// have not been stopped.
+func (clock *SimulatedClock) PendingTimers() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return len(clock.timers)
+}
+
+// WaitForPendingTimers blocks until there are at least n pending timers or
+// the real time timeout elapses, and returns whether the condition was met.
+// Tests use WaitForPendingTimers to synchronize with goroutines that are
+// about to block on a timer before calling Advance.
+func (clock *SimulatedClock) WaitForPendingTimers(n int, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		clock.mutex.Lock()
+		count := len(clock.timers)
+		changed := clock.timersChanged
+		clock.mutex.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// signalTimersChanged must be called with the clock mutex held.
+func (clock *SimulatedClock) signalTimersChanged() {
+	close(clock.timersChanged)
+	clock.timersChanged = make(chan struct{})
+}
+
+func (clock *SimulatedClock) stopTimer(timer *simulatedTimer) bool {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	for i, t := range clock.timers {
+		if t == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			clock.signalTimersChanged()
+			return true
+		}
+	}
+	return false
+}
+
+type simulatedTimer struct {
+	clock    *SimulatedClock
+	c        chan time.Time
+	deadline monotime.Time
+}
+
+func (timer *simulatedTimer) fire() {
+	// The channel has a buffer of 1 and each timer fires at most once, so
+	// this send doesn't block. As with time.Timer, the value is the wall
+	// clock time, which is not meaningful for simulated timers.
+	timer.c <- time.Now()
+}
+
+func (timer *simulatedTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *simulatedTimer) Stop() bool {
+	return timer.clock.stopTimer(timer)
+}
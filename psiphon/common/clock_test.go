@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulatedClock(t *testing.T) {
+
+	clock := NewSimulatedClock()
+
+	start := clock.Now()
+
+	timer1 := clock.NewTimer(2 * time.Hour)
+	timer2 := clock.NewTimer(1 * time.Hour)
+	timer3 := clock.NewTimer(3 * time.Hour)
+
+	if clock.PendingTimers() != 3 {
+		t.Fatalf("unexpected pending timers: %d", clock.PendingTimers())
+	}
+
+	expectFired := func(timer Timer, fired bool) {
+		select {
+		case <-timer.C():
+			if !fired {
+				t.Fatalf("unexpected timer fired")
+			}
+		default:
+			if fired {
+				t.Fatalf("expected timer fired")
+			}
+		}
+	}
+
+	clock.Advance(59 * time.Minute)
+	expectFired(timer2, false)
+
+	clock.Advance(1 * time.Minute)
+	expectFired(timer2, true)
+	expectFired(timer1, false)
+
+	if !timer3.Stop() {
+		t.Fatalf("unexpected Stop result")
+	}
+	if timer3.Stop() {
+		t.Fatalf("unexpected Stop result")
+	}
+
+	d := clock.AdvanceToNextTimer()
+	if d != 1*time.Hour {
+		t.Fatalf("unexpected advance: %s", d)
+	}
+	expectFired(timer1, true)
+
+	if clock.AdvanceToNextTimer() != 0 {
+		t.Fatalf("unexpected advance with no pending timers")
+	}
+	expectFired(timer3, false)
+
+	if clock.Now().Sub(start) != 2*time.Hour {
+		t.Fatalf("unexpected elapsed time: %s", clock.Now().Sub(start))
+	}
+
+	expectFired(clock.NewTimer(0), true)
+
+	// WaitForPendingTimers synchronizes with a goroutine that starts a timer.
+
+	fired := make(chan struct{})
+	go func() {
+		<-clock.NewTimer(24 * time.Hour).C()
+		close(fired)
+	}()
+
+	if !clock.WaitForPendingTimers(1, 5*time.Second) {
+		t.Fatalf("WaitForPendingTimers failed")
+	}
+	clock.Advance(24 * time.Hour)
+	<-fired
+
+	if clock.WaitForPendingTimers(1, 10*time.Millisecond) {
+		t.Fatalf("unexpected WaitForPendingTimers result")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -483,7 +484,7 @@ func (c *channel) handlePacket(packet []byte) error {
 		// - See comments above channelWindowSize definition.
 
 		//c.remoteWin.add(msg.MyWindow)
-		c.remoteWin.add(min(msg.MyWindow, getChannelWindowSize(c.chanType)))
+		c.remoteWin.add(min(msg.MyWindow, c.mux.getChannelWindowSize(c.chanType)))
 
 		c.msg <- msg
 	case *windowAdjustMsg:
@@ -506,9 +507,13 @@ func (c *channel) handlePacket(packet []byte) error {
 }
 
 func (m *mux) newChannel(chanType string, direction channelDirection, extraData []byte) *channel {
+	// PSIPHON
+	// =======
+	// - Apply window size overrides and record channel stats.
+	atomic.AddInt64(&m.stats.channels, 1)
 	ch := &channel{
-		remoteWin:        window{Cond: newCond()},
-		myWindow:         uint32(getChannelWindowSize(chanType)),
+		remoteWin:        window{Cond: newCond(), stats: &m.stats},
+		myWindow:         uint32(m.getChannelWindowSize(chanType)),
 		pending:          newBuffer(),
 		extPending:       newBuffer(),
 		direction:        direction,
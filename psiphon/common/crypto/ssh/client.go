@@ -83,10 +83,34 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		c.Close()
 		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
 	}
-	conn.mux = newMux(conn.transport)
+	conn.mux = newMuxWithConfig(conn.transport, &fullConf.Config)
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
 }
 
+// PSIPHON
+// =======
+// ChannelStats returns aggregate flow control statistics for all channels
+// opened on the client connection.
+func (c *Client) ChannelStats() ChannelStats {
+	conn, ok := c.Conn.(*connection)
+	if !ok {
+		return ChannelStats{}
+	}
+	return conn.mux.stats.get()
+}
+
+// PSIPHON
+// =======
+// ReleaseBuffers discards the write packet buffers retained by the channels
+// opened on the client connection. Buffers are reallocated on demand.
+func (c *Client) ReleaseBuffers() {
+	conn, ok := c.Conn.(*connection)
+	if !ok {
+		return
+	}
+	conn.mux.releaseBuffers()
+}
+
 // clientHandshake performs the client side key exchange. See RFC 4253 Section
 // 7.
 func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) error {
@@ -11,6 +11,7 @@ import (
 	"io"
 	"math"
 	"sync"
+	"time"
 
 	_ "crypto/sha1"
 	_ "crypto/sha256"
@@ -201,6 +202,15 @@ type Config struct {
 	// The allowed MAC algorithms. If unspecified then a sensible default
 	// is used.
 	MACs []string
+
+	// PSIPHON
+	// =======
+	// ChannelWindowSize and PacketTunnelChannelWindowSize override the
+	// initial/max channel window sizes returned by getChannelWindowSize.
+	// When 0, the default size is used. Sizes less than channelMaxPacket
+	// are raised to channelMaxPacket.
+	ChannelWindowSize             int
+	PacketTunnelChannelWindowSize int
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -307,6 +317,13 @@ type window struct {
 	win          uint32 // RFC 4254 5.2 says the window size can grow to 2^32-1
 	writeWaiters int
 	closed       bool
+
+	// PSIPHON
+	// =======
+	// peak is the largest available window observed, and stats, when set,
+	// records window stalls and in-flight bytes for ChannelStats.
+	peak  uint32
+	stats *channelStats
 }
 
 // add adds win to the amount of window available
@@ -322,6 +339,9 @@ func (w *window) add(win uint32) bool {
 		return false
 	}
 	w.win += win
+	if w.win > w.peak {
+		w.peak = w.win
+	}
 	// It is unusual that multiple goroutines would be attempting to reserve
 	// window space, but not guaranteed. Use broadcast to notify all waiters
 	// that additional window is available.
@@ -347,6 +367,13 @@ func (w *window) reserve(win uint32) (uint32, error) {
 	w.L.Lock()
 	w.writeWaiters++
 	w.Broadcast()
+	if w.win == 0 && !w.closed && w.stats != nil {
+		stallStartTime := time.Now()
+		for w.win == 0 && !w.closed {
+			w.Wait()
+		}
+		w.stats.addStall(time.Since(stallStartTime))
+	}
 	for w.win == 0 && !w.closed {
 		w.Wait()
 	}
@@ -355,6 +382,9 @@ func (w *window) reserve(win uint32) (uint32, error) {
 		win = w.win
 	}
 	w.win -= win
+	if w.stats != nil {
+		w.stats.updateMaxInFlight(int64(w.peak - w.win))
+	}
 	if w.closed {
 		err = io.EOF
 	}
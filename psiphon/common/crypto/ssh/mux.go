@@ -11,6 +11,7 @@ import (
 	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // debugMux, if set, causes messages in the connection protocol to be
@@ -86,6 +87,15 @@ func (c *chanList) dropAll() []*channel {
 // mux represents the state for the SSH connection protocol, which
 // multiplexes many channels onto a single packet transport.
 type mux struct {
+	// PSIPHON
+	// =======
+	// stats contains 64-bit ints used with atomic operations and is placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	stats                         channelStats
+	channelWindowSize             int
+	packetTunnelChannelWindowSize int
+
 	conn     packetConn
 	chanList chanList
 
@@ -114,6 +124,16 @@ func (m *mux) Wait() error {
 
 // newMux returns a mux that runs over the given connection.
 func newMux(p packetConn) *mux {
+	return newMuxWithConfig(p, nil)
+}
+
+// PSIPHON
+// =======
+// newMuxWithConfig returns a mux that runs over the given connection and
+// applies any channel window size overrides in config. The overrides are
+// set before the mux loop starts, as incoming channels may be opened
+// immediately.
+func newMuxWithConfig(p packetConn, config *Config) *mux {
 	m := &mux{
 		conn:             p,
 		incomingChannels: make(chan NewChannel, chanSize),
@@ -121,6 +141,10 @@ func newMux(p packetConn) *mux {
 		incomingRequests: make(chan *Request, chanSize),
 		errCond:          newCond(),
 	}
+	if config != nil {
+		m.channelWindowSize = config.ChannelWindowSize
+		m.packetTunnelChannelWindowSize = config.PacketTunnelChannelWindowSize
+	}
 	if debugMux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
 	}
@@ -328,3 +352,94 @@ func (m *mux) openChannel(chanType string, extra []byte) (*channel, error) {
 		return nil, fmt.Errorf("ssh: unexpected packet in response to channel open: %T", msg)
 	}
 }
+
+// PSIPHON
+// =======
+// getChannelWindowSize returns the initial/max channel window size, applying
+// any override set in the mux config.
+func (m *mux) getChannelWindowSize(chanType string) int {
+
+	size := getChannelWindowSize(chanType)
+
+	override := m.channelWindowSize
+	if chanType == "tun@psiphon.ca" {
+		override = m.packetTunnelChannelWindowSize
+	}
+
+	if override > 0 {
+		size = override
+		if size < channelMaxPacket {
+			size = channelMaxPacket
+		}
+	}
+
+	return size
+}
+
+// PSIPHON
+// =======
+// releaseBuffers discards the write packet buffers retained by each open
+// channel. Buffers are reallocated on demand by subsequent writes. This
+// reduces the memory held by idle, long-lived channels.
+func (m *mux) releaseBuffers() {
+
+	m.chanList.Lock()
+	chans := make([]*channel, 0, len(m.chanList.chans))
+	for _, ch := range m.chanList.chans {
+		if ch != nil {
+			chans = append(chans, ch)
+		}
+	}
+	m.chanList.Unlock()
+
+	for _, ch := range chans {
+		ch.writeMu.Lock()
+		ch.packetPool = make(map[uint32][]byte)
+		ch.writeMu.Unlock()
+	}
+}
+
+// ChannelStats are aggregate flow control statistics for all channels
+// multiplexed over an SSH connection.
+//
+// WindowStalls is the number of writes which blocked waiting for the peer
+// to open the channel window, and WindowStallDuration is the total time
+// spent blocked. MaxInFlightBytes is the largest number of bytes sent on
+// any channel and not yet acknowledged by a window adjustment.
+type ChannelStats struct {
+	Channels            int64
+	WindowStalls        int64
+	WindowStallDuration time.Duration
+	MaxInFlightBytes    int64
+}
+
+type channelStats struct {
+	channels            int64
+	windowStalls        int64
+	windowStallDuration int64
+	maxInFlightBytes    int64
+}
+
+func (stats *channelStats) addStall(duration time.Duration) {
+	atomic.AddInt64(&stats.windowStalls, 1)
+	atomic.AddInt64(&stats.windowStallDuration, int64(duration))
+}
+
+func (stats *channelStats) updateMaxInFlight(inFlight int64) {
+	for {
+		max := atomic.LoadInt64(&stats.maxInFlightBytes)
+		if inFlight <= max ||
+			atomic.CompareAndSwapInt64(&stats.maxInFlightBytes, max, inFlight) {
+			return
+		}
+	}
+}
+
+func (stats *channelStats) get() ChannelStats {
+	return ChannelStats{
+		Channels:            atomic.LoadInt64(&stats.channels),
+		WindowStalls:        atomic.LoadInt64(&stats.windowStalls),
+		WindowStallDuration: time.Duration(atomic.LoadInt64(&stats.windowStallDuration)),
+		MaxInFlightBytes:    atomic.LoadInt64(&stats.maxInFlightBytes),
+	}
+}
@@ -491,6 +491,54 @@ func TestMuxMaxPacketSize(t *testing.T) {
 	}
 }
 
+// PSIPHON
+// =======
+// Test that releaseBuffers discards channel write buffers, and that
+// subsequent writes succeed.
+func TestMuxReleaseBuffers(t *testing.T) {
+	s, c, mux := channelPair(t)
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	magic := "hello world"
+
+	for i := 0; i < 2; i++ {
+
+		go func() {
+			_, err := c.Write([]byte(magic))
+			if err != nil {
+				t.Errorf("Write: %v", err)
+			}
+		}()
+
+		var buf [1024]byte
+		n, err := io.ReadFull(s, buf[:len(magic)])
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got := string(buf[:n]); got != magic {
+			t.Fatalf("got %q want %q", got, magic)
+		}
+
+		c.writeMu.Lock()
+		pooled := len(c.packetPool)
+		c.writeMu.Unlock()
+		if pooled != 1 {
+			t.Fatalf("unexpected pooled buffers: %d", pooled)
+		}
+
+		mux.releaseBuffers()
+
+		c.writeMu.Lock()
+		pooled = len(c.packetPool)
+		c.writeMu.Unlock()
+		if pooled != 0 {
+			t.Fatalf("unexpected pooled buffers after release: %d", pooled)
+		}
+	}
+}
+
 // Don't ship code with debug=true.
 func TestDebug(t *testing.T) {
 	if debugMux {
@@ -245,7 +245,7 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	if err != nil {
 		return nil, err
 	}
-	s.mux = newMux(s.transport)
+	s.mux = newMuxWithConfig(s.transport, &config.Config)
 	return perms, err
 }
 
@@ -58,6 +58,7 @@ type Conn struct {
 	maxWriteBytes   int
 	minDelay        time.Duration
 	maxDelay        time.Duration
+	splitTLSSNI     bool
 }
 
 // NewConn creates a new Conn.
@@ -81,16 +82,52 @@ func NewConn(
 	}
 }
 
+// EnableSplitTLSSNI causes the first write, when it is a TLS ClientHello
+// with a server_name extension, to be split into two TCP packets at a point
+// within the server name. This defeats DPI which inspects the SNI of only the
+// first packet. The split is applied before, and in addition to, any
+// fragmentation of the initial bytes. EnableSplitTLSSNI must be called
+// before the first Write.
+func (c *Conn) EnableSplitTLSSNI() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.splitTLSSNI = true
+}
+
 func (c *Conn) Write(buffer []byte) (int, error) {
 
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
-	if c.bytesFragmented >= c.bytesToFragment {
-		return c.Conn.Write(buffer)
+	totalBytesWritten := 0
+
+	if c.splitTLSSNI {
+		c.splitTLSSNI = false
+
+		splitOffset := getTLSSNISplitOffset(buffer)
+		if splitOffset > 0 {
+
+			bytesWritten, err := c.Conn.Write(buffer[:splitOffset])
+			totalBytesWritten += bytesWritten
+			if err != nil {
+				return totalBytesWritten, err
+			}
+
+			if c.noticeEmitter != nil && c.numNotices < MAX_FRAGMENTOR_NOTICES {
+				c.noticeEmitter(fmt.Sprintf(
+					"split TLS SNI %d bytes: %d", len(buffer), splitOffset))
+				c.numNotices += 1
+			}
+
+			buffer = buffer[splitOffset:]
+		}
 	}
 
-	totalBytesWritten := 0
+	if c.bytesFragmented >= c.bytesToFragment {
+		bytesWritten, err := c.Conn.Write(buffer)
+		return totalBytesWritten + bytesWritten, err
+	}
 
 	emitNotice := c.noticeEmitter != nil &&
 		c.numNotices < MAX_FRAGMENTOR_NOTICES
@@ -174,6 +211,92 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 	return totalBytesWritten, nil
 }
 
+// getTLSSNISplitOffset returns the offset of the midpoint of the server
+// name in a TLS ClientHello record, or 0 when the buffer doesn't contain a
+// ClientHello with a server_name extension.
+func getTLSSNISplitOffset(buffer []byte) int {
+
+	const (
+		recordTypeHandshake    = 0x16
+		handshakeTypeHello     = 0x01
+		extensionServerName    = 0x0000
+		serverNameTypeHostName = 0x00
+	)
+
+	readUint16 := func(offset int) (int, bool) {
+		if offset+2 > len(buffer) {
+			return 0, false
+		}
+		return int(buffer[offset])<<8 | int(buffer[offset+1]), true
+	}
+
+	// Record header (5), handshake header (4), client version (2), random (32)
+
+	if len(buffer) < 44 ||
+		buffer[0] != recordTypeHandshake ||
+		buffer[5] != handshakeTypeHello {
+		return 0
+	}
+
+	// Session ID
+
+	offset := 43
+	offset += 1 + int(buffer[offset])
+
+	// Cipher suites
+
+	length, ok := readUint16(offset)
+	if !ok {
+		return 0
+	}
+	offset += 2 + length
+
+	// Compression methods
+
+	if offset >= len(buffer) {
+		return 0
+	}
+	offset += 1 + int(buffer[offset])
+
+	// Extensions
+
+	length, ok = readUint16(offset)
+	if !ok {
+		return 0
+	}
+	offset += 2
+	end := offset + length
+	if end > len(buffer) {
+		end = len(buffer)
+	}
+
+	for offset+4 <= end {
+
+		extensionType, _ := readUint16(offset)
+		extensionLength, _ := readUint16(offset + 2)
+		offset += 4
+
+		if extensionType == extensionServerName {
+
+			// Server name list length (2), name type (1), name length (2)
+
+			if offset+5 > end || buffer[offset+2] != serverNameTypeHostName {
+				return 0
+			}
+			nameLength, _ := readUint16(offset + 3)
+			nameOffset := offset + 5
+			if nameLength < 2 || nameOffset+nameLength > end {
+				return 0
+			}
+			return nameOffset + nameLength/2
+		}
+
+		offset += extensionLength
+	}
+
+	return 0
+}
+
 func (c *Conn) Close() (err error) {
 	if !atomic.CompareAndSwapInt32(&c.isClosed, 0, 1) {
 		return nil
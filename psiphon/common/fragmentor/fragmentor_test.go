@@ -22,6 +22,7 @@ package fragmentor
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net"
@@ -114,3 +115,76 @@ func TestFragmentor(t *testing.T) {
 		t.Errorf("goroutine failed: %s", err)
 	}
 }
+
+type writeRecordingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (conn *writeRecordingConn) Write(b []byte) (int, error) {
+	conn.writes = append(conn.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (conn *writeRecordingConn) Close() error {
+	return nil
+}
+
+func TestSplitTLSSNI(t *testing.T) {
+
+	serverName := "www.example.org"
+
+	// Capture a ClientHello.
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		tlsConn := tls.Client(
+			clientConn, &tls.Config{ServerName: serverName})
+		tlsConn.Handshake()
+		clientConn.Close()
+	}()
+
+	clientHello := make([]byte, 16384)
+	n, err := serverConn.Read(clientHello)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	clientHello = clientHello[:n]
+
+	nameOffset := bytes.Index(clientHello, []byte(serverName))
+	if nameOffset == -1 {
+		t.Fatalf("server name not found")
+	}
+
+	splitOffset := getTLSSNISplitOffset(clientHello)
+	if splitOffset != nameOffset+len(serverName)/2 {
+		t.Fatalf("unexpected split offset: %d", splitOffset)
+	}
+
+	if getTLSSNISplitOffset([]byte("GET / HTTP/1.1\r\n\r\n")) != 0 {
+		t.Fatalf("unexpected split offset for non-TLS")
+	}
+
+	// The split applies only to the first write.
+
+	recordingConn := &writeRecordingConn{}
+
+	conn := NewConn(recordingConn, nil, 0, 1, 1, 0, 0)
+	conn.EnableSplitTLSSNI()
+
+	for i := 0; i < 2; i++ {
+		n, err = conn.Write(clientHello)
+		if err != nil || n != len(clientHello) {
+			t.Fatalf("Write failed: %d, %v", n, err)
+		}
+	}
+
+	if len(recordingConn.writes) != 3 ||
+		!bytes.Equal(recordingConn.writes[0], clientHello[:splitOffset]) ||
+		!bytes.Equal(recordingConn.writes[1], clientHello[splitOffset:]) ||
+		!bytes.Equal(recordingConn.writes[2], clientHello) {
+		t.Fatalf("unexpected writes: %d", len(recordingConn.writes))
+	}
+}
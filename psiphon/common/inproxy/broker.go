@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package inproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	BROKER_CLIENT_OFFER_PATH = "/client-offer"
+
+	brokerMaxResponseSize = 65536
+)
+
+// ClientOfferRequest is sent by a client to the broker to request a proxy.
+// The broker forwards the offer to a matched proxy, which relays the data
+// channel to DestinationAddress.
+type ClientOfferRequest struct {
+
+	// SessionID is the Psiphon client session ID. The broker and the proxy
+	// don't learn more about the client than this ID and the client's
+	// network address.
+	SessionID string `json:"session_id"`
+
+	// Offer is the client WebRTC SDP offer, including all gathered ICE
+	// candidates.
+	Offer string `json:"offer"`
+
+	// DestinationServerIP is the IP address of the Psiphon server to which
+	// the proxy is to relay. The broker must check that this is a Psiphon
+	// server, so that proxies can't be used to reach arbitrary
+	// destinations.
+	DestinationServerIP string `json:"destination_server_ip"`
+
+	// DestinationAddress is the address, "host:port", of the Psiphon server
+	// port to which the proxy is to relay.
+	DestinationAddress string `json:"destination_address"`
+
+	// NATType is the client NAT type, as discovered by DiscoverNATType, or
+	// blank when unknown. The broker may use the NAT type to match the client
+	// with a proxy with a compatible NAT type.
+	NATType string `json:"nat_type"`
+}
+
+// ClientOfferResponse is the broker response to a ClientOfferRequest.
+type ClientOfferResponse struct {
+
+	// ConnectionID identifies the relayed connection in broker, proxy, and
+	// Psiphon server logs.
+	ConnectionID string `json:"connection_id"`
+
+	// Answer is the proxy WebRTC SDP answer, including all gathered ICE
+	// candidates.
+	Answer string `json:"answer"`
+
+	// ProxyNATType is the matched proxy's NAT type, or blank when unknown.
+	ProxyNATType string `json:"proxy_nat_type"`
+
+	// NoProxy indicates that the broker has no available proxy.
+	NoProxy bool `json:"no_proxy"`
+}
+
+// doClientOfferRequest sends a ClientOfferRequest to the broker at
+// brokerURL and returns the broker response.
+func doClientOfferRequest(
+	ctx context.Context,
+	httpClient *http.Client,
+	brokerURL string,
+	offerRequest *ClientOfferRequest) (*ClientOfferResponse, error) {
+
+	requestBody, err := json.Marshal(offerRequest)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request, err := http.NewRequest(
+		"POST", brokerURL+BROKER_CLIENT_OFFER_PATH, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected broker response status code: %d", response.StatusCode))
+	}
+
+	responseBody, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, brokerMaxResponseSize))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var offerResponse *ClientOfferResponse
+	err = json.Unmarshal(responseBody, &offerResponse)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if offerResponse == nil {
+		return nil, common.ContextError(errors.New("invalid broker response"))
+	}
+
+	if offerResponse.NoProxy {
+		return nil, common.ContextError(errors.New("no in-proxy available"))
+	}
+
+	if offerResponse.ConnectionID == "" || offerResponse.Answer == "" {
+		return nil, common.ContextError(errors.New("incomplete broker response"))
+	}
+
+	return offerResponse, nil
+}
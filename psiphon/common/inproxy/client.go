@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+
+Package inproxy implements the client side of in-proxy, a brokered peer
+relay mode in which volunteer proxies relay the first hop of a Psiphon
+tunnel over WebRTC data channels.
+
+A client dial proceeds as follows:
+
+1. The client creates a WebRTC peer connection and an SDP offer. NAT
+traversal is performed by ICE, using the configured STUN servers, and all
+ICE candidates are gathered before the offer is sent.
+
+2. The client sends the offer, along with the destination Psiphon server, to
+the broker. The broker matches the client with an available proxy, forwards
+the offer, and returns the proxy's SDP answer.
+
+3. The client applies the answer and waits for the data channel to open. The
+proxy relays the data channel to the destination Psiphon server, and the
+client then runs obfuscated SSH over the data channel as usual.
+
+The WebRTC stack is provided by the host application through the
+WebRTCProvider interface, as platforms such as Android and iOS include
+native WebRTC libraries.
+
+*/
+package inproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// WebRTCProvider creates WebRTC peer connections.
+type WebRTCProvider interface {
+
+	// NewPeerConnection creates a new peer connection which uses the
+	// specified STUN servers, in the form "stun:host:port", for ICE.
+	NewPeerConnection(ICEServers []string) (WebRTCPeerConnection, error)
+}
+
+// WebRTCPeerConnection is a WebRTC peer connection with a single reliable,
+// ordered data channel.
+type WebRTCPeerConnection interface {
+
+	// CreateOffer creates the data channel and an SDP offer. CreateOffer
+	// returns once ICE candidate gathering is complete, and the returned
+	// offer includes all gathered candidates.
+	CreateOffer(ctx context.Context) (string, error)
+
+	// SetAnswer applies the remote SDP answer.
+	SetAnswer(answer string) error
+
+	// AwaitDataChannel blocks until the data channel is open, and returns a
+	// net.Conn which reads from and writes to the data channel.
+	AwaitDataChannel(ctx context.Context) (net.Conn, error)
+
+	// Close closes the peer connection and its data channel.
+	Close() error
+}
+
+// ClientConfig specifies an in-proxy client dial.
+type ClientConfig struct {
+
+	// WebRTCProvider creates the WebRTC peer connection.
+	WebRTCProvider WebRTCProvider
+
+	// ICEServers are the STUN servers used for NAT traversal.
+	ICEServers []string
+
+	// BrokerURL is the base URL of the broker.
+	BrokerURL string
+
+	// BrokerHTTPClient is used to make broker requests.
+	BrokerHTTPClient *http.Client
+
+	// SessionID is the Psiphon client session ID.
+	SessionID string
+
+	// DestinationServerIP and DestinationAddress specify the Psiphon server
+	// to which the proxy is to relay. See ClientOfferRequest.
+	DestinationServerIP string
+	DestinationAddress  string
+
+	// NATType is the client NAT type, or blank when unknown. See
+	// DiscoverNATType.
+	NATType string
+}
+
+// ClientConn is a net.Conn over an in-proxy WebRTC data channel.
+type ClientConn struct {
+	net.Conn
+	peerConnection WebRTCPeerConnection
+	connectionID   string
+	closeOnce      sync.Once
+}
+
+// Dial establishes an in-proxy connection to the destination Psiphon
+// server. Dial returns once the data channel is open; the dial may be
+// interrupted by cancelling ctx.
+func Dial(ctx context.Context, config *ClientConfig) (*ClientConn, error) {
+
+	if config.WebRTCProvider == nil {
+		return nil, common.ContextError(errors.New("missing WebRTC provider"))
+	}
+
+	peerConnection, err := config.WebRTCProvider.NewPeerConnection(config.ICEServers)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	conn, err := dial(ctx, config, peerConnection)
+	if err != nil {
+		peerConnection.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
+
+func dial(
+	ctx context.Context,
+	config *ClientConfig,
+	peerConnection WebRTCPeerConnection) (*ClientConn, error) {
+
+	offer, err := peerConnection.CreateOffer(ctx)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	offerResponse, err := doClientOfferRequest(
+		ctx,
+		config.BrokerHTTPClient,
+		config.BrokerURL,
+		&ClientOfferRequest{
+			SessionID:           config.SessionID,
+			Offer:               offer,
+			DestinationServerIP: config.DestinationServerIP,
+			DestinationAddress:  config.DestinationAddress,
+			NATType:             config.NATType,
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = peerConnection.SetAnswer(offerResponse.Answer)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dataChannelConn, err := peerConnection.AwaitDataChannel(ctx)
+	if err != nil {
+		// Include the NAT types, which may explain why the peers couldn't
+		// connect.
+		return nil, common.ContextError(
+			fmt.Errorf("%s (client NAT type: %s, proxy NAT type: %s)",
+				err, natTypeOrUnknown(config.NATType), natTypeOrUnknown(offerResponse.ProxyNATType)))
+	}
+
+	return &ClientConn{
+		Conn:           dataChannelConn,
+		peerConnection: peerConnection,
+		connectionID:   offerResponse.ConnectionID,
+	}, nil
+}
+
+func natTypeOrUnknown(natType string) string {
+	if natType == "" {
+		return "unknown"
+	}
+	return natType
+}
+
+// ConnectionID returns the broker-assigned connection ID.
+func (conn *ClientConn) ConnectionID() string {
+	return conn.connectionID
+}
+
+// Close closes the data channel and the peer connection.
+func (conn *ClientConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		err = conn.Conn.Close()
+		conn.peerConnection.Close()
+	})
+	return err
+}
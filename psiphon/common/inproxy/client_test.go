@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package inproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebRTC simulates WebRTC peer connections, with data channels
+// implemented as net.Pipes. The test broker plays the role of the proxy,
+// echoing data channel traffic.
+type testWebRTC struct {
+	mutex        sync.Mutex
+	nextID       int
+	dataChannels map[string]net.Conn
+	closed       map[string]bool
+	failOffer    bool
+}
+
+func newTestWebRTC() *testWebRTC {
+	return &testWebRTC{
+		dataChannels: make(map[string]net.Conn),
+		closed:       make(map[string]bool),
+	}
+}
+
+func (w *testWebRTC) NewPeerConnection(ICEServers []string) (WebRTCPeerConnection, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.nextID += 1
+	return &testPeerConnection{webRTC: w, ID: strings.Repeat("x", w.nextID)}, nil
+}
+
+// answer is called by the test broker.
+func (w *testWebRTC) answer(offer string) string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	clientConn, proxyConn := net.Pipe()
+	w.dataChannels[offer] = clientConn
+	go func() {
+		io.Copy(proxyConn, proxyConn)
+		proxyConn.Close()
+	}()
+	return "answer-" + offer
+}
+
+type testPeerConnection struct {
+	webRTC *testWebRTC
+	ID     string
+	answer string
+}
+
+func (c *testPeerConnection) CreateOffer(ctx context.Context) (string, error) {
+	if c.webRTC.failOffer {
+		return "", errors.New("ICE gathering failed")
+	}
+	return c.ID, nil
+}
+
+func (c *testPeerConnection) SetAnswer(answer string) error {
+	c.answer = answer
+	return nil
+}
+
+func (c *testPeerConnection) AwaitDataChannel(ctx context.Context) (net.Conn, error) {
+	c.webRTC.mutex.Lock()
+	defer c.webRTC.mutex.Unlock()
+	conn, ok := c.webRTC.dataChannels[c.ID]
+	if !ok || c.answer != "answer-"+c.ID {
+		return nil, errors.New("data channel failed")
+	}
+	return conn, nil
+}
+
+func (c *testPeerConnection) Close() error {
+	c.webRTC.mutex.Lock()
+	defer c.webRTC.mutex.Unlock()
+	c.webRTC.closed[c.ID] = true
+	return nil
+}
+
+func TestDial(t *testing.T) {
+
+	webRTC := newTestWebRTC()
+
+	noProxy := false
+	destinationAddress := "192.0.2.1:443"
+
+	broker := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != BROKER_CLIENT_OFFER_PATH {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var request ClientOfferRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil || request.DestinationAddress != destinationAddress {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			response := &ClientOfferResponse{NoProxy: true}
+			if !noProxy {
+				answer := "unmatched"
+				if request.NATType != "APDM/APDF" {
+					answer = webRTC.answer(request.Offer)
+				}
+				response = &ClientOfferResponse{
+					ConnectionID: "connection-" + request.Offer,
+					Answer:       answer,
+					ProxyNATType: "ADM/ADF",
+				}
+			}
+			json.NewEncoder(w).Encode(response)
+		}))
+	defer broker.Close()
+
+	makeConfig := func(brokerURL string) *ClientConfig {
+		return &ClientConfig{
+			WebRTCProvider:      webRTC,
+			ICEServers:          []string{"stun:192.0.2.2:3478"},
+			BrokerURL:           brokerURL,
+			BrokerHTTPClient:    broker.Client(),
+			SessionID:           "session",
+			DestinationServerIP: "192.0.2.1",
+			DestinationAddress:  destinationAddress,
+		}
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	// Successful dial, with data relayed over the data channel
+
+	conn, err := Dial(ctx, makeConfig(broker.URL))
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	if conn.ConnectionID() != "connection-x" {
+		t.Fatalf("unexpected connection ID: %s", conn.ConnectionID())
+	}
+
+	message := []byte("in-proxy")
+	go conn.Write(message)
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if !bytes.Equal(message, received) {
+		t.Fatalf("unexpected relayed data")
+	}
+
+	conn.Close()
+	conn.Close()
+
+	if !webRTC.closed["x"] {
+		t.Fatalf("peer connection not closed")
+	}
+
+	// Failed dials close the peer connection
+
+	noProxy = true
+	_, err = Dial(ctx, makeConfig(broker.URL))
+	if err == nil || !strings.Contains(err.Error(), "no in-proxy available") {
+		t.Fatalf("unexpected Dial result: %v", err)
+	}
+	noProxy = false
+
+	_, err = Dial(ctx, makeConfig(broker.URL+"/invalid"))
+	if err == nil {
+		t.Fatalf("unexpected Dial success")
+	}
+
+	webRTC.failOffer = true
+	_, err = Dial(ctx, makeConfig(broker.URL))
+	if err == nil {
+		t.Fatalf("unexpected Dial success")
+	}
+	webRTC.failOffer = false
+
+	// Data channel failures report the client and proxy NAT types
+
+	config := makeConfig(broker.URL)
+	config.NATType = "APDM/APDF"
+	_, err = Dial(ctx, config)
+	if err == nil ||
+		!strings.Contains(err.Error(), "client NAT type: APDM/APDF, proxy NAT type: ADM/ADF") {
+		t.Fatalf("unexpected Dial result: %v", err)
+	}
+
+	for _, ID := range []string{"xx", "xxx", "xxxx", "xxxxx"} {
+		if !webRTC.closed[ID] {
+			t.Fatalf("peer connection not closed: %s", ID)
+		}
+	}
+
+	_, err = Dial(ctx, &ClientConfig{})
+	if err == nil {
+		t.Fatalf("unexpected Dial success")
+	}
+}
@@ -0,0 +1,490 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package inproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// NAT type discovery follows RFC 5780, "NAT Behavior Discovery Using
+// Session Traversal Utilities for NAT (STUN)". Discovery requires a STUN
+// server which has two IP addresses and ports and which supports the
+// OTHER-ADDRESS and CHANGE-REQUEST attributes.
+//
+// The NAT type indicates whether direct WebRTC connections between a client
+// and a proxy are likely to succeed. In particular, when both peers have
+// address-dependent mapping ("symmetric NAT"), hole punching fails.
+
+// NATMapping is the NAT mapping behavior, RFC 5780 section 4.3.
+type NATMapping int
+
+const (
+	NATMappingUnknown NATMapping = iota
+	NATMappingNone
+	NATMappingEndpointIndependent
+	NATMappingAddressDependent
+	NATMappingAddressPortDependent
+)
+
+func (m NATMapping) String() string {
+	switch m {
+	case NATMappingNone:
+		return "none"
+	case NATMappingEndpointIndependent:
+		return "EIM"
+	case NATMappingAddressDependent:
+		return "ADM"
+	case NATMappingAddressPortDependent:
+		return "APDM"
+	}
+	return "unknown"
+}
+
+// IsDependent indicates address-dependent or address-and-port-dependent
+// mapping, where the peer can't learn the mapped address to use for it
+// via STUN.
+func (m NATMapping) IsDependent() bool {
+	return m == NATMappingAddressDependent || m == NATMappingAddressPortDependent
+}
+
+// NATFiltering is the NAT filtering behavior, RFC 5780 section 4.4.
+type NATFiltering int
+
+const (
+	NATFilteringUnknown NATFiltering = iota
+	NATFilteringNone
+	NATFilteringEndpointIndependent
+	NATFilteringAddressDependent
+	NATFilteringAddressPortDependent
+)
+
+func (f NATFiltering) String() string {
+	switch f {
+	case NATFilteringNone:
+		return "none"
+	case NATFilteringEndpointIndependent:
+		return "EIF"
+	case NATFilteringAddressDependent:
+		return "ADF"
+	case NATFilteringAddressPortDependent:
+		return "APDF"
+	}
+	return "unknown"
+}
+
+// NATType is the NAT mapping and filtering behavior.
+type NATType struct {
+	Mapping   NATMapping
+	Filtering NATFiltering
+}
+
+// String returns a representation of the NAT type, such as "EIM/APDF",
+// suitable for notices and stats.
+func (t NATType) String() string {
+	return t.Mapping.String() + "/" + t.Filtering.String()
+}
+
+// NATTraversalCompatible indicates whether a direct connection between
+// peers with the specified NAT types is expected to succeed. When either
+// NAT type is unknown, NATTraversalCompatible returns true.
+//
+// When a peer has dependent mapping, the mapped port used for the other
+// peer differs from the port discovered via STUN, so the other peer's
+// packets reach the mapped port only when the other peer's NAT doesn't
+// filter by port.
+func NATTraversalCompatible(a, b NATType) bool {
+
+	if a.Mapping == NATMappingUnknown || b.Mapping == NATMappingUnknown {
+		return true
+	}
+
+	if a.Mapping.IsDependent() && b.Mapping.IsDependent() {
+		return false
+	}
+
+	if a.Mapping.IsDependent() && b.Filtering == NATFilteringAddressPortDependent ||
+		b.Mapping.IsDependent() && a.Filtering == NATFilteringAddressPortDependent {
+		return false
+	}
+
+	return true
+}
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest         = 0x0001
+	stunBindingSuccessResponse = 0x0101
+
+	stunAttributeMappedAddress    = 0x0001
+	stunAttributeChangeRequest    = 0x0003
+	stunAttributeChangedAddress   = 0x0005
+	stunAttributeXORMappedAddress = 0x0020
+	stunAttributeOtherAddress     = 0x802C
+
+	stunChangeIP   = 0x04
+	stunChangePort = 0x02
+
+	stunRetransmitInterval = 500 * time.Millisecond
+	stunMaxMessageSize     = 1500
+)
+
+// stunResponse is a parsed STUN Binding success response.
+type stunResponse struct {
+	mappedAddress *net.UDPAddr
+	otherAddress  *net.UDPAddr
+}
+
+// DiscoverNATType performs RFC 5780 NAT mapping and filtering tests using
+// the STUN server at serverAddress. All tests are sent from conn, which
+// should be an unconnected UDP socket. testTimeout is the time to wait for
+// each test response; filtering tests expect timeouts, so discovery takes at
+// least 2*testTimeout when the NAT filters.
+func DiscoverNATType(
+	ctx context.Context,
+	conn net.PacketConn,
+	serverAddress *net.UDPAddr,
+	testTimeout time.Duration) (NATType, error) {
+
+	natType := NATType{}
+
+	// Test I: the mapped address for the primary server address.
+
+	response, err := doSTUNBindingRequest(ctx, conn, serverAddress, 0, testTimeout)
+	if err != nil {
+		return natType, common.ContextError(err)
+	}
+	if response == nil {
+		return natType, common.ContextError(errors.New("no STUN response"))
+	}
+	if response.otherAddress == nil {
+		return natType, common.ContextError(errors.New("STUN server doesn't support RFC 5780"))
+	}
+
+	mappedAddress := response.mappedAddress
+	otherAddress := response.otherAddress
+
+	if isLocalAddress(conn.LocalAddr(), mappedAddress) {
+
+		natType.Mapping = NATMappingNone
+
+	} else {
+
+		// Test II: the mapped address for the alternate server IP address and
+		// the primary port.
+
+		response, err = doSTUNBindingRequest(
+			ctx, conn,
+			&net.UDPAddr{IP: otherAddress.IP, Port: serverAddress.Port},
+			0, testTimeout)
+		if err != nil {
+			return natType, common.ContextError(err)
+		}
+
+		if response != nil && equalUDPAddr(response.mappedAddress, mappedAddress) {
+
+			natType.Mapping = NATMappingEndpointIndependent
+
+		} else if response != nil {
+
+			mappedAddress = response.mappedAddress
+
+			// Test III: the mapped address for the alternate server IP
+			// address and port.
+
+			response, err = doSTUNBindingRequest(
+				ctx, conn, otherAddress, 0, testTimeout)
+			if err != nil {
+				return natType, common.ContextError(err)
+			}
+
+			if response != nil {
+				if equalUDPAddr(response.mappedAddress, mappedAddress) {
+					natType.Mapping = NATMappingAddressDependent
+				} else {
+					natType.Mapping = NATMappingAddressPortDependent
+				}
+			}
+		}
+	}
+
+	// Filtering Test II: request a response from the alternate IP address
+	// and port.
+
+	response, err = doSTUNBindingRequest(
+		ctx, conn, serverAddress, stunChangeIP|stunChangePort, testTimeout)
+	if err != nil {
+		return natType, common.ContextError(err)
+	}
+
+	if response != nil {
+
+		if natType.Mapping == NATMappingNone {
+			natType.Filtering = NATFilteringNone
+		} else {
+			natType.Filtering = NATFilteringEndpointIndependent
+		}
+
+	} else {
+
+		// Filtering Test III: request a response from the alternate port.
+
+		response, err = doSTUNBindingRequest(
+			ctx, conn, serverAddress, stunChangePort, testTimeout)
+		if err != nil {
+			return natType, common.ContextError(err)
+		}
+
+		if response != nil {
+			natType.Filtering = NATFilteringAddressDependent
+		} else {
+			natType.Filtering = NATFilteringAddressPortDependent
+		}
+	}
+
+	return natType, nil
+}
+
+// doSTUNBindingRequest sends a Binding request, with retransmissions, and
+// waits for the corresponding response. A nil response with no error
+// indicates a timeout.
+func doSTUNBindingRequest(
+	ctx context.Context,
+	conn net.PacketConn,
+	serverAddress *net.UDPAddr,
+	changeRequest uint32,
+	timeout time.Duration) (*stunResponse, error) {
+
+	transactionID := make([]byte, 12)
+	_, err := rand.Read(transactionID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request := makeSTUNBindingRequest(transactionID, changeRequest)
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, stunMaxMessageSize)
+
+	for {
+
+		if ctx.Err() != nil {
+			return nil, common.ContextError(ctx.Err())
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, nil
+		}
+
+		_, err := conn.WriteTo(request, serverAddress)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		readDeadline := now.Add(stunRetransmitInterval)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		for {
+			n, _, err := conn.ReadFrom(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, common.ContextError(err)
+			}
+
+			// Responses to earlier transactions, including late responses
+			// to filtering tests, are discarded.
+			response, err := parseSTUNBindingResponse(buffer[:n], transactionID)
+			if err == nil {
+				return response, nil
+			}
+		}
+	}
+}
+
+func makeSTUNBindingRequest(transactionID []byte, changeRequest uint32) []byte {
+
+	attributesSize := 0
+	if changeRequest != 0 {
+		attributesSize = 8
+	}
+
+	message := make([]byte, stunHeaderSize+attributesSize)
+	binary.BigEndian.PutUint16(message[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(message[2:4], uint16(attributesSize))
+	binary.BigEndian.PutUint32(message[4:8], stunMagicCookie)
+	copy(message[8:20], transactionID)
+
+	if changeRequest != 0 {
+		binary.BigEndian.PutUint16(message[20:22], stunAttributeChangeRequest)
+		binary.BigEndian.PutUint16(message[22:24], 4)
+		binary.BigEndian.PutUint32(message[24:28], changeRequest)
+	}
+
+	return message
+}
+
+func parseSTUNBindingResponse(message, transactionID []byte) (*stunResponse, error) {
+
+	if len(message) < stunHeaderSize ||
+		binary.BigEndian.Uint16(message[0:2]) != stunBindingSuccessResponse ||
+		binary.BigEndian.Uint32(message[4:8]) != stunMagicCookie ||
+		!bytes.Equal(message[8:20], transactionID) {
+
+		return nil, common.ContextError(errors.New("unexpected STUN message"))
+	}
+
+	length := int(binary.BigEndian.Uint16(message[2:4]))
+	if stunHeaderSize+length > len(message) {
+		return nil, common.ContextError(errors.New("truncated STUN message"))
+	}
+
+	response := &stunResponse{}
+
+	var mappedAddress, otherAddress *net.UDPAddr
+
+	attributes := message[stunHeaderSize : stunHeaderSize+length]
+	for len(attributes) >= 4 {
+
+		attributeType := binary.BigEndian.Uint16(attributes[0:2])
+		attributeLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attributeLength > len(attributes) {
+			return nil, common.ContextError(errors.New("truncated STUN attribute"))
+		}
+		value := attributes[4 : 4+attributeLength]
+
+		switch attributeType {
+		case stunAttributeXORMappedAddress:
+			response.mappedAddress = parseSTUNAddress(value, message[4:20])
+		case stunAttributeMappedAddress:
+			mappedAddress = parseSTUNAddress(value, nil)
+		case stunAttributeOtherAddress:
+			response.otherAddress = parseSTUNAddress(value, nil)
+		case stunAttributeChangedAddress:
+			otherAddress = parseSTUNAddress(value, nil)
+		}
+
+		// Attributes are padded to a multiple of 4 bytes.
+		padded := (4 + attributeLength + 3) &^ 3
+		if padded > len(attributes) {
+			break
+		}
+		attributes = attributes[padded:]
+	}
+
+	// Fall back to the legacy RFC 3489 attributes.
+	if response.mappedAddress == nil {
+		response.mappedAddress = mappedAddress
+	}
+	if response.otherAddress == nil {
+		response.otherAddress = otherAddress
+	}
+
+	if response.mappedAddress == nil {
+		return nil, common.ContextError(errors.New("missing mapped address"))
+	}
+
+	return response, nil
+}
+
+// parseSTUNAddress parses a STUN address attribute value. When xorKey, the
+// magic cookie and transaction ID, is not nil, the address is XOR-encoded.
+func parseSTUNAddress(value, xorKey []byte) *net.UDPAddr {
+
+	if len(value) < 4 {
+		return nil
+	}
+
+	var IPLength int
+	switch value[1] {
+	case 0x01:
+		IPLength = net.IPv4len
+	case 0x02:
+		IPLength = net.IPv6len
+	default:
+		return nil
+	}
+
+	if len(value) < 4+IPLength {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	IP := make(net.IP, IPLength)
+	copy(IP, value[4:4+IPLength])
+
+	if xorKey != nil {
+		port ^= binary.BigEndian.Uint16(xorKey[0:2])
+		for i := range IP {
+			IP[i] ^= xorKey[i]
+		}
+	}
+
+	return &net.UDPAddr{IP: IP, Port: int(port)}
+}
+
+func equalUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// isLocalAddress checks if the mapped address is the local socket address,
+// indicating there is no NAT.
+func isLocalAddress(localAddr net.Addr, mappedAddress *net.UDPAddr) bool {
+
+	localUDPAddr, ok := localAddr.(*net.UDPAddr)
+	if !ok || localUDPAddr.Port != mappedAddress.Port {
+		return false
+	}
+
+	if len(localUDPAddr.IP) > 0 && !localUDPAddr.IP.IsUnspecified() {
+		return localUDPAddr.IP.Equal(mappedAddress.IP)
+	}
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, interfaceAddr := range interfaceAddrs {
+		if IPNet, ok := interfaceAddr.(*net.IPNet); ok && IPNet.IP.Equal(mappedAddress.IP) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package inproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoverNATType(t *testing.T) {
+
+	testCases := []struct {
+		mapping   NATMapping
+		filtering NATFiltering
+	}{
+		{NATMappingNone, NATFilteringNone},
+		{NATMappingEndpointIndependent, NATFilteringEndpointIndependent},
+		{NATMappingEndpointIndependent, NATFilteringAddressDependent},
+		{NATMappingAddressDependent, NATFilteringAddressPortDependent},
+		{NATMappingAddressPortDependent, NATFilteringAddressPortDependent},
+	}
+
+	for _, testCase := range testCases {
+
+		expected := NATType{Mapping: testCase.mapping, Filtering: testCase.filtering}
+
+		t.Run(expected.String(), func(t *testing.T) {
+
+			serverAddress, stop := startTestSTUNServer(t, testCase.mapping, testCase.filtering)
+			defer stop()
+
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			if err != nil {
+				t.Fatalf("ListenUDP failed: %s", err)
+			}
+			defer conn.Close()
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancelFunc()
+
+			natType, err := DiscoverNATType(ctx, conn, serverAddress, 250*time.Millisecond)
+			if err != nil {
+				t.Fatalf("DiscoverNATType failed: %s", err)
+			}
+
+			if natType != expected {
+				t.Fatalf("unexpected NAT type: %s", natType)
+			}
+		})
+	}
+}
+
+func TestNATTraversalCompatible(t *testing.T) {
+
+	EIM_EIF := NATType{NATMappingEndpointIndependent, NATFilteringEndpointIndependent}
+	EIM_APDF := NATType{NATMappingEndpointIndependent, NATFilteringAddressPortDependent}
+	APDM_ADF := NATType{NATMappingAddressPortDependent, NATFilteringAddressDependent}
+	APDM_APDF := NATType{NATMappingAddressPortDependent, NATFilteringAddressPortDependent}
+	unknown := NATType{}
+
+	testCases := []struct {
+		a, b     NATType
+		expected bool
+	}{
+		{EIM_EIF, EIM_EIF, true},
+		{EIM_APDF, EIM_APDF, true},
+		{EIM_EIF, APDM_APDF, true},
+		{EIM_APDF, APDM_ADF, false},
+		{APDM_ADF, EIM_APDF, false},
+		{APDM_ADF, APDM_ADF, false},
+		{unknown, APDM_APDF, true},
+	}
+
+	for _, testCase := range testCases {
+		if NATTraversalCompatible(testCase.a, testCase.b) != testCase.expected {
+			t.Errorf("unexpected result for %s, %s", testCase.a, testCase.b)
+		}
+	}
+}
+
+// startTestSTUNServer starts an RFC 5780 STUN server listening on two
+// loopback IP addresses and two ports. The server simulates a NAT with the
+// specified behavior between the client and the server: reported mapped
+// addresses follow the mapping behavior, and responses which the NAT would
+// filter are dropped.
+func startTestSTUNServer(
+	t *testing.T,
+	mapping NATMapping,
+	filtering NATFiltering) (*net.UDPAddr, func()) {
+
+	IPs := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+
+	var conns [2][2]*net.UDPConn
+
+	for attempt := 0; ; attempt++ {
+		ports := [2]int{}
+		ok := true
+		for i := 0; i < 2 && ok; i++ {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: IPs[0]})
+			if err != nil {
+				t.Fatalf("ListenUDP failed: %s", err)
+			}
+			conns[0][i] = conn
+			ports[i] = conn.LocalAddr().(*net.UDPAddr).Port
+			conns[1][i], err = net.ListenUDP("udp4", &net.UDPAddr{IP: IPs[1], Port: ports[i]})
+			ok = err == nil
+		}
+		if ok {
+			break
+		}
+		for _, pair := range conns {
+			for _, conn := range pair {
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}
+		conns = [2][2]*net.UDPConn{}
+		if attempt > 10 {
+			t.Fatalf("failed to listen on test STUN server ports")
+		}
+	}
+
+	otherAddress := conns[1][1].LocalAddr().(*net.UDPAddr)
+
+	handle := func(IPIndex, portIndex int) {
+		conn := conns[IPIndex][portIndex]
+		buffer := make([]byte, stunMaxMessageSize)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request := buffer[:n]
+			if n < stunHeaderSize ||
+				binary.BigEndian.Uint16(request[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			var changeRequest uint32
+			if n >= stunHeaderSize+8 &&
+				binary.BigEndian.Uint16(request[20:22]) == stunAttributeChangeRequest {
+				changeRequest = binary.BigEndian.Uint32(request[24:28])
+			}
+
+			changeIP := changeRequest&stunChangeIP != 0
+			changePort := changeRequest&stunChangePort != 0
+
+			if (filtering == NATFilteringAddressDependent && changeIP) ||
+				(filtering == NATFilteringAddressPortDependent && (changeIP || changePort)) {
+				continue
+			}
+
+			mappedAddress := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 10000}
+			switch mapping {
+			case NATMappingNone:
+				mappedAddress = clientAddr
+			case NATMappingAddressDependent:
+				mappedAddress.Port += IPIndex
+			case NATMappingAddressPortDependent:
+				mappedAddress.Port += 2*IPIndex + portIndex
+			}
+
+			responseIPIndex, responsePortIndex := IPIndex, portIndex
+			if changeIP {
+				responseIPIndex ^= 1
+			}
+			if changePort {
+				responsePortIndex ^= 1
+			}
+
+			response := makeTestSTUNBindingResponse(
+				request[8:20], mappedAddress, otherAddress)
+
+			conns[responseIPIndex][responsePortIndex].WriteToUDP(response, clientAddr)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			go handle(i, j)
+		}
+	}
+
+	stop := func() {
+		for _, pair := range conns {
+			for _, conn := range pair {
+				conn.Close()
+			}
+		}
+	}
+
+	return conns[0][0].LocalAddr().(*net.UDPAddr), stop
+}
+
+func makeTestSTUNBindingResponse(
+	transactionID []byte, mappedAddress, otherAddress *net.UDPAddr) []byte {
+
+	encodeAddress := func(attributeType uint16, address *net.UDPAddr, xor bool) []byte {
+		attribute := make([]byte, 12)
+		binary.BigEndian.PutUint16(attribute[0:2], attributeType)
+		binary.BigEndian.PutUint16(attribute[2:4], 8)
+		attribute[5] = 0x01
+		port := uint16(address.Port)
+		IP := append(net.IP(nil), address.IP.To4()...)
+		if xor {
+			port ^= stunMagicCookie >> 16
+			var cookie [4]byte
+			binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+			for i := range IP {
+				IP[i] ^= cookie[i]
+			}
+		}
+		binary.BigEndian.PutUint16(attribute[6:8], port)
+		copy(attribute[8:12], IP)
+		return attribute
+	}
+
+	attributes := append(
+		encodeAddress(stunAttributeXORMappedAddress, mappedAddress, true),
+		encodeAddress(stunAttributeOtherAddress, otherAddress, false)...)
+
+	message := make([]byte, stunHeaderSize, stunHeaderSize+len(attributes))
+	binary.BigEndian.PutUint16(message[0:2], stunBindingSuccessResponse)
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(attributes)))
+	binary.BigEndian.PutUint32(message[4:8], stunMagicCookie)
+	copy(message[8:20], transactionID)
+
+	return append(message, attributes...)
+}
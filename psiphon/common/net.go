@@ -358,3 +358,103 @@ func (conn *ActivityMonitoredConn) IsClosed() bool {
 	}
 	return closer.IsClosed()
 }
+
+// IdleTimeoutConn wraps a net.Conn and closes the conn when no data is read
+// or written for the specified timeout period. Unlike ActivityMonitoredConn,
+// IdleTimeoutConn doesn't depend on deadline support in the underlying conn,
+// and so may be used with conns, such as SSH channel conns, which don't
+// support deadlines.
+//
+// When set, onIdle is called once when the conn is closed due to the idle
+// timeout. onIdle may be used to close other resources, such as the peer
+// conn in a relay.
+type IdleTimeoutConn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	lastActivityTime int64
+	net.Conn
+	timeout time.Duration
+	onIdle  func()
+	mutex   sync.Mutex
+	timer   *time.Timer
+	closed  bool
+}
+
+// NewIdleTimeoutConn creates a new IdleTimeoutConn. timeout must be > 0.
+func NewIdleTimeoutConn(
+	conn net.Conn, timeout time.Duration, onIdle func()) *IdleTimeoutConn {
+
+	idleConn := &IdleTimeoutConn{
+		lastActivityTime: int64(monotime.Now()),
+		Conn:             conn,
+		timeout:          timeout,
+		onIdle:           onIdle,
+	}
+
+	idleConn.timer = time.AfterFunc(timeout, idleConn.checkIdle)
+
+	return idleConn
+}
+
+func (conn *IdleTimeoutConn) checkIdle() {
+
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.mutex.Unlock()
+		return
+	}
+
+	idleTime := monotime.Since(
+		monotime.Time(atomic.LoadInt64(&conn.lastActivityTime)))
+	if idleTime < conn.timeout {
+		conn.timer.Reset(conn.timeout - idleTime)
+		conn.mutex.Unlock()
+		return
+	}
+
+	conn.closed = true
+	conn.mutex.Unlock()
+
+	conn.Conn.Close()
+	if conn.onIdle != nil {
+		conn.onIdle()
+	}
+}
+
+func (conn *IdleTimeoutConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastActivityTime, int64(monotime.Now()))
+	}
+	// Note: no context error to preserve error type
+	return n, err
+}
+
+func (conn *IdleTimeoutConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastActivityTime, int64(monotime.Now()))
+	}
+	// Note: no context error to preserve error type
+	return n, err
+}
+
+// Close stops the idle timer and closes the underlying conn.
+func (conn *IdleTimeoutConn) Close() error {
+	conn.mutex.Lock()
+	conn.closed = true
+	conn.timer.Stop()
+	conn.mutex.Unlock()
+	return conn.Conn.Close()
+}
+
+// IsClosed implements the Closer iterface. The return value
+// indicates whether the underlying conn has been closed.
+func (conn *IdleTimeoutConn) IsClosed() bool {
+	closer, ok := conn.Conn.(Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
@@ -273,3 +273,53 @@ func TestLRUConns(t *testing.T) {
 		t.Fatalf("unexpected IsClosed state")
 	}
 }
+
+func TestIdleTimeoutConn(t *testing.T) {
+	buffer := make([]byte, 1024)
+
+	var idleCount int32
+
+	conn := NewIdleTimeoutConn(
+		&dummyConn{t: t},
+		200*time.Millisecond,
+		func() { atomic.AddInt32(&idleCount, 1) })
+
+	for i := 0; i < 3; i++ {
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("read failed: %s", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, err = conn.Write(buffer)
+		if err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+
+		if conn.IsClosed() {
+			t.Fatalf("activity failed to extend timeout")
+		}
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	if !conn.IsClosed() {
+		t.Fatalf("failed to timeout")
+	}
+
+	if atomic.LoadInt32(&idleCount) != 1 {
+		t.Fatalf("unexpected onIdle count")
+	}
+
+	conn = NewIdleTimeoutConn(&dummyConn{t: t}, 100*time.Millisecond, func() {
+		t.Fatalf("unexpected onIdle after close")
+	})
+
+	conn.Close()
+
+	time.Sleep(200 * time.Millisecond)
+}
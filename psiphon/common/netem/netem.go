@@ -0,0 +1,520 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package netem emulates network conditions -- latency, jitter, loss,
+// bandwidth caps, mid-stream resets, and unreachable networks -- for
+// connections dialed by tests. This allows for hermetic testing of
+// reconnection and timeout behavior without tc/netem or real servers.
+package netem
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	DEFAULT_RETRANSMIT_DELAY = 200 * time.Millisecond
+	READ_BUFFER_SIZE         = 32768
+	QUEUE_SIZE               = 64
+)
+
+var (
+	ErrNetworkUnreachable = errors.New("netem: network is unreachable")
+	ErrConnectionReset    = errors.New("netem: connection reset")
+	ErrClosed             = errors.New("netem: use of closed connection")
+)
+
+// Conditions specify emulated network conditions. Latency, jitter, loss, and
+// bandwidth apply independently to each direction of each connection.
+type Conditions struct {
+
+	// Latency is the one way delay added to all data. The emulated dial
+	// handshake takes one round trip, 2 x Latency.
+	Latency time.Duration
+
+	// Jitter is the maximum random delay added to Latency. Data is always
+	// delivered in order, so jitter delays subsequent data.
+	Jitter time.Duration
+
+	// LossProbability is the probability that each write, or each dial
+	// handshake, is lost. As stream connections can't lose data, a loss
+	// instead adds RetransmitDelay, emulating a TCP retransmission.
+	LossProbability float64
+
+	// RetransmitDelay is the delay added for each loss. When 0,
+	// DEFAULT_RETRANSMIT_DELAY, the minimum TCP retransmission timeout, is
+	// used.
+	RetransmitDelay time.Duration
+
+	// BandwidthBytesPerSecond caps throughput. The default, 0, is no cap.
+	BandwidthBytesPerSecond int64
+
+	// ResetAfterBytes, when > 0, resets each connection once it has relayed
+	// the specified number of bytes, in both directions.
+	ResetAfterBytes int64
+
+	// Unreachable causes all new dials to fail immediately. Existing
+	// connections are unaffected; use ResetConns to also fail those.
+	Unreachable bool
+}
+
+// Dialer is a dial function, matching the signature of psiphon.Dialer.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Emulator applies Conditions to wrapped connections. Conditions may be
+// changed at any time with SetConditions, and apply to data written or read
+// after the change.
+type Emulator struct {
+	mutex      sync.Mutex
+	conditions Conditions
+	conns      map[*Conn]bool
+}
+
+// NewEmulator creates a new Emulator.
+func NewEmulator(conditions Conditions) *Emulator {
+	return &Emulator{
+		conditions: conditions,
+		conns:      make(map[*Conn]bool),
+	}
+}
+
+// SetConditions replaces the current conditions.
+func (emulator *Emulator) SetConditions(conditions Conditions) {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	emulator.conditions = conditions
+}
+
+// GetConditions returns the current conditions.
+func (emulator *Emulator) GetConditions() Conditions {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	return emulator.conditions
+}
+
+// ResetConns resets all open connections, returning the number of
+// connections reset. Pending data is discarded and subsequent reads and
+// writes fail with ErrConnectionReset.
+func (emulator *Emulator) ResetConns() int {
+	emulator.mutex.Lock()
+	conns := make([]*Conn, 0, len(emulator.conns))
+	for conn := range emulator.conns {
+		conns = append(conns, conn)
+	}
+	emulator.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.reset()
+	}
+	return len(conns)
+}
+
+// WrapDialer returns a Dialer which applies the current conditions to each
+// dial and wraps each dialed connection.
+func (emulator *Emulator) WrapDialer(dialer Dialer) Dialer {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		conditions := emulator.GetConditions()
+		if conditions.Unreachable {
+			return nil, common.ContextError(ErrNetworkUnreachable)
+		}
+
+		conn, err := dialer(ctx, network, addr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		// The underlying dial completes immediately on loopback; add the
+		// emulated handshake round trip.
+		handshakeDelay := 2*conditions.Latency + conditions.jitter()
+		if conditions.lost() {
+			handshakeDelay += conditions.retransmitDelay()
+		}
+
+		timer := time.NewTimer(handshakeDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			conn.Close()
+			return nil, common.ContextError(ctx.Err())
+		}
+
+		return emulator.WrapConn(conn), nil
+	}
+}
+
+// WrapConn wraps an existing connection.
+func (emulator *Emulator) WrapConn(conn net.Conn) net.Conn {
+
+	emulatedConn := &Conn{
+		Conn:           conn,
+		emulator:       emulator,
+		writeQueue:     make(chan *chunk, QUEUE_SIZE),
+		readQueue:      make(chan *chunk, QUEUE_SIZE),
+		closeBroadcast: make(chan struct{}),
+		resetBroadcast: make(chan struct{}),
+	}
+
+	emulator.mutex.Lock()
+	emulator.conns[emulatedConn] = true
+	emulator.mutex.Unlock()
+
+	go emulatedConn.writer()
+	go emulatedConn.reader()
+
+	return emulatedConn
+}
+
+func (emulator *Emulator) removeConn(conn *Conn) {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	delete(emulator.conns, conn)
+}
+
+func (conditions Conditions) jitter() time.Duration {
+	if conditions.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(conditions.Jitter) + 1))
+}
+
+func (conditions Conditions) lost() bool {
+	return conditions.LossProbability > 0 &&
+		rand.Float64() < conditions.LossProbability
+}
+
+func (conditions Conditions) retransmitDelay() time.Duration {
+	if conditions.RetransmitDelay <= 0 {
+		return DEFAULT_RETRANSMIT_DELAY
+	}
+	return conditions.RetransmitDelay
+}
+
+// chunk is data, or a terminal read error, in flight.
+type chunk struct {
+	data      []byte
+	err       error
+	deliverAt time.Time
+}
+
+// direction tracks the transmission schedule for one direction of a
+// connection.
+type direction struct {
+	busyUntil     time.Time
+	lastDeliverAt time.Time
+}
+
+// schedule returns the delivery time for size bytes sent now.
+func (d *direction) schedule(size int, conditions Conditions) time.Time {
+
+	now := time.Now()
+
+	sent := now
+	if conditions.BandwidthBytesPerSecond > 0 {
+		if d.busyUntil.After(sent) {
+			sent = d.busyUntil
+		}
+		sent = sent.Add(time.Duration(
+			int64(size) * int64(time.Second) / conditions.BandwidthBytesPerSecond))
+		d.busyUntil = sent
+	}
+
+	deliverAt := sent.Add(conditions.Latency + conditions.jitter())
+	if conditions.lost() {
+		deliverAt = deliverAt.Add(conditions.retransmitDelay())
+	}
+
+	// Preserve stream order.
+	if deliverAt.Before(d.lastDeliverAt) {
+		deliverAt = d.lastDeliverAt
+	}
+	d.lastDeliverAt = deliverAt
+
+	return deliverAt
+}
+
+// Conn is a net.Conn with emulated network conditions. Written data is
+// queued and relayed to the underlying conn by a writer goroutine, and data
+// read from the underlying conn is queued by a reader goroutine, each
+// holding data until its scheduled delivery time.
+//
+// Read deadlines are supported; write deadlines are ignored, as writes only
+// block when the write queue is full.
+type Conn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesRelayed int64
+
+	net.Conn
+	emulator *Emulator
+
+	writeMutex sync.Mutex
+	writeState direction
+	writeQueue chan *chunk
+	writeErr   atomic.Value
+
+	readMutex    sync.Mutex
+	readState    direction
+	readQueue    chan *chunk
+	readChunk    *chunk
+	readDeadline atomic.Value
+
+	closeOnce      sync.Once
+	resetOnce      sync.Once
+	closeBroadcast chan struct{}
+	resetBroadcast chan struct{}
+}
+
+// Write queues a copy of buffer for delivery.
+func (conn *Conn) Write(buffer []byte) (int, error) {
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	err := conn.closedErr()
+	if err != nil {
+		return 0, err
+	}
+	if err, ok := conn.writeErr.Load().(error); ok {
+		return 0, err
+	}
+
+	data := make([]byte, len(buffer))
+	copy(data, buffer)
+
+	c := &chunk{
+		data:      data,
+		deliverAt: conn.writeState.schedule(len(data), conn.emulator.GetConditions()),
+	}
+
+	select {
+	case conn.writeQueue <- c:
+	case <-conn.closeBroadcast:
+		return 0, conn.closedErr()
+	}
+
+	return len(buffer), nil
+}
+
+// Read returns data once its delivery time is reached.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	err := conn.closedErr()
+	if err != nil {
+		return 0, err
+	}
+
+	var deadline <-chan time.Time
+	if readDeadline, ok := conn.readDeadline.Load().(time.Time); ok && !readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(readDeadline))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	if conn.readChunk == nil {
+		select {
+		case conn.readChunk = <-conn.readQueue:
+		case <-deadline:
+			return 0, &timeoutError{}
+		case <-conn.closeBroadcast:
+			return 0, conn.closedErr()
+		}
+	}
+
+	wait := time.NewTimer(time.Until(conn.readChunk.deliverAt))
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+	case <-deadline:
+		return 0, &timeoutError{}
+	case <-conn.closeBroadcast:
+		return 0, conn.closedErr()
+	}
+
+	if len(conn.readChunk.data) == 0 && conn.readChunk.err != nil {
+		// The terminal error is retained and returned to subsequent reads.
+		return 0, conn.readChunk.err
+	}
+
+	n := copy(buffer, conn.readChunk.data)
+	conn.readChunk.data = conn.readChunk.data[n:]
+	if len(conn.readChunk.data) == 0 && conn.readChunk.err == nil {
+		conn.readChunk = nil
+	}
+
+	return n, nil
+}
+
+// SetDeadline implements net.Conn.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn. A new deadline doesn't apply to a
+// Read that's already blocking.
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. Write deadlines are ignored.
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close closes the conn. Queued writes are still delivered, after which the
+// underlying conn is closed.
+func (conn *Conn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closeBroadcast)
+		conn.emulator.removeConn(conn)
+	})
+	return nil
+}
+
+// reset immediately closes the underlying conn, discarding any queued data.
+func (conn *Conn) reset() {
+	conn.resetOnce.Do(func() {
+		close(conn.resetBroadcast)
+		conn.Close()
+		if lingerConn, ok := conn.Conn.(interface{ SetLinger(int) error }); ok {
+			// Send a TCP RST to the peer.
+			lingerConn.SetLinger(0)
+		}
+		conn.Conn.Close()
+	})
+}
+
+func (conn *Conn) closedErr() error {
+	select {
+	case <-conn.resetBroadcast:
+		return ErrConnectionReset
+	default:
+	}
+	select {
+	case <-conn.closeBroadcast:
+		return ErrClosed
+	default:
+	}
+	return nil
+}
+
+func (conn *Conn) addBytesRelayed(n int) {
+	resetAfterBytes := conn.emulator.GetConditions().ResetAfterBytes
+	if atomic.AddInt64(&conn.bytesRelayed, int64(n)) >= resetAfterBytes &&
+		resetAfterBytes > 0 {
+
+		conn.reset()
+	}
+}
+
+// deliver waits until the chunk delivery time, returning false if the conn
+// is reset before then.
+func (conn *Conn) deliver(c *chunk) bool {
+	timer := time.NewTimer(time.Until(c.deliverAt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-conn.resetBroadcast:
+		return false
+	}
+}
+
+func (conn *Conn) writer() {
+
+	// Closing the underlying conn also stops the reader goroutine.
+	defer conn.Conn.Close()
+
+	write := func(c *chunk) bool {
+		if !conn.deliver(c) {
+			return false
+		}
+		_, err := conn.Conn.Write(c.data)
+		if err != nil {
+			conn.writeErr.Store(err)
+			return false
+		}
+		conn.addBytesRelayed(len(c.data))
+		return true
+	}
+
+	for {
+		select {
+		case c := <-conn.writeQueue:
+			if !write(c) {
+				return
+			}
+		case <-conn.closeBroadcast:
+			// Flush any queued writes before closing the underlying conn.
+			for len(conn.writeQueue) > 0 {
+				if !write(<-conn.writeQueue) {
+					break
+				}
+			}
+			return
+		}
+	}
+}
+
+func (conn *Conn) reader() {
+	for {
+		buffer := make([]byte, READ_BUFFER_SIZE)
+		n, err := conn.Conn.Read(buffer)
+
+		c := &chunk{data: buffer[:n], err: err}
+		if n > 0 {
+			conn.addBytesRelayed(n)
+			c.deliverAt = conn.readState.schedule(n, conn.emulator.GetConditions())
+		} else {
+			c.deliverAt = conn.readState.lastDeliverAt
+		}
+
+		if n > 0 || err != nil {
+			select {
+			case conn.readQueue <- c:
+			case <-conn.closeBroadcast:
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// timeoutError implements the net.Error interface for read deadlines.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "netem: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package netem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// runEchoServer runs a TCP echo server and returns its address.
+func runEchoServer(t *testing.T) (string, func()) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func dial(t *testing.T, emulator *Emulator, addr string) net.Conn {
+
+	dialer := emulator.WrapDialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		})
+
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	return conn
+}
+
+// echo writes data and reads it back, returning the elapsed time.
+func echo(t *testing.T, conn net.Conn, data []byte) time.Duration {
+
+	start := time.Now()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		writeErr <- err
+	}()
+
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	err = <-writeErr
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if !bytes.Equal(data, received) {
+		t.Fatalf("unexpected echo data")
+	}
+
+	return time.Since(start)
+}
+
+func checkDuration(t *testing.T, name string, elapsed, minimum time.Duration) {
+	// The maximum is loose, to allow for slow test environments.
+	if elapsed < minimum || elapsed > minimum+time.Second {
+		t.Fatalf("unexpected %s duration: %s (expected >= %s)", name, elapsed, minimum)
+	}
+}
+
+func TestLatency(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	latency := 50 * time.Millisecond
+	emulator := NewEmulator(Conditions{Latency: latency})
+
+	start := time.Now()
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+	checkDuration(t, "dial", time.Since(start), 2*latency)
+
+	for i := 0; i < 3; i++ {
+		checkDuration(t, "echo", echo(t, conn, []byte("ping")), 2*latency)
+	}
+
+	// Changed conditions apply to subsequent data.
+	emulator.SetConditions(Conditions{})
+	elapsed := echo(t, conn, []byte("ping"))
+	if elapsed >= 2*latency {
+		t.Fatalf("unexpected echo duration: %s", elapsed)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	bytesPerSecond := int64(100000)
+	emulator := NewEmulator(Conditions{BandwidthBytesPerSecond: bytesPerSecond})
+
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+
+	// The write is paced at the capped rate, and the echoed data is paced
+	// again on read, so the echo takes at least the time to send the data
+	// once.
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	elapsed := echo(t, conn, data)
+	checkDuration(t, "transfer", elapsed, time.Duration(
+		int64(len(data))*int64(time.Second)/bytesPerSecond))
+}
+
+func TestLoss(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	retransmitDelay := 100 * time.Millisecond
+	emulator := NewEmulator(Conditions{
+		LossProbability: 1.0,
+		RetransmitDelay: retransmitDelay,
+	})
+
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+
+	// Both the write and the echo read are lost and retransmitted.
+	checkDuration(t, "echo", echo(t, conn, []byte("ping")), 2*retransmitDelay)
+}
+
+func TestResetAfterBytes(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	emulator := NewEmulator(Conditions{ResetAfterBytes: 150})
+
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+
+	echo(t, conn, make([]byte, 50))
+
+	_, err := conn.Write(make([]byte, 50))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	_, err = ioutil.ReadAll(conn)
+	if err != ErrConnectionReset {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	_, err = conn.Write([]byte("ping"))
+	if err != ErrConnectionReset {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+}
+
+func TestResetConnsAndUnreachable(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	emulator := NewEmulator(Conditions{})
+
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+
+	echo(t, conn, []byte("ping"))
+
+	emulator.SetConditions(Conditions{Unreachable: true})
+
+	dialer := emulator.WrapDialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			t.Fatalf("unexpected underlying dial")
+			return nil, nil
+		})
+	_, err := dialer(context.Background(), "tcp", addr)
+	if err == nil {
+		t.Fatalf("unexpected dial success")
+	}
+
+	// The existing conn is unaffected until reset.
+	echo(t, conn, []byte("ping"))
+
+	if emulator.ResetConns() != 1 {
+		t.Fatalf("unexpected reset count")
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	if err != ErrConnectionReset {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	// Closed conns are no longer tracked.
+	emulator.SetConditions(Conditions{})
+	conn = dial(t, emulator, addr)
+	conn.Close()
+	if emulator.ResetConns() != 0 {
+		t.Fatalf("unexpected reset count")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+
+	addr, stop := runEchoServer(t)
+	defer stop()
+
+	emulator := NewEmulator(Conditions{Latency: 200 * time.Millisecond})
+
+	conn := dial(t, emulator, addr)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	// The echo is in flight, and won't be delivered before the deadline.
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 4))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	// Data isn't lost after a timeout.
+	conn.SetReadDeadline(time.Time{})
+	received := make([]byte, 4)
+	_, err = io.ReadFull(conn, received)
+	if err != nil || string(received) != "ping" {
+		t.Fatalf("unexpected read: %s, %v", received, err)
+	}
+}
+
+func TestCloseFlushesWrites(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- data
+	}()
+
+	emulator := NewEmulator(Conditions{Latency: 50 * time.Millisecond})
+
+	conn := dial(t, emulator, listener.Addr().String())
+
+	_, err = conn.Write([]byte("goodbye"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	if err != ErrClosed {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+
+	data := <-received
+	if string(data) != "goodbye" {
+		t.Fatalf("unexpected received data: %s", data)
+	}
+}
@@ -112,18 +112,47 @@ func NewObfuscatedSshConn(
 	obfuscationKeyword string,
 	minPadding, maxPadding *int) (*ObfuscatedSshConn, error) {
 
+	return newObfuscatedSshConn(
+		mode,
+		conn,
+		&ObfuscatorConfig{
+			Keyword:    obfuscationKeyword,
+			MinPadding: minPadding,
+			MaxPadding: maxPadding,
+		})
+}
+
+// NewServerObfuscatedSshConn creates a new server mode ObfuscatedSshConn
+// which accepts clients using either the current obfuscation keyword or any
+// of the previous keywords. GetKeyword returns the keyword used by the
+// client. As with NewObfuscatedSshConn, NewServerObfuscatedSshConn blocks on
+// reading the client seed message from the underlying conn.
+func NewServerObfuscatedSshConn(
+	conn net.Conn,
+	obfuscationKeyword string,
+	previousObfuscationKeywords []string) (*ObfuscatedSshConn, error) {
+
+	return newObfuscatedSshConn(
+		OBFUSCATION_CONN_MODE_SERVER,
+		conn,
+		&ObfuscatorConfig{
+			Keyword:          obfuscationKeyword,
+			PreviousKeywords: previousObfuscationKeywords,
+		})
+}
+
+func newObfuscatedSshConn(
+	mode ObfuscatedSshConnMode,
+	conn net.Conn,
+	obfuscatorConfig *ObfuscatorConfig) (*ObfuscatedSshConn, error) {
+
 	var err error
 	var obfuscator *Obfuscator
 	var readDeobfuscate, writeObfuscate func([]byte)
 	var writeState ObfuscatedSshWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
-		obfuscator, err = NewClientObfuscator(
-			&ObfuscatorConfig{
-				Keyword:    obfuscationKeyword,
-				MinPadding: minPadding,
-				MaxPadding: maxPadding,
-			})
+		obfuscator, err = NewClientObfuscator(obfuscatorConfig)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -132,8 +161,7 @@ func NewObfuscatedSshConn(
 		writeState = OBFUSCATION_WRITE_STATE_CLIENT_SEND_SEED_MESSAGE
 	} else {
 		// NewServerObfuscator reads a seed message from conn
-		obfuscator, err = NewServerObfuscator(
-			conn, &ObfuscatorConfig{Keyword: obfuscationKeyword})
+		obfuscator, err = NewServerObfuscator(conn, obfuscatorConfig)
 		if err != nil {
 			// TODO: readForver() equivalent
 			return nil, common.ContextError(err)
@@ -157,6 +185,12 @@ func NewObfuscatedSshConn(
 	}, nil
 }
 
+// GetKeyword returns the obfuscation keyword used by the connection. In
+// server mode, this is the keyword used by the client.
+func (conn *ObfuscatedSshConn) GetKeyword() string {
+	return conn.obfuscator.GetKeyword()
+}
+
 // Read wraps standard Read, transparently applying the obfuscation
 // transformations.
 func (conn *ObfuscatedSshConn) Read(buffer []byte) (int, error) {
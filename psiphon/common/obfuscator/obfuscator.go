@@ -45,6 +45,7 @@ const (
 // https://github.com/brl/obfuscated-openssh/blob/master/README.obfuscation
 type Obfuscator struct {
 	seedMessage          []byte
+	keyword              string
 	clientToServerCipher *rc4.Cipher
 	serverToClientCipher *rc4.Cipher
 }
@@ -53,6 +54,12 @@ type ObfuscatorConfig struct {
 	Keyword    string
 	MinPadding *int
 	MaxPadding *int
+
+	// PreviousKeywords specifies additional keywords accepted by a server
+	// obfuscator. This allows a server to accept clients using either the
+	// current or a previous keyword during a keyword rotation. Clients always
+	// use Keyword.
+	PreviousKeywords []string
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -95,22 +102,28 @@ func NewClientObfuscator(
 
 	return &Obfuscator{
 		seedMessage:          seedMessage,
+		keyword:              config.Keyword,
 		clientToServerCipher: clientToServerCipher,
 		serverToClientCipher: serverToClientCipher}, nil
 }
 
 // NewServerObfuscator creates a new Obfuscator, reading a seed message directly
 // from the clientReader and initializing stream ciphers to obfuscate data.
+//
+// The seed message is accepted when obfuscated with either config.Keyword or
+// any of config.PreviousKeywords. GetKeyword returns the keyword used by the
+// client.
 func NewServerObfuscator(
 	clientReader io.Reader, config *ObfuscatorConfig) (obfuscator *Obfuscator, err error) {
 
-	clientToServerCipher, serverToClientCipher, err := readSeedMessage(
+	keyword, clientToServerCipher, serverToClientCipher, err := readSeedMessage(
 		clientReader, config)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
 	return &Obfuscator{
+		keyword:              keyword,
 		clientToServerCipher: clientToServerCipher,
 		serverToClientCipher: serverToClientCipher}, nil
 }
@@ -123,6 +136,11 @@ func (obfuscator *Obfuscator) SendSeedMessage() []byte {
 	return seedMessage
 }
 
+// GetKeyword returns the keyword used to derive the obfuscation keys.
+func (obfuscator *Obfuscator) GetKeyword() string {
+	return obfuscator.keyword
+}
+
 // ObfuscateClientToServer applies the client RC4 stream to the bytes in buffer.
 func (obfuscator *Obfuscator) ObfuscateClientToServer(buffer []byte) {
 	obfuscator.clientToServerCipher.XORKeyStream(buffer, buffer)
@@ -136,12 +154,18 @@ func (obfuscator *Obfuscator) ObfuscateServerToClient(buffer []byte) {
 func initObfuscatorCiphers(
 	seed []byte, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
 
-	clientToServerKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	return initKeywordObfuscatorCiphers(seed, config.Keyword)
+}
+
+func initKeywordObfuscatorCiphers(
+	seed []byte, keyword string) (*rc4.Cipher, *rc4.Cipher, error) {
+
+	clientToServerKey, err := deriveKey(seed, []byte(keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	serverToClientKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
+	serverToClientKey, err := deriveKey(seed, []byte(keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
@@ -204,54 +228,68 @@ func makeSeedMessage(minPadding, maxPadding int, seed []byte, clientToServerCiph
 }
 
 func readSeedMessage(
-	clientReader io.Reader, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
+	clientReader io.Reader,
+	config *ObfuscatorConfig) (string, *rc4.Cipher, *rc4.Cipher, error) {
 
 	seed := make([]byte, OBFUSCATE_SEED_LENGTH)
 	_, err := io.ReadFull(clientReader, seed)
 	if err != nil {
-		return nil, nil, common.ContextError(err)
+		return "", nil, nil, common.ContextError(err)
 	}
 
-	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(seed, config)
+	obfuscatedFixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
+	_, err = io.ReadFull(clientReader, obfuscatedFixedLengthFields)
 	if err != nil {
-		return nil, nil, common.ContextError(err)
+		return "", nil, nil, common.ContextError(err)
 	}
 
-	fixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
-	_, err = io.ReadFull(clientReader, fixedLengthFields)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
+	// Each candidate keyword is tried in turn, and the first keyword that
+	// yields the expected magic value is selected. The current keyword is
+	// tried first, as most clients are expected to use it.
 
-	clientToServerCipher.XORKeyStream(fixedLengthFields, fixedLengthFields)
+	keywords := append([]string{config.Keyword}, config.PreviousKeywords...)
 
-	buffer := bytes.NewReader(fixedLengthFields)
+	for _, keyword := range keywords {
 
-	var magicValue, paddingLength int32
-	err = binary.Read(buffer, binary.BigEndian, &magicValue)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
-	err = binary.Read(buffer, binary.BigEndian, &paddingLength)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
+		clientToServerCipher, serverToClientCipher, err := initKeywordObfuscatorCiphers(seed, keyword)
+		if err != nil {
+			return "", nil, nil, common.ContextError(err)
+		}
 
-	if magicValue != OBFUSCATE_MAGIC_VALUE {
-		return nil, nil, common.ContextError(errors.New("invalid magic value"))
-	}
+		fixedLengthFields := append([]byte(nil), obfuscatedFixedLengthFields...)
 
-	if paddingLength < 0 || paddingLength > OBFUSCATE_MAX_PADDING {
-		return nil, nil, common.ContextError(errors.New("invalid padding length"))
-	}
+		clientToServerCipher.XORKeyStream(fixedLengthFields, fixedLengthFields)
 
-	padding := make([]byte, paddingLength)
-	_, err = io.ReadFull(clientReader, padding)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
+		buffer := bytes.NewReader(fixedLengthFields)
 
-	clientToServerCipher.XORKeyStream(padding, padding)
+		var magicValue, paddingLength int32
+		err = binary.Read(buffer, binary.BigEndian, &magicValue)
+		if err != nil {
+			return "", nil, nil, common.ContextError(err)
+		}
+		err = binary.Read(buffer, binary.BigEndian, &paddingLength)
+		if err != nil {
+			return "", nil, nil, common.ContextError(err)
+		}
 
-	return clientToServerCipher, serverToClientCipher, nil
+		if magicValue != OBFUSCATE_MAGIC_VALUE {
+			continue
+		}
+
+		if paddingLength < 0 || paddingLength > OBFUSCATE_MAX_PADDING {
+			return "", nil, nil, common.ContextError(errors.New("invalid padding length"))
+		}
+
+		padding := make([]byte, paddingLength)
+		_, err = io.ReadFull(clientReader, padding)
+		if err != nil {
+			return "", nil, nil, common.ContextError(err)
+		}
+
+		clientToServerCipher.XORKeyStream(padding, padding)
+
+		return keyword, clientToServerCipher, serverToClientCipher, nil
+	}
+
+	return "", nil, nil, common.ContextError(errors.New("invalid magic value"))
 }
@@ -0,0 +1,61 @@
+// +build go1.18
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package obfuscator
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func FuzzServerObfuscator(f *testing.F) {
+
+	keyword, _ := common.MakeSecureRandomStringHex(32)
+
+	config := &ObfuscatorConfig{Keyword: keyword}
+
+	client, err := NewClientObfuscator(config)
+	if err != nil {
+		f.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	f.Add(client.SendSeedMessage())
+	f.Add([]byte{})
+	f.Add(make([]byte, OBFUSCATE_SEED_LENGTH))
+	f.Add(make([]byte, OBFUSCATE_SEED_LENGTH+8))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		// The seed message is the first data a server reads from an
+		// unauthenticated client; it must be rejected without panicking.
+
+		server, err := NewServerObfuscator(bytes.NewReader(data), config)
+		if err != nil {
+			return
+		}
+
+		b := []byte("client hello")
+		server.ObfuscateClientToServer(b)
+		server.ObfuscateServerToClient(b)
+	})
+}
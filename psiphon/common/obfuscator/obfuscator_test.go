@@ -76,6 +76,54 @@ func TestObfuscator(t *testing.T) {
 	}
 }
 
+func TestObfuscatorPreviousKeywords(t *testing.T) {
+
+	keyword, _ := common.MakeSecureRandomStringHex(32)
+	previousKeyword, _ := common.MakeSecureRandomStringHex(32)
+	otherKeyword, _ := common.MakeSecureRandomStringHex(32)
+
+	serverConfig := &ObfuscatorConfig{
+		Keyword:          keyword,
+		PreviousKeywords: []string{previousKeyword},
+	}
+
+	for _, clientKeyword := range []string{keyword, previousKeyword, otherKeyword} {
+
+		client, err := NewClientObfuscator(&ObfuscatorConfig{Keyword: clientKeyword})
+		if err != nil {
+			t.Fatalf("NewClientObfuscator failed: %s", err)
+		}
+
+		server, err := NewServerObfuscator(
+			bytes.NewReader(client.SendSeedMessage()), serverConfig)
+
+		if clientKeyword == otherKeyword {
+			if err == nil {
+				t.Fatalf("unexpected NewServerObfuscator success")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("NewServerObfuscator failed: %s", err)
+		}
+
+		if server.GetKeyword() != clientKeyword {
+			t.Fatalf("unexpected keyword")
+		}
+
+		clientMessage := []byte("client hello")
+
+		b := append([]byte(nil), clientMessage...)
+		client.ObfuscateClientToServer(b)
+		server.ObfuscateClientToServer(b)
+
+		if !bytes.Equal(clientMessage, b) {
+			t.Fatalf("unexpected client message")
+		}
+	}
+}
+
 func TestObfuscatedSSHConn(t *testing.T) {
 
 	keyword, _ := common.MakeSecureRandomStringHex(32)
@@ -46,6 +46,7 @@ import (
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1200,6 +1201,53 @@ func (keyShares *KeyShares) reassembleKey(lookup SLOKLookup, unboxKey bool) (boo
 	return true, joinedKey, nil
 }
 
+// progress recursively traverses a KeyShares tree, determining the minimum
+// number of SLOKs required to reassemble the root key and the minimum number
+// of additional SLOKs, beyond those found by lookup, that are still required.
+func (keyShares *KeyShares) progress(lookup SLOKLookup) (int, int, error) {
+
+	if (len(keyShares.SLOKIDs) > 0 && len(keyShares.KeyShares) > 0) ||
+		(len(keyShares.SLOKIDs) > 0 && len(keyShares.SLOKIDs) != len(keyShares.BoxedShares)) ||
+		(len(keyShares.KeyShares) > 0 && len(keyShares.KeyShares) != len(keyShares.BoxedShares)) ||
+		keyShares.Threshold > len(keyShares.BoxedShares) {
+		return 0, 0, common.ContextError(errors.New("unexpected KeyShares format"))
+	}
+
+	if len(keyShares.SLOKIDs) > 0 {
+		shareCount := 0
+		for i := 0; i < len(keyShares.SLOKIDs) && shareCount < keyShares.Threshold; i++ {
+			if lookup(keyShares.SLOKIDs[i]) != nil {
+				shareCount += 1
+			}
+		}
+		return keyShares.Threshold, keyShares.Threshold - shareCount, nil
+	}
+
+	// Each child share may be satisfied independently, so the minimums are the
+	// sums of the #Threshold smallest child minimums.
+
+	required := make([]int, len(keyShares.KeyShares))
+	remaining := make([]int, len(keyShares.KeyShares))
+	for i, childKeyShares := range keyShares.KeyShares {
+		var err error
+		required[i], remaining[i], err = childKeyShares.progress(lookup)
+		if err != nil {
+			return 0, 0, common.ContextError(err)
+		}
+	}
+	sort.Ints(required)
+	sort.Ints(remaining)
+
+	requiredCount := 0
+	remainingCount := 0
+	for i := 0; i < keyShares.Threshold; i++ {
+		requiredCount += required[i]
+		remainingCount += remaining[i]
+	}
+
+	return requiredCount, remainingCount, nil
+}
+
 // GetOSLRegistryURL returns the URL for an OSL registry. Clients
 // call this when fetching the registry from out-of-band
 // distribution sites.
@@ -1328,46 +1376,100 @@ func NewRegistryStreamer(
 func (s *RegistryStreamer) Next() (*OSLFileSpec, error) {
 
 	for {
-		if s.jsonDecoder.More() {
 
-			var fileSpec OSLFileSpec
-			err := s.jsonDecoder.Decode(&fileSpec)
-			if err != nil {
-				return nil, common.ContextError(err)
-			}
+		fileSpec, err := s.nextFileSpec()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 
-			ok, _, err := fileSpec.KeyShares.reassembleKey(s.lookup, false)
-			if err != nil {
-				return nil, common.ContextError(err)
-			}
+		if fileSpec == nil {
+			return nil, nil
+		}
 
-			if ok {
-				return &fileSpec, nil
-			}
+		ok, _, err := fileSpec.KeyShares.reassembleKey(s.lookup, false)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 
-		} else {
+		if ok {
+			return fileSpec, nil
+		}
+	}
+}
 
-			// Expect the end of the FileSpecs array.
-			err := expectJSONDelimiter(s.jsonDecoder, "]")
-			if err != nil {
-				return nil, common.ContextError(err)
-			}
+// OSLProgress describes the client's progress towards unlocking an OSL.
+// SLOKsRequired is the minimum number of SLOKs required to reassemble the
+// OSL key and SLOKsRemaining is the minimum number of additional SLOKs the
+// client must be seeded with. The OSL is unlocked when SLOKsRemaining is 0.
+type OSLProgress struct {
+	ID             []byte
+	SLOKsRequired  int
+	SLOKsRemaining int
+}
 
-			// Expect the end of the Registry object.
-			err = expectJSONDelimiter(s.jsonDecoder, "}")
-			if err != nil {
-				return nil, common.ContextError(err)
-			}
+// NextProgress returns the SLOK collection progress for the next OSL
+// file spec, whether or not the client has sufficient SLOKs to decrypt.
+// NextProgress returns nil at EOF.
+//
+// Next and NextProgress both advance the same registry stream and should
+// not be used together.
+func (s *RegistryStreamer) NextProgress() (*OSLProgress, error) {
 
-			// Expect the end of the registry content.
-			_, err = s.jsonDecoder.Token()
-			if err != io.EOF {
-				return nil, common.ContextError(err)
-			}
+	fileSpec, err := s.nextFileSpec()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
-			return nil, nil
+	if fileSpec == nil {
+		return nil, nil
+	}
+
+	required, remaining, err := fileSpec.KeyShares.progress(s.lookup)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &OSLProgress{
+		ID:             fileSpec.ID,
+		SLOKsRequired:  required,
+		SLOKsRemaining: remaining,
+	}, nil
+}
+
+// nextFileSpec returns the next OSL file spec in the registry,
+// or nil at EOF.
+func (s *RegistryStreamer) nextFileSpec() (*OSLFileSpec, error) {
+
+	if s.jsonDecoder.More() {
+
+		var fileSpec OSLFileSpec
+		err := s.jsonDecoder.Decode(&fileSpec)
+		if err != nil {
+			return nil, common.ContextError(err)
 		}
+
+		return &fileSpec, nil
 	}
+
+	// Expect the end of the FileSpecs array.
+	err := expectJSONDelimiter(s.jsonDecoder, "]")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Expect the end of the Registry object.
+	err = expectJSONDelimiter(s.jsonDecoder, "}")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Expect the end of the registry content.
+	_, err = s.jsonDecoder.Token()
+	if err != io.EOF {
+		return nil, common.ContextError(err)
+	}
+
+	return nil, nil
 }
 
 func expectJSONDelimiter(jsonDecoder *json.Decoder, delimiter string) error {
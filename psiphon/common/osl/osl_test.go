@@ -614,6 +614,51 @@ func TestOSL(t *testing.T) {
 			if seededOSLCount != testCase.expectedOSLCount {
 				t.Fatalf("expected %d OSLs got %d", testCase.expectedOSLCount, seededOSLCount)
 			}
+
+			progressStreamer, err := NewRegistryStreamer(
+				bytes.NewReader(pavedRegistries[testCase.propagationChannelID]),
+				signingPublicKey,
+				lookupSLOKs)
+			if err != nil {
+				t.Fatalf("NewRegistryStreamer failed: %s", err)
+			}
+
+			unlockedOSLCount := 0
+			inProgressOSLCount := 0
+
+			for {
+
+				progress, err := progressStreamer.NextProgress()
+				if err != nil {
+					t.Fatalf("NextProgress failed: %s", err)
+				}
+
+				if progress == nil {
+					break
+				}
+
+				if progress.SLOKsRequired < 1 ||
+					progress.SLOKsRemaining < 0 ||
+					progress.SLOKsRemaining > progress.SLOKsRequired {
+					t.Fatalf("unexpected OSL progress: %+v", progress)
+				}
+
+				if progress.SLOKsRemaining == 0 {
+					unlockedOSLCount += 1
+				} else if progress.SLOKsRemaining < progress.SLOKsRequired {
+					inProgressOSLCount += 1
+				}
+			}
+
+			if unlockedOSLCount != testCase.expectedOSLCount {
+				t.Fatalf("expected %d unlocked OSLs got %d", testCase.expectedOSLCount, unlockedOSLCount)
+			}
+
+			// All test cases issue some SLOKs, so an OSL that is not unlocked
+			// should show progress.
+			if unlockedOSLCount == 0 && inProgressOSLCount == 0 {
+				t.Fatalf("expected OSL progress")
+			}
 		})
 	}
 }
@@ -77,11 +77,50 @@ const (
 	EstablishTunnelWorkTime                    = "EstablishTunnelWorkTime"
 	EstablishTunnelPausePeriod                 = "EstablishTunnelPausePeriod"
 	EstablishTunnelPausePeriodJitter           = "EstablishTunnelPausePeriodJitter"
+	EstablishTunnelPausePeriodMultiplier       = "EstablishTunnelPausePeriodMultiplier"
+	EstablishTunnelPausePeriodMax              = "EstablishTunnelPausePeriodMax"
 	EstablishTunnelServerAffinityGracePeriod   = "EstablishTunnelServerAffinityGracePeriod"
+	EstablishTunnelPinnedServerGracePeriod     = "EstablishTunnelPinnedServerGracePeriod"
+	ServerEntryAvailabilityWindowRanking       = "ServerEntryAvailabilityWindowRanking"
+	ServerEntryAvailabilityWindowClockSkew     = "ServerEntryAvailabilityWindowClockSkew"
+	ServerLoadAvoidanceThreshold               = "ServerLoadAvoidanceThreshold"
+	ServerLoadAvoidancePeriod                  = "ServerLoadAvoidancePeriod"
 	StaggerConnectionWorkersPeriod             = "StaggerConnectionWorkersPeriod"
 	StaggerConnectionWorkersJitter             = "StaggerConnectionWorkersJitter"
 	LimitIntensiveConnectionWorkers            = "LimitIntensiveConnectionWorkers"
+	EstablishTunnelBytesPerSecond              = "EstablishTunnelBytesPerSecond"
+	ConstrainedHostConnectionWorkerPoolSize    = "ConstrainedHostConnectionWorkerPoolSize"
+	ConstrainedHostEstablishPauseMultiplier    = "ConstrainedHostEstablishPauseMultiplier"
+	MeteredNetworkSkipUpgradeCheck             = "MeteredNetworkSkipUpgradeCheck"
+	RegionLatencyProbePeriod                   = "RegionLatencyProbePeriod"
+	RegionLatencyProbeSampleSize               = "RegionLatencyProbeSampleSize"
+	RegionLatencyProbeTimeout                  = "RegionLatencyProbeTimeout"
+	TunnelLivenessProbePeriod                  = "TunnelLivenessProbePeriod"
+	TunnelLivenessProbeTimeout                 = "TunnelLivenessProbeTimeout"
+	TunnelLivenessProbeMaxFailures             = "TunnelLivenessProbeMaxFailures"
+	TunnelLivenessProbeAddress                 = "TunnelLivenessProbeAddress"
+	FastReconnectMaxAge                        = "FastReconnectMaxAge"
+	FastReconnectTimeout                       = "FastReconnectTimeout"
+	ControllerSnapshotMaxAge                   = "ControllerSnapshotMaxAge"
+	StatusFileUpdatePeriod                     = "StatusFileUpdatePeriod"
+	AdaptiveProtocolSelection                  = "AdaptiveProtocolSelection"
+	AdaptiveProtocolSelectionExploration       = "AdaptiveProtocolSelectionExploration"
+	DecoyTrafficMode                           = "DecoyTrafficMode"
+	DecoyTrafficURLs                           = "DecoyTrafficURLs"
+	DecoyTrafficMinInterval                    = "DecoyTrafficMinInterval"
+	DecoyTrafficMaxInterval                    = "DecoyTrafficMaxInterval"
+	DecoyTrafficRequestTimeout                 = "DecoyTrafficRequestTimeout"
+	DecoyTrafficMaxBytesPerRequest             = "DecoyTrafficMaxBytesPerRequest"
+	DecoyTrafficMaxBytesPerSecond              = "DecoyTrafficMaxBytesPerSecond"
+	DecoyTrafficMaxTotalBytes                  = "DecoyTrafficMaxTotalBytes"
+	TunnelPoolAutoscalePeriod                  = "TunnelPoolAutoscalePeriod"
+	TunnelPoolGrowBytesPerSecond               = "TunnelPoolGrowBytesPerSecond"
+	TunnelPoolShrinkBytesPerSecond             = "TunnelPoolShrinkBytesPerSecond"
+	TunnelPoolGrowPortForwardQueueDepth        = "TunnelPoolGrowPortForwardQueueDepth"
+	PacketTunnelFlowStatsPeriod                = "PacketTunnelFlowStatsPeriod"
+	PacketTunnelFlowStatsMaxFlows              = "PacketTunnelFlowStatsMaxFlows"
 	IgnoreHandshakeStatsRegexps                = "IgnoreHandshakeStatsRegexps"
+	HandshakeSessionResumption                 = "HandshakeSessionResumption"
 	PrioritizeTunnelProtocolsProbability       = "PrioritizeTunnelProtocolsProbability"
 	PrioritizeTunnelProtocols                  = "PrioritizeTunnelProtocols"
 	PrioritizeTunnelProtocolsCandidateCount    = "PrioritizeTunnelProtocolsCandidateCount"
@@ -94,6 +133,10 @@ const (
 	LimitTLSProfiles                           = "LimitTLSProfiles"
 	LimitQUICVersionsProbability               = "LimitQUICVersionsProbability"
 	LimitQUICVersions                          = "LimitQUICVersions"
+	QUICWireVersionsProbability                = "QUICWireVersionsProbability"
+	QUICWireVersions                           = "QUICWireVersions"
+	QUICInitialPacketPaddingMinBytes           = "QUICInitialPacketPaddingMinBytes"
+	QUICInitialPacketPaddingMaxBytes           = "QUICInitialPacketPaddingMaxBytes"
 	FragmentorProbability                      = "FragmentorProbability"
 	FragmentorLimitProtocols                   = "FragmentorLimitProtocols"
 	FragmentorMinTotalBytes                    = "FragmentorMinTotalBytes"
@@ -102,6 +145,10 @@ const (
 	FragmentorMaxWriteBytes                    = "FragmentorMaxWriteBytes"
 	FragmentorMinDelay                         = "FragmentorMinDelay"
 	FragmentorMaxDelay                         = "FragmentorMaxDelay"
+	FragmentorSplitTLSSNIProbability           = "FragmentorSplitTLSSNIProbability"
+	TCPMaxSegmentSizeProbability               = "TCPMaxSegmentSizeProbability"
+	TCPMaxSegmentSizeLimitProtocols            = "TCPMaxSegmentSizeLimitProtocols"
+	TCPMaxSegmentSize                          = "TCPMaxSegmentSize"
 	FragmentorDownstreamProbability            = "FragmentorDownstreamProbability"
 	FragmentorDownstreamLimitProtocols         = "FragmentorDownstreamLimitProtocols"
 	FragmentorDownstreamMinTotalBytes          = "FragmentorDownstreamMinTotalBytes"
@@ -110,10 +157,15 @@ const (
 	FragmentorDownstreamMaxWriteBytes          = "FragmentorDownstreamMaxWriteBytes"
 	FragmentorDownstreamMinDelay               = "FragmentorDownstreamMinDelay"
 	FragmentorDownstreamMaxDelay               = "FragmentorDownstreamMaxDelay"
+	TrafficShapingProfiles                     = "TrafficShapingProfiles"
+	KnockDelay                                 = "KnockDelay"
+	SSHChannelWindowSize                       = "SSHChannelWindowSize"
+	SSHPacketTunnelChannelWindowSize           = "SSHPacketTunnelChannelWindowSize"
 	ObfuscatedSSHMinPadding                    = "ObfuscatedSSHMinPadding"
 	ObfuscatedSSHMaxPadding                    = "ObfuscatedSSHMaxPadding"
 	TunnelOperateShutdownTimeout               = "TunnelOperateShutdownTimeout"
 	TunnelPortForwardDialTimeout               = "TunnelPortForwardDialTimeout"
+	PortForwardQueueTimeout                    = "PortForwardQueueTimeout"
 	TunnelRateLimits                           = "TunnelRateLimits"
 	AdditionalCustomHeaders                    = "AdditionalCustomHeaders"
 	SpeedTestPaddingMinBytes                   = "SpeedTestPaddingMinBytes"
@@ -128,14 +180,30 @@ const (
 	SSHKeepAlivePeriodicInactivePeriod         = "SSHKeepAlivePeriodicInactivePeriod"
 	SSHKeepAliveProbeTimeout                   = "SSHKeepAliveProbeTimeout"
 	SSHKeepAliveProbeInactivePeriod            = "SSHKeepAliveProbeInactivePeriod"
+	DormancyIdlePeriod                         = "DormancyIdlePeriod"
+	DormancySSHKeepAlivePeriodMin              = "DormancySSHKeepAlivePeriodMin"
+	DormancySSHKeepAlivePeriodMax              = "DormancySSHKeepAlivePeriodMax"
 	HTTPProxyOriginServerTimeout               = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost         = "HTTPProxyMaxIdleConnectionsPerHost"
+	HTTPProxyIdleTimeout                       = "HTTPProxyIdleTimeout"
+	SOCKSProxyIdleTimeout                      = "SOCKSProxyIdleTimeout"
+	TunneledPortForwardIdleTimeout             = "TunneledPortForwardIdleTimeout"
+	UDPChannelUdpgwServerAddress               = "UDPChannelUdpgwServerAddress"
+	DirectCheckTimeout                         = "DirectCheckTimeout"
+	PreflightCheckTimeout                      = "PreflightCheckTimeout"
+	CaptivePortalProbeURLs                     = "CaptivePortalProbeURLs"
+	CaptivePortalDetection                     = "CaptivePortalDetection"
+	CaptivePortalProbeTimeout                  = "CaptivePortalProbeTimeout"
+	CaptivePortalProbePeriod                   = "CaptivePortalProbePeriod"
 	FetchRemoteServerListTimeout               = "FetchRemoteServerListTimeout"
 	FetchRemoteServerListRetryPeriod           = "FetchRemoteServerListRetryPeriod"
 	FetchRemoteServerListStalePeriod           = "FetchRemoteServerListStalePeriod"
 	RemoteServerListSignaturePublicKey         = "RemoteServerListSignaturePublicKey"
 	RemoteServerListURLs                       = "RemoteServerListURLs"
+	RemoteServerListDeltaURLs                  = "RemoteServerListDeltaURLs"
 	ObfuscatedServerListRootURLs               = "ObfuscatedServerListRootURLs"
+	StegoServerListURLs                        = "StegoServerListURLs"
+	StegoServerListFetchEstablishRounds        = "StegoServerListFetchEstablishRounds"
 	PsiphonAPIRequestTimeout                   = "PsiphonAPIRequestTimeout"
 	PsiphonAPIStatusRequestPeriodMin           = "PsiphonAPIStatusRequestPeriodMin"
 	PsiphonAPIStatusRequestPeriodMax           = "PsiphonAPIStatusRequestPeriodMax"
@@ -150,11 +218,29 @@ const (
 	SplitTunnelRoutesURLFormat                 = "SplitTunnelRoutesURLFormat"
 	SplitTunnelRoutesSignaturePublicKey        = "SplitTunnelRoutesSignaturePublicKey"
 	SplitTunnelDNSServer                       = "SplitTunnelDNSServer"
+	DNSCacheMaxEntries                         = "DNSCacheMaxEntries"
+	DNSCacheMaxTTL                             = "DNSCacheMaxTTL"
+	DNSCacheNegativeTTL                        = "DNSCacheNegativeTTL"
+	UntunneledDNSResolvers                     = "UntunneledDNSResolvers"
+	UntunneledDNSResolverTimeout               = "UntunneledDNSResolverTimeout"
+	UntunneledDNSPlaintextFallback             = "UntunneledDNSPlaintextFallback"
+	UntunneledDNSResolversOnPoisoning          = "UntunneledDNSResolversOnPoisoning"
+	DNSAnswerValidation                        = "DNSAnswerValidation"
+	DNSPoisoningBlockIPs                       = "DNSPoisoningBlockIPs"
+	DNSPoisoningSwitchPeriod                   = "DNSPoisoningSwitchPeriod"
+	InproxyBrokerURLs                          = "InproxyBrokerURLs"
+	InproxyICEServers                          = "InproxyICEServers"
+	InproxyNATDiscoveryTestTimeout             = "InproxyNATDiscoveryTestTimeout"
 	FetchUpgradeTimeout                        = "FetchUpgradeTimeout"
 	FetchUpgradeRetryPeriod                    = "FetchUpgradeRetryPeriod"
 	FetchUpgradeStalePeriod                    = "FetchUpgradeStalePeriod"
 	UpgradeDownloadURLs                        = "UpgradeDownloadURLs"
 	UpgradeDownloadClientVersionHeader         = "UpgradeDownloadClientVersionHeader"
+	UpgradeDownloadChunkSize                   = "UpgradeDownloadChunkSize"
+	FeedbackUploadURLs                         = "FeedbackUploadURLs"
+	FeedbackEncryptionPublicKey                = "FeedbackEncryptionPublicKey"
+	FeedbackUploadTimeout                      = "FeedbackUploadTimeout"
+	FeedbackUploadRetryPeriod                  = "FeedbackUploadRetryPeriod"
 	TotalBytesTransferredNoticePeriod          = "TotalBytesTransferredNoticePeriod"
 	MeekDialDomainsOnly                        = "MeekDialDomainsOnly"
 	MeekLimitBufferSizes                       = "MeekLimitBufferSizes"
@@ -163,6 +249,7 @@ const (
 	MeekReadPayloadChunkLength                 = "MeekReadPayloadChunkLength"
 	MeekLimitedFullReceiveBufferLength         = "MeekLimitedFullReceiveBufferLength"
 	MeekLimitedReadPayloadChunkLength          = "MeekLimitedReadPayloadChunkLength"
+	MeekPooledBufferMaxSize                    = "MeekPooledBufferMaxSize"
 	MeekMinPollInterval                        = "MeekMinPollInterval"
 	MeekMinPollIntervalJitter                  = "MeekMinPollIntervalJitter"
 	MeekMaxPollInterval                        = "MeekMaxPollInterval"
@@ -213,15 +300,87 @@ var defaultClientParameters = map[string]struct {
 	EstablishTunnelWorkTime:                  {value: 60 * time.Second, minimum: 1 * time.Second},
 	EstablishTunnelPausePeriod:               {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 	EstablishTunnelPausePeriodJitter:         {value: 0.1, minimum: 0.0},
+	EstablishTunnelPausePeriodMultiplier:     {value: 1.5, minimum: 1.0},
+	EstablishTunnelPausePeriodMax:            {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	EstablishTunnelServerAffinityGracePeriod: {value: 1 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	EstablishTunnelPinnedServerGracePeriod:   {value: 1 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	ServerEntryAvailabilityWindowRanking:     {value: true},
+	ServerEntryAvailabilityWindowClockSkew:   {value: 30 * time.Minute, minimum: time.Duration(0)},
+	ServerLoadAvoidanceThreshold:             {value: 90, minimum: 0},
+	ServerLoadAvoidancePeriod:                {value: 30 * time.Minute, minimum: time.Duration(0)},
 	StaggerConnectionWorkersPeriod:           {value: time.Duration(0), minimum: time.Duration(0)},
 	StaggerConnectionWorkersJitter:           {value: 0.1, minimum: 0.0},
 	LimitIntensiveConnectionWorkers:          {value: 0, minimum: 0},
+	EstablishTunnelBytesPerSecond:            {value: 0, minimum: 0},
 	IgnoreHandshakeStatsRegexps:              {value: false},
+	HandshakeSessionResumption:               {value: true},
 	TunnelOperateShutdownTimeout:             {value: 1 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelPortForwardDialTimeout:             {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+	PortForwardQueueTimeout:                  {value: 10 * time.Second, minimum: time.Duration(0)},
 	TunnelRateLimits:                         {value: common.RateLimits{}},
 
+	// ConstrainedHost parameters apply when the host reports, via
+	// Controller.SetHostConditions, that it's on battery or in doze mode.
+
+	ConstrainedHostConnectionWorkerPoolSize: {value: 2, minimum: 1},
+	ConstrainedHostEstablishPauseMultiplier: {value: 4.0, minimum: 1.0},
+	MeteredNetworkSkipUpgradeCheck:          {value: true},
+
+	// RegionLatencyProbePeriod defaults to 0, meaning region latency probing
+	// is disabled.
+
+	RegionLatencyProbePeriod:     {value: time.Duration(0), minimum: time.Duration(0)},
+	RegionLatencyProbeSampleSize: {value: 3, minimum: 1},
+	RegionLatencyProbeTimeout:    {value: 5 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+
+	// TunnelLivenessProbePeriod defaults to 0, meaning the tunnel liveness
+	// watchdog is disabled.
+
+	TunnelLivenessProbePeriod:      {value: time.Duration(0), minimum: time.Duration(0)},
+	TunnelLivenessProbeTimeout:     {value: 10 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	TunnelLivenessProbeMaxFailures: {value: 3, minimum: 1},
+	TunnelLivenessProbeAddress:     {value: ""},
+
+	// FastReconnectMaxAge defaults to 0, meaning fast reconnect is disabled.
+
+	FastReconnectMaxAge:  {value: time.Duration(0), minimum: time.Duration(0)},
+	FastReconnectTimeout: {value: 5 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	ControllerSnapshotMaxAge: {value: 1 * time.Hour, minimum: time.Duration(0)},
+
+	StatusFileUpdatePeriod: {value: 5 * time.Second, minimum: 1 * time.Second},
+
+	AdaptiveProtocolSelection:            {value: false},
+	AdaptiveProtocolSelectionExploration: {value: 0.1, minimum: 0.0},
+
+	// DecoyTrafficMode defaults to "", meaning decoy traffic is disabled.
+	// DecoyTrafficMaxTotalBytes caps the decoy traffic for the lifetime of
+	// the controller.
+
+	DecoyTrafficMode:               {value: ""},
+	DecoyTrafficURLs:               {value: DownloadURLs{}},
+	DecoyTrafficMinInterval:        {value: 30 * time.Second, minimum: 1 * time.Second},
+	DecoyTrafficMaxInterval:        {value: 5 * time.Minute, minimum: 1 * time.Second},
+	DecoyTrafficRequestTimeout:     {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	DecoyTrafficMaxBytesPerRequest: {value: 256 * 1024, minimum: 0},
+	DecoyTrafficMaxBytesPerSecond:  {value: 16 * 1024, minimum: 1},
+	DecoyTrafficMaxTotalBytes:      {value: 10 * 1024 * 1024, minimum: 0},
+
+	// TunnelPool autoscale parameters apply only when the client config
+	// specifies a TunnelPoolMaxSize. Throughput thresholds are per active
+	// tunnel, averaged over each TunnelPoolAutoscalePeriod.
+
+	TunnelPoolAutoscalePeriod:           {value: 10 * time.Second, minimum: 1 * time.Second},
+	TunnelPoolGrowBytesPerSecond:        {value: 256 * 1024, minimum: 1},
+	TunnelPoolShrinkBytesPerSecond:      {value: 16 * 1024, minimum: 0},
+	TunnelPoolGrowPortForwardQueueDepth: {value: 8, minimum: 1},
+
+	// PacketTunnelFlowStats parameters apply only when the client config
+	// enables PacketTunnelTrackFlows. A period of 0 disables FlowStats notices.
+
+	PacketTunnelFlowStatsPeriod:   {value: 1 * time.Minute, minimum: time.Duration(0)},
+	PacketTunnelFlowStatsMaxFlows: {value: 20, minimum: 1},
+
 	// PrioritizeTunnelProtocols parameters are obsoleted by InitialLimitTunnelProtocols.
 	// TODO: remove once no longer required for older clients.
 	PrioritizeTunnelProtocolsProbability:    {value: 1.0, minimum: 0.0},
@@ -241,6 +400,11 @@ var defaultClientParameters = map[string]struct {
 	LimitQUICVersionsProbability: {value: 1.0, minimum: 0.0},
 	LimitQUICVersions:            {value: protocol.QUICVersions{protocol.QUIC_VERSION_GQUIC43}},
 
+	QUICWireVersionsProbability:      {value: 1.0, minimum: 0.0},
+	QUICWireVersions:                 {value: protocol.QUICWireVersions{}},
+	QUICInitialPacketPaddingMinBytes: {value: 0, minimum: 0},
+	QUICInitialPacketPaddingMaxBytes: {value: 0, minimum: 0},
+
 	FragmentorProbability:              {value: 0.5, minimum: 0.0},
 	FragmentorLimitProtocols:           {value: protocol.TunnelProtocols{}},
 	FragmentorMinTotalBytes:            {value: 0, minimum: 0},
@@ -249,6 +413,7 @@ var defaultClientParameters = map[string]struct {
 	FragmentorMaxWriteBytes:            {value: 1500, minimum: 1},
 	FragmentorMinDelay:                 {value: time.Duration(0), minimum: time.Duration(0)},
 	FragmentorMaxDelay:                 {value: 10 * time.Millisecond, minimum: time.Duration(0)},
+	FragmentorSplitTLSSNIProbability:   {value: 0.0, minimum: 0.0},
 	FragmentorDownstreamProbability:    {value: 0.5, minimum: 0.0},
 	FragmentorDownstreamLimitProtocols: {value: protocol.TunnelProtocols{}},
 	FragmentorDownstreamMinTotalBytes:  {value: 0, minimum: 0},
@@ -258,6 +423,26 @@ var defaultClientParameters = map[string]struct {
 	FragmentorDownstreamMinDelay:       {value: time.Duration(0), minimum: time.Duration(0)},
 	FragmentorDownstreamMaxDelay:       {value: 10 * time.Millisecond, minimum: time.Duration(0)},
 
+	// 88 is the Linux minimum MSS.
+
+	TCPMaxSegmentSizeProbability:    {value: 0.0, minimum: 0.0},
+	TCPMaxSegmentSizeLimitProtocols: {value: protocol.TunnelProtocols{}},
+	TCPMaxSegmentSize:               {value: 536, minimum: 88},
+
+	TrafficShapingProfiles: {value: ShapingProfiles{}},
+
+	KnockDelay: {value: 200 * time.Millisecond, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+
+	// SSHChannelWindowSize and SSHPacketTunnelChannelWindowSize set the
+	// client SSH channel flow control windows, which cap the downstream
+	// throughput of each channel at window size/RTT. The defaults favor
+	// low channel open latency on low bandwidth links; larger windows may
+	// be required on high bandwidth-delay-product links. The minimum is the
+	// SSH maximum packet size.
+
+	SSHChannelWindowSize:             {value: 4 * 32768, minimum: 32768},
+	SSHPacketTunnelChannelWindowSize: {value: 16 * 32768, minimum: 32768},
+
 	// The Psiphon server will reject obfuscated SSH seed messages with
 	// padding greater than OBFUSCATE_MAX_PADDING.
 	// obfuscator.NewClientObfuscator will ignore invalid min/max padding
@@ -292,16 +477,66 @@ var defaultClientParameters = map[string]struct {
 	SSHKeepAliveProbeTimeout:               {value: 5 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	SSHKeepAliveProbeInactivePeriod:        {value: 10 * time.Second, minimum: 1 * time.Second},
 
+	// DormancyIdlePeriod defaults to 0, meaning dormancy mode is off. The
+	// dormant SSH keep alive period is subject to the same 5 minute server
+	// inactivity soft max as SSHKeepAlivePeriodMax.
+
+	DormancyIdlePeriod:            {value: time.Duration(0), minimum: time.Duration(0)},
+	DormancySSHKeepAlivePeriodMin: {value: 3 * time.Minute, minimum: 1 * time.Second},
+	DormancySSHKeepAlivePeriodMax: {value: 4 * time.Minute, minimum: 1 * time.Second},
+
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
+	// The local proxy and tunneled port forward idle timeouts default to 0,
+	// meaning idle connections are not closed.
+
+	HTTPProxyIdleTimeout:           {value: time.Duration(0), minimum: time.Duration(0)},
+	SOCKSProxyIdleTimeout:          {value: time.Duration(0), minimum: time.Duration(0)},
+	TunneledPortForwardIdleTimeout: {value: time.Duration(0), minimum: time.Duration(0)},
+
+	// When UDPChannelUdpgwServerAddress is set, tunneled port forwards to
+	// this udpgw server address, as used by tun2socks UDP forwarding, are
+	// terminated by the client and their UDP flows are relayed using a UDP
+	// channel. When the server doesn't support UDP channels, the port
+	// forward is relayed to the server's udpgw.
+
+	UDPChannelUdpgwServerAddress: {value: ""},
+
+	DirectCheckTimeout: {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	// CaptivePortalProbeURLs are plaintext HTTP URLs which return an empty
+	// 204 No Content response when there's no captive portal.
+
+	PreflightCheckTimeout:  {value: 10 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	CaptivePortalProbeURLs: {value: []string{"http://connectivitycheck.gstatic.com/generate_204", "http://cp.cloudflare.com/generate_204"}},
+
+	// When CaptivePortalDetection is set, the probe URLs are requested in
+	// the background after each failed establishment round, and
+	// establishment pauses while a captive portal is detected, probing every
+	// CaptivePortalProbePeriod. Detection is off by default, as the probes
+	// are plaintext requests to third party hosts, and is enabled via
+	// tactics.
+
+	CaptivePortalDetection:    {value: false},
+	CaptivePortalProbeTimeout: {value: 10 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	CaptivePortalProbePeriod:  {value: 5 * time.Second, minimum: 1 * time.Second},
+
 	FetchRemoteServerListTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchRemoteServerListRetryPeriod:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	FetchRemoteServerListStalePeriod:   {value: 6 * time.Hour, minimum: 1 * time.Hour},
 	RemoteServerListSignaturePublicKey: {value: ""},
 	RemoteServerListURLs:               {value: DownloadURLs{}},
+	RemoteServerListDeltaURLs:          {value: DownloadURLs{}},
 	ObfuscatedServerListRootURLs:       {value: DownloadURLs{}},
 
+	// StegoServerListFetchEstablishRounds is the number of establishment
+	// rounds that must fail before stego server lists are fetched, as stego
+	// server lists are a last resort.
+
+	StegoServerListURLs:                 {value: DownloadURLs{}},
+	StegoServerListFetchEstablishRounds: {value: 3, minimum: 1},
+
 	PsiphonAPIRequestTimeout: {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
 	PsiphonAPIStatusRequestPeriodMin:       {value: 5 * time.Minute, minimum: 1 * time.Second},
@@ -319,18 +554,61 @@ var defaultClientParameters = map[string]struct {
 	SplitTunnelRoutesSignaturePublicKey: {value: ""},
 	SplitTunnelDNSServer:                {value: ""},
 
+	DNSCacheMaxEntries:  {value: 1000, minimum: 0},
+	DNSCacheMaxTTL:      {value: 1 * time.Hour, minimum: time.Duration(0)},
+	DNSCacheNegativeTTL: {value: 30 * time.Second, minimum: time.Duration(0)},
+
+	// UntunneledDNSResolvers is an ordered list of encrypted DNS resolvers,
+	// "https://<IP>/dns-query" for DNS-over-HTTPS and "tls://<IP>[:<port>]"
+	// for DNS-over-TLS, tried before the plaintext system or bound resolver.
+
+	UntunneledDNSResolvers:         {value: []string{}},
+	UntunneledDNSResolverTimeout:   {value: 5 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	UntunneledDNSPlaintextFallback: {value: true},
+
+	// When UntunneledDNSResolversOnPoisoning is set, the encrypted resolvers
+	// are used only once plaintext DNS poisoning is detected.
+	// DNSPoisoningBlockIPs is a list of IP addresses and CIDRs which are
+	// known to be returned by DNS injection.
+
+	UntunneledDNSResolversOnPoisoning: {value: false},
+	DNSAnswerValidation:               {value: true},
+	DNSPoisoningBlockIPs:              {value: []string{}},
+	DNSPoisoningSwitchPeriod:          {value: 1 * time.Hour, minimum: time.Duration(0)},
+
+	// InproxyBrokerURLs are the in-proxy brokers, one of which is selected
+	// at random for each INPROXY-WEBRTC-OSSH dial. InproxyICEServers are the
+	// STUN servers, "stun:<host>:<port>", used for NAT traversal. The
+	// INPROXY-WEBRTC-OSSH protocol is disabled by default and must also be
+	// enabled via LimitTunnelProtocols.
+
+	InproxyBrokerURLs: {value: []string{}},
+	InproxyICEServers: {value: []string{}},
+
+	// NAT type discovery uses the first InproxyICEServers STUN server, which
+	// must support RFC 5780.
+
+	InproxyNATDiscoveryTestTimeout: {value: 2 * time.Second, minimum: 100 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+
 	FetchUpgradeTimeout:                {value: 60 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchUpgradeRetryPeriod:            {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	FetchUpgradeStalePeriod:            {value: 6 * time.Hour, minimum: 1 * time.Hour},
 	UpgradeDownloadURLs:                {value: DownloadURLs{}},
 	UpgradeDownloadClientVersionHeader: {value: ""},
+	UpgradeDownloadChunkSize:           {value: 0, minimum: 0},
+
+	FeedbackUploadURLs:          {value: DownloadURLs{}},
+	FeedbackEncryptionPublicKey: {value: ""},
+	FeedbackUploadTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	FeedbackUploadRetryPeriod:   {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 
 	TotalBytesTransferredNoticePeriod: {value: 5 * time.Minute, minimum: 1 * time.Second},
 
 	// The meek server times out inactive sessions after 45 seconds, so this
 	// is a soft max for MeekMaxPollInterval,  MeekRoundTripTimeout, and
 	// MeekRoundTripRetryDeadline. MeekCookieMaxPadding cannot exceed
-	// common.OBFUSCATE_SEED_LENGTH.
+	// common.OBFUSCATE_SEED_LENGTH. Relay buffers which have grown beyond
+	// MeekPooledBufferMaxSize are not returned to the buffer pool.
 
 	MeekDialDomainsOnly:                        {value: false},
 	MeekLimitBufferSizes:                       {value: false},
@@ -339,6 +617,7 @@ var defaultClientParameters = map[string]struct {
 	MeekReadPayloadChunkLength:                 {value: 65536, minimum: 1024},
 	MeekLimitedFullReceiveBufferLength:         {value: 131072, minimum: 1024},
 	MeekLimitedReadPayloadChunkLength:          {value: 4096, minimum: 1024},
+	MeekPooledBufferMaxSize:                    {value: 262144, minimum: 0},
 	MeekMinPollInterval:                        {value: 100 * time.Millisecond, minimum: 1 * time.Millisecond},
 	MeekMinPollIntervalJitter:                  {value: 0.3, minimum: 0.0},
 	MeekMaxPollInterval:                        {value: 5 * time.Second, minimum: 1 * time.Millisecond},
@@ -371,6 +650,8 @@ type ClientParametersSnapshot struct {
 	getValueLogger func(error)
 	tag            string
 	parameters     map[string]interface{}
+	priorities     map[string]int
+	sources        map[string]string
 }
 
 // NewClientParameters initializes a new ClientParameters with the default
@@ -439,11 +720,124 @@ func makeDefaultParameters() (map[string]interface{}, error) {
 func (p *ClientParameters) Set(
 	tag string, skipOnError bool, applyParameters ...map[string]interface{}) ([]int, error) {
 
+	layers := make([]ParameterLayer, len(applyParameters))
+	for i, parameters := range applyParameters {
+		layers[i] = ParameterLayer{
+			Source:     SourceUnknown,
+			Parameters: parameters,
+		}
+	}
+
+	return p.SetLayers(tag, skipOnError, layers...)
+}
+
+// Parameter sources, recorded with each parameter value for diagnostics.
+const (
+	SourceDefault   = "default"
+	SourceConfig    = "config"
+	SourceTactics   = "tactics"
+	SourceHandshake = "handshake"
+	SourceUnknown   = "unknown"
+)
+
+// ParameterLayer is a set of parameters to apply along with the source of
+// those parameters, such as SourceConfig or SourceTactics.
+type ParameterLayer struct {
+	Source     string
+	Parameters map[string]interface{}
+}
+
+// ParameterProvenance is a parameter value along with the source and
+// priority of the layer which set the value. Priority is 0 for default
+// values, and the layer index plus one otherwise; layers with higher
+// priority take precedence.
+type ParameterProvenance struct {
+	Value    interface{}
+	Source   string
+	Priority int
+}
+
+// SetLayers is Set with a source specified for each set of parameters. The
+// source of each parameter value is recorded and reported by Snapshot.
+func (p *ClientParameters) SetLayers(
+	tag string, skipOnError bool, layers ...ParameterLayer) ([]int, error) {
+
+	applyParameters := make([]map[string]interface{}, len(layers))
+	for i, layer := range layers {
+		applyParameters[i] = layer.Parameters
+	}
+
+	parameters, priorities, counts, err := makeParameters(skipOnError, applyParameters...)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	sources := make(map[string]string)
+	for name, priority := range priorities {
+		sources[name] = layers[priority-1].Source
+	}
+
+	snapshot := &ClientParametersSnapshot{
+		getValueLogger: p.getValueLogger,
+		tag:            tag,
+		parameters:     parameters,
+		priorities:     priorities,
+		sources:        sources,
+	}
+
+	p.snapshot.Store(snapshot)
+
+	return counts, nil
+}
+
+// ParameterChange is a change in a parameter value, as reported by DryRun.
+type ParameterChange struct {
+	Current   interface{}
+	Candidate interface{}
+}
+
+// DryRun reports how the current parameters would change if Set were called
+// with the same skipOnError and applyParameters inputs. The current
+// parameters are not modified. The returned map contains an entry for each
+// parameter with a different value.
+func (p *ClientParameters) DryRun(
+	skipOnError bool, applyParameters ...map[string]interface{}) (map[string]ParameterChange, error) {
+
+	candidateParameters, _, _, err := makeParameters(skipOnError, applyParameters...)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	currentParameters := p.Get().parameters
+
+	changes := make(map[string]ParameterChange)
+	for name, candidateValue := range candidateParameters {
+		currentValue := currentParameters[name]
+		if !reflect.DeepEqual(currentValue, candidateValue) {
+			changes[name] = ParameterChange{
+				Current:   currentValue,
+				Candidate: candidateValue,
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// makeParameters initializes a set of parameters using the default values and
+// then applies each applyParameters in turn, as described in Set. The
+// returned priorities map records, for each parameter not set to its
+// default, the index plus one of the applyParameters that set its value.
+func makeParameters(
+	skipOnError bool,
+	applyParameters ...map[string]interface{}) (map[string]interface{}, map[string]int, []int, error) {
+
 	var counts []int
+	priorities := make(map[string]int)
 
 	parameters, err := makeDefaultParameters()
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, nil, nil, common.ContextError(err)
 	}
 
 	for i := 0; i < len(applyParameters); i++ {
@@ -457,7 +851,7 @@ func (p *ClientParameters) Set(
 				if skipOnError {
 					continue
 				}
-				return nil, common.ContextError(fmt.Errorf("unknown parameter: %s", name))
+				return nil, nil, nil, common.ContextError(fmt.Errorf("unknown parameter: %s", name))
 			}
 
 			// Accept strings such as "1h" for duration parameters.
@@ -489,7 +883,7 @@ func (p *ClientParameters) Set(
 				if skipOnError {
 					continue
 				}
-				return nil, common.ContextError(fmt.Errorf("unmarshal parameter %s failed: %s", name, err))
+				return nil, nil, nil, common.ContextError(fmt.Errorf("unmarshal parameter %s failed: %s", name, err))
 			}
 
 			newValue := newValuePtr.Elem().Interface()
@@ -506,7 +900,7 @@ func (p *ClientParameters) Set(
 					if skipOnError {
 						continue
 					}
-					return nil, common.ContextError(err)
+					return nil, nil, nil, common.ContextError(err)
 				}
 			case protocol.TunnelProtocols:
 				if skipOnError {
@@ -514,7 +908,7 @@ func (p *ClientParameters) Set(
 				} else {
 					err := v.Validate()
 					if err != nil {
-						return nil, common.ContextError(err)
+						return nil, nil, nil, common.ContextError(err)
 					}
 				}
 			case protocol.TLSProfiles:
@@ -523,7 +917,7 @@ func (p *ClientParameters) Set(
 				} else {
 					err := v.Validate()
 					if err != nil {
-						return nil, common.ContextError(err)
+						return nil, nil, nil, common.ContextError(err)
 					}
 				}
 			case protocol.QUICVersions:
@@ -532,9 +926,26 @@ func (p *ClientParameters) Set(
 				} else {
 					err := v.Validate()
 					if err != nil {
-						return nil, common.ContextError(err)
+						return nil, nil, nil, common.ContextError(err)
 					}
 				}
+			case protocol.QUICWireVersions:
+				if skipOnError {
+					newValue = v.PruneInvalid()
+				} else {
+					err := v.Validate()
+					if err != nil {
+						return nil, nil, nil, common.ContextError(err)
+					}
+				}
+			case ShapingProfiles:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, nil, nil, common.ContextError(err)
+				}
 			}
 
 			// Enforce any minimums. Assumes defaultClientParameters[name]
@@ -561,17 +972,18 @@ func (p *ClientParameters) Set(
 					if skipOnError {
 						continue
 					}
-					return nil, common.ContextError(fmt.Errorf("unexpected parameter with minimum: %s", name))
+					return nil, nil, nil, common.ContextError(fmt.Errorf("unexpected parameter with minimum: %s", name))
 				}
 				if !valid {
 					if skipOnError {
 						continue
 					}
-					return nil, common.ContextError(fmt.Errorf("parameter below minimum: %s", name))
+					return nil, nil, nil, common.ContextError(fmt.Errorf("parameter below minimum: %s", name))
 				}
 			}
 
 			parameters[name] = newValue
+			priorities[name] = i + 1
 
 			count++
 		}
@@ -579,15 +991,7 @@ func (p *ClientParameters) Set(
 		counts = append(counts, count)
 	}
 
-	snapshot := &ClientParametersSnapshot{
-		getValueLogger: p.getValueLogger,
-		tag:            tag,
-		parameters:     parameters,
-	}
-
-	p.snapshot.Store(snapshot)
-
-	return counts, nil
+	return parameters, priorities, counts, nil
 }
 
 // Get returns the current parameters. Values read from the current parameters
@@ -596,6 +1000,36 @@ func (p *ClientParameters) Get() *ClientParametersSnapshot {
 	return p.snapshot.Load().(*ClientParametersSnapshot)
 }
 
+// GetValues returns a copy of the map of all parameter names and values.
+// Values are not deep copies and must be treated read-only.
+func (p *ClientParametersSnapshot) GetValues() map[string]interface{} {
+	values := make(map[string]interface{})
+	for name, value := range p.parameters {
+		values[name] = value
+	}
+	return values
+}
+
+// Snapshot returns the current value of every parameter along with the
+// source of that value, for diagnostics. Values are not deep copies and must
+// be treated read-only.
+func (p *ClientParameters) Snapshot() map[string]ParameterProvenance {
+	snapshot := p.Get()
+	provenance := make(map[string]ParameterProvenance)
+	for name, value := range snapshot.parameters {
+		source, ok := snapshot.sources[name]
+		if !ok {
+			source = SourceDefault
+		}
+		provenance[name] = ParameterProvenance{
+			Value:    value,
+			Source:   source,
+			Priority: snapshot.priorities[name],
+		}
+	}
+	return provenance
+}
+
 // Tag returns the tag associated with these parameters.
 func (p *ClientParametersSnapshot) Tag() string {
 	return p.tag
@@ -799,6 +1233,35 @@ func (p *ClientParametersSnapshot) QUICVersions(name string) protocol.QUICVersio
 	return value
 }
 
+// QUICWireVersions returns a protocol.QUICWireVersions parameter value.
+// If there is a corresponding Probability value, a weighted coin flip
+// will be performed and, depending on the result, the value or the
+// parameter default will be returned.
+func (p *ClientParametersSnapshot) QUICWireVersions(name string) protocol.QUICWireVersions {
+
+	probabilityName := name + "Probability"
+	_, ok := p.parameters[probabilityName]
+	if ok {
+		probabilityValue := float64(1.0)
+		p.getValue(probabilityName, &probabilityValue)
+		if !common.FlipWeightedCoin(probabilityValue) {
+			defaultParameter, ok := defaultClientParameters[name]
+			if ok {
+				defaultValue, ok := defaultParameter.value.(protocol.QUICWireVersions)
+				if ok {
+					value := make(protocol.QUICWireVersions, len(defaultValue))
+					copy(value, defaultValue)
+					return value
+				}
+			}
+		}
+	}
+
+	value := protocol.QUICWireVersions{}
+	p.getValue(name, &value)
+	return value
+}
+
 // DownloadURLs returns a DownloadURLs parameter value.
 func (p *ClientParametersSnapshot) DownloadURLs(name string) DownloadURLs {
 	value := DownloadURLs{}
@@ -813,6 +1276,13 @@ func (p *ClientParametersSnapshot) RateLimits(name string) common.RateLimits {
 	return value
 }
 
+// ShapingProfiles returns a ShapingProfiles parameter value.
+func (p *ClientParametersSnapshot) ShapingProfiles(name string) ShapingProfiles {
+	value := ShapingProfiles{}
+	p.getValue(name, &value)
+	return value
+}
+
 // HTTPHeaders returns an http.Header parameter value.
 func (p *ClientParametersSnapshot) HTTPHeaders(name string) http.Header {
 	value := make(http.Header)
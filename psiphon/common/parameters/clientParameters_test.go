@@ -43,6 +43,11 @@ func TestGetDefaultParameters(t *testing.T) {
 			if v != g {
 				t.Fatalf("String returned %+v expected %+v", v, g)
 			}
+		case []string:
+			g := p.Get().Strings(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("Strings returned %+v expected %+v", v, g)
+			}
 		case int:
 			g := p.Get().Int(name)
 			if v != g {
@@ -78,11 +83,21 @@ func TestGetDefaultParameters(t *testing.T) {
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("QUICVersions returned %+v expected %+v", v, g)
 			}
+		case protocol.QUICWireVersions:
+			g := p.Get().QUICWireVersions(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("QUICWireVersions returned %+v expected %+v", v, g)
+			}
 		case DownloadURLs:
 			g := p.Get().DownloadURLs(name)
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("DownloadURLs returned %+v expected %+v", v, g)
 			}
+		case ShapingProfiles:
+			g := p.Get().ShapingProfiles(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("ShapingProfiles returned %+v expected %+v", v, g)
+			}
 		case common.RateLimits:
 			g := p.Get().RateLimits(name)
 			if !reflect.DeepEqual(v, g) {
@@ -183,6 +198,91 @@ func TestOverrides(t *testing.T) {
 	}
 }
 
+func TestDryRun(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	defaultConnectionWorkerPoolSize := p.Get().Int(ConnectionWorkerPoolSize)
+	newConnectionWorkerPoolSize := defaultConnectionWorkerPoolSize + 1
+
+	applyParameters := map[string]interface{}{
+		ConnectionWorkerPoolSize: newConnectionWorkerPoolSize,
+		"unknown-parameter-name": 1,
+	}
+
+	changes, err := p.DryRun(true, applyParameters)
+	if err != nil {
+		t.Fatalf("DryRun failed: %s", err)
+	}
+
+	if len(changes) != 1 {
+		t.Fatalf("DryRun returned unexpected changes: %+v", changes)
+	}
+
+	change, ok := changes[ConnectionWorkerPoolSize]
+	if !ok ||
+		change.Current != defaultConnectionWorkerPoolSize ||
+		change.Candidate != newConnectionWorkerPoolSize {
+		t.Fatalf("DryRun returned unexpected change: %+v", change)
+	}
+
+	if p.Get().Int(ConnectionWorkerPoolSize) != defaultConnectionWorkerPoolSize {
+		t.Fatalf("DryRun modified current parameters")
+	}
+
+	_, err = p.DryRun(false, applyParameters)
+	if err == nil {
+		t.Fatalf("DryRun succeeded unexpectedly")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = p.SetLayers(
+		"tag",
+		false,
+		ParameterLayer{
+			Source: SourceConfig,
+			Parameters: map[string]interface{}{
+				TacticsWaitPeriod:        "1s",
+				ConnectionWorkerPoolSize: 2,
+			},
+		},
+		ParameterLayer{
+			Source: SourceTactics,
+			Parameters: map[string]interface{}{
+				TacticsWaitPeriod: "2s",
+			},
+		})
+	if err != nil {
+		t.Fatalf("SetLayers failed: %s", err)
+	}
+
+	snapshot := p.Snapshot()
+
+	if len(snapshot) != len(defaultClientParameters) {
+		t.Fatalf("unexpected snapshot size: %d", len(snapshot))
+	}
+
+	expected := map[string]ParameterProvenance{
+		TacticsWaitPeriod:        {Value: 2 * time.Second, Source: SourceTactics, Priority: 2},
+		ConnectionWorkerPoolSize: {Value: 2, Source: SourceConfig, Priority: 1},
+		TacticsTimeout:           {Value: defaultClientParameters[TacticsTimeout].value, Source: SourceDefault, Priority: 0},
+	}
+
+	for name, expectedProvenance := range expected {
+		if snapshot[name] != expectedProvenance {
+			t.Fatalf("unexpected provenance for %s: %+v", name, snapshot[name])
+		}
+	}
+}
+
 func TestNetworkLatencyMultiplier(t *testing.T) {
 	p, err := NewClientParameters(nil)
 	if err != nil {
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ShapingProfile specifies a traffic shaping padding and timing profile applied to
+// tunnel flows to counter flow fingerprinting classifiers.
+type ShapingProfile struct {
+
+	// Name identifies the profile in stats.
+	Name string
+
+	// LimitProtocols specifies the tunnel protocols to which the profile
+	// applies. When empty, the profile applies to all protocols that
+	// support traffic shaping: OSSH and meek.
+	LimitProtocols protocol.TunnelProtocols
+
+	// WriteSizes is the packet size distribution. Each write to the
+	// network is split into chunks with sizes sampled uniformly from
+	// WriteSizes; repeat a size to increase its weight. When empty, writes
+	// are not split.
+	WriteSizes []int
+
+	// MinBurstIntervalMilliseconds and MaxBurstIntervalMilliseconds specify
+	// the range of the minimum interval between the starts of successive
+	// bursts, or writes, to the network. Each interval is sampled uniformly
+	// from the range. When both are 0, writes are not delayed.
+	MinBurstIntervalMilliseconds int
+	MaxBurstIntervalMilliseconds int
+
+	// MinPaddingBytes and MaxPaddingBytes specify the size range of padding
+	// messages, which are sent through the SSH layer and discarded by the
+	// server. MinPaddingIntervalMilliseconds and
+	// MaxPaddingIntervalMilliseconds specify the range of intervals between
+	// padding messages. When MaxPaddingBytes is 0, no padding is sent.
+	MinPaddingBytes                int
+	MaxPaddingBytes                int
+	MinPaddingIntervalMilliseconds int
+	MaxPaddingIntervalMilliseconds int
+}
+
+// ShapingProfiles is a list of traffic shaping profiles.
+type ShapingProfiles []*ShapingProfile
+
+// Validate checks that each profile has valid protocols, sizes, and ranges.
+func (profiles ShapingProfiles) Validate() error {
+
+	for _, profile := range profiles {
+
+		if profile.Name == "" {
+			return common.ContextError(fmt.Errorf("missing profile name"))
+		}
+
+		err := profile.LimitProtocols.Validate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		for _, writeSize := range profile.WriteSizes {
+			if writeSize <= 0 {
+				return common.ContextError(
+					fmt.Errorf("invalid write size in profile %s", profile.Name))
+			}
+		}
+
+		if profile.MinBurstIntervalMilliseconds < 0 ||
+			profile.MaxBurstIntervalMilliseconds < profile.MinBurstIntervalMilliseconds ||
+			profile.MinPaddingBytes < 0 ||
+			profile.MaxPaddingBytes < profile.MinPaddingBytes ||
+			profile.MinPaddingIntervalMilliseconds < 0 ||
+			profile.MaxPaddingIntervalMilliseconds < profile.MinPaddingIntervalMilliseconds {
+			return common.ContextError(
+				fmt.Errorf("invalid range in profile %s", profile.Name))
+		}
+
+		if profile.MaxPaddingBytes > 0 && profile.MaxPaddingIntervalMilliseconds == 0 {
+			return common.ContextError(
+				fmt.Errorf("missing padding interval in profile %s", profile.Name))
+		}
+	}
+
+	return nil
+}
+
+// Select chooses, at random, a profile applicable to the specified tunnel
+// protocol. Returns nil when there is no applicable profile.
+func (profiles ShapingProfiles) Select(tunnelProtocol string) *ShapingProfile {
+
+	if tunnelProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH &&
+		!protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+		return nil
+	}
+
+	var candidates []*ShapingProfile
+	for _, profile := range profiles {
+		if len(profile.LimitProtocols) == 0 ||
+			common.Contains(profile.LimitProtocols, tunnelProtocol) {
+			candidates = append(candidates, profile)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	index, err := common.MakeSecureRandomInt(len(candidates))
+	if err != nil {
+		index = 0
+	}
+
+	return candidates[index]
+}
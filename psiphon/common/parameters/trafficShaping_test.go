@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestShapingProfiles(t *testing.T) {
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	invalidProfiles := []map[string]interface{}{
+		{"WriteSizes": []int{100}},
+		{"Name": "x", "WriteSizes": []int{0}},
+		{"Name": "x", "LimitProtocols": []string{"INVALID"}},
+		{"Name": "x", "MinBurstIntervalMilliseconds": 10, "MaxBurstIntervalMilliseconds": 5},
+		{"Name": "x", "MaxPaddingBytes": 100},
+	}
+
+	for _, invalidProfile := range invalidProfiles {
+		_, err := p.Set("", false, map[string]interface{}{
+			TrafficShapingProfiles: []interface{}{invalidProfile}})
+		if err == nil {
+			t.Fatalf("Set succeeded unexpectedly for %+v", invalidProfile)
+		}
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{
+		TrafficShapingProfiles: []interface{}{
+			map[string]interface{}{
+				"Name":           "meek",
+				"LimitProtocols": []string{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK},
+				"WriteSizes":     []int{1200, 1400},
+			},
+			map[string]interface{}{
+				"Name":                           "padded",
+				"LimitProtocols":                 []string{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+				"MaxPaddingBytes":                256,
+				"MinPaddingIntervalMilliseconds": 100,
+				"MaxPaddingIntervalMilliseconds": 1000,
+			},
+		}})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	profiles := p.Get().ShapingProfiles(TrafficShapingProfiles)
+
+	profile := profiles.Select(protocol.TUNNEL_PROTOCOL_FRONTED_MEEK)
+	if profile == nil || profile.Name != "meek" {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+
+	profile = profiles.Select(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+	if profile == nil || profile.Name != "padded" {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+
+	profile = profiles.Select(protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH)
+	if profile != nil {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+}
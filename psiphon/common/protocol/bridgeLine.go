@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Bridge lines are the Tor pluggable transport bridge configuration format:
+//
+//   [Bridge] <transport> <address>:<port> [<fingerprint>] [<key>=<value> ...]
+//
+// Tor bridge lines don't carry the SSH credentials that every Psiphon
+// server requires, so a bridge line may be converted to a Psiphon server
+// entry only when the operator appends the Psiphon credentials as
+// additional key=value arguments. Pluggable transport arguments, such as
+// the obfs4 "cert" and "iat-mode", and the bridge fingerprint, are ignored.
+//
+// Transports are converted where capabilities align:
+//
+// - "obfs4" lines are converted to OSSH, which is likewise a fully
+//   randomized TCP stream. As the obfs4 port doesn't speak OSSH, the
+//   Psiphon server's OSSH port is given in the "ossh-port" argument.
+//
+// - "webtunnel" lines are converted to FRONTED-MEEK-OSSH, which is likewise
+//   HTTPS to the domain in the "url" argument. WebTunnel bridge addresses
+//   are often placeholders; the address is used only as the Psiphon server
+//   entry IP address, which must be unique.
+//
+// - "psiphon" lines are converted to OSSH on the bridge line port.
+//
+// Lines for other transports, such as "snowflake" and "meek_lite", are not
+// converted.
+
+const (
+	BRIDGE_LINE_TRANSPORT_OBFS4     = "obfs4"
+	BRIDGE_LINE_TRANSPORT_WEBTUNNEL = "webtunnel"
+	BRIDGE_LINE_TRANSPORT_PSIPHON   = "psiphon"
+
+	BRIDGE_LINE_ARG_SSH_USERNAME                      = "ssh-username"
+	BRIDGE_LINE_ARG_SSH_PASSWORD                      = "ssh-password"
+	BRIDGE_LINE_ARG_SSH_HOST_KEY                      = "ssh-host-key"
+	BRIDGE_LINE_ARG_SSH_OBFUSCATED_KEY                = "ssh-obfuscated-key"
+	BRIDGE_LINE_ARG_OSSH_PORT                         = "ossh-port"
+	BRIDGE_LINE_ARG_URL                               = "url"
+	BRIDGE_LINE_ARG_MEEK_COOKIE_ENCRYPTION_PUBLIC_KEY = "meek-cookie-encryption-public-key"
+	BRIDGE_LINE_ARG_MEEK_OBFUSCATED_KEY               = "meek-obfuscated-key"
+	BRIDGE_LINE_ARG_REGION                            = "region"
+	BRIDGE_LINE_ARG_CONFIGURATION_VERSION             = "configuration-version"
+)
+
+// ParseBridgeLine converts a single bridge line into a Psiphon server entry.
+// An error is returned when the transport has no Psiphon equivalent or when
+// a required Psiphon argument is missing.
+func ParseBridgeLine(line string) (*ServerEntry, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "Bridge" {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil, common.ContextError(errors.New("invalid bridge line"))
+	}
+
+	transport := fields[0]
+
+	host, portStr, err := net.SplitHostPort(fields[1])
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, common.ContextError(errors.New("invalid bridge address"))
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, common.ContextError(errors.New("invalid bridge port"))
+	}
+
+	args := make(map[string]string)
+	for _, field := range fields[2:] {
+		index := strings.Index(field, "=")
+		if index == -1 {
+			// The bridge fingerprint.
+			continue
+		}
+		args[field[:index]] = field[index+1:]
+	}
+
+	requireArg := func(name string) (string, error) {
+		value := args[name]
+		if value == "" {
+			return "", common.ContextError(
+				fmt.Errorf("missing bridge line argument: %s", name))
+		}
+		return value, nil
+	}
+
+	serverEntry := &ServerEntry{
+		IpAddress: host,
+		Region:    args[BRIDGE_LINE_ARG_REGION],
+	}
+
+	if args[BRIDGE_LINE_ARG_CONFIGURATION_VERSION] != "" {
+		serverEntry.ConfigurationVersion, err = strconv.Atoi(
+			args[BRIDGE_LINE_ARG_CONFIGURATION_VERSION])
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	for _, arg := range []struct {
+		name  string
+		value *string
+	}{
+		{BRIDGE_LINE_ARG_SSH_USERNAME, &serverEntry.SshUsername},
+		{BRIDGE_LINE_ARG_SSH_PASSWORD, &serverEntry.SshPassword},
+		{BRIDGE_LINE_ARG_SSH_HOST_KEY, &serverEntry.SshHostKey},
+		{BRIDGE_LINE_ARG_SSH_OBFUSCATED_KEY, &serverEntry.SshObfuscatedKey},
+	} {
+		*arg.value, err = requireArg(arg.name)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var tunnelProtocol string
+
+	switch transport {
+
+	case BRIDGE_LINE_TRANSPORT_OBFS4:
+
+		value, err := requireArg(BRIDGE_LINE_ARG_OSSH_PORT)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		serverEntry.SshObfuscatedPort, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		tunnelProtocol = TUNNEL_PROTOCOL_OBFUSCATED_SSH
+
+	case BRIDGE_LINE_TRANSPORT_PSIPHON:
+
+		serverEntry.SshObfuscatedPort = port
+		tunnelProtocol = TUNNEL_PROTOCOL_OBFUSCATED_SSH
+
+	case BRIDGE_LINE_TRANSPORT_WEBTUNNEL:
+
+		value, err := requireArg(BRIDGE_LINE_ARG_URL)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		webTunnelURL, err := url.Parse(value)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		// Fronted meek always dials port 443.
+		if webTunnelURL.Scheme != "https" ||
+			(webTunnelURL.Port() != "" && webTunnelURL.Port() != "443") {
+			return nil, common.ContextError(errors.New("unsupported webtunnel URL"))
+		}
+
+		serverEntry.MeekFrontingAddresses = []string{webTunnelURL.Hostname()}
+		serverEntry.MeekFrontingHosts = []string{webTunnelURL.Hostname()}
+		serverEntry.MeekServerPort = 443
+
+		serverEntry.MeekCookieEncryptionPublicKey, err = requireArg(
+			BRIDGE_LINE_ARG_MEEK_COOKIE_ENCRYPTION_PUBLIC_KEY)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		serverEntry.MeekObfuscatedKey, err = requireArg(
+			BRIDGE_LINE_ARG_MEEK_OBFUSCATED_KEY)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		tunnelProtocol = TUNNEL_PROTOCOL_FRONTED_MEEK
+
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported bridge transport: %s", transport))
+	}
+
+	// Without a web server, API requests are made over the SSH tunnel.
+
+	serverEntry.Capabilities = []string{
+		GetCapability(tunnelProtocol),
+		CAPABILITY_SSH_API_REQUESTS,
+	}
+
+	return serverEntry, nil
+}
+
+// DecodeBridgeLines converts newline-delimited bridge lines, as found in a
+// torrc or a bridges file, into server entries. Blank lines and "#" comments
+// are skipped. As with DecodeServerEntryList, the local source and timestamp
+// fields are populated with the given values.
+//
+// Lines which can't be converted are skipped and reported in the returned
+// list of errors, so that an operator can review which bridges were not
+// imported.
+func DecodeBridgeLines(
+	bridgeLines, timestamp, serverEntrySource string) ([]ServerEntryFields, []error) {
+
+	var serverEntries []ServerEntryFields
+	var lineErrors []error
+
+	scanner := bufio.NewScanner(strings.NewReader(bridgeLines))
+	lineNumber := 0
+
+	for scanner.Scan() {
+
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		serverEntryFields, err := decodeBridgeLine(line, timestamp, serverEntrySource)
+		if err != nil {
+			lineErrors = append(
+				lineErrors, fmt.Errorf("bridge line %d: %s", lineNumber, err))
+			continue
+		}
+
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+
+	if err := scanner.Err(); err != nil {
+		lineErrors = append(lineErrors, common.ContextError(err))
+	}
+
+	return serverEntries, lineErrors
+}
+
+func decodeBridgeLine(
+	line, timestamp, serverEntrySource string) (ServerEntryFields, error) {
+
+	serverEntry, err := ParseBridgeLine(line)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Convert to ServerEntryFields via JSON, as in DecodeServerEntryFields.
+
+	serverEntryJSON, err := json.Marshal(serverEntry)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var serverEntryFields ServerEntryFields
+	err = json.Unmarshal(serverEntryJSON, &serverEntryFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	serverEntryFields.SetLocalSource(serverEntrySource)
+	serverEntryFields.SetLocalTimestamp(timestamp)
+
+	err = ValidateServerEntryFields(serverEntryFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return serverEntryFields, nil
+}
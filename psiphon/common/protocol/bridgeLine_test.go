@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestBridgeLines(t *testing.T) {
+
+	credentials := "ssh-username=user ssh-password=password ssh-host-key=hostkey ssh-obfuscated-key=obfuscatedkey"
+
+	bridgeLines := strings.Join([]string{
+		"# comment",
+		"",
+		"Bridge obfs4 192.0.2.1:9001 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0 ossh-port=2222 region=CA " + credentials,
+		"webtunnel [2001:db8::1]:443 0123456789ABCDEF0123456789ABCDEF01234567 url=https://example.com/path meek-cookie-encryption-public-key=cookiekey meek-obfuscated-key=meekkey " + credentials,
+		"psiphon 192.0.2.2:443 " + credentials,
+		"obfs4 192.0.2.3:9001 cert=abc iat-mode=0 " + credentials,
+		"snowflake 192.0.2.4:1 " + credentials,
+		"psiphon 192.0.2.5:443 ssh-username=user",
+		"webtunnel 192.0.2.6:443 url=http://example.com meek-cookie-encryption-public-key=cookiekey meek-obfuscated-key=meekkey " + credentials,
+	}, "\n")
+
+	serverEntryFields, lineErrors := DecodeBridgeLines(
+		bridgeLines, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+
+	if len(serverEntryFields) != 3 {
+		t.Fatalf("unexpected server entry count: %d", len(serverEntryFields))
+	}
+
+	if len(lineErrors) != 4 ||
+		!strings.HasPrefix(lineErrors[0].Error(), "bridge line 6:") {
+		t.Fatalf("unexpected line errors: %v", lineErrors)
+	}
+
+	var serverEntries []*ServerEntry
+	for _, fields := range serverEntryFields {
+		encodedServerEntry, err := EncodeServerEntryFields(fields)
+		if err != nil {
+			t.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		serverEntry, err := DecodeServerEntry(
+			encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+		if err != nil {
+			t.Fatalf("DecodeServerEntry failed: %s", err)
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+
+	if serverEntries[0].IpAddress != "192.0.2.1" ||
+		serverEntries[0].SshObfuscatedPort != 2222 ||
+		serverEntries[0].Region != "CA" ||
+		serverEntries[0].SshObfuscatedKey != "obfuscatedkey" ||
+		!serverEntries[0].SupportsProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+		!serverEntries[0].SupportsSSHAPIRequests() {
+		t.Fatalf("unexpected obfs4 server entry: %+v", serverEntries[0])
+	}
+
+	if serverEntries[1].IpAddress != "2001:db8::1" ||
+		len(serverEntries[1].MeekFrontingAddresses) != 1 ||
+		serverEntries[1].MeekFrontingAddresses[0] != "example.com" ||
+		serverEntries[1].MeekObfuscatedKey != "meekkey" ||
+		!serverEntries[1].SupportsProtocol(TUNNEL_PROTOCOL_FRONTED_MEEK) ||
+		serverEntries[1].SupportsProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH) {
+		t.Fatalf("unexpected webtunnel server entry: %+v", serverEntries[1])
+	}
+
+	if serverEntries[2].SshObfuscatedPort != 443 ||
+		serverEntries[2].LocalSource != SERVER_ENTRY_SOURCE_IMPORTED {
+		t.Fatalf("unexpected psiphon server entry: %+v", serverEntries[2])
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+// compiler compiles a directory of server entry files into an embedded
+// server entry list, for operators maintaining private server fleets. The
+// output is either the raw list, as passed to the client as the embedded
+// server entry list, or, when a package name is specified, Go source
+// declaring the list as a string constant. The latter is intended for use
+// with go:generate, for example:
+//
+//   //go:generate go run github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol/compiler -input servers -output embeddedServerEntries.go -package main
+//
+// See protocol.CompileServerEntryDirectory for the server entry file format.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func main() {
+
+	var inputDirectory string
+	flag.StringVar(&inputDirectory, "input", "", "directory of server entry files")
+
+	var outputFilename string
+	flag.StringVar(&outputFilename, "output", "", "output filename; default, stdout")
+
+	var packageName string
+	flag.StringVar(&packageName, "package", "", "emit Go source in the specified package; default, emit the raw list")
+
+	var constantName string
+	flag.StringVar(&constantName, "const", "embeddedServerEntryList", "Go source constant name")
+
+	flag.Parse()
+
+	if inputDirectory == "" {
+		fmt.Printf("missing input directory\n")
+		os.Exit(1)
+	}
+
+	serverEntryList, err := protocol.CompileServerEntryDirectory(inputDirectory)
+	if err != nil {
+		fmt.Printf("failed compiling server entries: %s\n", err)
+		os.Exit(1)
+	}
+
+	output := []byte(serverEntryList)
+
+	if packageName != "" {
+		output, err = protocol.GenerateServerEntryListSource(
+			packageName, constantName, serverEntryList)
+		if err != nil {
+			fmt.Printf("failed generating source: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if outputFilename == "" {
+		os.Stdout.Write(output)
+		return
+	}
+
+	err = ioutil.WriteFile(outputFilename, output, 0644)
+	if err != nil {
+		fmt.Printf("failed writing output file: %s\n", err)
+		os.Exit(1)
+	}
+}
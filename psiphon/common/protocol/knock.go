@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	KNOCK_PROTOCOL_UDP = "udp"
+	KNOCK_PROTOCOL_TCP = "tcp"
+
+	KNOCK_KEY_SIZE       = 32
+	KNOCK_NONCE_SIZE     = 16
+	KNOCK_MAC_SIZE       = 16
+	KNOCK_PAYLOAD_SIZE   = 8 + KNOCK_NONCE_SIZE + KNOCK_MAC_SIZE
+	KNOCK_MAX_CLOCK_SKEW = 5 * time.Minute
+)
+
+// RequiresKnock indicates whether the server is behind a default-drop
+// firewall which opens only after receiving a valid knock payload on
+// KnockPort.
+func (serverEntry *ServerEntry) RequiresKnock() bool {
+	return serverEntry.KnockProtocol != ""
+}
+
+// ValidateKnock checks the knock fields of a server entry which requires a
+// knock.
+func (serverEntry *ServerEntry) ValidateKnock() error {
+	if serverEntry.KnockProtocol != KNOCK_PROTOCOL_UDP &&
+		serverEntry.KnockProtocol != KNOCK_PROTOCOL_TCP {
+		return common.ContextError(
+			fmt.Errorf("invalid knock protocol: %s", serverEntry.KnockProtocol))
+	}
+	if serverEntry.KnockPort <= 0 || serverEntry.KnockPort > 65535 {
+		return common.ContextError(
+			fmt.Errorf("invalid knock port: %d", serverEntry.KnockPort))
+	}
+	key, err := base64.StdEncoding.DecodeString(serverEntry.KnockKey)
+	if err != nil || len(key) != KNOCK_KEY_SIZE {
+		return common.ContextError(errors.New("invalid knock key"))
+	}
+	return nil
+}
+
+// MakeKnockPayload creates a knock payload authenticated with the base64
+// encoded knock key. The payload is an 8 byte Unix timestamp, a random
+// nonce, and a truncated HMAC-SHA256 of the timestamp and nonce. The
+// payload is indistinguishable from random bytes, apart from its length,
+// to an observer without the key.
+func MakeKnockPayload(knockKey string, now time.Time) ([]byte, error) {
+
+	key, err := base64.StdEncoding.DecodeString(knockKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	payload := make([]byte, KNOCK_PAYLOAD_SIZE)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(now.Unix()))
+
+	nonce, err := common.MakeSecureRandomBytes(KNOCK_NONCE_SIZE)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	copy(payload[8:8+KNOCK_NONCE_SIZE], nonce)
+
+	copy(payload[8+KNOCK_NONCE_SIZE:], knockMAC(key, payload[:8+KNOCK_NONCE_SIZE]))
+
+	return payload, nil
+}
+
+// VerifyKnockPayload checks that a knock payload is authenticated with the
+// base64 encoded knock key and that its timestamp is within
+// KNOCK_MAX_CLOCK_SKEW of now. Returns the payload nonce, which the caller
+// should use to reject replayed knocks within the clock skew window.
+func VerifyKnockPayload(knockKey string, payload []byte, now time.Time) ([]byte, error) {
+
+	key, err := base64.StdEncoding.DecodeString(knockKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if len(payload) != KNOCK_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("invalid knock payload size"))
+	}
+
+	if !hmac.Equal(
+		payload[8+KNOCK_NONCE_SIZE:],
+		knockMAC(key, payload[:8+KNOCK_NONCE_SIZE])) {
+		return nil, common.ContextError(errors.New("invalid knock MAC"))
+	}
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(payload[0:8])), 0)
+	skew := now.Sub(timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > KNOCK_MAX_CLOCK_SKEW {
+		return nil, common.ContextError(errors.New("invalid knock timestamp"))
+	}
+
+	return payload[8 : 8+KNOCK_NONCE_SIZE], nil
+}
+
+func knockMAC(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)[:KNOCK_MAC_SIZE]
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestKnockPayload(t *testing.T) {
+
+	key, err := common.MakeSecureRandomBytes(KNOCK_KEY_SIZE)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+	knockKey := base64.StdEncoding.EncodeToString(key)
+
+	serverEntry := &ServerEntry{
+		KnockProtocol: KNOCK_PROTOCOL_UDP,
+		KnockPort:     4000,
+		KnockKey:      knockKey,
+	}
+	if !serverEntry.RequiresKnock() {
+		t.Fatalf("unexpected RequiresKnock result")
+	}
+	err = serverEntry.ValidateKnock()
+	if err != nil {
+		t.Fatalf("ValidateKnock failed: %s", err)
+	}
+
+	serverEntry.KnockProtocol = "icmp"
+	if serverEntry.ValidateKnock() == nil {
+		t.Fatalf("ValidateKnock succeeded unexpectedly")
+	}
+
+	now := time.Now()
+
+	payload, err := MakeKnockPayload(knockKey, now)
+	if err != nil {
+		t.Fatalf("MakeKnockPayload failed: %s", err)
+	}
+
+	nonce, err := VerifyKnockPayload(knockKey, payload, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("VerifyKnockPayload failed: %s", err)
+	}
+	if !bytes.Equal(nonce, payload[8:8+KNOCK_NONCE_SIZE]) {
+		t.Fatalf("unexpected nonce")
+	}
+
+	// Each payload has a distinct nonce.
+	otherPayload, err := MakeKnockPayload(knockKey, now)
+	if err != nil {
+		t.Fatalf("MakeKnockPayload failed: %s", err)
+	}
+	if bytes.Equal(payload, otherPayload) {
+		t.Fatalf("unexpected identical payloads")
+	}
+
+	_, err = VerifyKnockPayload(
+		knockKey, payload, now.Add(KNOCK_MAX_CLOCK_SKEW+time.Minute))
+	if err == nil {
+		t.Fatalf("VerifyKnockPayload succeeded unexpectedly with expired payload")
+	}
+
+	tamperedPayload := append([]byte(nil), payload...)
+	tamperedPayload[0] ^= 1
+	_, err = VerifyKnockPayload(knockKey, tamperedPayload, now)
+	if err == nil {
+		t.Fatalf("VerifyKnockPayload succeeded unexpectedly with tampered payload")
+	}
+
+	otherKey, _ := common.MakeSecureRandomBytes(KNOCK_KEY_SIZE)
+	_, err = VerifyKnockPayload(
+		base64.StdEncoding.EncodeToString(otherKey), payload, now)
+	if err == nil {
+		t.Fatalf("VerifyKnockPayload succeeded unexpectedly with wrong key")
+	}
+}
@@ -20,8 +20,12 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
@@ -38,12 +42,15 @@ const (
 	TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH           = "QUIC-OSSH"
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH     = "MARIONETTE-OSSH"
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH       = "TAPDANCE-OSSH"
+	TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH = "INPROXY-WEBRTC-OSSH"
 
 	SERVER_ENTRY_SOURCE_EMBEDDED   = "EMBEDDED"
 	SERVER_ENTRY_SOURCE_REMOTE     = "REMOTE"
 	SERVER_ENTRY_SOURCE_DISCOVERY  = "DISCOVERY"
 	SERVER_ENTRY_SOURCE_TARGET     = "TARGET"
 	SERVER_ENTRY_SOURCE_OBFUSCATED = "OBFUSCATED"
+	SERVER_ENTRY_SOURCE_IMPORTED   = "IMPORTED"
+	SERVER_ENTRY_SOURCE_STEGO      = "STEGO"
 
 	CAPABILITY_SSH_API_REQUESTS            = "ssh-api-requests"
 	CAPABILITY_UNTUNNELED_WEB_API_REQUESTS = "handshake"
@@ -54,6 +61,7 @@ const (
 	PSIPHON_API_CONNECTED_REQUEST_NAME = "psiphon-connected"
 	PSIPHON_API_STATUS_REQUEST_NAME    = "psiphon-status"
 	PSIPHON_API_OSL_REQUEST_NAME       = "psiphon-osl"
+	PSIPHON_API_PADDING_REQUEST_NAME   = "psiphon-padding"
 
 	// PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME may still be used by older Android clients
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME = "psiphon-client-verification"
@@ -64,8 +72,10 @@ const (
 	PSIPHON_WEB_API_PROTOCOL = "web"
 
 	PACKET_TUNNEL_CHANNEL_TYPE = "tun@psiphon.ca"
+	UDP_CHANNEL_TYPE           = "udp@psiphon.ca"
 
-	PSIPHON_API_HANDSHAKE_AUTHORIZATIONS = "authorizations"
+	PSIPHON_API_HANDSHAKE_AUTHORIZATIONS           = "authorizations"
+	PSIPHON_API_HANDSHAKE_SESSION_RESUMPTION_TOKEN = "session_resumption_token"
 )
 
 type TunnelProtocols []string
@@ -100,11 +110,13 @@ var SupportedTunnelProtocols = TunnelProtocols{
 	TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+	TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH,
 }
 
 var DefaultDisabledTunnelProtocols = TunnelProtocols{
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+	TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH,
 }
 
 var SupportedServerEntrySources = TunnelProtocols{
@@ -113,6 +125,8 @@ var SupportedServerEntrySources = TunnelProtocols{
 	SERVER_ENTRY_SOURCE_DISCOVERY,
 	SERVER_ENTRY_SOURCE_TARGET,
 	SERVER_ENTRY_SOURCE_OBFUSCATED,
+	SERVER_ENTRY_SOURCE_IMPORTED,
+	SERVER_ENTRY_SOURCE_STEGO,
 }
 
 func TunnelProtocolUsesSSH(protocol string) bool {
@@ -155,6 +169,10 @@ func TunnelProtocolUsesTapdance(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH
 }
 
+func TunnelProtocolUsesInproxy(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH
+}
+
 func TunnelProtocolIsFronted(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK
 }
@@ -163,7 +181,8 @@ func TunnelProtocolIsResourceIntensive(protocol string) bool {
 	return TunnelProtocolUsesMeek(protocol) ||
 		TunnelProtocolUsesQUIC(protocol) ||
 		TunnelProtocolUsesMarionette(protocol) ||
-		TunnelProtocolUsesTapdance(protocol)
+		TunnelProtocolUsesTapdance(protocol) ||
+		TunnelProtocolUsesInproxy(protocol)
 }
 
 func UseClientTunnelProtocol(
@@ -262,17 +281,95 @@ func (versions QUICVersions) PruneInvalid() QUICVersions {
 	return u
 }
 
+// QUIC wire versions are the version numbers written in the headers of QUIC
+// client packets in place of the negotiated QUIC version, to mimic QUIC
+// versions which pass censor allowlists. A wire version is either a 4
+// character version tag, such as "Q050" or "T051", a hexadecimal version
+// number, such as "0xff00001d", or QUIC_WIRE_VERSION_GREASE, which selects a
+// random reserved version number of the form 0x?a?a?a?a.
+const (
+	QUIC_WIRE_VERSION_GREASE = "grease"
+)
+
+type QUICWireVersions []string
+
+func (versions QUICWireVersions) Validate() error {
+	for _, v := range versions {
+		_, err := ParseQUICWireVersion(v)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
+}
+
+func (versions QUICWireVersions) PruneInvalid() QUICWireVersions {
+	u := make(QUICWireVersions, 0)
+	for _, v := range versions {
+		_, err := ParseQUICWireVersion(v)
+		if err == nil {
+			u = append(u, v)
+		}
+	}
+	return u
+}
+
+// ParseQUICWireVersion returns the version number for a QUIC wire version.
+// For QUIC_WIRE_VERSION_GREASE, a new random reserved version number is
+// returned on each call.
+func ParseQUICWireVersion(version string) (uint32, error) {
+
+	if version == QUIC_WIRE_VERSION_GREASE {
+		b, err := common.MakeSecureRandomBytes(4)
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+		for i := range b {
+			b[i] = (b[i] & 0xf0) | 0x0a
+		}
+		return binary.BigEndian.Uint32(b), nil
+	}
+
+	if strings.HasPrefix(version, "0x") {
+		number, err := strconv.ParseUint(version[2:], 16, 32)
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+		if number == 0 {
+			// Version 0 is reserved for version negotiation.
+			return 0, common.ContextError(errors.New("invalid QUIC wire version"))
+		}
+		return uint32(number), nil
+	}
+
+	if len(version) == 4 {
+		for i := 0; i < len(version); i++ {
+			if version[i] < 0x21 || version[i] > 0x7e {
+				return 0, common.ContextError(
+					fmt.Errorf("invalid QUIC wire version: %s", version))
+			}
+		}
+		return binary.BigEndian.Uint32([]byte(version)), nil
+	}
+
+	return 0, common.ContextError(fmt.Errorf("invalid QUIC wire version: %s", version))
+}
+
 type HandshakeResponse struct {
-	SSHSessionID           string              `json:"ssh_session_id"`
-	Homepages              []string            `json:"homepages"`
-	UpgradeClientVersion   string              `json:"upgrade_client_version"`
-	PageViewRegexes        []map[string]string `json:"page_view_regexes"`
-	HttpsRequestRegexes    []map[string]string `json:"https_request_regexes"`
-	EncodedServerList      []string            `json:"encoded_server_list"`
-	ClientRegion           string              `json:"client_region"`
-	ServerTimestamp        string              `json:"server_timestamp"`
-	ActiveAuthorizationIDs []string            `json:"active_authorization_ids"`
-	TacticsPayload         json.RawMessage     `json:"tactics_payload"`
+	SSHSessionID           string                 `json:"ssh_session_id"`
+	Homepages              []string               `json:"homepages"`
+	UpgradeClientVersion   string                 `json:"upgrade_client_version"`
+	PageViewRegexes        []map[string]string    `json:"page_view_regexes"`
+	HttpsRequestRegexes    []map[string]string    `json:"https_request_regexes"`
+	EncodedServerList      []string               `json:"encoded_server_list"`
+	ClientRegion           string                 `json:"client_region"`
+	ServerTimestamp        string                 `json:"server_timestamp"`
+	ActiveAuthorizationIDs []string               `json:"active_authorization_ids"`
+	TacticsPayload         json.RawMessage        `json:"tactics_payload"`
+	ServerLoad             int                    `json:"server_load"`
+	ClientParameters       map[string]interface{} `json:"client_parameters"`
+	SessionResumptionToken string                 `json:"session_resumption_token"`
+	SessionResumed         bool                   `json:"session_resumed"`
 }
 
 type ConnectedResponse struct {
@@ -78,3 +78,34 @@ func TestTLSProfileValidation(t *testing.T) {
 		t.Errorf("unexpected %+v != %+v", prunedProfiles, SupportedTLSProfiles)
 	}
 }
+
+func TestQUICWireVersionValidation(t *testing.T) {
+
+	validVersions := QUICWireVersions{"Q050", "T051", "0xff00001d", QUIC_WIRE_VERSION_GREASE}
+
+	err := validVersions.Validate()
+	if err != nil {
+		t.Errorf("unexpected Validate error: %s", err)
+	}
+
+	invalidVersions := QUICWireVersions{"Q050", "0x0", "0xzz", "Q05", "Q0500"}
+	err = invalidVersions.Validate()
+	if err == nil {
+		t.Errorf("unexpected Validate success")
+	}
+
+	prunedVersions := invalidVersions.PruneInvalid()
+	if !reflect.DeepEqual(prunedVersions, QUICWireVersions{"Q050"}) {
+		t.Errorf("unexpected %+v", prunedVersions)
+	}
+
+	version, err := ParseQUICWireVersion("Q050")
+	if err != nil || version != 0x51303530 {
+		t.Errorf("unexpected version: %x, %v", version, err)
+	}
+
+	version, err = ParseQUICWireVersion(QUIC_WIRE_VERSION_GREASE)
+	if err != nil || version&0x0f0f0f0f != 0x0a0a0a0a {
+		t.Errorf("unexpected grease version: %x, %v", version, err)
+	}
+}
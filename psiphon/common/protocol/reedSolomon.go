@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"errors"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// This is a minimal Reed-Solomon error correcting code over GF(2^8), with
+// the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1 and generator roots
+// α^0 ... α^(paritySize-1). A codeword, including parity, is at most 255
+// bytes. Codewords are stored highest degree coefficient first, with the
+// data followed by the parity bytes.
+//
+// Decoding corrects up to paritySize/2 byte errors at unknown positions,
+// using Berlekamp-Massey to find the error locator, a Chien search to find
+// the error positions, and the Forney algorithm to find the error values.
+// Corrupt codewords with more errors may be miscorrected, so callers must
+// authenticate the decoded data.
+
+const reedSolomonMaxCodewordSize = 255
+
+var gfExp [2 * reedSolomonMaxCodewordSize]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < reedSolomonMaxCodewordSize; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := reedSolomonMaxCodewordSize; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-reedSolomonMaxCodewordSize]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+reedSolomonMaxCodewordSize-int(gfLog[b])]
+}
+
+// gfPowAlpha returns α^n, for any integer n.
+func gfPowAlpha(n int) byte {
+	n %= reedSolomonMaxCodewordSize
+	if n < 0 {
+		n += reedSolomonMaxCodewordSize
+	}
+	return gfExp[n]
+}
+
+// gfPolyEval evaluates a polynomial stored lowest degree coefficient first.
+func gfPolyEval(poly []byte, x byte) byte {
+	y := byte(0)
+	for i := len(poly) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ poly[i]
+	}
+	return y
+}
+
+// reedSolomonEncode returns data followed by paritySize parity bytes.
+func reedSolomonEncode(data []byte, paritySize int) ([]byte, error) {
+
+	if paritySize < 2 || len(data)+paritySize > reedSolomonMaxCodewordSize {
+		return nil, common.ContextError(errors.New("invalid Reed-Solomon codeword size"))
+	}
+
+	// generator is the product of (x - α^i), highest degree first.
+
+	generator := []byte{1}
+	for i := 0; i < paritySize; i++ {
+		root := gfPowAlpha(i)
+		product := make([]byte, len(generator)+1)
+		for j, coefficient := range generator {
+			product[j] ^= coefficient
+			product[j+1] ^= gfMul(coefficient, root)
+		}
+		generator = product
+	}
+
+	// The parity is the remainder of data * x^paritySize divided by the
+	// generator.
+
+	codeword := make([]byte, len(data)+paritySize)
+	copy(codeword, data)
+	for i := 0; i < len(data); i++ {
+		coefficient := codeword[i]
+		if coefficient == 0 {
+			continue
+		}
+		for j := 1; j < len(generator); j++ {
+			codeword[i+j] ^= gfMul(generator[j], coefficient)
+		}
+	}
+	copy(codeword, data)
+
+	return codeword, nil
+}
+
+// reedSolomonDecode corrects errors in codeword, in place, and returns the
+// data portion of the codeword.
+func reedSolomonDecode(codeword []byte, paritySize int) ([]byte, error) {
+
+	if paritySize < 2 ||
+		len(codeword) <= paritySize ||
+		len(codeword) > reedSolomonMaxCodewordSize {
+		return nil, common.ContextError(errors.New("invalid Reed-Solomon codeword size"))
+	}
+
+	n := len(codeword)
+
+	// Syndromes are the received codeword evaluated at each generator root.
+
+	syndromes := make([]byte, paritySize)
+	hasErrors := false
+	for i := 0; i < paritySize; i++ {
+		x := gfPowAlpha(i)
+		y := byte(0)
+		for _, coefficient := range codeword {
+			y = gfMul(y, x) ^ coefficient
+		}
+		syndromes[i] = y
+		if y != 0 {
+			hasErrors = true
+		}
+	}
+
+	if !hasErrors {
+		return codeword[:n-paritySize], nil
+	}
+
+	// Berlekamp-Massey. locator is stored lowest degree first.
+
+	locator := []byte{1}
+	previous := []byte{1}
+	errorCount := 0
+	shift := 1
+	previousDiscrepancy := byte(1)
+
+	for i := 0; i < paritySize; i++ {
+
+		discrepancy := syndromes[i]
+		for j := 1; j <= errorCount && j < len(locator); j++ {
+			discrepancy ^= gfMul(locator[j], syndromes[i-j])
+		}
+
+		if discrepancy == 0 {
+			shift++
+			continue
+		}
+
+		scale := gfDiv(discrepancy, previousDiscrepancy)
+		next := make([]byte, len(locator))
+		copy(next, locator)
+		if len(previous)+shift > len(next) {
+			next = append(next, make([]byte, len(previous)+shift-len(next))...)
+		}
+		for j, coefficient := range previous {
+			next[j+shift] ^= gfMul(scale, coefficient)
+		}
+
+		if 2*errorCount <= i {
+			previous = locator
+			errorCount = i + 1 - errorCount
+			previousDiscrepancy = discrepancy
+			shift = 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+
+	if 2*errorCount > paritySize {
+		return nil, common.ContextError(errors.New("too many Reed-Solomon errors"))
+	}
+
+	// Chien search. An error in the coefficient of x^p, which is
+	// codeword[n-1-p], corresponds to a locator root at α^-p.
+
+	var positions []int
+	for p := 0; p < n; p++ {
+		if gfPolyEval(locator, gfPowAlpha(-p)) == 0 {
+			positions = append(positions, p)
+		}
+	}
+
+	if len(positions) != errorCount {
+		return nil, common.ContextError(errors.New("uncorrectable Reed-Solomon errors"))
+	}
+
+	// Forney. The evaluator is syndromes(x) * locator(x) mod x^paritySize,
+	// and the locator derivative retains only the odd degree terms.
+
+	evaluator := make([]byte, paritySize)
+	for i, s := range syndromes {
+		for j, l := range locator {
+			if i+j < paritySize {
+				evaluator[i+j] ^= gfMul(s, l)
+			}
+		}
+	}
+
+	derivative := make([]byte, len(locator))
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i-1] = locator[i]
+	}
+
+	for _, p := range positions {
+		x := gfPowAlpha(p)
+		xInverse := gfPowAlpha(-p)
+		denominator := gfPolyEval(derivative, xInverse)
+		if denominator == 0 {
+			return nil, common.ContextError(errors.New("uncorrectable Reed-Solomon errors"))
+		}
+		magnitude := gfDiv(gfMul(x, gfPolyEval(evaluator, xInverse)), denominator)
+		codeword[n-1-p] ^= magnitude
+	}
+
+	return codeword[:n-paritySize], nil
+}
@@ -29,6 +29,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -64,6 +65,10 @@ type ServerEntry struct {
 	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
 	MarionetteFormat              string   `json:"marionetteFormat"`
 	ConfigurationVersion          int      `json:"configurationVersion"`
+	KnockProtocol                 string   `json:"knockProtocol"`
+	KnockPort                     int      `json:"knockPort"`
+	KnockKey                      string   `json:"knockKey"`
+	AvailabilityWindows           []string `json:"availabilityWindows"`
 
 	// These local fields are not expected to be present in downloaded server
 	// entries. They are added by the client to record and report stats about
@@ -148,7 +153,8 @@ func (serverEntry *ServerEntry) GetSupportedProtocols(
 
 		// TODO: Marionette UDP formats are incompatible with
 		// useUpstreamProxy, but not currently supported
-		if useUpstreamProxy && TunnelProtocolUsesQUIC(protocol) {
+		if useUpstreamProxy &&
+			(TunnelProtocolUsesQUIC(protocol) || TunnelProtocolUsesInproxy(protocol)) {
 			continue
 		}
 
@@ -218,6 +224,73 @@ func (serverEntry *ServerEntry) GetUntunneledWebRequestPorts() []string {
 	return ports
 }
 
+// IsAvailableAt returns true when the server is expected to be available at
+// the specified time, according to its AvailabilityWindows.
+//
+// AvailabilityWindows are daily UTC time windows, in the form "HH:MM-HH:MM",
+// which may be set for servers, such as community-operated servers, which
+// are only online at certain times of day. A window which ends before it
+// starts spans midnight; e.g., "22:00-06:00". Each window is extended by
+// clockSkew at both ends, to tolerate inaccurate client clocks.
+//
+// A server entry with no valid AvailabilityWindows is always available.
+func (serverEntry *ServerEntry) IsAvailableAt(t time.Time, clockSkew time.Duration) bool {
+
+	const day = 24 * time.Hour
+
+	t = t.UTC()
+	timeOfDay := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	hasValidWindow := false
+
+	for _, window := range serverEntry.AvailabilityWindows {
+
+		start, end, err := ParseAvailabilityWindow(window)
+		if err != nil {
+			continue
+		}
+		hasValidWindow = true
+
+		length := ((end-start)%day+day)%day + 2*clockSkew
+		if end == start || length >= day {
+			return true
+		}
+
+		start -= clockSkew
+		if ((timeOfDay-start)%day+day)%day < length {
+			return true
+		}
+	}
+
+	return !hasValidWindow
+}
+
+// ParseAvailabilityWindow parses a server entry availability window, in the
+// form "HH:MM-HH:MM", and returns the start and end times as offsets from
+// midnight UTC.
+func ParseAvailabilityWindow(window string) (time.Duration, time.Duration, error) {
+
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, common.ContextError(
+			fmt.Errorf("invalid availability window: %s", window))
+	}
+
+	times := make([]time.Duration, 2)
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, common.ContextError(err)
+		}
+		times[i] = time.Duration(t.Hour())*time.Hour +
+			time.Duration(t.Minute())*time.Minute
+	}
+
+	return times[0], times[1], nil
+}
+
 // EncodeServerEntry returns a string containing the encoding of
 // a ServerEntry following Psiphon conventions.
 func EncodeServerEntry(serverEntry *ServerEntry) (string, error) {
@@ -235,13 +308,36 @@ func EncodeServerEntry(serverEntry *ServerEntry) (string, error) {
 		serverEntryContents))), nil
 }
 
+// EncodeServerEntryFields returns a string containing the encoding of
+// ServerEntryFields following Psiphon conventions. Unlike EncodeServerEntry,
+// unrecognized fields are retained in the encoding.
+func EncodeServerEntryFields(serverEntryFields ServerEntryFields) (string, error) {
+	serverEntryContents, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	getString := func(name string) string {
+		value, _ := serverEntryFields[name].(string)
+		return value
+	}
+
+	return hex.EncodeToString([]byte(fmt.Sprintf(
+		"%s %s %s %s %s",
+		getString("ipAddress"),
+		getString("webServerPort"),
+		getString("webServerSecret"),
+		getString("webServerCertificate"),
+		serverEntryContents))), nil
+}
+
 // DecodeServerEntry extracts a server entry from the encoding
 // used by remote server lists and Psiphon server handshake requests.
 //
 // The resulting ServerEntry.LocalSource is populated with serverEntrySource,
 // which should be one of SERVER_ENTRY_SOURCE_EMBEDDED, SERVER_ENTRY_SOURCE_REMOTE,
 // SERVER_ENTRY_SOURCE_DISCOVERY, SERVER_ENTRY_SOURCE_TARGET,
-// SERVER_ENTRY_SOURCE_OBFUSCATED.
+// SERVER_ENTRY_SOURCE_OBFUSCATED, SERVER_ENTRY_SOURCE_STEGO.
 // ServerEntry.LocalTimestamp is populated with the provided timestamp, which
 // should be a RFC 3339 formatted string. These local fields are stored with the
 // server entry and reported to the server as stats (a coarse granularity timestamp
@@ -274,6 +370,11 @@ func DecodeServerEntryFields(
 		return nil, common.ContextError(err)
 	}
 
+	// A JSON null unmarshals without error, leaving a nil map.
+	if serverEntryFields == nil {
+		return nil, common.ContextError(errors.New("invalid server entry"))
+	}
+
 	// NOTE: if the source JSON happens to have values in these fields, they get clobbered.
 	serverEntryFields.SetLocalSource(serverEntrySource)
 	serverEntryFields.SetLocalTimestamp(timestamp)
@@ -354,6 +455,22 @@ type StreamingServerEntryDecoder struct {
 	scanner           *bufio.Scanner
 	timestamp         string
 	serverEntrySource string
+
+	// For NextBatch
+	localFieldsSuffix []byte
+	hexBuffer         []byte
+	slab              []byte
+	records           []ServerEntryRecord
+}
+
+// ServerEntryRecord is a decoded and validated server entry in the form
+// stored in the datastore: the JSON encoding of the server entry, with the
+// local source and timestamp fields set, keyed by IP address.
+// ConfigurationVersion is decoded for the datastore replacement check.
+type ServerEntryRecord struct {
+	IPAddress            string
+	ConfigurationVersion int
+	Data                 []byte
 }
 
 // NewStreamingServerEntryDecoder creates a new StreamingServerEntryDecoder.
@@ -405,3 +522,108 @@ func (decoder *StreamingServerEntryDecoder) Next() (ServerEntryFields, error) {
 		return serverEntryFields, nil
 	}
 }
+
+// NextBatch reads, decodes, and validates up to maxCount server entries from
+// the input stream, returning an empty batch when the stream is complete.
+//
+// NextBatch is an alternative to Next for bulk imports. Unlike Next, which
+// allocates a ServerEntryFields map and intermediate buffers for each server
+// entry, NextBatch reuses a hex decoding scratch buffer and copies each
+// record's Data into a slab which is reused across batches. The returned
+// records, including Data, are only valid until the next call to NextBatch.
+//
+// As with Next, any local source and timestamp fields in the encoded server
+// entry are clobbered.
+func (decoder *StreamingServerEntryDecoder) NextBatch(
+	maxCount int) ([]ServerEntryRecord, error) {
+
+	if decoder.localFieldsSuffix == nil {
+		localSource, err := json.Marshal(decoder.serverEntrySource)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		localTimestamp, err := json.Marshal(decoder.timestamp)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		decoder.localFieldsSuffix = []byte(fmt.Sprintf(
+			`,"localSource":%s,"localTimestamp":%s}`, localSource, localTimestamp))
+	}
+
+	decoder.slab = decoder.slab[:0]
+	decoder.records = decoder.records[:0]
+
+	// Record Data is first recorded as slab offsets, as the slab may be
+	// reallocated as it grows.
+	type span struct{ start, end int }
+	spans := make([]span, 0, maxCount)
+
+	for len(decoder.records) < maxCount {
+
+		if !decoder.scanner.Scan() {
+			err := decoder.scanner.Err()
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			break
+		}
+
+		encodedServerEntry := decoder.scanner.Bytes()
+
+		hexDecodedLength := hex.DecodedLen(len(encodedServerEntry))
+		if cap(decoder.hexBuffer) < hexDecodedLength {
+			decoder.hexBuffer = make([]byte, hexDecodedLength)
+		}
+		hexDecodedServerEntry := decoder.hexBuffer[:hexDecodedLength]
+
+		_, err := hex.Decode(hexDecodedServerEntry, encodedServerEntry)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		// Skip past legacy format (4 space delimited fields).
+		JSONServerEntry := hexDecodedServerEntry
+		for i := 0; i < 4; i++ {
+			index := bytes.IndexByte(JSONServerEntry, ' ')
+			if index == -1 {
+				return nil, common.ContextError(errors.New("invalid encoded server entry"))
+			}
+			JSONServerEntry = JSONServerEntry[index+1:]
+		}
+		JSONServerEntry = bytes.TrimRight(JSONServerEntry, " \t\r\n")
+
+		var recordFields struct {
+			IPAddress            string `json:"ipAddress"`
+			ConfigurationVersion int    `json:"configurationVersion"`
+		}
+		err = json.Unmarshal(JSONServerEntry, &recordFields)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		if net.ParseIP(recordFields.IPAddress) == nil {
+			// Skip this entry and continue with the next one
+			continue
+		}
+
+		// A valid server entry, with an ipAddress field, is a non-empty JSON
+		// object, so the local fields are appended in place of the closing
+		// brace.
+
+		start := len(decoder.slab)
+		decoder.slab = append(decoder.slab, JSONServerEntry[:len(JSONServerEntry)-1]...)
+		decoder.slab = append(decoder.slab, decoder.localFieldsSuffix...)
+		spans = append(spans, span{start, len(decoder.slab)})
+
+		decoder.records = append(decoder.records, ServerEntryRecord{
+			IPAddress:            recordFields.IPAddress,
+			ConfigurationVersion: recordFields.ConfigurationVersion,
+		})
+	}
+
+	for i := range decoder.records {
+		decoder.records[i].Data = decoder.slab[spans[i].start:spans[i].end:spans[i].end]
+	}
+
+	return decoder.records, nil
+}
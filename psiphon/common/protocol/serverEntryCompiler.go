@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// CompileServerEntryDirectory compiles the server entry files in the
+// specified directory into an embedded server entry list, the newline
+// delimited list of encoded server entries that is passed to the client as
+// the embedded server entry list.
+//
+// Each file may contain either a single server entry JSON object, as in the
+// JSON component of an encoded server entry, or one or more encoded server
+// entries, one per line. Files are processed in file name order;
+// subdirectories and files with names starting with "." are skipped.
+//
+// All server entries are validated and an error is returned for any invalid
+// server entry or for any IP address that appears more than once, so that
+// operators maintaining private server fleets catch mistakes at build time
+// rather than having clients silently skip entries.
+func CompileServerEntryDirectory(directory string) (string, error) {
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	var encodedServerEntries []string
+	ipAddresses := make(map[string]string)
+
+	for _, fileInfo := range fileInfos {
+
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+
+		filename := filepath.Join(directory, fileInfo.Name())
+
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", common.ContextError(err)
+		}
+
+		fileServerEntries, fileIPAddresses, err := compileServerEntryFile(content)
+		if err != nil {
+			return "", common.ContextError(
+				fmt.Errorf("%s: %s", fileInfo.Name(), err))
+		}
+
+		for i, encodedServerEntry := range fileServerEntries {
+
+			ipAddress := fileIPAddresses[i]
+			if otherFilename, ok := ipAddresses[ipAddress]; ok {
+				return "", common.ContextError(
+					fmt.Errorf("%s: duplicate server entry %s in %s",
+						fileInfo.Name(), ipAddress, otherFilename))
+			}
+			ipAddresses[ipAddress] = fileInfo.Name()
+
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+	}
+
+	return strings.Join(encodedServerEntries, "\n"), nil
+}
+
+// compileServerEntryFile returns the validated, encoded server entries
+// contained in a server entry file, along with their IP addresses.
+func compileServerEntryFile(content []byte) ([]string, []string, error) {
+
+	content = bytes.TrimSpace(content)
+
+	if bytes.HasPrefix(content, []byte("{")) {
+
+		var serverEntryFields ServerEntryFields
+		err := json.Unmarshal(content, &serverEntryFields)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		err = ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		encodedServerEntry, err := EncodeServerEntryFields(serverEntryFields)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		return []string{encodedServerEntry},
+			[]string{serverEntryFields.GetIPAddress()}, nil
+	}
+
+	var encodedServerEntries []string
+	var ipAddresses []string
+
+	for _, line := range strings.Split(string(content), "\n") {
+
+		encodedServerEntry := strings.TrimSpace(line)
+		if len(encodedServerEntry) == 0 {
+			continue
+		}
+
+		serverEntryFields, err := DecodeServerEntryFields(encodedServerEntry, "", "")
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		err = ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		ipAddresses = append(ipAddresses, serverEntryFields.GetIPAddress())
+	}
+
+	return encodedServerEntries, ipAddresses, nil
+}
+
+// GenerateServerEntryListSource returns Go source code declaring a string
+// constant, with the specified name, in the specified package, containing
+// the embedded server entry list. This is intended for use with go:generate
+// so that the compiled list is built into the client binary.
+func GenerateServerEntryListSource(
+	packageName, constantName, serverEntryList string) ([]byte, error) {
+
+	var source bytes.Buffer
+
+	fmt.Fprintf(&source, "// Code generated by CompileServerEntryDirectory. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&source, "package %s\n\n", packageName)
+	fmt.Fprintf(&source, "const %s = %s\n", constantName, strconv.Quote(serverEntryList))
+
+	formattedSource, err := format.Source(source.Bytes())
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return formattedSource, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestCompileServerEntryDirectory(t *testing.T) {
+
+	testDirectory, err := ioutil.TempDir("", "psiphon-server-entry-compiler-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(testDirectory, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	// A JSON server entry file, an encoded server entry list file, and
+	// ignored files.
+
+	writeFile("1.json", strings.Replace(
+		strings.SplitN(_VALID_NORMAL_SERVER_ENTRY, " ", 5)[4],
+		"192.168.0.1", "192.168.0.2", -1))
+
+	writeFile("2.txt",
+		hex.EncodeToString([]byte(_VALID_NORMAL_SERVER_ENTRY))+"\n\n"+
+			hex.EncodeToString([]byte(strings.Replace(
+				_VALID_FUTURE_SERVER_ENTRY, "192.168.0.1", "192.168.0.3", -1)))+"\n")
+
+	writeFile(".hidden", "invalid")
+
+	err = os.Mkdir(filepath.Join(testDirectory, "subdirectory"), 0700)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err)
+	}
+
+	serverEntryList, err := CompileServerEntryDirectory(testDirectory)
+	if err != nil {
+		t.Fatalf("CompileServerEntryDirectory failed: %s", err)
+	}
+
+	serverEntries, err := DecodeServerEntryList(
+		serverEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+
+	expectedIPAddresses := []string{"192.168.0.2", "192.168.0.1", "192.168.0.3"}
+
+	if len(serverEntries) != len(expectedIPAddresses) {
+		t.Fatalf("unexpected server entry count: %d", len(serverEntries))
+	}
+
+	for i, serverEntryFields := range serverEntries {
+		if serverEntryFields.GetIPAddress() != expectedIPAddresses[i] {
+			t.Fatalf("unexpected server entry IP address: %s", serverEntryFields.GetIPAddress())
+		}
+	}
+
+	if serverEntries[2][_EXPECTED_DUMMY_FUTURE_FIELD] != _EXPECTED_DUMMY_FUTURE_FIELD {
+		t.Fatalf("unexpected dropped future field")
+	}
+
+	source, err := GenerateServerEntryListSource("main", "testServerEntryList", serverEntryList)
+	if err != nil {
+		t.Fatalf("GenerateServerEntryListSource failed: %s", err)
+	}
+
+	if !strings.Contains(string(source), "package main") ||
+		!strings.Contains(string(source), "const testServerEntryList = "+strconv.Quote(serverEntryList)) {
+		t.Fatalf("unexpected source: %s", source)
+	}
+
+	// Duplicate and invalid server entries are rejected.
+
+	writeFile("3.json", strings.SplitN(_VALID_NORMAL_SERVER_ENTRY, " ", 5)[4])
+
+	_, err = CompileServerEntryDirectory(testDirectory)
+	if err == nil {
+		t.Fatalf("unexpected success with duplicate server entry")
+	}
+
+	writeFile("3.json", strings.SplitN(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY, " ", 5)[4])
+
+	_, err = CompileServerEntryDirectory(testDirectory)
+	if err == nil {
+		t.Fatalf("unexpected success with invalid server entry")
+	}
+
+	writeFile("3.json", "{")
+
+	_, err = CompileServerEntryDirectory(testDirectory)
+	if err == nil {
+		t.Fatalf("unexpected success with malformed server entry")
+	}
+}
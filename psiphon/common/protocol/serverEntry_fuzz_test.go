@@ -0,0 +1,94 @@
+// +build go1.18
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// FuzzDecodeServerEntry exercises server entry decoding, which is applied to
+// server entries received in remote server lists, handshake responses, and
+// server entry exchanges. Inputs are the decoded server entry bytes, which
+// are hex encoded by the harness. Run with:
+//
+//	go test -run xxx -fuzz FuzzDecodeServerEntry
+func FuzzDecodeServerEntry(f *testing.F) {
+
+	f.Add([]byte(_VALID_NORMAL_SERVER_ENTRY))
+	f.Add([]byte(_VALID_BLANK_LEGACY_SERVER_ENTRY))
+	f.Add([]byte(_VALID_FUTURE_SERVER_ENTRY))
+	f.Add([]byte(_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY))
+	f.Add([]byte(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY))
+	f.Add([]byte(`    {"ipAddress":1,"configurationVersion":"1"}`))
+	f.Add([]byte(`    null`))
+
+	timestamp := common.GetCurrentTimestamp()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		encodedServerEntry := hex.EncodeToString(data)
+
+		DecodeServerEntry(encodedServerEntry, timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+
+		serverEntryFields, err := DecodeServerEntryFields(
+			encodedServerEntry, timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+		if err == nil {
+			ValidateServerEntryFields(serverEntryFields)
+			serverEntryFields.GetIPAddress()
+			serverEntryFields.GetConfigurationVersion()
+			EncodeServerEntryFields(serverEntryFields)
+		}
+
+		// The raw input is also decoded as a server entry list, covering
+		// invalid hex encoding and line splitting.
+		DecodeServerEntryList(string(data), timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+
+		encodedServerEntryList := []byte(encodedServerEntry + "\n" + encodedServerEntry)
+
+		decoder := NewStreamingServerEntryDecoder(
+			bytes.NewReader(encodedServerEntryList), timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+		for i := 0; i < 3; i++ {
+			serverEntryFields, err := decoder.Next()
+			if err != nil || serverEntryFields == nil {
+				break
+			}
+		}
+
+		decoder = NewStreamingServerEntryDecoder(
+			bytes.NewReader(encodedServerEntryList), timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+		for i := 0; i < 3; i++ {
+			records, err := decoder.NextBatch(1)
+			if err != nil || len(records) == 0 {
+				break
+			}
+			// Record Data, with appended local fields, is stored as is.
+			if !json.Valid(records[0].Data) {
+				t.Fatalf("invalid record data: %s", records[0].Data)
+			}
+		}
+	})
+}
@@ -22,7 +22,9 @@ package protocol
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -75,6 +77,35 @@ func TestDecodeServerEntryList(t *testing.T) {
 	}
 }
 
+func TestEncodeServerEntryFields(t *testing.T) {
+
+	serverEntryFields, err := DecodeServerEntryFields(
+		hex.EncodeToString([]byte(_VALID_FUTURE_SERVER_ENTRY)),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	encodedServerEntry, err := EncodeServerEntryFields(serverEntryFields)
+	if err != nil {
+		t.Fatalf("EncodeServerEntryFields failed: %s", err)
+	}
+
+	serverEntryFields, err = DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	if serverEntryFields.GetIPAddress() != _EXPECTED_IP_ADDRESS {
+		t.Fatalf("unexpected IP address: %s", serverEntryFields.GetIPAddress())
+	}
+
+	if serverEntryFields[_EXPECTED_DUMMY_FUTURE_FIELD] != _EXPECTED_DUMMY_FUTURE_FIELD {
+		t.Fatalf("future field not retained")
+	}
+}
+
 func TestStreamingServerEntryDecoder(t *testing.T) {
 
 	decoder := NewStreamingServerEntryDecoder(
@@ -119,6 +150,123 @@ func TestStreamingServerEntryDecoder(t *testing.T) {
 	}
 }
 
+func TestStreamingServerEntryDecoderNextBatch(t *testing.T) {
+
+	timestamp := common.GetCurrentTimestamp()
+
+	decoder := NewStreamingServerEntryDecoder(
+		bytes.NewReader([]byte(testEncodedServerEntryList)),
+		timestamp, SERVER_ENTRY_SOURCE_EMBEDDED)
+
+	var serverEntries []ServerEntryFields
+
+	for {
+		batch, err := decoder.NextBatch(2)
+		if err != nil {
+			t.Fatalf("NextBatch failed: %s", err)
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		if len(batch) > 2 {
+			t.Fatalf("unexpected batch size: %d", len(batch))
+		}
+
+		// Records are only valid until the next NextBatch call, so decode
+		// each record now.
+
+		for _, record := range batch {
+
+			if record.IPAddress != _EXPECTED_IP_ADDRESS {
+				t.Fatalf("unexpected IP address in record: %s", record.IPAddress)
+			}
+
+			var serverEntryFields ServerEntryFields
+			err := json.Unmarshal(record.Data, &serverEntryFields)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+
+			serverEntries = append(serverEntries, serverEntryFields)
+		}
+	}
+
+	if len(serverEntries) != 3 {
+		t.Fatalf("unexpected number of valid server entries: %d", len(serverEntries))
+	}
+
+	numFutureFields := 0
+
+	for _, serverEntryFields := range serverEntries {
+		if serverEntryFields.GetIPAddress() != _EXPECTED_IP_ADDRESS {
+			t.Fatalf("unexpected IP address: %s", serverEntryFields.GetIPAddress())
+		}
+		if serverEntryFields["localSource"] != SERVER_ENTRY_SOURCE_EMBEDDED ||
+			serverEntryFields["localTimestamp"] != timestamp {
+			t.Fatalf("unexpected local fields: %+v", serverEntryFields)
+		}
+		if serverEntryFields[_EXPECTED_DUMMY_FUTURE_FIELD] == _EXPECTED_DUMMY_FUTURE_FIELD {
+			numFutureFields += 1
+		}
+	}
+
+	if numFutureFields != 1 {
+		t.Fatalf("unexpected number of retained future fields")
+	}
+}
+
+func BenchmarkStreamingServerEntryDecoder(b *testing.B) {
+
+	var encodedServerEntryList bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		encodedServerEntryList.WriteString(
+			hex.EncodeToString([]byte(_VALID_NORMAL_SERVER_ENTRY)) + "\n")
+	}
+	encodedServerEntries := encodedServerEntryList.Bytes()
+
+	timestamp := common.GetCurrentTimestamp()
+
+	b.Run("Next", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decoder := NewStreamingServerEntryDecoder(
+				bytes.NewReader(encodedServerEntries), timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+			for {
+				serverEntryFields, err := decoder.Next()
+				if err != nil {
+					b.Fatalf("Next failed: %s", err)
+				}
+				if serverEntryFields == nil {
+					break
+				}
+				_, err = json.Marshal(serverEntryFields)
+				if err != nil {
+					b.Fatalf("Marshal failed: %s", err)
+				}
+			}
+		}
+	})
+
+	b.Run("NextBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decoder := NewStreamingServerEntryDecoder(
+				bytes.NewReader(encodedServerEntries), timestamp, SERVER_ENTRY_SOURCE_REMOTE)
+			for {
+				batch, err := decoder.NextBatch(100)
+				if err != nil {
+					b.Fatalf("NextBatch failed: %s", err)
+				}
+				if len(batch) == 0 {
+					break
+				}
+			}
+		}
+	})
+}
+
 // Directly call DecodeServerEntryFields and ValidateServerEntry with invalid inputs
 func TestInvalidServerEntries(t *testing.T) {
 
@@ -152,3 +300,45 @@ func TestDecodeServerEntryStruct(t *testing.T) {
 		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
 	}
 }
+
+func TestServerEntryAvailabilityWindows(t *testing.T) {
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2019, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		description string
+		windows     []string
+		time        time.Time
+		clockSkew   time.Duration
+		expected    bool
+	}{
+		{"no windows", nil, at(12, 0), 0, true},
+		{"invalid window", []string{"night"}, at(12, 0), 0, true},
+		{"in window", []string{"09:00-17:00"}, at(12, 0), 0, true},
+		{"before window", []string{"09:00-17:00"}, at(8, 0), 0, false},
+		{"at window end", []string{"09:00-17:00"}, at(17, 0), 0, false},
+		{"within skew before window", []string{"09:00-17:00"}, at(8, 45), 30 * time.Minute, true},
+		{"within skew after window", []string{"09:00-17:00"}, at(17, 15), 30 * time.Minute, true},
+		{"outside skew", []string{"09:00-17:00"}, at(18, 0), 30 * time.Minute, false},
+		{"spans midnight, late", []string{"22:00-06:00"}, at(23, 30), 0, true},
+		{"spans midnight, early", []string{"22:00-06:00"}, at(2, 0), 0, true},
+		{"spans midnight, outside", []string{"22:00-06:00"}, at(12, 0), 0, false},
+		{"skew wraps midnight", []string{"00:30-06:00"}, at(23, 45), time.Hour, true},
+		{"multiple windows", []string{"01:00-02:00", "13:00-14:00"}, at(13, 30), 0, true},
+		{"skew covers day", []string{"00:00-23:00"}, at(23, 30), time.Hour, true},
+		{"full day", []string{"00:00-00:00"}, at(12, 0), 0, true},
+		{"skips invalid", []string{"25:00-26:00", "09:00-17:00"}, at(8, 0), 0, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			serverEntry := &ServerEntry{AvailabilityWindows: testCase.windows}
+			available := serverEntry.IsAvailableAt(testCase.time, testCase.clockSkew)
+			if available != testCase.expected {
+				t.Errorf("unexpected availability: %v", available)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ed25519"
+)
+
+// A share code is a compact, signed, error-corrected encoding of a small set
+// of server entries, suitable for display as a QR code or for copy-and-paste
+// between users.
+//
+// The binary format is:
+//
+//   version (1 byte) | signature (64 bytes) | compressed payload
+//
+// The payload is a zlib compressed JSON array of server entries, and the
+// Ed25519 signature covers the version and compressed payload. The binary
+// data is split into blocks of up to SHARE_CODE_BLOCK_DATA_SIZE bytes, and
+// each block is followed by SHARE_CODE_BLOCK_PARITY_SIZE Reed-Solomon parity
+// bytes.
+//
+// The text format is the error-corrected data encoded with the Crockford
+// base32 alphabet, prefixed with SHARE_CODE_PREFIX and grouped with hyphens.
+// When decoding, case, whitespace and hyphens are ignored and commonly
+// confused characters (O, I, L) are normalized. Each block can then recover
+// from up to SHARE_CODE_BLOCK_PARITY_SIZE/2 corrupt bytes, or at least 4
+// mistyped characters, as a base32 character spans at most 2 bytes. Missing
+// or extra characters are not corrected. The signature check rejects any
+// share code that's miscorrected.
+
+const (
+	SHARE_CODE_PREFIX     = "PSIPHON"
+	SHARE_CODE_VERSION    = 1
+	SHARE_CODE_GROUP_SIZE = 5
+
+	SHARE_CODE_BLOCK_PARITY_SIZE = 16
+	SHARE_CODE_BLOCK_DATA_SIZE   = reedSolomonMaxCodewordSize - SHARE_CODE_BLOCK_PARITY_SIZE
+
+	shareCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var shareCodeEncoding = base32.NewEncoding(shareCodeAlphabet).WithPadding(base32.NoPadding)
+
+// GenerateShareCodeKeys generates a base64 encoded Ed25519 key pair for
+// signing and verifying share codes.
+func GenerateShareCodeKeys() (string, string, error) {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKey),
+		base64.StdEncoding.EncodeToString(privateKey),
+		nil
+}
+
+// EncodeShareCode creates a share code containing the specified server
+// entries, signed with the given private key. Local fields, such as
+// localSource, are omitted.
+func EncodeShareCode(
+	serverEntries []ServerEntryFields, signingPrivateKey string) (string, error) {
+
+	privateKey, err := base64.StdEncoding.DecodeString(signingPrivateKey)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return "", common.ContextError(errors.New("invalid signing private key"))
+	}
+
+	payloadEntries := make([]ServerEntryFields, len(serverEntries))
+	for i, serverEntryFields := range serverEntries {
+		payloadEntry := make(ServerEntryFields)
+		for name, value := range serverEntryFields {
+			if name == "localSource" || name == "localTimestamp" {
+				continue
+			}
+			payloadEntry[name] = value
+		}
+		payloadEntries[i] = payloadEntry
+	}
+
+	payload, err := json.Marshal(payloadEntries)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	signedData := append([]byte{SHARE_CODE_VERSION}, common.Compress(payload)...)
+
+	signature := ed25519.Sign(ed25519.PrivateKey(privateKey), signedData)
+
+	data := make([]byte, 0, len(signedData)+ed25519.SignatureSize)
+	data = append(data, SHARE_CODE_VERSION)
+	data = append(data, signature...)
+	data = append(data, signedData[1:]...)
+
+	var buffer bytes.Buffer
+	for len(data) > 0 {
+		n := SHARE_CODE_BLOCK_DATA_SIZE
+		if n > len(data) {
+			n = len(data)
+		}
+		block, err := reedSolomonEncode(data[:n], SHARE_CODE_BLOCK_PARITY_SIZE)
+		if err != nil {
+			return "", common.ContextError(err)
+		}
+		buffer.Write(block)
+		data = data[n:]
+	}
+
+	encoded := shareCodeEncoding.EncodeToString(buffer.Bytes())
+
+	groups := []string{SHARE_CODE_PREFIX}
+	for len(encoded) > 0 {
+		n := SHARE_CODE_GROUP_SIZE
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		groups = append(groups, encoded[:n])
+		encoded = encoded[n:]
+	}
+
+	return strings.Join(groups, "-"), nil
+}
+
+// DecodeShareCode verifies and extracts the server entries in a share code.
+// The share code must be signed with the key corresponding to
+// signingPublicKey. As with DecodeServerEntryList, the local source and
+// timestamp fields are populated with the given values, and invalid server
+// entries are skipped.
+func DecodeShareCode(
+	shareCode, signingPublicKey, timestamp, serverEntrySource string) ([]ServerEntryFields, error) {
+
+	publicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, common.ContextError(errors.New("invalid signing public key"))
+	}
+
+	normalized := strings.Map(
+		func(r rune) rune {
+			switch r {
+			case '-', ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		},
+		strings.ToUpper(shareCode))
+
+	if !strings.HasPrefix(normalized, SHARE_CODE_PREFIX) {
+		return nil, common.ContextError(errors.New("missing share code prefix"))
+	}
+
+	// Correct confusable characters only after the prefix, which itself
+	// contains such characters.
+
+	normalized = strings.Map(
+		func(r rune) rune {
+			switch r {
+			case 'O':
+				return '0'
+			case 'I', 'L':
+				return '1'
+			}
+			return r
+		},
+		normalized[len(SHARE_CODE_PREFIX):])
+
+	encoded, err := shareCodeEncoding.DecodeString(normalized)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var data []byte
+	for len(encoded) > 0 {
+		n := reedSolomonMaxCodewordSize
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		block, err := reedSolomonDecode(encoded[:n], SHARE_CODE_BLOCK_PARITY_SIZE)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		data = append(data, block...)
+		encoded = encoded[n:]
+	}
+
+	if len(data) < 1+ed25519.SignatureSize {
+		return nil, common.ContextError(errors.New("invalid share code length"))
+	}
+
+	if data[0] != SHARE_CODE_VERSION {
+		return nil, common.ContextError(errors.New("unsupported share code version"))
+	}
+
+	signature := data[1 : 1+ed25519.SignatureSize]
+	compressedPayload := data[1+ed25519.SignatureSize:]
+
+	signedData := append([]byte{data[0]}, compressedPayload...)
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), signedData, signature) {
+		return nil, common.ContextError(errors.New("invalid share code signature"))
+	}
+
+	payload, err := common.Decompress(compressedPayload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var payloadEntries []ServerEntryFields
+	err = json.Unmarshal(payload, &payloadEntries)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	serverEntries := make([]ServerEntryFields, 0, len(payloadEntries))
+	for _, serverEntryFields := range payloadEntries {
+		if ValidateServerEntryFields(serverEntryFields) != nil {
+			// Skip this entry and continue with the next one
+			continue
+		}
+		serverEntryFields.SetLocalSource(serverEntrySource)
+		serverEntryFields.SetLocalTimestamp(timestamp)
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+
+	return serverEntries, nil
+}
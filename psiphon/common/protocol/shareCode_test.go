@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestShareCode(t *testing.T) {
+
+	publicKey, privateKey, err := GenerateShareCodeKeys()
+	if err != nil {
+		t.Fatalf("GenerateShareCodeKeys failed: %s", err)
+	}
+
+	serverEntries, err := DecodeServerEntryList(
+		testEncodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+
+	shareCode, err := EncodeShareCode(serverEntries, privateKey)
+	if err != nil {
+		t.Fatalf("EncodeShareCode failed: %s", err)
+	}
+
+	// Simulate transcription: lower case, confusable characters, and
+	// different grouping.
+
+	transcribed := strings.ToLower(
+		strings.Replace(strings.Replace(shareCode, "-", " ", -1), "0", "O", -1))
+
+	decodedServerEntries, err := DecodeShareCode(
+		transcribed, publicKey, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+	if err != nil {
+		t.Fatalf("DecodeShareCode failed: %s", err)
+	}
+
+	if len(decodedServerEntries) != len(serverEntries) {
+		t.Fatalf("unexpected number of server entries: %d", len(decodedServerEntries))
+	}
+
+	for _, serverEntryFields := range decodedServerEntries {
+		if serverEntryFields.GetIPAddress() != _EXPECTED_IP_ADDRESS {
+			t.Fatalf("unexpected IP address: %s", serverEntryFields.GetIPAddress())
+		}
+		if serverEntryFields["localSource"] != SERVER_ENTRY_SOURCE_IMPORTED {
+			t.Fatalf("unexpected local source")
+		}
+	}
+
+	// Transcription errors within each block's error correction capacity
+	// must be corrected, and others must be rejected.
+
+	encoded := strings.Replace(shareCode[len(SHARE_CODE_PREFIX):], "-", "", -1)
+
+	substitute := func(encoded string, indexes ...int) string {
+		corrupted := []byte(encoded)
+		for _, index := range indexes {
+			if corrupted[index] == '2' {
+				corrupted[index] = '3'
+			} else {
+				corrupted[index] = '2'
+			}
+		}
+		return string(corrupted)
+	}
+
+	transpose := func(encoded string, index int) string {
+		corrupted := []byte(encoded)
+		corrupted[index], corrupted[index+1] = corrupted[index+1], corrupted[index]
+		return string(corrupted)
+	}
+
+	lastBlock := (len(encoded) - 1) * 5 / 8 / reedSolomonMaxCodewordSize
+	if lastBlock < 1 {
+		t.Fatalf("unexpected number of blocks: %d", lastBlock+1)
+	}
+	lastBlockIndex := lastBlock * reedSolomonMaxCodewordSize * 8 / 5
+
+	var manyIndexes []int
+	for i := 0; i < 40; i++ {
+		manyIndexes = append(manyIndexes, 10+i)
+	}
+
+	testCases := []struct {
+		description   string
+		encoded       string
+		expectSuccess bool
+	}{
+		{"substitution", substitute(encoded, 10), true},
+		{"first character", substitute(encoded, 0), true},
+		{"last character", substitute(encoded, len(encoded)-1), true},
+		{"transposition", transpose(encoded, 20), true},
+		{"multiple substitutions", substitute(encoded, 1, 50, 100, 150), true},
+		{"multiple blocks", substitute(encoded, 30, 60, lastBlockIndex+1, len(encoded)-3), true},
+		{"too many substitutions", substitute(encoded, manyIndexes...), false},
+		{"truncated", encoded[:len(encoded)-SHARE_CODE_GROUP_SIZE], false},
+		{"deletion", encoded[:10] + encoded[11:], false},
+		{"invalid character", encoded[:10] + "U" + encoded[11:], false},
+	}
+
+	for _, testCase := range testCases {
+
+		decodedServerEntries, err := DecodeShareCode(
+			SHARE_CODE_PREFIX+testCase.encoded,
+			publicKey,
+			common.GetCurrentTimestamp(),
+			SERVER_ENTRY_SOURCE_IMPORTED)
+
+		if testCase.expectSuccess {
+			if err != nil {
+				t.Fatalf("DecodeShareCode failed with %s: %s", testCase.description, err)
+			}
+			if len(decodedServerEntries) != len(serverEntries) {
+				t.Fatalf("unexpected number of server entries with %s: %d",
+					testCase.description, len(decodedServerEntries))
+			}
+		} else if err == nil {
+			t.Fatalf("DecodeShareCode unexpectedly succeeded with %s", testCase.description)
+		}
+	}
+
+	_, err = DecodeShareCode(
+		"PSIPHOM"+encoded, publicKey, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+	if err == nil {
+		t.Fatalf("DecodeShareCode unexpectedly succeeded with invalid prefix")
+	}
+
+	// A share code signed with another key must be rejected.
+
+	otherPublicKey, _, err := GenerateShareCodeKeys()
+	if err != nil {
+		t.Fatalf("GenerateShareCodeKeys failed: %s", err)
+	}
+
+	_, err = DecodeShareCode(
+		shareCode, otherPublicKey, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_IMPORTED)
+	if err == nil {
+		t.Fatalf("DecodeShareCode unexpectedly succeeded with wrong key")
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+
+	for _, dataSize := range []int{1, 100, SHARE_CODE_BLOCK_DATA_SIZE} {
+
+		data := make([]byte, dataSize)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		codeword, err := reedSolomonEncode(data, SHARE_CODE_BLOCK_PARITY_SIZE)
+		if err != nil {
+			t.Fatalf("reedSolomonEncode failed: %s", err)
+		}
+
+		for errorCount := 0; errorCount <= SHARE_CODE_BLOCK_PARITY_SIZE/2+1; errorCount++ {
+
+			corrupted := append([]byte(nil), codeword...)
+			for i := 0; i < errorCount; i++ {
+				index := (i * 37) % len(corrupted)
+				corrupted[index] ^= byte(i + 1)
+			}
+
+			decoded, err := reedSolomonDecode(corrupted, SHARE_CODE_BLOCK_PARITY_SIZE)
+
+			if errorCount <= SHARE_CODE_BLOCK_PARITY_SIZE/2 {
+				if err != nil {
+					t.Fatalf("reedSolomonDecode failed with %d errors: %s", errorCount, err)
+				}
+				if !bytes.Equal(decoded, data) {
+					t.Fatalf("unexpected decoded data with %d errors", errorCount)
+				}
+			} else if err == nil && bytes.Equal(decoded, data) {
+				t.Fatalf("reedSolomonDecode unexpectedly corrected %d errors", errorCount)
+			}
+		}
+	}
+
+	_, err := reedSolomonEncode(
+		make([]byte, SHARE_CODE_BLOCK_DATA_SIZE+1), SHARE_CODE_BLOCK_PARITY_SIZE)
+	if err == nil {
+		t.Fatalf("reedSolomonEncode unexpectedly succeeded with oversized data")
+	}
+}
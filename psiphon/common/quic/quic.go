@@ -68,6 +68,7 @@ var serverIdleTimeout = SERVER_IDLE_TIMEOUT
 // Listener is a net.Listener.
 type Listener struct {
 	quic_go.Listener
+	packetConn net.PacketConn
 }
 
 // Listen creates a new Listener.
@@ -97,17 +98,36 @@ func Listen(addr string) (*Listener, error) {
 		KeepAlive:             true,
 	}
 
-	quicListener, err := quic_go.ListenAddr(
-		addr, tlsConfig, quicConfig)
+	packetConn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
+	// Client packets may have a transformed wire image; see WireImage.
+	quicListener, err := quic_go.Listen(
+		&wireImageListenerPacketConn{PacketConn: packetConn}, tlsConfig, quicConfig)
+	if err != nil {
+		packetConn.Close()
+		return nil, common.ContextError(err)
+	}
+
 	return &Listener{
-		Listener: quicListener,
+		Listener:   quicListener,
+		packetConn: packetConn,
 	}, nil
 }
 
+// Close closes the Listener and its underlying packet conn, which, unlike
+// with ListenAddr, quic-go doesn't close.
+func (listener *Listener) Close() error {
+	err := listener.Listener.Close()
+	err1 := listener.packetConn.Close()
+	if err == nil {
+		err = err1
+	}
+	return err
+}
+
 // Accept returns a net.Conn that wraps a single QUIC session and stream. The
 // stream establishment is deferred until the first Read or Write, allowing
 // Accept to be called in a fast loop while goroutines spawned to handle each
@@ -140,12 +160,16 @@ var supportedVersionNumbers = map[string]quic_go.VersionNumber{
 //
 // Keep alive and idle timeout functionality in QUIC is disabled as these
 // aspects are expected to be handled at a higher level.
+//
+// When wireImage is not nil, its transformations are applied to the initial
+// client packets.
 func Dial(
 	ctx context.Context,
 	packetConn net.PacketConn,
 	remoteAddr *net.UDPAddr,
 	quicSNIAddress string,
-	negotiateQUICVersion string) (net.Conn, error) {
+	negotiateQUICVersion string,
+	wireImage *WireImage) (net.Conn, error) {
 
 	var versions []quic_go.VersionNumber
 
@@ -169,6 +193,10 @@ func Dial(
 		quicConfig.HandshakeTimeout = deadline.Sub(time.Now())
 	}
 
+	if wireImage != nil {
+		packetConn = newWireImagePacketConn(packetConn, wireImage)
+	}
+
 	session, err := quic_go.DialContext(
 		ctx,
 		packetConn,
@@ -34,12 +34,18 @@ import (
 func TestQUIC(t *testing.T) {
 	for negotiateQUICVersion, _ := range supportedVersionNumbers {
 		t.Run(negotiateQUICVersion, func(t *testing.T) {
-			runQUIC(t, negotiateQUICVersion)
+			runQUIC(t, negotiateQUICVersion, nil)
+		})
+		t.Run(negotiateQUICVersion+"-wire-image", func(t *testing.T) {
+			runQUIC(t, negotiateQUICVersion, &WireImage{Version: 0x51303530, PaddingBytes: 100})
+		})
+		t.Run(negotiateQUICVersion+"-wire-image-max-padding", func(t *testing.T) {
+			runQUIC(t, negotiateQUICVersion, &WireImage{PaddingBytes: maxWireImageDatagramSize})
 		})
 	}
 }
 
-func runQUIC(t *testing.T, negotiateQUICVersion string) {
+func runQUIC(t *testing.T, negotiateQUICVersion string, wireImage *WireImage) {
 
 	clients := 10
 	bytesToSend := 1 << 20
@@ -126,7 +132,8 @@ func runQUIC(t *testing.T, negotiateQUICVersion string) {
 				packetConn,
 				remoteAddr,
 				serverAddress,
-				negotiateQUICVersion)
+				negotiateQUICVersion,
+				wireImage)
 			if err != nil {
 				return common.ContextError(err)
 			}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package quic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	quic_go "github.com/lucas-clemente/quic-go"
+)
+
+// The QUIC wire image is transformed, below quic-go, by rewriting the client
+// packets which carry a version number: the initial packets sent before the
+// client receives a server packet.
+//
+// The version number in the packet header is replaced with the wire version,
+// and a trailer is appended to the datagram:
+//
+//   [random padding][16 byte nonce][masked 4 byte version][masked 2 byte trailer length]
+//
+// The mask is derived from the random nonce, so the trailer is random
+// looking. The server Listener recognizes and removes the trailer and
+// restores the original version number before passing the packet to
+// quic-go. Since the original header bytes are restored, gQUIC packet
+// integrity checks, which cover the header, succeed.
+//
+// Limitation: gQUIC CHLO tags, which are the gQUIC equivalent of transport
+// parameters, and the CHLO version tag are within the integrity protected
+// packet payload and are not transformed.
+
+const (
+	wireImageNonceSize      = 16
+	wireImageMaskedSize     = 6
+	wireImageMinTrailerSize = wireImageNonceSize + wireImageMaskedSize
+
+	// maxWireImageDatagramSize is quic-go's receive buffer size,
+	// MaxReceivePacketSize.
+	maxWireImageDatagramSize = 1452
+)
+
+// WireImage specifies transformations applied to QUIC client packets.
+type WireImage struct {
+
+	// Version, when not 0, is the version number written in packet headers
+	// in place of the negotiated QUIC version.
+	Version uint32
+
+	// PaddingBytes is the number of random padding bytes added to each
+	// initial packet, in addition to the trailer. Padding is truncated as
+	// required to fit the maximum datagram size.
+	PaddingBytes int
+}
+
+// getVersionOffset returns the offset of the version number in a client
+// packet header, or -1 when the packet has no version number.
+func getVersionOffset(packet []byte) int {
+
+	if len(packet) < 1 {
+		return -1
+	}
+
+	typeByte := packet[0]
+
+	offset := -1
+
+	if typeByte&0x80 != 0 {
+
+		// IETF long header
+		offset = 1
+
+	} else if typeByte&0x38 != 0x30 && typeByte&0x02 == 0 && typeByte&0x01 != 0 {
+
+		// gQUIC public header with version flag set and reset flag not set,
+		// and optional 8 byte connection ID
+		offset = 1
+		if typeByte&0x08 != 0 {
+			offset += 8
+		}
+	}
+
+	if offset == -1 || len(packet) < offset+4 {
+		return -1
+	}
+
+	return offset
+}
+
+func getWireImageMask(nonce []byte) []byte {
+	digest := sha256.Sum256(nonce)
+	return digest[:wireImageMaskedSize]
+}
+
+// wireImagePacketConn applies a WireImage to packets written by a QUIC
+// client.
+type wireImagePacketConn struct {
+	net.PacketConn
+	wireImage *WireImage
+}
+
+func newWireImagePacketConn(
+	packetConn net.PacketConn, wireImage *WireImage) *wireImagePacketConn {
+
+	return &wireImagePacketConn{
+		PacketConn: packetConn,
+		wireImage:  wireImage,
+	}
+}
+
+func (conn *wireImagePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+
+	versionOffset := getVersionOffset(p)
+
+	trailerSize := wireImageMinTrailerSize + conn.wireImage.PaddingBytes
+	if len(p)+trailerSize > maxWireImageDatagramSize {
+		trailerSize = maxWireImageDatagramSize - len(p)
+	}
+
+	if versionOffset == -1 || trailerSize < wireImageMinTrailerSize {
+		return conn.PacketConn.WriteTo(p, addr)
+	}
+
+	datagram := make([]byte, len(p)+trailerSize)
+	copy(datagram, p)
+
+	trailer := datagram[len(p):]
+	_, err := rand.Read(trailer[:trailerSize-wireImageMaskedSize])
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	nonce := trailer[trailerSize-wireImageMinTrailerSize : trailerSize-wireImageMaskedSize]
+	masked := trailer[trailerSize-wireImageMaskedSize:]
+
+	copy(masked[0:4], p[versionOffset:versionOffset+4])
+	binary.BigEndian.PutUint16(masked[4:6], uint16(trailerSize))
+	mask := getWireImageMask(nonce)
+	for i := range masked {
+		masked[i] ^= mask[i]
+	}
+
+	if conn.wireImage.Version != 0 {
+		binary.BigEndian.PutUint32(
+			datagram[versionOffset:versionOffset+4], conn.wireImage.Version)
+	}
+
+	_, err = conn.PacketConn.WriteTo(datagram, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// wireImageListenerPacketConn reverses WireImage transformations on packets
+// read by a QUIC server. Packets without a valid trailer are passed through
+// unmodified.
+type wireImageListenerPacketConn struct {
+	net.PacketConn
+}
+
+func (conn *wireImageListenerPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+
+	n, addr, err := conn.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+
+	versionOffset := getVersionOffset(p[:n])
+	if versionOffset == -1 || n < versionOffset+4+wireImageMinTrailerSize {
+		return n, addr, nil
+	}
+
+	nonce := p[n-wireImageMinTrailerSize : n-wireImageMaskedSize]
+	mask := getWireImageMask(nonce)
+
+	var unmasked [wireImageMaskedSize]byte
+	for i := range unmasked {
+		unmasked[i] = p[n-wireImageMaskedSize+i] ^ mask[i]
+	}
+
+	version := binary.BigEndian.Uint32(unmasked[0:4])
+	trailerSize := int(binary.BigEndian.Uint16(unmasked[4:6]))
+
+	if !isSupportedVersionNumber(version) ||
+		trailerSize < wireImageMinTrailerSize ||
+		trailerSize > n-(versionOffset+4) {
+
+		return n, addr, nil
+	}
+
+	copy(p[versionOffset:versionOffset+4], unmasked[0:4])
+
+	return n - trailerSize, addr, nil
+}
+
+func isSupportedVersionNumber(version uint32) bool {
+	for _, versionNumber := range supportedVersionNumbers {
+		if quic_go.VersionNumber(version) == versionNumber {
+			return true
+		}
+	}
+	return false
+}
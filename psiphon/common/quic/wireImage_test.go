@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package quic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	quic_go "github.com/lucas-clemente/quic-go"
+)
+
+func TestWireImage(t *testing.T) {
+
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer serverConn.Close()
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	wireVersion := uint32(0x51303530)
+
+	wireImageConn := newWireImagePacketConn(
+		clientConn, &WireImage{Version: wireVersion, PaddingBytes: 100})
+
+	listenerConn := &wireImageListenerPacketConn{PacketConn: serverConn}
+
+	// A gQUIC public header packet with the version and connection ID flags
+	// set, followed by a payload.
+
+	packet := make([]byte, 200)
+	packet[0] = 0x09
+	binary.BigEndian.PutUint32(packet[9:13], uint32(quic_go.VersionGQUIC43))
+	for i := 13; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+
+	// A packet without a version number is not transformed.
+
+	shortPacket := []byte{0x08, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for _, testPacket := range [][]byte{packet, shortPacket} {
+
+		n, err := wireImageConn.WriteTo(testPacket, serverConn.LocalAddr())
+		if err != nil || n != len(testPacket) {
+			t.Fatalf("WriteTo failed: %d, %v", n, err)
+		}
+
+		b := make([]byte, maxWireImageDatagramSize)
+
+		n, _, err = serverConn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %s", err)
+		}
+
+		if len(testPacket) == len(packet) {
+			if n != len(packet)+wireImageMinTrailerSize+100 ||
+				binary.BigEndian.Uint32(b[9:13]) != wireVersion {
+				t.Fatalf("unexpected wire image: %d", n)
+			}
+		} else if !bytes.Equal(b[:n], testPacket) {
+			t.Fatalf("unexpected transformed packet")
+		}
+
+		// Replay the datagram through the listener conn.
+
+		_, err = clientConn.WriteTo(b[:n], serverConn.LocalAddr())
+		if err != nil {
+			t.Fatalf("WriteTo failed: %s", err)
+		}
+
+		n, _, err = listenerConn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %s", err)
+		}
+
+		if !bytes.Equal(b[:n], testPacket) {
+			t.Fatalf("unexpected restored packet")
+		}
+	}
+}
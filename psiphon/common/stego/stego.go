@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package stego embeds and extracts payloads in innocuous looking content,
+// for distributing small, signed resources, such as server entries, through
+// channels which aren't blocked during severe blocking events.
+//
+// Two cover formats are supported:
+//
+// - PNG images, where the payload is stored in the least significant bits of
+// the red, green, and blue channels of each pixel, in row order. PNG is
+// lossless, but images that are recompressed or resized by a hosting service
+// lose the payload; such services must be avoided.
+//
+// - Text, such as social media posts, web pages, and DNS TXT records, where
+// the payload is stored as a sequence of invisible zero-width characters.
+//
+// In both formats, the payload is prefixed with its 4 byte, big endian
+// length. The payload isn't encrypted or authenticated; callers should embed
+// authenticated data, such as a signed data package, and may wish to
+// encrypt it so that it is indistinguishable from noise.
+package stego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	MAX_PAYLOAD_SIZE = 1 << 20
+
+	payloadLengthSize = 4
+
+	zeroWidthZeroBit = '\u200b'
+	zeroWidthOneBit  = '\u200c'
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Extract extracts a payload from content in any supported cover format.
+// The format is detected from the content.
+func Extract(content []byte) ([]byte, error) {
+
+	if bytes.HasPrefix(content, pngSignature) {
+		img, err := png.Decode(bytes.NewReader(content))
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		payload, err := ExtractFromImage(img)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return payload, nil
+	}
+
+	if utf8.Valid(content) {
+		payload, err := ExtractFromText(string(content))
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return payload, nil
+	}
+
+	return nil, common.ContextError(errors.New("unsupported content"))
+}
+
+// EmbedInImage returns a copy of the cover image with the payload embedded.
+// The cover image must have at least 3 bits of capacity per payload bit,
+// including the length prefix.
+func EmbedInImage(cover image.Image, payload []byte) (*image.NRGBA, error) {
+
+	bits, err := framePayload(payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	bounds := cover.Bounds()
+	if len(bits) > 3*bounds.Dx()*bounds.Dy() {
+		return nil, common.ContextError(errors.New("insufficient cover capacity"))
+	}
+
+	img := image.NewNRGBA(bounds)
+
+	index := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(cover.At(x, y)).(color.NRGBA)
+			for _, channel := range []*uint8{&c.R, &c.G, &c.B} {
+				if index < len(bits) {
+					*channel = (*channel &^ 1) | bits[index]
+					index++
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img, nil
+}
+
+// ExtractFromImage extracts a payload embedded by EmbedInImage.
+func ExtractFromImage(img image.Image) ([]byte, error) {
+
+	bounds := img.Bounds()
+	bits := make([]byte, 0, 3*bounds.Dx()*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			bits = append(bits, c.R&1, c.G&1, c.B&1)
+		}
+	}
+
+	payload, err := unframePayload(bits)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return payload, nil
+}
+
+// EmbedInText returns the cover text with the payload embedded, as
+// zero-width characters, after the first word.
+func EmbedInText(cover string, payload []byte) (string, error) {
+
+	bits, err := framePayload(payload)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	var encoded strings.Builder
+	for _, bit := range bits {
+		if bit == 0 {
+			encoded.WriteRune(zeroWidthZeroBit)
+		} else {
+			encoded.WriteRune(zeroWidthOneBit)
+		}
+	}
+
+	index := strings.IndexAny(cover, " \t\n")
+	if index == -1 {
+		index = len(cover)
+	}
+
+	return cover[:index] + encoded.String() + cover[index:], nil
+}
+
+// ExtractFromText extracts a payload embedded by EmbedInText. All other
+// characters in the text are ignored, so the payload may be extracted from,
+// for example, a web page containing the cover text.
+func ExtractFromText(text string) ([]byte, error) {
+
+	var bits []byte
+	for _, r := range text {
+		switch r {
+		case zeroWidthZeroBit:
+			bits = append(bits, 0)
+		case zeroWidthOneBit:
+			bits = append(bits, 1)
+		}
+	}
+
+	payload, err := unframePayload(bits)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return payload, nil
+}
+
+// framePayload prefixes the payload with its length and returns the result
+// as bits, most significant first.
+func framePayload(payload []byte) ([]byte, error) {
+
+	if len(payload) > MAX_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("payload too large"))
+	}
+
+	framed := make([]byte, payloadLengthSize+len(payload))
+	binary.BigEndian.PutUint32(framed, uint32(len(payload)))
+	copy(framed[payloadLengthSize:], payload)
+
+	bits := make([]byte, 0, 8*len(framed))
+	for _, b := range framed {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, (b>>uint(i))&1)
+		}
+	}
+
+	return bits, nil
+}
+
+// unframePayload reverses framePayload, ignoring any trailing bits.
+func unframePayload(bits []byte) ([]byte, error) {
+
+	readBytes := func(offset, count int) []byte {
+		b := make([]byte, count)
+		for i := range b {
+			for _, bit := range bits[8*(offset+i) : 8*(offset+i+1)] {
+				b[i] = (b[i] << 1) | bit
+			}
+		}
+		return b
+	}
+
+	if len(bits) < 8*payloadLengthSize {
+		return nil, common.ContextError(errors.New("missing payload"))
+	}
+
+	length := int(binary.BigEndian.Uint32(readBytes(0, payloadLengthSize)))
+	if length > MAX_PAYLOAD_SIZE ||
+		len(bits) < 8*(payloadLengthSize+length) {
+		return nil, common.ContextError(errors.New("invalid payload length"))
+	}
+
+	return readBytes(payloadLengthSize, length), nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package stego
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestImage(t *testing.T) {
+
+	cover := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			cover.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+
+	payload := bytes.Repeat([]byte("server entry "), 80)
+
+	img, err := EmbedInImage(cover, payload)
+	if err != nil {
+		t.Fatalf("EmbedInImage failed: %s", err)
+	}
+
+	// Pixels change by at most 1 per channel.
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			a := cover.RGBAAt(x, y)
+			b := img.NRGBAAt(x, y)
+			if absDiff(a.R, b.R) > 1 || absDiff(a.G, b.G) > 1 || absDiff(a.B, b.B) > 1 {
+				t.Fatalf("unexpected pixel change at %d,%d", x, y)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = png.Encode(&buffer, img)
+	if err != nil {
+		t.Fatalf("png.Encode failed: %s", err)
+	}
+
+	extracted, err := Extract(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("Extract failed: %s", err)
+	}
+	if !bytes.Equal(payload, extracted) {
+		t.Fatalf("unexpected payload")
+	}
+
+	_, err = EmbedInImage(cover, bytes.Repeat([]byte("x"), 2000))
+	if err == nil {
+		t.Fatalf("unexpected EmbedInImage success")
+	}
+
+	_, err = Extract(buffer.Bytes()[:100])
+	if err == nil {
+		t.Fatalf("unexpected Extract success")
+	}
+}
+
+func TestText(t *testing.T) {
+
+	cover := "Lovely weather in the park today!"
+	payload := []byte("server entry")
+
+	text, err := EmbedInText(cover, payload)
+	if err != nil {
+		t.Fatalf("EmbedInText failed: %s", err)
+	}
+
+	if !strings.HasPrefix(text, "Lovely") ||
+		!strings.HasSuffix(text, " weather in the park today!") {
+		t.Fatalf("unexpected text: %s", text)
+	}
+
+	page := "<html><body><p>" + text + "</p></body></html>"
+
+	extracted, err := Extract([]byte(page))
+	if err != nil {
+		t.Fatalf("Extract failed: %s", err)
+	}
+	if !bytes.Equal(payload, extracted) {
+		t.Fatalf("unexpected payload")
+	}
+
+	_, err = Extract([]byte(cover))
+	if err == nil {
+		t.Fatalf("unexpected Extract success")
+	}
+
+	_, err = Extract([]byte{0xff, 0xfe, 0xfd})
+	if err == nil {
+		t.Fatalf("unexpected Extract success")
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tactics
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ed25519"
+)
+
+// Tactics payloads may be digitally signed by the server and verified by
+// the client. Signing keys are configured in the tactics configuration file
+// and the corresponding verification keys are deployed to clients in a key
+// ring.
+//
+// Multiple signing keys may be configured concurrently to support key
+// rotation. Each key has an optional validity period, and the server signs
+// with the valid key that has the most recent NotBefore time. To rotate
+// keys, first deploy the new verification key to clients; then configure
+// the new signing key, with a NotBefore time after the client deployment,
+// alongside the old signing key, setting the old key NotAfter time to
+// expire it.
+
+const (
+	signingKeyIDLength  = 32
+	signedPayloadPrefix = "psiphon-tactics-payload\n"
+)
+
+// SigningKey is an Ed25519 private key used to sign tactics payloads. The
+// key ID is included in signed payloads and identifies the corresponding
+// verification key. NotBefore and NotAfter specify the validity period of
+// the key; zero values indicate no bound.
+type SigningKey struct {
+	ID         []byte
+	PrivateKey []byte
+	NotBefore  time.Time
+	NotAfter   time.Time
+}
+
+// VerificationKey is the Ed25519 public key used to verify tactics payloads
+// signed with the signing key with the same ID. A payload signature is
+// accepted only within the key validity period.
+type VerificationKey struct {
+	ID        []byte
+	PublicKey []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// VerificationKeyRing is a set of verification keys to be deployed to
+// clients for verifying signed tactics payloads.
+type VerificationKeyRing struct {
+	Keys []*VerificationKey
+}
+
+// NewSigningKeyPair generates a new tactics signing key pair, with the
+// specified validity period.
+func NewSigningKeyPair(
+	notBefore, notAfter time.Time) (*SigningKey, *VerificationKey, error) {
+
+	ID, err := common.MakeSecureRandomBytes(signingKeyIDLength)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
+	signingKey := &SigningKey{
+		ID:         ID,
+		PrivateKey: privateKey,
+		NotBefore:  notBefore,
+		NotAfter:   notAfter,
+	}
+
+	verificationKey := &VerificationKey{
+		ID:        ID,
+		PublicKey: publicKey,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}
+
+	return signingKey, verificationKey, nil
+}
+
+func isValidKeyPeriod(notBefore, notAfter, now time.Time) bool {
+	return (notBefore.IsZero() || !now.Before(notBefore)) &&
+		(notAfter.IsZero() || now.Before(notAfter))
+}
+
+// ValidateSigningKeys checks that the signing keys are correctly
+// configured.
+func ValidateSigningKeys(signingKeys []*SigningKey) error {
+	for _, key := range signingKeys {
+		if len(key.ID) != signingKeyIDLength ||
+			len(key.PrivateKey) != ed25519.PrivateKeySize ||
+			(!key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore)) {
+			return common.ContextError(errors.New("invalid signing key"))
+		}
+	}
+	return nil
+}
+
+// ValidateVerificationKeyRing checks that a verification key ring is
+// correctly configured.
+func ValidateVerificationKeyRing(keyRing *VerificationKeyRing) error {
+	for _, key := range keyRing.Keys {
+		if len(key.ID) != signingKeyIDLength ||
+			len(key.PublicKey) != ed25519.PublicKeySize ||
+			(!key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore)) {
+			return common.ContextError(errors.New("invalid verification key"))
+		}
+	}
+	return nil
+}
+
+// CheckSigningKeys checks that each signing key has a corresponding
+// verification key, with the same ID, public key, and validity period, in
+// the key ring. CheckSigningKeys may be used by operators to check that
+// signing keys are deployable before configuring them on servers.
+func CheckSigningKeys(
+	signingKeys []*SigningKey, keyRing *VerificationKeyRing) error {
+
+	err := ValidateSigningKeys(signingKeys)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	for _, signingKey := range signingKeys {
+		found := false
+		for _, key := range keyRing.Keys {
+			if bytes.Equal(signingKey.ID, key.ID) &&
+				bytes.Equal(
+					ed25519.PrivateKey(signingKey.PrivateKey).Public().(ed25519.PublicKey),
+					key.PublicKey) &&
+				signingKey.NotBefore.Equal(key.NotBefore) &&
+				signingKey.NotAfter.Equal(key.NotAfter) {
+
+				found = true
+				break
+			}
+		}
+		if !found {
+			return common.ContextError(
+				fmt.Errorf("missing verification key: %x", signingKey.ID))
+		}
+	}
+
+	return nil
+}
+
+// selectSigningKey returns the valid signing key with the most recent
+// NotBefore time, or nil when no key is valid.
+func selectSigningKey(signingKeys []*SigningKey, now time.Time) *SigningKey {
+	var selectedKey *SigningKey
+	for _, key := range signingKeys {
+		if !isValidKeyPeriod(key.NotBefore, key.NotAfter, now) {
+			continue
+		}
+		if selectedKey == nil || key.NotBefore.After(selectedKey.NotBefore) {
+			selectedKey = key
+		}
+	}
+	return selectedKey
+}
+
+// getSignedPayloadData returns the payload data covered by the signature:
+// the tag and, when present, the tactics.
+func getSignedPayloadData(payload *Payload) []byte {
+	data := []byte(signedPayloadPrefix)
+	data = append(data, []byte(payload.Tag)...)
+	data = append(data, '\n')
+	data = append(data, payload.Tactics...)
+	return data
+}
+
+// signPayload signs the payload with the current signing key. The payload
+// is left unsigned when no signing key is valid.
+func signPayload(signingKeys []*SigningKey, payload *Payload, now time.Time) {
+
+	signingKey := selectSigningKey(signingKeys, now)
+	if signingKey == nil {
+		return
+	}
+
+	payload.SigningKeyID = signingKey.ID
+	payload.Signature = ed25519.Sign(
+		signingKey.PrivateKey, getSignedPayloadData(payload))
+}
+
+// VerifyPayload verifies the payload signature using the verification key
+// identified by the payload signing key ID. An error is returned when the
+// payload is unsigned, the key is not in the key ring or is not valid at the
+// specified time, or the signature is invalid.
+//
+// VerifyPayload is used by clients to verify received tactics, and may be
+// used by operators to verify tactics payloads before deployment.
+func VerifyPayload(
+	keyRing *VerificationKeyRing, payload *Payload, now time.Time) error {
+
+	err := ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if len(payload.SigningKeyID) != signingKeyIDLength {
+		return common.ContextError(errors.New("invalid key ID length"))
+	}
+
+	if len(payload.Signature) != ed25519.SignatureSize {
+		return common.ContextError(errors.New("invalid signature length"))
+	}
+
+	var verificationKey *VerificationKey
+
+	for _, key := range keyRing.Keys {
+		if subtle.ConstantTimeCompare(payload.SigningKeyID, key.ID) == 1 {
+			verificationKey = key
+		}
+	}
+
+	if verificationKey == nil {
+		return common.ContextError(errors.New("invalid key ID"))
+	}
+
+	if !isValidKeyPeriod(verificationKey.NotBefore, verificationKey.NotAfter, now) {
+		return common.ContextError(errors.New("expired key"))
+	}
+
+	if !ed25519.Verify(
+		verificationKey.PublicKey, getSignedPayloadData(payload), payload.Signature) {
+		return common.ContextError(errors.New("invalid signature"))
+	}
+
+	return nil
+}
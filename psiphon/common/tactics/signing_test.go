@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tactics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSigning(t *testing.T) {
+
+	now := time.Now()
+
+	// The old key expires in one hour; the new key becomes valid in 30
+	// minutes. Between those times, both keys are valid and the new key is
+	// used for signing.
+
+	oldSigningKey, oldVerificationKey, err := NewSigningKeyPair(
+		now.Add(-24*time.Hour), now.Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("NewSigningKeyPair failed: %s", err)
+	}
+
+	newSigningKey, newVerificationKey, err := NewSigningKeyPair(
+		now.Add(30*time.Minute), time.Time{})
+	if err != nil {
+		t.Fatalf("NewSigningKeyPair failed: %s", err)
+	}
+
+	signingKeys := []*SigningKey{oldSigningKey, newSigningKey}
+
+	keyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{oldVerificationKey, newVerificationKey},
+	}
+
+	err = CheckSigningKeys(signingKeys, keyRing)
+	if err != nil {
+		t.Fatalf("CheckSigningKeys failed: %s", err)
+	}
+
+	err = CheckSigningKeys(
+		signingKeys, &VerificationKeyRing{Keys: []*VerificationKey{oldVerificationKey}})
+	if err == nil {
+		t.Fatalf("unexpected CheckSigningKeys success")
+	}
+
+	makePayload := func(signTime time.Time) *Payload {
+		payload := &Payload{
+			Tag:     "TAG",
+			Tactics: []byte(`{"TTL":"1h","Probability":1.0}`),
+		}
+		signPayload(signingKeys, payload, signTime)
+		return payload
+	}
+
+	for _, testCase := range []struct {
+		signTime   time.Time
+		signingKey *SigningKey
+	}{
+		{now, oldSigningKey},
+		{now.Add(45 * time.Minute), newSigningKey},
+		{now.Add(2 * time.Hour), newSigningKey},
+	} {
+		payload := makePayload(testCase.signTime)
+		if !bytes.Equal(payload.SigningKeyID, testCase.signingKey.ID) {
+			t.Fatalf("unexpected signing key at %s", testCase.signTime)
+		}
+		err = VerifyPayload(keyRing, payload, testCase.signTime)
+		if err != nil {
+			t.Fatalf("VerifyPayload failed: %s", err)
+		}
+	}
+
+	// A payload signed with an expired key is rejected.
+
+	payload := makePayload(now)
+
+	err = VerifyPayload(keyRing, payload, now.Add(2*time.Hour))
+	if err == nil {
+		t.Fatalf("unexpected VerifyPayload success with expired key")
+	}
+
+	// A payload with modified tactics is rejected.
+
+	payload.Tactics = []byte(`{"TTL":"1h","Probability":0.5}`)
+
+	err = VerifyPayload(keyRing, payload, now)
+	if err == nil {
+		t.Fatalf("unexpected VerifyPayload success with modified tactics")
+	}
+
+	// When a key ring is configured, unsigned payloads are rejected.
+
+	storer := newTestStorer()
+
+	_, err = HandleTacticsPayload(
+		storer, "NETWORK", keyRing,
+		&Payload{Tag: "TAG", Tactics: []byte(`{"TTL":"1h","Probability":1.0}`)})
+	if err == nil {
+		t.Fatalf("unexpected HandleTacticsPayload success with unsigned payload")
+	}
+
+	_, err = HandleTacticsPayload(storer, "NETWORK", keyRing, makePayload(now))
+	if err != nil {
+		t.Fatalf("HandleTacticsPayload failed: %s", err)
+	}
+
+	// With no signing keys, payloads are unsigned.
+
+	payload = &Payload{Tag: "TAG"}
+	signPayload(nil, payload, now)
+	if payload.SigningKeyID != nil || payload.Signature != nil {
+		t.Fatalf("unexpected payload signature")
+	}
+}
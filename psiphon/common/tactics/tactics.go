@@ -148,6 +148,13 @@ The client sends all its speed test samples, for the current network context, to
 the server in tactics and handshake requests; this allows the server logic to
 handle outliers and aggregation. Currently, filtered tactics support filerting
 on speed test RTT maximum, minimum, and median.
+
+Tactics payloads may be signed with Ed25519 signing keys configured on the
+server. Clients configured with a verification key ring reject unsigned or
+invalid payloads, both from tactics requests and handshake responses.
+Multiple signing keys, with validity periods, may be configured at once to
+support key rotation. The tactics verifier utility may be used to verify
+signed payloads and validate tactics configurations before deployment.
 */
 package tactics
 
@@ -237,6 +244,10 @@ type Server struct {
 	// tactics parameters via Listeners.
 	EnforceLimitsServerSide bool
 
+	// SigningKeys are the tactics payload signing keys. When no key is
+	// valid, payloads are not signed. See SigningKey.
+	SigningKeys []*SigningKey
+
 	// DefaultTactics is the baseline tactics for all clients. It must include a
 	// TTL and Probability.
 	DefaultTactics Tactics
@@ -317,6 +328,12 @@ type Payload struct {
 
 	// Tactics is a JSON-encoded Tactics struct and may be nil.
 	Tactics json.RawMessage
+
+	// SigningKeyID and Signature are the ID of the key used to sign the
+	// payload and the Ed25519 signature of the Tag and Tactics. Both are
+	// nil when the payload is not signed.
+	SigningKeyID []byte `json:",omitempty"`
+	Signature    []byte `json:",omitempty"`
 }
 
 // Record is the tactics data persisted by the client. There is one
@@ -457,6 +474,7 @@ func NewServer(
 			server.RequestPrivateKey = newServer.RequestPrivateKey
 			server.RequestObfuscatedKey = newServer.RequestObfuscatedKey
 			server.EnforceLimitsServerSide = newServer.EnforceLimitsServerSide
+			server.SigningKeys = newServer.SigningKeys
 			server.DefaultTactics = newServer.DefaultTactics
 			server.FilteredTactics = newServer.FilteredTactics
 
@@ -490,6 +508,11 @@ func (server *Server) Validate() error {
 		}
 	}
 
+	err := ValidateSigningKeys(server.SigningKeys)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
 	validateTactics := func(tactics *Tactics, isDefault bool) error {
 
 		// Allow "" for 0, even though ParseDuration does not.
@@ -549,7 +572,7 @@ func (server *Server) Validate() error {
 		return nil
 	}
 
-	err := validateTactics(&server.DefaultTactics, true)
+	err = validateTactics(&server.DefaultTactics, true)
 	if err != nil {
 		return common.ContextError(fmt.Errorf("invalid default tactics: %s", err))
 	}
@@ -664,6 +687,12 @@ func (server *Server) GetTacticsPayload(
 		payload.Tactics = marshaledTactics
 	}
 
+	server.ReloadableFile.RLock()
+	signingKeys := server.SigningKeys
+	server.ReloadableFile.RUnlock()
+
+	signPayload(signingKeys, payload, time.Now())
+
 	return payload, nil
 }
 
@@ -1241,9 +1270,13 @@ func SetTacticsAPIParameters(
 // retained and the exipry is extended using the previous TTL.
 // HandleTacticsPayload is called by the Psiphon client to handle the
 // tactics payload in the handshake response.
+//
+// When verificationKeyRing is not nil and contains keys, the payload must
+// be signed with one of the keys in the ring.
 func HandleTacticsPayload(
 	storer Storer,
 	networkID string,
+	verificationKeyRing *VerificationKeyRing,
 	payload *Payload) (*Record, error) {
 
 	// Note: since, in the client, a tactics request and a handshake
@@ -1269,7 +1302,7 @@ func HandleTacticsPayload(
 		return nil, common.ContextError(err)
 	}
 
-	err = applyTacticsPayload(storer, networkID, record, payload)
+	err = applyTacticsPayload(storer, networkID, verificationKeyRing, record, payload)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -1304,6 +1337,21 @@ func UseStoredTactics(
 	return nil, nil
 }
 
+// GetStoredTactics returns the stored tactics record for the given network
+// ID, whether or not it has expired. When there is no stored record, the
+// returned record has a blank Tag. GetStoredTactics is intended for
+// inspection and debugging; use UseStoredTactics to select tactics to apply.
+func GetStoredTactics(
+	storer Storer, networkID string) (*Record, error) {
+
+	record, err := getStoredTacticsRecord(storer, networkID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return record, nil
+}
+
 // FetchTactics performs a tactics request. When there are no stored
 // speed test samples for the network ID, a speed test request is
 // performed immediately before the tactics request, using the same
@@ -1324,11 +1372,15 @@ func UseStoredTactics(
 // the request. This is partially mitigated by rechecking the network ID
 // after the request and failing if it differs from the initial network ID.
 //
+// When verificationKeyRing is not nil and contains keys, the response
+// payload must be signed with one of the keys in the ring.
+//
 // FetchTactics modifies the apiParams input.
 func FetchTactics(
 	ctx context.Context,
 	clientParameters *parameters.ClientParameters,
 	storer Storer,
+	verificationKeyRing *VerificationKeyRing,
 	getNetworkID func() string,
 	apiParams common.APIParameters,
 	endPointRegion string,
@@ -1450,7 +1502,7 @@ func FetchTactics(
 		return nil, common.ContextError(err)
 	}
 
-	err = applyTacticsPayload(storer, networkID, record, payload)
+	err = applyTacticsPayload(storer, networkID, verificationKeyRing, record, payload)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -1613,6 +1665,7 @@ func getStoredTacticsRecord(
 func applyTacticsPayload(
 	storer Storer,
 	networkID string,
+	verificationKeyRing *VerificationKeyRing,
 	record *Record,
 	payload *Payload) error {
 
@@ -1620,6 +1673,13 @@ func applyTacticsPayload(
 		return common.ContextError(errors.New("invalid tag"))
 	}
 
+	if verificationKeyRing != nil && len(verificationKeyRing.Keys) > 0 {
+		err := VerifyPayload(verificationKeyRing, payload, time.Now())
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
 	// Replace the tactics data when the tags differ.
 
 	if payload.Tag != record.Tag {
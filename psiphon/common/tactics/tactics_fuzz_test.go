@@ -0,0 +1,114 @@
+// +build go1.18
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tactics
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func FuzzHandleTacticsPayload(f *testing.F) {
+
+	f.Add([]byte(`{"Tag":"abc","Tactics":{"TTL":"1h","Probability":1.0,"Parameters":{"ConnectionWorkerPoolSize":5}}}`))
+	f.Add([]byte(`{"Tag":"abc","Tactics":null}`))
+	f.Add([]byte(`{"Tag":"abc","Tactics":{"TTL":"-1h","Parameters":{"LimitTunnelProtocols":["OSSH"]}}}`))
+	f.Add([]byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var payload *Payload
+		err := json.Unmarshal(data, &payload)
+		if err != nil {
+			return
+		}
+
+		record, err := HandleTacticsPayload(newTestStorer(), "NETWORK", nil, payload)
+		if err != nil {
+			return
+		}
+
+		p, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			t.Fatalf("NewClientParameters failed: %s", err)
+		}
+
+		// skipOnError is true for Psiphon clients
+		_, _ = p.Set(record.Tag, true, record.Tactics.Parameters)
+	})
+}
+
+func FuzzUnboxTacticsRequest(f *testing.F) {
+
+	encodedRequestPublicKey, encodedRequestPrivateKey, encodedObfuscatedKey, err := GenerateKeys()
+	if err != nil {
+		f.Fatalf("GenerateKeys failed: %s", err)
+	}
+
+	requestPublicKey, _ := base64.StdEncoding.DecodeString(encodedRequestPublicKey)
+	requestPrivateKey, _ := base64.StdEncoding.DecodeString(encodedRequestPrivateKey)
+	obfuscatedKey, _ := base64.StdEncoding.DecodeString(encodedObfuscatedKey)
+
+	ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		f.Fatalf("box.GenerateKey failed: %s", err)
+	}
+
+	apiParams := common.APIParameters{
+		"client_platform": "P1",
+		"client_version":  "V1",
+	}
+
+	boxedRequest, err := boxPayload(
+		TACTICS_REQUEST_NONCE,
+		requestPublicKey,
+		ephemeralPrivateKey[:],
+		obfuscatedKey,
+		ephemeralPublicKey[:],
+		&apiParams)
+	if err != nil {
+		f.Fatalf("boxPayload failed: %s", err)
+	}
+
+	f.Add(boxedRequest)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		// unboxPayload deobfuscates in-place, so pass a copy of the
+		// fuzz input.
+
+		var apiParams common.APIParameters
+		_, _ = unboxPayload(
+			TACTICS_REQUEST_NONCE,
+			nil,
+			requestPrivateKey,
+			obfuscatedKey,
+			append([]byte(nil), data...),
+			&apiParams)
+	})
+}
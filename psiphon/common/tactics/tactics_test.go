@@ -334,6 +334,7 @@ func TestTactics(t *testing.T) {
 		ctx,
 		clientParams,
 		storer,
+		nil,
 		getNetworkID,
 		apiParams,
 		endPointProtocol,
@@ -406,6 +407,7 @@ func TestTactics(t *testing.T) {
 		context.Background(),
 		clientParams,
 		storer,
+		nil,
 		getNetworkID,
 		apiParams,
 		endPointProtocol,
@@ -483,6 +485,7 @@ func TestTactics(t *testing.T) {
 		context.Background(),
 		clientParams,
 		storer,
+		nil,
 		getNetworkID,
 		apiParams,
 		endPointProtocol,
@@ -531,7 +534,7 @@ func TestTactics(t *testing.T) {
 		t.Fatalf("GetTacticsPayload failed: %s", err)
 	}
 
-	handshakeTacticsRecord, err := HandleTacticsPayload(storer, networkID, tacticsPayload)
+	handshakeTacticsRecord, err := HandleTacticsPayload(storer, networkID, nil, tacticsPayload)
 	if err != nil {
 		t.Fatalf("HandleTacticsPayload failed: %s", err)
 	}
@@ -639,6 +642,7 @@ func TestTactics(t *testing.T) {
 		context.Background(),
 		clientParams,
 		storer,
+		nil,
 		getNetworkID,
 		apiParams,
 		endPointProtocol,
@@ -654,6 +658,7 @@ func TestTactics(t *testing.T) {
 		context.Background(),
 		clientParams,
 		storer,
+		nil,
 		getNetworkID,
 		apiParams,
 		endPointProtocol,
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// verifier is an offline utility for tactics signing keys and payloads. It
+// generates signing key pairs; validates tactics configuration files,
+// including checking that the configured signing keys have corresponding
+// keys in a client verification key ring; and verifies signed tactics
+// payloads.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+func main() {
+
+	var generate bool
+	flag.BoolVar(&generate, "generate", false, "generate a new signing key pair")
+
+	var notBefore string
+	flag.StringVar(&notBefore, "not-before", "", "generated key validity start time (RFC3339); default, none")
+
+	var notAfter string
+	flag.StringVar(&notAfter, "not-after", "", "generated key validity end time (RFC3339); default, none")
+
+	var configFilename string
+	flag.StringVar(&configFilename, "config", "", "tactics configuration filename to validate")
+
+	var keyRingFilename string
+	flag.StringVar(&keyRingFilename, "keys", "", "verification key ring filename")
+
+	var payloadFilename string
+	flag.StringVar(&payloadFilename, "payload", "", "signed tactics payload filename to verify")
+
+	var verifyTime string
+	flag.StringVar(&verifyTime, "time", "", "payload verification time (RFC3339); default, now")
+
+	flag.Parse()
+
+	if generate {
+		err := generateKeyPair(notBefore, notAfter)
+		if err != nil {
+			fmt.Printf("failed generating key pair: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var keyRing *tactics.VerificationKeyRing
+	if keyRingFilename != "" {
+		keyRingJSON, err := ioutil.ReadFile(keyRingFilename)
+		if err == nil {
+			err = json.Unmarshal(keyRingJSON, &keyRing)
+		}
+		if err == nil && keyRing == nil {
+			err = fmt.Errorf("empty key ring")
+		}
+		if err == nil {
+			err = tactics.ValidateVerificationKeyRing(keyRing)
+		}
+		if err != nil {
+			fmt.Printf("failed loading key ring file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if configFilename == "" && payloadFilename == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if configFilename != "" {
+		err := validateConfig(configFilename, keyRing)
+		if err != nil {
+			fmt.Printf("invalid tactics configuration: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("valid tactics configuration: %s\n", configFilename)
+	}
+
+	if payloadFilename != "" {
+
+		if keyRing == nil {
+			fmt.Printf("payload verification requires a key ring\n")
+			os.Exit(1)
+		}
+
+		now := time.Now()
+		if verifyTime != "" {
+			var err error
+			now, err = time.Parse(time.RFC3339, verifyTime)
+			if err != nil {
+				fmt.Printf("invalid time: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		tag, err := verifyPayload(payloadFilename, keyRing, now)
+		if err != nil {
+			fmt.Printf("invalid tactics payload: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("valid tactics payload: %s\n", tag)
+	}
+}
+
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func generateKeyPair(notBefore, notAfter string) error {
+
+	notBeforeTime, err := parseOptionalTime(notBefore)
+	if err != nil {
+		return err
+	}
+
+	notAfterTime, err := parseOptionalTime(notAfter)
+	if err != nil {
+		return err
+	}
+
+	signingKey, verificationKey, err := tactics.NewSigningKeyPair(
+		notBeforeTime, notAfterTime)
+	if err != nil {
+		return err
+	}
+
+	err = tactics.ValidateSigningKeys([]*tactics.SigningKey{signingKey})
+	if err != nil {
+		return err
+	}
+
+	output, err := json.MarshalIndent(
+		struct {
+			SigningKey      *tactics.SigningKey
+			VerificationKey *tactics.VerificationKey
+		}{signingKey, verificationKey}, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", output)
+
+	return nil
+}
+
+func validateConfig(configFilename string, keyRing *tactics.VerificationKeyRing) error {
+
+	configJSON, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return err
+	}
+
+	var server tactics.Server
+	err = json.Unmarshal(configJSON, &server)
+	if err != nil {
+		return err
+	}
+
+	err = server.Validate()
+	if err != nil {
+		return err
+	}
+
+	if keyRing != nil {
+		err = tactics.CheckSigningKeys(server.SigningKeys, keyRing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func verifyPayload(
+	payloadFilename string,
+	keyRing *tactics.VerificationKeyRing,
+	now time.Time) (string, error) {
+
+	payloadJSON, err := ioutil.ReadFile(payloadFilename)
+	if err != nil {
+		return "", err
+	}
+
+	var payload *tactics.Payload
+	err = json.Unmarshal(payloadJSON, &payload)
+	if err == nil && payload == nil {
+		err = fmt.Errorf("empty payload")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = tactics.VerifyPayload(keyRing, payload, now)
+	if err != nil {
+		return "", err
+	}
+
+	// The payload may omit the tactics, in which case only the tag is
+	// signed.
+
+	if payload.Tactics != nil {
+
+		var payloadTactics tactics.Tactics
+		err = json.Unmarshal(payload.Tactics, &payloadTactics)
+		if err != nil {
+			return "", err
+		}
+
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = clientParameters.Set("", false, payloadTactics.Parameters)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return payload.Tag, nil
+}
@@ -0,0 +1,434 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// FlowApplicationLookup is a callback which returns the name of the local
+// application which owns the specified flow, or "" when the application is
+// not known. Protocol is "TCP" or "UDP".
+type FlowApplicationLookup func(
+	protocol string,
+	localIPAddress net.IP,
+	localPort int,
+	remoteIPAddress net.IP,
+	remotePort int) string
+
+// FlowStats is a snapshot of the activity of a single client flow.
+//
+// Bytes are IP packet bytes, including headers. As with server flow
+// tracking, retransmitted packets are counted.
+type FlowStats struct {
+	Protocol        string
+	LocalIPAddress  net.IP
+	LocalPort       int
+	RemoteIPAddress net.IP
+	RemotePort      int
+	Application     string
+	BytesUp         int64
+	BytesDown       int64
+	PacketsUp       int64
+	PacketsDown     int64
+	Age             time.Duration
+	IdleTime        time.Duration
+}
+
+// ApplicationStats is the total activity of all client flows owned by a
+// single local application, including flows which have expired.
+type ApplicationStats struct {
+	Application string
+	BytesUp     int64
+	BytesDown   int64
+	Flows       int64
+}
+
+// clientFlows is a client-side flow table, tracking the activity of each
+// flow relayed by a packet tunnel client.
+//
+// Unlike server flow tracking, which is performed within processPacket,
+// client flow tracking is performed only for packets which processPacket
+// has validated, and only when enabled with ClientConfig.TrackFlows.
+//
+// clientFlows also enforces application exclusion: packets of flows owned
+// by an excluded application are dropped. Each flow's exclusion is checked
+// on its first packet, and rechecked after the excluded applications are
+// changed, which requires a synchronous application lookup on the packet
+// relay path.
+type clientFlows struct {
+	lastReapIndex        int64
+	exclusionGeneration  int64
+	applicationLookup    FlowApplicationLookup
+	flows                sync.Map
+	exclusionMutex       sync.Mutex
+	excludedApplications map[string]bool
+	totalsMutex          sync.Mutex
+	reapedTotals         map[string]*ApplicationStats
+}
+
+type clientFlowState struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesUp             int64
+	bytesDown           int64
+	packetsUp           int64
+	packetsDown         int64
+	lastPacketTime      int64
+	exclusionGeneration int64
+	excluded            int32
+	startTime           monotime.Time
+	applicationMutex    sync.Mutex
+	applicationChecked  bool
+	application         string
+}
+
+func newClientFlows(applicationLookup FlowApplicationLookup) *clientFlows {
+	return &clientFlows{
+		applicationLookup: applicationLookup,
+		reapedTotals:      make(map[string]*ApplicationStats),
+	}
+}
+
+// setExcludedApplications replaces the set of excluded applications.
+// Exclusion requires an application lookup.
+func (flows *clientFlows) setExcludedApplications(applications []string) {
+
+	excludedApplications := make(map[string]bool)
+	for _, application := range applications {
+		if application != "" {
+			excludedApplications[application] = true
+		}
+	}
+
+	flows.exclusionMutex.Lock()
+	flows.excludedApplications = excludedApplications
+	flows.exclusionMutex.Unlock()
+
+	atomic.AddInt64(&flows.exclusionGeneration, 1)
+}
+
+// update records a packet relayed in the specified direction. The packet
+// must have been validated by processPacket. update returns false when the
+// packet belongs to a flow owned by an excluded application, and must be
+// dropped; excluded packets aren't recorded.
+func (flows *clientFlows) update(direction packetDirection, packet []byte) bool {
+
+	ID, ok := getClientFlowID(direction, packet)
+	if !ok {
+		return true
+	}
+
+	now := int64(monotime.Now())
+
+	// Once every period, iterate over flows and reap expired entries.
+	reapIndex := now / int64(monotime.Time(FLOW_IDLE_EXPIRY/2))
+	previousReapIndex := atomic.LoadInt64(&flows.lastReapIndex)
+	if reapIndex != previousReapIndex &&
+		atomic.CompareAndSwapInt64(&flows.lastReapIndex, previousReapIndex, reapIndex) {
+		flows.reap()
+	}
+
+	f, ok := flows.flows.Load(ID)
+	if !ok {
+		f, _ = flows.flows.LoadOrStore(
+			ID, &clientFlowState{startTime: monotime.Time(now)})
+	}
+	flowState := f.(*clientFlowState)
+
+	if flows.isExcluded(ID, flowState) {
+		// Excluded flows remain in the table, until idle, to cache the
+		// exclusion result.
+		atomic.StoreInt64(&flowState.lastPacketTime, now)
+		return false
+	}
+
+	if direction == packetDirectionClientUpstream {
+		atomic.AddInt64(&flowState.bytesUp, int64(len(packet)))
+		atomic.AddInt64(&flowState.packetsUp, 1)
+	} else {
+		atomic.AddInt64(&flowState.bytesDown, int64(len(packet)))
+		atomic.AddInt64(&flowState.packetsDown, 1)
+	}
+	atomic.StoreInt64(&flowState.lastPacketTime, now)
+
+	return true
+}
+
+// isExcluded returns whether the flow is owned by an excluded application.
+// The result is cached in flowState until the excluded applications change.
+func (flows *clientFlows) isExcluded(ID flowID, flowState *clientFlowState) bool {
+
+	generation := atomic.LoadInt64(&flows.exclusionGeneration)
+	if generation == 0 || flows.applicationLookup == nil {
+		return false
+	}
+
+	if atomic.LoadInt64(&flowState.exclusionGeneration) == generation {
+		return atomic.LoadInt32(&flowState.excluded) == 1
+	}
+
+	application := flows.getApplication(ID, flowState)
+
+	flows.exclusionMutex.Lock()
+	excluded := flows.excludedApplications[application]
+	flows.exclusionMutex.Unlock()
+
+	if excluded {
+		atomic.StoreInt32(&flowState.excluded, 1)
+	} else {
+		atomic.StoreInt32(&flowState.excluded, 0)
+	}
+	atomic.StoreInt64(&flowState.exclusionGeneration, generation)
+
+	return excluded
+}
+
+// getApplication returns the application which owns the flow. The lookup is
+// performed at most once per flow.
+func (flows *clientFlows) getApplication(ID flowID, flowState *clientFlowState) string {
+
+	if flows.applicationLookup == nil {
+		return ""
+	}
+
+	flowState.applicationMutex.Lock()
+	defer flowState.applicationMutex.Unlock()
+
+	if !flowState.applicationChecked {
+		protocol := "TCP"
+		if ID.protocol == internetProtocolUDP {
+			protocol = "UDP"
+		}
+		flowState.application = flows.applicationLookup(
+			protocol,
+			flowIPAddress(ID.downstreamIPAddress),
+			int(ID.downstreamPort),
+			flowIPAddress(ID.upstreamIPAddress),
+			int(ID.upstreamPort))
+		flowState.applicationChecked = true
+	}
+
+	return flowState.application
+}
+
+// reap removes expired idle flows, adding their activity to the application
+// totals.
+func (flows *clientFlows) reap() {
+	now := monotime.Now()
+	flows.flows.Range(func(key, value interface{}) bool {
+		flowState := value.(*clientFlowState)
+		if now.Sub(monotime.Time(atomic.LoadInt64(&flowState.lastPacketTime))) > FLOW_IDLE_EXPIRY {
+			flows.flows.Delete(key)
+			application := flows.getApplication(key.(flowID), flowState)
+			flows.totalsMutex.Lock()
+			addApplicationStats(flows.reapedTotals, application, flowState)
+			flows.totalsMutex.Unlock()
+		}
+		return true
+	})
+}
+
+// addApplicationStats adds the activity of a flow to the application's
+// totals. Flows with no recorded activity, including excluded flows, are
+// skipped.
+func addApplicationStats(
+	totals map[string]*ApplicationStats,
+	application string,
+	flowState *clientFlowState) {
+
+	bytesUp := atomic.LoadInt64(&flowState.bytesUp)
+	bytesDown := atomic.LoadInt64(&flowState.bytesDown)
+	if bytesUp == 0 && bytesDown == 0 {
+		return
+	}
+
+	stats, ok := totals[application]
+	if !ok {
+		stats = &ApplicationStats{Application: application}
+		totals[application] = stats
+	}
+	stats.BytesUp += bytesUp
+	stats.BytesDown += bytesDown
+	stats.Flows += 1
+}
+
+// getApplicationStats returns the total activity of each application, over
+// both active and expired flows, sorted by total bytes transferred,
+// descending. Flows with an unknown application are totalled under "".
+func (flows *clientFlows) getApplicationStats() []ApplicationStats {
+
+	totals := make(map[string]*ApplicationStats)
+
+	flows.totalsMutex.Lock()
+	for application, stats := range flows.reapedTotals {
+		statsCopy := *stats
+		totals[application] = &statsCopy
+	}
+	flows.totalsMutex.Unlock()
+
+	flows.flows.Range(func(key, value interface{}) bool {
+		flowState := value.(*clientFlowState)
+		application := flows.getApplication(key.(flowID), flowState)
+		addApplicationStats(totals, application, flowState)
+		return true
+	})
+
+	stats := make([]ApplicationStats, 0, len(totals))
+	for _, applicationStats := range totals {
+		stats = append(stats, *applicationStats)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].BytesUp+stats[i].BytesDown > stats[j].BytesUp+stats[j].BytesDown
+	})
+
+	return stats
+}
+
+// getStats returns a snapshot of all active flows, sorted by total bytes
+// transferred, descending. The application lookup, when configured, is
+// performed once per flow, on the first getStats call that includes the
+// flow, keeping the lookup off the packet relay path unless applications
+// are excluded.
+func (flows *clientFlows) getStats() []FlowStats {
+
+	now := monotime.Now()
+
+	var stats []FlowStats
+
+	flows.flows.Range(func(key, value interface{}) bool {
+
+		ID := key.(flowID)
+		flowState := value.(*clientFlowState)
+
+		idleTime := now.Sub(monotime.Time(atomic.LoadInt64(&flowState.lastPacketTime)))
+		if idleTime > FLOW_IDLE_EXPIRY {
+			return true
+		}
+
+		if atomic.LoadInt64(&flowState.packetsUp)+atomic.LoadInt64(&flowState.packetsDown) == 0 {
+			// Excluded flow.
+			return true
+		}
+
+		protocol := "TCP"
+		if ID.protocol == internetProtocolUDP {
+			protocol = "UDP"
+		}
+
+		flowStats := FlowStats{
+			Protocol:        protocol,
+			LocalIPAddress:  flowIPAddress(ID.downstreamIPAddress),
+			LocalPort:       int(ID.downstreamPort),
+			RemoteIPAddress: flowIPAddress(ID.upstreamIPAddress),
+			RemotePort:      int(ID.upstreamPort),
+			BytesUp:         atomic.LoadInt64(&flowState.bytesUp),
+			BytesDown:       atomic.LoadInt64(&flowState.bytesDown),
+			PacketsUp:       atomic.LoadInt64(&flowState.packetsUp),
+			PacketsDown:     atomic.LoadInt64(&flowState.packetsDown),
+			Age:             now.Sub(flowState.startTime),
+			IdleTime:        idleTime,
+		}
+
+		flowStats.Application = flows.getApplication(ID, flowState)
+
+		stats = append(stats, flowStats)
+
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].BytesUp+stats[i].BytesDown > stats[j].BytesUp+stats[j].BytesDown
+	})
+
+	return stats
+}
+
+// getClientFlowID returns the flowID for a client packet. Packets have
+// already passed processPacket validation, which ensures that the packet
+// is IPv4 or IPv6, without options, and TCP or UDP with ports present.
+func getClientFlowID(direction packetDirection, packet []byte) (flowID, bool) {
+
+	var ID flowID
+
+	if len(packet) < 1 {
+		return ID, false
+	}
+
+	var protocol internetProtocol
+	var sourceIPAddress, destinationIPAddress net.IP
+	var sourcePort, destinationPort uint16
+
+	version := packet[0] >> 4
+
+	if version == 4 {
+		if len(packet) < 24 {
+			return ID, false
+		}
+		protocol = internetProtocol(packet[9])
+		sourceIPAddress = packet[12:16]
+		destinationIPAddress = packet[16:20]
+		sourcePort = binary.BigEndian.Uint16(packet[20:22])
+		destinationPort = binary.BigEndian.Uint16(packet[22:24])
+	} else if version == 6 {
+		if len(packet) < 44 {
+			return ID, false
+		}
+		protocol = internetProtocol(packet[6])
+		sourceIPAddress = packet[8:24]
+		destinationIPAddress = packet[24:40]
+		sourcePort = binary.BigEndian.Uint16(packet[40:42])
+		destinationPort = binary.BigEndian.Uint16(packet[42:44])
+	} else {
+		return ID, false
+	}
+
+	if protocol != internetProtocolTCP && protocol != internetProtocolUDP {
+		return ID, false
+	}
+
+	// For client flows, "downstream" is the local end and "upstream" is the
+	// remote end.
+
+	if direction == packetDirectionClientUpstream {
+		ID.set(sourceIPAddress, sourcePort, destinationIPAddress, destinationPort, protocol)
+	} else {
+		ID.set(destinationIPAddress, destinationPort, sourceIPAddress, sourcePort, protocol)
+	}
+
+	return ID, true
+}
+
+func flowIPAddress(address [net.IPv6len]byte) net.IP {
+	IP := net.IP(append([]byte(nil), address[:]...))
+	if IPv4 := IP.To4(); IPv4 != nil {
+		return IPv4
+	}
+	return IP
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func makeTestIPv4Packet(
+	protocol internetProtocol,
+	sourceIPAddress net.IP, sourcePort uint16,
+	destinationIPAddress net.IP, destinationPort uint16,
+	size int) []byte {
+
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	packet[9] = byte(protocol)
+	copy(packet[12:16], sourceIPAddress.To4())
+	copy(packet[16:20], destinationIPAddress.To4())
+	binary.BigEndian.PutUint16(packet[20:22], sourcePort)
+	binary.BigEndian.PutUint16(packet[22:24], destinationPort)
+	return packet
+}
+
+func TestClientFlows(t *testing.T) {
+
+	lookups := 0
+
+	flows := newClientFlows(
+		func(protocol string, _ net.IP, localPort int, _ net.IP, _ int) string {
+			lookups += 1
+			if protocol == "TCP" && localPort == 40000 {
+				return "browser"
+			}
+			return ""
+		})
+
+	localIPAddress := net.ParseIP("10.0.0.1")
+	remoteIPAddress1 := net.ParseIP("192.0.2.1")
+	remoteIPAddress2 := net.ParseIP("192.0.2.2")
+
+	for i := 0; i < 10; i++ {
+		flows.update(
+			packetDirectionClientUpstream,
+			makeTestIPv4Packet(
+				internetProtocolTCP, localIPAddress, 40000, remoteIPAddress1, 443, 100))
+		flows.update(
+			packetDirectionClientDownstream,
+			makeTestIPv4Packet(
+				internetProtocolTCP, remoteIPAddress1, 443, localIPAddress, 40000, 1000))
+	}
+
+	flows.update(
+		packetDirectionClientUpstream,
+		makeTestIPv4Packet(
+			internetProtocolUDP, localIPAddress, 50000, remoteIPAddress2, 53, 60))
+
+	for i := 0; i < 2; i++ {
+
+		stats := flows.getStats()
+
+		if len(stats) != 2 {
+			t.Fatalf("unexpected flow count: %d", len(stats))
+		}
+
+		flow := stats[0]
+		if flow.Protocol != "TCP" ||
+			!flow.LocalIPAddress.Equal(localIPAddress) ||
+			flow.LocalPort != 40000 ||
+			!flow.RemoteIPAddress.Equal(remoteIPAddress1) ||
+			flow.RemotePort != 443 ||
+			flow.Application != "browser" ||
+			flow.BytesUp != 1000 ||
+			flow.BytesDown != 10000 ||
+			flow.PacketsUp != 10 ||
+			flow.PacketsDown != 10 {
+			t.Fatalf("unexpected flow stats: %+v", flow)
+		}
+
+		flow = stats[1]
+		if flow.Protocol != "UDP" ||
+			flow.RemotePort != 53 ||
+			flow.Application != "" ||
+			flow.BytesUp != 60 ||
+			flow.BytesDown != 0 {
+			t.Fatalf("unexpected flow stats: %+v", flow)
+		}
+	}
+
+	if lookups != 2 {
+		t.Fatalf("unexpected application lookup count: %d", lookups)
+	}
+}
+
+func TestClientFlowsExclusion(t *testing.T) {
+
+	flows := newClientFlows(
+		func(_ string, _ net.IP, localPort int, _ net.IP, _ int) string {
+			if localPort == 40000 {
+				return "browser"
+			}
+			return "messenger"
+		})
+
+	localIPAddress := net.ParseIP("10.0.0.1")
+	remoteIPAddress := net.ParseIP("192.0.2.1")
+
+	browserPacket := makeTestIPv4Packet(
+		internetProtocolTCP, localIPAddress, 40000, remoteIPAddress, 443, 100)
+	messengerPacket := makeTestIPv4Packet(
+		internetProtocolTCP, localIPAddress, 40001, remoteIPAddress, 443, 300)
+
+	if !flows.update(packetDirectionClientUpstream, browserPacket) ||
+		!flows.update(packetDirectionClientUpstream, messengerPacket) {
+		t.Fatalf("unexpected excluded packet")
+	}
+
+	flows.setExcludedApplications([]string{"messenger"})
+
+	if !flows.update(packetDirectionClientUpstream, browserPacket) {
+		t.Fatalf("unexpected excluded packet")
+	}
+
+	if flows.update(packetDirectionClientUpstream, messengerPacket) {
+		t.Fatalf("unexpected relayed packet")
+	}
+
+	stats := flows.getApplicationStats()
+
+	if len(stats) != 2 ||
+		stats[0].Application != "messenger" ||
+		stats[0].BytesUp != 300 ||
+		stats[0].Flows != 1 ||
+		stats[1].Application != "browser" ||
+		stats[1].BytesUp != 200 ||
+		stats[1].Flows != 1 {
+		t.Fatalf("unexpected application stats: %+v", stats)
+	}
+
+	flows.setExcludedApplications(nil)
+
+	if !flows.update(packetDirectionClientUpstream, messengerPacket) {
+		t.Fatalf("unexpected excluded packet")
+	}
+
+	flows.reap()
+	flows.flows.Range(func(key, value interface{}) bool {
+		// Force expiry.
+		value.(*clientFlowState).lastPacketTime = 0
+		return true
+	})
+	flows.reap()
+
+	if len(flows.getStats()) != 0 {
+		t.Fatalf("unexpected active flows")
+	}
+
+	stats = flows.getApplicationStats()
+
+	if len(stats) != 2 ||
+		stats[0].Application != "messenger" ||
+		stats[0].BytesUp != 600 ||
+		stats[1].Application != "browser" ||
+		stats[1].BytesUp != 200 {
+		t.Fatalf("unexpected application stats: %+v", stats)
+	}
+}
@@ -1686,6 +1686,13 @@ type ClientConfig struct {
 	// and create and configure a tun device.
 	TunFileDescriptor int
 
+	// DeviceName specifies the name of the tun device to create,
+	// when TunFileDescriptor is not specified. On Linux, the name
+	// may include a "%d" placeholder for a kernel assigned unit
+	// number; on Darwin, the name must be in the form "utun<N>".
+	// When DeviceName is "", a system default name is used.
+	DeviceName string
+
 	// IPv4AddressCIDR is the IPv4 address and netmask to
 	// assign to a newly created tun device.
 	IPv4AddressCIDR string
@@ -1698,6 +1705,31 @@ type ClientConfig struct {
 	// to be configured to be routed through a newly
 	// created tun device.
 	RouteDestinations []string
+
+	// RouteIPv4Destinations specifies that IPv4 RouteDestinations
+	// are to be routed through the tun device on Linux. By default,
+	// only IPv6 RouteDestinations are explicitly routed on Linux,
+	// and IPv4 packets reach the tun device via its subnet or via
+	// sockets bound to the device. On Darwin, all RouteDestinations
+	// are always routed.
+	RouteIPv4Destinations bool
+
+	// TrackFlows enables client-side flow tracking, which records
+	// per-flow bytes and packets relayed. Flow stats are retrieved
+	// with GetFlowStats.
+	TrackFlows bool
+
+	// FlowApplicationLookup is an optional callback used, when
+	// TrackFlows is set, to identify the local application that
+	// owns each flow.
+	FlowApplicationLookup FlowApplicationLookup
+
+	// ExcludedApplications is an optional list of applications, as
+	// identified by FlowApplicationLookup, whose packets are dropped
+	// rather than relayed. ExcludedApplications requires TrackFlows
+	// and FlowApplicationLookup. The list may be changed, while
+	// running, with SetExcludedApplications.
+	ExcludedApplications []string
 }
 
 // Client is a packet tunnel client. A packet tunnel client
@@ -1709,6 +1741,7 @@ type Client struct {
 	channel         *Channel
 	upstreamPackets *PacketQueue
 	metrics         *packetMetrics
+	flows           *clientFlows
 	runContext      context.Context
 	stopRunning     context.CancelFunc
 	workers         *sync.WaitGroup
@@ -1737,6 +1770,14 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		upstreamPacketQueueSize = config.UpstreamPacketQueueSize
 	}
 
+	var flows *clientFlows
+	if config.TrackFlows {
+		flows = newClientFlows(config.FlowApplicationLookup)
+		if len(config.ExcludedApplications) > 0 {
+			flows.setExcludedApplications(config.ExcludedApplications)
+		}
+	}
+
 	runContext, stopRunning := context.WithCancel(context.Background())
 
 	return &Client{
@@ -1745,6 +1786,7 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		channel:         NewChannel(config.Transport, getMTU(config.MTU)),
 		upstreamPackets: NewPacketQueue(upstreamPacketQueueSize),
 		metrics:         new(packetMetrics),
+		flows:           flows,
 		runContext:      runContext,
 		stopRunning:     stopRunning,
 		workers:         new(sync.WaitGroup),
@@ -1790,6 +1832,11 @@ func (client *Client) Start() {
 				continue
 			}
 
+			if client.flows != nil &&
+				!client.flows.update(packetDirectionClientUpstream, readPacket) {
+				continue
+			}
+
 			// Instead of immediately writing to the channel, the
 			// packet is enqueued, which has the effect of batching
 			// up IP packets into a single channel packet (for Psiphon,
@@ -1854,6 +1901,11 @@ func (client *Client) Start() {
 				continue
 			}
 
+			if client.flows != nil &&
+				!client.flows.update(packetDirectionClientDownstream, readPacket) {
+				continue
+			}
+
 			err = client.device.WritePacket(readPacket)
 
 			if err != nil {
@@ -1884,6 +1936,36 @@ func (client *Client) Stop() {
 	client.config.Logger.WithContext().Info("stopped")
 }
 
+// GetFlowStats returns a snapshot of the client's active flows, sorted by
+// bytes transferred, descending. GetFlowStats returns nil when
+// ClientConfig.TrackFlows is not set.
+func (client *Client) GetFlowStats() []FlowStats {
+	if client.flows == nil {
+		return nil
+	}
+	return client.flows.getStats()
+}
+
+// GetApplicationStats returns the total activity of each application,
+// including the activity of expired flows. GetApplicationStats returns nil
+// when ClientConfig.TrackFlows is not set.
+func (client *Client) GetApplicationStats() []ApplicationStats {
+	if client.flows == nil {
+		return nil
+	}
+	return client.flows.getApplicationStats()
+}
+
+// SetExcludedApplications replaces ClientConfig.ExcludedApplications. The
+// new list applies to both new and existing flows. SetExcludedApplications
+// has no effect when ClientConfig.TrackFlows is not set.
+func (client *Client) SetExcludedApplications(applications []string) {
+	if client.flows == nil {
+		return
+	}
+	client.flows.setExcludedApplications(applications)
+}
+
 /*
    Packet offset constants in getPacketDestinationIPAddress and
    processPacket are from the following RFC definitions.
@@ -2632,7 +2714,7 @@ func NewServerDevice(config *ServerConfig) (*Device, error) {
 // Multiple client tun devices may exist per host.
 func NewClientDevice(config *ClientConfig) (*Device, error) {
 
-	file, deviceName, err := OpenTunDevice("")
+	file, deviceName, err := OpenTunDevice(config.DeviceName)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
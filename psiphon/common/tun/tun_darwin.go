@@ -383,10 +383,9 @@ func configureClientInterface(
 	config *ClientConfig,
 	tunDeviceName string) error {
 
-	// TODO: fix or remove the following broken code
-	return common.ContextError(unsupportedError)
-
-	// Set tun device network addresses and MTU
+	// Set tun device network addresses and MTU. utun devices are
+	// point-to-point, so the local address is also used as the
+	// destination address.
 
 	IPv4Address, IPv4Netmask, err := splitIPMask(config.IPv4AddressCIDR)
 	if err != nil {
@@ -406,7 +405,10 @@ func configureClientInterface(
 		return common.ContextError(err)
 	}
 
-	IPv6Address, IPv6Prefixlen, err := splitIPPrefixLen(serverIPv6AddressCIDR)
+	// Route the rest of the tun device subnet, which may include, e.g., the
+	// transparent DNS resolver address.
+
+	_, IPv4Network, err := net.ParseCIDR(config.IPv4AddressCIDR)
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -414,36 +416,91 @@ func configureClientInterface(
 	err = runNetworkConfigCommand(
 		config.Logger,
 		config.SudoNetworkConfigCommands,
-		"ifconfig",
-		tunDeviceName,
-		"inet6", IPv6Address, "prefixlen", IPv6Prefixlen)
+		"route",
+		"add",
+		"-net", IPv4Network.String(),
+		"-interface", tunDeviceName)
 	if err != nil {
 		return common.ContextError(err)
 	}
 
+	err = configureClientInterfaceIPv6(config, tunDeviceName)
+	if err != nil {
+		if config.AllowNoIPv6NetworkConfiguration {
+			config.Logger.WithContextFields(
+				common.LogFields{
+					"error": err}).Warning(
+				"assign IPv6 address failed")
+		} else {
+			return common.ContextError(err)
+		}
+	}
+
 	// Set routing. Routes set here should automatically
 	// drop when the tun device is removed.
 
 	for _, destination := range config.RouteDestinations {
 
-		// TODO: IPv6
+		// Destination may be host (IP) or network (CIDR)
+
+		destinationType := "-host"
+		IP := net.ParseIP(destination)
+		if IP == nil {
+			var err error
+			IP, _, err = net.ParseCIDR(destination)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			destinationType = "-net"
+		}
+
+		args := []string{"add"}
+		if IP.To4() == nil {
+			args = append(args, "-inet6")
+		}
+		args = append(args, destinationType, destination, "-interface", tunDeviceName)
 
 		err = runNetworkConfigCommand(
 			config.Logger,
 			config.SudoNetworkConfigCommands,
 			"route",
-			"add",
-			"-ifscope", tunDeviceName,
-			destination,
-			IPv4Address)
+			args...)
 		if err != nil {
-			return common.ContextError(err)
+			if IP.To4() == nil && config.AllowNoIPv6NetworkConfiguration {
+				config.Logger.WithContextFields(
+					common.LogFields{
+						"error": err}).Warning("add IPv6 route failed")
+			} else {
+				return common.ContextError(err)
+			}
 		}
 	}
 
 	return nil
 }
 
+func configureClientInterfaceIPv6(
+	config *ClientConfig,
+	tunDeviceName string) error {
+
+	IPv6Address, IPv6Prefixlen, err := splitIPPrefixLen(config.IPv6AddressCIDR)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = runNetworkConfigCommand(
+		config.Logger,
+		config.SudoNetworkConfigCommands,
+		"ifconfig",
+		tunDeviceName,
+		"inet6", IPv6Address, "prefixlen", IPv6Prefixlen)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 // BindToDevice binds a socket to the specified interface.
 func BindToDevice(fd int, deviceName string) error {
 
@@ -377,6 +377,23 @@ func configureClientInterface(
 			}
 		}
 		if IP.To4() != nil {
+
+			if !config.RouteIPv4Destinations {
+				continue
+			}
+
+			err = runNetworkConfigCommand(
+				config.Logger,
+				config.SudoNetworkConfigCommands,
+				"ip",
+				"-4",
+				"route", "replace",
+				destination,
+				"dev", tunDeviceName)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
 			continue
 		}
 
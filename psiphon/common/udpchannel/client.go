@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package udpchannel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	FLOW_DOWNSTREAM_QUEUE_SIZE = 64
+)
+
+// Client relays UDP flows over a UDP channel. Each flow is a net.Conn which
+// sends and receives whole datagrams.
+//
+// Downstream datagrams are queued per flow; when a flow's queue is full,
+// further datagrams are dropped, as with a full UDP socket receive buffer.
+type Client struct {
+	channel      io.ReadWriteCloser
+	writeMutex   sync.Mutex
+	flowsMutex   sync.Mutex
+	flows        map[uint32]*Flow
+	nextFlowID   uint32
+	closed       bool
+	runWaitGroup *sync.WaitGroup
+}
+
+// NewClient initializes a new Client which relays flows over the specified
+// UDP channel. Client takes ownership of the channel, which is closed when
+// the Client is closed.
+func NewClient(channel io.ReadWriteCloser) *Client {
+
+	client := &Client{
+		channel:      channel,
+		flows:        make(map[uint32]*Flow),
+		runWaitGroup: new(sync.WaitGroup),
+	}
+
+	client.runWaitGroup.Add(1)
+	go func() {
+		defer client.runWaitGroup.Done()
+		client.relayDownstream()
+	}()
+
+	return client
+}
+
+// Close closes the UDP channel and all flows.
+func (client *Client) Close() error {
+	err := client.channel.Close()
+	client.runWaitGroup.Wait()
+	return err
+}
+
+// Dial opens a new flow to remoteAddr. No frame is sent until the first
+// Write. When forwardDNS is set, the server relays the flow to its own DNS
+// resolver rather than to remoteAddr.
+func (client *Client) Dial(remoteAddr *net.UDPAddr, forwardDNS bool) (*Flow, error) {
+
+	remoteIP := remoteAddr.IP.To4()
+	if remoteIP == nil {
+		remoteIP = remoteAddr.IP.To16()
+	}
+	if remoteIP == nil {
+		return nil, common.ContextError(errors.New("invalid remote address"))
+	}
+
+	client.flowsMutex.Lock()
+	defer client.flowsMutex.Unlock()
+
+	if client.closed {
+		return nil, common.ContextError(errors.New("client closed"))
+	}
+
+	// Flow IDs are assigned sequentially, skipping any IDs still in use
+	// after wrapping around.
+
+	for {
+		client.nextFlowID += 1
+		if client.flows[client.nextFlowID] == nil {
+			break
+		}
+	}
+
+	flow := &Flow{
+		client:     client,
+		flowID:     client.nextFlowID,
+		remoteIP:   remoteIP,
+		remoteAddr: remoteAddr,
+		forwardDNS: forwardDNS,
+		packets:    make(chan []byte, FLOW_DOWNSTREAM_QUEUE_SIZE),
+		closed:     make(chan struct{}),
+	}
+
+	client.flows[flow.flowID] = flow
+
+	return flow, nil
+}
+
+func (client *Client) relayDownstream() {
+
+	buffer := make([]byte, MAX_FRAME_SIZE)
+
+	for {
+		frame, err := ReadFrame(client.channel, buffer)
+		if err != nil {
+			break
+		}
+
+		client.flowsMutex.Lock()
+		flow := client.flows[frame.FlowID]
+		client.flowsMutex.Unlock()
+
+		if flow == nil {
+			continue
+		}
+
+		if frame.IsClose() {
+			flow.close(false)
+			continue
+		}
+
+		select {
+		case flow.packets <- append([]byte(nil), frame.Payload...):
+		default:
+		}
+	}
+
+	client.flowsMutex.Lock()
+	client.closed = true
+	flows := client.flows
+	client.flows = make(map[uint32]*Flow)
+	client.flowsMutex.Unlock()
+
+	for _, flow := range flows {
+		flow.close(false)
+	}
+}
+
+func (client *Client) writeFrame(frame *Frame) error {
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	return WriteFrame(client.channel, frame)
+}
+
+// Flow is a UDP flow relayed by a Client. Flow implements net.Conn. Each
+// Read returns a single datagram, truncated to the size of the read buffer,
+// and each Write sends a single datagram.
+//
+// A flow is closed when the server closes it, for example when the flow
+// has been idle for longer than the server's UDP idle timeout; Read then
+// returns io.EOF.
+type Flow struct {
+	client        *Client
+	flowID        uint32
+	remoteIP      net.IP
+	remoteAddr    *net.UDPAddr
+	forwardDNS    bool
+	opened        bool
+	packets       chan []byte
+	closeOnce     sync.Once
+	closed        chan struct{}
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+// Read implements the net.Conn interface.
+func (flow *Flow) Read(buffer []byte) (int, error) {
+
+	// Queued packets are returned first, and a closed flow returns io.EOF
+	// even when the read deadline has passed.
+
+	select {
+	case packet := <-flow.packets:
+		return copy(buffer, packet), nil
+	default:
+	}
+
+	select {
+	case <-flow.closed:
+		return 0, io.EOF
+	default:
+	}
+
+	flow.deadlineMutex.Lock()
+	readDeadline := flow.readDeadline
+	flow.deadlineMutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(readDeadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-flow.packets:
+		return copy(buffer, packet), nil
+	case <-flow.closed:
+		return 0, io.EOF
+	case <-timeout:
+		// Return a net.Error, not wrapped, so callers can check Timeout.
+		return 0, &timeoutError{}
+	}
+}
+
+// Write implements the net.Conn interface.
+func (flow *Flow) Write(buffer []byte) (int, error) {
+
+	if len(buffer) > MAX_PAYLOAD_SIZE {
+		return 0, common.ContextError(errors.New("datagram too large"))
+	}
+
+	select {
+	case <-flow.closed:
+		return 0, common.ContextError(errors.New("flow closed"))
+	default:
+	}
+
+	frame := &Frame{
+		FlowID:  flow.flowID,
+		Payload: buffer,
+	}
+
+	// The first frame opens the flow. flow.opened is guarded by writeMutex.
+
+	flow.client.writeMutex.Lock()
+	defer flow.client.writeMutex.Unlock()
+
+	if !flow.opened {
+		frame.Flags = FLAG_OPEN
+		if flow.forwardDNS {
+			frame.Flags |= FLAG_DNS
+		}
+		frame.RemoteIP = flow.remoteIP
+		frame.RemotePort = uint16(flow.remoteAddr.Port)
+	}
+
+	err := WriteFrame(flow.client.channel, frame)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	flow.opened = true
+
+	return len(buffer), nil
+}
+
+// Close implements the net.Conn interface. Closing an opened flow notifies
+// the server, which closes its corresponding port forward.
+func (flow *Flow) Close() error {
+	flow.close(true)
+	return nil
+}
+
+func (flow *Flow) close(notifyServer bool) {
+	flow.closeOnce.Do(func() {
+
+		flow.client.flowsMutex.Lock()
+		if flow.client.flows[flow.flowID] == flow {
+			delete(flow.client.flows, flow.flowID)
+		}
+		flow.client.flowsMutex.Unlock()
+
+		close(flow.closed)
+
+		if notifyServer {
+			flow.client.writeMutex.Lock()
+			opened := flow.opened
+			flow.client.writeMutex.Unlock()
+
+			if opened {
+				_ = flow.client.writeFrame(
+					&Frame{Flags: FLAG_CLOSE, FlowID: flow.flowID})
+			}
+		}
+	})
+}
+
+func (flow *Flow) isClosed() bool {
+	select {
+	case <-flow.closed:
+		return true
+	default:
+	}
+	return false
+}
+
+// LocalAddr implements the net.Conn interface.
+func (flow *Flow) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (flow *Flow) RemoteAddr() net.Addr {
+	return flow.remoteAddr
+}
+
+// SetDeadline implements the net.Conn interface. Only the read deadline is
+// applied.
+func (flow *Flow) SetDeadline(t time.Time) error {
+	return flow.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn interface. A new deadline applies
+// to subsequent Read calls.
+func (flow *Flow) SetReadDeadline(t time.Time) error {
+	flow.deadlineMutex.Lock()
+	flow.readDeadline = t
+	flow.deadlineMutex.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface. Writes are not
+// subject to deadlines.
+func (flow *Flow) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
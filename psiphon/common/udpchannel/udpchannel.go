@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package udpchannel implements a UDP relay protocol which runs over a single
+SSH channel of type protocol.UDP_CHANNEL_TYPE.
+
+The protocol multiplexes many UDP flows, each identified by a client
+assigned flow ID, over the channel. Each datagram is sent in a frame:
+
+	| 2 byte frame size | 1 byte flags | 4 byte flow ID | address | payload |
+
+All integers are big endian. The frame size is the size of the frame
+following the frame size field. The address is present only when
+FLAG_OPEN is set, and has the form:
+
+	| 1 byte IP length (4 or 16) | IP address | 2 byte port |
+
+FLAG_OPEN opens a new flow to the specified address and relays the payload;
+any existing flow with the same ID is first closed. Subsequent upstream
+frames for the flow omit the address. FLAG_DNS, sent with FLAG_OPEN,
+requests that the server relay the flow to its own DNS resolver.
+FLAG_CLOSE, with no address or payload, closes a flow; it is sent by the
+client to close a flow and by the server when a flow is closed due to an
+idle timeout or an error.
+
+Unlike the legacy udpgw protocol, which is run over a TCP port forward to a
+designated udpgw server address, the flow ID space is 32 bits, addresses
+are sent only when opening a flow, and flow closure is signaled in both
+directions.
+*/
+package udpchannel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	FLAG_OPEN  = 1 << 0
+	FLAG_DNS   = 1 << 1
+	FLAG_CLOSE = 1 << 2
+
+	FRAME_SIZE_FIELD_SIZE = 2
+	FRAME_HEADER_SIZE     = FRAME_SIZE_FIELD_SIZE + 1 + 4
+	MAX_ADDRESS_SIZE      = 1 + net.IPv6len + 2
+	MAX_FRAME_SIZE        = FRAME_SIZE_FIELD_SIZE + 65535
+	MAX_PAYLOAD_SIZE      = MAX_FRAME_SIZE - FRAME_HEADER_SIZE - MAX_ADDRESS_SIZE
+)
+
+// Frame is a decoded protocol frame. RemoteIP and RemotePort are set only
+// when FLAG_OPEN is set.
+type Frame struct {
+	Flags      uint8
+	FlowID     uint32
+	RemoteIP   net.IP
+	RemotePort uint16
+	Payload    []byte
+}
+
+// IsOpen indicates whether the frame opens a new flow.
+func (frame *Frame) IsOpen() bool {
+	return frame.Flags&FLAG_OPEN == FLAG_OPEN
+}
+
+// IsDNS indicates whether the frame requests transparent DNS forwarding.
+func (frame *Frame) IsDNS() bool {
+	return frame.Flags&FLAG_DNS == FLAG_DNS
+}
+
+// IsClose indicates whether the frame closes a flow.
+func (frame *Frame) IsClose() bool {
+	return frame.Flags&FLAG_CLOSE == FLAG_CLOSE
+}
+
+// GetHeaderSize returns the encoded size of the frame, excluding the
+// payload.
+func (frame *Frame) GetHeaderSize() int {
+	size := FRAME_HEADER_SIZE
+	if frame.IsOpen() {
+		size += 1 + len(frame.RemoteIP) + 2
+	}
+	return size
+}
+
+// ReadFrame reads a single frame from reader. buffer must be at least
+// MAX_FRAME_SIZE bytes. The returned Frame references memory in buffer, so
+// the frame is valid only until the next ReadFrame call using the same
+// buffer. ReadFrame returns io.EOF when reader returns io.EOF before any
+// frame data is read.
+func ReadFrame(reader io.Reader, buffer []byte) (*Frame, error) {
+
+	if len(buffer) < MAX_FRAME_SIZE {
+		return nil, common.ContextError(errors.New("buffer too small"))
+	}
+
+	_, err := io.ReadFull(reader, buffer[0:FRAME_SIZE_FIELD_SIZE])
+	if err != nil {
+		if err != io.EOF {
+			err = common.ContextError(err)
+		}
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(buffer[0:FRAME_SIZE_FIELD_SIZE]))
+
+	if size < FRAME_HEADER_SIZE-FRAME_SIZE_FIELD_SIZE {
+		return nil, common.ContextError(errors.New("invalid frame size"))
+	}
+
+	frameEnd := FRAME_SIZE_FIELD_SIZE + size
+
+	_, err = io.ReadFull(reader, buffer[FRAME_SIZE_FIELD_SIZE:frameEnd])
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	frame := &Frame{
+		Flags:  buffer[2],
+		FlowID: binary.BigEndian.Uint32(buffer[3:FRAME_HEADER_SIZE]),
+	}
+
+	offset := FRAME_HEADER_SIZE
+
+	if frame.IsOpen() {
+
+		if offset+1 > frameEnd {
+			return nil, common.ContextError(errors.New("invalid frame address"))
+		}
+
+		IPLength := int(buffer[offset])
+		offset += 1
+
+		if (IPLength != net.IPv4len && IPLength != net.IPv6len) ||
+			offset+IPLength+2 > frameEnd {
+			return nil, common.ContextError(errors.New("invalid frame address"))
+		}
+
+		frame.RemoteIP = net.IP(append([]byte(nil), buffer[offset:offset+IPLength]...))
+		offset += IPLength
+
+		frame.RemotePort = binary.BigEndian.Uint16(buffer[offset : offset+2])
+		offset += 2
+	}
+
+	if frame.IsClose() && offset != frameEnd {
+		return nil, common.ContextError(errors.New("unexpected close frame payload"))
+	}
+
+	frame.Payload = buffer[offset:frameEnd]
+
+	return frame, nil
+}
+
+// WriteFrameHeader encodes the frame, excluding the payload, into the start
+// of buffer, for a payload of payloadSize bytes which the caller places in
+// buffer immediately following the header. The header size is
+// frame.GetHeaderSize(). frame.Payload is ignored.
+//
+// WriteFrameHeader allows callers to read datagrams directly into a buffer
+// at the payload offset and then send the entire frame with one write.
+func WriteFrameHeader(frame *Frame, payloadSize int, buffer []byte) error {
+
+	headerSize := frame.GetHeaderSize()
+
+	if frame.IsOpen() &&
+		len(frame.RemoteIP) != net.IPv4len && len(frame.RemoteIP) != net.IPv6len {
+		return common.ContextError(errors.New("invalid frame address"))
+	}
+
+	if payloadSize > MAX_FRAME_SIZE-headerSize {
+		return common.ContextError(errors.New("invalid payload size"))
+	}
+
+	if len(buffer) < headerSize+payloadSize {
+		return common.ContextError(errors.New("buffer too small"))
+	}
+
+	binary.BigEndian.PutUint16(
+		buffer[0:FRAME_SIZE_FIELD_SIZE],
+		uint16(headerSize-FRAME_SIZE_FIELD_SIZE+payloadSize))
+
+	buffer[2] = frame.Flags
+
+	binary.BigEndian.PutUint32(buffer[3:FRAME_HEADER_SIZE], frame.FlowID)
+
+	if frame.IsOpen() {
+		offset := FRAME_HEADER_SIZE
+		buffer[offset] = uint8(len(frame.RemoteIP))
+		offset += 1
+		copy(buffer[offset:], frame.RemoteIP)
+		offset += len(frame.RemoteIP)
+		binary.BigEndian.PutUint16(buffer[offset:offset+2], frame.RemotePort)
+	}
+
+	return nil
+}
+
+// WriteFrame encodes the frame, including the payload, and writes it to
+// writer in a single write.
+func WriteFrame(writer io.Writer, frame *Frame) error {
+
+	buffer := make([]byte, frame.GetHeaderSize()+len(frame.Payload))
+
+	err := WriteFrameHeader(frame, len(frame.Payload), buffer)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	copy(buffer[frame.GetHeaderSize():], frame.Payload)
+
+	_, err = writer.Write(buffer)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package udpchannel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+
+	frames := []*Frame{
+		{
+			Flags:      FLAG_OPEN,
+			FlowID:     1,
+			RemoteIP:   net.ParseIP("192.168.0.1").To4(),
+			RemotePort: 53,
+			Payload:    []byte("payload"),
+		},
+		{
+			Flags:      FLAG_OPEN | FLAG_DNS,
+			FlowID:     2,
+			RemoteIP:   net.ParseIP("2001:db8::1"),
+			RemotePort: 443,
+			Payload:    make([]byte, MAX_PAYLOAD_SIZE),
+		},
+		{
+			FlowID:  3,
+			Payload: []byte{},
+		},
+		{
+			Flags:   FLAG_CLOSE,
+			FlowID:  0xFFFFFFFF,
+			Payload: []byte{},
+		},
+	}
+
+	var stream bytes.Buffer
+
+	for _, frame := range frames {
+		err := WriteFrame(&stream, frame)
+		if err != nil {
+			t.Fatalf("WriteFrame failed: %s", err)
+		}
+	}
+
+	buffer := make([]byte, MAX_FRAME_SIZE)
+
+	for _, frame := range frames {
+
+		readFrame, err := ReadFrame(&stream, buffer)
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %s", err)
+		}
+
+		if readFrame.Flags != frame.Flags ||
+			readFrame.FlowID != frame.FlowID ||
+			!readFrame.RemoteIP.Equal(frame.RemoteIP) ||
+			readFrame.RemotePort != frame.RemotePort ||
+			!bytes.Equal(readFrame.Payload, frame.Payload) {
+
+			t.Fatalf("unexpected frame: %+v", readFrame)
+		}
+	}
+
+	_, err := ReadFrame(&stream, buffer)
+	if err != io.EOF {
+		t.Fatalf("unexpected ReadFrame result: %v", err)
+	}
+
+	err = WriteFrame(&stream, &Frame{Payload: make([]byte, MAX_FRAME_SIZE)})
+	if err == nil {
+		t.Fatalf("unexpected WriteFrame success with oversized payload")
+	}
+
+	err = WriteFrame(&stream, &Frame{Flags: FLAG_OPEN, RemoteIP: []byte{1, 2, 3}})
+	if err == nil {
+		t.Fatalf("unexpected WriteFrame success with invalid address")
+	}
+
+	for _, invalidFrame := range [][]byte{
+		// Frame size too small
+		{0, 4, 0, 0, 0, 0},
+		// Truncated frame
+		{0, 10, 0, 0, 0, 0, 1},
+		// Invalid IP length
+		{0, 9, FLAG_OPEN, 0, 0, 0, 1, 3, 1, 2, 3},
+		// Missing address
+		{0, 5, FLAG_OPEN, 0, 0, 0, 1},
+		// Close with payload
+		{0, 6, FLAG_CLOSE, 0, 0, 0, 1, 0},
+	} {
+		_, err := ReadFrame(bytes.NewReader(invalidFrame), buffer)
+		if err == nil {
+			t.Fatalf("unexpected ReadFrame success: %x", invalidFrame)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+
+	serverResult := runTestServer(serverConn)
+
+	client := NewClient(clientConn)
+
+	flow, err := client.Dial(&net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}, false)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	buffer := make([]byte, 1024)
+
+	for i := 0; i < 2; i++ {
+
+		datagram := []byte("datagram")
+
+		_, err = flow.Write(datagram)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		n, err := flow.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+
+		if !bytes.Equal(buffer[:n], datagram) {
+			t.Fatalf("unexpected datagram")
+		}
+	}
+
+	// The server closed the flow.
+
+	_, err = flow.Read(buffer)
+	if err != io.EOF {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	// Read deadlines time out.
+
+	otherFlow, err := client.Dial(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, true)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	otherFlow.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	_, err = otherFlow.Read(buffer)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	// Closing the client closes all flows.
+
+	client.Close()
+
+	_, err = otherFlow.Read(buffer)
+	if err != io.EOF {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	_, err = client.Dial(&net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}, false)
+	if err == nil {
+		t.Fatalf("unexpected Dial success")
+	}
+
+	err = <-serverResult
+	if err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+}
+
+func TestRelayUdpgw(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+
+	serverResult := runTestServer(serverConn)
+
+	udpgwConn, relayConn := net.Pipe()
+
+	relayDone := make(chan struct{})
+	go func() {
+		RelayUdpgw(relayConn, NewClient(clientConn))
+		close(relayDone)
+	}()
+
+	buffer := make([]byte, UDPGW_MAX_MESSAGE_SIZE)
+
+	for _, remoteIP := range []net.IP{
+		net.ParseIP("192.168.0.1").To4(),
+		net.ParseIP("2001:db8::1"),
+	} {
+
+		flags := uint8(0)
+		if len(remoteIP) == net.IPv6len {
+			flags = UDPGW_FLAG_IPV6
+		}
+		connID := uint16(len(remoteIP))
+		remotePort := uint16(53)
+
+		// The server closes the flow after the second datagram. The third
+		// datagram requests a rebind, as tun2socks does when reusing a conn
+		// ID, and is relayed using a new flow.
+
+		for i := 0; i < 3; i++ {
+
+			messageFlags := flags
+			if i == 2 {
+				messageFlags |= UDPGW_FLAG_REBIND
+			}
+
+			datagram := []byte(fmt.Sprintf("datagram %d", i))
+
+			preambleSize := 7 + len(remoteIP)
+			copy(buffer[preambleSize:], datagram)
+
+			err := WriteUdpgwPreamble(
+				preambleSize,
+				messageFlags,
+				connID,
+				remoteIP,
+				remotePort,
+				uint16(len(datagram)),
+				buffer)
+			if err != nil {
+				t.Fatalf("WriteUdpgwPreamble failed: %s", err)
+			}
+
+			_, err = udpgwConn.Write(buffer[:preambleSize+len(datagram)])
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			message, err := ReadUdpgwMessage(udpgwConn, buffer)
+			if err != nil {
+				t.Fatalf("ReadUdpgwMessage failed: %s", err)
+			}
+
+			if message.ConnID != connID ||
+				!bytes.Equal(message.RemoteIP, remoteIP) ||
+				message.RemotePort != remotePort ||
+				!bytes.Equal(message.Packet, datagram) {
+
+				t.Fatalf("unexpected message: %+v", message)
+			}
+		}
+	}
+
+	// Closing the udpgw connection closes the UDP channel.
+
+	udpgwConn.Close()
+
+	<-relayDone
+
+	err := <-serverResult
+	if err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+}
+
+// runTestServer runs a UDP channel test server, which echoes each datagram
+// and closes each flow after echoing the flow's second datagram. The server
+// result is sent to the returned channel once serverConn is closed.
+func runTestServer(serverConn net.Conn) <-chan error {
+
+	serverResult := make(chan error, 1)
+
+	go func() {
+		buffer := make([]byte, MAX_FRAME_SIZE)
+		flows := make(map[uint32]*Frame)
+		for {
+			frame, err := ReadFrame(serverConn, buffer)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				serverResult <- err
+				return
+			}
+
+			if frame.IsClose() {
+				delete(flows, frame.FlowID)
+				continue
+			}
+
+			if frame.IsOpen() {
+				flows[frame.FlowID] = &Frame{
+					RemoteIP:   frame.RemoteIP,
+					RemotePort: frame.RemotePort,
+				}
+			}
+
+			flow := flows[frame.FlowID]
+			if flow == nil {
+				continue
+			}
+			flow.Flags += 1
+
+			err = WriteFrame(serverConn, &Frame{FlowID: frame.FlowID, Payload: frame.Payload})
+			if err == nil && flow.Flags == 2 {
+				err = WriteFrame(serverConn, &Frame{Flags: FLAG_CLOSE, FlowID: frame.FlowID})
+			}
+			if err != nil {
+				serverResult <- err
+				return
+			}
+		}
+	}()
+
+	return serverResult
+}
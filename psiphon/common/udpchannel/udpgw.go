@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package udpchannel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// The udpgw protocol and original server implementation:
+// Copyright (c) 2009, Ambroz Bizjak <ambrop7@gmail.com>
+// https://github.com/ambrop72/badvpn
+
+// TODO: express and/or calculate UDPGW_MAX_PAYLOAD_SIZE as function of MTU?
+const (
+	UDPGW_FLAG_KEEPALIVE = 1 << 0
+	UDPGW_FLAG_REBIND    = 1 << 1
+	UDPGW_FLAG_DNS       = 1 << 2
+	UDPGW_FLAG_IPV6      = 1 << 3
+
+	UDPGW_MAX_PREAMBLE_SIZE = 23
+	UDPGW_MAX_PAYLOAD_SIZE  = 32768
+	UDPGW_MAX_MESSAGE_SIZE  = UDPGW_MAX_PREAMBLE_SIZE + UDPGW_MAX_PAYLOAD_SIZE
+)
+
+// UdpgwMessage is a decoded udpgw protocol message.
+type UdpgwMessage struct {
+	ConnID              uint16
+	RemoteIP            []byte
+	RemotePort          uint16
+	DiscardExistingConn bool
+	ForwardDNS          bool
+	Packet              []byte
+}
+
+// ReadUdpgwMessage reads the next udpgw message, skipping keep-alive
+// messages. buffer must be at least UDPGW_MAX_MESSAGE_SIZE bytes. The
+// returned message Packet references memory in buffer.
+func ReadUdpgwMessage(
+	reader io.Reader, buffer []byte) (*UdpgwMessage, error) {
+
+	// udpgw message layout:
+	//
+	// | 2 byte size | 3 byte header | 6 or 18 byte address | variable length packet |
+
+	for {
+		// Read message
+
+		_, err := io.ReadFull(reader, buffer[0:2])
+		if err != nil {
+			if err != io.EOF {
+				err = common.ContextError(err)
+			}
+			return nil, err
+		}
+
+		size := binary.LittleEndian.Uint16(buffer[0:2])
+
+		if size < 3 || int(size) > len(buffer)-2 {
+			return nil, common.ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		_, err = io.ReadFull(reader, buffer[2:2+size])
+		if err != nil {
+			if err != io.EOF {
+				err = common.ContextError(err)
+			}
+			return nil, err
+		}
+
+		flags := buffer[2]
+
+		connID := binary.LittleEndian.Uint16(buffer[3:5])
+
+		// Ignore udpgw keep-alive messages -- read another message
+
+		if flags&UDPGW_FLAG_KEEPALIVE == UDPGW_FLAG_KEEPALIVE {
+			continue
+		}
+
+		// Read address
+
+		var remoteIP []byte
+		var remotePort uint16
+		var packetStart, packetEnd int
+
+		if flags&UDPGW_FLAG_IPV6 == UDPGW_FLAG_IPV6 {
+
+			if size < 21 {
+				return nil, common.ContextError(errors.New("invalid udpgw message size"))
+			}
+
+			remoteIP = make([]byte, 16)
+			copy(remoteIP, buffer[5:21])
+			remotePort = binary.BigEndian.Uint16(buffer[21:23])
+			packetStart = 23
+			packetEnd = 23 + int(size) - 21
+
+		} else {
+
+			if size < 9 {
+				return nil, common.ContextError(errors.New("invalid udpgw message size"))
+			}
+
+			remoteIP = make([]byte, 4)
+			copy(remoteIP, buffer[5:9])
+			remotePort = binary.BigEndian.Uint16(buffer[9:11])
+			packetStart = 11
+			packetEnd = 11 + int(size) - 9
+		}
+
+		// Assemble message
+		// Note: UdpgwMessage.Packet references memory in the input buffer
+
+		message := &UdpgwMessage{
+			ConnID:              connID,
+			RemoteIP:            remoteIP,
+			RemotePort:          remotePort,
+			DiscardExistingConn: flags&UDPGW_FLAG_REBIND == UDPGW_FLAG_REBIND,
+			ForwardDNS:          flags&UDPGW_FLAG_DNS == UDPGW_FLAG_DNS,
+			Packet:              buffer[packetStart:packetEnd],
+		}
+
+		return message, nil
+	}
+}
+
+// WriteUdpgwPreamble writes the preamble for a udpgw message with a packet
+// of packetSize bytes into the start of buffer. preambleSize must be
+// 7 + len(remoteIP).
+func WriteUdpgwPreamble(
+	preambleSize int,
+	flags uint8,
+	connID uint16,
+	remoteIP []byte,
+	remotePort uint16,
+	packetSize uint16,
+	buffer []byte) error {
+
+	if preambleSize != 7+len(remoteIP) {
+		return common.ContextError(errors.New("invalid udpgw preamble size"))
+	}
+
+	size := uint16(preambleSize-2) + packetSize
+
+	// size
+	binary.LittleEndian.PutUint16(buffer[0:2], size)
+
+	// flags
+	buffer[2] = flags
+
+	// connID
+	binary.LittleEndian.PutUint16(buffer[3:5], connID)
+
+	// addr
+	copy(buffer[5:5+len(remoteIP)], remoteIP)
+	binary.BigEndian.PutUint16(buffer[5+len(remoteIP):7+len(remoteIP)], remotePort)
+
+	return nil
+}
+
+// RelayUdpgw terminates a udpgw protocol connection, as made by tun2socks
+// to its udpgw server address, and relays each udpgw connection's datagrams
+// as a UDP channel flow using client. This replaces relaying the udpgw
+// protocol over a TCP port forward to the server's udpgw.
+//
+// RelayUdpgw returns when udpgwConn or client fails or is closed. Both
+// udpgwConn and client are closed on return.
+func RelayUdpgw(udpgwConn io.ReadWriteCloser, client *Client) {
+
+	writeMutex := new(sync.Mutex)
+	relayWaitGroup := new(sync.WaitGroup)
+
+	// flows is accessed only by this goroutine.
+	flows := make(map[uint16]*Flow)
+
+	buffer := make([]byte, UDPGW_MAX_MESSAGE_SIZE)
+	for {
+		// Note: message.Packet points to the reusable memory in "buffer".
+		message, err := ReadUdpgwMessage(udpgwConn, buffer)
+		if err != nil {
+			break
+		}
+
+		flow := flows[message.ConnID]
+
+		// A flow closed by the server, for example after an idle timeout, is
+		// replaced by a new flow.
+
+		if flow != nil && (message.DiscardExistingConn || flow.isClosed()) {
+			flow.Close()
+			flow = nil
+		}
+
+		if flow == nil {
+
+			remoteAddr := &net.UDPAddr{
+				IP:   message.RemoteIP,
+				Port: int(message.RemotePort),
+			}
+
+			flow, err = client.Dial(remoteAddr, message.ForwardDNS)
+			if err != nil {
+				break
+			}
+
+			flows[message.ConnID] = flow
+
+			relayWaitGroup.Add(1)
+			go func(connID uint16, flow *Flow, remoteAddr *net.UDPAddr) {
+				defer relayWaitGroup.Done()
+				relayUdpgwDownstream(udpgwConn, writeMutex, connID, flow, remoteAddr)
+			}(message.ConnID, flow, remoteAddr)
+		}
+
+		// As with UDP, a datagram that can't be sent is dropped.
+		_, _ = flow.Write(message.Packet)
+	}
+
+	for _, flow := range flows {
+		flow.Close()
+	}
+	client.Close()
+	udpgwConn.Close()
+
+	relayWaitGroup.Wait()
+}
+
+func relayUdpgwDownstream(
+	udpgwConn io.Writer,
+	writeMutex *sync.Mutex,
+	connID uint16,
+	flow *Flow,
+	remoteAddr *net.UDPAddr) {
+
+	remoteIP := []byte(remoteAddr.IP)
+	flags := uint8(0)
+	if len(remoteIP) == net.IPv6len {
+		flags = UDPGW_FLAG_IPV6
+	}
+
+	preambleSize := 7 + len(remoteIP)
+	buffer := make([]byte, preambleSize+UDPGW_MAX_PAYLOAD_SIZE)
+
+	for {
+		packetSize, err := flow.Read(buffer[preambleSize:])
+		if err != nil {
+			return
+		}
+
+		err = WriteUdpgwPreamble(
+			preambleSize,
+			flags,
+			connID,
+			remoteIP,
+			uint16(remoteAddr.Port),
+			uint16(packetSize),
+			buffer)
+		if err != nil {
+			return
+		}
+
+		writeMutex.Lock()
+		_, err = udpgwConn.Write(buffer[:preambleSize+packetSize])
+		writeMutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
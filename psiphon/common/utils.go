@@ -256,6 +256,25 @@ func JitterDuration(
 	return time.Duration(Jitter(int64(d), factor))
 }
 
+// BackoffDuration returns an exponential backoff period: base multiplied by
+// multiplier once for each previous attempt, capped at max. attempt is 0 for
+// the first attempt, which returns base. When max < base, base is returned.
+func BackoffDuration(
+	base time.Duration, multiplier float64, max time.Duration, attempt int) time.Duration {
+
+	d := float64(base)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if d < float64(base) {
+		d = float64(base)
+	}
+	return time.Duration(d)
+}
+
 // GetCurrentTimestamp returns the current time in UTC as
 // an RFC 3339 formatted string.
 func GetCurrentTimestamp() string {
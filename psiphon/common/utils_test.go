@@ -181,6 +181,35 @@ func TestJitter(t *testing.T) {
 	}
 }
 
+func TestBackoffDuration(t *testing.T) {
+
+	testCases := []struct {
+		base       time.Duration
+		multiplier float64
+		max        time.Duration
+		attempt    int
+		expected   time.Duration
+	}{
+		{1 * time.Second, 2.0, 1 * time.Minute, 0, 1 * time.Second},
+		{1 * time.Second, 2.0, 1 * time.Minute, 1, 2 * time.Second},
+		{1 * time.Second, 2.0, 1 * time.Minute, 3, 8 * time.Second},
+		{1 * time.Second, 2.0, 1 * time.Minute, 10, 1 * time.Minute},
+		{1 * time.Second, 2.0, 1 * time.Minute, 1000000, 1 * time.Minute},
+		{1 * time.Second, 1.0, 1 * time.Minute, 10, 1 * time.Second},
+		{5 * time.Second, 2.0, 1 * time.Second, 2, 5 * time.Second},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("backoff case: %+v", testCase), func(t *testing.T) {
+			d := BackoffDuration(
+				testCase.base, testCase.multiplier, testCase.max, testCase.attempt)
+			if d != testCase.expected {
+				t.Errorf("unexpected backoff duration: %s", d)
+			}
+		})
+	}
+}
+
 func TestCompress(t *testing.T) {
 
 	originalData := []byte("test data")
@@ -24,16 +24,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"unicode"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/inproxy"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/netem"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 )
 
 const (
@@ -54,10 +60,19 @@ type Config struct {
 	//
 	// Warning: If the datastore file, DataStoreDirectory/DATA_STORE_FILENAME,
 	// exists but fails to open for any reason (checksum error, unexpected
-	// file format, etc.) it will be deleted in order to pave a new datastore
-	// and continue running.
+	// file format, etc.) it will be replaced with a new datastore, into which
+	// any readable server entries are salvaged, in order to continue running.
 	DataStoreDirectory string
 
+	// EphemeralDataStore specifies that the datastore is kept entirely in
+	// memory and is discarded when closed. Server entries must be supplied
+	// on each run, for example by importing embedded server entries after
+	// OpenDataStore. Features which write files, including the notice
+	// history, client upgrade downloads, and remote server list fetches,
+	// may not be used with EphemeralDataStore. Notice files set with
+	// SetNoticeFiles are not affected.
+	EphemeralDataStore bool
+
 	// PropagationChannelId is a string identifier which indicates how the
 	// Psiphon client was distributed. This parameter is required. This value
 	// is supplied by and depends on the Psiphon Network, and is typically
@@ -93,7 +108,8 @@ type Config struct {
 
 	// EgressRegion is a ISO 3166-1 alpha-2 country code which indicates which
 	// country to egress from. For the default, "", the best performing server
-	// in any country is selected.
+	// in any country is selected. EgressRegion may be changed after the
+	// controller is started; see Controller.SetEgressRegion.
 	EgressRegion string
 
 	// ListenInterface specifies which interface to listen on.  If no
@@ -110,14 +126,53 @@ type Config struct {
 	// free port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// LocalSocksProxyResolution specifies where hostnames in SOCKS CONNECT
+	// requests are resolved: "remote", the default, resolves at the tunnel
+	// egress; "local" resolves on the client, using the untunneled resolver,
+	// before dialing the resulting IP address through the tunnel. Local
+	// resolution reveals destination hostnames to the local network. A SOCKS
+	// client may override this per request with a "resolve=local" or
+	// "resolve=remote" SOCKS username argument.
+	LocalSocksProxyResolution string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a
 	// free port (a notice reporting the selected port is emitted).
 	LocalHttpProxyPort int
 
+	// LocalSocksProxyListener and LocalHttpProxyListener, when set, are
+	// pre-bound TCP listeners for the local SOCKS and HTTP proxies, such as
+	// listeners received through socket activation; see
+	// GetActivatedListeners. When a listener is set, ListenInterface and the
+	// corresponding port parameter are ignored.
+	//
+	// The controller doesn't take ownership of these listeners: each run
+	// accepts on a duplicate, so the same listeners may be used by successive
+	// controllers. The caller is responsible for closing them.
+	LocalSocksProxyListener net.Listener
+	LocalHttpProxyListener  net.Listener
+
 	// DisableLocalHTTPProxy disables running the local HTTP proxy.
 	DisableLocalHTTPProxy bool
 
+	// LocalHttpProxySNIRules, when set, also applies the port forward policy,
+	// for HTTP proxy CONNECT requests, to the SNI host in the client's TLS
+	// ClientHello, and applies split tunnel rules to the SNI host instead of
+	// the CONNECT target host. The ClientHello is inspected but not decrypted
+	// or modified, and the port forward is always made to the CONNECT
+	// target. To read the ClientHello, the CONNECT request is accepted
+	// before the port forward is dialed, so dial failures and policy denials
+	// close the connection instead of returning an HTTP error response.
+	LocalHttpProxySNIRules bool
+
+	// LocalHttpProxyCacheMaxSize, when > 0, enables a bounded, on-disk cache
+	// of responses relayed by the local HTTP proxy, stored in
+	// DataStoreDirectory. The value is the maximum size, in bytes, of cached
+	// response bodies. Only cacheable responses, according to HTTP caching
+	// semantics, to plaintext HTTP GET requests are cached. The cache is
+	// disabled by default.
+	LocalHttpProxyCacheMaxSize int64
+
 	// NetworkLatencyMultiplier is a multiplier that is to be applied to
 	// default network event timeouts. Set this to tune performance for
 	// slow networks.
@@ -135,8 +190,8 @@ type Config struct {
 	// include:
 	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "UNFRONTED-MEEK-HTTPS-OSSH",
 	// "UNFRONTED-MEEK-SESSION-TICKET-OSSH", "FRONTED-MEEK-OSSH",
-	// "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH", "MARIONETTE-OSSH", and
-	// "TAPDANCE-OSSH".
+	// "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH", "MARIONETTE-OSSH",
+	// "TAPDANCE-OSSH", and "INPROXY-WEBRTC-OSSH".
 	// For the default, an empty list, all protocols are used.
 	LimitTunnelProtocols []string
 
@@ -175,7 +230,10 @@ type Config struct {
 	// to establish tunnels. Briefly pausing allows for network conditions to
 	// improve and for asynchronous operations such as fetch remote server
 	// list to complete. If omitted, a default value is used. This value is
-	// typical overridden for testing.
+	// typical overridden for testing. This is the initial pause period;
+	// subsequent pauses back off as configured by the
+	// EstablishTunnelPausePeriodMultiplier and EstablishTunnelPausePeriodMax
+	// parameters.
 	EstablishTunnelPausePeriodSeconds *int
 
 	// ConnectionWorkerPoolSize specifies how many connection attempts to
@@ -188,6 +246,37 @@ type Config struct {
 	// the default is TUNNEL_POOL_SIZE, which is recommended.
 	TunnelPoolSize int
 
+	// TunnelPoolMinSize and TunnelPoolMaxSize enable tunnel pool autoscaling
+	// when TunnelPoolMaxSize > 0. The pool starts at TunnelPoolSize and is
+	// grown or shrunk, within these bounds, based on aggregate tunneled
+	// throughput and the number of pending port forwards. If omitted or when
+	// 0, TunnelPoolMinSize is 1. Autoscaling is not supported in packet
+	// tunnel mode.
+	TunnelPoolMinSize int
+	TunnelPoolMaxSize int
+
+	// MemoryLimitBytes, when > 0, sets a soft memory limit for the Go
+	// runtime, using runtime/debug.SetMemoryLimit, and relaxes the GC
+	// percent used after explicit garbage collections to
+	// MemoryLimitGCPercent, or 100 when omitted or 0. The limit applies to
+	// the whole process, including any Go code in the host application, and
+	// the previous settings are restored when the controller stops. The
+	// memory limit requires Go 1.19 or later and is ignored otherwise.
+	MemoryLimitBytes     int64
+	MemoryLimitGCPercent int
+
+	// MaxConcurrentPortForwards and MaxConcurrentPortForwardsPerHost limit
+	// the number of concurrent tunneled port forwards, in total and to any
+	// one destination host. When a limit is reached, PortForwardLimitPolicy
+	// determines whether new port forwards wait, for up to
+	// PortForwardQueueTimeoutMilliseconds, for an open port forward to
+	// close ("queue", the default) or fail immediately ("reject"). Limits
+	// are disabled when omitted or 0.
+	MaxConcurrentPortForwards           int
+	MaxConcurrentPortForwardsPerHost    int
+	PortForwardLimitPolicy              string
+	PortForwardQueueTimeoutMilliseconds *int
+
 	// StaggerConnectionWorkersMilliseconds adds a specified delay before
 	// making each server candidate available to connection workers. This
 	// option is enabled when StaggerConnectionWorkersMilliseconds > 0.
@@ -199,6 +288,12 @@ type Config struct {
 	// > 0.
 	LimitIntensiveConnectionWorkers int
 
+	// EstablishTunnelBytesPerSecond caps the aggregate rate of connection
+	// traffic, up to the completion of the SSH handshake, across all
+	// concurrent connection workers. This option is enabled when
+	// EstablishTunnelBytesPerSecond > 0.
+	EstablishTunnelBytesPerSecond int
+
 	// LimitMeekBufferSizes selects smaller buffers for meek protocols.
 	LimitMeekBufferSizes bool
 
@@ -211,6 +306,25 @@ type Config struct {
 	// https://github.com/Psiphon-Labs/psiphon-tunnel-core/tree/master/psiphon/upstreamproxy
 	UpstreamProxyURL string
 
+	// UpstreamProxyChainURLs specifies additional upstream proxies to chain
+	// after UpstreamProxyURL. Each proxy is reached through the previous
+	// proxy, and the last proxy in the chain connects to the destination.
+	// For example, a corporate "http" or "https" proxy followed by a
+	// "socks5" proxy. UpstreamProxyChainURLs requires UpstreamProxyURL.
+	UpstreamProxyChainURLs []string
+
+	// V2RayOutboundProxyURL is the URL of the "socks" or "http" inbound of a
+	// locally running V2Ray or Xray instance, for example
+	// "socks5://127.0.0.1:10808". When set, tunnel connections are dialed
+	// through the instance's outbound, such as VLESS or VMess, before the
+	// Psiphon handshake. V2RayOutboundProxyURL may not be combined with
+	// UpstreamProxyURL. See the V2Ray outbound adapter doc.
+	V2RayOutboundProxyURL string
+
+	// V2RayOutboundProtocol is the protocol of the V2Ray outbound, "vless"
+	// or "vmess", used for diagnostics. V2RayOutboundProtocol is optional.
+	V2RayOutboundProtocol string
+
 	// CustomHeaders is a set of additional arbitrary HTTP headers that are
 	// added to all plaintext HTTP requests and requests made through an HTTP
 	// upstream proxy when specified by UpstreamProxyURL.
@@ -227,6 +341,14 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	NetworkConnectivityChecker NetworkConnectivityChecker
 
+	// EstablishmentStrategy is an interface that enables the host
+	// application to customize the order in which candidate servers are
+	// tried and the tunnel protocol selected for each. See:
+	// EstablishmentStrategy doc. When nil, the default strategy is used.
+	//
+	// This parameter is only applicable to library deployments.
+	EstablishmentStrategy EstablishmentStrategy
+
 	// DeviceBinder is an interface that enables tunnel-core to call into the
 	// host application to bind sockets to specific devices. See: DeviceBinder
 	// doc.
@@ -255,15 +377,63 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	NetworkIDGetter NetworkIDGetter
 
+	// NetworkMetadataGetter is an interface that enables tunnel-core to call
+	// into the host application to get coarse metadata, such as the MCC/MNC
+	// and ASN, for the host's current active network. See:
+	// NetworkMetadataGetter doc.
+	//
+	// This parameter is only applicable to library deployments.
+	NetworkMetadataGetter NetworkMetadataGetter
+
+	// HostNetworkProvider is an interface that enables tunnel-core to call
+	// into the host network stack to bind sockets, get DNS servers, and get
+	// a network ID for the current active network. See: HostNetworkProvider
+	// doc. HostNetworkProvider replaces, and may not be combined with,
+	// DeviceBinder, DnsServerGetter, and NetworkIDGetter.
+	//
+	// This parameter is only applicable to library deployments.
+	HostNetworkProvider HostNetworkProvider
+
+	// InproxyWebRTCProvider is an interface that enables tunnel-core to call
+	// into the host WebRTC stack to create peer connections for the
+	// INPROXY-WEBRTC-OSSH tunnel protocol. See: inproxy.WebRTCProvider doc.
+	// When InproxyWebRTCProvider is not set, INPROXY-WEBRTC-OSSH is not
+	// used.
+	//
+	// This parameter is only applicable to library deployments.
+	InproxyWebRTCProvider inproxy.WebRTCProvider
+
 	// NetworkID, when not blank, is used as the identifier for the host's
 	// current active network.
-	// NetworkID is ignored when NetworkIDGetter is set.
+	// NetworkID is ignored when NetworkIDGetter or HostNetworkProvider is
+	// set.
 	NetworkID string
 
+	// NetworkEmulator, when set, applies emulated network conditions to all
+	// TCP connections dialed by the client, including tunnel, meek, and
+	// untunneled connections. See: netem.Emulator doc.
+	//
+	// This parameter is only applicable to tests.
+	NetworkEmulator *netem.Emulator
+
+	// Clock, when set, replaces the system clock for controller timers,
+	// including establishment pause and stagger periods, remote server list
+	// and upgrade retry periods, and the tactics wait period. Tests may set
+	// a common.SimulatedClock to verify long-running backoff behavior.
+	//
+	// This parameter is only applicable to tests.
+	Clock common.Clock
+
 	// DisableTactics disables tactics operations including requests, payload
 	// handling, and application of parameters.
 	DisableTactics bool
 
+	// TacticsVerificationKeyRing, when set and not empty, specifies the
+	// verification keys for signed tactics payloads. Tactics payloads that
+	// are unsigned or not signed with a valid key in the ring are rejected.
+	// See: tactics.VerificationKeyRing.
+	TacticsVerificationKeyRing *tactics.VerificationKeyRing
+
 	// TransformHostNames specifies whether to use hostname transformation
 	// circumvention strategies. Set to "always" to always transform, "never"
 	// to never transform, and "", the default, for the default transformation
@@ -275,6 +445,15 @@ type Config struct {
 	// ignored.
 	TargetServerEntry string
 
+	// PinnedServerEntries and ExcludedServerEntries are server entry IP
+	// addresses which are, respectively, always tried first and never
+	// dialed. See ServerEntryPolicy. When either field is set, the policy is
+	// stored in the datastore by NewController, replacing any policy set in
+	// a previous session with Controller.SetServerEntryPolicy; otherwise,
+	// the stored policy remains in effect.
+	PinnedServerEntries   []string
+	ExcludedServerEntries []string
+
 	// DisableApi disables Psiphon server API calls including handshake,
 	// connected, status, etc. This is used for special case temporary tunnels
 	// (Windows VPN mode).
@@ -307,6 +486,14 @@ type Config struct {
 	// DownloadURL must have OnlyAfterAttempts = 0.
 	RemoteServerListURLs parameters.DownloadURLs
 
+	// RemoteServerListDeltaURLs is a list of URLs which specify locations to
+	// fetch remote server list deltas. When set, and when a previous remote
+	// server list download has been stored, the client first attempts to
+	// fetch only the server entries that are new or changed since that
+	// download, falling back to a full download on failure. See
+	// FetchCommonRemoteServerList for the delta resource naming scheme.
+	RemoteServerListDeltaURLs parameters.DownloadURLs
+
 	// RemoteServerListDownloadFilename specifies a target filename for
 	// storing the remote server list download. Data is stored in co-located
 	// files (RemoteServerListDownloadFilename.part*) to allow for resumable
@@ -319,6 +506,11 @@ type Config struct {
 	// client binary.
 	RemoteServerListSignaturePublicKey string
 
+	// ShareCodeSignaturePublicKey specifies a base64 encoded Ed25519 public
+	// key that's used to authenticate server entry share codes. See
+	// DecodeShareCode.
+	ShareCodeSignaturePublicKey string
+
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
@@ -351,6 +543,18 @@ type Config struct {
 	// downloading.
 	ObfuscatedServerListDownloadDirectory string
 
+	// StegoServerListURLs is a list of URLs which specify locations of
+	// server lists embedded in innocuous looking content, such as images and
+	// social media posts. Stego server lists are a last resort bootstrap
+	// mechanism, fetched only after several establishment rounds have failed.
+	// See FetchStegoServerLists. All URLs must point to the same entity with
+	// the same ETag. At least one DownloadURL must have OnlyAfterAttempts = 0.
+	StegoServerListURLs parameters.DownloadURLs
+
+	// StegoServerListDownloadFilename specifies a target filename for
+	// storing the stego server list download.
+	StegoServerListDownloadFilename string
+
 	// SplitTunnelRoutesURLFormat is a URL which specifies the location of a
 	// routes file to use for split tunnel mode. The URL must include a
 	// placeholder for the client region to be supplied. Split tunnel mode
@@ -372,6 +576,34 @@ type Config struct {
 	// server must support TCP requests.
 	SplitTunnelDNSServer string
 
+	// SplitTunnelGeoIPDatabaseFilename specifies a MaxMind format GeoIP
+	// country database used to classify port forward destinations by country
+	// on the client, independent of the server-supplied routes data. The
+	// host application may update the file; it's reloaded, when changed,
+	// each time a tunnel is established. GeoIP classification requires
+	// SplitTunnelDNSServer and SplitTunnelUntunneledCountries.
+	SplitTunnelGeoIPDatabaseFilename string
+
+	// SplitTunnelUntunneledCountries is a list of ISO 3166-1 alpha-2 country
+	// codes. When SplitTunnelGeoIPDatabaseFilename is set, destinations in
+	// these countries are not tunneled.
+	SplitTunnelUntunneledCountries []string
+
+	// SplitTunnelTunneledCountries is a list of ISO 3166-1 alpha-2 country
+	// codes. When SplitTunnelGeoIPDatabaseFilename is set, destinations in
+	// these countries are always tunneled, even when the routes data
+	// classifies them as untunneled.
+	SplitTunnelTunneledCountries []string
+
+	// SplitTunnelUntunneledDomains and SplitTunnelTunneledDomains are domain
+	// rules, applied by the local proxies, which route matching destination
+	// hostnames directly or through the tunnel. See SplitTunnelRules for the
+	// rule format. Domain rules don't require any other split tunnel
+	// configuration and may be replaced at runtime with
+	// Controller.SetSplitTunnelRules.
+	SplitTunnelUntunneledDomains []string
+	SplitTunnelTunneledDomains   []string
+
 	// UpgradeDownloadUrl specifies a URL from which to download a host client
 	// upgrade file, when one is available. The core tunnel controller
 	// provides a resumable download facility which downloads this resource
@@ -406,11 +638,36 @@ type Config struct {
 	// (UpgradeDownloadFilename.part*) to allow for resumable downloading.
 	UpgradeDownloadFilename string
 
+	// UpgradeDownloadSignaturePublicKey, when set, specifies a public key
+	// used to authenticate a signed manifest, located at the upgrade download
+	// URL with ".manifest" appended to its path, which lists digests used to
+	// verify the upgrade download as each chunk is received.
+	UpgradeDownloadSignaturePublicKey string
+
+	// UpgradeDownloadPatchBaseFilename is the currently installed client
+	// package or binary. When set along with UpgradeDownloadSignaturePublicKey,
+	// and the upgrade manifest lists a binary patch for this base file, the
+	// smaller patch is downloaded and applied in place of the full upgrade.
+	UpgradeDownloadPatchBaseFilename string
+
 	// FetchUpgradeRetryPeriodMilliseconds specifies the delay before resuming
 	// a client upgrade download after a failure. If omitted, a default value
 	// is used. This value is typical overridden for testing.
 	FetchUpgradeRetryPeriodMilliseconds *int
 
+	// FeedbackUploadURLs is a list of URLs which specify locations to which
+	// Controller.SendFeedback uploads encrypted feedback packages. A unique
+	// upload ID is appended to the selected URL. URLs with OnlyAfterAttempts
+	// > 0, such as fronted endpoints, are used only after initial upload
+	// attempts fail. At least one DownloadURL must have OnlyAfterAttempts =
+	// 0. This value is supplied by and depends on the Psiphon Network.
+	FeedbackUploadURLs parameters.DownloadURLs
+
+	// FeedbackEncryptionPublicKey is a base64-encoded, RSA public key value
+	// used to encrypt feedback packages. FeedbackEncryptionPublicKey is
+	// required when FeedbackUploadURLs is specified.
+	FeedbackEncryptionPublicKey string
+
 	// EmitBytesTransferred indicates whether to emit periodic notices showing
 	// bytes sent and received.
 	EmitBytesTransferred bool
@@ -429,6 +686,48 @@ type Config struct {
 	// out, the tunnel is considered to have failed.
 	DisablePeriodicSshKeepAlive bool
 
+	// DormancyIdlePeriodSeconds specifies a period of no tunneled traffic
+	// after which an active tunnel enters dormancy mode. While dormant, the
+	// tunnel sends SSH keep alives at a reduced cadence and releases idle
+	// meek buffers. Dormancy ends, and full operation resumes, as soon as
+	// any tunneled traffic is transferred. If omitted or 0, dormancy mode is
+	// off.
+	DormancyIdlePeriodSeconds *int
+
+	// TunnelLivenessProbePeriodSeconds enables the tunnel liveness watchdog,
+	// which probes each active tunnel at the specified period and replaces
+	// tunnels whose probes fail repeatedly. If omitted or 0, the watchdog is
+	// disabled.
+	TunnelLivenessProbePeriodSeconds *int
+
+	// TunnelLivenessProbeAddress is an optional host:port which liveness
+	// probes attempt to reach with a TCP port forward through the tunnel.
+	// When omitted, liveness probes are SSH requests, which test only the
+	// tunnel to the server.
+	TunnelLivenessProbeAddress string
+
+	// FastReconnectMaxAgeSeconds enables fast reconnect: the server and
+	// tunnel protocol of the last successful tunnel on the current network
+	// are tried first, with a short timeout, when establishing. Records
+	// older than the specified age are considered stale and are ignored. If
+	// omitted or 0, fast reconnect is disabled.
+	FastReconnectMaxAgeSeconds *int
+
+	// DialReplayProtocolTTLSeconds specifies, per tunnel protocol, the
+	// maximum age of fast reconnect records, overriding
+	// FastReconnectMaxAgeSeconds. A fast reconnect replays the server, tunnel
+	// protocol, and selected dial parameters, such as the meek fronting
+	// address, TLS profile, and User-Agent, of the last successful tunnel. A
+	// TTL of 0 disables replay for the protocol. Replay may be enabled for
+	// only the specified protocols by omitting FastReconnectMaxAgeSeconds.
+	DialReplayProtocolTTLSeconds map[string]int
+
+	// AdaptiveProtocolSelection enables adaptive tunnel protocol selection:
+	// per-protocol success rates, dial latencies, and throughput are
+	// recorded for each network, and establishment selects tunnel protocols
+	// weighted by these scores instead of uniformly at random.
+	AdaptiveProtocolSelection bool
+
 	// DeviceRegion is the optional, reported region the host device is
 	// running in. This input value should be a ISO 3166-1 alpha-2 country
 	// code. The device region is reported to the server in the connected
@@ -445,6 +744,37 @@ type Config struct {
 	// distributed or displayed to users. Default is off.
 	EmitDiagnosticNotices bool
 
+	// NoticeRedactionPolicy specifies a redaction policy applied to all
+	// notices, including diagnostic notices: "none", the default,
+	// "standard", or "strict". See SetNoticeRedactionPolicy for details.
+	NoticeRedactionPolicy string
+
+	// NoticeHistoryMaxSize, when > 0, enables a bounded, on-disk history of
+	// recent notices, stored in DataStoreDirectory, which persists across
+	// restarts and may be queried with Controller.QueryNotices. The value is
+	// the maximum size, in bytes, of the history files.
+	NoticeHistoryMaxSize int
+
+	// LogFilename, when not blank, enables a structured JSON log with
+	// leveled severities, distinct from notices. LogLevel is one of "debug",
+	// "info", "warn", or "error", and defaults to "info". LogComponentLevels
+	// optionally overrides LogLevel for specific components, such as
+	// {"meekConn": "debug"}. See SetLogFile.
+	LogFilename        string
+	LogLevel           string
+	LogComponentLevels map[string]string
+
+	// StatusFilename, when not blank, enables a machine-readable JSON status
+	// file, for integration with router UIs and monitoring agents which
+	// don't consume notices. The file is rewritten, atomically, every
+	// StatusFileUpdatePeriodSeconds while the controller is running, and
+	// once more when the controller stops. See StatusFileRecord.
+	StatusFilename string
+
+	// StatusFileUpdatePeriodSeconds specifies how often the status file is
+	// rewritten. If omitted, a default value is used.
+	StatusFileUpdatePeriodSeconds *int
+
 	// RateLimits specify throttling configuration for the tunnel.
 	RateLimits common.RateLimits
 
@@ -453,6 +783,25 @@ type Config struct {
 	// and testing only.
 	EmitSLOKs bool
 
+	// EmitFirstFlightFingerprints indicates whether to emit notices
+	// describing the lengths, timing, and entropy of the bytes sent by each
+	// TCP tunnel connection before the server's first response. This audit
+	// mode is intended for verifying obfuscation properties and is for
+	// research and testing only.
+	EmitFirstFlightFingerprints bool
+
+	// DialCaptureFilename specifies a file to which the client writes a PCAP
+	// capture of the TCP connections it dials for tunnels and tactics
+	// requests. This debug option is intended for diagnosing middlebox
+	// interference. By default, the capture records only the timing,
+	// direction, and length of reads and writes; DialCaptureIncludePayload
+	// adds the obfuscated bytes on the wire. DialCaptureRawPackets captures
+	// the actual network packets instead, where the platform and privileges
+	// permit; currently only on Linux with CAP_NET_RAW.
+	DialCaptureFilename       string
+	DialCaptureIncludePayload bool
+	DialCaptureRawPackets     bool
+
 	// PacketTunnelTunDeviceFileDescriptor specifies a tun device file
 	// descriptor to use for running a packet tunnel. When this value is > 0,
 	// a packet tunnel is established through the server and packets are
@@ -461,6 +810,96 @@ type Config struct {
 	// set, TunnelPoolSize must be 1.
 	PacketTunnelTunFileDescriptor int
 
+	// PacketTunnelTunDeviceName specifies a tun device to open, or create,
+	// for running a packet tunnel, as an alternative to
+	// PacketTunnelTunFileDescriptor for hosts which don't provide a tun
+	// device file descriptor. On Linux, the name may include a "%d"
+	// placeholder, e.g. "tun%d"; on macOS, the name must be in the form
+	// "utun<N>". Opening or creating a tun device requires root or
+	// CAP_NET_ADMIN privileges. When PacketTunnelTunDeviceName is set,
+	// TunnelPoolSize must be 1.
+	PacketTunnelTunDeviceName string
+
+	// PacketTunnelConfigureTunDevice specifies that the tun device opened
+	// via PacketTunnelTunDeviceName is to be configured with the
+	// PacketTunnelIPv4AddressCIDR and PacketTunnelIPv6AddressCIDR addresses,
+	// the tunnel MTU, and routes for PacketTunnelRouteDestinations. When not
+	// set, the tun device is expected to already be configured.
+	//
+	// In either case, for transparent tunneled DNS, the host or DNS clients
+	// should use the address given by
+	// tun.GetTransparentDNSResolverIPv4Address, which is within the default
+	// PacketTunnelIPv4AddressCIDR subnet.
+	PacketTunnelConfigureTunDevice bool
+
+	// PacketTunnelIPv4AddressCIDR and PacketTunnelIPv6AddressCIDR specify the
+	// addresses assigned to the tun device when PacketTunnelConfigureTunDevice
+	// is set. As the packet tunnel server performs source address rewriting,
+	// any private addresses may be used. When not set, default values are
+	// used. Failure to configure IPv6 is logged but not fatal.
+	PacketTunnelIPv4AddressCIDR string
+	PacketTunnelIPv6AddressCIDR string
+
+	// PacketTunnelRouteDestinations are IP addresses or CIDRs to route
+	// through the tun device when PacketTunnelConfigureTunDevice is set. To
+	// route all traffic, use "0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"
+	// along with PacketTunnelBypassInterfaceName, which ensures connections
+	// to Psiphon servers aren't themselves routed through the tun device.
+	PacketTunnelRouteDestinations []string
+
+	// PacketTunnelSudoNetworkConfigCommands specifies whether to use "sudo"
+	// when running the network configuration commands used to configure the
+	// tun device.
+	PacketTunnelSudoNetworkConfigCommands bool
+
+	// PacketTunnelBypassInterfaceName specifies a network interface, such as
+	// "eth0" or "en0", to which all sockets used to connect to Psiphon
+	// servers, and any other untunneled sockets, are bound, bypassing tun
+	// device routing. When set, PacketTunnelBypassDNSServers are used to
+	// resolve domains for untunneled connections. This is an alternative to,
+	// and may not be combined with, DeviceBinder.
+	PacketTunnelBypassInterfaceName string
+
+	// PacketTunnelBypassDNSServers are the DNS server IP addresses used for
+	// untunneled resolution when PacketTunnelBypassInterfaceName is set. At
+	// most two servers, a primary and secondary, are used. When not set,
+	// default public DNS servers are used.
+	PacketTunnelBypassDNSServers []string
+
+	// PacketTunnelTrackFlows enables packet tunnel flow tracking, which
+	// records the bytes transferred by each active flow. Flow stats are
+	// available via Controller.GetPacketTunnelFlowStats and are periodically
+	// emitted in FlowStats notices. As flow stats reveal user browsing
+	// activity, this is intended for local diagnostics only.
+	PacketTunnelTrackFlows bool
+
+	// FlowApplicationGetter is an interface that enables tunnel-core to call
+	// into the host application to identify the application that owns a
+	// packet tunnel flow. See: FlowApplicationGetter doc.
+	//
+	// This parameter is only applicable to library deployments.
+	FlowApplicationGetter FlowApplicationGetter
+
+	// PortForwardPolicy is an interface that enables tunnel-core to call into
+	// the host application to allow, deny, or redirect each port forward
+	// requested by the local SOCKS and HTTP proxies. The policy applies to
+	// both tunneled and split tunnel untunneled port forwards. See:
+	// PortForwardPolicy doc.
+	//
+	// This parameter is only applicable to library deployments.
+	PortForwardPolicy PortForwardPolicy
+
+	// PacketTunnelExcludedApplications is a list of applications, as
+	// identified by FlowApplicationGetter, whose packet tunnel traffic is
+	// dropped instead of tunneled. This supports per-app split tunneling on
+	// platforms where the host cannot exclude apps from the VPN itself.
+	// Setting PacketTunnelExcludedApplications enables flow tracking. The
+	// list may be changed, while running, with
+	// Controller.SetPacketTunnelExcludedApplications.
+	//
+	// PacketTunnelExcludedApplications requires FlowApplicationGetter.
+	PacketTunnelExcludedApplications []string
+
 	// SessionID specifies a client session ID to use in the Psiphon API. The
 	// session ID should be a randomly generated value that is used only for a
 	// single session, which is defined as the period between a user starting
@@ -501,12 +940,27 @@ type Config struct {
 	// calling clientParameters.Set directly will fail to add config values.
 	clientParameters *parameters.ClientParameters
 
+	// tacticsParameters and handshakeParameters are the most recently
+	// applied tactics and handshake parameter layers, retained so that each
+	// layer may be reapplied when the other changes.
+	parametersMutex     sync.Mutex
+	tacticsTag          string
+	tacticsParameters   map[string]interface{}
+	handshakeParameters map[string]interface{}
+
 	dynamicConfigMutex sync.Mutex
 	sponsorID          string
 	authorizations     []string
+	egressRegion       string
+
+	deviceBinder          DeviceBinder
+	dnsServerGetter       DnsServerGetter
+	networkIDGetter       NetworkIDGetter
+	networkMetadataGetter NetworkMetadataGetter
+	clock                 common.Clock
 
-	deviceBinder    DeviceBinder
-	networkIDGetter NetworkIDGetter
+	// dialCapture is opened by NewController when DialCaptureFilename is set.
+	dialCapture *dialCapture
 
 	committed bool
 }
@@ -541,7 +995,15 @@ func (config *Config) IsCommitted() bool {
 // not be reflected in internal data structures.
 func (config *Config) Commit() error {
 
-	// Do SetEmitDiagnosticNotices first, to ensure config file errors are emitted.
+	// Do SetNoticeRedactionPolicy and SetEmitDiagnosticNotices first, to
+	// ensure config file errors are emitted, and redacted.
+
+	if config.NoticeRedactionPolicy != "" {
+		err := SetNoticeRedactionPolicy(config.NoticeRedactionPolicy)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
 
 	if config.EmitDiagnosticNotices {
 		SetEmitDiagnosticNotices(true)
@@ -576,6 +1038,44 @@ func (config *Config) Commit() error {
 		config.DataStoreDirectory = wd
 	}
 
+	if config.EphemeralDataStore {
+		if config.NoticeHistoryMaxSize > 0 {
+			return common.ContextError(errors.New("NoticeHistoryMaxSize not supported with EphemeralDataStore"))
+		}
+		if config.LocalHttpProxyCacheMaxSize > 0 {
+			return common.ContextError(errors.New("LocalHttpProxyCacheMaxSize not supported with EphemeralDataStore"))
+		}
+		if config.UpgradeDownloadURLs != nil {
+			return common.ContextError(errors.New("UpgradeDownloadURLs not supported with EphemeralDataStore"))
+		}
+		if !config.DisableRemoteServerListFetcher &&
+			(config.RemoteServerListURLs != nil ||
+				config.ObfuscatedServerListRootURLs != nil ||
+				config.StegoServerListURLs != nil) {
+			return common.ContextError(errors.New("remote server list fetching not supported with EphemeralDataStore"))
+		}
+	}
+
+	if config.NoticeHistoryMaxSize > 0 {
+		err := SetNoticeHistoryFile(
+			filepath.Join(config.DataStoreDirectory, NOTICE_HISTORY_FILENAME),
+			config.NoticeHistoryMaxSize)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	if config.LogFilename != "" {
+		logLevel := config.LogLevel
+		if logLevel == "" {
+			logLevel = LOG_LEVEL_INFO
+		}
+		err := SetLogFile(config.LogFilename, logLevel, config.LogComponentLevels)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
 	if config.ClientVersion == "" {
 		config.ClientVersion = "0"
 	}
@@ -584,6 +1084,22 @@ func (config *Config) Commit() error {
 		config.TunnelPoolSize = TUNNEL_POOL_SIZE
 	}
 
+	if config.TunnelPoolMaxSize > 0 {
+		if config.TunnelPoolMinSize == 0 {
+			config.TunnelPoolMinSize = 1
+		}
+		if config.TunnelPoolMinSize > config.TunnelPoolMaxSize {
+			return common.ContextError(
+				errors.New("TunnelPoolMinSize must not exceed TunnelPoolMaxSize"))
+		}
+		if config.TunnelPoolSize < config.TunnelPoolMinSize {
+			config.TunnelPoolSize = config.TunnelPoolMinSize
+		}
+		if config.TunnelPoolSize > config.TunnelPoolMaxSize {
+			config.TunnelPoolSize = config.TunnelPoolMaxSize
+		}
+	}
+
 	// Validate config fields.
 
 	if config.PropagationChannelId == "" {
@@ -629,6 +1145,15 @@ func (config *Config) Commit() error {
 			}
 		}
 
+		if config.StegoServerListURLs != nil {
+			if config.RemoteServerListSignaturePublicKey == "" {
+				return common.ContextError(errors.New("missing RemoteServerListSignaturePublicKey"))
+			}
+			if config.StegoServerListDownloadFilename == "" {
+				return common.ContextError(errors.New("missing StegoServerListDownloadFilename"))
+			}
+		}
+
 	}
 
 	if config.SplitTunnelRoutesURLFormat != "" {
@@ -640,6 +1165,33 @@ func (config *Config) Commit() error {
 		}
 	}
 
+	if config.SplitTunnelGeoIPDatabaseFilename != "" {
+		if config.SplitTunnelDNSServer == "" {
+			return common.ContextError(errors.New("missing SplitTunnelDNSServer"))
+		}
+		if len(config.SplitTunnelUntunneledCountries) == 0 {
+			return common.ContextError(errors.New("missing SplitTunnelUntunneledCountries"))
+		}
+	}
+
+	splitTunnelRules := &SplitTunnelRules{
+		UntunneledDomains: config.SplitTunnelUntunneledDomains,
+		TunneledDomains:   config.SplitTunnelTunneledDomains,
+	}
+	err = splitTunnelRules.Validate()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	serverEntryPolicy := &ServerEntryPolicy{
+		PinnedServerEntries:   config.PinnedServerEntries,
+		ExcludedServerEntries: config.ExcludedServerEntries,
+	}
+	err = serverEntryPolicy.Validate()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
 	if config.UpgradeDownloadURLs != nil {
 		if config.UpgradeDownloadClientVersionHeader == "" {
 			return common.ContextError(errors.New("missing UpgradeDownloadClientVersionHeader"))
@@ -647,14 +1199,109 @@ func (config *Config) Commit() error {
 		if config.UpgradeDownloadFilename == "" {
 			return common.ContextError(errors.New("missing UpgradeDownloadFilename"))
 		}
+		if config.UpgradeDownloadPatchBaseFilename != "" &&
+			config.UpgradeDownloadSignaturePublicKey == "" {
+			return common.ContextError(errors.New("missing UpgradeDownloadSignaturePublicKey"))
+		}
+	}
+
+	if config.FeedbackUploadURLs != nil && config.FeedbackEncryptionPublicKey == "" {
+		return common.ContextError(errors.New("missing FeedbackEncryptionPublicKey"))
+	}
+
+	switch config.LocalSocksProxyResolution {
+	case "", SOCKS_RESOLUTION_REMOTE, SOCKS_RESOLUTION_LOCAL:
+	default:
+		return common.ContextError(
+			fmt.Errorf("invalid LocalSocksProxyResolution: %s", config.LocalSocksProxyResolution))
+	}
+
+	if len(config.UpstreamProxyChainURLs) > 0 && config.UpstreamProxyURL == "" {
+		return common.ContextError(errors.New("missing UpstreamProxyURL"))
+	}
+
+	err = config.validateV2RayOutbound()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if config.PacketTunnelTunFileDescriptor > 0 && config.PacketTunnelTunDeviceName != "" {
+		return common.ContextError(
+			errors.New("PacketTunnelTunFileDescriptor and PacketTunnelTunDeviceName are mutually exclusive"))
+	}
+
+	if config.PacketTunnelTunDeviceName != "" && !tun.IsSupported() {
+		return common.ContextError(errors.New("packet tunnel tun device not supported on this platform"))
+	}
+
+	if config.PacketTunnelConfigureTunDevice && config.PacketTunnelTunDeviceName == "" {
+		return common.ContextError(errors.New("missing PacketTunnelTunDeviceName"))
+	}
+
+	if config.HostNetworkProvider != nil {
+		if config.DeviceBinder != nil ||
+			config.DnsServerGetter != nil ||
+			config.NetworkIDGetter != nil {
+			return common.ContextError(
+				errors.New("HostNetworkProvider and DeviceBinder, DnsServerGetter, NetworkIDGetter are mutually exclusive"))
+		}
+	}
+
+	if config.PacketTunnelBypassInterfaceName != "" {
+		if config.DeviceBinder != nil || config.HostNetworkProvider != nil {
+			return common.ContextError(
+				errors.New("PacketTunnelBypassInterfaceName and DeviceBinder, HostNetworkProvider are mutually exclusive"))
+		}
+		for _, DNSServer := range config.PacketTunnelBypassDNSServers {
+			if net.ParseIP(DNSServer) == nil {
+				return common.ContextError(fmt.Errorf("invalid PacketTunnelBypassDNSServers: %s", DNSServer))
+			}
+		}
 	}
 
 	// This constraint is expected by logic in Controller.runTunnels().
 
-	if config.PacketTunnelTunFileDescriptor > 0 && config.TunnelPoolSize != 1 {
+	if len(config.PacketTunnelExcludedApplications) > 0 && config.FlowApplicationGetter == nil {
+		return common.ContextError(
+			errors.New("PacketTunnelExcludedApplications requires FlowApplicationGetter"))
+	}
+
+	if config.isPacketTunnel() && config.TunnelPoolSize != 1 {
 		return common.ContextError(errors.New("packet tunnel mode requires TunnelPoolSize to be 1"))
 	}
 
+	if config.MemoryLimitBytes < 0 || config.MemoryLimitGCPercent < 0 {
+		return common.ContextError(errors.New("invalid MemoryLimitBytes or MemoryLimitGCPercent"))
+	}
+
+	if config.PortForwardLimitPolicy == "" {
+		config.PortForwardLimitPolicy = PORT_FORWARD_LIMIT_POLICY_QUEUE
+	}
+
+	if config.PortForwardLimitPolicy != PORT_FORWARD_LIMIT_POLICY_QUEUE &&
+		config.PortForwardLimitPolicy != PORT_FORWARD_LIMIT_POLICY_REJECT {
+		return common.ContextError(
+			fmt.Errorf("invalid PortForwardLimitPolicy: %s", config.PortForwardLimitPolicy))
+	}
+
+	if config.TacticsVerificationKeyRing != nil {
+		err := tactics.ValidateVerificationKeyRing(config.TacticsVerificationKeyRing)
+		if err != nil {
+			return common.ContextError(fmt.Errorf("invalid TacticsVerificationKeyRing: %s", err))
+		}
+	}
+
+	for tunnelProtocol, TTLSeconds := range config.DialReplayProtocolTTLSeconds {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) || TTLSeconds < 0 {
+			return common.ContextError(
+				fmt.Errorf("invalid DialReplayProtocolTTLSeconds: %s", tunnelProtocol))
+		}
+	}
+
+	if config.isPacketTunnel() && config.TunnelPoolMaxSize > 0 {
+		return common.ContextError(errors.New("packet tunnel mode does not support TunnelPoolMaxSize"))
+	}
+
 	// SessionID must be PSIPHON_API_CLIENT_SESSION_ID_LENGTH lowercase hex-encoded bytes.
 
 	if config.SessionID == "" {
@@ -696,21 +1343,53 @@ func (config *Config) Commit() error {
 	// Set defaults for dynamic config fields.
 
 	config.SetDynamicConfig(config.SponsorId, config.Authorizations)
+	config.SetEgressRegion(config.EgressRegion)
 
 	// Initialize config.deviceBinder and config.config.networkIDGetter. These
-	// wrap config.DeviceBinder and config.NetworkIDGetter/NetworkID with
-	// loggers.
+	// wrap config.DeviceBinder and config.NetworkIDGetter/NetworkID, or
+	// config.HostNetworkProvider, with loggers.
 	//
 	// New variables are set to avoid mutating input config fields.
-	// Internally, code must use config.deviceBinder and
-	// config.networkIDGetter and not the input/exported fields.
+	// Internally, code must use config.deviceBinder,
+	// config.dnsServerGetter, config.networkIDGetter, and config.clock and
+	// not the input/exported fields.
 
 	if config.DeviceBinder != nil {
 		config.deviceBinder = &loggingDeviceBinder{config.DeviceBinder}
 	}
 
+	config.dnsServerGetter = config.DnsServerGetter
+
+	config.clock = config.Clock
+	if config.clock == nil {
+		config.clock = common.SystemClock
+	}
+
 	networkIDGetter := config.NetworkIDGetter
 
+	hostNetworkProvider := config.HostNetworkProvider
+
+	if config.PacketTunnelBypassInterfaceName != "" {
+
+		// The bypass network ID is the static NetworkID, and is left to
+		// the NetworkID case below.
+
+		hostNetworkProvider = newPacketTunnelBypass(
+			config.PacketTunnelBypassInterfaceName,
+			config.PacketTunnelBypassDNSServers,
+			config.NetworkID)
+
+	} else if hostNetworkProvider != nil {
+
+		networkIDGetter = newHostNetworkAdapter(hostNetworkProvider)
+	}
+
+	if hostNetworkProvider != nil && hostNetworkProvider.BindsSockets() {
+		adapter := newHostNetworkAdapter(hostNetworkProvider)
+		config.deviceBinder = &loggingDeviceBinder{adapter}
+		config.dnsServerGetter = adapter
+	}
+
 	if networkIDGetter == nil && config.NetworkID != "" {
 
 		// Enable tactics when a NetworkID is specified
@@ -726,11 +1405,35 @@ func (config *Config) Commit() error {
 		config.networkIDGetter = &loggingNetworkIDGetter{networkIDGetter}
 	}
 
+	config.networkMetadataGetter = config.NetworkMetadataGetter
+
 	config.committed = true
 
 	return nil
 }
 
+// getNetworkMetadata returns the metadata for the current network, or blank
+// metadata when no NetworkMetadataGetter is configured.
+func (config *Config) getNetworkMetadata() NetworkMetadata {
+	if config.networkMetadataGetter == nil {
+		return NetworkMetadata{}
+	}
+	return config.networkMetadataGetter.GetNetworkMetadata()
+}
+
+// getTacticsNetworkID returns the key under which tactics and speed test
+// samples are stored for the current network. When the network ASN is
+// known, the key combines the network ID and ASN. Assumes networkIDGetter
+// is set.
+func (config *Config) getTacticsNetworkID() string {
+	networkID := config.networkIDGetter.GetNetworkID()
+	ASN := config.getNetworkMetadata().ASN
+	if ASN != "" {
+		networkID = fmt.Sprintf("%s-ASN%s", networkID, ASN)
+	}
+	return networkID
+}
+
 // GetClientParameters returns a snapshot of the current client parameters.
 func (config *Config) GetClientParameters() *parameters.ClientParametersSnapshot {
 	return config.clientParameters.Get()
@@ -747,16 +1450,80 @@ func (config *Config) GetClientParameters() *parameters.ClientParametersSnapshot
 // In the case of applying tactics, do not call Config.clientParameters.Set
 // directly as this will not first apply config values.
 //
+// Any handshake parameters, applied by SetHandshakeClientParameters, are
+// reapplied on top of the input parameters.
+//
 // If there is an error, the existing Config.clientParameters are left
 // entirely unmodified.
 func (config *Config) SetClientParameters(tag string, skipOnError bool, applyParameters map[string]interface{}) error {
 
-	setParameters := []map[string]interface{}{config.makeConfigParameters()}
-	if applyParameters != nil {
-		setParameters = append(setParameters, applyParameters)
+	config.parametersMutex.Lock()
+	defer config.parametersMutex.Unlock()
+
+	err := config.setClientParameters(
+		tag, skipOnError, applyParameters, config.handshakeParameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.tacticsTag = tag
+	config.tacticsParameters = applyParameters
+
+	return nil
+}
+
+// SetHandshakeClientParameters applies client parameters pushed by the
+// server in a handshake response. Handshake parameters take precedence over
+// config and tactics parameters, and replace any previously pushed
+// handshake parameters; the most recently applied tactics are retained.
+// Unknown or invalid handshake parameter values are skipped.
+func (config *Config) SetHandshakeClientParameters(applyParameters map[string]interface{}) error {
+
+	config.parametersMutex.Lock()
+	defer config.parametersMutex.Unlock()
+
+	err := config.setClientParameters(
+		config.tacticsTag, true, config.tacticsParameters, applyParameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.handshakeParameters = applyParameters
+
+	return nil
+}
+
+func (config *Config) setClientParameters(
+	tag string,
+	skipOnError bool,
+	tacticsParameters map[string]interface{},
+	handshakeParameters map[string]interface{}) error {
+
+	// Tactics parameters take precedence over config parameters, and
+	// handshake parameters take precedence over tactics parameters. The
+	// source of each parameter value is recorded for diagnostics; see
+	// ClientParameters.Snapshot.
+
+	layers := []parameters.ParameterLayer{
+		{Source: parameters.SourceConfig, Parameters: config.makeConfigParameters()},
+	}
+	if tacticsParameters != nil {
+		layers = append(layers,
+			parameters.ParameterLayer{Source: parameters.SourceTactics, Parameters: tacticsParameters})
+	}
+	if handshakeParameters != nil {
+		layers = append(layers,
+			parameters.ParameterLayer{Source: parameters.SourceHandshake, Parameters: handshakeParameters})
+	}
+
+	// Handshake parameters are always applied with skipOnError, so that an
+	// invalid value pushed by the server doesn't cause the config or tactics
+	// parameters to be rejected.
+	if handshakeParameters != nil {
+		skipOnError = true
 	}
 
-	counts, err := config.clientParameters.Set(tag, skipOnError, setParameters...)
+	counts, err := config.clientParameters.SetLayers(tag, skipOnError, layers...)
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -801,8 +1568,25 @@ func (config *Config) GetAuthorizations() []string {
 	return config.authorizations
 }
 
+// SetEgressRegion sets the current egress region. The config EgressRegion
+// field is not modified; use GetEgressRegion to read the current value.
+func (config *Config) SetEgressRegion(region string) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.egressRegion = region
+}
+
+// GetEgressRegion returns the current egress region.
+func (config *Config) GetEgressRegion() string {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.egressRegion
+}
+
+// UseUpstreamProxy indicates whether tunnel dials use an upstream proxy,
+// including the V2Ray outbound adapter, which limits tunnel protocols.
 func (config *Config) UseUpstreamProxy() bool {
-	return config.UpstreamProxyURL != ""
+	return config.UpstreamProxyURL != "" || config.useV2RayOutbound()
 }
 
 func (config *Config) makeConfigParameters() map[string]interface{} {
@@ -859,6 +1643,10 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.LimitIntensiveConnectionWorkers] = config.LimitIntensiveConnectionWorkers
 	}
 
+	if config.EstablishTunnelBytesPerSecond > 0 {
+		applyParameters[parameters.EstablishTunnelBytesPerSecond] = config.EstablishTunnelBytesPerSecond
+	}
+
 	applyParameters[parameters.MeekLimitBufferSizes] = config.LimitMeekBufferSizes
 
 	applyParameters[parameters.IgnoreHandshakeStatsRegexps] = config.IgnoreHandshakeStatsRegexps
@@ -867,10 +1655,38 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.EstablishTunnelTimeout] = fmt.Sprintf("%ds", *config.EstablishTunnelTimeoutSeconds)
 	}
 
+	if config.DormancyIdlePeriodSeconds != nil {
+		applyParameters[parameters.DormancyIdlePeriod] = fmt.Sprintf("%ds", *config.DormancyIdlePeriodSeconds)
+	}
+
+	if config.TunnelLivenessProbePeriodSeconds != nil {
+		applyParameters[parameters.TunnelLivenessProbePeriod] = fmt.Sprintf("%ds", *config.TunnelLivenessProbePeriodSeconds)
+	}
+
+	if config.TunnelLivenessProbeAddress != "" {
+		applyParameters[parameters.TunnelLivenessProbeAddress] = config.TunnelLivenessProbeAddress
+	}
+
+	if config.AdaptiveProtocolSelection {
+		applyParameters[parameters.AdaptiveProtocolSelection] = true
+	}
+
+	if config.FastReconnectMaxAgeSeconds != nil {
+		applyParameters[parameters.FastReconnectMaxAge] = fmt.Sprintf("%ds", *config.FastReconnectMaxAgeSeconds)
+	}
+
+	if config.StatusFileUpdatePeriodSeconds != nil {
+		applyParameters[parameters.StatusFileUpdatePeriod] = fmt.Sprintf("%ds", *config.StatusFileUpdatePeriodSeconds)
+	}
+
 	if config.FetchRemoteServerListRetryPeriodMilliseconds != nil {
 		applyParameters[parameters.FetchRemoteServerListRetryPeriod] = fmt.Sprintf("%dms", *config.FetchRemoteServerListRetryPeriodMilliseconds)
 	}
 
+	if config.PortForwardQueueTimeoutMilliseconds != nil {
+		applyParameters[parameters.PortForwardQueueTimeout] = fmt.Sprintf("%dms", *config.PortForwardQueueTimeoutMilliseconds)
+	}
+
 	if config.FetchUpgradeRetryPeriodMilliseconds != nil {
 		applyParameters[parameters.FetchUpgradeRetryPeriod] = fmt.Sprintf("%dms", *config.FetchUpgradeRetryPeriodMilliseconds)
 	}
@@ -887,6 +1703,9 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		if config.RemoteServerListURLs != nil {
 			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
 			applyParameters[parameters.RemoteServerListURLs] = config.RemoteServerListURLs
+			if config.RemoteServerListDeltaURLs != nil {
+				applyParameters[parameters.RemoteServerListDeltaURLs] = config.RemoteServerListDeltaURLs
+			}
 		}
 
 		if config.ObfuscatedServerListRootURLs != nil {
@@ -894,6 +1713,11 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 			applyParameters[parameters.ObfuscatedServerListRootURLs] = config.ObfuscatedServerListRootURLs
 		}
 
+		if config.StegoServerListURLs != nil {
+			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
+			applyParameters[parameters.StegoServerListURLs] = config.StegoServerListURLs
+		}
+
 	}
 
 	applyParameters[parameters.SplitTunnelRoutesURLFormat] = config.SplitTunnelRoutesURLFormat
@@ -905,6 +1729,11 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.UpgradeDownloadURLs] = config.UpgradeDownloadURLs
 	}
 
+	if config.FeedbackUploadURLs != nil {
+		applyParameters[parameters.FeedbackEncryptionPublicKey] = config.FeedbackEncryptionPublicKey
+		applyParameters[parameters.FeedbackUploadURLs] = config.FeedbackUploadURLs
+	}
+
 	applyParameters[parameters.TunnelRateLimits] = config.RateLimits
 
 	switch config.UseFragmentor {
@@ -24,7 +24,11 @@ import (
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -187,3 +191,138 @@ func (suite *ConfigTestSuite) Test_LoadConfig_GoodJson() {
 	}
 	suite.Nil(err, "JSON with null for optional values should succeed")
 }
+
+func TestHandshakeClientParameters(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`))
+	if err == nil {
+		err = config.Commit()
+	}
+	if err != nil {
+		t.Fatalf("error loading configuration: %s", err)
+	}
+
+	checkProvenance := func(name string, value interface{}, source string) {
+		provenance := config.clientParameters.Snapshot()[name]
+		if provenance.Value != value || provenance.Source != source {
+			t.Fatalf("unexpected provenance for %s: %+v", name, provenance)
+		}
+	}
+
+	err = config.SetClientParameters("tag", true, map[string]interface{}{
+		parameters.TacticsWaitPeriod:        "2s",
+		parameters.ConnectionWorkerPoolSize: 3,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Handshake parameters take precedence over tactics, and unknown
+	// handshake parameters are skipped.
+
+	err = config.SetHandshakeClientParameters(map[string]interface{}{
+		parameters.TacticsWaitPeriod: "3s",
+		"UnknownParameter":           1,
+	})
+	if err != nil {
+		t.Fatalf("SetHandshakeClientParameters failed: %s", err)
+	}
+
+	checkProvenance(parameters.TacticsWaitPeriod, 3*time.Second, parameters.SourceHandshake)
+	checkProvenance(parameters.ConnectionWorkerPoolSize, 3, parameters.SourceTactics)
+
+	// New tactics retain the handshake parameters, and new handshake
+	// parameters retain the tactics.
+
+	err = config.SetClientParameters("tag", true, map[string]interface{}{
+		parameters.ConnectionWorkerPoolSize: 4,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	checkProvenance(parameters.TacticsWaitPeriod, 3*time.Second, parameters.SourceHandshake)
+	checkProvenance(parameters.ConnectionWorkerPoolSize, 4, parameters.SourceTactics)
+
+	err = config.SetHandshakeClientParameters(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("SetHandshakeClientParameters failed: %s", err)
+	}
+
+	checkProvenance(parameters.TacticsWaitPeriod, 10*time.Second, parameters.SourceDefault)
+	checkProvenance(parameters.ConnectionWorkerPoolSize, 4, parameters.SourceTactics)
+}
+
+type testNetworkMetadataGetter struct {
+	metadata NetworkMetadata
+}
+
+func (getter *testNetworkMetadataGetter) GetNetworkMetadata() NetworkMetadata {
+	return getter.metadata
+}
+
+func TestNetworkMetadata(t *testing.T) {
+
+	metadataGetter := &testNetworkMetadataGetter{}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "NetworkID" : "MOBILE-TEST"
+    }`))
+	if err == nil {
+		config.NetworkMetadataGetter = metadataGetter
+		err = config.Commit()
+	}
+	if err != nil {
+		t.Fatalf("error loading configuration: %s", err)
+	}
+
+	getParams := func() common.APIParameters {
+		dialStats := &DialStats{}
+		dialStats.MeekResolvedIPAddress.Store("")
+		return getBaseAPIParameters(
+			config, config.SessionID, &protocol.ServerEntry{},
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, dialStats)
+	}
+
+	// Without an ASN, tactics are stored under the network ID.
+
+	if config.getTacticsNetworkID() != "MOBILE-TEST" {
+		t.Fatalf("unexpected tactics network ID: %s", config.getTacticsNetworkID())
+	}
+
+	params := getParams()
+	for _, name := range []string{"network_mcc", "network_mnc", "network_asn"} {
+		if _, ok := params[name]; ok {
+			t.Fatalf("unexpected API parameter: %s", name)
+		}
+	}
+
+	// Roaming to another provider under the same network ID selects a
+	// distinct tactics network ID.
+
+	metadataGetter.metadata = NetworkMetadata{MCC: "310", MNC: "260", ASN: "21928"}
+
+	if config.getTacticsNetworkID() != "MOBILE-TEST-ASN21928" {
+		t.Fatalf("unexpected tactics network ID: %s", config.getTacticsNetworkID())
+	}
+
+	params = getParams()
+	if params["network_mcc"] != "310" ||
+		params["network_mnc"] != "260" ||
+		params["network_asn"] != "21928" {
+		t.Fatalf("unexpected API parameters: %+v", params)
+	}
+}
@@ -0,0 +1,391 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// ControlHost is implemented by the host process which runs the controller,
+// such as ConsoleClient, to allow a ControlServer to start and stop
+// tunneling. The host retains ownership of the controller lifecycle.
+type ControlHost interface {
+
+	// StartTunneling starts running a controller. StartTunneling is a noop
+	// when a controller is already running.
+	StartTunneling() error
+
+	// StopTunneling stops the running controller, if any, and waits for it
+	// to stop. The host process continues running.
+	StopTunneling() error
+
+	// GetController returns the running controller, or nil when no
+	// controller is running.
+	GetController() *Controller
+}
+
+// ControlServer is a local control surface for a running client, which
+// allows GUIs and scripts to manage a long-running client process without
+// embedding this package.
+//
+// The protocol is JSON-RPC 2.0, with one JSON object per line, in both
+// directions. The supported methods are:
+//
+//   - "start": start tunneling. No params.
+//   - "stop": stop tunneling. No params.
+//   - "status": the result is a ControllerStatus. When tunneling is stopped,
+//     State is CONTROLLER_STATE_STOPPED.
+//   - "setEgressRegion": params {"region": <region>}; see
+//     Controller.SetEgressRegion. Tunneling must be running.
+//   - "subscribeNotices": params {"noticeTypes": [<type>, ...]}, where
+//     noticeTypes is optional. After the result, each notice of the specified
+//     types, or all notices, is sent as a "notice" notification, with the
+//     notice JSON object as params, until the connection is closed.
+//
+// Notices are subject to the same diagnostic notice setting as the notice
+// writer.
+type ControlServer struct {
+	host           ControlHost
+	listener       net.Listener
+	serveWaitGroup *sync.WaitGroup
+	openConns      *common.Conns
+}
+
+const (
+	controlErrorParse          = -32700
+	controlErrorInvalidRequest = -32600
+	controlErrorMethodNotFound = -32601
+	controlErrorInvalidParams  = -32602
+	controlErrorServer         = -32000
+
+	controlMaxRequestSize = 65536
+)
+
+// ListenControlSocket listens on a unix domain socket at the specified path
+// for use with NewControlServer. A stale socket file left by a previous
+// process is replaced. The socket file is accessible only to the current
+// user.
+func ListenControlSocket(path string) (net.Listener, error) {
+
+	fileInfo, err := os.Lstat(path)
+	if err == nil {
+		if fileInfo.Mode()&os.ModeSocket == 0 {
+			return nil, common.ContextError(
+				errors.New("control socket path exists and is not a socket"))
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	// The socket is created with restrictive permissions, rather than
+	// relying only on the following chmod, so that other users can't
+	// connect to it in the window between listen and chmod.
+
+	listener, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return listener, nil
+}
+
+// NewControlServer starts serving control requests on the listener. The
+// ControlServer takes ownership of the listener.
+func NewControlServer(host ControlHost, listener net.Listener) *ControlServer {
+
+	server := &ControlServer{
+		host:           host,
+		listener:       listener,
+		serveWaitGroup: new(sync.WaitGroup),
+		openConns:      common.NewConns(),
+	}
+
+	server.serveWaitGroup.Add(1)
+	go server.serve()
+
+	return server
+}
+
+// Close stops the server, closing the listener and all open control
+// connections, and waits for all connection handlers to complete.
+func (server *ControlServer) Close() {
+	server.listener.Close()
+	server.openConns.CloseAll()
+	server.serveWaitGroup.Wait()
+}
+
+func (server *ControlServer) serve() {
+	defer server.serveWaitGroup.Done()
+
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			// The listener is closed.
+			return
+		}
+
+		if !server.openConns.Add(conn) {
+			// The server is closed.
+			conn.Close()
+			return
+		}
+
+		server.serveWaitGroup.Add(1)
+		go server.handleConn(conn)
+	}
+}
+
+type controlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type controlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// controlConn is a single control connection. Writes are serialized as
+// notice notifications are written concurrently with responses.
+type controlConn struct {
+	server            *ControlServer
+	conn              net.Conn
+	writeMutex        sync.Mutex
+	unsubscribe       func()
+	newSubscription   *controlSubscription
+	subscriptionGroup *sync.WaitGroup
+}
+
+func (server *ControlServer) handleConn(conn net.Conn) {
+	defer server.serveWaitGroup.Done()
+
+	controlConn := &controlConn{
+		server:            server,
+		conn:              conn,
+		subscriptionGroup: new(sync.WaitGroup),
+	}
+
+	defer func() {
+		conn.Close()
+		server.openConns.Remove(conn)
+		if controlConn.unsubscribe != nil {
+			controlConn.unsubscribe()
+		}
+		controlConn.subscriptionGroup.Wait()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), controlMaxRequestSize)
+	for scanner.Scan() {
+		controlConn.handleRequest(scanner.Bytes())
+	}
+}
+
+func (controlConn *controlConn) handleRequest(line []byte) {
+
+	var request controlRequest
+	err := json.Unmarshal(line, &request)
+	if err != nil {
+		controlConn.writeError(nil, controlErrorParse, "parse error")
+		return
+	}
+
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		controlConn.writeError(request.ID, controlErrorInvalidRequest, "invalid request")
+		return
+	}
+
+	result, code, err := controlConn.invoke(request.Method, request.Params)
+
+	// A request without an id is a notification, which receives no
+	// response.
+	if request.ID != nil {
+		if err != nil {
+			controlConn.writeError(request.ID, code, err.Error())
+		} else {
+			controlConn.write(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      request.ID,
+				"result":  result,
+			})
+		}
+	}
+
+	// Start relaying notices only after the subscribeNotices result is
+	// written.
+	if controlConn.newSubscription != nil {
+		controlConn.startNoticeSubscription(controlConn.newSubscription)
+		controlConn.newSubscription = nil
+	}
+}
+
+type controlSubscription struct {
+	noticeTypes map[string]bool
+	notices     <-chan []byte
+}
+
+func (controlConn *controlConn) invoke(
+	method string, params json.RawMessage) (interface{}, int, error) {
+
+	host := controlConn.server.host
+
+	switch method {
+
+	case "start":
+		err := host.StartTunneling()
+		if err != nil {
+			return nil, controlErrorServer, common.ContextError(err)
+		}
+		return true, 0, nil
+
+	case "stop":
+		err := host.StopTunneling()
+		if err != nil {
+			return nil, controlErrorServer, common.ContextError(err)
+		}
+		return true, 0, nil
+
+	case "status":
+		controller := host.GetController()
+		if controller == nil {
+			return &ControllerStatus{State: CONTROLLER_STATE_STOPPED}, 0, nil
+		}
+		return controller.Status(), 0, nil
+
+	case "setEgressRegion":
+		var egressRegionParams struct {
+			Region *string `json:"region"`
+		}
+		if params == nil ||
+			json.Unmarshal(params, &egressRegionParams) != nil ||
+			egressRegionParams.Region == nil {
+			return nil, controlErrorInvalidParams, errors.New("invalid params")
+		}
+		controller := host.GetController()
+		if controller == nil {
+			return nil, controlErrorServer, errors.New("tunneling is not running")
+		}
+		controller.SetEgressRegion(*egressRegionParams.Region)
+		return true, 0, nil
+
+	case "subscribeNotices":
+		var subscribeParams struct {
+			NoticeTypes []string `json:"noticeTypes"`
+		}
+		if params != nil && json.Unmarshal(params, &subscribeParams) != nil {
+			return nil, controlErrorInvalidParams, errors.New("invalid params")
+		}
+		if controlConn.unsubscribe != nil {
+			return nil, controlErrorServer, errors.New("already subscribed")
+		}
+		subscription := &controlSubscription{}
+		if len(subscribeParams.NoticeTypes) > 0 {
+			subscription.noticeTypes = make(map[string]bool)
+			for _, noticeType := range subscribeParams.NoticeTypes {
+				subscription.noticeTypes[noticeType] = true
+			}
+		}
+		subscription.notices, controlConn.unsubscribe = SubscribeNotices()
+		controlConn.newSubscription = subscription
+		return true, 0, nil
+	}
+
+	return nil, controlErrorMethodNotFound, errors.New("method not found")
+}
+
+func (controlConn *controlConn) startNoticeSubscription(subscription *controlSubscription) {
+
+	controlConn.subscriptionGroup.Add(1)
+	go func() {
+		defer controlConn.subscriptionGroup.Done()
+
+		// The channel is closed by unsubscribe when the connection closes.
+		for notice := range subscription.notices {
+
+			if subscription.noticeTypes != nil {
+				noticeType, _, err := GetNotice(notice)
+				if err != nil || !subscription.noticeTypes[noticeType] {
+					continue
+				}
+			}
+
+			err := controlConn.write(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "notice",
+				"params":  json.RawMessage(notice),
+			})
+			if err != nil {
+				controlConn.conn.Close()
+			}
+		}
+	}()
+}
+
+func (controlConn *controlConn) writeError(
+	id json.RawMessage, code int, message string) {
+
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	controlConn.write(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error":   &controlError{Code: code, Message: message},
+	})
+}
+
+func (controlConn *controlConn) write(message interface{}) error {
+
+	encodedMessage, err := json.Marshal(message)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	controlConn.writeMutex.Lock()
+	defer controlConn.writeMutex.Unlock()
+
+	_, err = controlConn.conn.Write(append(encodedMessage, '\n'))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type testControlHost struct {
+	mutex      sync.Mutex
+	config     *Config
+	controller *Controller
+}
+
+func (host *testControlHost) StartTunneling() error {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	if host.controller == nil {
+		controller, err := NewController(host.config)
+		if err != nil {
+			return err
+		}
+		host.controller = controller
+	}
+	return nil
+}
+
+func (host *testControlHost) StopTunneling() error {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	host.controller = nil
+	return nil
+}
+
+func (host *testControlHost) GetController() *Controller {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	return host.controller
+}
+
+func TestControlServer(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-control-server-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Linux",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	socketPath := filepath.Join(testDataDirName, "control")
+
+	// A stale socket file is replaced.
+
+	for i := 0; i < 2; i++ {
+		listener, err := ListenControlSocket(socketPath)
+		if err != nil {
+			t.Fatalf("ListenControlSocket failed: %s", err)
+		}
+		if i == 0 {
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+			continue
+		}
+		server := NewControlServer(&testControlHost{config: config}, listener)
+		defer server.Close()
+	}
+
+	fileInfo, err := os.Stat(socketPath)
+	if err != nil || fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected control socket mode: %v", err)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	type response struct {
+		ID     int             `json:"id"`
+		Method string          `json:"method"`
+		Result json.RawMessage `json:"result"`
+		Params json.RawMessage `json:"params"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+
+	readResponse := func() *response {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("ReadBytes failed: %s", err)
+		}
+		var r response
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		return &r
+	}
+
+	nextID := 0
+	call := func(method string, params string) *response {
+		nextID++
+		request := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      nextID,
+			"method":  method,
+		}
+		if params != "" {
+			request["params"] = json.RawMessage(params)
+		}
+		encodedRequest, _ := json.Marshal(request)
+		_, err := conn.Write(append(encodedRequest, '\n'))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		r := readResponse()
+		if r.ID != nextID {
+			t.Fatalf("unexpected response id: %d", r.ID)
+		}
+		return r
+	}
+
+	expectState := func(expectedState string) {
+		r := call("status", "")
+		var status ControllerStatus
+		if r.Error != nil || json.Unmarshal(r.Result, &status) != nil {
+			t.Fatalf("unexpected status response: %+v", r)
+		}
+		if status.State != expectedState {
+			t.Fatalf("unexpected state: %s", status.State)
+		}
+	}
+
+	expectErrorCode := func(r *response, code int) {
+		if r.Error == nil || r.Error.Code != code {
+			t.Fatalf("unexpected response: %+v", r)
+		}
+	}
+
+	expectState(CONTROLLER_STATE_STOPPED)
+
+	expectErrorCode(
+		call("setEgressRegion", `{"region":"US"}`), controlErrorServer)
+
+	if r := call("start", ""); r.Error != nil {
+		t.Fatalf("start failed: %+v", r.Error)
+	}
+
+	expectErrorCode(call("setEgressRegion", `{}`), controlErrorInvalidParams)
+
+	if r := call("setEgressRegion", `{"region":"US"}`); r.Error != nil {
+		t.Fatalf("setEgressRegion failed: %+v", r.Error)
+	}
+
+	r := call("status", "")
+	var status ControllerStatus
+	json.Unmarshal(r.Result, &status)
+	if status.EgressRegion != "US" {
+		t.Fatalf("unexpected egress region: %s", status.EgressRegion)
+	}
+
+	if r := call("stop", ""); r.Error != nil {
+		t.Fatalf("stop failed: %+v", r.Error)
+	}
+
+	expectState(CONTROLLER_STATE_STOPPED)
+
+	expectErrorCode(call("unknown", ""), controlErrorMethodNotFound)
+
+	_, err = conn.Write([]byte("{\n"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectErrorCode(readResponse(), controlErrorParse)
+
+	// Subscribed notices are streamed as notifications, filtered by type.
+
+	if r := call("subscribeNotices", `{"noticeTypes":["ClientRegion"]}`); r.Error != nil {
+		t.Fatalf("subscribeNotices failed: %+v", r.Error)
+	}
+
+	NoticeHostConditions(false, false, false)
+	NoticeClientRegion("CA")
+
+	r = readResponse()
+	if r.Method != "notice" {
+		t.Fatalf("unexpected notification: %+v", r)
+	}
+	noticeType, payload, err := GetNotice(r.Params)
+	if err != nil || noticeType != "ClientRegion" || payload["region"] != "CA" {
+		t.Fatalf("unexpected notice: %s", r.Params)
+	}
+}
@@ -0,0 +1,47 @@
+// +build !windows,!js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMutex serializes listenUnixPrivate umask changes. Note that the umask
+// is process wide, so files created concurrently by other goroutines also
+// get the restrictive umask.
+var umaskMutex sync.Mutex
+
+// listenUnixPrivate listens on a unix domain socket which is created with no
+// group or other permissions, so the socket is never accessible to other
+// users, even briefly before a chmod.
+func listenUnixPrivate(path string) (net.Listener, error) {
+
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+
+	oldUmask := syscall.Umask(0077)
+	defer syscall.Umask(oldUmask)
+
+	return net.Listen("unix", path)
+}
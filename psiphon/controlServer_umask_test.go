@@ -0,0 +1,67 @@
+// +build !windows,!js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixPrivate(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-control-umask-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// With a permissive umask, net.Listen alone creates a socket file which
+	// any user may connect to.
+
+	oldUmask := syscall.Umask(0)
+	defer syscall.Umask(oldUmask)
+
+	socketPath := filepath.Join(testDataDirName, "control")
+
+	listener, err := listenUnixPrivate(socketPath)
+	if err != nil {
+		t.Fatalf("listenUnixPrivate failed: %s", err)
+	}
+	defer listener.Close()
+
+	fileInfo, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if fileInfo.Mode().Perm()&0077 != 0 {
+		t.Fatalf("unexpected control socket mode: %s", fileInfo.Mode())
+	}
+
+	// The umask is restored.
+
+	if umask := syscall.Umask(0); umask != 0 {
+		t.Fatalf("unexpected umask: %o", umask)
+	}
+}
@@ -30,10 +30,12 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
@@ -44,6 +46,11 @@ import (
 // connect to; establishes and monitors tunnels; and runs local proxies which
 // route traffic through the tunnels.
 type Controller struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesSent                               int64
+	bytesReceived                           int64
 	config                                  *Config
 	sessionId                               string
 	runCtx                                  context.Context
@@ -55,9 +62,14 @@ type Controller struct {
 	establishedOnce                         bool
 	tunnels                                 []*Tunnel
 	nextTunnel                              int
+	tunnelPoolSize                          int
+	signalTunnelPoolResize                  chan struct{}
+	pendingPortForwards                     int32
+	portForwardLimiter                      *portForwardLimiter
 	startedConnectedReporter                bool
 	isEstablishing                          bool
 	establishLimitTunnelProtocolsState      *limitTunnelProtocolsState
+	establishBudget                         *establishBudget
 	concurrentEstablishTunnelsMutex         sync.Mutex
 	establishConnectTunnelCount             int
 	concurrentEstablishTunnels              int
@@ -72,11 +84,49 @@ type Controller struct {
 	splitTunnelClassifier                   *SplitTunnelClassifier
 	signalFetchCommonRemoteServerList       chan struct{}
 	signalFetchObfuscatedServerLists        chan struct{}
+	signalFetchStegoServerLists             chan struct{}
 	signalDownloadUpgrade                   chan string
 	signalReportConnected                   chan struct{}
 	serverAffinityDoneBroadcast             chan struct{}
 	packetTunnelClient                      *tun.Client
 	packetTunnelTransport                   *PacketTunnelTransport
+	hostConditionsMutex                     sync.Mutex
+	hostConditions                          HostConditions
+	signalProbeRegionLatencies              chan struct{}
+	regionLatenciesMutex                    sync.Mutex
+	regionLatencies                         map[string]time.Duration
+	statusMutex                             sync.Mutex
+	isRunning                               bool
+	runStartTime                            monotime.Time
+	lastError                               string
+	lastErrorTime                           time.Time
+	stateMutex                              sync.Mutex
+	state                                   string
+	stateSubscribers                        map[chan ControllerStateTransition]bool
+	isDraining                              int32
+	portForwardsMutex                       sync.Mutex
+	portForwards                            map[*drainablePortForwardConn]bool
+	httpProxy                               *HttpProxy
+	signalPortForwardClosed                 chan struct{}
+	establishRoundCount                     int32
+	triedServersMutex                       sync.Mutex
+	triedServers                            map[string]bool
+	resumeSnapshot                          *ControllerSnapshot
+}
+
+// HostConditions are host device and network conditions which the host
+// application may report to the controller. Establishment is throttled
+// when the host is constrained, to conserve battery and data.
+type HostConditions struct {
+	OnBattery        bool
+	IsMeteredNetwork bool
+	IsDozeMode       bool
+}
+
+// isConstrained indicates that the host is running on battery or is in doze
+// mode, and that establishment should be less aggressive.
+func (conditions HostConditions) isConstrained() bool {
+	return conditions.OnBattery || conditions.IsDozeMode
 }
 
 // NewController initializes a new controller.
@@ -95,11 +145,14 @@ func NewController(config *Config) (controller *Controller, err error) {
 
 	untunneledDialConfig := &DialConfig{
 		UpstreamProxyURL:              config.UpstreamProxyURL,
+		UpstreamProxyChainURLs:        config.UpstreamProxyChainURLs,
 		CustomHeaders:                 config.CustomHeaders,
 		DeviceBinder:                  config.deviceBinder,
-		DnsServerGetter:               config.DnsServerGetter,
+		DnsServerGetter:               config.dnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		ClientParameters:              config.clientParameters,
+		NetworkEmulator:               config.NetworkEmulator,
 	}
 
 	controller = &Controller{
@@ -108,9 +161,15 @@ func NewController(config *Config) (controller *Controller, err error) {
 		runWaitGroup: new(sync.WaitGroup),
 		// connectedTunnels and failedTunnels buffer sizes are large enough to
 		// receive full pools of tunnels without blocking. Senders should not block.
-		connectedTunnels:         make(chan *Tunnel, config.TunnelPoolSize),
-		failedTunnels:            make(chan *Tunnel, config.TunnelPoolSize),
-		tunnels:                  make([]*Tunnel, 0),
+		connectedTunnels:       make(chan *Tunnel, maxTunnelPoolSize(config)),
+		failedTunnels:          make(chan *Tunnel, maxTunnelPoolSize(config)),
+		tunnels:                make([]*Tunnel, 0),
+		tunnelPoolSize:         config.TunnelPoolSize,
+		signalTunnelPoolResize: make(chan struct{}, 1),
+		portForwardLimiter: newPortForwardLimiter(
+			config.MaxConcurrentPortForwards,
+			config.MaxConcurrentPortForwardsPerHost,
+			config.PortForwardLimitPolicy),
 		establishedOnce:          false,
 		startedConnectedReporter: false,
 		isEstablishing:           false,
@@ -120,13 +179,25 @@ func NewController(config *Config) (controller *Controller, err error) {
 		// establish will eventually signal another fetch remote.
 		signalFetchCommonRemoteServerList: make(chan struct{}),
 		signalFetchObfuscatedServerLists:  make(chan struct{}),
+		signalFetchStegoServerLists:       make(chan struct{}),
 		signalDownloadUpgrade:             make(chan string),
 		signalReportConnected:             make(chan struct{}),
+		signalProbeRegionLatencies:        make(chan struct{}),
+	}
+
+	if config.PinnedServerEntries != nil || config.ExcludedServerEntries != nil {
+		err := StoreServerEntryPolicy(&ServerEntryPolicy{
+			PinnedServerEntries:   config.PinnedServerEntries,
+			ExcludedServerEntries: config.ExcludedServerEntries,
+		})
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
 
-	if config.PacketTunnelTunFileDescriptor > 0 {
+	if config.isPacketTunnel() {
 
 		// Run a packet tunnel client. The lifetime of the tun.Client is the
 		// lifetime of the Controller, so it exists across tunnel establishments
@@ -136,11 +207,7 @@ func NewController(config *Config) (controller *Controller, err error) {
 
 		packetTunnelTransport := NewPacketTunnelTransport()
 
-		packetTunnelClient, err := tun.NewClient(&tun.ClientConfig{
-			Logger:            NoticeCommonLogger(),
-			TunFileDescriptor: config.PacketTunnelTunFileDescriptor,
-			Transport:         packetTunnelTransport,
-		})
+		packetTunnelClient, err := newPacketTunnelClient(config, packetTunnelTransport)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -149,6 +216,17 @@ func NewController(config *Config) (controller *Controller, err error) {
 		controller.packetTunnelTransport = packetTunnelTransport
 	}
 
+	if config.DialCaptureFilename != "" {
+		config.dialCapture, err = newDialCapture(
+			config.DialCaptureFilename,
+			config.DialCaptureIncludePayload,
+			config.DialCaptureRawPackets)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		NoticeInfo("dial capture enabled")
+	}
+
 	return controller, nil
 }
 
@@ -163,11 +241,31 @@ func (controller *Controller) Run(ctx context.Context) {
 	// an initial instance of any repetitive error notice, etc.
 	ResetRepetitiveNotices()
 
+	// The memory limit is process-wide, so the previous runtime settings are
+	// restored when the controller stops and don't carry over to any later
+	// controller.
+	restoreMemoryLimit := applyMemoryLimit(
+		controller.config.MemoryLimitBytes, controller.config.MemoryLimitGCPercent)
+	defer restoreMemoryLimit()
+
 	runCtx, stopRunning := context.WithCancel(ctx)
 	defer stopRunning()
 
+	// runCtx and stopRunning are set under stateMutex as they're read by
+	// Shutdown, which may be called concurrently.
+	controller.stateMutex.Lock()
 	controller.runCtx = runCtx
 	controller.stopRunning = stopRunning
+	controller.stateMutex.Unlock()
+
+	if controller.config.StatusFilename != "" {
+		// This deferred call runs after setRunning(false), so the final
+		// status file records the stopped state.
+		defer controller.writeStatusFile()
+	}
+
+	controller.setRunning(true)
+	defer controller.setRunning(false)
 
 	// Start components
 
@@ -205,6 +303,27 @@ func (controller *Controller) Run(ctx context.Context) {
 			return
 		}
 		defer httpProxy.Close()
+		controller.setHttpProxy(httpProxy)
+		defer controller.setHttpProxy(nil)
+	}
+
+	if controller.config.useV2RayOutbound() {
+		controller.runWaitGroup.Add(1)
+		go func() {
+			defer controller.runWaitGroup.Done()
+			checkV2RayOutbound(controller.runCtx, controller.config)
+		}()
+	}
+
+	if isInproxyEnabled(controller.config) {
+		controller.runWaitGroup.Add(1)
+		go func() {
+			defer controller.runWaitGroup.Done()
+			_, err := DiscoverNATType(controller.runCtx, controller.config)
+			if err != nil {
+				NoticeAlert("NAT type discovery failed: %s", err)
+			}
+		}()
 	}
 
 	if !controller.config.DisableRemoteServerListFetcher {
@@ -224,6 +343,14 @@ func (controller *Controller) Run(ctx context.Context) {
 				FetchObfuscatedServerLists,
 				controller.signalFetchObfuscatedServerLists)
 		}
+
+		if controller.config.StegoServerListURLs != nil {
+			controller.runWaitGroup.Add(1)
+			go controller.remoteServerListFetcher(
+				"stego",
+				FetchStegoServerLists,
+				controller.signalFetchStegoServerLists)
+		}
 	}
 
 	if controller.config.UpgradeDownloadURLs != nil {
@@ -240,6 +367,30 @@ func (controller *Controller) Run(ctx context.Context) {
 	controller.runWaitGroup.Add(1)
 	go controller.establishTunnelWatcher()
 
+	controller.runWaitGroup.Add(1)
+	go controller.regionLatencyProber()
+
+	controller.runWaitGroup.Add(1)
+	go controller.tunnelLivenessWatchdog()
+
+	controller.runWaitGroup.Add(1)
+	go controller.decoyTrafficGenerator()
+
+	if controller.config.StatusFilename != "" {
+		controller.runWaitGroup.Add(1)
+		go controller.statusFileWriter()
+	}
+
+	if controller.config.TunnelPoolMaxSize > 0 {
+		controller.runWaitGroup.Add(1)
+		go controller.tunnelPoolAutoscaler()
+	}
+
+	if controller.packetTunnelClient != nil && controller.config.PacketTunnelTrackFlows {
+		controller.runWaitGroup.Add(1)
+		go controller.flowStatsReporter()
+	}
+
 	if controller.packetTunnelClient != nil {
 		controller.packetTunnelClient.Start()
 	}
@@ -249,6 +400,8 @@ func (controller *Controller) Run(ctx context.Context) {
 	<-controller.runCtx.Done()
 	NoticeInfo("controller stopped")
 
+	controller.setStateStopping()
+
 	if controller.packetTunnelClient != nil {
 		controller.packetTunnelClient.Stop()
 	}
@@ -262,6 +415,10 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	controller.splitTunnelClassifier.Shutdown()
 
+	if controller.config.dialCapture != nil {
+		controller.config.dialCapture.close()
+	}
+
 	NoticeInfo("exiting controller")
 
 	NoticeExiting()
@@ -281,6 +438,118 @@ func (controller *Controller) SetDynamicConfig(sponsorID string, authorizations
 	controller.config.SetDynamicConfig(sponsorID, authorizations)
 }
 
+// SetHostConditions sets the current host conditions. The new conditions
+// take effect on the next establishment round and the next upgrade check;
+// established tunnels are not affected.
+func (controller *Controller) SetHostConditions(conditions HostConditions) {
+	controller.hostConditionsMutex.Lock()
+	controller.hostConditions = conditions
+	controller.hostConditionsMutex.Unlock()
+
+	NoticeHostConditions(
+		conditions.OnBattery, conditions.IsMeteredNetwork, conditions.IsDozeMode)
+}
+
+func (controller *Controller) getHostConditions() HostConditions {
+	controller.hostConditionsMutex.Lock()
+	defer controller.hostConditionsMutex.Unlock()
+	return controller.hostConditions
+}
+
+// SetEgressRegion changes the egress region. Active tunnels to servers in the
+// new region are retained; all other active tunnels are terminated and
+// replaced with tunnels to servers in the new region. Set region to "" to
+// select servers in any region, which retains all active tunnels.
+func (controller *Controller) SetEgressRegion(region string) {
+
+	controller.config.SetEgressRegion(region)
+
+	var mismatchedTunnels []*Tunnel
+	controller.tunnelMutex.Lock()
+	for _, tunnel := range controller.tunnels {
+		if !controller.isEgressRegionTunnel(tunnel) {
+			mismatchedTunnels = append(mismatchedTunnels, tunnel)
+		}
+	}
+	controller.tunnelMutex.Unlock()
+
+	NoticeInfo(
+		"set egress region '%s': replacing %d tunnels", region, len(mismatchedTunnels))
+
+	for _, tunnel := range mismatchedTunnels {
+		controller.SignalTunnelFailure(tunnel)
+	}
+}
+
+// SetSplitTunnelRules replaces the split tunnel domain rules, overriding
+// the SplitTunnelUntunneledDomains and SplitTunnelTunneledDomains config
+// values. The new rules apply to subsequent port forwards; existing port
+// forwards are not affected. A nil rules value clears all domain rules.
+func (controller *Controller) SetSplitTunnelRules(rules *SplitTunnelRules) error {
+
+	if rules == nil {
+		rules = &SplitTunnelRules{}
+	}
+
+	err := rules.Validate()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	controller.splitTunnelClassifier.SetRules(rules)
+
+	NoticeInfo(
+		"set split tunnel rules: %d untunneled, %d tunneled",
+		len(rules.UntunneledDomains), len(rules.TunneledDomains))
+
+	return nil
+}
+
+// SetServerEntryPolicy replaces the server entry pinning and exclusion
+// policy, overriding the PinnedServerEntries and ExcludedServerEntries config
+// values. The policy is persisted in the datastore and takes effect on the
+// next establishment round. Active tunnels to newly excluded servers are
+// terminated and replaced. A nil policy clears the policy.
+func (controller *Controller) SetServerEntryPolicy(policy *ServerEntryPolicy) error {
+
+	err := StoreServerEntryPolicy(policy)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var excludedTunnels []*Tunnel
+	controller.tunnelMutex.Lock()
+	for _, tunnel := range controller.tunnels {
+		if policy.isExcluded(tunnel.serverEntry.IpAddress) {
+			excludedTunnels = append(excludedTunnels, tunnel)
+		}
+	}
+	controller.tunnelMutex.Unlock()
+
+	pinnedCount, excludedCount := 0, 0
+	if policy != nil {
+		pinnedCount = len(policy.PinnedServerEntries)
+		excludedCount = len(policy.ExcludedServerEntries)
+	}
+
+	NoticeInfo(
+		"set server entry policy: %d pinned, %d excluded: replacing %d tunnels",
+		pinnedCount, excludedCount, len(excludedTunnels))
+
+	for _, tunnel := range excludedTunnels {
+		controller.SignalTunnelFailure(tunnel)
+	}
+
+	return nil
+}
+
+// isEgressRegionTunnel indicates whether the tunnel's server is in the
+// current egress region.
+func (controller *Controller) isEgressRegionTunnel(tunnel *Tunnel) bool {
+	region := controller.config.GetEgressRegion()
+	return region == "" || tunnel.serverEntry.Region == region
+}
+
 // TerminateNextActiveTunnel terminates the active tunnel, which will initiate
 // establishment of a new tunnel.
 func (controller *Controller) TerminateNextActiveTunnel() {
@@ -300,6 +569,7 @@ func (controller *Controller) remoteServerListFetcher(
 	signal <-chan struct{}) {
 
 	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("remoteServerListFetcher")
 
 	var lastFetchTime monotime.Time
 
@@ -319,7 +589,7 @@ fetcherLoop:
 			parameters.FetchRemoteServerListStalePeriod)
 
 		if lastFetchTime != 0 &&
-			lastFetchTime.Add(stalePeriod).After(monotime.Now()) {
+			lastFetchTime.Add(stalePeriod).After(controller.config.clock.Now()) {
 			continue
 		}
 
@@ -345,7 +615,7 @@ fetcherLoop:
 				controller.untunneledDialConfig)
 
 			if err == nil {
-				lastFetchTime = monotime.Now()
+				lastFetchTime = controller.config.clock.Now()
 				break retryLoop
 			}
 
@@ -354,9 +624,9 @@ fetcherLoop:
 			retryPeriod := controller.config.clientParameters.Get().Duration(
 				parameters.FetchRemoteServerListRetryPeriod)
 
-			timer := time.NewTimer(retryPeriod)
+			timer := controller.config.clock.NewTimer(retryPeriod)
 			select {
-			case <-timer.C:
+			case <-timer.C():
 			case <-controller.runCtx.Done():
 				timer.Stop()
 				break fetcherLoop
@@ -374,18 +644,20 @@ fetcherLoop:
 // is left running (to re-establish).
 func (controller *Controller) establishTunnelWatcher() {
 	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("establishTunnelWatcher")
 
 	timeout := controller.config.clientParameters.Get().Duration(
 		parameters.EstablishTunnelTimeout)
 
 	if timeout > 0 {
-		timer := time.NewTimer(timeout)
+		timer := controller.config.clock.NewTimer(timeout)
 		defer timer.Stop()
 
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			if !controller.hasEstablishedOnce() {
 				NoticeAlert("failed to establish tunnel before timeout")
+				controller.setLastError("failed to establish tunnel before timeout")
 				controller.SignalComponentFailure()
 			}
 		case <-controller.runCtx.Done():
@@ -405,6 +677,7 @@ func (controller *Controller) establishTunnelWatcher() {
 // request immediately after a reconnect.
 func (controller *Controller) connectedReporter() {
 	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("connectedReporter")
 loop:
 	for {
 
@@ -433,11 +706,11 @@ loop:
 			duration = controller.config.clientParameters.Get().Duration(
 				parameters.PsiphonAPIConnectedRequestRetryPeriod)
 		}
-		timer := time.NewTimer(duration)
+		timer := controller.config.clock.NewTimer(duration)
 		doBreak := false
 		select {
 		case <-controller.signalReportConnected:
-		case <-timer.C:
+		case <-timer.C():
 			// Make another connected request
 		case <-controller.runCtx.Done():
 			doBreak = true
@@ -490,6 +763,7 @@ func (controller *Controller) startOrSignalConnectedReporter() {
 //
 func (controller *Controller) upgradeDownloader() {
 	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("upgradeDownloader")
 
 	var lastDownloadTime monotime.Time
 
@@ -503,14 +777,24 @@ downloadLoop:
 			break downloadLoop
 		}
 
-		stalePeriod := controller.config.clientParameters.Get().Duration(
-			parameters.FetchUpgradeStalePeriod)
+		p := controller.config.clientParameters.Get()
+		stalePeriod := p.Duration(parameters.FetchUpgradeStalePeriod)
+		skipOnMetered := p.Bool(parameters.MeteredNetworkSkipUpgradeCheck)
+		p = nil
+
+		// Unless handshake is explicitly advertizing a new version, skip
+		// checking entirely when on a metered network.
+		if handshakeVersion == "" &&
+			skipOnMetered &&
+			controller.getHostConditions().IsMeteredNetwork {
+			continue
+		}
 
 		// Unless handshake is explicitly advertizing a new version, skip
 		// checking entirely when a recent download was successful.
 		if handshakeVersion == "" &&
 			lastDownloadTime != 0 &&
-			lastDownloadTime.Add(stalePeriod).After(monotime.Now()) {
+			lastDownloadTime.Add(stalePeriod).After(controller.config.clock.Now()) {
 			continue
 		}
 
@@ -537,7 +821,7 @@ downloadLoop:
 				controller.untunneledDialConfig)
 
 			if err == nil {
-				lastDownloadTime = monotime.Now()
+				lastDownloadTime = controller.config.clock.Now()
 				break retryLoop
 			}
 
@@ -546,9 +830,9 @@ downloadLoop:
 			timeout := controller.config.clientParameters.Get().Duration(
 				parameters.FetchUpgradeRetryPeriod)
 
-			timer := time.NewTimer(timeout)
+			timer := controller.config.clock.NewTimer(timeout)
 			select {
-			case <-timer.C:
+			case <-timer.C():
 			case <-controller.runCtx.Done():
 				timer.Stop()
 				break downloadLoop
@@ -575,6 +859,7 @@ downloadLoop:
 // restarted to fill the pool.
 func (controller *Controller) runTunnels() {
 	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("runTunnels")
 
 	// Start running
 
@@ -584,6 +869,8 @@ loop:
 		select {
 		case failedTunnel := <-controller.failedTunnels:
 			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
+			controller.setLastError(
+				fmt.Sprintf("tunnel failed: %s", failedTunnel.serverEntry.IpAddress))
 			controller.terminateTunnel(failedTunnel)
 
 			// Clear the reference to this tunnel before calling startEstablishing,
@@ -594,6 +881,9 @@ loop:
 			// which reference controller.isEstablishing.
 			controller.startEstablishing()
 
+		case <-controller.signalTunnelPoolResize:
+			controller.resizeTunnelPool()
+
 		case connectedTunnel := <-controller.connectedTunnels:
 
 			// Tunnel establishment has two phases: connection and activation.
@@ -629,6 +919,14 @@ loop:
 			isFirstTunnel := (active == 0)
 			isLastTunnel := (outstanding == 1)
 
+			// The egress region may have changed, via SetEgressRegion, while
+			// this tunnel was connecting.
+
+			if !discardTunnel && !controller.isEgressRegionTunnel(connectedTunnel) {
+				NoticeInfo("discarded %s: egress region changed", connectedTunnel.serverEntry.IpAddress)
+				discardTunnel = true
+			}
+
 			if !discardTunnel {
 
 				if isLastTunnel {
@@ -639,6 +937,8 @@ loop:
 
 				if err != nil {
 					NoticeAlert("failed to activate %s: %s", connectedTunnel.serverEntry.IpAddress, err)
+					controller.setLastError(
+						fmt.Sprintf("failed to activate %s: %s", connectedTunnel.serverEntry.IpAddress, err))
 					discardTunnel = true
 				} else {
 					// It's unlikely that registerTunnel will fail, since only this goroutine
@@ -674,6 +974,11 @@ loop:
 				connectedTunnel.protocol,
 				connectedTunnel.serverEntry.SupportsSSHAPIRequests())
 
+			select {
+			case controller.signalProbeRegionLatencies <- *new(struct{}):
+			default:
+			}
+
 			if isFirstTunnel {
 
 				// The split tunnel classifier is started once the first tunnel is
@@ -763,6 +1068,20 @@ func (controller *Controller) SignalSeededNewSLOK() {
 	}
 }
 
+// GetOSLProgress returns the client's progress towards unlocking each OSL.
+// See GetOSLProgress.
+func (controller *Controller) GetOSLProgress() ([]*osl.OSLProgress, error) {
+	return GetOSLProgress(controller.config)
+}
+
+// ReportBytesTransferred implements the TunnelOwner interface. This function
+// is called by Tunnel.operateTunnel with bytes transferred through the
+// tunnel, which are accumulated for ControllerStatus.
+func (controller *Controller) ReportBytesTransferred(sent, received int64) {
+	atomic.AddInt64(&controller.bytesSent, sent)
+	atomic.AddInt64(&controller.bytesReceived, received)
+}
+
 // SignalTunnelFailure implements the TunnelOwner interface. This function
 // is called by Tunnel.operateTunnel when the tunnel has detected that it
 // has failed. The Controller will signal runTunnels to create a new
@@ -795,7 +1114,7 @@ func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
+	if len(controller.tunnels) >= controller.tunnelPoolSize {
 		return false
 	}
 	// Perform a final check just in case we've established
@@ -809,6 +1128,7 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.establishedOnce = true
 	controller.tunnels = append(controller.tunnels, tunnel)
 	NoticeTunnels(len(controller.tunnels))
+	controller.updateTunnelPoolState()
 
 	// Promote this successful tunnel to first rank so it's one
 	// of the first candidates next time establish runs.
@@ -816,6 +1136,7 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	// ranking.
 	if controller.config.TargetServerEntry == "" {
 		PromoteServerEntry(controller.config, tunnel.serverEntry.IpAddress)
+		controller.recordFastReconnect(tunnel)
 	}
 
 	return true
@@ -834,7 +1155,7 @@ func (controller *Controller) hasEstablishedOnce() bool {
 func (controller *Controller) isFullyEstablished() bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	return len(controller.tunnels) >= controller.tunnelPoolSize
 }
 
 // numTunnels returns the number of active and outstanding tunnels.
@@ -844,7 +1165,7 @@ func (controller *Controller) numTunnels() (int, int) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	active := len(controller.tunnels)
-	outstanding := controller.config.TunnelPoolSize - len(controller.tunnels)
+	outstanding := controller.tunnelPoolSize - len(controller.tunnels)
 	return active, outstanding
 }
 
@@ -866,6 +1187,7 @@ func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 			}
 			activeTunnel.Close(false)
 			NoticeTunnels(len(controller.tunnels))
+			controller.updateTunnelPoolState()
 			break
 		}
 	}
@@ -892,6 +1214,7 @@ func (controller *Controller) terminateAllTunnels() {
 	controller.tunnels = make([]*Tunnel, 0)
 	controller.nextTunnel = 0
 	NoticeTunnels(len(controller.tunnels))
+	controller.updateTunnelPoolState()
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
@@ -929,14 +1252,21 @@ func (controller *Controller) isActiveTunnelServerEntry(
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
+	if controller.isDrainingPortForwards() {
+		return nil, common.ContextError(errors.New("controller is shutting down"))
+	}
+
 	tunnel := controller.getNextActiveTunnel()
 	if tunnel == nil {
 		return nil, common.ContextError(errors.New("no active tunnels"))
 	}
 
-	// Perform split tunnel classification when feature is enabled, and if the remote
-	// address is classified as untunneled, dial directly.
-	if !alwaysTunnel && controller.config.SplitTunnelDNSServer != "" {
+	// Perform split tunnel classification when domain rules are set or the split
+	// tunnel feature is enabled, and if the remote address is classified as
+	// untunneled, dial directly.
+	if !alwaysTunnel &&
+		(controller.config.SplitTunnelDNSServer != "" ||
+			controller.splitTunnelClassifier.hasRules()) {
 
 		host, _, err := net.SplitHostPort(remoteAddr)
 		if err != nil {
@@ -954,12 +1284,43 @@ func (controller *Controller) Dial(
 		}
 	}
 
+	atomic.AddInt32(&controller.pendingPortForwards, 1)
+	defer atomic.AddInt32(&controller.pendingPortForwards, -1)
+
+	// Queued port forwards count towards pendingPortForwards, so the tunnel
+	// pool autoscaler observes port forwards waiting on limits.
+
+	var release func()
+	if controller.portForwardLimiter.isEnabled() {
+
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		timeout := controller.config.clientParameters.Get().Duration(
+			parameters.PortForwardQueueTimeout)
+
+		release, err = controller.portForwardLimiter.acquire(
+			controller.runCtx, host, timeout)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	tunneledConn, err := tunnel.Dial(remoteAddr, alwaysTunnel, downstreamConn)
 	if err != nil {
+		if release != nil {
+			release()
+		}
 		return nil, common.ContextError(err)
 	}
 
-	return tunneledConn, nil
+	if release != nil {
+		tunneledConn = &limitedConn{Conn: tunneledConn, release: release}
+	}
+
+	return controller.trackPortForward(tunneledConn), nil
 }
 
 // DirectDial dials an untunneled TCP connection within the controller run context.
@@ -967,11 +1328,22 @@ func (controller *Controller) DirectDial(remoteAddr string) (conn net.Conn, err
 	return DialTCP(controller.runCtx, remoteAddr, controller.untunneledDialConfig)
 }
 
+// IsUntunneled returns true when host is classified as untunneled by split
+// tunnel classification.
+func (controller *Controller) IsUntunneled(host string) bool {
+	return controller.splitTunnelClassifier.IsUntunneled(host)
+}
+
 type limitTunnelProtocolsState struct {
 	useUpstreamProxy      bool
 	initialProtocols      protocol.TunnelProtocols
 	initialCandidateCount int
 	protocols             protocol.TunnelProtocols
+	strategy              EstablishmentStrategy
+	adaptiveSelection     bool
+	adaptiveExploration   float64
+	networkID             string
+	inproxyEnabled        bool
 }
 
 func (l *limitTunnelProtocolsState) isInitialCandidate(
@@ -1004,12 +1376,33 @@ func (l *limitTunnelProtocolsState) selectProtocol(
 		limitProtocols,
 		excludeIntensive)
 
+	if !l.inproxyEnabled {
+		candidateProtocols = excludeInproxyProtocols(candidateProtocols)
+	}
+
 	if len(candidateProtocols) == 0 {
 		return "", errNoProtocolSupported
 	}
 
-	// Pick at random from the supported protocols. This ensures that we'll
-	// eventually try all possible protocols. Depending on network
+	if l.strategy != nil {
+		selectedProtocol := l.strategy.SelectProtocol(serverEntry, candidateProtocols)
+		if common.Contains(candidateProtocols, selectedProtocol) {
+			return selectedProtocol, nil
+		}
+	}
+
+	// With adaptive protocol selection, pick at random weighted by the
+	// protocol scores for this network. See selectAdaptiveProtocol.
+	if l.adaptiveSelection {
+		stats, err := getProtocolStats(l.networkID)
+		if err == nil {
+			return selectAdaptiveProtocol(stats, candidateProtocols, l.adaptiveExploration), nil
+		}
+		NoticeAlert("failed to get protocol stats: %s", err)
+	}
+
+	// Otherwise, pick at random from the supported protocols. This ensures
+	// that we'll eventually try all possible protocols. Depending on network
 	// configuration, it may be the case that some protocol is only available
 	// through multi-capability servers, and a simpler ranked preference of
 	// protocols could lead to that protocol never being selected.
@@ -1024,10 +1417,25 @@ func (l *limitTunnelProtocolsState) selectProtocol(
 
 }
 
+// excludeInproxyProtocols removes in-proxy protocols, which may not be used
+// when in-proxy isn't configured.
+func excludeInproxyProtocols(protocols []string) []string {
+	filteredProtocols := make([]string, 0, len(protocols))
+	for _, tunnelProtocol := range protocols {
+		if !protocol.TunnelProtocolUsesInproxy(tunnelProtocol) {
+			filteredProtocols = append(filteredProtocols, tunnelProtocol)
+		}
+	}
+	return filteredProtocols
+}
+
 type candidateServerEntry struct {
 	serverEntry                *protocol.ServerEntry
 	isServerAffinityCandidate  bool
 	adjustedEstablishStartTime monotime.Time
+	fastReconnectProtocol      string
+	fastReconnectNetworkID     string
+	replayDialParameters       *replayDialParameters
 }
 
 // startEstablishing creates a pool of worker goroutines which will
@@ -1087,6 +1495,7 @@ func (controller *Controller) startEstablishing() {
 func (controller *Controller) launchEstablishing() {
 
 	defer controller.establishWaitGroup.Done()
+	defer controller.recoverPanic("launchEstablishing")
 
 	// Before starting the establish tunnel workers, get and apply
 	// tactics, launching a tactics request if required.
@@ -1114,7 +1523,7 @@ func (controller *Controller) launchEstablishing() {
 			parameters.TacticsWaitPeriod)
 
 		tacticsDone := make(chan struct{})
-		tacticsWaitPeriod := time.NewTimer(timeout)
+		tacticsWaitPeriod := controller.config.clock.NewTimer(timeout)
 		defer tacticsWaitPeriod.Stop()
 
 		controller.establishWaitGroup.Add(1)
@@ -1122,7 +1531,7 @@ func (controller *Controller) launchEstablishing() {
 
 		select {
 		case <-tacticsDone:
-		case <-tacticsWaitPeriod.C:
+		case <-tacticsWaitPeriod.C():
 		}
 
 		tacticsWaitPeriod.Stop()
@@ -1151,10 +1560,33 @@ func (controller *Controller) launchEstablishing() {
 		initialProtocols:      p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
 		initialCandidateCount: p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
 		protocols:             p.TunnelProtocols(parameters.LimitTunnelProtocols),
+		strategy:              controller.config.EstablishmentStrategy,
+		adaptiveSelection:     p.Bool(parameters.AdaptiveProtocolSelection),
+		adaptiveExploration:   p.Float(parameters.AdaptiveProtocolSelectionExploration),
+		inproxyEnabled:        isInproxyEnabled(controller.config),
+	}
+
+	if controller.establishLimitTunnelProtocolsState.adaptiveSelection {
+		controller.establishLimitTunnelProtocolsState.networkID =
+			getNetworkIDKey(controller.config)
 	}
 
-	workerPoolSize := controller.config.clientParameters.Get().Int(
-		parameters.ConnectionWorkerPoolSize)
+	// The establishment byte budget is shared by all workers in this
+	// establishment. establishBudget is nil when there is no budget.
+
+	controller.establishBudget = newEstablishBudget(
+		p.Int(parameters.EstablishTunnelBytesPerSecond))
+
+	workerPoolSize := p.Int(parameters.ConnectionWorkerPoolSize)
+
+	// When the host is on battery or in doze mode, use fewer workers.
+
+	if controller.getHostConditions().isConstrained() {
+		constrainedPoolSize := p.Int(parameters.ConstrainedHostConnectionWorkerPoolSize)
+		if workerPoolSize > constrainedPoolSize {
+			workerPoolSize = constrainedPoolSize
+		}
+	}
 
 	p = nil
 
@@ -1200,6 +1632,12 @@ func (controller *Controller) stopEstablishing() {
 	controller.candidateServerEntries = nil
 	controller.serverAffinityDoneBroadcast = nil
 
+	// Retain the establishment context for Snapshot when the controller is
+	// stopping, as establishment didn't complete.
+	if controller.runCtx.Err() == nil {
+		controller.resetEstablishmentContext()
+	}
+
 	controller.concurrentEstablishTunnelsMutex.Lock()
 	peakConcurrent := controller.peakConcurrentEstablishTunnels
 	peakConcurrentIntensive := controller.peakConcurrentIntensiveEstablishTunnels
@@ -1218,11 +1656,12 @@ func (controller *Controller) stopEstablishing() {
 
 func (controller *Controller) getTactics(done chan struct{}) {
 	defer controller.establishWaitGroup.Done()
+	defer controller.recoverPanic("getTactics")
 	defer close(done)
 
 	tacticsRecord, err := tactics.UseStoredTactics(
 		GetTacticsStorer(),
-		controller.config.networkIDGetter.GetNetworkID())
+		controller.config.getTacticsNetworkID())
 	if err != nil {
 		NoticeAlert("get stored tactics failed: %s", err)
 
@@ -1285,12 +1724,12 @@ func (controller *Controller) getTactics(done chan struct{}) {
 				p.Float(parameters.TacticsRetryPeriodJitter))
 			p = nil
 
-			tacticsRetryDelay := time.NewTimer(timeout)
+			tacticsRetryDelay := controller.config.clock.NewTimer(timeout)
 
 			select {
 			case <-controller.establishCtx.Done():
 				return
-			case <-tacticsRetryDelay.C:
+			case <-tacticsRetryDelay.C():
 			}
 
 			tacticsRetryDelay.Stop()
@@ -1336,7 +1775,8 @@ func (controller *Controller) doFetchTactics(
 		controller.config,
 		serverEntry,
 		tacticsProtocol,
-		"")
+		"",
+		nil)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -1378,6 +1818,12 @@ func (controller *Controller) doFetchTactics(
 	// the request when the pre-dial connection is broken,
 	// to minimize the possibility of network ID mismatches.
 
+	err = knockIfRequired(
+		ctx, controller.config, dialConfig, serverEntry, tacticsProtocol)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	meekConn, err := DialMeek(ctx, meekConfig, dialConfig)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -1391,11 +1837,19 @@ func (controller *Controller) doFetchTactics(
 		tacticsProtocol,
 		dialStats)
 
+	// Report recent blocking events on this network, so that tactics may
+	// respond to the blocking observed by the client.
+	blockingEvents := takeBlockingEventSummary(getNetworkIDKey(controller.config))
+	if blockingEvents != "" {
+		apiParams["blocking_events"] = blockingEvents
+	}
+
 	tacticsRecord, err := tactics.FetchTactics(
 		ctx,
 		controller.config.clientParameters,
 		GetTacticsStorer(),
-		controller.config.networkIDGetter.GetNetworkID,
+		controller.config.TacticsVerificationKeyRing,
+		controller.config.getTacticsNetworkID,
 		apiParams,
 		serverEntry.Region,
 		tacticsProtocol,
@@ -1420,6 +1874,7 @@ func (controller *Controller) doFetchTactics(
 // servers with higher rank are priority candidates.
 func (controller *Controller) establishCandidateGenerator() {
 	defer controller.establishWaitGroup.Done()
+	defer controller.recoverPanic("establishCandidateGenerator")
 	defer close(controller.candidateServerEntries)
 
 	// establishStartTime is used to calculate and report the
@@ -1428,7 +1883,7 @@ func (controller *Controller) establishCandidateGenerator() {
 	// networkWaitDuration is the elapsed time spent waiting
 	// for network connectivity. This duration will be excluded
 	// from reported tunnel establishment duration.
-	establishStartTime := monotime.Now()
+	establishStartTime := controller.config.clock.Now()
 	var totalNetworkWaitDuration time.Duration
 
 	applyServerAffinity, iterator, err := NewServerEntryIterator(controller.config)
@@ -1440,16 +1895,74 @@ func (controller *Controller) establishCandidateGenerator() {
 	defer iterator.Close()
 
 	// TODO: reconcile server affinity scheme with multi-tunnel mode
-	if controller.config.TunnelPoolSize > 1 {
+	if maxTunnelPoolSize(controller.config) > 1 {
 		applyServerAffinity = false
 	}
 
+	serverEntryPolicy, err := GetServerEntryPolicy()
+	if err != nil {
+		// Don't fail establishment due to a corrupt policy record.
+		NoticeAlert("failed to get server entry policy: %s", err)
+		serverEntryPolicy = &ServerEntryPolicy{}
+	}
+
+	// roundCount is the number of completed rounds, and determines the
+	// exponential backoff pause period between rounds.
+	roundCount := 0
+
+	// captivePortalCheck receives the result of a pending background captive
+	// portal check, and is nil when no check is pending.
+	var captivePortalCheck <-chan *captivePortalCheckResult
+
+	// When resuming from a snapshot, the backoff continues from the
+	// snapshot round count and servers that were already tried are
+	// deferred to the end of the first round.
+	resumeSnapshot := controller.takeResumeSnapshot()
+	if resumeSnapshot != nil {
+		roundCount = resumeSnapshot.EstablishRoundCount
+	}
+
+	// When there's a fast reconnect candidate, it's tried first, and it
+	// takes the place of the server affinity candidate: other candidates
+	// are not started until it completes or FastReconnectTimeout elapses.
+	// When the fast reconnect candidate fails, the same server remains a
+	// regular candidate, with a newly selected tunnel protocol.
+
+	fastReconnectCandidate := controller.getFastReconnectCandidate(establishStartTime)
+
 	isServerAffinityCandidate := true
-	if !applyServerAffinity {
+	if !applyServerAffinity && fastReconnectCandidate == nil {
 		isServerAffinityCandidate = false
 		close(controller.serverAffinityDoneBroadcast)
 	}
 
+	if fastReconnectCandidate != nil {
+
+		isServerAffinityCandidate = false
+
+		NoticeInfo("fast reconnect: %s %s",
+			fastReconnectCandidate.serverEntry.IpAddress,
+			fastReconnectCandidate.fastReconnectProtocol)
+
+		select {
+		case controller.candidateServerEntries <- fastReconnectCandidate:
+		case <-controller.establishCtx.Done():
+			return
+		}
+
+		timer := controller.config.clock.NewTimer(
+			controller.config.clientParameters.Get().Duration(
+				parameters.FastReconnectTimeout))
+		select {
+		case <-timer.C():
+		case <-controller.serverAffinityDoneBroadcast:
+		case <-controller.establishCtx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+
 loop:
 	// Repeat until stopped
 	for {
@@ -1460,16 +1973,41 @@ loop:
 		// Counts may change during establishment due to remote server
 		// list fetches, etc.
 
+		egressRegion := controller.config.GetEgressRegion()
 		initialCount, count := CountServerEntriesWithLimits(
 			controller.config.UseUpstreamProxy(),
-			controller.config.EgressRegion,
+			egressRegion,
 			controller.establishLimitTunnelProtocolsState)
 		NoticeCandidateServers(
-			controller.config.EgressRegion,
+			egressRegion,
 			controller.establishLimitTunnelProtocolsState,
 			initialCount,
 			count)
 
+		// When an EstablishmentStrategy is configured, the strategy orders
+		// the round's candidates; otherwise, candidates are taken directly
+		// from the iterator.
+
+		nextServerEntry := iterator.Next
+		if controller.config.EstablishmentStrategy != nil {
+			candidates, err := newStrategyCandidates(
+				controller.config.EstablishmentStrategy, roundCount, iterator)
+			if err != nil {
+				NoticeAlert("failed to order candidates: %s", err)
+				controller.SignalComponentFailure()
+				break loop
+			}
+			nextServerEntry = candidates.Next
+		}
+
+		if resumeSnapshot != nil {
+			nextServerEntry = newDeferredCandidates(
+				nextServerEntry, resumeSnapshot.TriedServers).Next
+			resumeSnapshot = nil
+		}
+
+		atomic.StoreInt32(&controller.establishRoundCount, int32(roundCount))
+
 		// A "round" consists of a new shuffle of the server entries
 		// and attempted connections up to the end of the server entry
 		// list, or parameters.EstablishTunnelWorkTime elapsed. Time
@@ -1479,23 +2017,23 @@ loop:
 		// If the first round ends with no connection, remote server
 		// list and upgrade checks are launched.
 
-		roundStartTime := monotime.Now()
+		roundStartTime := controller.config.clock.Now()
 		var roundNetworkWaitDuration time.Duration
 
 		// Send each iterator server entry to the establish workers
 		for {
 
-			networkWaitStartTime := monotime.Now()
+			networkWaitStartTime := controller.config.clock.Now()
 			if !WaitForNetworkConnectivity(
 				controller.establishCtx,
 				controller.config.NetworkConnectivityChecker) {
 				break loop
 			}
-			networkWaitDuration := monotime.Since(networkWaitStartTime)
+			networkWaitDuration := controller.config.clock.Now().Sub(networkWaitStartTime)
 			roundNetworkWaitDuration += networkWaitDuration
 			totalNetworkWaitDuration += networkWaitDuration
 
-			serverEntry, err := iterator.Next()
+			serverEntry, err := nextServerEntry()
 			if err != nil {
 				NoticeAlert("failed to get next candidate: %s", err)
 				controller.SignalComponentFailure()
@@ -1539,7 +2077,7 @@ loop:
 			workTime := controller.config.clientParameters.Get().Duration(
 				parameters.EstablishTunnelWorkTime)
 
-			if roundStartTime.Add(-roundNetworkWaitDuration).Add(workTime).Before(monotime.Now()) {
+			if roundStartTime.Add(-roundNetworkWaitDuration).Add(workTime).Before(controller.config.clock.Now()) {
 				// Start over, after a brief pause, with a new shuffle of the server
 				// entries, and potentially some newly fetched server entries.
 				break
@@ -1549,15 +2087,16 @@ loop:
 
 				// Don't start the next candidate until either the server affinity
 				// candidate has completed (success or failure) or is still working
-				// and the grace period has elapsed.
+				// and the grace period has elapsed. A pinned server entry has its
+				// own grace period.
 
-				gracePeriod := controller.config.clientParameters.Get().Duration(
-					parameters.EstablishTunnelServerAffinityGracePeriod)
+				gracePeriod := serverEntryPolicy.getHeadCandidateGracePeriod(
+					controller.config.clientParameters.Get(), serverEntry.IpAddress)
 
 				if gracePeriod > 0 {
-					timer := time.NewTimer(gracePeriod)
+					timer := controller.config.clock.NewTimer(gracePeriod)
 					select {
-					case <-timer.C:
+					case <-timer.C():
 					case <-controller.serverAffinityDoneBroadcast:
 					case <-controller.establishCtx.Done():
 						timer.Stop()
@@ -1579,9 +2118,9 @@ loop:
 
 					timeout := common.JitterDuration(staggerPeriod, staggerJitter)
 
-					timer := time.NewTimer(timeout)
+					timer := controller.config.clock.NewTimer(timeout)
 					select {
-					case <-timer.C:
+					case <-timer.C():
 					case <-controller.establishCtx.Done():
 						timer.Stop()
 						break loop
@@ -1594,6 +2133,50 @@ loop:
 		// Free up resources now, but don't reset until after the pause.
 		iterator.Close()
 
+		// When the round ended with no active tunnels, check for a captive
+		// portal, which would cause every connection attempt to fail. The
+		// check runs in the background, concurrent with the following
+		// round, and its result is consumed at the end of a round.
+		//
+		// While a captive portal is detected, establishment is paused, and
+		// the time spent paused is excluded from reported establishment
+		// duration, as with waiting for network connectivity. Once the
+		// portal is cleared, establishment restarts from the first round,
+		// without a pause or the remote server list and upgrade fetches
+		// triggered below, which would also have been futile.
+
+		if activeTunnels, _ := controller.numTunnels(); activeTunnels == 0 {
+
+			var checkResult *captivePortalCheckResult
+			if captivePortalCheck != nil {
+				select {
+				case checkResult = <-captivePortalCheck:
+					captivePortalCheck = nil
+				default:
+				}
+			}
+
+			if checkResult != nil && checkResult.isCaptivePortal {
+
+				captivePortalWaitStartTime := controller.config.clock.Now()
+				if !controller.waitForCaptivePortalCleared(
+					controller.establishCtx, checkResult.portalURL) {
+					break loop
+				}
+
+				totalNetworkWaitDuration +=
+					controller.config.clock.Now().Sub(captivePortalWaitStartTime)
+				roundCount = 0
+				iterator.Reset()
+				continue
+			}
+
+			if captivePortalCheck == nil {
+				captivePortalCheck = controller.startCaptivePortalCheck(
+					controller.establishCtx)
+			}
+		}
+
 		// Trigger a common remote server list fetch, since we may have failed
 		// to connect with all known servers. Don't block sending signal, since
 		// this signal may have already been sent.
@@ -1614,6 +2197,18 @@ loop:
 		default:
 		}
 
+		// Trigger a stego server list fetch only after several rounds have
+		// failed, which indicates that the standard remote server list and OSL
+		// fetches may also be blocked.
+		if roundCount+1 >= controller.config.clientParameters.Get().Int(
+			parameters.StegoServerListFetchEstablishRounds) {
+
+			select {
+			case controller.signalFetchStegoServerLists <- *new(struct{}):
+			default:
+			}
+		}
+
 		// Trigger an out-of-band upgrade availability check and download.
 		// Since we may have failed to connect, we may benefit from upgrading
 		// to a new client version with new circumvention capabilities.
@@ -1627,16 +2222,28 @@ loop:
 		// network conditions to change. Also allows for fetch remote to complete,
 		// in typical conditions (it isn't strictly necessary to wait for this, there will
 		// be more rounds if required).
+		//
+		// The pause period backs off exponentially, from EstablishTunnelPausePeriod
+		// up to EstablishTunnelPausePeriodMax, so that long-running establishment
+		// doesn't retry at the same fixed cadence indefinitely.
 
 		p := controller.config.clientParameters.Get()
 		timeout := common.JitterDuration(
-			p.Duration(parameters.EstablishTunnelPausePeriod),
+			common.BackoffDuration(
+				p.Duration(parameters.EstablishTunnelPausePeriod),
+				p.Float(parameters.EstablishTunnelPausePeriodMultiplier),
+				p.Duration(parameters.EstablishTunnelPausePeriodMax),
+				roundCount),
 			p.Float(parameters.EstablishTunnelPausePeriodJitter))
+		if controller.getHostConditions().isConstrained() {
+			timeout = time.Duration(
+				float64(timeout) * p.Float(parameters.ConstrainedHostEstablishPauseMultiplier))
+		}
 		p = nil
 
-		timer := time.NewTimer(timeout)
+		timer := controller.config.clock.NewTimer(timeout)
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			// Retry iterating
 		case <-controller.establishCtx.Done():
 			timer.Stop()
@@ -1644,6 +2251,8 @@ loop:
 		}
 		timer.Stop()
 
+		roundCount += 1
+
 		iterator.Reset()
 	}
 }
@@ -1652,6 +2261,7 @@ loop:
 // a connection to the tunnel server, and delivers the connected tunnel to a channel.
 func (controller *Controller) establishTunnelWorker() {
 	defer controller.establishWaitGroup.Done()
+	defer controller.recoverPanic("establishTunnelWorker")
 loop:
 	for candidateServerEntry := range controller.candidateServerEntries {
 		// Note: don't receive from candidateServerEntries and isStopEstablishing
@@ -1689,10 +2299,23 @@ loop:
 			excludeIntensive = true
 		}
 
-		selectedProtocol, err := controller.establishLimitTunnelProtocolsState.selectProtocol(
-			controller.establishConnectTunnelCount,
-			excludeIntensive,
-			candidateServerEntry.serverEntry)
+		var selectedProtocol string
+		var err error
+
+		if candidateServerEntry.fastReconnectProtocol != "" {
+
+			// The fast reconnect candidate uses its recorded protocol. It's the
+			// first candidate, so the intensive limit need not be checked.
+			selectedProtocol = candidateServerEntry.fastReconnectProtocol
+
+		} else {
+
+			selectedProtocol, err = controller.establishLimitTunnelProtocolsState.selectProtocol(
+				controller.establishConnectTunnelCount,
+				excludeIntensive,
+				candidateServerEntry.serverEntry)
+		}
+
 		if err != nil {
 
 			controller.concurrentEstablishTunnelsMutex.Unlock()
@@ -1739,13 +2362,28 @@ loop:
 		// reclaim as much as possible.
 		DoGarbageCollection()
 
+		connectStartTime := monotime.Now()
+
+		connectCtx := controller.establishCtx
+		cancelConnect := func() {}
+		if candidateServerEntry.fastReconnectProtocol != "" {
+			connectCtx, cancelConnect = context.WithTimeout(
+				controller.establishCtx,
+				controller.config.clientParameters.Get().Duration(
+					parameters.FastReconnectTimeout))
+		}
+
 		tunnel, err := ConnectTunnel(
-			controller.establishCtx,
+			connectCtx,
 			controller.config,
 			controller.sessionId,
 			candidateServerEntry.serverEntry,
 			selectedProtocol,
-			candidateServerEntry.adjustedEstablishStartTime)
+			candidateServerEntry.replayDialParameters,
+			candidateServerEntry.adjustedEstablishStartTime,
+			controller.establishBudget)
+
+		cancelConnect()
 
 		controller.concurrentEstablishTunnelsMutex.Lock()
 		if isIntensive {
@@ -1754,6 +2392,25 @@ loop:
 		controller.concurrentEstablishTunnels -= 1
 		controller.concurrentEstablishTunnelsMutex.Unlock()
 
+		if !controller.isStopEstablishing() {
+
+			connectDuration := monotime.Since(connectStartTime)
+
+			if controller.config.EstablishmentStrategy != nil {
+				controller.config.EstablishmentStrategy.ReportResult(
+					candidateServerEntry.serverEntry,
+					selectedProtocol,
+					connectDuration,
+					err)
+			}
+
+			limitState := controller.establishLimitTunnelProtocolsState
+			if limitState.adaptiveSelection {
+				recordProtocolDial(
+					limitState.networkID, selectedProtocol, connectDuration, err == nil)
+			}
+		}
+
 		// Periodically emit memory metrics during the establishment cycle.
 		if !controller.isStopEstablishing() {
 			emitMemoryMetrics()
@@ -1783,8 +2440,22 @@ loop:
 				break loop
 			}
 
+			// A failed fast reconnect record is discarded, so that it's not
+			// retried in subsequent establishments.
+			if candidateServerEntry.fastReconnectProtocol != "" {
+				err := DeleteFastReconnectRecord(candidateServerEntry.fastReconnectNetworkID)
+				if err != nil {
+					NoticeAlert("failed to delete fast reconnect record: %s", err)
+				}
+			}
+
+			controller.recordTriedServer(candidateServerEntry.serverEntry.IpAddress)
+
 			NoticeInfo("failed to connect to %s: %s",
 				candidateServerEntry.serverEntry.IpAddress, err)
+			controller.setLastError(
+				fmt.Sprintf("failed to connect to %s: %s",
+					candidateServerEntry.serverEntry.IpAddress, err))
 
 			continue
 		}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Shutdown gracefully stops a running controller. Shutdown first stops
+// accepting new port forwards, so that Dial fails for new proxied
+// connections; then waits for in-flight tunneled port forwards to close;
+// and then stops Run, which closes all tunnels. Shutdown returns once Run
+// has stopped.
+//
+// ctx bounds only the wait for in-flight port forwards. When ctx is done
+// before all port forwards close, the remaining port forwards are closed
+// and Shutdown returns the ctx error, after stopping Run.
+//
+// Packet tunnel flows are not drained. Shutdown is a no-op when the
+// controller is not running.
+func (controller *Controller) Shutdown(ctx context.Context) error {
+
+	stateTransitions, unsubscribe := controller.SubscribeStateTransitions()
+	defer unsubscribe()
+
+	controller.stateMutex.Lock()
+	state := controller.getState()
+	stopRunning := controller.stopRunning
+	controller.stateMutex.Unlock()
+
+	if state == CONTROLLER_STATE_STOPPED {
+		return nil
+	}
+
+	atomic.StoreInt32(&controller.isDraining, 1)
+	defer atomic.StoreInt32(&controller.isDraining, 0)
+
+	NoticeInfo("draining %d port forwards", controller.countPortForwards())
+
+	drainErr := controller.drainPortForwards(ctx)
+	if drainErr != nil {
+		NoticeAlert(
+			"closing %d port forwards after drain: %s",
+			controller.countPortForwards(), drainErr)
+		controller.closePortForwards()
+	}
+
+	stopRunning()
+
+	for controller.State() != CONTROLLER_STATE_STOPPED {
+		transition, ok := <-stateTransitions
+		if !ok || transition.To == CONTROLLER_STATE_STOPPED {
+			break
+		}
+	}
+
+	if drainErr != nil {
+		return common.ContextError(drainErr)
+	}
+	return nil
+}
+
+// isDrainingPortForwards indicates that Shutdown is in progress and new port
+// forwards must be refused.
+func (controller *Controller) isDrainingPortForwards() bool {
+	return atomic.LoadInt32(&controller.isDraining) == 1
+}
+
+// drainPortForwards waits until there are no in-flight port forwards, or
+// until ctx is done.
+//
+// Keep-alive connections pooled by the local HTTP proxy are tracked port
+// forwards which won't close until the pool's idle timeout, so idle pooled
+// connections are closed before waiting. As active pooled connections may
+// become idle while draining, this is repeated whenever a port forward
+// closes.
+func (controller *Controller) drainPortForwards(ctx context.Context) error {
+	for {
+		controller.portForwardsMutex.Lock()
+		httpProxy := controller.httpProxy
+		controller.portForwardsMutex.Unlock()
+
+		if httpProxy != nil {
+			httpProxy.CloseIdleConnections()
+		}
+
+		controller.portForwardsMutex.Lock()
+		count := len(controller.portForwards)
+		signal := controller.signalPortForwardClosed
+		if signal == nil {
+			signal = make(chan struct{})
+			controller.signalPortForwardClosed = signal
+		}
+		controller.portForwardsMutex.Unlock()
+
+		if count == 0 {
+			return nil
+		}
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setHttpProxy sets the running local HTTP proxy, if any, whose pooled
+// connections are closed when draining.
+func (controller *Controller) setHttpProxy(httpProxy *HttpProxy) {
+	controller.portForwardsMutex.Lock()
+	defer controller.portForwardsMutex.Unlock()
+	controller.httpProxy = httpProxy
+}
+
+// trackPortForward registers an in-flight port forward, which is drained by
+// Shutdown. The returned conn must be used in place of conn, as its Close
+// unregisters the port forward.
+func (controller *Controller) trackPortForward(conn net.Conn) net.Conn {
+
+	trackedConn := &drainablePortForwardConn{
+		Conn:       conn,
+		controller: controller,
+	}
+
+	controller.portForwardsMutex.Lock()
+	if controller.portForwards == nil {
+		controller.portForwards = make(map[*drainablePortForwardConn]bool)
+	}
+	controller.portForwards[trackedConn] = true
+	controller.portForwardsMutex.Unlock()
+
+	return trackedConn
+}
+
+func (controller *Controller) untrackPortForward(conn *drainablePortForwardConn) {
+	controller.portForwardsMutex.Lock()
+	defer controller.portForwardsMutex.Unlock()
+	delete(controller.portForwards, conn)
+	if controller.signalPortForwardClosed != nil {
+		close(controller.signalPortForwardClosed)
+		controller.signalPortForwardClosed = nil
+	}
+}
+
+func (controller *Controller) countPortForwards() int {
+	controller.portForwardsMutex.Lock()
+	defer controller.portForwardsMutex.Unlock()
+	return len(controller.portForwards)
+}
+
+func (controller *Controller) closePortForwards() {
+	controller.portForwardsMutex.Lock()
+	conns := make([]*drainablePortForwardConn, 0, len(controller.portForwards))
+	for conn := range controller.portForwards {
+		conns = append(conns, conn)
+	}
+	controller.portForwardsMutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+type drainablePortForwardConn struct {
+	net.Conn
+	controller *Controller
+	closeOnce  sync.Once
+}
+
+func (conn *drainablePortForwardConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.controller.untrackPortForward(conn)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestControllerShutdown(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-controller-shutdown-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableLocalHTTPProxy" : true,
+        "DisableTactics" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	t.Run("drained", func(t *testing.T) {
+		testControllerShutdown(t, clientConfig, true)
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		testControllerShutdown(t, clientConfig, false)
+	})
+}
+
+func testControllerShutdown(t *testing.T, config *Config, drain bool) {
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	// Shutdown is a no-op before Run.
+
+	err = controller.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+
+	transitions, unsubscribe := controller.SubscribeStateTransitions()
+	defer unsubscribe()
+
+	runWaitGroup := new(sync.WaitGroup)
+	runWaitGroup.Add(1)
+	go func() {
+		defer runWaitGroup.Done()
+		controller.Run(context.Background())
+	}()
+
+	<-transitions
+
+	// Simulate an in-flight port forward. Tunneled port forwards returned
+	// by Dial are tracked in the same way.
+
+	localConn, remoteConn := net.Pipe()
+	defer remoteConn.Close()
+	portForward := controller.trackPortForward(localConn)
+
+	shutdownTimeout := 5 * time.Second
+	if !drain {
+		shutdownTimeout = 100 * time.Millisecond
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelFunc()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- controller.Shutdown(ctx)
+	}()
+
+	// New port forwards are refused while draining.
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !controller.isDrainingPortForwards() {
+		if time.Now().After(deadline) {
+			t.Fatalf("controller not draining")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	_, err = controller.Dial("127.0.0.1:80", true, nil)
+	if err == nil {
+		t.Fatalf("unexpected Dial success while draining")
+	}
+
+	if drain {
+
+		// The controller keeps running while the port forward is in flight.
+
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("unexpected Shutdown return: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if controller.State() == CONTROLLER_STATE_STOPPING ||
+			controller.State() == CONTROLLER_STATE_STOPPED {
+			t.Fatalf("unexpected state: %s", controller.State())
+		}
+
+		portForward.Close()
+
+		err = <-shutdownErr
+		if err != nil {
+			t.Fatalf("Shutdown failed: %s", err)
+		}
+
+	} else {
+
+		err = <-shutdownErr
+		if err == nil {
+			t.Fatalf("unexpected Shutdown success")
+		}
+
+		// The remaining port forward is closed.
+
+		_, err = remoteConn.Write([]byte{0})
+		if err == nil {
+			t.Fatalf("unexpected open port forward")
+		}
+	}
+
+	if controller.State() != CONTROLLER_STATE_STOPPED {
+		t.Fatalf("unexpected state: %s", controller.State())
+	}
+
+	if controller.countPortForwards() != 0 {
+		t.Fatalf("unexpected port forwards: %d", controller.countPortForwards())
+	}
+
+	runWaitGroup.Wait()
+}
+
+func TestControllerShutdownPooledConnections(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-controller-shutdown-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableTactics" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, _ *http.Request) {
+			responseWriter.Write([]byte("ok"))
+		}))
+	defer server.Close()
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	runWaitGroup := new(sync.WaitGroup)
+	runWaitGroup.Add(1)
+	go func() {
+		defer runWaitGroup.Done()
+		controller.Run(context.Background())
+	}()
+	defer runWaitGroup.Wait()
+
+	var httpProxy *HttpProxy
+	deadline := time.Now().Add(5 * time.Second)
+	for httpProxy == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("HTTP proxy not running")
+		}
+		time.Sleep(1 * time.Millisecond)
+		controller.portForwardsMutex.Lock()
+		httpProxy = controller.httpProxy
+		controller.portForwardsMutex.Unlock()
+	}
+
+	// Simulate a tunneled keep-alive connection pooled by the HTTP proxy
+	// transport. The dial is tracked as a port forward, as with Dial.
+
+	transport := httpProxy.httpProxyTunneledRelay
+	transport.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return controller.trackPortForward(conn), nil
+	}
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %s", err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	// The connection is returned to the pool asynchronously.
+
+	deadline = time.Now().Add(5 * time.Second)
+	for controller.countPortForwards() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected port forwards: %d", controller.countPortForwards())
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Shutdown doesn't wait for the idle pooled connection.
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	err = controller.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+
+	if controller.countPortForwards() != 0 {
+		t.Fatalf("unexpected port forwards: %d", controller.countPortForwards())
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+// controllerSnapshotKey is the datastore key/value key under which the
+// most recent controller snapshot is stored.
+const controllerSnapshotKey = "controllerSnapshot"
+
+// ControllerSnapshot is the establishment context persisted by
+// Controller.Snapshot and applied by Controller.ResumeFromSnapshot.
+type ControllerSnapshot struct {
+
+	// Time is when the snapshot was taken.
+	Time time.Time
+
+	// NetworkID is the network ID key at the time of the snapshot. A
+	// snapshot is only resumed on the same network.
+	NetworkID string
+
+	// EstablishRoundCount is the number of completed establishment rounds
+	// in the in-progress establishment, which determines the establishment
+	// pause backoff.
+	EstablishRoundCount int
+
+	// TriedServers are the IP addresses of candidates that failed to
+	// connect in the in-progress establishment.
+	TriedServers []string
+
+	// AffinityServers are the IP addresses of the servers of the active
+	// tunnels.
+	AffinityServers []string
+
+	// TacticsTag is the tag of the applied tactics.
+	TacticsTag string
+}
+
+// Snapshot captures the establishment context and persists it to the
+// datastore, so that a host application that is killed by the OS may
+// call ResumeFromSnapshot, when restarted, to resume establishment roughly
+// where it left off. Host applications should call Snapshot when
+// backgrounded. Snapshot may be called concurrently with Run.
+func (controller *Controller) Snapshot() (*ControllerSnapshot, error) {
+
+	snapshot := &ControllerSnapshot{
+		Time:                time.Now(),
+		NetworkID:           getNetworkIDKey(controller.config),
+		EstablishRoundCount: int(atomic.LoadInt32(&controller.establishRoundCount)),
+		TacticsTag:          controller.config.clientParameters.Get().Tag(),
+	}
+
+	controller.triedServersMutex.Lock()
+	for ipAddress := range controller.triedServers {
+		snapshot.TriedServers = append(snapshot.TriedServers, ipAddress)
+	}
+	controller.triedServersMutex.Unlock()
+	sort.Strings(snapshot.TriedServers)
+
+	controller.tunnelMutex.Lock()
+	for _, tunnel := range controller.tunnels {
+		snapshot.AffinityServers = append(
+			snapshot.AffinityServers, tunnel.serverEntry.IpAddress)
+	}
+	controller.tunnelMutex.Unlock()
+
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = SetKeyValue(controllerSnapshotKey, string(value))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return snapshot, nil
+}
+
+// ResumeFromSnapshot loads the snapshot persisted by Snapshot and applies it
+// to the next establishment:
+//
+//   - the first affinity server is promoted to be the server affinity
+//     candidate;
+//
+//   - the stored tactics with the snapshot tactics tag are applied
+//     immediately, even if expired, rather than waiting on a tactics request;
+//
+//   - servers that were already tried are deferred to the end of the first
+//     establishment round;
+//
+// - the establishment pause backoff continues from the snapshot round count.
+//
+// A snapshot is used at most once, and is ignored when it's older than
+// ControllerSnapshotMaxAge or was taken on a different network.
+// ResumeFromSnapshot returns false when there is no usable snapshot.
+// ResumeFromSnapshot must be called before Run.
+func (controller *Controller) ResumeFromSnapshot() (bool, error) {
+
+	value, err := GetKeyValue(controllerSnapshotKey)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	// Consume the snapshot, so that a stale context isn't repeatedly
+	// resumed.
+	err = SetKeyValue(controllerSnapshotKey, "")
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	var snapshot *ControllerSnapshot
+	err = json.Unmarshal([]byte(value), &snapshot)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	if snapshot == nil {
+		return false, common.ContextError(errors.New("invalid snapshot"))
+	}
+
+	maxAge := controller.config.clientParameters.Get().Duration(
+		parameters.ControllerSnapshotMaxAge)
+	if time.Since(snapshot.Time) > maxAge {
+		NoticeInfo("controller snapshot expired")
+		return false, nil
+	}
+
+	if snapshot.NetworkID != getNetworkIDKey(controller.config) {
+		NoticeInfo("controller snapshot network mismatch")
+		return false, nil
+	}
+
+	if len(snapshot.AffinityServers) > 0 {
+		err := PromoteServerEntry(controller.config, snapshot.AffinityServers[0])
+		if err != nil {
+			NoticeAlert("failed to promote snapshot affinity server: %s", err)
+		}
+	}
+
+	if snapshot.TacticsTag != "" &&
+		!controller.config.DisableTactics &&
+		controller.config.networkIDGetter != nil {
+
+		controller.applySnapshotTactics(snapshot.TacticsTag)
+	}
+
+	controller.resumeSnapshot = snapshot
+
+	NoticeInfo(
+		"resuming from controller snapshot: %d rounds, %d tried servers",
+		snapshot.EstablishRoundCount, len(snapshot.TriedServers))
+
+	return true, nil
+}
+
+func (controller *Controller) applySnapshotTactics(tag string) {
+
+	record, err := tactics.GetStoredTactics(
+		GetTacticsStorer(),
+		controller.config.getTacticsNetworkID())
+	if err != nil {
+		NoticeAlert("get stored tactics failed: %s", err)
+		return
+	}
+
+	if record.Tag != tag {
+		return
+	}
+
+	err = controller.config.SetClientParameters(
+		record.Tag, true, record.Tactics.Parameters)
+	if err != nil {
+		NoticeAlert("apply snapshot tactics failed: %s", err)
+	}
+}
+
+// recordTriedServer records a candidate that failed to connect in the
+// in-progress establishment.
+func (controller *Controller) recordTriedServer(ipAddress string) {
+	controller.triedServersMutex.Lock()
+	defer controller.triedServersMutex.Unlock()
+	if controller.triedServers == nil {
+		controller.triedServers = make(map[string]bool)
+	}
+	controller.triedServers[ipAddress] = true
+}
+
+// resetEstablishmentContext clears the establishment context recorded for
+// Snapshot, when establishment stops.
+func (controller *Controller) resetEstablishmentContext() {
+	controller.triedServersMutex.Lock()
+	controller.triedServers = nil
+	controller.triedServersMutex.Unlock()
+	atomic.StoreInt32(&controller.establishRoundCount, 0)
+}
+
+// takeResumeSnapshot returns and clears the snapshot to apply to the next
+// establishment, if any.
+func (controller *Controller) takeResumeSnapshot() *ControllerSnapshot {
+	controller.triedServersMutex.Lock()
+	defer controller.triedServersMutex.Unlock()
+	snapshot := controller.resumeSnapshot
+	controller.resumeSnapshot = nil
+	return snapshot
+}
+
+// deferredCandidates wraps a candidate source and defers the given servers
+// until all other candidates have been returned.
+type deferredCandidates struct {
+	next      func() (*protocol.ServerEntry, error)
+	deferred  map[string]bool
+	queue     []*protocol.ServerEntry
+	exhausted bool
+}
+
+func newDeferredCandidates(
+	next func() (*protocol.ServerEntry, error),
+	deferServers []string) *deferredCandidates {
+
+	deferred := make(map[string]bool)
+	for _, ipAddress := range deferServers {
+		deferred[ipAddress] = true
+	}
+
+	return &deferredCandidates{
+		next:     next,
+		deferred: deferred,
+	}
+}
+
+func (candidates *deferredCandidates) Next() (*protocol.ServerEntry, error) {
+
+	for !candidates.exhausted {
+		serverEntry, err := candidates.next()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if serverEntry == nil {
+			candidates.exhausted = true
+			break
+		}
+		if candidates.deferred[serverEntry.IpAddress] {
+			candidates.queue = append(candidates.queue, serverEntry)
+			continue
+		}
+		return serverEntry, nil
+	}
+
+	if len(candidates.queue) == 0 {
+		return nil, nil
+	}
+	serverEntry := candidates.queue[0]
+	candidates.queue = candidates.queue[1:]
+	return serverEntry, nil
+}
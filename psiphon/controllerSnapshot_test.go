@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+func TestControllerSnapshot(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-controller-snapshot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "NetworkID" : "WIFI-TEST"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverIPAddresses := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for _, serverIPAddress := range serverIPAddresses {
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            serverIPAddress,
+				"configurationVersion": 1,
+				"capabilities":         []string{"SSH", "OSSH"},
+			},
+			false)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	// Snapshot an establishment in progress.
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	affinityServer, err := getServerEntry(serverIPAddresses[2])
+	if err != nil {
+		t.Fatalf("getServerEntry failed: %s", err)
+	}
+
+	controller.recordTriedServer(serverIPAddresses[1])
+	controller.recordTriedServer(serverIPAddresses[0])
+	controller.establishRoundCount = 3
+	controller.tunnels = []*Tunnel{{serverEntry: affinityServer}}
+
+	snapshot, err := controller.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	if snapshot.NetworkID != "WIFI-TEST" ||
+		snapshot.EstablishRoundCount != 3 ||
+		!reflect.DeepEqual(snapshot.TriedServers, serverIPAddresses[0:2]) ||
+		!reflect.DeepEqual(snapshot.AffinityServers, serverIPAddresses[2:3]) {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+
+	// Resume in a new controller.
+
+	controller, err = NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	resumed, err := controller.ResumeFromSnapshot()
+	if err != nil || !resumed {
+		t.Fatalf("ResumeFromSnapshot failed: %v", err)
+	}
+
+	resumeSnapshot := controller.takeResumeSnapshot()
+	if resumeSnapshot == nil || resumeSnapshot.EstablishRoundCount != 3 {
+		t.Fatalf("unexpected resume snapshot: %+v", resumeSnapshot)
+	}
+
+	// The affinity server is promoted.
+
+	applyServerAffinity, iterator, err := NewServerEntryIterator(clientConfig)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	serverEntry, err := iterator.Next()
+	iterator.Close()
+	if err != nil || !applyServerAffinity || serverEntry.IpAddress != serverIPAddresses[2] {
+		t.Fatalf("unexpected affinity server: %v", err)
+	}
+
+	// Tried servers are deferred to the end of the round.
+
+	candidates := newDeferredCandidates(
+		newTestCandidateSource(serverIPAddresses), resumeSnapshot.TriedServers)
+	var order []string
+	for {
+		serverEntry, err := candidates.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		order = append(order, serverEntry.IpAddress)
+	}
+	expectedOrder := []string{serverIPAddresses[2], serverIPAddresses[0], serverIPAddresses[1]}
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Fatalf("unexpected candidate order: %v", order)
+	}
+
+	// A snapshot is resumed only once.
+
+	resumed, err = controller.ResumeFromSnapshot()
+	if err != nil || resumed {
+		t.Fatalf("unexpected ResumeFromSnapshot result: %v, %v", resumed, err)
+	}
+
+	// A snapshot from another network is not resumed.
+
+	storeSnapshot := func(snapshot *ControllerSnapshot) {
+		value, _ := json.Marshal(snapshot)
+		err := SetKeyValue(controllerSnapshotKey, string(value))
+		if err != nil {
+			t.Fatalf("SetKeyValue failed: %s", err)
+		}
+	}
+
+	storeSnapshot(&ControllerSnapshot{Time: time.Now(), NetworkID: "WIFI-OTHER"})
+
+	resumed, err = controller.ResumeFromSnapshot()
+	if err != nil || resumed {
+		t.Fatalf("unexpected ResumeFromSnapshot result: %v, %v", resumed, err)
+	}
+
+	// An expired snapshot is not resumed.
+
+	storeSnapshot(&ControllerSnapshot{
+		Time:      time.Now().Add(-2 * time.Hour),
+		NetworkID: "WIFI-TEST",
+	})
+
+	resumed, err = controller.ResumeFromSnapshot()
+	if err != nil || resumed {
+		t.Fatalf("unexpected ResumeFromSnapshot result: %v, %v", resumed, err)
+	}
+
+	// Stored tactics with the snapshot tag are applied.
+
+	tacticsJSON, _ := json.Marshal(&tactics.Tactics{
+		TTL:         "1ns",
+		Probability: 1.0,
+		Parameters: map[string]interface{}{
+			parameters.ConnectionWorkerPoolSize: 7,
+		},
+	})
+	_, err = tactics.HandleTacticsPayload(
+		GetTacticsStorer(),
+		"WIFI-TEST",
+		nil,
+		&tactics.Payload{Tag: "TACTICS-TAG", Tactics: tacticsJSON})
+	if err != nil {
+		t.Fatalf("HandleTacticsPayload failed: %s", err)
+	}
+
+	storeSnapshot(&ControllerSnapshot{
+		Time:       time.Now(),
+		NetworkID:  "WIFI-TEST",
+		TacticsTag: "TACTICS-TAG",
+	})
+
+	resumed, err = controller.ResumeFromSnapshot()
+	if err != nil || !resumed {
+		t.Fatalf("ResumeFromSnapshot failed: %v", err)
+	}
+
+	p := clientConfig.clientParameters.Get()
+	if p.Tag() != "TACTICS-TAG" || p.Int(parameters.ConnectionWorkerPoolSize) != 7 {
+		t.Fatalf("unexpected tactics: %s", p.Tag())
+	}
+}
+
+func newTestCandidateSource(
+	serverIPAddresses []string) func() (*protocol.ServerEntry, error) {
+
+	index := 0
+	return func() (*protocol.ServerEntry, error) {
+		if index >= len(serverIPAddresses) {
+			return nil, nil
+		}
+		serverEntry := &protocol.ServerEntry{IpAddress: serverIPAddresses[index]}
+		index++
+		return serverEntry, nil
+	}
+}
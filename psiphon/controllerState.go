@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+// Controller lifecycle states. A controller is CONTROLLER_STATE_STOPPED
+// before and after Run. While running, the state reflects the active tunnel
+// pool: CONTROLLER_STATE_ESTABLISHING when there are no active tunnels,
+// CONTROLLER_STATE_DEGRADED when there are some active tunnels but fewer
+// than the target pool size, and CONTROLLER_STATE_CONNECTED when the pool is
+// full. CONTROLLER_STATE_STOPPING is from when Run is stopped until it
+// returns.
+const (
+	CONTROLLER_STATE_STOPPED      = "stopped"
+	CONTROLLER_STATE_ESTABLISHING = "establishing"
+	CONTROLLER_STATE_CONNECTED    = "connected"
+	CONTROLLER_STATE_DEGRADED     = "degraded"
+	CONTROLLER_STATE_STOPPING     = "stopping"
+)
+
+// controllerStateTransitions lists the valid transitions from each state.
+var controllerStateTransitions = map[string][]string{
+	CONTROLLER_STATE_STOPPED: {
+		CONTROLLER_STATE_ESTABLISHING,
+	},
+	CONTROLLER_STATE_ESTABLISHING: {
+		CONTROLLER_STATE_CONNECTED,
+		CONTROLLER_STATE_DEGRADED,
+		CONTROLLER_STATE_STOPPING,
+	},
+	CONTROLLER_STATE_CONNECTED: {
+		CONTROLLER_STATE_ESTABLISHING,
+		CONTROLLER_STATE_DEGRADED,
+		CONTROLLER_STATE_STOPPING,
+	},
+	CONTROLLER_STATE_DEGRADED: {
+		CONTROLLER_STATE_ESTABLISHING,
+		CONTROLLER_STATE_CONNECTED,
+		CONTROLLER_STATE_STOPPING,
+	},
+	CONTROLLER_STATE_STOPPING: {
+		CONTROLLER_STATE_STOPPED,
+	},
+}
+
+// controllerStateSubscriberBufferSize is the number of transitions buffered
+// for each subscriber. Transitions are dropped for subscribers that fall
+// further behind, so that a slow subscriber can't block the controller.
+const controllerStateSubscriberBufferSize = 32
+
+// ControllerStateTransition is a controller state change, delivered to
+// subscribers registered with SubscribeStateTransitions.
+type ControllerStateTransition struct {
+	From          string
+	To            string
+	Time          time.Time
+	ActiveTunnels int
+}
+
+// State returns the current controller state.
+func (controller *Controller) State() string {
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+	return controller.getState()
+}
+
+// SubscribeStateTransitions registers a subscriber that receives all
+// subsequent controller state transitions. The returned function
+// unsubscribes and closes the channel. Subscribe before calling Run to
+// observe all transitions.
+//
+// The channel is buffered. When a subscriber doesn't keep up, transitions
+// are dropped rather than blocking the controller; the current state is
+// always available via State.
+func (controller *Controller) SubscribeStateTransitions() (
+	<-chan ControllerStateTransition, func()) {
+
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+
+	if controller.stateSubscribers == nil {
+		controller.stateSubscribers = make(map[chan ControllerStateTransition]bool)
+	}
+
+	subscriber := make(chan ControllerStateTransition, controllerStateSubscriberBufferSize)
+	controller.stateSubscribers[subscriber] = true
+
+	unsubscribe := func() {
+		controller.stateMutex.Lock()
+		defer controller.stateMutex.Unlock()
+		if controller.stateSubscribers[subscriber] {
+			delete(controller.stateSubscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return subscriber, unsubscribe
+}
+
+// getState must be called with stateMutex held.
+func (controller *Controller) getState() string {
+	if controller.state == "" {
+		return CONTROLLER_STATE_STOPPED
+	}
+	return controller.state
+}
+
+// tunnelPoolState returns the running state corresponding to the number of
+// active tunnels and the target pool size.
+func tunnelPoolState(activeTunnels, tunnelPoolSize int) string {
+	if activeTunnels == 0 {
+		return CONTROLLER_STATE_ESTABLISHING
+	} else if activeTunnels < tunnelPoolSize {
+		return CONTROLLER_STATE_DEGRADED
+	}
+	return CONTROLLER_STATE_CONNECTED
+}
+
+// updateTunnelPoolState applies a state transition, if required, following
+// a change to the active tunnel pool or the target pool size. The
+// transition is not applied when the controller is not running, as Run
+// alone drives the STOPPED and STOPPING states. updateTunnelPoolState must
+// be called with tunnelMutex held.
+func (controller *Controller) updateTunnelPoolState() {
+
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+
+	state := controller.getState()
+	if state == CONTROLLER_STATE_STOPPED || state == CONTROLLER_STATE_STOPPING {
+		return
+	}
+
+	// Tunnels are terminated as the controller shuts down, which may be
+	// observed here before Run calls setStateStopping.
+	if controller.runCtx != nil && controller.runCtx.Err() != nil {
+		controller.transitionState(
+			CONTROLLER_STATE_STOPPING, len(controller.tunnels))
+		return
+	}
+
+	controller.transitionState(
+		tunnelPoolState(len(controller.tunnels), controller.tunnelPoolSize),
+		len(controller.tunnels))
+}
+
+// setStateStarting transitions from STOPPED, when Run starts.
+func (controller *Controller) setStateStarting() {
+
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+
+	controller.transitionState(
+		CONTROLLER_STATE_ESTABLISHING, len(controller.tunnels))
+	controller.transitionState(
+		tunnelPoolState(len(controller.tunnels), controller.tunnelPoolSize),
+		len(controller.tunnels))
+}
+
+// setStateStopping transitions to STOPPING, when Run is stopped. Redundant
+// calls are ignored.
+func (controller *Controller) setStateStopping() {
+
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+
+	if controller.getState() == CONTROLLER_STATE_STOPPING {
+		return
+	}
+
+	controller.transitionState(
+		CONTROLLER_STATE_STOPPING, len(controller.tunnels))
+}
+
+// setStateStopped transitions to STOPPED, via STOPPING, when Run returns.
+func (controller *Controller) setStateStopped() {
+
+	controller.setStateStopping()
+
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+
+	controller.transitionState(
+		CONTROLLER_STATE_STOPPED, len(controller.tunnels))
+}
+
+// transitionState applies and publishes a state transition. A transition to
+// the current state is a no-op. An invalid transition indicates a
+// controller bug; it's logged and not applied. transitionState must be
+// called with stateMutex held.
+func (controller *Controller) transitionState(to string, activeTunnels int) {
+
+	from := controller.getState()
+	if from == to {
+		return
+	}
+
+	isValid := false
+	for _, validTo := range controllerStateTransitions[from] {
+		if validTo == to {
+			isValid = true
+			break
+		}
+	}
+	if !isValid {
+		NoticeAlert("invalid controller state transition: %s -> %s", from, to)
+		return
+	}
+
+	controller.state = to
+
+	NoticeControllerState(from, to, activeTunnels)
+
+	transition := ControllerStateTransition{
+		From:          from,
+		To:            to,
+		Time:          time.Now(),
+		ActiveTunnels: activeTunnels,
+	}
+
+	for subscriber := range controller.stateSubscribers {
+		select {
+		case subscriber <- transition:
+		default:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestControllerStateTransitions(t *testing.T) {
+
+	controller := &Controller{
+		config:         &Config{},
+		tunnelPoolSize: 2,
+	}
+
+	transitions, unsubscribe := controller.SubscribeStateTransitions()
+
+	setTunnels := func(count int) {
+		controller.tunnelMutex.Lock()
+		defer controller.tunnelMutex.Unlock()
+		controller.tunnels = nil
+		for i := 0; i < count; i++ {
+			controller.tunnels = append(controller.tunnels, &Tunnel{
+				protocol:    protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+				serverEntry: &protocol.ServerEntry{},
+			})
+		}
+		controller.updateTunnelPoolState()
+	}
+
+	// Tunnel pool changes while stopped don't transition.
+	setTunnels(1)
+	setTunnels(0)
+
+	controller.setRunning(true)
+	setTunnels(1)
+	setTunnels(2)
+	setTunnels(1)
+	setTunnels(0)
+	setTunnels(2)
+	controller.setRunning(false)
+
+	// Tunnel pool changes while stopped don't transition.
+	setTunnels(0)
+
+	expected := []struct {
+		from, to      string
+		activeTunnels int
+	}{
+		{CONTROLLER_STATE_STOPPED, CONTROLLER_STATE_ESTABLISHING, 0},
+		{CONTROLLER_STATE_ESTABLISHING, CONTROLLER_STATE_DEGRADED, 1},
+		{CONTROLLER_STATE_DEGRADED, CONTROLLER_STATE_CONNECTED, 2},
+		{CONTROLLER_STATE_CONNECTED, CONTROLLER_STATE_DEGRADED, 1},
+		{CONTROLLER_STATE_DEGRADED, CONTROLLER_STATE_ESTABLISHING, 0},
+		{CONTROLLER_STATE_ESTABLISHING, CONTROLLER_STATE_CONNECTED, 2},
+		{CONTROLLER_STATE_CONNECTED, CONTROLLER_STATE_STOPPING, 2},
+		{CONTROLLER_STATE_STOPPING, CONTROLLER_STATE_STOPPED, 2},
+	}
+
+	for i, e := range expected {
+		select {
+		case transition := <-transitions:
+			if transition.From != e.from ||
+				transition.To != e.to ||
+				transition.ActiveTunnels != e.activeTunnels ||
+				transition.Time.IsZero() {
+				t.Fatalf("unexpected transition %d: %+v", i, transition)
+			}
+		default:
+			t.Fatalf("missing transition %d", i)
+		}
+	}
+
+	select {
+	case transition := <-transitions:
+		t.Fatalf("unexpected transition: %+v", transition)
+	default:
+	}
+
+	// Invalid transitions are not applied.
+
+	controller.stateMutex.Lock()
+	controller.transitionState(CONTROLLER_STATE_CONNECTED, 0)
+	controller.stateMutex.Unlock()
+
+	if controller.State() != CONTROLLER_STATE_STOPPED {
+		t.Fatalf("unexpected state: %s", controller.State())
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	_, ok := <-transitions
+	if ok {
+		t.Fatalf("unexpected open subscriber channel")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// ControllerStatus is a snapshot of the controller state, returned by
+// Controller.Status.
+type ControllerStatus struct {
+
+	// State is the controller lifecycle state; see CONTROLLER_STATE_STOPPED
+	// and the other CONTROLLER_STATE values.
+	State string
+
+	// ActiveTunnels is the number of active tunnels.
+	ActiveTunnels int
+
+	// TunnelProtocols and TunnelRegions are the tunnel protocol and server
+	// region of each active tunnel.
+	TunnelProtocols []string
+	TunnelRegions   []string
+
+	// EgressRegion is the configured egress region. "" indicates the best
+	// performing region.
+	EgressRegion string
+
+	// LastError is the most recent tunnel establishment or tunnel failure
+	// error, and LastErrorTime is when it occurred. LastError is "" when
+	// no error has occurred.
+	LastError     string
+	LastErrorTime time.Time
+
+	// Uptime is the time elapsed since Run started. Uptime is 0 when Run is
+	// not running.
+	Uptime time.Duration
+
+	// BytesSent and BytesReceived are the total bytes transferred through
+	// all tunnels established by the controller.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Status returns a snapshot of the controller state. Status is safe to call
+// concurrently with Run, and may be called before or after Run.
+func (controller *Controller) Status() *ControllerStatus {
+
+	status := &ControllerStatus{
+		State:         controller.State(),
+		EgressRegion:  controller.config.GetEgressRegion(),
+		BytesSent:     atomic.LoadInt64(&controller.bytesSent),
+		BytesReceived: atomic.LoadInt64(&controller.bytesReceived),
+	}
+
+	controller.statusMutex.Lock()
+	isRunning := controller.isRunning
+	if isRunning {
+		status.Uptime = monotime.Since(controller.runStartTime)
+	}
+	status.LastError = controller.lastError
+	status.LastErrorTime = controller.lastErrorTime
+	controller.statusMutex.Unlock()
+
+	controller.tunnelMutex.Lock()
+	status.ActiveTunnels = len(controller.tunnels)
+	for _, tunnel := range controller.tunnels {
+		status.TunnelProtocols = append(status.TunnelProtocols, tunnel.protocol)
+		status.TunnelRegions = append(status.TunnelRegions, tunnel.serverEntry.Region)
+	}
+	controller.tunnelMutex.Unlock()
+
+	return status
+}
+
+// setRunning records whether Run is running, for Status, and applies the
+// corresponding state transition.
+func (controller *Controller) setRunning(isRunning bool) {
+	controller.statusMutex.Lock()
+	controller.isRunning = isRunning
+	if isRunning {
+		controller.runStartTime = monotime.Now()
+	}
+	controller.statusMutex.Unlock()
+
+	if isRunning {
+		controller.setStateStarting()
+	} else {
+		controller.setStateStopped()
+	}
+}
+
+// setLastError records the most recent tunnel error, for Status.
+func (controller *Controller) setLastError(errorMessage string) {
+	controller.statusMutex.Lock()
+	defer controller.statusMutex.Unlock()
+	controller.lastError = errorMessage
+	controller.lastErrorTime = time.Now()
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestControllerStatus(t *testing.T) {
+
+	config := &Config{EgressRegion: "CA"}
+	config.SetEgressRegion(config.EgressRegion)
+
+	controller := &Controller{
+		config:         config,
+		tunnelPoolSize: 1,
+	}
+
+	status := controller.Status()
+	if status.State != CONTROLLER_STATE_STOPPED ||
+		status.EgressRegion != "CA" ||
+		status.Uptime != 0 {
+
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	controller.setRunning(true)
+
+	status = controller.Status()
+	if status.State != CONTROLLER_STATE_ESTABLISHING ||
+		status.ActiveTunnels != 0 {
+
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	controller.setLastError("failed to connect")
+	controller.tunnelMutex.Lock()
+	controller.tunnels = []*Tunnel{
+		{
+			protocol:    protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			serverEntry: &protocol.ServerEntry{Region: "US"},
+		},
+	}
+	controller.updateTunnelPoolState()
+	controller.tunnelMutex.Unlock()
+
+	status = controller.Status()
+	if status.State != CONTROLLER_STATE_CONNECTED ||
+		status.ActiveTunnels != 1 ||
+		status.TunnelProtocols[0] != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+		status.TunnelRegions[0] != "US" ||
+		status.LastError != "failed to connect" ||
+		status.LastErrorTime.IsZero() {
+
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	controller.setRunning(false)
+
+	status = controller.Status()
+	if status.State != CONTROLLER_STATE_STOPPED {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
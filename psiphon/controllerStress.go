@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// ControllerStressParameters configures StressControllerLifecycle.
+type ControllerStressParameters struct {
+
+	// Duration is how long to keep starting new controllers. Controllers
+	// running at the end of Duration are stopped before
+	// StressControllerLifecycle returns.
+	Duration time.Duration
+
+	// MaxConcurrentControllers is the maximum number of controllers that
+	// may be running, or stopping, at the same time. When 0, a default of
+	// 2 is used.
+	MaxConcurrentControllers int
+
+	// MaxControllerLifetime is the upper bound for the randomly selected
+	// period each controller is run before it is stopped. When 0, a
+	// default of 5 seconds is used.
+	MaxControllerLifetime time.Duration
+
+	// MaxAPICallInterval is the upper bound for the random interval between
+	// concurrent API calls made against each controller. When 0, a default
+	// of 100 milliseconds is used.
+	MaxAPICallInterval time.Duration
+
+	// StopTimeout is how long to wait for a canceled controller to stop
+	// before reporting a lifecycle failure. When 0, a default of 30
+	// seconds is used.
+	StopTimeout time.Duration
+
+	// EgressRegions is the set of regions randomly passed to
+	// SetEgressRegion. The empty region is always included.
+	EgressRegions []string
+}
+
+// ControllerStressResult reports the activity performed by
+// StressControllerLifecycle.
+type ControllerStressResult struct {
+	ControllersStarted int64
+	APICalls           int64
+}
+
+// StressControllerLifecycle starts and stops controllers with randomized,
+// overlapping timings while concurrently making controller API calls, such
+// as SetEgressRegion and TerminateNextActiveTunnel. API calls are made
+// throughout each controller's lifetime, including while it's starting and
+// after it's stopped. This is intended to flush out lifecycle races, and
+// should be run with the race detector enabled.
+//
+// config must be committed and the datastore must be open. All controllers
+// share config, as they would when a host application restarts the
+// controller.
+//
+// An error is returned when a controller fails to stop within StopTimeout,
+// which indicates a lifecycle deadlock.
+func StressControllerLifecycle(
+	ctx context.Context,
+	config *Config,
+	params *ControllerStressParameters) (*ControllerStressResult, error) {
+
+	maxConcurrentControllers := params.MaxConcurrentControllers
+	if maxConcurrentControllers <= 0 {
+		maxConcurrentControllers = 2
+	}
+	maxControllerLifetime := params.MaxControllerLifetime
+	if maxControllerLifetime <= 0 {
+		maxControllerLifetime = 5 * time.Second
+	}
+	maxAPICallInterval := params.MaxAPICallInterval
+	if maxAPICallInterval <= 0 {
+		maxAPICallInterval = 100 * time.Millisecond
+	}
+	stopTimeout := params.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = 30 * time.Second
+	}
+	egressRegions := append([]string{""}, params.EgressRegions...)
+
+	stressCtx, stopStress := context.WithTimeout(ctx, params.Duration)
+	defer stopStress()
+
+	result := &ControllerStressResult{}
+	slots := make(chan struct{}, maxConcurrentControllers)
+	errs := make(chan error, 1)
+	waitGroup := new(sync.WaitGroup)
+
+	randomPeriod := func(max time.Duration) time.Duration {
+		period, _ := common.MakeSecureRandomPeriod(0, max)
+		return period
+	}
+
+	runController := func(controller *Controller) {
+		defer waitGroup.Done()
+		defer func() { <-slots }()
+
+		controllerCtx, stopController := context.WithTimeout(
+			stressCtx, randomPeriod(maxControllerLifetime))
+		defer stopController()
+
+		stopped := make(chan struct{})
+		abandoned := make(chan struct{})
+
+		apiWaitGroup := new(sync.WaitGroup)
+		apiWaitGroup.Add(1)
+		go func() {
+			defer apiWaitGroup.Done()
+
+			// Continue making API calls for a short period after the
+			// controller stops, as host applications may.
+			controllerStopped := stopped
+			var stopCalls <-chan time.Time
+			for {
+				select {
+				case <-controllerStopped:
+					controllerStopped = nil
+					stopCalls = time.After(randomPeriod(maxAPICallInterval))
+				case <-stopCalls:
+					return
+				case <-abandoned:
+					return
+				case <-time.After(randomPeriod(maxAPICallInterval)):
+				}
+				makeRandomControllerAPICall(controller, egressRegions)
+				atomic.AddInt64(&result.APICalls, 1)
+			}
+		}()
+
+		// Run in a separate goroutine so that a stuck shutdown is detected
+		// and reported rather than hanging the stress run.
+		go func() {
+			controller.Run(controllerCtx)
+			close(stopped)
+		}()
+
+		<-controllerCtx.Done()
+
+		timer := time.NewTimer(stopTimeout)
+		defer timer.Stop()
+		select {
+		case <-stopped:
+		case <-timer.C:
+			select {
+			case errs <- errors.New("controller failed to stop"):
+			default:
+			}
+			stopStress()
+			close(abandoned)
+			return
+		}
+
+		apiWaitGroup.Wait()
+	}
+
+	var err error
+
+loop:
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-stressCtx.Done():
+			break loop
+		}
+
+		controller, controllerErr := NewController(config)
+		if controllerErr != nil {
+			<-slots
+			err = controllerErr
+			stopStress()
+			break loop
+		}
+		atomic.AddInt64(&result.ControllersStarted, 1)
+
+		waitGroup.Add(1)
+		go runController(controller)
+
+		// Stagger starts by a random delay, less than the typical
+		// controller lifetime, so that controllers overlap.
+		select {
+		case <-time.After(randomPeriod(
+			maxControllerLifetime / time.Duration(maxConcurrentControllers))):
+		case <-stressCtx.Done():
+			break loop
+		}
+	}
+
+	waitGroup.Wait()
+
+	if err != nil {
+		return result, common.ContextError(err)
+	}
+
+	select {
+	case err := <-errs:
+		return result, common.ContextError(err)
+	default:
+	}
+
+	return result, nil
+}
+
+func makeRandomControllerAPICall(controller *Controller, egressRegions []string) {
+
+	n, _ := common.MakeSecureRandomInt(4)
+
+	switch n {
+	case 0:
+		i, _ := common.MakeSecureRandomInt(len(egressRegions))
+		controller.SetEgressRegion(egressRegions[i])
+	case 1:
+		controller.TerminateNextActiveTunnel()
+	case 2:
+		controller.SetHostConditions(HostConditions{
+			OnBattery:        common.FlipCoin(),
+			IsMeteredNetwork: common.FlipCoin(),
+		})
+	case 3:
+		_ = controller.Status()
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestStressControllerLifecycle(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-controller-stress-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableLocalHTTPProxy" : true,
+        "EstablishTunnelPausePeriodSeconds" : 1
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	// The server entry is unreachable, so controllers remain in the
+	// establishing state, with connection workers in flight, when stopped.
+
+	err = StoreServerEntry(
+		protocol.ServerEntryFields{
+			"ipAddress":            "192.0.2.1",
+			"region":               "US",
+			"configurationVersion": 1,
+			"capabilities":         []string{"SSH", "OSSH"},
+		},
+		false)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	result, err := StressControllerLifecycle(
+		context.Background(),
+		clientConfig,
+		&ControllerStressParameters{
+			Duration:                 5 * time.Second,
+			MaxConcurrentControllers: 3,
+			MaxControllerLifetime:    500 * time.Millisecond,
+			MaxAPICallInterval:       10 * time.Millisecond,
+			StopTimeout:              10 * time.Second,
+			EgressRegions:            []string{"US", "CA"},
+		})
+	if err != nil {
+		t.Fatalf("StressControllerLifecycle failed: %s", err)
+	}
+
+	if result.ControllersStarted < 2 || result.APICalls == 0 {
+		t.Fatalf("unexpected stress result: %+v", result)
+	}
+}
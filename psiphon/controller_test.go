@@ -1083,3 +1083,58 @@ func initUpstreamProxy() {
 
 	// TODO: wait until listener is active?
 }
+
+func TestSetEgressRegion(t *testing.T) {
+
+	config := &Config{}
+	config.SetEgressRegion(config.EgressRegion)
+
+	tunnelCA := &Tunnel{serverEntry: &protocol.ServerEntry{IpAddress: "192.0.2.1", Region: "CA"}}
+	tunnelUS := &Tunnel{serverEntry: &protocol.ServerEntry{IpAddress: "192.0.2.2", Region: "US"}}
+
+	controller := &Controller{
+		config:        config,
+		tunnels:       []*Tunnel{tunnelCA, tunnelUS},
+		failedTunnels: make(chan *Tunnel, 2),
+	}
+
+	checkFailedTunnels := func(expectedTunnels ...*Tunnel) {
+		for _, expectedTunnel := range expectedTunnels {
+			select {
+			case tunnel := <-controller.failedTunnels:
+				if tunnel != expectedTunnel {
+					t.Fatalf("unexpected failed tunnel: %s", tunnel.serverEntry.IpAddress)
+				}
+			default:
+				t.Fatalf("missing failed tunnel: %s", expectedTunnel.serverEntry.IpAddress)
+			}
+		}
+		select {
+		case tunnel := <-controller.failedTunnels:
+			t.Fatalf("unexpected failed tunnel: %s", tunnel.serverEntry.IpAddress)
+		default:
+		}
+	}
+
+	// Only tunnels to servers outside the new egress region are replaced.
+
+	controller.SetEgressRegion("CA")
+	checkFailedTunnels(tunnelUS)
+
+	if config.GetEgressRegion() != "CA" || config.EgressRegion != "" {
+		t.Fatalf("unexpected egress region: %s, %s", config.GetEgressRegion(), config.EgressRegion)
+	}
+
+	if !controller.isEgressRegionTunnel(tunnelCA) || controller.isEgressRegionTunnel(tunnelUS) {
+		t.Fatalf("unexpected isEgressRegionTunnel result")
+	}
+
+	// Any region retains all tunnels.
+
+	controller.SetEgressRegion("")
+	checkFailedTunnels()
+
+	if !controller.isEgressRegionTunnel(tunnelCA) || !controller.isEgressRegionTunnel(tunnelUS) {
+		t.Fatalf("unexpected isEgressRegionTunnel result")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	CRASH_REPORT_MAX_GOROUTINE_DUMP_SIZE = 1 << 20
+)
+
+// recoverPanic recovers from a panic in a Controller goroutine, emits a
+// CrashReport notice, and initiates a controller shutdown. This prevents a
+// bug in any one component from terminating the host application process.
+//
+// recoverPanic must be invoked directly with defer, and should be deferred
+// after the goroutine's wait group Done call, so that it runs first.
+//
+// As with SignalComponentFailure, the shutdown is best effort: state held by
+// the panicking goroutine, such as locked mutexes, is not cleaned up.
+func (controller *Controller) recoverPanic(component string) {
+
+	panicValue := recover()
+	if panicValue == nil {
+		return
+	}
+
+	stack := debug.Stack()
+
+	goroutines := make([]byte, CRASH_REPORT_MAX_GOROUTINE_DUMP_SIZE)
+	goroutines = goroutines[:runtime.Stack(goroutines, true)]
+
+	NoticeCrashReport(
+		component,
+		fmt.Sprintf("%v", panicValue),
+		string(stack),
+		string(goroutines),
+		getFeedbackMemStats())
+
+	controller.SignalComponentFailure()
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecoverPanic(t *testing.T) {
+
+	var notices bytes.Buffer
+	SetNoticeWriter(&notices)
+	defer SetNoticeWriter(os.Stderr)
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	controller := &Controller{
+		runCtx:       runCtx,
+		stopRunning:  stopRunning,
+		runWaitGroup: new(sync.WaitGroup),
+	}
+
+	controller.runWaitGroup.Add(1)
+	go func() {
+		defer controller.runWaitGroup.Done()
+		defer controller.recoverPanic("testComponent")
+		panic("test panic")
+	}()
+	controller.runWaitGroup.Wait()
+
+	select {
+	case <-runCtx.Done():
+	default:
+		t.Fatalf("controller not stopped")
+	}
+
+	var crashReport map[string]interface{}
+
+	for _, line := range strings.Split(notices.String(), "\n") {
+		var notice struct {
+			NoticeType string                 `json:"noticeType"`
+			Data       map[string]interface{} `json:"data"`
+		}
+		if json.Unmarshal([]byte(line), &notice) == nil &&
+			notice.NoticeType == "CrashReport" {
+			crashReport = notice.Data
+		}
+	}
+
+	if crashReport == nil {
+		t.Fatalf("missing CrashReport notice")
+	}
+
+	if crashReport["component"] != "testComponent" ||
+		crashReport["panic"] != "test panic" ||
+		!strings.Contains(crashReport["stack"].(string), "TestRecoverPanic") ||
+		crashReport["goroutines"] == "" ||
+		crashReport["memStats"] == nil {
+
+		t.Fatalf("unexpected CrashReport notice: %+v", crashReport)
+	}
+}
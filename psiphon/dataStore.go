@@ -25,7 +25,9 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
@@ -42,11 +44,19 @@ var (
 	datastoreSLOKsBucket                        = []byte("SLOKs")
 	datastoreTacticsBucket                      = []byte("tactics")
 	datastoreSpeedTestSamplesBucket             = []byte("speedTestSamples")
+	datastoreFastReconnectBucket                = []byte("fastReconnect")
+	datastoreProtocolStatsBucket                = []byte("protocolStats")
+	datastoreBytesTransferredBucket             = []byte("bytesTransferred")
+	datastoreServerLoadBucket                   = []byte("serverLoad")
+	datastoreSessionResumptionBucket            = []byte("sessionResumption")
 	datastoreLastConnectedKey                   = "lastConnected"
 	datastoreLastServerEntryFilterKey           = []byte("lastServerEntryFilter")
 	datastoreAffinityServerEntryIDKey           = []byte("affinityServerEntryID")
+	datastoreServerEntryPolicyKey               = []byte("serverEntryPolicy")
 	datastorePersistentStatTypeRemoteServerList = string(datastoreRemoteServerListStatsBucket)
 	datastoreServerEntryFetchGCThreshold        = 20
+	datastoreServerEntryStoreBatchSize          = 20
+	datastoreBytesTransferredRetentionDays      = 90
 
 	datastoreInitalizeMutex sync.Mutex
 	datastoreReferenceMutex sync.Mutex
@@ -67,7 +77,13 @@ func OpenDataStore(config *Config) error {
 		return common.ContextError(errors.New("db already open"))
 	}
 
-	newDB, err := datastoreOpenDB(config.DataStoreDirectory)
+	var newDB *datastoreDB
+	var err error
+	if config.EphemeralDataStore {
+		newDB, err = datastoreOpenMemoryDB()
+	} else {
+		newDB, err = datastoreOpenDB(config.DataStoreDirectory)
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -163,55 +179,116 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 	// is expected to be acceptable.
 
 	err = datastoreUpdate(func(tx *datastoreTx) error {
+		return storeServerEntry(tx, serverEntryFields, replaceIfExists)
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
 
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+	return nil
+}
 
-		ipAddress := serverEntryFields.GetIPAddress()
+// storeServerEntry performs the StoreServerEntry insert/update within the
+// specified transaction. The server entry must already be validated.
+func storeServerEntry(
+	tx *datastoreTx,
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool) error {
 
-		// Check not only that the entry exists, but is valid. This
-		// will replace in the rare case where the data is corrupt.
-		existingConfigurationVersion := -1
-		existingData := serverEntries.get([]byte(ipAddress))
-		if existingData != nil {
-			var existingServerEntry *protocol.ServerEntry
-			err := json.Unmarshal(existingData, &existingServerEntry)
-			if err == nil {
-				existingConfigurationVersion = existingServerEntry.ConfigurationVersion
-			}
-		}
+	serverEntries := tx.bucket(datastoreServerEntriesBucket)
 
-		exists := existingConfigurationVersion > -1
-		newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
-		update := !exists || replaceIfExists || newer
+	ipAddress := serverEntryFields.GetIPAddress()
 
-		if !update {
-			// Disabling this notice, for now, as it generates too much noise
-			// in diagnostics with clients that always submit embedded servers
-			// to the core on each run.
-			// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
-			return nil
-		}
+	if !shouldUpdateServerEntry(
+		serverEntries,
+		ipAddress,
+		serverEntryFields.GetConfigurationVersion(),
+		replaceIfExists) {
 
-		data, err := json.Marshal(serverEntryFields)
-		if err != nil {
-			return common.ContextError(err)
-		}
-		err = serverEntries.put([]byte(ipAddress), data)
-		if err != nil {
-			return common.ContextError(err)
-		}
+		return nil
+	}
+
+	data, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	err = serverEntries.put([]byte(ipAddress), data)
+	if err != nil {
+		return common.ContextError(err)
+	}
 
-		NoticeInfo("updated server %s", ipAddress)
+	NoticeInfo("updated server %s", ipAddress)
+
+	return nil
+}
+
+// storeServerEntryRecord is storeServerEntry for a server entry record
+// decoded by StreamingServerEntryDecoder.NextBatch, which is already
+// validated and encoded for storage.
+func storeServerEntryRecord(
+	tx *datastoreTx,
+	record *protocol.ServerEntryRecord,
+	replaceIfExists bool) error {
+
+	serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+	if !shouldUpdateServerEntry(
+		serverEntries,
+		record.IPAddress,
+		record.ConfigurationVersion,
+		replaceIfExists) {
 
 		return nil
-	})
+	}
+
+	err := serverEntries.put([]byte(record.IPAddress), record.Data)
 	if err != nil {
 		return common.ContextError(err)
 	}
 
+	NoticeInfo("updated server %s", record.IPAddress)
+
 	return nil
 }
 
+// shouldUpdateServerEntry checks if a new server entry with the specified
+// configuration version should replace any existing entry.
+func shouldUpdateServerEntry(
+	serverEntries *datastoreBucket,
+	ipAddress string,
+	configurationVersion int,
+	replaceIfExists bool) bool {
+
+	// Check not only that the entry exists, but is valid. This
+	// will replace in the rare case where the data is corrupt.
+	// Only the configuration version is decoded, to avoid allocating
+	// a full ServerEntry.
+	existingConfigurationVersion := -1
+	existingData := serverEntries.get([]byte(ipAddress))
+	if existingData != nil {
+		var existingServerEntry struct {
+			ConfigurationVersion int `json:"configurationVersion"`
+		}
+		err := json.Unmarshal(existingData, &existingServerEntry)
+		if err == nil {
+			existingConfigurationVersion = existingServerEntry.ConfigurationVersion
+		}
+	}
+
+	exists := existingConfigurationVersion > -1
+	newer := exists && existingConfigurationVersion < configurationVersion
+	update := !exists || replaceIfExists || newer
+
+	// Disabling this notice, for now, as it generates too much noise
+	// in diagnostics with clients that always submit embedded servers
+	// to the core on each run.
+	// if !update {
+	//	NoticeInfo("ignored update for server %s", ipAddress)
+	// }
+
+	return update
+}
+
 // StoreServerEntries stores a list of server entries.
 // There is an independent transaction for each entry insert/update.
 func StoreServerEntries(
@@ -230,39 +307,47 @@ func StoreServerEntries(
 }
 
 // StreamingStoreServerEntries stores a list of server entries.
-// There is an independent transaction for each entry insert/update.
+// Entries are inserted/updated in batches of up to
+// datastoreServerEntryStoreBatchSize, with one transaction per batch. Only
+// one batch of decoded server entries is held in memory at a time.
 func StreamingStoreServerEntries(
 	config *Config,
 	serverEntries *protocol.StreamingServerEntryDecoder,
 	replaceIfExists bool) error {
 
-	// Note: both StreamingServerEntryDecoder.Next and StoreServerEntry
-	// allocate temporary memory buffers for hex/JSON decoding/encoding,
-	// so this isn't true constant-memory streaming (it depends on garbage
-	// collection).
+	// Server entries are decoded in batches by
+	// StreamingServerEntryDecoder.NextBatch, which reuses its decoding
+	// buffers and a single slab for the batch's encoded records. Each
+	// batch must be stored before the next batch is decoded.
 
-	n := 0
 	for {
-		serverEntry, err := serverEntries.Next()
+		batch, err := serverEntries.NextBatch(datastoreServerEntryStoreBatchSize)
 		if err != nil {
 			return common.ContextError(err)
 		}
 
-		if serverEntry == nil {
+		if len(batch) == 0 {
 			// No more server entries
 			break
 		}
 
-		err = StoreServerEntry(serverEntry, replaceIfExists)
+		// NextBatch skips invalid entries, so there is no need to call
+		// ValidateServerEntryFields here.
+
+		err = datastoreUpdate(func(tx *datastoreTx) error {
+			for i := range batch {
+				err := storeServerEntryRecord(tx, &batch[i], replaceIfExists)
+				if err != nil {
+					return common.ContextError(err)
+				}
+			}
+			return nil
+		})
 		if err != nil {
 			return common.ContextError(err)
 		}
 
-		n += 1
-		if n == datastoreServerEntryFetchGCThreshold {
-			DoGarbageCollection()
-			n = 0
-		}
+		DoGarbageCollection()
 	}
 
 	return nil
@@ -317,7 +402,7 @@ func makeServerEntryFilterValue(config *Config) ([]byte, error) {
 	// If the tunnel protocol filter changes, any existing affinity server
 	// either passes the new filter, or it will be skipped anyway.
 
-	return []byte(config.EgressRegion), nil
+	return []byte(config.GetEgressRegion()), nil
 }
 
 func hasServerEntryFilterChanged(config *Config) (bool, error) {
@@ -347,6 +432,68 @@ func hasServerEntryFilterChanged(config *Config) (bool, error) {
 	return changed, nil
 }
 
+// StoreServerEntryPolicy persists the server entry pinning and exclusion
+// policy, replacing any previously stored policy. The policy takes effect
+// the next time a ServerEntryIterator is reset. A nil policy clears the
+// stored policy.
+func StoreServerEntryPolicy(policy *ServerEntryPolicy) error {
+
+	if !policy.IsEmpty() {
+		err := policy.Validate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		if policy.IsEmpty() {
+			return bucket.delete(datastoreServerEntryPolicyKey)
+		}
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		return bucket.put(datastoreServerEntryPolicyKey, data)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetServerEntryPolicy returns the stored server entry policy. When no policy
+// is stored, an empty policy is returned.
+func GetServerEntryPolicy() (*ServerEntryPolicy, error) {
+
+	var policy *ServerEntryPolicy
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		var err error
+		policy, err = getServerEntryPolicy(tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return policy, nil
+}
+
+func getServerEntryPolicy(tx *datastoreTx) (*ServerEntryPolicy, error) {
+	policy := &ServerEntryPolicy{}
+	bucket := tx.bucket(datastoreKeyValueBucket)
+	data := bucket.get(datastoreServerEntryPolicyKey)
+	if data != nil {
+		err := json.Unmarshal(data, policy)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+	return policy, nil
+}
+
 // ServerEntryIterator is used to iterate over
 // stored server entries in rank order.
 type ServerEntryIterator struct {
@@ -354,6 +501,11 @@ type ServerEntryIterator struct {
 	applyServerAffinity          bool
 	serverEntryIDs               [][]byte
 	serverEntryIndex             int
+	pinnedServerEntryCount       int
+	rankedServerEntryCount       int
+	availabilityWindowRanking    bool
+	availabilityWindowClockSkew  time.Duration
+	serverLoadAvoidancePeriod    time.Duration
 	isTacticsServerEntryIterator bool
 	isTargetServerEntryIterator  bool
 	hasNextTargetServerEntry     bool
@@ -408,6 +560,7 @@ func NewTacticsServerEntryIterator(config *Config) (*ServerEntryIterator, error)
 	}
 
 	iterator := &ServerEntryIterator{
+		config:                       config,
 		isTacticsServerEntryIterator: true,
 	}
 
@@ -436,7 +589,8 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 
 	} else {
 
-		if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
+		egressRegion := config.GetEgressRegion()
+		if egressRegion != "" && serverEntry.Region != egressRegion {
 			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support EgressRegion"))
 		}
 
@@ -488,31 +642,56 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// list is built.
 
 	var serverEntryIDs [][]byte
+	var pinnedServerEntryCount int
 
 	err := datastoreView(func(tx *datastoreTx) error {
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
+		policy, err := getServerEntryPolicy(tx)
+		if err != nil {
+			// Don't fail establishment due to a corrupt policy record.
+			NoticeAlert("ServerEntryIterator.Reset: %s", err)
+			policy = &ServerEntryPolicy{}
+		}
 
 		serverEntryIDs = make([][]byte, 0)
-		shuffleHead := 0
+
+		// Pinned server entries are first, in policy order, followed by the
+		// affinity server entry. These head candidates are not shuffled.
+
+		serverEntriesBucket := tx.bucket(datastoreServerEntriesBucket)
+		for _, ipAddress := range policy.PinnedServerEntries {
+			if serverEntriesBucket.get([]byte(ipAddress)) != nil {
+				serverEntryIDs = append(serverEntryIDs, []byte(ipAddress))
+			}
+		}
+		pinnedServerEntryCount = len(serverEntryIDs)
+
+		bucket := tx.bucket(datastoreKeyValueBucket)
 
 		var affinityServerEntryID []byte
 		if iterator.applyServerAffinity {
 			affinityServerEntryID = bucket.get(datastoreAffinityServerEntryIDKey)
-			if affinityServerEntryID != nil {
+			if affinityServerEntryID != nil &&
+				!policy.isExcluded(string(affinityServerEntryID)) &&
+				!common.Contains(policy.PinnedServerEntries, string(affinityServerEntryID)) {
+
 				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), affinityServerEntryID...))
-				shuffleHead = 1
 			}
 		}
 
-		bucket = tx.bucket(datastoreServerEntriesBucket)
-		cursor := bucket.cursor()
+		shuffleHead := len(serverEntryIDs)
+
+		cursor := serverEntriesBucket.cursor()
 		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
 			if affinityServerEntryID != nil {
 				if bytes.Equal(affinityServerEntryID, key) {
 					continue
 				}
 			}
+			if policy.isExcluded(string(key)) ||
+				common.Contains(policy.PinnedServerEntries, string(key)) {
+				continue
+			}
 			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
 		}
 		cursor.close()
@@ -530,6 +709,18 @@ func (iterator *ServerEntryIterator) Reset() error {
 
 	iterator.serverEntryIDs = serverEntryIDs
 	iterator.serverEntryIndex = 0
+	iterator.pinnedServerEntryCount = pinnedServerEntryCount
+	iterator.rankedServerEntryCount = len(serverEntryIDs)
+
+	if iterator.config != nil {
+		p := iterator.config.clientParameters.Get()
+		iterator.availabilityWindowRanking = p.Bool(
+			parameters.ServerEntryAvailabilityWindowRanking)
+		iterator.availabilityWindowClockSkew = p.Duration(
+			parameters.ServerEntryAvailabilityWindowClockSkew)
+		iterator.serverLoadAvoidancePeriod = p.Duration(
+			parameters.ServerLoadAvoidancePeriod)
+	}
 
 	return nil
 }
@@ -573,7 +764,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		serverEntryID := iterator.serverEntryIDs[iterator.serverEntryIndex]
 		iterator.serverEntryIndex += 1
 
-		var data []byte
+		var data, serverLoadData []byte
 
 		err = datastoreView(func(tx *datastoreTx) error {
 			bucket := tx.bucket(datastoreServerEntriesBucket)
@@ -583,6 +774,13 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 				data = make([]byte, len(value))
 				copy(data, value)
 			}
+			if iterator.serverLoadAvoidancePeriod > 0 {
+				bucket = tx.bucket(datastoreServerLoadBucket)
+				value = bucket.get(serverEntryID)
+				if value != nil {
+					serverLoadData = append([]byte(nil), value...)
+				}
+			}
 			return nil
 		})
 		if err != nil {
@@ -596,6 +794,9 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 			continue
 		}
 
+		// Unmarshal into a new ServerEntry, so that fields of any previously
+		// skipped server entry are not retained.
+		serverEntry = nil
 		err = json.Unmarshal(data, &serverEntry)
 		if err != nil {
 			// In case of data corruption or a bug causing this condition,
@@ -613,22 +814,71 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		if iterator.isTacticsServerEntryIterator {
 
 			// Tactics doesn't filter by egress region.
-			if len(serverEntry.GetSupportedTacticsProtocols()) > 0 {
-				break
+			if len(serverEntry.GetSupportedTacticsProtocols()) == 0 {
+				continue
 			}
 
 		} else {
 
-			if iterator.config.EgressRegion == "" ||
-				serverEntry.Region == iterator.config.EgressRegion {
-				break
+			egressRegion := iterator.config.GetEgressRegion()
+			if egressRegion != "" && serverEntry.Region != egressRegion {
+				continue
 			}
 		}
+
+		// Server entries which are outside of their availability windows are
+		// deferred to the end of the cycle, after all other candidates. These
+		// server entries are not excluded, as the client clock may be wrong
+		// by more than the tolerated clock skew. Pinned server entries are
+		// not deferred.
+
+		if iterator.availabilityWindowRanking &&
+			iterator.serverEntryIndex > iterator.pinnedServerEntryCount &&
+			iterator.serverEntryIndex <= iterator.rankedServerEntryCount &&
+			!serverEntry.IsAvailableAt(time.Now(), iterator.availabilityWindowClockSkew) {
+
+			iterator.serverEntryIDs = append(iterator.serverEntryIDs, serverEntryID)
+			continue
+		}
+
+		// Server entries which reported a high load in a recent handshake are
+		// also deferred. The probability of deferral decays over the avoidance
+		// period, so that clients return to the server gradually rather than
+		// all at once, as may happen after a regional blocking event ends.
+
+		if serverLoadData != nil &&
+			iterator.serverEntryIndex > iterator.pinnedServerEntryCount &&
+			iterator.serverEntryIndex <= iterator.rankedServerEntryCount &&
+			iterator.isServerLoadAvoided(serverLoadData) {
+
+			iterator.serverEntryIDs = append(iterator.serverEntryIDs, serverEntryID)
+			continue
+		}
+
+		break
 	}
 
 	return MakeCompatibleServerEntry(serverEntry), nil
 }
 
+func (iterator *ServerEntryIterator) isServerLoadAvoided(serverLoadData []byte) bool {
+
+	var record serverLoadRecord
+	err := json.Unmarshal(serverLoadData, &record)
+	if err != nil {
+		NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
+		return false
+	}
+
+	elapsed := time.Since(record.RecordTime)
+	if elapsed < 0 || elapsed >= iterator.serverLoadAvoidancePeriod {
+		return false
+	}
+
+	return common.FlipWeightedCoin(
+		1.0 - float64(elapsed)/float64(iterator.serverLoadAvoidancePeriod))
+}
+
 // MakeCompatibleServerEntry provides backwards compatibility with old server entries
 // which have a single meekFrontingDomain and not a meekFrontingAddresses array.
 // By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
@@ -1224,6 +1474,299 @@ func GetTacticsStorer() *TacticsStorer {
 	return &TacticsStorer{}
 }
 
+// SetFastReconnectRecord stores the fast reconnect record for the specified
+// network ID.
+func SetFastReconnectRecord(networkID string, record []byte) error {
+	return setBucketValue(datastoreFastReconnectBucket, []byte(networkID), record)
+}
+
+// GetFastReconnectRecord retrieves the fast reconnect record for the
+// specified network ID. Returns nil with no error when there is no record.
+func GetFastReconnectRecord(networkID string) ([]byte, error) {
+
+	var record []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreFastReconnectBucket)
+		value := bucket.get([]byte(networkID))
+		if value != nil {
+			// Must make a copy as slice is only valid within transaction.
+			record = append([]byte(nil), value...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return record, nil
+}
+
+// DeleteFastReconnectRecord deletes the fast reconnect record for the
+// specified network ID.
+func DeleteFastReconnectRecord(networkID string) error {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreFastReconnectBucket)
+		return bucket.delete([]byte(networkID))
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// DeleteFastReconnectRecords deletes the fast reconnect records for all
+// networks.
+func DeleteFastReconnectRecords() error {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreFastReconnectBucket)
+		var keys [][]byte
+		cursor := bucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		cursor.close()
+		for _, key := range keys {
+			err := bucket.delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// serverLoadRecord is a server load hint reported in a handshake response.
+type serverLoadRecord struct {
+	Load       int
+	RecordTime time.Time
+}
+
+// SetServerLoad records the load, a percentage of capacity, reported by the
+// specified server. Loaded servers are deprioritized by ServerEntryIterator
+// for parameters.ServerLoadAvoidancePeriod.
+func SetServerLoad(ipAddress string, load int) error {
+
+	record, err := json.Marshal(
+		&serverLoadRecord{Load: load, RecordTime: time.Now()})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return setBucketValue(datastoreServerLoadBucket, []byte(ipAddress), record)
+}
+
+// SetSessionResumptionRecord stores the handshake session resumption record
+// for the specified server.
+func SetSessionResumptionRecord(ipAddress string, record []byte) error {
+	return setBucketValue(datastoreSessionResumptionBucket, []byte(ipAddress), record)
+}
+
+// GetSessionResumptionRecord retrieves the handshake session resumption
+// record for the specified server. Returns nil with no error when there is
+// no record.
+func GetSessionResumptionRecord(ipAddress string) ([]byte, error) {
+
+	var record []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSessionResumptionBucket)
+		value := bucket.get([]byte(ipAddress))
+		if value != nil {
+			// Must make a copy as slice is only valid within transaction.
+			record = append([]byte(nil), value...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return record, nil
+}
+
+// DeleteSessionResumptionRecord deletes the handshake session resumption
+// record for the specified server.
+func DeleteSessionResumptionRecord(ipAddress string) error {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSessionResumptionBucket)
+		return bucket.delete([]byte(ipAddress))
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// SetProtocolStatsRecord stores the tunnel protocol stats record for the
+// specified network ID.
+func SetProtocolStatsRecord(networkID string, record []byte) error {
+	return setBucketValue(datastoreProtocolStatsBucket, []byte(networkID), record)
+}
+
+// GetProtocolStatsRecord retrieves the tunnel protocol stats record for the
+// specified network ID. Returns nil with no error when there is no record.
+func GetProtocolStatsRecord(networkID string) ([]byte, error) {
+
+	var record []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreProtocolStatsBucket)
+		value := bucket.get([]byte(networkID))
+		if value != nil {
+			// Must make a copy as slice is only valid within transaction.
+			record = append([]byte(nil), value...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return record, nil
+}
+
+// BytesTransferredTotal is the cumulative number of bytes transferred
+// through tunnels to servers in Region on Day, a UTC date in the form
+// "2006-01-02".
+type BytesTransferredTotal struct {
+	Day      string
+	Region   string
+	Sent     int64
+	Received int64
+}
+
+// AddBytesTransferred adds the specified bytes to the persistent total for
+// the day and region, and returns the updated total. Totals for days more
+// than datastoreBytesTransferredRetentionDays before day are deleted.
+func AddBytesTransferred(
+	day, region string, sent, received int64) (*BytesTransferredTotal, error) {
+
+	cutoffTime, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	cutoff := cutoffTime.AddDate(0, 0, -datastoreBytesTransferredRetentionDays).Format("2006-01-02")
+
+	total := &BytesTransferredTotal{Day: day, Region: region}
+	key := []byte(day + "/" + region)
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(datastoreBytesTransferredBucket)
+
+		value := bucket.get(key)
+		if value != nil {
+			err := json.Unmarshal(value, total)
+			if err != nil {
+				return err
+			}
+		}
+
+		total.Sent += sent
+		total.Received += received
+
+		value, err := json.Marshal(total)
+		if err != nil {
+			return err
+		}
+		err = bucket.put(key, value)
+		if err != nil {
+			return err
+		}
+
+		expiredKeys := make([][]byte, 0)
+		cursor := bucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			if string(key) < cutoff {
+				expiredKeys = append(expiredKeys, append([]byte(nil), key...))
+			}
+		}
+		cursor.close()
+		for _, key := range expiredKeys {
+			err := bucket.delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return total, nil
+}
+
+// GetBytesTransferredTotals returns the persistent bytes transferred totals
+// for each day and region, sorted by day and then region. The totals persist
+// across controller restarts and are retained for
+// datastoreBytesTransferredRetentionDays.
+func GetBytesTransferredTotals() ([]*BytesTransferredTotal, error) {
+
+	var totals []*BytesTransferredTotal
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreBytesTransferredBucket)
+		cursor := bucket.cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var total *BytesTransferredTotal
+			err := json.Unmarshal(value, &total)
+			if err != nil {
+				// Skip invalid records.
+				NoticeAlert("invalid bytes transferred record: %s", err)
+				continue
+			}
+			totals = append(totals, total)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Day != totals[j].Day {
+			return totals[i].Day < totals[j].Day
+		}
+		return totals[i].Region < totals[j].Region
+	})
+
+	return totals, nil
+}
+
+// getServerEntry retrieves the stored server entry with the specified IP
+// address. Returns nil with no error when there is no such server entry.
+func getServerEntry(ipAddress string) (*protocol.ServerEntry, error) {
+
+	var serverEntry *protocol.ServerEntry
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		value := bucket.get([]byte(ipAddress))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &serverEntry)
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if serverEntry == nil {
+		return nil, nil
+	}
+
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
 func setBucketValue(bucket, key, value []byte) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 
@@ -52,6 +53,10 @@ type datastoreCursor struct {
 	prefix         []byte
 }
 
+func datastoreOpenMemoryDB() (*datastoreDB, error) {
+	return nil, common.ContextError(errors.New("ephemeral datastore not supported"))
+}
+
 func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 
 	dbDirectory := filepath.Join(rootDataDirectory, "psiphon.badgerdb")
@@ -1,4 +1,4 @@
-// +build !BADGER_DB,!FILES_DB
+// +build !BADGER_DB,!FILES_DB,!js
 
 /*
  * Copyright (c) 2018, Psiphon Inc.
@@ -22,36 +22,71 @@
 package psiphon
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/Psiphon-Labs/bolt"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
+// The BoltDB datastore also supports an in-memory mode, for
+// Config.EphemeralDataStore. When memoryDB is set, all operations are
+// delegated to the memoryDatastore.
+
 type datastoreDB struct {
-	boltDB *bolt.DB
+	boltDB   *bolt.DB
+	memoryDB *memoryDatastore
 }
 
 type datastoreTx struct {
-	boltTx *bolt.Tx
+	boltTx   *bolt.Tx
+	memoryTx *memoryDatastoreTx
 }
 
 type datastoreBucket struct {
-	boltBucket *bolt.Bucket
+	boltBucket   *bolt.Bucket
+	memoryBucket *memoryDatastoreBucket
 }
 
 type datastoreCursor struct {
-	boltCursor *bolt.Cursor
+	boltCursor   *bolt.Cursor
+	memoryCursor *memoryDatastoreCursor
+}
+
+func datastoreOpenMemoryDB() (*datastoreDB, error) {
+	return &datastoreDB{memoryDB: newMemoryDatastore()}, nil
 }
 
 func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 
 	filename := filepath.Join(rootDataDirectory, "psiphon.boltdb")
+	corruptFilename := filename + ".corrupt"
 
 	var newDB *bolt.DB
 	var err error
+	var corruptErr error
+
+	// When the datastore file is corrupt, it's set aside and a fresh
+	// datastore is created. Once the fresh datastore is ready, readable
+	// server entries are salvaged from the corrupt file. Only the first
+	// corrupt file is retained for salvage; if the fresh datastore also
+	// fails, it's simply deleted.
+
+	setAsideCorruptFile := func(err error) {
+		if corruptErr == nil {
+			corruptErr = err
+			os.Remove(corruptFilename)
+			if os.Rename(filename, corruptFilename) == nil {
+				return
+			}
+		}
+		os.Remove(filename)
+	}
 
 	for retry := 0; retry < 3; retry++ {
 
@@ -59,26 +94,24 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 			NoticeAlert("datastoreOpenDB retry: %d", retry)
 		}
 
-		newDB, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		newDB, err = openBoltDB(filename, false)
 
-		// The datastore file may be corrupt, so attempt to delete and try again
+		// The datastore file may be corrupt, so attempt to set aside and try again
 		if err != nil {
 			NoticeAlert("bolt.Open error: %s", err)
-			os.Remove(filename)
+			setAsideCorruptFile(err)
 			continue
 		}
 
 		// Run consistency checks on datastore and emit errors for diagnostics purposes
 		// We assume this will complete quickly for typical size Psiphon datastores.
-		err = newDB.View(func(tx *bolt.Tx) error {
-			return tx.SynchronousCheck()
-		})
+		err = checkBoltDB(newDB)
 
-		// The datastore file may be corrupt, so attempt to delete and try again
+		// The datastore file may be corrupt, so attempt to set aside and try again
 		if err != nil {
 			NoticeAlert("bolt.SynchronousCheck error: %s", err)
 			newDB.Close()
-			os.Remove(filename)
+			setAsideCorruptFile(err)
 			continue
 		}
 
@@ -100,6 +133,11 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 			datastoreSLOKsBucket,
 			datastoreTacticsBucket,
 			datastoreSpeedTestSamplesBucket,
+			datastoreFastReconnectBucket,
+			datastoreProtocolStatsBucket,
+			datastoreBytesTransferredBucket,
+			datastoreServerLoadBucket,
+			datastoreSessionResumptionBucket,
 		}
 		for _, bucket := range requiredBuckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
@@ -135,14 +173,133 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 		return nil, common.ContextError(err)
 	}
 
+	if corruptErr != nil {
+		count, err := salvageBoltServerEntries(corruptFilename, newDB)
+		if err != nil {
+			NoticeAlert("salvage server entries error: %s", err)
+		}
+		os.Remove(corruptFilename)
+		NoticeDataStoreRecovered(corruptErr, count)
+	}
+
 	return &datastoreDB{boltDB: newDB}, nil
 }
 
+// openBoltDB opens a bolt database file. Bolt may panic, instead of
+// returning an error, when opening some corrupt files, so panics are
+// recovered and returned as errors.
+func openBoltDB(filename string, readOnly bool) (db *bolt.DB, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			db = nil
+			err = common.ContextError(fmt.Errorf("bolt.Open panic: %v", e))
+		}
+	}()
+	return bolt.Open(
+		filename,
+		0600,
+		&bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+}
+
+// checkBoltDB runs bolt consistency checks, recovering from any panic.
+func checkBoltDB(db *bolt.DB) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = common.ContextError(fmt.Errorf("bolt.SynchronousCheck panic: %v", e))
+		}
+	}()
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.SynchronousCheck()
+	})
+}
+
+// salvageBoltServerEntries copies readable, valid server entries from a
+// corrupt datastore file into db, returning the number of entries copied.
+// Reading stops at the first error or panic, and any entries read up to
+// that point are still copied.
+func salvageBoltServerEntries(corruptFilename string, db *bolt.DB) (int, error) {
+
+	type serverEntryRecord struct {
+		key   []byte
+		value []byte
+	}
+
+	var records []serverEntryRecord
+
+	readErr := func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = common.ContextError(fmt.Errorf("salvage panic: %v", e))
+			}
+		}()
+
+		corruptDB, err := openBoltDB(corruptFilename, true)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		defer corruptDB.Close()
+
+		return corruptDB.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(datastoreServerEntriesBucket)
+			if bucket == nil {
+				return common.ContextError(errors.New("missing server entries bucket"))
+			}
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+
+				var serverEntry *protocol.ServerEntry
+				if json.Unmarshal(value, &serverEntry) != nil ||
+					serverEntry == nil ||
+					serverEntry.IpAddress != string(key) {
+					continue
+				}
+
+				// Bolt keys and values are valid only for the life of the
+				// transaction, so copies are retained.
+				records = append(records, serverEntryRecord{
+					key:   append([]byte(nil), key...),
+					value: append([]byte(nil), value...),
+				})
+			}
+			return nil
+		})
+	}()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(datastoreServerEntriesBucket)
+		for _, record := range records {
+			err := bucket.Put(record.key, record.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	if readErr != nil {
+		return len(records), common.ContextError(readErr)
+	}
+
+	return len(records), nil
+}
+
 func (db *datastoreDB) close() error {
+	if db.memoryDB != nil {
+		return db.memoryDB.close()
+	}
 	return db.boltDB.Close()
 }
 
 func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+	if db.memoryDB != nil {
+		return db.memoryDB.view(
+			func(tx *memoryDatastoreTx) error {
+				return fn(&datastoreTx{memoryTx: tx})
+			})
+	}
 	return db.boltDB.View(
 		func(tx *bolt.Tx) error {
 			err := fn(&datastoreTx{boltTx: tx})
@@ -154,6 +311,12 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 }
 
 func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+	if db.memoryDB != nil {
+		return db.memoryDB.update(
+			func(tx *memoryDatastoreTx) error {
+				return fn(&datastoreTx{memoryTx: tx})
+			})
+	}
 	return db.boltDB.Update(
 		func(tx *bolt.Tx) error {
 			err := fn(&datastoreTx{boltTx: tx})
@@ -165,10 +328,16 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 }
 
 func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
+	if tx.memoryTx != nil {
+		return &datastoreBucket{memoryBucket: tx.memoryTx.bucket(name)}
+	}
 	return &datastoreBucket{boltBucket: tx.boltTx.Bucket(name)}
 }
 
 func (tx *datastoreTx) clearBucket(name []byte) error {
+	if tx.memoryTx != nil {
+		return tx.memoryTx.clearBucket(name)
+	}
 	err := tx.boltTx.DeleteBucket(name)
 	if err != nil {
 		return common.ContextError(err)
@@ -181,10 +350,16 @@ func (tx *datastoreTx) clearBucket(name []byte) error {
 }
 
 func (b *datastoreBucket) get(key []byte) []byte {
+	if b.memoryBucket != nil {
+		return b.memoryBucket.get(key)
+	}
 	return b.boltBucket.Get(key)
 }
 
 func (b *datastoreBucket) put(key, value []byte) error {
+	if b.memoryBucket != nil {
+		return b.memoryBucket.put(key, value)
+	}
 	err := b.boltBucket.Put(key, value)
 	if err != nil {
 		return common.ContextError(err)
@@ -193,6 +368,9 @@ func (b *datastoreBucket) put(key, value []byte) error {
 }
 
 func (b *datastoreBucket) delete(key []byte) error {
+	if b.memoryBucket != nil {
+		return b.memoryBucket.delete(key)
+	}
 	err := b.boltBucket.Delete(key)
 	if err != nil {
 		return common.ContextError(err)
@@ -201,27 +379,47 @@ func (b *datastoreBucket) delete(key []byte) error {
 }
 
 func (b *datastoreBucket) cursor() datastoreCursor {
+	if b.memoryBucket != nil {
+		return datastoreCursor{memoryCursor: b.memoryBucket.cursor()}
+	}
 	return datastoreCursor{boltCursor: b.boltBucket.Cursor()}
 }
 
 func (c *datastoreCursor) firstKey() []byte {
+	if c.memoryCursor != nil {
+		key, _ := c.memoryCursor.first()
+		return key
+	}
 	key, _ := c.boltCursor.First()
 	return key
 }
 
 func (c *datastoreCursor) nextKey() []byte {
+	if c.memoryCursor != nil {
+		key, _ := c.memoryCursor.next()
+		return key
+	}
 	key, _ := c.boltCursor.Next()
 	return key
 }
 
 func (c *datastoreCursor) first() ([]byte, []byte) {
+	if c.memoryCursor != nil {
+		return c.memoryCursor.first()
+	}
 	return c.boltCursor.First()
 }
 
 func (c *datastoreCursor) next() ([]byte, []byte) {
+	if c.memoryCursor != nil {
+		return c.memoryCursor.next()
+	}
 	return c.boltCursor.Next()
 }
 
 func (c *datastoreCursor) close() {
+	if c.memoryCursor != nil {
+		c.memoryCursor.close()
+	}
 	// BoltDB doesn't close cursors.
 }
@@ -0,0 +1,129 @@
+// +build !BADGER_DB,!FILES_DB,!js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestDataStoreCorruptionRecovery(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-recovery-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	var notices bytes.Buffer
+	SetNoticeWriter(&notices)
+	defer SetNoticeWriter(os.Stderr)
+
+	config := &Config{DataStoreDirectory: testDataDirName}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	serverEntryCount := 10
+
+	// Each entry is stored in its own transaction, which results in freed
+	// pages.
+	for i := 0; i < serverEntryCount; i++ {
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            fmt.Sprintf("192.0.2.%d", i+1),
+				"configurationVersion": 1,
+			},
+			false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	CloseDataStore()
+
+	// Corrupt the datastore by emptying the freelist page referenced by the
+	// current meta page. The freed pages are then unreachable and unfreed,
+	// which fails the consistency check, while the server entries remain
+	// readable.
+
+	filename := filepath.Join(testDataDirName, "psiphon.boltdb")
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	pageSize := os.Getpagesize()
+	metaOffset := 16
+	freelistPage := uint64(0)
+	maxTxid := uint64(0)
+	for i := 0; i < 2; i++ {
+		meta := data[i*pageSize+metaOffset:]
+		txid := binary.LittleEndian.Uint64(meta[48:56])
+		if i == 0 || txid > maxTxid {
+			maxTxid = txid
+			freelistPage = binary.LittleEndian.Uint64(meta[32:40])
+		}
+	}
+
+	countOffset := int(freelistPage)*pageSize + 10
+	if binary.LittleEndian.Uint16(data[countOffset:countOffset+2]) == 0 {
+		t.Fatalf("unexpected empty freelist")
+	}
+	binary.LittleEndian.PutUint16(data[countOffset:countOffset+2], 0)
+
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	if !strings.Contains(notices.String(), "DataStoreRecovered") {
+		t.Fatalf("missing DataStoreRecovered notice")
+	}
+
+	count := CountServerEntries()
+	if count != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	_, err = os.Stat(filename + ".corrupt")
+	if !os.IsNotExist(err) {
+		t.Fatalf("corrupt datastore file not removed")
+	}
+}
@@ -75,6 +75,10 @@ type datastoreCursor struct {
 	lastBuffer *bytes.Buffer
 }
 
+func datastoreOpenMemoryDB() (*datastoreDB, error) {
+	return nil, common.ContextError(errors.New("ephemeral datastore not supported"))
+}
+
 func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 
 	dataDirectory := filepath.Join(rootDataDirectory, "psiphon.filesdb")
@@ -0,0 +1,121 @@
+// +build js,wasm,!BADGER_DB,!FILES_DB
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// BoltDB doesn't build for js/wasm, where there is no mmap or file locking,
+// so only the in-memory datastore, for Config.EphemeralDataStore, is
+// supported.
+
+type datastoreDB struct {
+	memoryDB *memoryDatastore
+}
+
+type datastoreTx struct {
+	memoryTx *memoryDatastoreTx
+}
+
+type datastoreBucket struct {
+	memoryBucket *memoryDatastoreBucket
+}
+
+type datastoreCursor struct {
+	memoryCursor *memoryDatastoreCursor
+}
+
+func datastoreOpenMemoryDB() (*datastoreDB, error) {
+	return &datastoreDB{memoryDB: newMemoryDatastore()}, nil
+}
+
+func datastoreOpenDB(_ string) (*datastoreDB, error) {
+	return nil, common.ContextError(
+		errors.New("only EphemeralDataStore is supported on js/wasm"))
+}
+
+func (db *datastoreDB) close() error {
+	return db.memoryDB.close()
+}
+
+func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+	return db.memoryDB.view(
+		func(tx *memoryDatastoreTx) error {
+			return fn(&datastoreTx{memoryTx: tx})
+		})
+}
+
+func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+	return db.memoryDB.update(
+		func(tx *memoryDatastoreTx) error {
+			return fn(&datastoreTx{memoryTx: tx})
+		})
+}
+
+func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
+	return &datastoreBucket{memoryBucket: tx.memoryTx.bucket(name)}
+}
+
+func (tx *datastoreTx) clearBucket(name []byte) error {
+	return tx.memoryTx.clearBucket(name)
+}
+
+func (b *datastoreBucket) get(key []byte) []byte {
+	return b.memoryBucket.get(key)
+}
+
+func (b *datastoreBucket) put(key, value []byte) error {
+	return b.memoryBucket.put(key, value)
+}
+
+func (b *datastoreBucket) delete(key []byte) error {
+	return b.memoryBucket.delete(key)
+}
+
+func (b *datastoreBucket) cursor() datastoreCursor {
+	return datastoreCursor{memoryCursor: b.memoryBucket.cursor()}
+}
+
+func (c *datastoreCursor) firstKey() []byte {
+	key, _ := c.memoryCursor.first()
+	return key
+}
+
+func (c *datastoreCursor) nextKey() []byte {
+	key, _ := c.memoryCursor.next()
+	return key
+}
+
+func (c *datastoreCursor) first() ([]byte, []byte) {
+	return c.memoryCursor.first()
+}
+
+func (c *datastoreCursor) next() ([]byte, []byte) {
+	return c.memoryCursor.next()
+}
+
+func (c *datastoreCursor) close() {
+	c.memoryCursor.close()
+}
@@ -0,0 +1,50 @@
+// +build js,wasm,!BADGER_DB,!FILES_DB
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+func TestJSDataStore(t *testing.T) {
+
+	// Test: only the ephemeral datastore is supported
+
+	err := OpenDataStore(&Config{DataStoreDirectory: "/"})
+	if err == nil {
+		CloseDataStore()
+		t.Fatalf("unexpected OpenDataStore success")
+	}
+
+	err = OpenDataStore(&Config{EphemeralDataStore: true})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Test: split tunnel GeoIP isn't supported
+
+	_, err = newGeoIPReader([]byte{})
+	if err == nil {
+		t.Fatalf("unexpected newGeoIPReader success")
+	}
+}
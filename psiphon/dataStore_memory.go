@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// memoryDatastore is an in-memory key/value store which implements the
+// datastore interface for Config.EphemeralDataStore. Nothing is written to
+// disk and all data is discarded when the datastore is closed.
+//
+// View transactions may run concurrently. Update transactions are
+// exclusive and, as with BoltDB, are rolled back when the transaction
+// function returns an error. Buckets are created on first update.
+//
+// As with the other datastores, value slices are only valid within a
+// transaction.
+type memoryDatastore struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memoryDatastoreTx struct {
+	db        *memoryDatastore
+	canUpdate bool
+	undo      []func()
+}
+
+type memoryDatastoreBucket struct {
+	tx   *memoryDatastoreTx
+	name string
+}
+
+type memoryDatastoreCursor struct {
+	bucket *memoryDatastoreBucket
+	keys   []string
+	index  int
+}
+
+func newMemoryDatastore() *memoryDatastore {
+	return &memoryDatastore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (db *memoryDatastore) close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.buckets = nil
+	return nil
+}
+
+func (db *memoryDatastore) view(fn func(tx *memoryDatastoreTx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.buckets == nil {
+		return common.ContextError(errors.New("database is closed"))
+	}
+	err := fn(&memoryDatastoreTx{db: db})
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (db *memoryDatastore) update(fn func(tx *memoryDatastoreTx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.buckets == nil {
+		return common.ContextError(errors.New("database is closed"))
+	}
+	tx := &memoryDatastoreTx{db: db, canUpdate: true}
+	err := fn(tx)
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (tx *memoryDatastoreTx) bucket(name []byte) *memoryDatastoreBucket {
+	bucketName := string(name)
+	if tx.canUpdate {
+		if _, ok := tx.db.buckets[bucketName]; !ok {
+			tx.db.buckets[bucketName] = make(map[string][]byte)
+			tx.undo = append(tx.undo, func() {
+				delete(tx.db.buckets, bucketName)
+			})
+		}
+	}
+	return &memoryDatastoreBucket{tx: tx, name: bucketName}
+}
+
+func (tx *memoryDatastoreTx) clearBucket(name []byte) error {
+	if !tx.canUpdate {
+		return common.ContextError(errors.New("read-only transaction"))
+	}
+	bucketName := string(name)
+	oldBucket, existed := tx.db.buckets[bucketName]
+	tx.db.buckets[bucketName] = make(map[string][]byte)
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.db.buckets[bucketName] = oldBucket
+		} else {
+			delete(tx.db.buckets, bucketName)
+		}
+	})
+	return nil
+}
+
+func (b *memoryDatastoreBucket) get(key []byte) []byte {
+	return b.tx.db.buckets[b.name][string(key)]
+}
+
+func (b *memoryDatastoreBucket) put(key, value []byte) error {
+	if !b.tx.canUpdate {
+		return common.ContextError(errors.New("read-only transaction"))
+	}
+	bucket := b.tx.db.buckets[b.name]
+	stringKey := string(key)
+	oldValue, existed := bucket[stringKey]
+	// The caller may reuse the value buffer, so a copy is stored.
+	bucket[stringKey] = append([]byte(nil), value...)
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			bucket[stringKey] = oldValue
+		} else {
+			delete(bucket, stringKey)
+		}
+	})
+	return nil
+}
+
+func (b *memoryDatastoreBucket) delete(key []byte) error {
+	if !b.tx.canUpdate {
+		return common.ContextError(errors.New("read-only transaction"))
+	}
+	bucket := b.tx.db.buckets[b.name]
+	stringKey := string(key)
+	oldValue, existed := bucket[stringKey]
+	if !existed {
+		return nil
+	}
+	delete(bucket, stringKey)
+	b.tx.undo = append(b.tx.undo, func() {
+		bucket[stringKey] = oldValue
+	})
+	return nil
+}
+
+// cursor returns a cursor which iterates over the bucket keys, in sorted
+// order, as of the time the cursor is created. Keys deleted during
+// iteration are skipped.
+func (b *memoryDatastoreBucket) cursor() *memoryDatastoreCursor {
+	bucket := b.tx.db.buckets[b.name]
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &memoryDatastoreCursor{bucket: b, keys: keys}
+}
+
+func (c *memoryDatastoreCursor) first() ([]byte, []byte) {
+	c.index = 0
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) next() ([]byte, []byte) {
+	c.index += 1
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) current() ([]byte, []byte) {
+	bucket := c.bucket.tx.db.buckets[c.bucket.name]
+	for ; c.index < len(c.keys); c.index++ {
+		value, ok := bucket[c.keys[c.index]]
+		if ok {
+			return []byte(c.keys[c.index]), value
+		}
+	}
+	return nil, nil
+}
+
+func (c *memoryDatastoreCursor) close() {
+	c.keys = nil
+}
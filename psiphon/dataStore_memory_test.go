@@ -0,0 +1,116 @@
+// +build !BADGER_DB,!FILES_DB
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestEphemeralDataStore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-ephemeral-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := &Config{
+		DataStoreDirectory: testDataDirName,
+		EphemeralDataStore: true,
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	serverEntryCount := 10
+
+	for i := 0; i < serverEntryCount; i++ {
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            fmt.Sprintf("192.0.2.%d", i+1),
+				"configurationVersion": 1,
+			},
+			false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	count := CountServerEntries()
+	if count != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// A failed update transaction is rolled back.
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		err := bucket.delete([]byte("192.0.2.1"))
+		if err != nil {
+			return err
+		}
+		err = bucket.put([]byte("192.0.2.100"), []byte("{}"))
+		if err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatalf("unexpected update success")
+	}
+
+	count = CountServerEntries()
+	if count != serverEntryCount {
+		t.Fatalf("unexpected server entry count after rollback: %d", count)
+	}
+
+	CloseDataStore()
+
+	fileInfos, err := ioutil.ReadDir(testDataDirName)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %s", err)
+	}
+	if len(fileInfos) > 0 {
+		t.Fatalf("unexpected datastore files: %d", len(fileInfos))
+	}
+
+	// Data is discarded on close.
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	count = CountServerEntries()
+	if count != 0 {
+		t.Fatalf("unexpected server entry count after reopen: %d", count)
+	}
+}
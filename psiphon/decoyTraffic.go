@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/juju/ratelimit"
+)
+
+const (
+	DECOY_TRAFFIC_MODE_TUNNELED   = "tunneled"
+	DECOY_TRAFFIC_MODE_UNTUNNELED = "untunneled"
+)
+
+// decoyTrafficGenerator periodically makes cover HTTP requests to
+// DecoyTrafficURLs, at random intervals, to mask the idle and burst
+// patterns of tunneled traffic. Per DecoyTrafficMode, requests are sent
+// through an active tunnel or alongside the tunnel, untunneled. Decoy
+// traffic is disabled by default and is expected to be enabled via tactics.
+//
+// Decoy traffic is strictly capped: response bodies are limited to
+// DecoyTrafficMaxBytesPerRequest and read at no more than
+// DecoyTrafficMaxBytesPerSecond, and the generator stops once
+// DecoyTrafficMaxTotalBytes have been received.
+func (controller *Controller) decoyTrafficGenerator() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("decoyTrafficGenerator")
+
+	requests := 0
+	failures := 0
+	totalBytes := int64(0)
+
+	for {
+		p := controller.config.clientParameters.Get()
+		mode := p.String(parameters.DecoyTrafficMode)
+		URLs := p.DownloadURLs(parameters.DecoyTrafficURLs)
+		interval := makeRandomPeriod(
+			p.Duration(parameters.DecoyTrafficMinInterval),
+			p.Duration(parameters.DecoyTrafficMaxInterval))
+		timeout := p.Duration(parameters.DecoyTrafficRequestTimeout)
+		maxBytes := int64(p.Int(parameters.DecoyTrafficMaxBytesPerRequest))
+		bytesPerSecond := int64(p.Int(parameters.DecoyTrafficMaxBytesPerSecond))
+		maxTotalBytes := int64(p.Int(parameters.DecoyTrafficMaxTotalBytes))
+		p = nil
+
+		// When disabled, recheck periodically in case tactics enable decoy
+		// traffic.
+		enabled := (mode == DECOY_TRAFFIC_MODE_TUNNELED ||
+			mode == DECOY_TRAFFIC_MODE_UNTUNNELED) && len(URLs) > 0
+		if !enabled {
+			interval = 1 * time.Minute
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			NoticeInfo("exiting decoy traffic generator")
+			return
+		}
+
+		if !enabled {
+			continue
+		}
+
+		if totalBytes >= maxTotalBytes {
+			continue
+		}
+		if maxBytes > maxTotalBytes-totalBytes {
+			maxBytes = maxTotalBytes - totalBytes
+		}
+
+		var httpClient *http.Client
+		var err error
+		_, URL, skipVerify := URLs.Select(0)
+
+		if mode == DECOY_TRAFFIC_MODE_TUNNELED {
+			tunnel := controller.getNextActiveTunnel()
+			if tunnel == nil {
+				continue
+			}
+			httpClient, err = MakeTunneledHTTPClient(
+				controller.config, tunnel, skipVerify)
+		} else {
+			httpClient, err = MakeUntunneledHTTPClient(
+				controller.runCtx,
+				controller.config,
+				controller.untunneledDialConfig,
+				nil,
+				skipVerify)
+		}
+		if err != nil {
+			NoticeAlert("make decoy traffic client failed: %s", err)
+			continue
+		}
+
+		ctx, cancelFunc := context.WithTimeout(controller.runCtx, timeout)
+		n, err := makeDecoyRequest(ctx, httpClient, URL, maxBytes, bytesPerSecond)
+		cancelFunc()
+
+		requests += 1
+		totalBytes += n
+		if err != nil {
+			failures += 1
+			NoticeInfo("decoy request failed: %s", err)
+		}
+
+		NoticeDecoyStats(mode, requests, failures, totalBytes)
+	}
+}
+
+// makeDecoyRequest makes a GET request to the specified URL and discards up
+// to maxBytes of the response body, read at no more than bytesPerSecond.
+// Returns the number of response body bytes read.
+func makeDecoyRequest(
+	ctx context.Context,
+	httpClient *http.Client,
+	URL string,
+	maxBytes int64,
+	bytesPerSecond int64) (int64, error) {
+
+	request, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	if maxBytes == 0 {
+		return 0, nil
+	}
+
+	reader := ratelimit.Reader(
+		io.LimitReader(response.Body, maxBytes),
+		ratelimit.NewBucketWithRate(float64(bytesPerSecond), bytesPerSecond))
+
+	n, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = errors.New("request timeout")
+		}
+		return n, common.ContextError(err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+func TestMakeDecoyRequest(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Path == "/slow" {
+				<-r.Context().Done()
+				return
+			}
+			w.Write(make([]byte, 65536))
+		}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	// The response body is truncated at maxBytes.
+
+	n, err := makeDecoyRequest(ctx, http.DefaultClient, server.URL, 1000, 1000000)
+	if err != nil {
+		t.Fatalf("makeDecoyRequest failed: %s", err)
+	}
+	if n != 1000 {
+		t.Fatalf("unexpected bytes read: %d", n)
+	}
+
+	// The response body is read at no more than bytesPerSecond, after an
+	// initial burst of bytesPerSecond.
+
+	startTime := monotime.Now()
+	n, err = makeDecoyRequest(ctx, http.DefaultClient, server.URL, 20000, 10000)
+	if err != nil {
+		t.Fatalf("makeDecoyRequest failed: %s", err)
+	}
+	if n != 20000 {
+		t.Fatalf("unexpected bytes read: %d", n)
+	}
+	if monotime.Since(startTime) < 900*time.Millisecond {
+		t.Fatalf("unexpected read duration: %s", monotime.Since(startTime))
+	}
+
+	// The request is interrupted by the context.
+
+	timeoutCtx, cancelFunc := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelFunc()
+	_, err = makeDecoyRequest(timeoutCtx, http.DefaultClient, server.URL+"/slow", 1000, 1000)
+	if err == nil {
+		t.Fatalf("makeDecoyRequest succeeded unexpectedly")
+	}
+
+	_, err = makeDecoyRequest(ctx, http.DefaultClient, server.URL+"/missing", 1000, 1000)
+	if err == nil {
+		t.Fatalf("makeDecoyRequest succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PCAP_MAGIC               = 0xa1b2c3d4
+	PCAP_SNAP_LENGTH         = 65535
+	PCAP_LINKTYPE_RAW        = 101
+	DIAL_CAPTURE_MAX_SEGMENT = 65535 - 60
+)
+
+// dialCapture writes the client's dial traffic to a PCAP capture file, for
+// diagnosing middlebox interference reported by users. The capture is
+// enabled with the DialCaptureFilename config and records the TCP
+// connections made when dialing tunnels and fetching tactics.
+//
+// By default, the capture consists of synthetic IP and TCP packets, one per
+// read or write on each dialed conn, which record the timing, direction,
+// and length of the framing sent and received by the client. The payload,
+// which consists of the obfuscated bytes on the wire, is included only
+// when DialCaptureIncludePayload is set. Since these packets are recorded
+// above the network stack, retransmissions, segmentation, and packets
+// injected by middleboxes are not captured.
+//
+// When DialCaptureRawPackets is set, and where the platform and privileges
+// permit, the actual packets sent to and received from dialed server
+// addresses are captured instead.
+type dialCapture struct {
+	mutex          sync.Mutex
+	file           *os.File
+	includePayload bool
+	remoteIPs      map[string]int
+	rawCapture     *rawCapture
+}
+
+func newDialCapture(
+	filename string, includePayload, rawPackets bool) (*dialCapture, error) {
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], PCAP_SNAP_LENGTH)
+	binary.LittleEndian.PutUint32(header[20:24], PCAP_LINKTYPE_RAW)
+
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		return nil, common.ContextError(err)
+	}
+
+	capture := &dialCapture{
+		file:           file,
+		includePayload: includePayload,
+		remoteIPs:      make(map[string]int),
+	}
+
+	if rawPackets {
+		capture.rawCapture, err = startRawCapture(capture)
+		if err != nil {
+			NoticeAlert("raw packet dial capture unavailable: %s", err)
+		}
+	}
+
+	return capture, nil
+}
+
+func (capture *dialCapture) close() {
+	if capture.rawCapture != nil {
+		capture.rawCapture.stop()
+	}
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	capture.file.Close()
+	capture.file = nil
+}
+
+// writePacket writes a PCAP record for the IP packet, truncated to
+// capturedLength bytes.
+func (capture *dialCapture) writePacket(
+	timestamp time.Time, packet []byte, capturedLength int) {
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.file == nil {
+		return
+	}
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(capturedLength))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(packet)))
+
+	_, err := capture.file.Write(append(header, packet[:capturedLength]...))
+	if err != nil {
+		NoticeAlert("dial capture write failed: %s", common.ContextError(err))
+	}
+}
+
+// isCapturedIP indicates whether the IP address is the remote address of an
+// active captured conn.
+func (capture *dialCapture) isCapturedIP(IP net.IP) bool {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return capture.remoteIPs[IP.String()] > 0
+}
+
+// wrapConn returns a conn which records its traffic in the capture. conns
+// which are not TCP conns are not captured.
+func (capture *dialCapture) wrapConn(conn net.Conn) net.Conn {
+
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return conn
+	}
+	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn
+	}
+
+	capture.mutex.Lock()
+	capture.remoteIPs[remoteAddr.IP.String()] += 1
+	capture.mutex.Unlock()
+
+	captureConn := &captureConn{
+		Conn:       conn,
+		capture:    capture,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+	}
+
+	// Record the handshake which has already completed.
+	captureConn.writeSegment(true, TCP_FLAG_SYN, nil)
+	captureConn.writeSegment(false, TCP_FLAG_SYN|TCP_FLAG_ACK, nil)
+
+	return captureConn
+}
+
+const (
+	TCP_FLAG_FIN = 0x01
+	TCP_FLAG_SYN = 0x02
+	TCP_FLAG_PSH = 0x08
+	TCP_FLAG_ACK = 0x10
+)
+
+// captureConn records synthetic TCP segments for each read and write.
+type captureConn struct {
+	net.Conn
+	capture    *dialCapture
+	localAddr  *net.TCPAddr
+	remoteAddr *net.TCPAddr
+	mutex      sync.Mutex
+	sentSeq    uint32
+	recvSeq    uint32
+	isClosed   int32
+}
+
+func (conn *captureConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		conn.writeData(false, buffer[:n])
+	}
+	return n, err
+}
+
+func (conn *captureConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	if n > 0 {
+		conn.writeData(true, buffer[:n])
+	}
+	return n, err
+}
+
+func (conn *captureConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.isClosed, 0, 1) {
+		conn.writeSegment(true, TCP_FLAG_FIN|TCP_FLAG_ACK, nil)
+		conn.capture.mutex.Lock()
+		conn.capture.remoteIPs[conn.remoteAddr.IP.String()] -= 1
+		if conn.capture.remoteIPs[conn.remoteAddr.IP.String()] <= 0 {
+			delete(conn.capture.remoteIPs, conn.remoteAddr.IP.String())
+		}
+		conn.capture.mutex.Unlock()
+	}
+	return conn.Conn.Close()
+}
+
+// IsClosed implements the Closer interface, when the underlying conn does.
+func (conn *captureConn) IsClosed() bool {
+	closer, ok := conn.Conn.(common.Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
+
+func (conn *captureConn) writeData(isSent bool, data []byte) {
+	for len(data) > 0 {
+		segment := data
+		if len(segment) > DIAL_CAPTURE_MAX_SEGMENT {
+			segment = segment[:DIAL_CAPTURE_MAX_SEGMENT]
+		}
+		conn.writeSegment(isSent, TCP_FLAG_PSH|TCP_FLAG_ACK, segment)
+		data = data[len(segment):]
+	}
+}
+
+func (conn *captureConn) writeSegment(isSent bool, flags byte, payload []byte) {
+
+	// When raw packets are being captured, the synthetic segments are
+	// redundant.
+	if conn.capture.rawCapture != nil {
+		return
+	}
+
+	// The segment is written under the conn lock, so records for the conn
+	// are written in sequence order.
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	srcAddr, dstAddr := conn.localAddr, conn.remoteAddr
+	seq, ack := conn.sentSeq, conn.recvSeq
+	if !isSent {
+		srcAddr, dstAddr = dstAddr, srcAddr
+		seq, ack = ack, seq
+	}
+
+	advance := uint32(len(payload))
+	if flags&(TCP_FLAG_SYN|TCP_FLAG_FIN) != 0 {
+		advance += 1
+	}
+	if isSent {
+		conn.sentSeq += advance
+	} else {
+		conn.recvSeq += advance
+	}
+
+	tcpHeader := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcpHeader[0:2], uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(tcpHeader[2:4], uint16(dstAddr.Port))
+	binary.BigEndian.PutUint32(tcpHeader[4:8], seq)
+	if flags&TCP_FLAG_ACK != 0 {
+		binary.BigEndian.PutUint32(tcpHeader[8:12], ack)
+	}
+	tcpHeader[12] = 5 << 4
+	tcpHeader[13] = flags
+	binary.BigEndian.PutUint16(tcpHeader[14:16], 65535)
+
+	var ipHeader []byte
+	if srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4(); srcIP != nil && dstIP != nil {
+		ipHeader = make([]byte, 20)
+		ipHeader[0] = 0x45
+		binary.BigEndian.PutUint16(ipHeader[2:4], uint16(20+20+len(payload)))
+		binary.BigEndian.PutUint16(ipHeader[6:8], 0x4000)
+		ipHeader[8] = 64
+		ipHeader[9] = 6
+		copy(ipHeader[12:16], srcIP)
+		copy(ipHeader[16:20], dstIP)
+		binary.BigEndian.PutUint16(ipHeader[10:12], ipv4HeaderChecksum(ipHeader))
+	} else {
+		ipHeader = make([]byte, 40)
+		ipHeader[0] = 0x60
+		binary.BigEndian.PutUint16(ipHeader[4:6], uint16(20+len(payload)))
+		ipHeader[6] = 6
+		ipHeader[7] = 64
+		copy(ipHeader[8:24], srcAddr.IP.To16())
+		copy(ipHeader[24:40], dstAddr.IP.To16())
+	}
+
+	packet := append(append(ipHeader, tcpHeader...), payload...)
+
+	capturedLength := len(packet)
+	if !conn.capture.includePayload {
+		capturedLength = len(ipHeader) + len(tcpHeader)
+	}
+
+	conn.capture.writePacket(time.Now(), packet, capturedLength)
+}
+
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// packetHeadersLength returns the length of the IP header and any TCP or
+// UDP header of the IP packet.
+func packetHeadersLength(packet []byte) int {
+
+	if len(packet) < 1 {
+		return 0
+	}
+
+	var length int
+	var transportProtocol byte
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return len(packet)
+		}
+		length = int(packet[0]&0x0f) * 4
+		transportProtocol = packet[9]
+	case 6:
+		if len(packet) < 40 {
+			return len(packet)
+		}
+		length = 40
+		transportProtocol = packet[6]
+	default:
+		return len(packet)
+	}
+
+	switch transportProtocol {
+	case 6:
+		if len(packet) >= length+13 {
+			length += int(packet[length+12]>>4) * 4
+		}
+	case 17:
+		length += 8
+	}
+
+	if length > len(packet) {
+		length = len(packet)
+	}
+	return length
+}
+
+// packetAddresses returns the source and destination addresses of the IP
+// packet.
+func packetAddresses(packet []byte) (net.IP, net.IP, bool) {
+	if len(packet) < 1 {
+		return nil, nil, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, nil, false
+		}
+		return net.IP(packet[12:16]), net.IP(packet[16:20]), true
+	case 6:
+		if len(packet) < 40 {
+			return nil, nil, false
+		}
+		return net.IP(packet[8:24]), net.IP(packet[24:40]), true
+	}
+	return nil, nil, false
+}
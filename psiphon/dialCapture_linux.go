@@ -0,0 +1,106 @@
+// +build linux
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// rawCapture captures packets using an AF_PACKET socket, which requires
+// CAP_NET_RAW. Only packets to and from the remote addresses of active
+// captured conns are recorded.
+type rawCapture struct {
+	socketFD  int
+	isStopped int32
+	waitGroup sync.WaitGroup
+}
+
+func startRawCapture(capture *dialCapture) (*rawCapture, error) {
+
+	// SOCK_DGRAM delivers packets with the link-layer header removed, which
+	// matches the PCAP_LINKTYPE_RAW capture format.
+	socketFD, err := syscall.Socket(
+		syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// A receive timeout allows the capture goroutine to check for stop.
+	timeout := syscall.NsecToTimeval(int64(500 * time.Millisecond))
+	err = syscall.SetsockoptTimeval(
+		socketFD, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
+
+	raw := &rawCapture{socketFD: socketFD}
+
+	raw.waitGroup.Add(1)
+	go func() {
+		defer raw.waitGroup.Done()
+
+		buffer := make([]byte, PCAP_SNAP_LENGTH)
+		for atomic.LoadInt32(&raw.isStopped) == 0 {
+
+			n, _, err := syscall.Recvfrom(socketFD, buffer, 0)
+			if err != nil {
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				NoticeAlert("raw packet dial capture failed: %s", common.ContextError(err))
+				return
+			}
+
+			packet := buffer[:n]
+			srcIP, dstIP, ok := packetAddresses(packet)
+			if !ok ||
+				!(capture.isCapturedIP(srcIP) || capture.isCapturedIP(dstIP)) {
+				continue
+			}
+
+			capturedLength := len(packet)
+			if !capture.includePayload {
+				capturedLength = packetHeadersLength(packet)
+			}
+
+			capture.writePacket(time.Now(), packet, capturedLength)
+		}
+	}()
+
+	return raw, nil
+}
+
+func (raw *rawCapture) stop() {
+	atomic.StoreInt32(&raw.isStopped, 1)
+	raw.waitGroup.Wait()
+	syscall.Close(raw.socketFD)
+}
+
+func htons(value uint16) uint16 {
+	return (value << 8) | (value >> 8)
+}
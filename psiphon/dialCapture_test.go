@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialCapture(t *testing.T) {
+	for _, includePayload := range []bool{false, true} {
+		runTestDialCapture(t, includePayload)
+	}
+}
+
+func runTestDialCapture(t *testing.T, includePayload bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-dial-capture-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "capture.pcap")
+
+	capture, err := newDialCapture(filename, includePayload, false)
+	if err != nil {
+		t.Fatalf("newDialCapture failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 100)
+		n, err := conn.Read(buffer)
+		if err == nil {
+			conn.Write(buffer[:n/2])
+		}
+	}()
+
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	conn := capture.wrapConn(tcpConn)
+
+	if !capture.isCapturedIP(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected isCapturedIP result")
+	}
+
+	_, err = conn.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	_, err = conn.Read(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	conn.Close()
+
+	if capture.isCapturedIP(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected isCapturedIP result")
+	}
+
+	capture.close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	if len(data) < 24 ||
+		binary.LittleEndian.Uint32(data[0:4]) != PCAP_MAGIC ||
+		binary.LittleEndian.Uint32(data[20:24]) != PCAP_LINKTYPE_RAW {
+		t.Fatalf("unexpected PCAP header")
+	}
+
+	// Expect SYN, SYN-ACK, written data, read data, and FIN.
+
+	expectedFlags := []byte{
+		TCP_FLAG_SYN,
+		TCP_FLAG_SYN | TCP_FLAG_ACK,
+		TCP_FLAG_PSH | TCP_FLAG_ACK,
+		TCP_FLAG_PSH | TCP_FLAG_ACK,
+		TCP_FLAG_FIN | TCP_FLAG_ACK,
+	}
+	expectedPayloadLengths := []int{0, 0, 100, 50, 0}
+
+	offset := 24
+	for i := 0; i < len(expectedFlags); i++ {
+
+		if len(data) < offset+16 {
+			t.Fatalf("missing record %d", i)
+		}
+		capturedLength := int(binary.LittleEndian.Uint32(data[offset+8 : offset+12]))
+		originalLength := int(binary.LittleEndian.Uint32(data[offset+12 : offset+16]))
+		offset += 16
+
+		packet := data[offset : offset+capturedLength]
+		offset += capturedLength
+
+		if originalLength != 40+expectedPayloadLengths[i] {
+			t.Fatalf("unexpected length for record %d: %d", i, originalLength)
+		}
+		if includePayload && capturedLength != originalLength ||
+			!includePayload && capturedLength != 40 {
+			t.Fatalf("unexpected captured length for record %d: %d", i, capturedLength)
+		}
+		if packetHeadersLength(packet) != 40 {
+			t.Fatalf("unexpected headers length for record %d", i)
+		}
+		if packet[33] != expectedFlags[i] {
+			t.Fatalf("unexpected flags for record %d: %x", i, packet[33])
+		}
+		if ipv4HeaderChecksum(packet[0:20]) != 0 {
+			t.Fatalf("invalid IP header checksum for record %d", i)
+		}
+	}
+
+	if offset != len(data) {
+		t.Fatalf("unexpected additional records")
+	}
+}
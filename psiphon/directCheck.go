@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	DIRECT_CHECK_MAX_BODY_SIZE = 1 << 20
+)
+
+// DirectCheckResult is the result of a direct check, which performs the
+// same HTTP request both through the tunnel and directly, untunneled. The
+// results may be compared to diagnose whether a site is blocked on the local
+// network: for example, an untunneled request that fails, or that returns a
+// different status or body, while the tunneled request succeeds.
+//
+// StatusCodesMatch and BodiesMatch are set only when both requests succeed.
+type DirectCheckResult struct {
+	Tunneled         *DirectCheckRequestResult
+	Untunneled       *DirectCheckRequestResult
+	StatusCodesMatch bool
+	BodiesMatch      bool
+}
+
+// DirectCheckRequestResult is the result of one direct check request.
+//
+// Duration is the time taken to receive the response body, up to
+// DIRECT_CHECK_MAX_BODY_SIZE, or until the request failed. BodySHA256 is the
+// hex-encoded SHA-256 digest of the response body; when the body exceeds
+// DIRECT_CHECK_MAX_BODY_SIZE, only that prefix is read and hashed, and
+// BodyTruncated is set. Error is set when the request fails.
+type DirectCheckRequestResult struct {
+	StatusCode    int
+	Duration      time.Duration
+	BodySize      int64
+	BodySHA256    string
+	BodyTruncated bool
+	Error         string
+}
+
+// DirectCheck performs the specified HTTP request both through an active
+// tunnel and directly, untunneled, and returns the comparative results.
+// The two requests are performed concurrently. Request failures are
+// reported in the results; an error is returned only when the check cannot
+// be performed, for example when there is no active tunnel.
+//
+// Both requests use the untunneled dial configuration and tunnel in use by
+// the controller, so DirectCheck may be called only while the controller is
+// running.
+func (controller *Controller) DirectCheck(
+	ctx context.Context, method, requestURL string) (*DirectCheckResult, error) {
+
+	tunnel := controller.getNextActiveTunnel()
+	if tunnel == nil {
+		return nil, common.ContextError(errors.New("no active tunnels"))
+	}
+
+	timeout := controller.config.clientParameters.Get().Duration(
+		parameters.DirectCheckTimeout)
+
+	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	tunneledClient, err := MakeTunneledHTTPClient(
+		controller.config, tunnel, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	untunneledClient, err := MakeUntunneledHTTPClient(
+		ctx, controller.config, controller.untunneledDialConfig, nil, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// The untunneled request is visible to the local network, so it must not
+	// use the Psiphon User-Agent, which identifies the client. A generic
+	// User-Agent is used for both requests, so that the responses are
+	// comparable. When no User-Agent picker is registered, the User-Agent is
+	// blank and no User-Agent header is sent.
+
+	userAgent := pickUserAgent()
+
+	result := &DirectCheckResult{}
+
+	waitGroup := new(sync.WaitGroup)
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		result.Tunneled = performDirectCheckRequest(
+			ctx, tunneledClient, method, requestURL, userAgent)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		result.Untunneled = performDirectCheckRequest(
+			ctx, untunneledClient, method, requestURL, userAgent)
+	}()
+	waitGroup.Wait()
+
+	compareDirectCheckResults(result)
+
+	return result, nil
+}
+
+// performDirectCheckRequest performs one direct check request with the
+// specified http.Client.
+func performDirectCheckRequest(
+	ctx context.Context,
+	httpClient *http.Client,
+	method, requestURL, userAgent string) *DirectCheckRequestResult {
+
+	defer httpClient.Transport.(*http.Transport).CloseIdleConnections()
+
+	result := &DirectCheckRequestResult{}
+
+	request, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		result.Error = common.ContextError(err).Error()
+		return result
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", userAgent)
+
+	startTime := time.Now()
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		result.Duration = time.Since(startTime)
+		result.Error = common.ContextError(FilterUrlError(err)).Error()
+		return result
+	}
+	defer response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, io.LimitReader(response.Body, DIRECT_CHECK_MAX_BODY_SIZE))
+	if err == nil && n == DIRECT_CHECK_MAX_BODY_SIZE {
+		var extra [1]byte
+		var m int
+		m, err = io.ReadFull(response.Body, extra[:])
+		if m > 0 {
+			result.BodyTruncated = true
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	result.Duration = time.Since(startTime)
+	if err != nil {
+		result.Error = common.ContextError(err).Error()
+		return result
+	}
+
+	result.BodySize = n
+	result.BodySHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return result
+}
+
+func compareDirectCheckResults(result *DirectCheckResult) {
+
+	if result.Tunneled.Error != "" || result.Untunneled.Error != "" {
+		return
+	}
+
+	result.StatusCodesMatch =
+		result.Tunneled.StatusCode == result.Untunneled.StatusCode
+
+	result.BodiesMatch =
+		result.Tunneled.BodyTruncated == result.Untunneled.BodyTruncated &&
+			result.Tunneled.BodySize == result.Untunneled.BodySize &&
+			result.Tunneled.BodySHA256 == result.Untunneled.BodySHA256
+}
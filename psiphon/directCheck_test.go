@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDirectCheckRequests(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/blank-user-agent" {
+				if _, ok := request.Header["User-Agent"]; ok {
+					http.Error(responseWriter, "", http.StatusBadRequest)
+				}
+				return
+			}
+			if request.Header.Get("User-Agent") != "test-user-agent" {
+				http.Error(responseWriter, "", http.StatusBadRequest)
+				return
+			}
+			switch request.URL.Path {
+			case "/blocked":
+				http.Error(responseWriter, "blocked", http.StatusForbidden)
+			case "/large":
+				responseWriter.Write(
+					[]byte(strings.Repeat("x", DIRECT_CHECK_MAX_BODY_SIZE+1)))
+			default:
+				responseWriter.Write([]byte("content"))
+			}
+		}))
+	defer server.Close()
+
+	check := func(path string) *DirectCheckRequestResult {
+		return performDirectCheckRequest(
+			context.Background(),
+			&http.Client{Transport: &http.Transport{}},
+			"GET",
+			server.URL+path,
+			"test-user-agent")
+	}
+
+	content := check("/content")
+	if content.Error != "" ||
+		content.StatusCode != http.StatusOK ||
+		content.BodySize != int64(len("content")) ||
+		content.BodySHA256 == "" ||
+		content.BodyTruncated {
+		t.Fatalf("unexpected result: %+v", content)
+	}
+
+	large := check("/large")
+	if large.Error != "" ||
+		large.BodySize != DIRECT_CHECK_MAX_BODY_SIZE ||
+		!large.BodyTruncated {
+		t.Fatalf("unexpected result: %+v", large)
+	}
+
+	failed := performDirectCheckRequest(
+		context.Background(),
+		&http.Client{Transport: &http.Transport{}},
+		"GET",
+		"http://127.0.0.1:0/",
+		"test-user-agent")
+	if failed.Error == "" {
+		t.Fatalf("unexpected result: %+v", failed)
+	}
+
+	// With no registered User-Agent picker, no User-Agent header is sent.
+
+	blankUserAgent := performDirectCheckRequest(
+		context.Background(),
+		&http.Client{Transport: &http.Transport{}},
+		"GET",
+		server.URL+"/blank-user-agent",
+		"")
+	if blankUserAgent.Error != "" || blankUserAgent.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected result: %+v", blankUserAgent)
+	}
+
+	testCases := []struct {
+		tunneled         *DirectCheckRequestResult
+		untunneled       *DirectCheckRequestResult
+		statusCodesMatch bool
+		bodiesMatch      bool
+	}{
+		{content, check("/content"), true, true},
+		{content, check("/blocked"), false, false},
+		{content, failed, false, false},
+		{large, check("/large"), true, true},
+	}
+
+	for _, testCase := range testCases {
+		result := &DirectCheckResult{
+			Tunneled:   testCase.tunneled,
+			Untunneled: testCase.untunneled,
+		}
+		compareDirectCheckResults(result)
+		if result.StatusCodesMatch != testCase.statusCodesMatch ||
+			result.BodiesMatch != testCase.bodiesMatch {
+			t.Fatalf("unexpected comparison: %+v", result)
+		}
+	}
+}
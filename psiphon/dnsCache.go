@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// dnsCache is a bounded, least recently used cache of tunneled DNS
+// resolutions. Each tunneled resolution is a round trip through the tunnel,
+// which, on high latency tunnels, noticeably delays each connection that
+// requires one.
+//
+// Positive entries expire after the record TTL, capped by the DNSCacheMaxTTL
+// parameter. Resolutions which return no addresses, such as NXDOMAIN, are
+// cached as negative entries for DNSCacheNegativeTTL. Resolution errors,
+// which may be transient, are not cached.
+type dnsCache struct {
+	clientParameters *parameters.ClientParameters
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	metrics DNSCacheMetrics
+}
+
+type dnsCacheEntry struct {
+	host   string
+	IPs    []net.IP
+	expiry monotime.Time
+}
+
+// DNSCacheMetrics reports DNS cache activity. Hits includes NegativeHits.
+type DNSCacheMetrics struct {
+	Entries      int
+	Hits         int64
+	NegativeHits int64
+	Misses       int64
+	Evictions    int64
+}
+
+func newDNSCache(clientParameters *parameters.ClientParameters) *dnsCache {
+	return &dnsCache{
+		clientParameters: clientParameters,
+		entries:          make(map[string]*list.Element),
+		lru:              list.New(),
+	}
+}
+
+// get returns the cached addresses for host and the entry's remaining TTL.
+// The returned IPs are empty for a negative entry. ok is false when there is
+// no unexpired entry.
+func (cache *dnsCache) get(host string) (IPs []net.IP, TTL time.Duration, ok bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[host]
+	if ok {
+		entry := element.Value.(*dnsCacheEntry)
+		TTL = entry.expiry.Sub(monotime.Now())
+		if TTL > 0 {
+			cache.lru.MoveToFront(element)
+			cache.metrics.Hits += 1
+			if len(entry.IPs) == 0 {
+				cache.metrics.NegativeHits += 1
+			}
+			return entry.IPs, TTL, true
+		}
+		cache.lru.Remove(element)
+		delete(cache.entries, host)
+	}
+
+	cache.metrics.Misses += 1
+	return nil, 0, false
+}
+
+// put stores a resolution result. An empty IPs stores a negative entry.
+func (cache *dnsCache) put(host string, IPs []net.IP, TTL time.Duration) {
+
+	p := cache.clientParameters.Get()
+	maxEntries := p.Int(parameters.DNSCacheMaxEntries)
+	if len(IPs) == 0 {
+		TTL = p.Duration(parameters.DNSCacheNegativeTTL)
+	} else if maxTTL := p.Duration(parameters.DNSCacheMaxTTL); TTL > maxTTL {
+		TTL = maxTTL
+	}
+	p = nil
+
+	if maxEntries == 0 || TTL <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := &dnsCacheEntry{
+		host:   host,
+		IPs:    IPs,
+		expiry: monotime.Now().Add(TTL),
+	}
+
+	if element, ok := cache.entries[host]; ok {
+		element.Value = entry
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[host] = cache.lru.PushFront(entry)
+
+	for cache.lru.Len() > maxEntries {
+		element := cache.lru.Back()
+		cache.lru.Remove(element)
+		delete(cache.entries, element.Value.(*dnsCacheEntry).host)
+		cache.metrics.Evictions += 1
+	}
+}
+
+// getMetrics returns a snapshot of the cache metrics.
+func (cache *dnsCache) getMetrics() DNSCacheMetrics {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	metrics := cache.metrics
+	metrics.Entries = cache.lru.Len()
+	return metrics
+}
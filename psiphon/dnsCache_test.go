@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestDNSCache(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.DNSCacheMaxEntries:  2,
+		parameters.DNSCacheMaxTTL:      "1m",
+		parameters.DNSCacheNegativeTTL: "100ms",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	cache := newDNSCache(clientParameters)
+
+	IP1 := net.ParseIP("192.0.2.1")
+	IP2 := net.ParseIP("192.0.2.2")
+
+	if _, _, ok := cache.get("a.example.org"); ok {
+		t.Fatalf("unexpected hit")
+	}
+
+	cache.put("a.example.org", []net.IP{IP1}, 1*time.Hour)
+	cache.put("b.example.org", nil, 0)
+
+	IPs, TTL, ok := cache.get("a.example.org")
+	if !ok || len(IPs) != 1 || !IPs[0].Equal(IP1) || TTL > 1*time.Minute {
+		t.Fatalf("unexpected entry: %v %s %v", IPs, TTL, ok)
+	}
+
+	IPs, _, ok = cache.get("b.example.org")
+	if !ok || len(IPs) != 0 {
+		t.Fatalf("unexpected negative entry")
+	}
+
+	// Evicts a.example.org, the least recently used entry.
+	cache.put("c.example.org", []net.IP{IP2}, 1*time.Minute)
+
+	if _, _, ok := cache.get("a.example.org"); ok {
+		t.Fatalf("unexpected hit")
+	}
+
+	cache.put("b.example.org", nil, 0)
+	time.Sleep(200 * time.Millisecond)
+
+	if _, _, ok := cache.get("b.example.org"); ok {
+		t.Fatalf("unexpected negative hit after expiry")
+	}
+
+	metrics := cache.getMetrics()
+	if metrics.Entries != 1 ||
+		metrics.Hits != 2 ||
+		metrics.NegativeHits != 1 ||
+		metrics.Misses != 3 ||
+		metrics.Evictions != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
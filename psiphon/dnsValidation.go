@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// Plaintext DNS answers for untunneled lookups, including fronting domain
+// resolution during bootstrap, are checked for signs of poisoning:
+//
+// - Bogon answers: private, loopback, link-local, reserved, and other
+//   non-routable addresses, which DNS injectors commonly return.
+//
+// - Known block IPs: addresses, listed in the DNSPoisoningBlockIPs
+//   parameter, which are known to be returned by DNS injection.
+//
+// - Mismatched TTLs: the records of an RRset must have the same TTL (RFC 2181
+//   section 5.2); injected answers which are assembled without regard for
+//   this are flagged.
+//
+// When poisoning is detected, a DNSPoisoningDetected notice is emitted and
+// the lookup is retried with the UntunneledDNSResolvers encrypted resolvers.
+// For DNSPoisoningSwitchPeriod, subsequent lookups use only the encrypted
+// resolvers, when configured.
+//
+// Answers from encrypted resolvers are authenticated by TLS and are not
+// checked.
+
+var bogonNetworks = parseCIDRs([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/3",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+	"2001:db8::/32",
+})
+
+func parseCIDRs(CIDRs []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(CIDRs))
+	for _, CIDR := range CIDRs {
+		_, network, err := net.ParseCIDR(CIDR)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// dnsPoisoningDetectedTime is the monotonic time at which plaintext DNS
+// poisoning was last detected, or 0.
+var dnsPoisoningDetectedTime int64
+
+func setDNSPoisoningDetected() {
+	atomic.StoreInt64(&dnsPoisoningDetectedTime, int64(monotime.Now()))
+}
+
+func isDNSPoisoningDetected(period time.Duration) bool {
+	detectedTime := atomic.LoadInt64(&dnsPoisoningDetectedTime)
+	return detectedTime != 0 &&
+		monotime.Since(monotime.Time(detectedTime)) < period
+}
+
+// validateDNSAnswer returns a description of why the answer appears to be
+// poisoned, or "" when no poisoning is detected. TTLs may be nil when the
+// resolver doesn't report TTLs.
+func validateDNSAnswer(
+	IPs []net.IP, TTLs []time.Duration, blockIPs []string) string {
+
+	for _, IP := range IPs {
+		for _, network := range bogonNetworks {
+			if network.Contains(IP) {
+				return fmt.Sprintf("bogon answer: %s", IP)
+			}
+		}
+	}
+
+	for _, blockIP := range blockIPs {
+		_, network, err := net.ParseCIDR(blockIP)
+		if err != nil {
+			IP := net.ParseIP(blockIP)
+			if IP == nil {
+				continue
+			}
+			bits := 128
+			if IP.To4() != nil {
+				bits = 32
+			}
+			network = &net.IPNet{IP: IP, Mask: net.CIDRMask(bits, bits)}
+		}
+		for _, IP := range IPs {
+			if network.Contains(IP) {
+				return fmt.Sprintf("known block IP: %s", IP)
+			}
+		}
+	}
+
+	for i := 1; i < len(TTLs); i++ {
+		if TTLs[i] != TTLs[0] {
+			return fmt.Sprintf("mismatched TTLs: %s, %s", TTLs[0], TTLs[i])
+		}
+	}
+
+	return ""
+}
+
+// plaintextLookupIPFunc is the platform plaintext DNS lookup, which returns
+// record TTLs when available.
+type plaintextLookupIPFunc func(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, []time.Duration, error)
+
+// validatedLookupIP resolves host using the encrypted resolvers and the
+// plaintext lookup, in the order determined by the client parameters, and
+// checks plaintext answers for poisoning.
+func validatedLookupIP(
+	ctx context.Context,
+	host string,
+	config *DialConfig,
+	plaintextLookupIP plaintextLookupIPFunc) ([]net.IP, error) {
+
+	if config.ClientParameters == nil {
+		IPs, _, err := plaintextLookupIP(ctx, host, config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return IPs, nil
+	}
+
+	p := config.ClientParameters.Get()
+	onPoisoning := p.Bool(parameters.UntunneledDNSResolversOnPoisoning)
+	validate := p.Bool(parameters.DNSAnswerValidation)
+	blockIPs := p.Strings(parameters.DNSPoisoningBlockIPs)
+	switchPeriod := p.Duration(parameters.DNSPoisoningSwitchPeriod)
+	p = nil
+
+	poisoningDetected := isDNSPoisoningDetected(switchPeriod)
+
+	secureAttempted := false
+
+	if !onPoisoning || poisoningDetected {
+
+		IPs, attempted, fallback, err := secureLookupIP(ctx, host, config)
+		if attempted {
+			if err == nil {
+				return IPs, nil
+			}
+			if !fallback || poisoningDetected {
+				return nil, common.ContextError(err)
+			}
+		}
+		secureAttempted = attempted
+	}
+
+	IPs, TTLs, err := plaintextLookupIP(ctx, host, config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if !validate {
+		return IPs, nil
+	}
+
+	reason := validateDNSAnswer(IPs, TTLs, blockIPs)
+	if reason == "" {
+		return IPs, nil
+	}
+
+	setDNSPoisoningDetected()
+	NoticeDNSPoisoningDetected(host, reason)
+
+	if !secureAttempted {
+		IPs, attempted, _, err := secureLookupIP(ctx, host, config)
+		if attempted && err == nil {
+			return IPs, nil
+		}
+	}
+
+	return nil, common.ContextError(fmt.Errorf("DNS poisoning detected: %s", reason))
+}
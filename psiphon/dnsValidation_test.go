@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestValidateDNSAnswer(t *testing.T) {
+
+	blockIPs := []string{"203.98.7.65", "8.7.198.0/24"}
+
+	testCases := []struct {
+		description string
+		IPs         []string
+		TTLs        []time.Duration
+		poisoned    bool
+	}{
+		{"valid", []string{"93.184.216.34"}, nil, false},
+		{"valid IPv6", []string{"2606:2800:220:1:248:1893:25c8:1946"}, nil, false},
+		{"valid TTLs", []string{"93.184.216.34", "93.184.216.35"}, []time.Duration{60 * time.Second, 60 * time.Second}, false},
+		{"private", []string{"10.10.34.35"}, nil, true},
+		{"loopback", []string{"127.0.0.1"}, nil, true},
+		{"unspecified", []string{"0.0.0.0"}, nil, true},
+		{"reserved", []string{"243.185.187.39"}, nil, true},
+		{"IPv6 loopback", []string{"::1"}, nil, true},
+		{"block IP", []string{"203.98.7.65"}, nil, true},
+		{"block CIDR", []string{"8.7.198.45"}, nil, true},
+		{"mismatched TTLs", []string{"93.184.216.34", "93.184.216.35"}, []time.Duration{60 * time.Second, 300 * time.Second}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			var IPs []net.IP
+			for _, IP := range testCase.IPs {
+				IPs = append(IPs, net.ParseIP(IP))
+			}
+			reason := validateDNSAnswer(IPs, testCase.TTLs, blockIPs)
+			if (reason != "") != testCase.poisoned {
+				t.Fatalf("unexpected result: %s", reason)
+			}
+		})
+	}
+}
+
+func TestValidatedLookupIP(t *testing.T) {
+
+	secureIP := net.ParseIP("93.184.216.34")
+	poisonedIP := net.ParseIP("10.10.34.35")
+
+	dohResolver, _, CAFilename, stop := startTestSecureDNSServers(t, secureIP)
+	defer stop()
+
+	plaintextLookups := 0
+	poisonedLookupIP := func(
+		_ context.Context, _ string, _ *DialConfig) ([]net.IP, []time.Duration, error) {
+		plaintextLookups += 1
+		return []net.IP{poisonedIP}, nil, nil
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"UntunneledDNSResolvers":            []string{dohResolver},
+		"UntunneledDNSResolversOnPoisoning": true,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	dialConfig := &DialConfig{
+		TrustedCACertificatesFilename: CAFilename,
+		ClientParameters:              clientParameters,
+	}
+
+	atomic.StoreInt64(&dnsPoisoningDetectedTime, 0)
+	defer atomic.StoreInt64(&dnsPoisoningDetectedTime, 0)
+
+	// The poisoned plaintext answer is detected and the lookup switches to
+	// the encrypted resolver.
+
+	IPs, err := validatedLookupIP(
+		context.Background(), "example.org", dialConfig, poisonedLookupIP)
+	if err != nil {
+		t.Fatalf("validatedLookupIP failed: %s", err)
+	}
+	if len(IPs) != 1 || !IPs[0].Equal(secureIP) || plaintextLookups != 1 {
+		t.Fatalf("unexpected result: %v, %d", IPs, plaintextLookups)
+	}
+
+	// Subsequent lookups use only the encrypted resolver.
+
+	IPs, err = validatedLookupIP(
+		context.Background(), "example.org", dialConfig, poisonedLookupIP)
+	if err != nil {
+		t.Fatalf("validatedLookupIP failed: %s", err)
+	}
+	if len(IPs) != 1 || !IPs[0].Equal(secureIP) || plaintextLookups != 1 {
+		t.Fatalf("unexpected result: %v, %d", IPs, plaintextLookups)
+	}
+
+	// Without encrypted resolvers, the poisoned answer is rejected.
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"UntunneledDNSResolvers": []string{},
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	_, err = validatedLookupIP(
+		context.Background(), "example.org", dialConfig, poisonedLookupIP)
+	if err == nil {
+		t.Fatalf("unexpected success")
+	}
+
+	// With validation disabled, the answer is accepted.
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"DNSAnswerValidation": false,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	IPs, err = validatedLookupIP(
+		context.Background(), "example.org", dialConfig, poisonedLookupIP)
+	if err != nil {
+		t.Fatalf("validatedLookupIP failed: %s", err)
+	}
+	if len(IPs) != 1 || !IPs[0].Equal(poisonedIP) {
+		t.Fatalf("unexpected result: %v", IPs)
+	}
+}
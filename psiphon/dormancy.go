@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// tunnelDormancy tracks the dormancy mode state of a tunnel. A tunnel enters
+// dormancy mode after an idle period with no tunneled traffic, and exits
+// dormancy mode as soon as there's new traffic. Unlike the tunnel's received
+// bytes tracking, any sent or received bytes count as activity.
+//
+// tunnelDormancy is not safe for concurrent use.
+type tunnelDormancy struct {
+	lastBytesTransferredTime monotime.Time
+	isDormant                bool
+}
+
+func newTunnelDormancy(now monotime.Time) *tunnelDormancy {
+	return &tunnelDormancy{
+		lastBytesTransferredTime: now,
+	}
+}
+
+// update records the bytes transferred since the previous update and
+// returns whether the tunnel has just entered or exited dormancy mode. An
+// idle period of 0 disables dormancy mode, and exits dormancy mode if
+// already dormant.
+func (dormancy *tunnelDormancy) update(
+	now monotime.Time,
+	idlePeriod time.Duration,
+	sent, received int64) (entered, exited bool) {
+
+	if sent > 0 || received > 0 {
+		dormancy.lastBytesTransferredTime = now
+	}
+
+	if !dormancy.isDormant &&
+		idlePeriod > 0 &&
+		dormancy.lastBytesTransferredTime.Add(idlePeriod).Before(now) {
+
+		dormancy.isDormant = true
+		return true, false
+
+	} else if dormancy.isDormant &&
+		(sent > 0 || received > 0 || idlePeriod == 0) {
+
+		dormancy.isDormant = false
+		return false, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+func TestTunnelDormancy(t *testing.T) {
+
+	idlePeriod := 10 * time.Second
+
+	now := monotime.Now()
+	dormancy := newTunnelDormancy(now)
+
+	type step struct {
+		elapsed    time.Duration
+		idlePeriod time.Duration
+		sent       int64
+		received   int64
+		entered    bool
+		exited     bool
+		isDormant  bool
+	}
+
+	steps := []step{
+		// Traffic resets the idle period.
+		{5 * time.Second, idlePeriod, 1, 0, false, false, false},
+		{6 * time.Second, idlePeriod, 0, 0, false, false, false},
+		// Idle for longer than the idle period.
+		{5 * time.Second, idlePeriod, 0, 0, true, false, true},
+		// Remains dormant without a repeat transition.
+		{1 * time.Second, idlePeriod, 0, 0, false, false, true},
+		// Either sent or received bytes exit dormancy.
+		{1 * time.Second, idlePeriod, 0, 1, false, true, false},
+		{11 * time.Second, idlePeriod, 0, 0, true, false, true},
+		// Disabling dormancy exits dormancy.
+		{1 * time.Second, 0, 0, 0, false, true, false},
+		// Dormancy isn't entered while disabled.
+		{time.Minute, 0, 0, 0, false, false, false},
+	}
+
+	for i, step := range steps {
+
+		now = now.Add(step.elapsed)
+
+		entered, exited := dormancy.update(
+			now, step.idlePeriod, step.sent, step.received)
+
+		if entered != step.entered ||
+			exited != step.exited ||
+			dormancy.isDormant != step.isDormant {
+
+			t.Fatalf("unexpected result for step %d: %v %v %v",
+				i, entered, exited, dormancy.isDormant)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/juju/ratelimit"
+)
+
+// establishBudget caps the aggregate rate of tunnel connection traffic
+// across all concurrent establishment workers. Unlike
+// ConnectionWorkerPoolSize and LimitIntensiveConnectionWorkers, which limit
+// the number of concurrent connection attempts, the budget limits the
+// number of bytes sent and received, which better matches the traffic
+// pattern that triggers ISP rate limiting during reconnect storms.
+//
+// The budget applies to bytes read from and written to the tunnel dial
+// conn up to the completion of the SSH handshake. For meek and QUIC
+// protocols, this is the payload carried by the transport, and transport
+// overhead is not counted. A connected tunnel is released from the budget
+// and its subsequent traffic is not limited.
+type establishBudget struct {
+	bucket *ratelimit.Bucket
+}
+
+// newEstablishBudget creates an establishBudget with the specified rate and
+// a burst size of one second of traffic. Returns nil when bytesPerSecond is
+// 0, indicating no budget.
+func newEstablishBudget(bytesPerSecond int) *establishBudget {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &establishBudget{
+		bucket: ratelimit.NewBucketWithRate(
+			float64(bytesPerSecond), int64(bytesPerSecond)),
+	}
+}
+
+// budgetedConn is a net.Conn that consumes its establishBudget for all bytes
+// read and written until released.
+type budgetedConn struct {
+	net.Conn
+	budget       *establishBudget
+	isReleased   int32
+	closeOnce    sync.Once
+	closedSignal chan struct{}
+}
+
+// wrapConn returns a budgetedConn wrapping the specified conn. When budget
+// is nil, the conn is wrapped but never limited.
+func (budget *establishBudget) wrapConn(conn net.Conn) *budgetedConn {
+	budgetedConn := &budgetedConn{
+		Conn:         conn,
+		budget:       budget,
+		closedSignal: make(chan struct{}),
+	}
+	if budget == nil {
+		budgetedConn.isReleased = 1
+	}
+	return budgetedConn
+}
+
+// release stops consuming the budget. release may be called on a nil
+// budgetedConn, which is a no-op.
+func (conn *budgetedConn) release() {
+	if conn == nil {
+		return
+	}
+	atomic.StoreInt32(&conn.isReleased, 1)
+}
+
+func (conn *budgetedConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		// As with ratelimit.Reader, the budget is consumed after the read,
+		// delaying the next read.
+		waitErr := conn.wait(n)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (conn *budgetedConn) Write(buffer []byte) (int, error) {
+	err := conn.wait(len(buffer))
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	return conn.Conn.Write(buffer)
+}
+
+func (conn *budgetedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closedSignal)
+	})
+	return conn.Conn.Close()
+}
+
+func (conn *budgetedConn) IsClosed() bool {
+	closer, ok := conn.Conn.(common.Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
+
+// wait blocks until count bytes are available in the budget. The wait is
+// interrupted when the conn is closed, so that a budget wait doesn't delay
+// the cancellation of a connection attempt.
+func (conn *budgetedConn) wait(count int) error {
+	if atomic.LoadInt32(&conn.isReleased) == 1 {
+		return nil
+	}
+	waitDuration := conn.budget.bucket.Take(int64(count))
+	if waitDuration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(waitDuration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-conn.closedSignal:
+		return common.ContextError(errors.New("conn closed"))
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+type discardConn struct {
+	net.Conn
+	isClosed int32
+}
+
+func (conn *discardConn) Write(buffer []byte) (int, error) {
+	return len(buffer), nil
+}
+
+func (conn *discardConn) Close() error {
+	atomic.StoreInt32(&conn.isClosed, 1)
+	return nil
+}
+
+func (conn *discardConn) IsClosed() bool {
+	return atomic.LoadInt32(&conn.isClosed) == 1
+}
+
+func TestEstablishBudget(t *testing.T) {
+
+	bytesPerSecond := 1000000
+
+	budget := newEstablishBudget(bytesPerSecond)
+
+	// The budget is shared by all conns. With a full bucket of one second of
+	// traffic, writing three seconds of traffic takes at least two seconds.
+
+	conns := []*budgetedConn{
+		budget.wrapConn(&discardConn{}),
+		budget.wrapConn(&discardConn{}),
+		budget.wrapConn(&discardConn{}),
+	}
+
+	startTime := time.Now()
+
+	var waitGroup sync.WaitGroup
+	for _, conn := range conns {
+		waitGroup.Add(1)
+		go func(conn *budgetedConn) {
+			defer waitGroup.Done()
+			buffer := make([]byte, bytesPerSecond/10)
+			for i := 0; i < 10; i++ {
+				_, err := conn.Write(buffer)
+				if err != nil {
+					t.Errorf("Write failed: %s", err)
+					return
+				}
+			}
+		}(conn)
+	}
+	waitGroup.Wait()
+
+	elapsed := time.Since(startTime)
+	if elapsed < 1900*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("unexpected budgeted elapsed time: %s", elapsed)
+	}
+
+	// Released conns are not limited.
+
+	for _, conn := range conns {
+		conn.release()
+	}
+
+	startTime = time.Now()
+
+	_, err := conns[0].Write(make([]byte, 10*bytesPerSecond))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	elapsed = time.Since(startTime)
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("unexpected released elapsed time: %s", elapsed)
+	}
+
+	// Closing a conn interrupts a budget wait.
+
+	conn := budget.wrapConn(&discardConn{})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	startTime = time.Now()
+
+	_, err = conn.Write(make([]byte, 10*bytesPerSecond))
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+
+	elapsed = time.Since(startTime)
+	if elapsed > 1*time.Second {
+		t.Fatalf("unexpected interrupted elapsed time: %s", elapsed)
+	}
+
+	// IsClosed is delegated to the underlying conn, so that closed conns are
+	// detected through the activity monitor layered on top.
+
+	monitoredConn, err := common.NewActivityMonitoredConn(
+		budget.wrapConn(&discardConn{}), 0, false, nil, nil)
+	if err != nil {
+		t.Fatalf("NewActivityMonitoredConn failed: %s", err)
+	}
+	if monitoredConn.IsClosed() {
+		t.Fatalf("unexpected IsClosed")
+	}
+	monitoredConn.Close()
+	if !monitoredConn.IsClosed() {
+		t.Fatalf("unexpected !IsClosed")
+	}
+
+	// A nil budget doesn't limit.
+
+	var nilBudget *establishBudget
+	conn = nilBudget.wrapConn(&discardConn{})
+
+	_, err = conn.Write(make([]byte, 10*bytesPerSecond))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestEstablishPauseBackoff(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-establish-pause-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// With no server entries, each establishment round ends immediately and
+	// the only controller timer is the pause between rounds.
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableLocalHTTPProxy" : true,
+        "DisableTactics" : true,
+        "EstablishTunnelTimeoutSeconds" : 0
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clock := common.NewSimulatedClock()
+
+	clientConfig.DataStoreDirectory = testDataDirName
+	clientConfig.Clock = clock
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	pausePeriod := 5 * time.Second
+	pausePeriodMax := 2 * time.Hour
+
+	err = clientConfig.SetClientParameters("", false, map[string]interface{}{
+		parameters.EstablishTunnelPausePeriod:           pausePeriod,
+		parameters.EstablishTunnelPausePeriodJitter:     0.0,
+		parameters.EstablishTunnelPausePeriodMultiplier: 2.0,
+		parameters.EstablishTunnelPausePeriodMax:        pausePeriodMax,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	controllerWaitGroup := new(sync.WaitGroup)
+	controllerWaitGroup.Add(1)
+	go func() {
+		defer controllerWaitGroup.Done()
+		controller.Run(ctx)
+	}()
+	defer func() {
+		cancelFunc()
+		controllerWaitGroup.Wait()
+	}()
+
+	// Run through many hours of simulated backoff: the pause doubles each
+	// round until it reaches the maximum.
+
+	var elapsed time.Duration
+	expectedPause := pausePeriod
+
+	for round := 0; round < 16; round++ {
+
+		if !clock.WaitForPendingTimers(1, 10*time.Second) {
+			t.Fatalf("round %d: missing pause timer", round)
+		}
+
+		pause := clock.AdvanceToNextTimer()
+		if pause != expectedPause {
+			t.Fatalf("round %d: unexpected pause: %s", round, pause)
+		}
+		elapsed += pause
+
+		expectedPause *= 2
+		if expectedPause > pausePeriodMax {
+			expectedPause = pausePeriodMax
+		}
+	}
+
+	if elapsed < 10*time.Hour {
+		t.Fatalf("unexpected simulated elapsed time: %s", elapsed)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// EstablishmentStrategy is an interface that enables advanced deployments to
+// customize the order in which candidate servers are tried and the tunnel
+// protocol selected for each candidate, for example to prefer low latency
+// servers or, for measurement, to prefer protocols that have not yet been
+// tried. See Config.EstablishmentStrategy.
+//
+// The default establishment logic still applies the egress region, tunnel
+// protocol limits, server entry policy, worker pool and pacing parameters;
+// a strategy only orders and filters the candidates that remain.
+//
+// SelectProtocol and ReportResult are called concurrently from establishment
+// workers and must be safe for concurrent use.
+type EstablishmentStrategy interface {
+
+	// OrderCandidates is called at the start of each establishment round,
+	// with round starting at 0, and with the round's candidate server
+	// entries in the default order: pinned and affinity server entries
+	// first, followed by the remaining server entries in random order.
+	// OrderCandidates returns the server entries to try in the round, in the
+	// order in which to try them. Candidates may be omitted, but the
+	// returned server entries should be taken from the input.
+	//
+	// When server affinity applies, the first candidate returned in the
+	// first round receives the server affinity grace period.
+	OrderCandidates(round int, serverEntries []*protocol.ServerEntry) []*protocol.ServerEntry
+
+	// SelectProtocol selects the tunnel protocol to use for the candidate
+	// from candidateProtocols, the protocols that are supported by the
+	// server entry and permitted by the tunnel protocol limits. When the
+	// return value is "" or is not in candidateProtocols, a protocol is
+	// selected at random, as it is when no strategy is configured.
+	SelectProtocol(serverEntry *protocol.ServerEntry, candidateProtocols []string) string
+
+	// ReportResult reports the outcome of each tunnel connection attempt,
+	// including the elapsed time. err is nil when the tunnel was
+	// established. Attempts interrupted by the end of establishment are not
+	// reported.
+	ReportResult(serverEntry *protocol.ServerEntry, tunnelProtocol string, duration time.Duration, err error)
+}
+
+// strategyCandidates holds the server entries for one establishment round,
+// as ordered by an EstablishmentStrategy. Unlike ServerEntryIterator, which
+// loads one server entry at a time, all of the round's server entries are
+// loaded into memory so that the strategy may order them.
+type strategyCandidates struct {
+	serverEntries []*protocol.ServerEntry
+	index         int
+}
+
+func newStrategyCandidates(
+	strategy EstablishmentStrategy,
+	round int,
+	iterator *ServerEntryIterator) (*strategyCandidates, error) {
+
+	var serverEntries []*protocol.ServerEntry
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+
+	return &strategyCandidates{
+		serverEntries: strategy.OrderCandidates(round, serverEntries),
+	}, nil
+}
+
+// Next returns the next server entry in strategy order, or nil when the
+// round's candidates are exhausted.
+func (candidates *strategyCandidates) Next() (*protocol.ServerEntry, error) {
+	for candidates.index < len(candidates.serverEntries) {
+		serverEntry := candidates.serverEntries[candidates.index]
+		candidates.index += 1
+		if serverEntry != nil {
+			return serverEntry, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+type testEstablishmentStrategy struct {
+	rounds []int
+}
+
+// OrderCandidates returns the server entries in descending IP address
+// order, omitting every other server entry.
+func (strategy *testEstablishmentStrategy) OrderCandidates(
+	round int, serverEntries []*protocol.ServerEntry) []*protocol.ServerEntry {
+
+	strategy.rounds = append(strategy.rounds, round)
+
+	sort.Slice(serverEntries, func(i, j int) bool {
+		return serverEntries[i].IpAddress > serverEntries[j].IpAddress
+	})
+	var ordered []*protocol.ServerEntry
+	for i := 0; i < len(serverEntries); i += 2 {
+		ordered = append(ordered, serverEntries[i])
+	}
+	return ordered
+}
+
+// SelectProtocol selects the last candidate protocol for IP addresses ending
+// in "1", and an unsupported protocol otherwise.
+func (strategy *testEstablishmentStrategy) SelectProtocol(
+	serverEntry *protocol.ServerEntry, candidateProtocols []string) string {
+
+	if serverEntry.IpAddress[len(serverEntry.IpAddress)-1] == '1' {
+		return candidateProtocols[len(candidateProtocols)-1]
+	}
+	return "UNSUPPORTED"
+}
+
+func (strategy *testEstablishmentStrategy) ReportResult(
+	_ *protocol.ServerEntry, _ string, _ time.Duration, _ error) {
+}
+
+func TestEstablishmentStrategy(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-establishment-strategy-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	for i := 0; i < 10; i++ {
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            fmt.Sprintf("192.0.2.%d", i),
+				"configurationVersion": 1,
+				"capabilities":         []string{"SSH", "OSSH", "UNFRONTED-MEEK"},
+			},
+			false)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	strategy := &testEstablishmentStrategy{}
+
+	_, iterator, err := NewServerEntryIterator(clientConfig)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	candidates, err := newStrategyCandidates(strategy, 3, iterator)
+	if err != nil {
+		t.Fatalf("newStrategyCandidates failed: %s", err)
+	}
+
+	if len(strategy.rounds) != 1 || strategy.rounds[0] != 3 {
+		t.Fatalf("unexpected rounds: %+v", strategy.rounds)
+	}
+
+	var ipAddresses []string
+	for {
+		serverEntry, err := candidates.Next()
+		if err != nil {
+			t.Fatalf("strategyCandidates.Next failed: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+
+	expectedIPAddresses := []string{
+		"192.0.2.9", "192.0.2.7", "192.0.2.5", "192.0.2.3", "192.0.2.1"}
+
+	if fmt.Sprintf("%v", ipAddresses) != fmt.Sprintf("%v", expectedIPAddresses) {
+		t.Fatalf("unexpected candidates: %+v", ipAddresses)
+	}
+
+	limitState := &limitTunnelProtocolsState{
+		protocols: protocol.TunnelProtocols{"SSH", "OSSH"},
+		strategy:  strategy,
+	}
+
+	// The strategy selects the last candidate protocol.
+
+	selectedProtocol, err := limitState.selectProtocol(
+		0, false, &protocol.ServerEntry{IpAddress: "192.0.2.1", Capabilities: []string{"SSH", "OSSH"}})
+	if err != nil {
+		t.Fatalf("selectProtocol failed: %s", err)
+	}
+	if selectedProtocol != "OSSH" {
+		t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+	}
+
+	// An unsupported strategy selection falls back to random selection.
+
+	for i := 0; i < 10; i++ {
+		selectedProtocol, err = limitState.selectProtocol(
+			0, false, &protocol.ServerEntry{IpAddress: "192.0.2.2", Capabilities: []string{"SSH", "OSSH"}})
+		if err != nil {
+			t.Fatalf("selectProtocol failed: %s", err)
+		}
+		if selectedProtocol != "SSH" && selectedProtocol != "OSSH" {
+			t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+		}
+	}
+}
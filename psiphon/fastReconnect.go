@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// DEFAULT_NETWORK_ID_KEY is the network ID under which per-network records,
+// such as fast reconnect records, are stored when no network ID is
+// configured.
+const DEFAULT_NETWORK_ID_KEY = "DEFAULT"
+
+// fastReconnectRecord is the last-known-good server, tunnel protocol, and
+// dial parameters for a network.
+type fastReconnectRecord struct {
+	ServerEntryIPAddress string
+	TunnelProtocol       string
+	DialParameters       *replayDialParameters
+	ConnectedTime        time.Time
+}
+
+// replayDialParameters are the randomly selected dial parameters of a
+// successful tunnel. The fast reconnect candidate replays these parameters
+// instead of selecting new values.
+type replayDialParameters struct {
+	SelectedSSHClientVersion bool
+	SSHClientVersion         string
+	MeekDialAddress          string
+	MeekSNIServerName        string
+	MeekHostHeader           string
+	MeekTransformedHostName  bool
+	SelectedUserAgent        bool
+	UserAgent                string
+	TLSProfile               string
+}
+
+func makeReplayDialParameters(dialStats *DialStats) *replayDialParameters {
+	if dialStats == nil {
+		return nil
+	}
+	return &replayDialParameters{
+		SelectedSSHClientVersion: dialStats.SelectedSSHClientVersion,
+		SSHClientVersion:         dialStats.SSHClientVersion,
+		MeekDialAddress:          dialStats.MeekDialAddress,
+		MeekSNIServerName:        dialStats.MeekSNIServerName,
+		MeekHostHeader:           dialStats.MeekHostHeader,
+		MeekTransformedHostName:  dialStats.MeekTransformedHostName,
+		SelectedUserAgent:        dialStats.SelectedUserAgent,
+		UserAgent:                dialStats.UserAgent,
+		TLSProfile:               dialStats.TLSProfile,
+	}
+}
+
+// getNetworkIDKey returns the current network ID, for use as a datastore
+// key.
+func getNetworkIDKey(config *Config) string {
+	if config.networkIDGetter == nil {
+		return DEFAULT_NETWORK_ID_KEY
+	}
+	networkID := config.networkIDGetter.GetNetworkID()
+	if networkID == "" {
+		return DEFAULT_NETWORK_ID_KEY
+	}
+	return networkID
+}
+
+// getFastReconnectMaxAge returns the maximum age of fast reconnect records
+// for the specified tunnel protocol. The DialReplayProtocolTTLSeconds config
+// overrides FastReconnectMaxAge. A return value of 0 indicates that fast
+// reconnect is disabled for the protocol.
+func (controller *Controller) getFastReconnectMaxAge(tunnelProtocol string) time.Duration {
+	TTLSeconds, ok := controller.config.DialReplayProtocolTTLSeconds[tunnelProtocol]
+	if ok {
+		return time.Duration(TTLSeconds) * time.Second
+	}
+	return controller.config.clientParameters.Get().Duration(
+		parameters.FastReconnectMaxAge)
+}
+
+// isFastReconnectEnabled indicates whether fast reconnect is enabled for
+// any tunnel protocol.
+func (controller *Controller) isFastReconnectEnabled() bool {
+	for _, TTLSeconds := range controller.config.DialReplayProtocolTTLSeconds {
+		if TTLSeconds > 0 {
+			return true
+		}
+	}
+	return controller.config.clientParameters.Get().Duration(
+		parameters.FastReconnectMaxAge) > 0
+}
+
+// recordFastReconnect stores the server, tunnel protocol, and dial
+// parameters of a successful tunnel as the fast reconnect record for the
+// current network.
+func (controller *Controller) recordFastReconnect(tunnel *Tunnel) {
+
+	if controller.getFastReconnectMaxAge(tunnel.protocol) == 0 {
+		return
+	}
+
+	record, err := json.Marshal(&fastReconnectRecord{
+		ServerEntryIPAddress: tunnel.serverEntry.IpAddress,
+		TunnelProtocol:       tunnel.protocol,
+		DialParameters:       makeReplayDialParameters(tunnel.dialStats),
+		ConnectedTime:        time.Now(),
+	})
+	if err == nil {
+		err = SetFastReconnectRecord(getNetworkIDKey(controller.config), record)
+	}
+	if err != nil {
+		NoticeAlert("failed to store fast reconnect record: %s", common.ContextError(err))
+	}
+}
+
+// getFastReconnectCandidate returns a candidate for the last-known-good
+// server and tunnel protocol on the current network, or nil when fast
+// reconnect is disabled or there is no usable record.
+//
+// A record is not used when it's older than the maximum age for its tunnel
+// protocol; when the
+// server entry is no longer stored, is excluded by the server entry
+// policy, or is not in the egress region; or when the tunnel protocol is no
+// longer supported by the server entry or permitted by
+// LimitTunnelProtocols.
+func (controller *Controller) getFastReconnectCandidate(
+	adjustedEstablishStartTime monotime.Time) *candidateServerEntry {
+
+	if controller.config.TargetServerEntry != "" {
+		return nil
+	}
+
+	if !controller.isFastReconnectEnabled() {
+		return nil
+	}
+
+	networkID := getNetworkIDKey(controller.config)
+
+	data, err := GetFastReconnectRecord(networkID)
+	if err != nil {
+		NoticeAlert("failed to get fast reconnect record: %s", err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+
+	var record fastReconnectRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		NoticeAlert("invalid fast reconnect record: %s", common.ContextError(err))
+		return nil
+	}
+
+	maxAge := controller.getFastReconnectMaxAge(record.TunnelProtocol)
+	if maxAge == 0 || time.Since(record.ConnectedTime) > maxAge {
+		NoticeInfo("stale fast reconnect record: %s", record.ServerEntryIPAddress)
+		return nil
+	}
+
+	serverEntry, err := getServerEntry(record.ServerEntryIPAddress)
+	if err != nil {
+		NoticeAlert("failed to get fast reconnect server entry: %s", err)
+		return nil
+	}
+	if serverEntry == nil {
+		return nil
+	}
+
+	policy, err := GetServerEntryPolicy()
+	if err != nil || policy.isExcluded(serverEntry.IpAddress) {
+		return nil
+	}
+
+	egressRegion := controller.config.GetEgressRegion()
+	if egressRegion != "" && serverEntry.Region != egressRegion {
+		return nil
+	}
+
+	limitState := controller.establishLimitTunnelProtocolsState
+	supportedProtocols := serverEntry.GetSupportedProtocols(
+		limitState.useUpstreamProxy, limitState.protocols, false)
+	if !common.Contains(supportedProtocols, record.TunnelProtocol) {
+		return nil
+	}
+
+	return &candidateServerEntry{
+		serverEntry:                serverEntry,
+		isServerAffinityCandidate:  true,
+		adjustedEstablishStartTime: adjustedEstablishStartTime,
+		fastReconnectProtocol:      record.TunnelProtocol,
+		fastReconnectNetworkID:     networkID,
+		replayDialParameters:       record.DialParameters,
+	}
+}
+
+// ClearReplayParameters deletes the fast reconnect records, including the
+// replayed dial parameters, for all networks. Subsequent establishments
+// select fresh dial parameters until a new tunnel is established. This may
+// be used to recover when a client is stuck replaying parameters that no
+// longer work.
+func (controller *Controller) ClearReplayParameters() error {
+	err := DeleteFastReconnectRecords()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	NoticeInfo("cleared replay parameters")
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestFastReconnect(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-fast-reconnect-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "NetworkID" : "WIFI-TEST",
+        "FastReconnectMaxAgeSeconds" : 3600
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverIPAddress := "192.0.2.1"
+
+	err = StoreServerEntry(
+		protocol.ServerEntryFields{
+			"ipAddress":            serverIPAddress,
+			"configurationVersion": 1,
+			"capabilities":         []string{"SSH", "OSSH"},
+		},
+		false)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	controller.establishLimitTunnelProtocolsState = &limitTunnelProtocolsState{}
+
+	// No record.
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	serverEntry, err := getServerEntry(serverIPAddress)
+	if err != nil || serverEntry == nil {
+		t.Fatalf("getServerEntry failed: %v", err)
+	}
+
+	controller.recordFastReconnect(
+		&Tunnel{
+			serverEntry: serverEntry,
+			protocol:    protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			dialStats: &DialStats{
+				SelectedUserAgent: true,
+				UserAgent:         "User-Agent",
+			},
+		})
+
+	candidate := controller.getFastReconnectCandidate(monotime.Now())
+	if candidate == nil {
+		t.Fatalf("missing fast reconnect candidate")
+	}
+	if candidate.serverEntry.IpAddress != serverIPAddress ||
+		candidate.fastReconnectProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+		candidate.fastReconnectNetworkID != "WIFI-TEST" ||
+		!candidate.isServerAffinityCandidate {
+		t.Fatalf("unexpected fast reconnect candidate: %+v", candidate)
+	}
+	if candidate.replayDialParameters == nil ||
+		!candidate.replayDialParameters.SelectedUserAgent ||
+		candidate.replayDialParameters.UserAgent != "User-Agent" {
+		t.Fatalf("unexpected replay dial parameters: %+v", candidate.replayDialParameters)
+	}
+
+	// A per-protocol TTL overrides FastReconnectMaxAge.
+
+	clientConfig.DialReplayProtocolTTLSeconds = map[string]int{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 0,
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	clientConfig.DialReplayProtocolTTLSeconds = nil
+
+	// The recorded protocol is not permitted by LimitTunnelProtocols.
+
+	controller.establishLimitTunnelProtocolsState = &limitTunnelProtocolsState{
+		protocols: protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH},
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	controller.establishLimitTunnelProtocolsState = &limitTunnelProtocolsState{}
+
+	// The server is excluded.
+
+	err = StoreServerEntryPolicy(
+		&ServerEntryPolicy{ExcludedServerEntries: []string{serverIPAddress}})
+	if err != nil {
+		t.Fatalf("StoreServerEntryPolicy failed: %s", err)
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	err = StoreServerEntryPolicy(nil)
+	if err != nil {
+		t.Fatalf("StoreServerEntryPolicy failed: %s", err)
+	}
+
+	// The record is stale.
+
+	record, _ := json.Marshal(&fastReconnectRecord{
+		ServerEntryIPAddress: serverIPAddress,
+		TunnelProtocol:       protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		ConnectedTime:        time.Now().Add(-2 * time.Hour),
+	})
+	err = SetFastReconnectRecord("WIFI-TEST", record)
+	if err != nil {
+		t.Fatalf("SetFastReconnectRecord failed: %s", err)
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	// The record is deleted.
+
+	controller.recordFastReconnect(
+		&Tunnel{serverEntry: serverEntry, protocol: protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+
+	err = DeleteFastReconnectRecord("WIFI-TEST")
+	if err != nil {
+		t.Fatalf("DeleteFastReconnectRecord failed: %s", err)
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+
+	// Replay parameters are cleared.
+
+	controller.recordFastReconnect(
+		&Tunnel{serverEntry: serverEntry, protocol: protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+
+	if controller.getFastReconnectCandidate(monotime.Now()) == nil {
+		t.Fatalf("missing fast reconnect candidate")
+	}
+
+	err = controller.ClearReplayParameters()
+	if err != nil {
+		t.Fatalf("ClearReplayParameters failed: %s", err)
+	}
+
+	if controller.getFastReconnectCandidate(monotime.Now()) != nil {
+		t.Fatalf("unexpected fast reconnect candidate")
+	}
+}
@@ -115,11 +115,14 @@ func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer
 
 	untunneledDialConfig := &DialConfig{
 		UpstreamProxyURL:              config.UpstreamProxyURL,
+		UpstreamProxyChainURLs:        config.UpstreamProxyChainURLs,
 		CustomHeaders:                 config.CustomHeaders,
 		DeviceBinder:                  nil,
 		IPv6Synthesizer:               nil,
 		DnsServerGetter:               nil,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		ClientParameters:              config.clientParameters,
+		NetworkEmulator:               config.NetworkEmulator,
 	}
 
 	secureFeedback, err := encryptFeedback(diagnosticsJson, b64EncodedPublicKey)
@@ -177,14 +180,30 @@ func uploadFeedback(
 		return err
 	}
 
+	return putFeedback(ctx, client, feedbackData, url, userAgent, headerPieces)
+}
+
+// putFeedback uploads feedback data using the specified HTTP client. When
+// headerPieces is not nil, it specifies a single additional request header.
+func putFeedback(
+	ctx context.Context,
+	client *http.Client,
+	feedbackData []byte,
+	url, userAgent string,
+	headerPieces []string) error {
+
 	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(feedbackData))
 	if err != nil {
 		return common.ContextError(err)
 	}
 
+	req = req.WithContext(ctx)
+
 	req.Header.Set("User-Agent", userAgent)
 
-	req.Header.Set(headerPieces[0], headerPieces[1])
+	if headerPieces != nil {
+		req.Header.Set(headerPieces[0], headerPieces[1])
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
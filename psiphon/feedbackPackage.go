@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"runtime"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	FEEDBACK_PACKAGE_VERSION               = 4
+	FEEDBACK_NOTICES_MAX_AGE               = 1 * time.Hour
+	FEEDBACK_ESTABLISHMENT_REPORTS_MAX_AGE = 24 * time.Hour
+	FEEDBACK_REDACTED_VALUE                = "[REDACTED]"
+)
+
+// feedbackEstablishmentNoticeTypes are the notice types which report on
+// tunnel establishment. These are included in feedback packages over a
+// longer period than other notices.
+var feedbackEstablishmentNoticeTypes = []string{
+	"CandidateServers",
+	"ConnectingServer",
+	"ConnectedServer",
+	"RequestingTactics",
+	"RequestedTactics",
+	"ActiveTunnel",
+	"Tunnels",
+}
+
+// feedbackRedactedConfigFields are Config fields which may contain secrets,
+// such as credentials or server entries. The values of these fields are
+// replaced with FEEDBACK_REDACTED_VALUE in feedback packages.
+var feedbackRedactedConfigFields = []string{
+	"TargetServerEntry",
+	"Authorizations",
+	"CustomHeaders",
+	"UpstreamProxyCustomHeaders",
+}
+
+// feedbackPackage is the plaintext content of a feedback upload. The
+// Metadata and Feedback fields conform to the diagnostics format expected
+// by the feedback decryptor.
+type feedbackPackage struct {
+	Metadata struct {
+		ID       string `json:"id"`
+		Platform string `json:"platform"`
+		Version  int    `json:"version"`
+	}
+	DiagnosticInfo struct {
+		BuildInfo            *common.BuildInfo
+		Config               map[string]interface{}
+		MemStats             *feedbackMemStats
+		EstablishmentReports []feedbackNotice
+		DiagnosticHistory    []feedbackNotice
+	}
+	Feedback struct {
+		Message struct {
+			Text string `json:"text"`
+		}
+	}
+}
+
+type feedbackMemStats struct {
+	Timestamp    string
+	Goroutines   int
+	TotalAlloc   uint64
+	Sys          uint64
+	HeapAlloc    uint64
+	HeapSys      uint64
+	HeapIdle     uint64
+	HeapInuse    uint64
+	HeapReleased uint64
+	HeapObjects  uint64
+	StackInuse   uint64
+	StackSys     uint64
+	NextGC       uint64
+	NumGC        uint32
+}
+
+type feedbackNotice struct {
+	NoticeType string                 `json:"noticeType"`
+	Data       map[string]interface{} `json:"data"`
+	Timestamp  string                 `json:"timestamp"`
+}
+
+// SendFeedback packages recent notices, the client config with secrets
+// redacted, a memory stats snapshot, and tunnel establishment reports
+// along with the user's comment; encrypts the package with
+// FeedbackEncryptionPublicKey; and uploads the package to one of
+// FeedbackUploadURLs.
+//
+// The upload is made through an active tunnel, when one is available, and
+// otherwise untunneled. Failed uploads are retried, and URLs with
+// OnlyAfterAttempts > 0, such as fronted endpoints, become candidates in
+// later attempts. SendFeedback blocks until the upload succeeds, all
+// attempts fail, or ctx is done.
+//
+// Notices are included only when the notice history is enabled with
+// Config.NoticeHistoryMaxSize.
+func (controller *Controller) SendFeedback(ctx context.Context, comment string) error {
+
+	p := controller.config.clientParameters.Get()
+	uploadURLs := p.DownloadURLs(parameters.FeedbackUploadURLs)
+	publicKey := p.String(parameters.FeedbackEncryptionPublicKey)
+	uploadTimeout := p.Duration(parameters.FeedbackUploadTimeout)
+	retryPeriod := p.Duration(parameters.FeedbackUploadRetryPeriod)
+	p = nil
+
+	if len(uploadURLs) == 0 || publicKey == "" {
+		return common.ContextError(errors.New("feedback upload not configured"))
+	}
+
+	randBytes, err := common.MakeSecureRandomBytes(8)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	uploadID := hex.EncodeToString(randBytes)
+
+	feedbackJSON, err := makeFeedbackPackage(controller.config, uploadID, comment)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	secureFeedback, err := encryptFeedback(string(feedbackJSON), publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	for attempt := 0; attempt < FEEDBACK_UPLOAD_MAX_RETRIES; attempt++ {
+
+		if attempt > 0 {
+			timer := time.NewTimer(retryPeriod)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return common.ContextError(ctx.Err())
+			}
+		}
+
+		_, uploadURL, skipVerify := uploadURLs.Select(attempt)
+
+		err = controller.uploadFeedbackPackage(
+			ctx, uploadTimeout, secureFeedback, uploadURL+uploadID, skipVerify)
+		if err == nil {
+			NoticeInfo("feedback uploaded: %s", uploadID)
+			return nil
+		}
+
+		NoticeAlert("feedback upload attempt %d failed: %s", attempt, err)
+	}
+
+	return common.ContextError(err)
+}
+
+func (controller *Controller) uploadFeedbackPackage(
+	ctx context.Context,
+	uploadTimeout time.Duration,
+	feedbackData []byte,
+	uploadURL string,
+	skipVerify bool) error {
+
+	ctx, cancelFunc := context.WithTimeout(ctx, uploadTimeout)
+	defer cancelFunc()
+
+	// Pick any active tunnel. If there's no active tunnel, the
+	// untunneledDialConfig will be used.
+	tunnel := controller.getNextActiveTunnel()
+
+	client, err := MakeDownloadHTTPClient(
+		ctx,
+		controller.config,
+		tunnel,
+		controller.untunneledDialConfig,
+		skipVerify)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return putFeedback(
+		ctx,
+		client,
+		feedbackData,
+		uploadURL,
+		MakePsiphonUserAgent(controller.config),
+		nil)
+}
+
+// makeFeedbackPackage creates the plaintext, JSON-encoded feedback package.
+func makeFeedbackPackage(config *Config, uploadID, comment string) ([]byte, error) {
+
+	var feedback feedbackPackage
+
+	feedback.Metadata.ID = uploadID
+	feedback.Metadata.Platform = config.ClientPlatform
+	feedback.Metadata.Version = FEEDBACK_PACKAGE_VERSION
+
+	feedback.DiagnosticInfo.BuildInfo = common.GetBuildInfo()
+	feedback.DiagnosticInfo.Config = getRedactedConfig(config)
+	feedback.DiagnosticInfo.MemStats = getFeedbackMemStats()
+
+	now := time.Now()
+
+	establishmentReports, err := QueryNoticeHistory(
+		now.Add(-FEEDBACK_ESTABLISHMENT_REPORTS_MAX_AGE),
+		feedbackEstablishmentNoticeTypes...)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	for _, notice := range establishmentReports {
+		feedback.DiagnosticInfo.EstablishmentReports = append(
+			feedback.DiagnosticInfo.EstablishmentReports,
+			makeFeedbackNotice(notice))
+	}
+
+	notices, err := QueryNoticeHistory(now.Add(-FEEDBACK_NOTICES_MAX_AGE))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	for _, notice := range notices {
+		// Establishment notices are already included in EstablishmentReports.
+		if common.Contains(feedbackEstablishmentNoticeTypes, notice.NoticeType) {
+			continue
+		}
+		feedback.DiagnosticInfo.DiagnosticHistory = append(
+			feedback.DiagnosticInfo.DiagnosticHistory,
+			makeFeedbackNotice(notice))
+	}
+
+	feedback.Feedback.Message.Text = comment
+
+	feedbackJSON, err := json.Marshal(feedback)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return feedbackJSON, nil
+}
+
+func makeFeedbackNotice(notice HistoricalNotice) feedbackNotice {
+	return feedbackNotice{
+		NoticeType: notice.NoticeType,
+		Data:       notice.Data,
+		Timestamp:  notice.Timestamp.UTC().Format(common.RFC3339Milli),
+	}
+}
+
+func getFeedbackMemStats() *feedbackMemStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return &feedbackMemStats{
+		Timestamp:    time.Now().UTC().Format(common.RFC3339Milli),
+		Goroutines:   runtime.NumGoroutine(),
+		TotalAlloc:   memStats.TotalAlloc,
+		Sys:          memStats.Sys,
+		HeapAlloc:    memStats.HeapAlloc,
+		HeapSys:      memStats.HeapSys,
+		HeapIdle:     memStats.HeapIdle,
+		HeapInuse:    memStats.HeapInuse,
+		HeapReleased: memStats.HeapReleased,
+		HeapObjects:  memStats.HeapObjects,
+		StackInuse:   memStats.StackInuse,
+		StackSys:     memStats.StackSys,
+		NextGC:       memStats.NextGC,
+		NumGC:        memStats.NumGC,
+	}
+}
+
+// getRedactedConfig returns the exported Config fields, keyed by field name,
+// with secrets redacted. Fields listed in feedbackRedactedConfigFields are
+// replaced, when set, with FEEDBACK_REDACTED_VALUE; credentials are removed
+// from upstream proxy URLs; and host-supplied interface fields, such as
+// DeviceBinder, are reported only as present or absent.
+func getRedactedConfig(config *Config) map[string]interface{} {
+
+	redactedConfig := make(map[string]interface{})
+
+	value := reflect.ValueOf(config).Elem()
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+
+		field := valueType.Field(i)
+		if field.PkgPath != "" {
+			// Unexported field.
+			continue
+		}
+
+		fieldValue := value.Field(i)
+
+		if field.Type.Kind() == reflect.Interface {
+			redactedConfig[field.Name] = !fieldValue.IsNil()
+			continue
+		}
+
+		if common.Contains(feedbackRedactedConfigFields, field.Name) {
+			if !fieldValue.IsZero() {
+				redactedConfig[field.Name] = FEEDBACK_REDACTED_VALUE
+			}
+			continue
+		}
+
+		redactedConfig[field.Name] = fieldValue.Interface()
+	}
+
+	redactedConfig["UpstreamProxyURL"] = redactURLCredentials(config.UpstreamProxyURL)
+
+	chainURLs := make([]string, len(config.UpstreamProxyChainURLs))
+	for i, chainURL := range config.UpstreamProxyChainURLs {
+		chainURLs[i] = redactURLCredentials(chainURL)
+	}
+	redactedConfig["UpstreamProxyChainURLs"] = chainURLs
+
+	redactedConfig["V2RayOutboundProxyURL"] = redactURLCredentials(config.V2RayOutboundProxyURL)
+
+	return redactedConfig
+}
+
+// redactURLCredentials removes any user info, such as a proxy username and
+// password, from a URL. When the URL cannot be parsed, the entire value is
+// redacted.
+func redactURLCredentials(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return FEEDBACK_REDACTED_VALUE
+	}
+	parsedURL.User = nil
+	return parsedURL.String()
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	FIRST_FLIGHT_MAX_WRITES       = 32
+	FIRST_FLIGHT_MAX_SAMPLE_BYTES = 16384
+)
+
+// FirstFlightFingerprint describes the bytes on the wire sent by a client
+// connection before the first response from the peer: the length and
+// timing of each write, and the entropy of the bytes written. The
+// fingerprint is intended for verifying obfuscation properties, such as
+// the absence of fixed lengths or low entropy plaintext, and for detecting
+// regressions in those properties across releases.
+//
+// WriteOffsets and FirstReadOffset are relative to the time the connection
+// was established. FirstReadOffset is 0 when the connection was closed, or
+// the write limit reached, before any response was received. Entropy is the
+// Shannon entropy, in bits per byte, of up to the first
+// FIRST_FLIGHT_MAX_SAMPLE_BYTES bytes written.
+type FirstFlightFingerprint struct {
+	WriteLengths    []int
+	WriteOffsets    []time.Duration
+	FirstReadOffset time.Duration
+	TotalBytes      int
+	Entropy         float64
+}
+
+// firstFlightConn is a net.Conn that records the FirstFlightFingerprint of
+// the connection and reports it, once, to a callback. The first flight ends
+// with the first read of response bytes, after FIRST_FLIGHT_MAX_WRITES
+// writes, or when the conn is closed.
+type firstFlightConn struct {
+	net.Conn
+	callback    func(FirstFlightFingerprint)
+	startTime   monotime.Time
+	mutex       sync.Mutex
+	isReported  bool
+	fingerprint FirstFlightFingerprint
+	sample      []byte
+}
+
+func newFirstFlightConn(
+	conn net.Conn, callback func(FirstFlightFingerprint)) *firstFlightConn {
+
+	return &firstFlightConn{
+		Conn:      conn,
+		callback:  callback,
+		startTime: monotime.Now(),
+	}
+}
+
+func (conn *firstFlightConn) Write(buffer []byte) (int, error) {
+	conn.recordWrite(buffer)
+	return conn.Conn.Write(buffer)
+}
+
+func (conn *firstFlightConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		conn.report(true)
+	}
+	return n, err
+}
+
+func (conn *firstFlightConn) Close() error {
+	conn.report(false)
+	return conn.Conn.Close()
+}
+
+// IsClosed implements the Closer interface, when the underlying conn does.
+func (conn *firstFlightConn) IsClosed() bool {
+	closer, ok := conn.Conn.(common.Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
+
+func (conn *firstFlightConn) recordWrite(buffer []byte) {
+
+	conn.mutex.Lock()
+	if conn.isReported {
+		conn.mutex.Unlock()
+		return
+	}
+
+	fingerprint := &conn.fingerprint
+	fingerprint.WriteLengths = append(fingerprint.WriteLengths, len(buffer))
+	fingerprint.WriteOffsets = append(
+		fingerprint.WriteOffsets, monotime.Since(conn.startTime))
+	fingerprint.TotalBytes += len(buffer)
+
+	sampleSize := FIRST_FLIGHT_MAX_SAMPLE_BYTES - len(conn.sample)
+	if sampleSize > len(buffer) {
+		sampleSize = len(buffer)
+	}
+	conn.sample = append(conn.sample, buffer[:sampleSize]...)
+
+	writeLimit := len(fingerprint.WriteLengths) >= FIRST_FLIGHT_MAX_WRITES
+	conn.mutex.Unlock()
+
+	if writeLimit {
+		conn.report(false)
+	}
+}
+
+func (conn *firstFlightConn) report(isResponse bool) {
+
+	conn.mutex.Lock()
+	if conn.isReported {
+		conn.mutex.Unlock()
+		return
+	}
+	conn.isReported = true
+
+	fingerprint := conn.fingerprint
+	if isResponse {
+		fingerprint.FirstReadOffset = monotime.Since(conn.startTime)
+	}
+	fingerprint.Entropy = shannonEntropy(conn.sample)
+	conn.sample = nil
+	conn.mutex.Unlock()
+
+	// Connections which never sent any bytes have no fingerprint.
+	if fingerprint.TotalBytes == 0 {
+		return
+	}
+
+	conn.callback(fingerprint)
+}
+
+// shannonEntropy returns the Shannon entropy, in bits per byte, of the
+// specified bytes.
+func shannonEntropy(buffer []byte) float64 {
+	if len(buffer) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range buffer {
+		counts[b] += 1
+	}
+	entropy := 0.0
+	total := float64(len(buffer))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+func TestFirstFlightFingerprint(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+
+	fingerprints := make(chan FirstFlightFingerprint, 2)
+	conn := newFirstFlightConn(
+		clientConn,
+		func(fingerprint FirstFlightFingerprint) {
+			fingerprints <- fingerprint
+		})
+
+	randomBytes := make([]byte, 4096)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	go func() {
+		buffer := make([]byte, 8192)
+		received := 0
+		for received < 4096+100 {
+			n, err := serverConn.Read(buffer)
+			if err != nil {
+				return
+			}
+			received += n
+		}
+		serverConn.Write([]byte("response"))
+	}()
+
+	_, err = conn.Write(randomBytes)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	_, err = conn.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	_, err = conn.Read(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	// Writes after the first response are not part of the first flight.
+	go serverConn.Read(make([]byte, 100))
+	conn.Write([]byte("after"))
+	conn.Close()
+
+	fingerprint := <-fingerprints
+
+	if len(fingerprint.WriteLengths) != 2 ||
+		fingerprint.WriteLengths[0] != 4096 ||
+		fingerprint.WriteLengths[1] != 100 ||
+		len(fingerprint.WriteOffsets) != 2 {
+		t.Fatalf("unexpected write lengths: %+v", fingerprint.WriteLengths)
+	}
+
+	if fingerprint.TotalBytes != 4196 {
+		t.Fatalf("unexpected total bytes: %d", fingerprint.TotalBytes)
+	}
+
+	if fingerprint.FirstReadOffset == 0 {
+		t.Fatalf("unexpected first read offset")
+	}
+
+	// The sample is mostly random bytes with a run of zeros.
+	if fingerprint.Entropy < 7.0 || fingerprint.Entropy > 8.0 {
+		t.Fatalf("unexpected entropy: %f", fingerprint.Entropy)
+	}
+
+	select {
+	case <-fingerprints:
+		t.Fatalf("unexpected second fingerprint")
+	default:
+	}
+}
+
+func TestShannonEntropy(t *testing.T) {
+
+	if shannonEntropy(nil) != 0 {
+		t.Fatalf("unexpected entropy for empty buffer")
+	}
+
+	if shannonEntropy(make([]byte, 1024)) != 0 {
+		t.Fatalf("unexpected entropy for constant buffer")
+	}
+
+	buffer := make([]byte, 256)
+	for i := range buffer {
+		buffer[i] = byte(i)
+	}
+	if shannonEntropy(buffer) != 8.0 {
+		t.Fatalf("unexpected entropy for uniform buffer")
+	}
+}
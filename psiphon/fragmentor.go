@@ -50,8 +50,8 @@ func NewTCPFragmentorDialer(
 }
 
 // DialTCPFragmentor performs a DialTCP and wraps the dialed conn in a
-// fragmentor.Conn, subject to FragmentorProbability and
-// FragmentorLimitProtocols.
+// fragmentor.Conn, subject to FragmentorProbability,
+// FragmentorSplitTLSSNIProbability, and FragmentorLimitProtocols.
 func DialTCPFragmentor(
 	ctx context.Context,
 	addr string,
@@ -79,29 +79,64 @@ func DialTCPFragmentor(
 		coinFlip = p.WeightedCoinFlip(parameters.FragmentorProbability)
 	}
 
-	if coinFlip {
+	totalBytes := 0
+	if !coinFlip {
+		totalBytes, err = common.MakeSecureRandomRange(
+			p.Int(parameters.FragmentorMinTotalBytes),
+			p.Int(parameters.FragmentorMaxTotalBytes))
+		if err != nil {
+			totalBytes = 0
+			NoticeAlert("MakeSecureRandomRange failed: %s", common.ContextError(err))
+		}
+	}
+
+	splitTLSSNI := p.WeightedCoinFlip(parameters.FragmentorSplitTLSSNIProbability)
+
+	if totalBytes == 0 && !splitTLSSNI {
 		return conn, nil
 	}
 
-	totalBytes, err := common.MakeSecureRandomRange(
-		p.Int(parameters.FragmentorMinTotalBytes),
-		p.Int(parameters.FragmentorMaxTotalBytes))
-	if err != nil {
-		totalBytes = 0
-		NoticeAlert("MakeSecureRandomRange failed: %s", common.ContextError(err))
+	fragmentorConn := fragmentor.NewConn(
+		conn,
+		func(message string) { NoticeInfo(message) },
+		totalBytes,
+		p.Int(parameters.FragmentorMinWriteBytes),
+		p.Int(parameters.FragmentorMaxWriteBytes),
+		p.Duration(parameters.FragmentorMinDelay),
+		p.Duration(parameters.FragmentorMaxDelay))
+
+	if splitTLSSNI {
+		fragmentorConn.EnableSplitTLSSNI()
 	}
 
-	if totalBytes == 0 {
-		return conn, nil
+	return fragmentorConn, nil
+}
+
+// selectTCPMaxSegmentSize selects a TCP maximum segment size for the tunnel
+// protocol, subject to TCPMaxSegmentSizeProbability and
+// TCPMaxSegmentSizeLimitProtocols. Returns 0 when the system default MSS is
+// to be used.
+//
+// A small MSS causes the first application-level message, such as a TLS
+// ClientHello, to span multiple TCP packets, for DPI which only inspects the
+// first packet. Unlike fragmentation, the MSS applies for the lifetime of the
+// TCP conn, at some cost in throughput.
+//
+// Sending TCP segments out of order, another first packet evasion, is not
+// supported, as it requires raw sockets.
+func selectTCPMaxSegmentSize(
+	clientParameters *parameters.ClientParameters, tunnelProtocol string) int {
+
+	p := clientParameters.Get()
+
+	protocols := p.TunnelProtocols(parameters.TCPMaxSegmentSizeLimitProtocols)
+	if len(protocols) > 0 && !common.Contains(protocols, tunnelProtocol) {
+		return 0
+	}
+
+	if !p.WeightedCoinFlip(parameters.TCPMaxSegmentSizeProbability) {
+		return 0
 	}
 
-	return fragmentor.NewConn(
-			conn,
-			func(message string) { NoticeInfo(message) },
-			totalBytes,
-			p.Int(parameters.FragmentorMinWriteBytes),
-			p.Int(parameters.FragmentorMaxWriteBytes),
-			p.Duration(parameters.FragmentorMinDelay),
-			p.Duration(parameters.FragmentorMaxDelay)),
-		nil
+	return p.Int(parameters.TCPMaxSegmentSize)
 }
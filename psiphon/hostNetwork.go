@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// HostNetworkProvider defines the interface to the host network stack. It
+// consolidates the DeviceBinder, DnsServerGetter, and NetworkIDGetter
+// callbacks, which must all describe the same active network for
+// VPN-excluded sockets to behave correctly: a socket bound to one network
+// must resolve using that network's DNS servers.
+type HostNetworkProvider interface {
+
+	// GetActiveInterface returns a name for the host's current active
+	// physical network interface, for diagnostics, or "" when unknown.
+	GetActiveInterface() string
+
+	// BindsSockets indicates whether sockets must be bound, with
+	// BindToNetwork, to bypass VPN routing. When false, as on iOS where
+	// sockets created by a Network Extension are excluded from the VPN,
+	// BindToNetwork is not called and the platform resolver is used.
+	BindsSockets() bool
+
+	// BindToNetwork binds the socket to the active physical network, as in
+	// DeviceBinder. The string return value reports network information for
+	// diagnostics.
+	BindToNetwork(fileDescriptor int) (string, error)
+
+	// GetDNSServers returns the IP addresses of the DNS servers of the active
+	// physical network, in order of preference. Only the first two servers
+	// are used.
+	GetDNSServers() []string
+
+	// GetNetworkID returns an identifier for the active network. See:
+	// NetworkIDGetter doc.
+	GetNetworkID() string
+}
+
+// hostNetworkAdapter adapts a HostNetworkProvider to the DeviceBinder,
+// DnsServerGetter, and NetworkIDGetter interfaces used internally.
+type hostNetworkAdapter struct {
+	provider HostNetworkProvider
+}
+
+func newHostNetworkAdapter(provider HostNetworkProvider) *hostNetworkAdapter {
+	return &hostNetworkAdapter{provider: provider}
+}
+
+// BindToDevice implements the DeviceBinder interface. When the provider
+// reports no network information, the active interface name is reported.
+func (adapter *hostNetworkAdapter) BindToDevice(fileDescriptor int) (string, error) {
+	networkInfo, err := adapter.provider.BindToNetwork(fileDescriptor)
+	if err == nil && networkInfo == "" {
+		networkInfo = adapter.provider.GetActiveInterface()
+	}
+	return networkInfo, err
+}
+
+// GetPrimaryDnsServer implements the DnsServerGetter interface.
+func (adapter *hostNetworkAdapter) GetPrimaryDnsServer() string {
+	DNSServers := adapter.provider.GetDNSServers()
+	if len(DNSServers) < 1 {
+		return ""
+	}
+	return DNSServers[0]
+}
+
+// GetSecondaryDnsServer implements the DnsServerGetter interface.
+func (adapter *hostNetworkAdapter) GetSecondaryDnsServer() string {
+	DNSServers := adapter.provider.GetDNSServers()
+	if len(DNSServers) < 2 {
+		return ""
+	}
+	return DNSServers[1]
+}
+
+// GetNetworkID implements the NetworkIDGetter interface.
+func (adapter *hostNetworkAdapter) GetNetworkID() string {
+	return adapter.provider.GetNetworkID()
+}
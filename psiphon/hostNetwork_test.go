@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+type testHostNetworkProvider struct {
+	bindsSockets bool
+	DNSServers   []string
+}
+
+func (p *testHostNetworkProvider) GetActiveInterface() string {
+	return "test0"
+}
+
+func (p *testHostNetworkProvider) BindsSockets() bool {
+	return p.bindsSockets
+}
+
+func (p *testHostNetworkProvider) BindToNetwork(fileDescriptor int) (string, error) {
+	return "", nil
+}
+
+func (p *testHostNetworkProvider) GetDNSServers() []string {
+	return p.DNSServers
+}
+
+func (p *testHostNetworkProvider) GetNetworkID() string {
+	return "WIFI-test"
+}
+
+func TestHostNetworkProvider(t *testing.T) {
+
+	for _, bindsSockets := range []bool{false, true} {
+
+		config, err := LoadConfig([]byte(`{"PropagationChannelId" : "0", "SponsorId" : "0"}`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		config.HostNetworkProvider = &testHostNetworkProvider{
+			bindsSockets: bindsSockets,
+			DNSServers:   []string{"192.0.2.1"},
+		}
+
+		err = config.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+
+		if config.networkIDGetter == nil ||
+			config.networkIDGetter.GetNetworkID() != "WIFI-test" {
+			t.Fatalf("unexpected network ID getter")
+		}
+
+		if !bindsSockets {
+			if config.deviceBinder != nil || config.dnsServerGetter != nil {
+				t.Fatalf("unexpected device binder")
+			}
+			continue
+		}
+
+		deviceInfo, err := config.deviceBinder.BindToDevice(0)
+		if err != nil || deviceInfo != "test0" {
+			t.Fatalf("unexpected BindToDevice result: %s, %v", deviceInfo, err)
+		}
+
+		if config.dnsServerGetter.GetPrimaryDnsServer() != "192.0.2.1" ||
+			config.dnsServerGetter.GetSecondaryDnsServer() != "" {
+			t.Fatalf("unexpected DNS servers")
+		}
+	}
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId" : "0", "SponsorId" : "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.HostNetworkProvider = &testHostNetworkProvider{}
+	config.DeviceBinder = newHostNetworkAdapter(&testHostNetworkProvider{})
+	if config.Commit() == nil {
+		t.Fatalf("unexpected Commit success")
+	}
+}
@@ -39,6 +39,7 @@ import (
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 	"github.com/grafov/m3u8"
 )
 
@@ -75,10 +76,12 @@ import (
 // URL encoded.
 //
 type HttpProxy struct {
+	config                 *Config
 	tunneler               Tunneler
 	listener               net.Listener
 	serveWaitGroup         *sync.WaitGroup
 	httpProxyTunneledRelay *http.Transport
+	httpProxyCache         *httpProxyCache
 	urlProxyTunneledRelay  *http.Transport
 	urlProxyTunneledClient *http.Client
 	urlProxyDirectRelay    *http.Transport
@@ -98,16 +101,28 @@ func NewHttpProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *HttpProxy, err error) {
 
-	listener, err := net.Listen(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalHttpProxyPort))
-	if err != nil {
-		if IsAddressInUseError(err) {
-			NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+	var listener net.Listener
+	if config.LocalHttpProxyListener != nil {
+		listener, err = duplicateListener(config.LocalHttpProxyListener)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	} else {
+		listener, err = net.Listen(
+			"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalHttpProxyPort))
+		if err != nil {
+			if IsAddressInUseError(err) {
+				NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+			}
+			return nil, common.ContextError(err)
 		}
-		return nil, common.ContextError(err)
 	}
 
 	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
+		addr, err = checkPortForwardPolicy(config, _HTTP_PROXY_TYPE, addr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 		// downstreamConn is not set in this case, as there is not a fixed
 		// association between a downstream client connection and a particular
 		// tunnel.
@@ -123,11 +138,15 @@ func NewHttpProxy(
 	maxIdleConnsPerHost := config.clientParameters.Get().Int(
 		parameters.HTTPProxyMaxIdleConnectionsPerHost)
 
+	idleTimeout := config.clientParameters.Get().Duration(
+		parameters.HTTPProxyIdleTimeout)
+
 	// TODO: could HTTP proxy share a tunneled transport with URL proxy?
 	// For now, keeping them distinct just to be conservative.
 	httpProxyTunneledRelay := &http.Transport{
 		Dial:                  tunneledDialer,
 		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleTimeout,
 		ResponseHeaderTimeout: responseHeaderTimeout,
 	}
 
@@ -138,6 +157,7 @@ func NewHttpProxy(
 	urlProxyTunneledRelay := &http.Transport{
 		Dial:                  tunneledDialer,
 		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleTimeout,
 		ResponseHeaderTimeout: responseHeaderTimeout,
 	}
 	urlProxyTunneledClient := &http.Client{
@@ -152,6 +172,7 @@ func NewHttpProxy(
 	urlProxyDirectRelay := &http.Transport{
 		Dial:                  directDialer,
 		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleTimeout,
 		ResponseHeaderTimeout: responseHeaderTimeout,
 	}
 	urlProxyDirectClient := &http.Client{
@@ -159,14 +180,28 @@ func NewHttpProxy(
 		Jar:       nil,
 	}
 
+	var httpProxyCache *httpProxyCache
+	if config.LocalHttpProxyCacheMaxSize > 0 {
+		httpProxyCache, err = newHTTPProxyCache(
+			httpProxyTunneledRelay,
+			filepath.Join(config.DataStoreDirectory, HTTP_PROXY_CACHE_DIRECTORY_NAME),
+			config.LocalHttpProxyCacheMaxSize)
+		if err != nil {
+			listener.Close()
+			return nil, common.ContextError(err)
+		}
+	}
+
 	proxyIP, proxyPortString, _ := net.SplitHostPort(listener.Addr().String())
 	proxyPort, _ := strconv.Atoi(proxyPortString)
 
 	proxy = &HttpProxy{
+		config:                 config,
 		tunneler:               tunneler,
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
 		httpProxyTunneledRelay: httpProxyTunneledRelay,
+		httpProxyCache:         httpProxyCache,
 		urlProxyTunneledRelay:  urlProxyTunneledRelay,
 		urlProxyTunneledClient: urlProxyTunneledClient,
 		urlProxyDirectRelay:    urlProxyDirectRelay,
@@ -205,6 +240,12 @@ func (proxy *HttpProxy) Close() {
 	proxy.openConns.CloseAll()
 	// Close idle proxy->origin persistent connections
 	// TODO: also close active connections
+	proxy.CloseIdleConnections()
+}
+
+// CloseIdleConnections closes idle, pooled proxy->origin persistent
+// connections. Active connections are not affected.
+func (proxy *HttpProxy) CloseIdleConnections() {
 	proxy.httpProxyTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyDirectRelay.CloseIdleConnections()
@@ -251,24 +292,158 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	defer localConn.Close()
 	defer proxy.openConns.Remove(localConn)
 	proxy.openConns.Add(localConn)
-	// Setting downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
-	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
-	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(target, false, localConn)
+
+	// With LocalHttpProxySNIRules, the CONNECT request is accepted first so
+	// that the client sends its ClientHello, and rules are also applied to
+	// the SNI, when present. The port forward is always made to the CONNECT
+	// target; the SNI is only used for rule checks.
+	var clientHello []byte
+	var sni string
+	if proxy.config.LocalHttpProxySNIRules {
+		_, err = localConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		if err != nil {
+			return common.ContextError(err)
+		}
+		clientHello, sni, err = readClientHelloSNI(localConn)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	dialTarget, err := checkPortForwardPolicy(proxy.config, _HTTP_PROXY_TYPE, target)
+	if err != nil {
+		if !proxy.config.LocalHttpProxySNIRules {
+			_, _ = localConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		}
+		return common.ContextError(err)
+	}
+
+	alwaysTunnel := false
+	untunneled := false
+
+	if sni != "" {
+
+		_, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		// Only a policy denial of the SNI address applies; any redirect is
+		// ignored.
+		_, err = checkPortForwardPolicy(
+			proxy.config, _HTTP_PROXY_TYPE, net.JoinHostPort(sni, port))
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		// Perform split tunnel classification on the SNI instead of on the
+		// CONNECT target.
+		if splitTunneler, ok := proxy.tunneler.(splitTunneler); ok {
+			untunneled = splitTunneler.IsUntunneled(sni)
+			alwaysTunnel = true
+		}
+	}
+
+	var remoteConn net.Conn
+	if untunneled {
+		remoteConn, err = proxy.tunneler.DirectDial(dialTarget)
+	} else {
+		// Setting downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
+		// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
+		// open connection for data which will never arrive.
+		remoteConn, err = proxy.tunneler.Dial(dialTarget, alwaysTunnel, localConn)
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
 	defer remoteConn.Close()
-	_, err = localConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	if proxy.config.LocalHttpProxySNIRules {
+		if len(clientHello) > 0 {
+			_, err = remoteConn.Write(clientHello)
+		}
+	} else {
+		_, err = localConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
-	LocalProxyRelay(_HTTP_PROXY_TYPE, localConn, remoteConn)
+	var relayConn net.Conn = localConn
+	idleTimeout := proxy.config.clientParameters.Get().Duration(
+		parameters.HTTPProxyIdleTimeout)
+	if idleTimeout > 0 {
+		relayConn = common.NewIdleTimeoutConn(
+			localConn, idleTimeout, func() { remoteConn.Close() })
+	}
+	LocalProxyRelay(_HTTP_PROXY_TYPE, relayConn, remoteConn)
 	return nil
 }
 
+// splitTunneler is implemented by Tunnelers which perform split tunnel
+// classification, and is used to classify a CONNECT request by its SNI.
+type splitTunneler interface {
+	IsUntunneled(host string) bool
+}
+
+const (
+	HTTP_PROXY_CLIENT_HELLO_TIMEOUT = 2 * time.Second
+	TLS_RECORD_HEADER_SIZE          = 5
+	TLS_MAX_RECORD_SIZE             = 16384
+)
+
+// readClientHelloSNI reads the first TLS record sent by the client and
+// returns the bytes read along with the SNI, when the record is a TLS
+// ClientHello with an SNI. The SNI is not returned when it is an IP address.
+//
+// When the client doesn't send a TLS record, such as for protocols where
+// the server speaks first, or for non-TLS protocols, readClientHelloSNI
+// returns any bytes read once HTTP_PROXY_CLIENT_HELLO_TIMEOUT elapses or
+// the bytes read are not a TLS record.
+func readClientHelloSNI(conn net.Conn) ([]byte, string, error) {
+
+	err := conn.SetReadDeadline(time.Now().Add(HTTP_PROXY_CLIENT_HELLO_TIMEOUT))
+	if err != nil {
+		return nil, "", common.ContextError(err)
+	}
+
+	buffer := make([]byte, TLS_RECORD_HEADER_SIZE, TLS_RECORD_HEADER_SIZE+TLS_MAX_RECORD_SIZE)
+
+	n, err := io.ReadFull(conn, buffer)
+	if err == nil && buffer[0] == 22 {
+		recordSize := int(buffer[3])<<8 | int(buffer[4])
+		if recordSize <= TLS_MAX_RECORD_SIZE {
+			buffer = buffer[:TLS_RECORD_HEADER_SIZE+recordSize]
+			var m int
+			m, err = io.ReadFull(conn, buffer[TLS_RECORD_HEADER_SIZE:])
+			n += m
+		}
+	}
+	buffer = buffer[:n]
+
+	if err != nil {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return nil, "", common.ContextError(err)
+		}
+	}
+
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, "", common.ContextError(err)
+	}
+
+	sni, ok := transferstats.GetTLSHostname(buffer)
+	if !ok || sni == "" || net.ParseIP(sni) != nil {
+		sni = ""
+	}
+
+	return buffer, sni, nil
+}
+
 func (proxy *HttpProxy) httpProxyHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	proxy.relayHTTPRequest(nil, proxy.httpProxyTunneledRelay, request, responseWriter, nil, nil)
+	var transport http.RoundTripper = proxy.httpProxyTunneledRelay
+	if proxy.httpProxyCache != nil {
+		transport = proxy.httpProxyCache
+	}
+	proxy.relayHTTPRequest(nil, transport, request, responseWriter, nil, nil)
 }
 
 const (
@@ -398,6 +573,10 @@ func (proxy *HttpProxy) makeRewriteICYClient() (*http.Client, *rewriteICYStatus)
 	rewriteICYStatus := &rewriteICYStatus{}
 
 	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
+		addr, err = checkPortForwardPolicy(proxy.config, _HTTP_PROXY_TYPE, addr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 		// See comment in NewHttpProxy regarding downstreamConn
 		return proxy.tunneler.Dial(addr, false, nil)
 	}
@@ -473,7 +652,7 @@ func (proxy *HttpProxy) makeRewriteICYClient() (*http.Client, *rewriteICYStatus)
 
 func (proxy *HttpProxy) relayHTTPRequest(
 	client *http.Client,
-	transport *http.Transport,
+	transport http.RoundTripper,
 	request *http.Request,
 	responseWriter http.ResponseWriter,
 	rewrites url.Values,
@@ -482,10 +661,25 @@ func (proxy *HttpProxy) relayHTTPRequest(
 	// Transform received request struct before using as input to relayed request
 	request.Close = false
 	request.RequestURI = ""
+
+	// Protocol upgrade requests, such as WebSocket handshakes and h2c
+	// upgrades, retain the Connection and Upgrade headers, which are
+	// otherwise removed as hop-by-hop headers, so that the upgrade is relayed
+	// to the origin server. The Connection header is retained as-is since h2c
+	// also requires the HTTP2-Settings connection option.
+	isUpgrade := isUpgradeRequest(request)
+	connectionHeader := request.Header["Connection"]
+	upgradeHeader := request.Header["Upgrade"]
+
 	for _, key := range hopHeaders {
 		request.Header.Del(key)
 	}
 
+	if isUpgrade {
+		request.Header["Connection"] = connectionHeader
+		request.Header["Upgrade"] = upgradeHeader
+	}
+
 	// Relay the HTTP request and get the response. Use a client when supplied,
 	// otherwise a transport. A client handles cookies and redirects, and a
 	// transport does not.
@@ -505,6 +699,11 @@ func (proxy *HttpProxy) relayHTTPRequest(
 
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		proxy.relayUpgradedConn(responseWriter, response)
+		return
+	}
+
 	if rewrites != nil {
 		// NOTE: Rewrite functions are responsible for leaving response.Body in
 		// a valid, readable state if there's no error.
@@ -585,9 +784,13 @@ func (proxy *HttpProxy) relayHTTPRequest(
 	} else {
 
 		// Standard HTTP response.
+		//
+		// The response body is flushed as it's relayed, so that streamed
+		// responses, such as server-sent events and long polling responses,
+		// aren't held in the http.Server response buffer.
 
 		responseWriter.WriteHeader(response.StatusCode)
-		_, err = io.Copy(responseWriter, response.Body)
+		err = relayResponseBody(responseWriter, response.Body)
 		if err != nil {
 			NoticeAlert("%s", common.ContextError(err))
 			forceClose(responseWriter)
@@ -596,6 +799,135 @@ func (proxy *HttpProxy) relayHTTPRequest(
 	}
 }
 
+// relayResponseBody copies the response body to the responseWriter,
+// flushing after each write when the responseWriter is an http.Flusher.
+func relayResponseBody(responseWriter http.ResponseWriter, body io.Reader) error {
+
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(responseWriter, body)
+		return err
+	}
+
+	buffer := relayBufferPool.Get().(*[]byte)
+	defer relayBufferPool.Put(buffer)
+
+	for {
+		n, err := body.Read(*buffer)
+		if n > 0 {
+			_, writeErr := responseWriter.Write((*buffer)[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isUpgradeRequest indicates whether the request is a protocol upgrade
+// request: the request has an Upgrade header and the Connection header
+// includes the "upgrade" option.
+func isUpgradeRequest(request *http.Request) bool {
+	if request.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range request.Header["Connection"] {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayUpgradedConn completes a protocol upgrade, such as a WebSocket
+// handshake or an h2c upgrade, by sending the 101 Switching Protocols
+// response downstream and then relaying the upgraded connection, in both
+// directions, until either side closes.
+//
+// The upstream connection is the response body, which http.Transport
+// provides as an io.ReadWriteCloser for 101 responses.
+func (proxy *HttpProxy) relayUpgradedConn(
+	responseWriter http.ResponseWriter, response *http.Response) {
+
+	remoteConn, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		NoticeAlert("%s", common.ContextError(errors.New("upgrade response body is not writable")))
+		forceClose(responseWriter)
+		return
+	}
+
+	hijacker, ok := responseWriter.(http.Hijacker)
+	if !ok {
+		NoticeAlert("%s", common.ContextError(errors.New("responseWriter is not an http.Hijacker")))
+		return
+	}
+	localConn, localBuffer, err := hijacker.Hijack()
+	if err != nil {
+		NoticeAlert("%s", common.ContextError(fmt.Errorf("responseWriter hijack failed: %s", err)))
+		return
+	}
+
+	defer localConn.Close()
+	defer remoteConn.Close()
+	defer proxy.openConns.Remove(localConn)
+	proxy.openConns.Add(localConn)
+
+	for _, key := range []string{"Keep-Alive", "Proxy-Authenticate", "Proxy-Connection"} {
+		response.Header.Del(key)
+	}
+	response.Body = nil
+	err = response.Write(localConn)
+	if err != nil {
+		NoticeAlert("%s", common.ContextError(err))
+		return
+	}
+
+	// Relay any upgraded protocol data which the client sent immediately
+	// after the upgrade request and which has already been buffered by the
+	// http.Server.
+	if n := localBuffer.Reader.Buffered(); n > 0 {
+		data, _ := localBuffer.Reader.Peek(n)
+		_, err = remoteConn.Write(data)
+		if err != nil {
+			NoticeAlert("%s", common.ContextError(err))
+			return
+		}
+	}
+
+	var relayConn net.Conn = localConn
+	idleTimeout := proxy.config.clientParameters.Get().Duration(
+		parameters.HTTPProxyIdleTimeout)
+	if idleTimeout > 0 {
+		relayConn = common.NewIdleTimeoutConn(
+			localConn, idleTimeout, func() { remoteConn.Close() })
+	}
+
+	// When either direction ends, both conns are closed by the deferred
+	// Close calls, which interrupts the other direction.
+	errChannel := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(remoteConn, relayConn)
+		errChannel <- err
+	}()
+	go func() {
+		_, err := io.Copy(relayConn, remoteConn)
+		errChannel <- err
+	}()
+	err = <-errChannel
+	if err != nil {
+		err = fmt.Errorf("Relay failed: %s", common.ContextError(err))
+		NoticeLocalProxyError(_HTTP_PROXY_TYPE, err)
+	}
+}
+
 // forceClose hijacks and closes persistent connections. This is used
 // to ensure local persistent connections into the HTTP proxy are closed
 // when ServeHTTP encounters an error.
@@ -658,6 +990,8 @@ func (proxy *HttpProxy) serve() {
 	httpServer := &http.Server{
 		Handler:   proxy,
 		ConnState: proxy.httpConnStateCallback,
+		IdleTimeout: proxy.config.clientParameters.Get().Duration(
+			parameters.HTTPProxyIdleTimeout),
 	}
 	// Note: will be interrupted by listener.Close() call made by proxy.Close()
 	err := httpServer.Serve(proxy.listener)
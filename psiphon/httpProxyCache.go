@@ -0,0 +1,733 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	HTTP_PROXY_CACHE_DIRECTORY_NAME             = "psiphon.httpproxy.cache"
+	HTTP_PROXY_CACHE_MAX_HEURISTIC_LIFETIME     = 24 * time.Hour
+	HTTP_PROXY_CACHE_HEURISTIC_LIFETIME_DIVISOR = 10
+)
+
+// httpProxyCache is a bounded, on-disk HTTP cache for the local HTTP proxy.
+// It is an http.RoundTripper which wraps the tunneled transport and follows
+// HTTP caching semantics for a private cache: only complete 200 responses to
+// GET requests are stored; Cache-Control, Expires, Pragma, and Vary are
+// respected; and stale responses with an ETag or Last-Modified validator are
+// revalidated with a conditional request.
+//
+// Each response is stored in two files: a JSON metadata file and a body
+// file. When the total size of stored bodies exceeds the maximum size, the
+// least recently used responses are evicted. The cache persists across
+// process restarts, and the LRU order is recovered from file modification
+// times.
+//
+// Requests with credentials, cookies, ranges, or conditional headers
+// bypass the cache, as do responses which set cookies.
+type httpProxyCache struct {
+	transport http.RoundTripper
+	directory string
+	maxSize   int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lruList *list.List
+	size    int64
+}
+
+// httpProxyCacheEntry is the stored metadata for a cached response.
+type httpProxyCacheEntry struct {
+	Key               string
+	URL               string
+	StatusCode        int
+	Header            http.Header
+	VaryHeader        http.Header
+	ResponseTime      time.Time
+	InitialAge        time.Duration
+	FreshnessLifetime time.Duration
+	Size              int64
+}
+
+func newHTTPProxyCache(
+	transport http.RoundTripper,
+	directory string,
+	maxSize int64) (*httpProxyCache, error) {
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	cache := &httpProxyCache{
+		transport: transport,
+		directory: directory,
+		maxSize:   maxSize,
+		entries:   make(map[string]*list.Element),
+		lruList:   list.New(),
+	}
+
+	err = cache.load()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return cache, nil
+}
+
+// load initializes the in-memory index from the stored metadata files.
+// Incomplete or invalid entries, such as those left by a crash, are
+// removed.
+func (cache *httpProxyCache) load() error {
+
+	fileInfos, err := ioutil.ReadDir(cache.directory)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	type loadedEntry struct {
+		entry   *httpProxyCacheEntry
+		modTime time.Time
+	}
+	var loadedEntries []*loadedEntry
+
+	for _, fileInfo := range fileInfos {
+
+		name := fileInfo.Name()
+
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(cache.directory, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		key := strings.TrimSuffix(name, ".json")
+
+		entry, err := cache.readEntry(key)
+		if err != nil {
+			NoticeAlert("invalid HTTP proxy cache entry: %s", common.ContextError(err))
+			cache.removeFiles(key)
+			continue
+		}
+
+		bodyFileInfo, err := os.Stat(cache.bodyFilename(key))
+		if err != nil || bodyFileInfo.Size() != entry.Size {
+			cache.removeFiles(key)
+			continue
+		}
+
+		loadedEntries = append(
+			loadedEntries, &loadedEntry{entry: entry, modTime: bodyFileInfo.ModTime()})
+	}
+
+	// Oldest first, so that the most recently used entry ends up at the
+	// front of the LRU list.
+
+	for len(loadedEntries) > 0 {
+		oldest := 0
+		for i, loaded := range loadedEntries {
+			if loaded.modTime.Before(loadedEntries[oldest].modTime) {
+				oldest = i
+			}
+		}
+		entry := loadedEntries[oldest].entry
+		loadedEntries = append(loadedEntries[:oldest], loadedEntries[oldest+1:]...)
+
+		cache.entries[entry.Key] = cache.lruList.PushFront(entry)
+		cache.size += entry.Size
+	}
+
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+
+	return nil
+}
+
+func (cache *httpProxyCache) metadataFilename(key string) string {
+	return filepath.Join(cache.directory, key+".json")
+}
+
+func (cache *httpProxyCache) bodyFilename(key string) string {
+	return filepath.Join(cache.directory, key+".body")
+}
+
+func (cache *httpProxyCache) readEntry(key string) (*httpProxyCacheEntry, error) {
+
+	data, err := ioutil.ReadFile(cache.metadataFilename(key))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var entry httpProxyCacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if entry.Key != key {
+		return nil, common.ContextError(errors.New("unexpected key"))
+	}
+
+	return &entry, nil
+}
+
+// writeEntry atomically replaces the stored metadata for the entry.
+func (cache *httpProxyCache) writeEntry(entry *httpProxyCacheEntry) error {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	filename := cache.metadataFilename(entry.Key)
+
+	err = ioutil.WriteFile(filename+".tmp", data, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func (cache *httpProxyCache) removeFiles(key string) {
+	os.Remove(cache.metadataFilename(key))
+	os.Remove(cache.bodyFilename(key))
+}
+
+// evict removes least recently used entries until the cache size is within
+// the maximum size. The caller must hold the mutex.
+func (cache *httpProxyCache) evict() {
+	for cache.size > cache.maxSize {
+		element := cache.lruList.Back()
+		if element == nil {
+			break
+		}
+		cache.removeElement(element)
+	}
+}
+
+// removeElement removes an entry from the index and disk. The caller must
+// hold the mutex.
+func (cache *httpProxyCache) removeElement(element *list.Element) {
+	entry := element.Value.(*httpProxyCacheEntry)
+	cache.lruList.Remove(element)
+	delete(cache.entries, entry.Key)
+	cache.size -= entry.Size
+	cache.removeFiles(entry.Key)
+}
+
+// getEntry returns the cached entry for the request, or nil when there is
+// no entry or when the entry was stored for different Vary request header
+// values.
+func (cache *httpProxyCache) getEntry(key string, request *http.Request) *httpProxyCacheEntry {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*httpProxyCacheEntry)
+
+	for name, values := range entry.VaryHeader {
+		if strings.Join(request.Header[name], ",") != strings.Join(values, ",") {
+			return nil
+		}
+	}
+
+	return entry
+}
+
+// touchEntry marks the entry as most recently used.
+func (cache *httpProxyCache) touchEntry(entry *httpProxyCacheEntry) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[entry.Key]
+	if !ok || element.Value != entry {
+		return
+	}
+
+	cache.lruList.MoveToFront(element)
+
+	now := time.Now()
+	os.Chtimes(cache.bodyFilename(entry.Key), now, now)
+}
+
+// putEntry adds a new entry, replacing any existing entry for the same
+// key. The body file, already written to tempBodyFilename, is moved into
+// place.
+func (cache *httpProxyCache) putEntry(
+	entry *httpProxyCacheEntry, tempBodyFilename string) error {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[entry.Key]; ok {
+		cache.removeElement(element)
+	}
+
+	err := os.Rename(tempBodyFilename, cache.bodyFilename(entry.Key))
+	if err != nil {
+		os.Remove(tempBodyFilename)
+		return common.ContextError(err)
+	}
+
+	err = cache.writeEntry(entry)
+	if err != nil {
+		cache.removeFiles(entry.Key)
+		return common.ContextError(err)
+	}
+
+	cache.entries[entry.Key] = cache.lruList.PushFront(entry)
+	cache.size += entry.Size
+
+	cache.evict()
+
+	return nil
+}
+
+// updateEntry replaces the metadata for an existing entry, following a
+// successful revalidation.
+func (cache *httpProxyCache) updateEntry(
+	entry, updatedEntry *httpProxyCacheEntry) error {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[entry.Key]
+	if !ok || element.Value != entry {
+		return common.ContextError(errors.New("entry not found"))
+	}
+
+	err := cache.writeEntry(updatedEntry)
+	if err != nil {
+		cache.removeElement(element)
+		return common.ContextError(err)
+	}
+
+	element.Value = updatedEntry
+	cache.lruList.MoveToFront(element)
+
+	return nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (cache *httpProxyCache) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	if !isCacheableRequest(request) {
+		return cache.transport.RoundTrip(request)
+	}
+
+	key := getHTTPProxyCacheKey(request)
+	requestCacheControl := parseCacheControl(request.Header)
+	_, requestNoCache := requestCacheControl["no-cache"]
+	if request.Header.Get("Pragma") == "no-cache" ||
+		requestCacheControl["max-age"] == "0" {
+		requestNoCache = true
+	}
+
+	entry := cache.getEntry(key, request)
+
+	if entry != nil && !requestNoCache && entry.isFresh(time.Now()) {
+		response, err := cache.makeCachedResponse(entry, request)
+		if err == nil {
+			return response, nil
+		}
+		NoticeAlert("HTTP proxy cache read failed: %s", common.ContextError(err))
+		entry = nil
+	}
+
+	upstreamRequest := request
+
+	if entry != nil {
+		etag := entry.Header.Get("ETag")
+		lastModified := entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			upstreamRequest = request.WithContext(request.Context())
+			upstreamRequest.Header = cloneHeader(request.Header)
+			if etag != "" {
+				upstreamRequest.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				upstreamRequest.Header.Set("If-Modified-Since", lastModified)
+			}
+		} else {
+			entry = nil
+		}
+	}
+
+	requestTime := time.Now()
+
+	response, err := cache.transport.RoundTrip(upstreamRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil && response.StatusCode == http.StatusNotModified {
+
+		response.Body.Close()
+
+		updatedEntry := *entry
+		updatedEntry.Header = cloneHeader(entry.Header)
+		for name, values := range response.Header {
+			if name == "Content-Length" || name == "Transfer-Encoding" {
+				continue
+			}
+			updatedEntry.Header[name] = values
+		}
+		updatedEntry.ResponseTime = requestTime
+		updatedEntry.InitialAge = getInitialAge(updatedEntry.Header)
+		updatedEntry.FreshnessLifetime = getFreshnessLifetime(updatedEntry.Header, requestTime)
+
+		err = cache.updateEntry(entry, &updatedEntry)
+		if err == nil {
+			response, err = cache.makeCachedResponse(&updatedEntry, request)
+		}
+		if err != nil {
+			// The revalidated response is no longer available, so request
+			// the full response.
+			NoticeAlert("HTTP proxy cache update failed: %s", common.ContextError(err))
+			return cache.transport.RoundTrip(request)
+		}
+		return response, nil
+	}
+
+	if !isCacheableResponse(response, requestTime) ||
+		response.ContentLength > cache.maxSize {
+		return response, nil
+	}
+
+	file, err := ioutil.TempFile(cache.directory, key+".*.tmp")
+	if err != nil {
+		NoticeAlert("HTTP proxy cache write failed: %s", common.ContextError(err))
+		return response, nil
+	}
+
+	newEntry := &httpProxyCacheEntry{
+		Key:               key,
+		URL:               request.URL.String(),
+		StatusCode:        response.StatusCode,
+		Header:            cloneHeader(response.Header),
+		VaryHeader:        getVaryHeader(request, response),
+		ResponseTime:      requestTime,
+		InitialAge:        getInitialAge(response.Header),
+		FreshnessLifetime: getFreshnessLifetime(response.Header, requestTime),
+	}
+
+	response.Body = &httpProxyCacheBody{
+		ReadCloser:    response.Body,
+		cache:         cache,
+		entry:         newEntry,
+		file:          file,
+		contentLength: response.ContentLength,
+	}
+
+	return response, nil
+}
+
+func (cache *httpProxyCache) makeCachedResponse(
+	entry *httpProxyCacheEntry, request *http.Request) (*http.Response, error) {
+
+	file, err := os.Open(cache.bodyFilename(entry.Key))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	cache.touchEntry(entry)
+
+	header := cloneHeader(entry.Header)
+	header.Set("Age", strconv.FormatInt(
+		int64(entry.getAge(time.Now())/time.Second), 10))
+
+	return &http.Response{
+		Status:        strconv.Itoa(entry.StatusCode) + " " + http.StatusText(entry.StatusCode),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          file,
+		ContentLength: entry.Size,
+		Request:       request,
+	}, nil
+}
+
+// httpProxyCacheBody relays a response body while writing it to a cache
+// body file. The entry is added to the cache only when the complete body
+// has been read.
+type httpProxyCacheBody struct {
+	io.ReadCloser
+	cache         *httpProxyCache
+	entry         *httpProxyCacheEntry
+	file          *os.File
+	contentLength int64
+}
+
+func (body *httpProxyCacheBody) Read(buffer []byte) (int, error) {
+
+	n, err := body.ReadCloser.Read(buffer)
+
+	if body.file != nil {
+
+		if n > 0 {
+			_, writeErr := body.file.Write(buffer[:n])
+			body.entry.Size += int64(n)
+			if writeErr != nil || body.entry.Size > body.cache.maxSize {
+				body.abort()
+			}
+		}
+
+		if err == io.EOF && body.file != nil {
+			body.commit()
+		}
+	}
+
+	// Note: no context error to preserve error type
+	return n, err
+}
+
+func (body *httpProxyCacheBody) Close() error {
+	if body.file != nil {
+		body.abort()
+	}
+	return body.ReadCloser.Close()
+}
+
+func (body *httpProxyCacheBody) abort() {
+	body.file.Close()
+	os.Remove(body.file.Name())
+	body.file = nil
+}
+
+func (body *httpProxyCacheBody) commit() {
+
+	if body.contentLength >= 0 && body.entry.Size != body.contentLength {
+		body.abort()
+		return
+	}
+
+	tempBodyFilename := body.file.Name()
+
+	err := body.file.Close()
+	body.file = nil
+	if err != nil {
+		os.Remove(tempBodyFilename)
+		return
+	}
+
+	err = body.cache.putEntry(body.entry, tempBodyFilename)
+	if err != nil {
+		NoticeAlert("HTTP proxy cache write failed: %s", common.ContextError(err))
+	}
+}
+
+func (entry *httpProxyCacheEntry) getAge(now time.Time) time.Duration {
+	return entry.InitialAge + now.Sub(entry.ResponseTime)
+}
+
+func (entry *httpProxyCacheEntry) isFresh(now time.Time) bool {
+	return entry.getAge(now) < entry.FreshnessLifetime
+}
+
+func getHTTPProxyCacheKey(request *http.Request) string {
+	hash := sha256.Sum256([]byte(request.URL.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+// parseCacheControl returns the Cache-Control directives, with lower case
+// names, and any values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.Index(directive, "="); i != -1 {
+				name = strings.TrimSpace(directive[:i])
+				value = strings.Trim(strings.TrimSpace(directive[i+1:]), "\"")
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func isCacheableRequest(request *http.Request) bool {
+
+	if request.Method != "GET" ||
+		request.URL.Scheme != "http" ||
+		isUpgradeRequest(request) {
+		return false
+	}
+
+	for _, name := range []string{
+		"Authorization", "Cookie", "Range",
+		"If-Match", "If-None-Match", "If-Modified-Since",
+		"If-Unmodified-Since", "If-Range"} {
+
+		if request.Header.Get(name) != "" {
+			return false
+		}
+	}
+
+	_, noStore := parseCacheControl(request.Header)["no-store"]
+
+	return !noStore
+}
+
+func isCacheableResponse(response *http.Response, responseTime time.Time) bool {
+
+	if response.StatusCode != http.StatusOK ||
+		response.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	cacheControl := parseCacheControl(response.Header)
+	if _, ok := cacheControl["no-store"]; ok {
+		return false
+	}
+
+	for _, value := range response.Header["Vary"] {
+		if strings.Contains(value, "*") {
+			return false
+		}
+	}
+
+	return getFreshnessLifetime(response.Header, responseTime) > 0 ||
+		response.Header.Get("ETag") != "" ||
+		response.Header.Get("Last-Modified") != ""
+}
+
+// getFreshnessLifetime returns the response freshness lifetime from the
+// max-age directive or the Expires header, or else a heuristic lifetime
+// based on Last-Modified. no-cache responses have a lifetime of 0, and so
+// are always revalidated.
+func getFreshnessLifetime(header http.Header, responseTime time.Time) time.Duration {
+
+	cacheControl := parseCacheControl(header)
+
+	if _, ok := cacheControl["no-cache"]; ok {
+		return 0
+	}
+
+	if value, ok := cacheControl["max-age"]; ok {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	date := responseTime
+	if value := header.Get("Date"); value != "" {
+		parsedDate, err := http.ParseTime(value)
+		if err == nil {
+			date = parsedDate
+		}
+	}
+
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil || !expires.After(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	if value := header.Get("Last-Modified"); value != "" {
+		lastModified, err := http.ParseTime(value)
+		if err != nil || !lastModified.Before(date) {
+			return 0
+		}
+		lifetime := date.Sub(lastModified) / HTTP_PROXY_CACHE_HEURISTIC_LIFETIME_DIVISOR
+		if lifetime > HTTP_PROXY_CACHE_MAX_HEURISTIC_LIFETIME {
+			lifetime = HTTP_PROXY_CACHE_MAX_HEURISTIC_LIFETIME
+		}
+		return lifetime
+	}
+
+	return 0
+}
+
+func getInitialAge(header http.Header) time.Duration {
+	seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getVaryHeader returns the request header values named by the response
+// Vary header. A cached response is used only for requests with the same
+// values.
+func getVaryHeader(request *http.Request, response *http.Response) http.Header {
+	varyHeader := make(http.Header)
+	for _, value := range response.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			varyHeader[name] = request.Header[name]
+		}
+	}
+	return varyHeader
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
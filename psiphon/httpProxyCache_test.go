@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHttpProxyCache(t *testing.T) {
+
+	testDirectory, err := ioutil.TempDir("", "psiphon-http-proxy-cache-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	var requestCount, notModifiedCount int32
+
+	originServer := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+
+			atomic.AddInt32(&requestCount, 1)
+
+			switch request.URL.Path {
+			case "/fresh", "/large1", "/large2":
+				responseWriter.Header().Set("Cache-Control", "max-age=60")
+			case "/revalidate":
+				responseWriter.Header().Set("Cache-Control", "no-cache")
+				responseWriter.Header().Set("ETag", `"1"`)
+				if request.Header.Get("If-None-Match") == `"1"` {
+					atomic.AddInt32(&notModifiedCount, 1)
+					responseWriter.WriteHeader(http.StatusNotModified)
+					return
+				}
+			case "/no-store":
+				responseWriter.Header().Set("Cache-Control", "no-store")
+			}
+
+			body := "body for " + request.URL.Path
+			if strings.HasPrefix(request.URL.Path, "/large") {
+				body = strings.Repeat("x", 600)
+			}
+			fmt.Fprint(responseWriter, body)
+		}))
+	defer originServer.Close()
+
+	cache, err := newHTTPProxyCache(&http.Transport{}, testDirectory, 1000)
+	if err != nil {
+		t.Fatalf("newHTTPProxyCache failed: %s", err)
+	}
+
+	get := func(cache *httpProxyCache, path string) (string, *http.Response) {
+		request, err := http.NewRequest("GET", originServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		response, err := cache.RoundTrip(request)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %s", err)
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", response.StatusCode)
+		}
+		return string(body), response
+	}
+
+	expectRequests := func(expected int32) {
+		count := atomic.SwapInt32(&requestCount, 0)
+		if count != expected {
+			t.Fatalf("unexpected origin request count: %d", count)
+		}
+	}
+
+	// Test: fresh response is served from the cache
+
+	body, _ := get(cache, "/fresh")
+	if body != "body for /fresh" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	expectRequests(1)
+
+	body, response := get(cache, "/fresh")
+	if body != "body for /fresh" || response.Header.Get("Age") == "" {
+		t.Fatalf("unexpected cached response: %s %+v", body, response.Header)
+	}
+	expectRequests(0)
+
+	// Test: no-cache response is revalidated
+
+	get(cache, "/revalidate")
+	expectRequests(1)
+
+	body, _ = get(cache, "/revalidate")
+	if body != "body for /revalidate" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	expectRequests(1)
+	if atomic.LoadInt32(&notModifiedCount) != 1 {
+		t.Fatalf("unexpected not modified count")
+	}
+
+	// Test: no-store response isn't cached
+
+	get(cache, "/no-store")
+	get(cache, "/no-store")
+	expectRequests(2)
+
+	// Test: incomplete response body isn't cached
+
+	request, _ := http.NewRequest("GET", originServer.URL+"/large1", nil)
+	response, err = cache.RoundTrip(request)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %s", err)
+	}
+	response.Body.Read(make([]byte, 10))
+	response.Body.Close()
+	expectRequests(1)
+
+	get(cache, "/large1")
+	expectRequests(1)
+
+	// Test: cache persists across restarts
+
+	cache, err = newHTTPProxyCache(&http.Transport{}, testDirectory, 1000)
+	if err != nil {
+		t.Fatalf("newHTTPProxyCache failed: %s", err)
+	}
+
+	get(cache, "/large1")
+	get(cache, "/fresh")
+	expectRequests(0)
+
+	// Test: least recently used responses are evicted to enforce the
+	// maximum size
+
+	get(cache, "/large2")
+	expectRequests(1)
+
+	get(cache, "/large2")
+	get(cache, "/fresh")
+	expectRequests(0)
+
+	get(cache, "/large1")
+	expectRequests(1)
+
+	fileInfos, err := ioutil.ReadDir(testDirectory)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %s", err)
+	}
+	var size int64
+	for _, fileInfo := range fileInfos {
+		if strings.HasSuffix(fileInfo.Name(), ".body") {
+			size += fileInfo.Size()
+		}
+	}
+	if size > 1000 {
+		t.Fatalf("unexpected cache size: %d", size)
+	}
+}
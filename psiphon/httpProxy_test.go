@@ -20,14 +20,24 @@
 package psiphon
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 func TestToAbsoluteURL(t *testing.T) {
@@ -154,3 +164,328 @@ func TestRewriteM3U8(t *testing.T) {
 		}
 	}
 }
+
+type directTunneler struct {
+	dialAddress string
+}
+
+func (tunneler *directTunneler) Dial(
+	remoteAddr string, _ bool, _ net.Conn) (net.Conn, error) {
+	tunneler.dialAddress = remoteAddr
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *directTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *directTunneler) SignalComponentFailure() {
+}
+
+func TestHttpProxyUpgradeAndStreaming(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	tunneler := &directTunneler{}
+
+	proxy := &HttpProxy{
+		config:   &Config{clientParameters: clientParameters},
+		tunneler: tunneler,
+		httpProxyTunneledRelay: &http.Transport{
+			Dial: func(_, addr string) (net.Conn, error) {
+				return tunneler.Dial(addr, false, nil)
+			},
+		},
+		openConns: common.NewConns(),
+	}
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	streamSignal := make(chan struct{})
+
+	originServer := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+
+			switch request.URL.Path {
+
+			case "/upgrade":
+
+				if request.Header.Get("Upgrade") != "test" ||
+					!isUpgradeRequest(request) {
+					http.Error(responseWriter, "", http.StatusBadRequest)
+					return
+				}
+
+				conn, buffer, err := responseWriter.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				fmt.Fprintf(buffer,
+					"HTTP/1.1 101 Switching Protocols\r\n"+
+						"Connection: Upgrade\r\nUpgrade: test\r\n\r\n")
+				buffer.Flush()
+
+				// Echo the upgraded protocol data.
+				io.Copy(conn, buffer.Reader)
+
+			case "/stream":
+
+				fmt.Fprint(responseWriter, "first")
+				responseWriter.(http.Flusher).Flush()
+				<-streamSignal
+				fmt.Fprint(responseWriter, "second")
+			}
+		}))
+	defer originServer.Close()
+
+	// Test: upgrade request is relayed and the upgraded conn is relayed in
+	// both directions, including data sent along with the upgrade request.
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn,
+		"GET %s/upgrade HTTP/1.1\r\nHost: %s\r\n"+
+			"Connection: Upgrade\r\nUpgrade: test\r\n\r\nhello",
+		originServer.URL, originServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %s", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Upgrade") != "test" {
+		t.Fatalf("unexpected upgrade response: %+v", response)
+	}
+
+	_, err = conn.Write([]byte(" world"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	echo := make([]byte, len("hello world"))
+	_, err = io.ReadFull(reader, echo)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if string(echo) != "hello world" {
+		t.Fatalf("unexpected echo: %s", echo)
+	}
+
+	// Test: streamed response body is relayed without waiting for the
+	// complete response.
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+
+	response, err = client.Get(originServer.URL + "/stream")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	defer response.Body.Close()
+
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(response.Body, first)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if string(first) != "first" {
+		t.Fatalf("unexpected first chunk: %s", first)
+	}
+
+	close(streamSignal)
+
+	second, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if string(second) != "second" {
+		t.Fatalf("unexpected second chunk: %s", second)
+	}
+}
+
+type sniRulesPortForwardPolicy struct {
+	checkedAddresses []string
+	deniedHost       string
+}
+
+func (policy *sniRulesPortForwardPolicy) CheckPortForward(
+	_, remoteAddress string) string {
+
+	policy.checkedAddresses = append(policy.checkedAddresses, remoteAddress)
+	host, _, _ := net.SplitHostPort(remoteAddress)
+	if host == policy.deniedHost {
+		return ""
+	}
+	return remoteAddress
+}
+
+type splitDirectTunneler struct {
+	directTunneler
+	untunneledHost    string
+	alwaysTunnel      bool
+	directDialAddress string
+}
+
+func (tunneler *splitDirectTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+	tunneler.alwaysTunnel = alwaysTunnel
+	return tunneler.directTunneler.Dial(remoteAddr, alwaysTunnel, downstreamConn)
+}
+
+func (tunneler *splitDirectTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	tunneler.directDialAddress = remoteAddr
+	return tunneler.directTunneler.DirectDial(remoteAddr)
+}
+
+func (tunneler *splitDirectTunneler) IsUntunneled(host string) bool {
+	return host == tunneler.untunneledHost
+}
+
+func TestHttpProxyConnectSNIRules(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	originListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer originListener.Close()
+
+	originAddress := originListener.Addr().String()
+	_, originPort, _ := net.SplitHostPort(originAddress)
+
+	policy := &sniRulesPortForwardPolicy{
+		deniedHost: "denied.example.org",
+	}
+
+	tunneler := &splitDirectTunneler{
+		untunneledHost: "untunneled.example.org",
+	}
+
+	proxy := &HttpProxy{
+		config: &Config{
+			clientParameters:       clientParameters,
+			PortForwardPolicy:      policy,
+			LocalHttpProxySNIRules: true,
+		},
+		tunneler:  tunneler,
+		openConns: common.NewConns(),
+	}
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	originSNI := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := originListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, sni, err := readClientHelloSNI(conn)
+				if err != nil {
+					sni = err.Error()
+				}
+				originSNI <- sni
+			}()
+		}
+	}()
+
+	connect := func(sni string) net.Conn {
+
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+
+		_, err = fmt.Fprintf(conn,
+			"CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", originAddress, originAddress)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %s", err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", response.StatusCode)
+		}
+
+		// The TLS handshake won't complete, so the ClientHello is sent in a
+		// goroutine.
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: sni})
+		go tlsConn.Handshake()
+
+		return conn
+	}
+
+	// Test: rules are applied to both the CONNECT target and the SNI, the
+	// port forward is made to the CONNECT target, and the ClientHello is
+	// relayed
+
+	conn := connect("allowed.example.org")
+	defer conn.Close()
+
+	sni := <-originSNI
+	if sni != "allowed.example.org" {
+		t.Fatalf("unexpected origin SNI: %s", sni)
+	}
+
+	if len(policy.checkedAddresses) != 2 ||
+		policy.checkedAddresses[0] != originAddress ||
+		policy.checkedAddresses[1] != net.JoinHostPort("allowed.example.org", originPort) {
+		t.Fatalf("unexpected policy checks: %v", policy.checkedAddresses)
+	}
+
+	if tunneler.dialAddress != originAddress || !tunneler.alwaysTunnel {
+		t.Fatalf("unexpected dial: %s, %v", tunneler.dialAddress, tunneler.alwaysTunnel)
+	}
+
+	// Test: split tunnel classification is applied to the SNI
+
+	conn = connect("untunneled.example.org")
+	defer conn.Close()
+
+	sni = <-originSNI
+	if sni != "untunneled.example.org" {
+		t.Fatalf("unexpected origin SNI: %s", sni)
+	}
+
+	if tunneler.directDialAddress != originAddress {
+		t.Fatalf("unexpected direct dial address: %s", tunneler.directDialAddress)
+	}
+
+	// Test: SNI denied by policy closes the connection
+
+	conn = connect("denied.example.org")
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("unexpected read result: %v", err)
+	}
+}
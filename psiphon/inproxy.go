@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/inproxy"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// The INPROXY-WEBRTC-OSSH tunnel protocol relays obfuscated SSH through a
+// volunteer in-proxy, matched by a broker, over a WebRTC data channel. See
+// the inproxy package doc.
+//
+// The protocol is gated: it's in DefaultDisabledTunnelProtocols, so it's
+// only selected when enabled by LimitTunnelProtocols, typically via
+// tactics; and it's not selected unless the host application provides an
+// InproxyWebRTCProvider and InproxyBrokerURLs are configured.
+
+// isInproxyEnabled indicates whether the INPROXY-WEBRTC-OSSH protocol may be
+// selected.
+func isInproxyEnabled(config *Config) bool {
+	return config.InproxyWebRTCProvider != nil &&
+		len(config.clientParameters.Get().Strings(parameters.InproxyBrokerURLs)) > 0
+}
+
+// lastNATType is the most recently discovered NAT type, a string, or "".
+var lastNATType atomic.Value
+
+func init() {
+	lastNATType.Store("")
+}
+
+// DiscoverNATType discovers the NAT type of the current network using the
+// first InproxyICEServers STUN server, which must support RFC 5780. The
+// result is reported in a NATType notice and is sent to in-proxy brokers in
+// subsequent dials.
+//
+// DiscoverNATType may be used by the host application to diagnose in-proxy
+// connection failures.
+func DiscoverNATType(ctx context.Context, config *Config) (inproxy.NATType, error) {
+
+	p := config.clientParameters.Get()
+	ICEServers := p.Strings(parameters.InproxyICEServers)
+	testTimeout := p.Duration(parameters.InproxyNATDiscoveryTestTimeout)
+	p = nil
+
+	if len(ICEServers) == 0 {
+		return inproxy.NATType{}, common.ContextError(errors.New("no STUN server"))
+	}
+
+	STUNServerAddress := strings.TrimPrefix(ICEServers[0], "stun:")
+
+	dialConfig, _ := initDialConfig(config, nil)
+
+	conn, serverAddress, err := NewUDPConn(ctx, STUNServerAddress, dialConfig)
+	if err != nil {
+		return inproxy.NATType{}, common.ContextError(err)
+	}
+	defer conn.Close()
+
+	natType, err := inproxy.DiscoverNATType(ctx, conn, serverAddress, testTimeout)
+	if err != nil {
+		return inproxy.NATType{}, common.ContextError(err)
+	}
+
+	lastNATType.Store(natType.String())
+	NoticeNATType(natType.String())
+
+	return natType, nil
+}
+
+// dialInproxy establishes an in-proxy connection to the OSSH port,
+// destinationAddress, of the server.
+func dialInproxy(
+	ctx context.Context,
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	destinationAddress string,
+	sessionID string,
+	dialStats *DialStats) (net.Conn, error) {
+
+	p := config.clientParameters.Get()
+	brokerURLs := p.Strings(parameters.InproxyBrokerURLs)
+	ICEServers := p.Strings(parameters.InproxyICEServers)
+	p = nil
+
+	if config.InproxyWebRTCProvider == nil || len(brokerURLs) == 0 {
+		return nil, common.ContextError(errors.New("in-proxy not configured"))
+	}
+
+	index, err := common.MakeSecureRandomInt(len(brokerURLs))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	brokerURL := brokerURLs[index]
+
+	// Broker requests are made directly, and aren't subject to the traffic
+	// shaping and TCP options applied to tunnel dials.
+	brokerDialConfig, _ := initDialConfig(config, nil)
+
+	brokerHTTPClient, err := MakeUntunneledHTTPClient(
+		ctx, config, brokerDialConfig, nil, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	conn, err := inproxy.Dial(
+		ctx,
+		&inproxy.ClientConfig{
+			WebRTCProvider:      config.InproxyWebRTCProvider,
+			ICEServers:          ICEServers,
+			BrokerURL:           brokerURL,
+			BrokerHTTPClient:    brokerHTTPClient,
+			SessionID:           sessionID,
+			DestinationServerIP: serverEntry.IpAddress,
+			DestinationAddress:  destinationAddress,
+			NATType:             lastNATType.Load().(string),
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dialStats.InproxyConnectionID = conn.ConnectionID()
+
+	return conn, nil
+}
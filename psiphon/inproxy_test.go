@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/inproxy"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+type testWebRTCProvider struct {
+}
+
+func (p *testWebRTCProvider) NewPeerConnection(
+	ICEServers []string) (inproxy.WebRTCPeerConnection, error) {
+	return nil, nil
+}
+
+func TestInproxyProtocolSelection(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	config := &Config{clientParameters: clientParameters}
+
+	if isInproxyEnabled(config) {
+		t.Fatalf("unexpected in-proxy enabled")
+	}
+
+	config.InproxyWebRTCProvider = &testWebRTCProvider{}
+
+	if isInproxyEnabled(config) {
+		t.Fatalf("unexpected in-proxy enabled without brokers")
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.InproxyBrokerURLs: []string{"https://broker.example.org"},
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if !isInproxyEnabled(config) {
+		t.Fatalf("unexpected in-proxy disabled")
+	}
+
+	serverEntry := &protocol.ServerEntry{
+		Capabilities: []string{
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH),
+		},
+	}
+
+	// In-proxy is disabled by default, and so not selected without
+	// LimitTunnelProtocols.
+
+	for i := 0; i < 10; i++ {
+		selectedProtocol, err := (&limitTunnelProtocolsState{inproxyEnabled: true}).selectProtocol(
+			0, false, serverEntry)
+		if err != nil {
+			t.Fatalf("selectProtocol failed: %s", err)
+		}
+		if selectedProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+			t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+		}
+	}
+
+	limitProtocols := protocol.TunnelProtocols{
+		protocol.TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH,
+	}
+
+	selectedProtocol, err := (&limitTunnelProtocolsState{
+		protocols:      limitProtocols,
+		inproxyEnabled: true,
+	}).selectProtocol(0, false, serverEntry)
+	if err != nil {
+		t.Fatalf("selectProtocol failed: %s", err)
+	}
+	if selectedProtocol != protocol.TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH {
+		t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+	}
+
+	_, err = (&limitTunnelProtocolsState{
+		protocols:      limitProtocols,
+		inproxyEnabled: false,
+	}).selectProtocol(0, false, serverEntry)
+	if err != errNoProtocolSupported {
+		t.Fatalf("unexpected selectProtocol result: %v", err)
+	}
+
+	// In-proxy is not used with an upstream proxy.
+
+	_, err = (&limitTunnelProtocolsState{
+		useUpstreamProxy: true,
+		protocols:        limitProtocols,
+		inproxyEnabled:   true,
+	}).selectProtocol(0, false, serverEntry)
+	if err != errNoProtocolSupported {
+		t.Fatalf("unexpected selectProtocol result: %v", err)
+	}
+
+	_, err = dialInproxy(
+		context.Background(),
+		&Config{clientParameters: clientParameters},
+		serverEntry,
+		net.JoinHostPort("192.0.2.1", "443"),
+		"",
+		&DialStats{})
+	if err == nil {
+		t.Fatalf("unexpected dialInproxy success")
+	}
+
+	_, err = DiscoverNATType(context.Background(), &Config{clientParameters: clientParameters})
+	if err == nil {
+		t.Fatalf("unexpected DiscoverNATType success without STUN server")
+	}
+}
@@ -1,3 +1,5 @@
+// +build !js
+
 /*
  * Copyright (c) 2018, Psiphon Inc.
  * All rights reserved.
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// meekBufferPool holds empty meek relay send and receive buffers, which are
+// shared across meek connections to avoid reallocating and regrowing buffers
+// for each new connection and after each dormancy period. Buffers larger
+// than the MeekPooledBufferMaxSize cap are discarded instead of pooled, so
+// that a burst of downstream traffic doesn't pin a large buffer in memory.
+var meekBufferPool = sync.Pool{
+	New: func() interface{} {
+		atomic.AddInt64(&meekBufferPoolAllocations, 1)
+		return new(bytes.Buffer)
+	},
+}
+
+var (
+	meekBufferPoolGets        int64
+	meekBufferPoolAllocations int64
+	meekBufferPoolPuts        int64
+	meekBufferPoolDiscards    int64
+)
+
+// MeekBufferPoolStats are cumulative meek buffer pool statistics.
+// Allocations counts gets which were not satisfied by a pooled buffer, and
+// Discards counts buffers which exceeded the size cap.
+type MeekBufferPoolStats struct {
+	Gets        int64
+	Allocations int64
+	Puts        int64
+	Discards    int64
+}
+
+func getMeekBuffer() *bytes.Buffer {
+	atomic.AddInt64(&meekBufferPoolGets, 1)
+	return meekBufferPool.Get().(*bytes.Buffer)
+}
+
+// putMeekBuffer returns buffer to the pool, unless its capacity exceeds
+// maxSize. The caller must not retain any reference to buffer.
+func putMeekBuffer(buffer *bytes.Buffer, maxSize int) {
+	if buffer.Cap() > maxSize {
+		atomic.AddInt64(&meekBufferPoolDiscards, 1)
+		return
+	}
+	buffer.Reset()
+	atomic.AddInt64(&meekBufferPoolPuts, 1)
+	meekBufferPool.Put(buffer)
+}
+
+func getMeekBufferPoolStats() MeekBufferPoolStats {
+	return MeekBufferPoolStats{
+		Gets:        atomic.LoadInt64(&meekBufferPoolGets),
+		Allocations: atomic.LoadInt64(&meekBufferPoolAllocations),
+		Puts:        atomic.LoadInt64(&meekBufferPoolPuts),
+		Discards:    atomic.LoadInt64(&meekBufferPoolDiscards),
+	}
+}
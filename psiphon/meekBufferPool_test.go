@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMeekBufferPool(t *testing.T) {
+
+	initialStats := getMeekBufferPoolStats()
+
+	buffer := getMeekBuffer()
+	buffer.Write(make([]byte, 1024))
+	putMeekBuffer(buffer, 4096)
+
+	// Pooled buffers are returned empty.
+
+	buffer = getMeekBuffer()
+	if buffer.Len() != 0 {
+		t.Fatalf("unexpected pooled buffer length: %d", buffer.Len())
+	}
+
+	// Buffers exceeding the size cap are discarded.
+
+	buffer.Write(make([]byte, 8192))
+	putMeekBuffer(buffer, 4096)
+
+	stats := getMeekBufferPoolStats()
+
+	if stats.Gets-initialStats.Gets != 2 ||
+		stats.Puts-initialStats.Puts != 1 ||
+		stats.Discards-initialStats.Discards != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// sync.Pool doesn't guarantee that a put buffer is returned by the next
+	// get, so allocations are only bounded.
+
+	allocations := stats.Allocations - initialStats.Allocations
+	if allocations < 0 || allocations > 2 {
+		t.Fatalf("unexpected allocations: %d", allocations)
+	}
+}
+
+func TestMeekConnReleaseBuffers(t *testing.T) {
+
+	meek := &MeekConn{
+		pooledBufferMaxSize: 65536,
+		emptyReceiveBuffer:  make(chan *bytes.Buffer, 1),
+		emptySendBuffer:     make(chan *bytes.Buffer, 1),
+	}
+
+	receiveBuffer := getMeekBuffer()
+	receiveBuffer.Grow(4096)
+	meek.emptyReceiveBuffer <- receiveBuffer
+
+	initialStats := getMeekBufferPoolStats()
+
+	// Empty buffers are returned to the pool and replaced with zero
+	// capacity buffers. The send buffer is in use, and is left in place.
+
+	meek.ReleaseBuffers()
+
+	stats := getMeekBufferPoolStats()
+
+	if stats.Puts-initialStats.Puts != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	buffer := <-meek.emptyReceiveBuffer
+	if buffer == receiveBuffer || buffer.Cap() != 0 {
+		t.Fatalf("receive buffer not released")
+	}
+
+	if len(meek.emptySendBuffer) != 0 {
+		t.Fatalf("unexpected send buffer")
+	}
+}
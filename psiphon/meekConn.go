@@ -149,6 +149,7 @@ type MeekConn struct {
 	// For relay mode
 	fullReceiveBufferLength int
 	readPayloadChunkLength  int
+	pooledBufferMaxSize     int
 	emptyReceiveBuffer      chan *bytes.Buffer
 	partialReceiveBuffer    chan *bytes.Buffer
 	fullReceiveBuffer       chan *bytes.Buffer
@@ -330,6 +331,7 @@ func DialMeek(
 		// request line. In this one case, we can use an HTTP proxy that does
 		// not offer CONNECT support.
 		if strings.HasPrefix(dialConfig.UpstreamProxyURL, "http://") &&
+			len(dialConfig.UpstreamProxyChainURLs) == 0 &&
 			(meekConfig.DialAddress == meekConfig.HostHeader ||
 				meekConfig.DialAddress == meekConfig.HostHeader+":80") {
 
@@ -457,6 +459,7 @@ func DialMeek(
 			meek.fullReceiveBufferLength = p.Int(parameters.MeekFullReceiveBufferLength)
 			meek.readPayloadChunkLength = p.Int(parameters.MeekReadPayloadChunkLength)
 		}
+		meek.pooledBufferMaxSize = p.Int(parameters.MeekPooledBufferMaxSize)
 		p = nil
 
 		meek.emptyReceiveBuffer = make(chan *bytes.Buffer, 1)
@@ -466,8 +469,8 @@ func DialMeek(
 		meek.partialSendBuffer = make(chan *bytes.Buffer, 1)
 		meek.fullSendBuffer = make(chan *bytes.Buffer, 1)
 
-		meek.emptyReceiveBuffer <- new(bytes.Buffer)
-		meek.emptySendBuffer <- new(bytes.Buffer)
+		meek.emptyReceiveBuffer <- getMeekBuffer()
+		meek.emptySendBuffer <- getMeekBuffer()
 
 		meek.relayWaitGroup.Add(1)
 		go meek.relay()
@@ -537,10 +540,39 @@ func (meek *MeekConn) Close() (err error) {
 		}
 		meek.relayWaitGroup.Wait()
 		meek.transport.CloseIdleConnections()
+		meek.releaseBuffersToPool()
 	}
 	return nil
 }
 
+// releaseBuffersToPool returns any relay mode buffers which are not checked
+// out to the meek buffer pool. It's called once the relay has stopped; Read
+// and Write calls, which exit on runCtx Done, will not check out buffers
+// after this point.
+func (meek *MeekConn) releaseBuffersToPool() {
+
+	if meek.roundTripperOnly {
+		return
+	}
+
+	for _, buffers := range []chan *bytes.Buffer{
+		meek.emptyReceiveBuffer,
+		meek.partialReceiveBuffer,
+		meek.fullReceiveBuffer,
+		meek.emptySendBuffer,
+		meek.partialSendBuffer,
+		meek.fullSendBuffer} {
+
+		select {
+		case buffer := <-buffers:
+			putMeekBuffer(buffer, meek.pooledBufferMaxSize)
+		default:
+		}
+	}
+
+	NoticeMeekBufferPoolStats(getMeekBufferPoolStats())
+}
+
 // IsClosed implements the Closer iterface. The return value
 // indicates whether the MeekConn has been closed.
 func (meek *MeekConn) IsClosed() bool {
@@ -552,6 +584,32 @@ func (meek *MeekConn) IsClosed() bool {
 	return isClosed
 }
 
+// ReleaseBuffers replaces any empty relay mode send and receive buffers with
+// new, zero capacity buffers, returning the old buffers to the meek buffer
+// pool, from which unused buffers are garbage collected. This is used when
+// the tunnel is dormant. Buffers that are in use or contain data are left in
+// place. New buffers will grow on demand when traffic resumes.
+func (meek *MeekConn) ReleaseBuffers() {
+
+	if meek.roundTripperOnly {
+		return
+	}
+
+	select {
+	case buffer := <-meek.emptyReceiveBuffer:
+		meek.emptyReceiveBuffer <- new(bytes.Buffer)
+		putMeekBuffer(buffer, meek.pooledBufferMaxSize)
+	default:
+	}
+
+	select {
+	case buffer := <-meek.emptySendBuffer:
+		meek.emptySendBuffer <- new(bytes.Buffer)
+		putMeekBuffer(buffer, meek.pooledBufferMaxSize)
+	default:
+	}
+}
+
 // RoundTrip makes a request to the meek server and returns the response.
 // A new, obfuscated meek cookie is created for every request. The specified
 // end point is recorded in the cookie and is not exposed as plaintext in the
@@ -0,0 +1,33 @@
+// +build go1.19
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"runtime/debug"
+)
+
+// setMemoryLimit sets the Go runtime soft memory limit and returns the
+// previous limit. A negative limitBytes returns the current limit without
+// changing it.
+func setMemoryLimit(limitBytes int64) (int64, bool) {
+	return debug.SetMemoryLimit(limitBytes), true
+}
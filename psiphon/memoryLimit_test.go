@@ -0,0 +1,91 @@
+// +build go1.19
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"runtime/debug"
+	"sync/atomic"
+	"testing"
+)
+
+func TestApplyMemoryLimit(t *testing.T) {
+
+	previousRuntimeGCPercent := debug.SetGCPercent(100)
+	defer func() {
+		debug.SetMemoryLimit(math.MaxInt64)
+		atomic.StoreInt32(&gcPercent, DEFAULT_GC_PERCENT)
+		debug.SetGCPercent(previousRuntimeGCPercent)
+	}()
+
+	// A limit of 0 leaves the runtime settings unchanged.
+
+	restore := applyMemoryLimit(0, 0)
+
+	if debug.SetMemoryLimit(-1) != math.MaxInt64 {
+		t.Fatalf("unexpected memory limit: %d", debug.SetMemoryLimit(-1))
+	}
+	if atomic.LoadInt32(&gcPercent) != DEFAULT_GC_PERCENT {
+		t.Fatalf("unexpected GC percent: %d", gcPercent)
+	}
+
+	restore()
+
+	restore = applyMemoryLimit(64*1024*1024, 0)
+
+	if debug.SetMemoryLimit(-1) != 64*1024*1024 {
+		t.Fatalf("unexpected memory limit: %d", debug.SetMemoryLimit(-1))
+	}
+	if atomic.LoadInt32(&gcPercent) != MEMORY_LIMIT_GC_PERCENT {
+		t.Fatalf("unexpected GC percent: %d", gcPercent)
+	}
+
+	// DoGarbageCollection retains the relaxed GC percent.
+
+	DoGarbageCollection()
+
+	if debug.SetGCPercent(MEMORY_LIMIT_GC_PERCENT) != MEMORY_LIMIT_GC_PERCENT {
+		t.Fatalf("unexpected GC percent after garbage collection")
+	}
+
+	// Restoring reverts to the previous runtime settings, so a later
+	// controller without a memory limit doesn't inherit them.
+
+	restore()
+
+	if debug.SetMemoryLimit(-1) != math.MaxInt64 {
+		t.Fatalf("unexpected memory limit: %d", debug.SetMemoryLimit(-1))
+	}
+	if atomic.LoadInt32(&gcPercent) != DEFAULT_GC_PERCENT {
+		t.Fatalf("unexpected GC percent: %d", gcPercent)
+	}
+	if debug.SetGCPercent(100) != 100 {
+		t.Fatalf("unexpected runtime GC percent")
+	}
+
+	restore = applyMemoryLimit(32*1024*1024, 50)
+	defer restore()
+
+	if atomic.LoadInt32(&gcPercent) != 50 {
+		t.Fatalf("unexpected GC percent: %d", gcPercent)
+	}
+}
@@ -41,7 +41,9 @@ import (
 // memory_test is a memory stress test suite that repeatedly reestablishes
 // tunnels and restarts the Controller.
 //
-// runtime.MemStats is used to monitor system memory usage during the test.
+// runtime.MemStats is used to monitor system memory usage during the test,
+// which must remain within the runtime soft memory limit set via
+// Config.MemoryLimitBytes.
 //
 // These tests are in its own package as its runtime.MemStats checks must not
 // be impacted by other test runs. For the same reason, this test doesn't run
@@ -61,6 +63,7 @@ const (
 	testModeReconnectTunnel = iota
 	testModeRestartController
 	testModeReconnectAndRestart
+	testModeLifecycleStress
 )
 
 func TestReconnectTunnel(t *testing.T) {
@@ -75,6 +78,14 @@ func TestReconnectAndRestart(t *testing.T) {
 	runMemoryTest(t, testModeReconnectAndRestart)
 }
 
+// TestLifecycleStress starts and stops controllers with randomized,
+// overlapping timings and concurrent API calls; see
+// psiphon.StressControllerLifecycle. Run with -race to check for lifecycle
+// races.
+func TestLifecycleStress(t *testing.T) {
+	runMemoryTest(t, testModeLifecycleStress)
+}
+
 func runMemoryTest(t *testing.T, testMode int) {
 
 	testDataDirName, err := ioutil.TempDir("", "psiphon-memory-test")
@@ -92,6 +103,10 @@ func runMemoryTest(t *testing.T, testMode int) {
 		t.Skipf("error loading configuration file: %s", err)
 	}
 
+	// The controller sets a runtime soft memory limit, which the test
+	// checks is in place and honored.
+	memoryLimit := int64(11 * 1024 * 1024)
+
 	// Most of these fields _must_ be filled in before calling LoadConfig,
 	// so that they are correctly set into client parameters.
 	var modifyConfig map[string]interface{}
@@ -110,6 +125,7 @@ func runMemoryTest(t *testing.T, testMode int) {
 	modifyConfig["LimitMeekBufferSizes"] = true
 	modifyConfig["StaggerConnectionWorkersMilliseconds"] = 100
 	modifyConfig["IgnoreHandshakeStatsRegexps"] = true
+	modifyConfig["MemoryLimitBytes"] = memoryLimit
 
 	configJSON, _ = json.Marshal(modifyConfig)
 
@@ -148,7 +164,6 @@ func runMemoryTest(t *testing.T, testMode int) {
 	postActiveTunnelTerminateDelay := 250 * time.Millisecond
 	testDuration := 2 * time.Minute
 	memInspectionFrequency := 10 * time.Second
-	maxSysMemory := uint64(11 * 1024 * 1024)
 
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
 		func(notice []byte) {
@@ -217,6 +232,62 @@ func runMemoryTest(t *testing.T, testMode int) {
 	memInspectionTicker := time.NewTicker(memInspectionFrequency)
 	lastTunnelsEstablished := int32(0)
 
+	inspectMemory := func() {
+		// The memory limit is only set by Go 1.19 and later runtimes.
+		if limit, ok := getMemoryLimit(); ok && limit != memoryLimit {
+			t.Fatalf("unexpected memory limit: %d", limit)
+		}
+		// The runtime memory limit applies to Sys less memory
+		// released to the OS.
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.Sys-m.HeapReleased > uint64(memoryLimit) {
+			t.Fatalf("memory exceeds limit: %d", m.Sys-m.HeapReleased)
+		} else {
+			n := atomic.LoadInt32(&tunnelsEstablished)
+			fmt.Printf("Tunnels established: %d, MemStats.Sys (peak system memory used): %s, MemStats.TotalAlloc (cumulative allocations): %s\n",
+				n, common.FormatByteCount(m.Sys), common.FormatByteCount(m.TotalAlloc))
+			// Stressed controllers may be stopped before establishing.
+			if testMode != testModeLifecycleStress && lastTunnelsEstablished-n >= 0 {
+				t.Fatalf("expected established tunnels")
+			}
+			lastTunnelsEstablished = n
+		}
+	}
+
+	if testMode == testModeLifecycleStress {
+
+		stressErr := make(chan error, 1)
+		go func() {
+			result, err := psiphon.StressControllerLifecycle(
+				context.Background(),
+				config,
+				&psiphon.ControllerStressParameters{
+					Duration:                 testDuration,
+					MaxConcurrentControllers: 3,
+					MaxControllerLifetime:    10 * time.Second,
+					MaxAPICallInterval:       250 * time.Millisecond,
+				})
+			if err == nil {
+				fmt.Printf("Controllers started: %d, API calls: %d\n",
+					result.ControllersStarted, result.APICalls)
+			}
+			stressErr <- err
+		}()
+
+		for {
+			select {
+			case err := <-stressErr:
+				if err != nil {
+					t.Fatalf("StressControllerLifecycle failed: %s", err)
+				}
+				return
+			case <-memInspectionTicker.C:
+				inspectMemory()
+			}
+		}
+	}
+
 	startController()
 
 test_loop:
@@ -227,19 +298,7 @@ test_loop:
 			break test_loop
 
 		case <-memInspectionTicker.C:
-			var m runtime.MemStats
-			runtime.ReadMemStats(&m)
-			if m.Sys > maxSysMemory {
-				t.Fatalf("sys memory exceeds limit: %d", m.Sys)
-			} else {
-				n := atomic.LoadInt32(&tunnelsEstablished)
-				fmt.Printf("Tunnels established: %d, MemStats.Sys (peak system memory used): %s, MemStats.TotalAlloc (cumulative allocations): %s\n",
-					n, common.FormatByteCount(m.Sys), common.FormatByteCount(m.TotalAlloc))
-				if lastTunnelsEstablished-n >= 0 {
-					t.Fatalf("expected established tunnels")
-				}
-				lastTunnelsEstablished = n
-			}
+			inspectMemory()
 
 		case <-reconnectTunnel:
 			controller.TerminateNextActiveTunnel()
@@ -34,7 +34,10 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/dns"
+	socks "github.com/Psiphon-Labs/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/netem"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 const DNS_PORT = 53
@@ -56,6 +59,10 @@ type DialConfig struct {
 	// UpstreamProxyURL is not used by UDPDial.
 	UpstreamProxyURL string
 
+	// UpstreamProxyChainURLs specifies additional proxies to chain after
+	// UpstreamProxyURL. See Config.UpstreamProxyChainURLs.
+	UpstreamProxyChainURLs []string
+
 	// CustomHeaders is a set of additional arbitrary HTTP headers that are
 	// added to all plaintext HTTP requests and requests made through an HTTP
 	// upstream proxy when specified by UpstreamProxyURL.
@@ -77,12 +84,40 @@ type DialConfig struct {
 	// CA certs. See Config.TrustedCACertificatesFilename.
 	TrustedCACertificatesFilename string
 
+	// ClientParameters, when set, provides the UntunneledDNSResolvers
+	// encrypted DNS resolvers used by LookupIP. When nil, LookupIP uses only
+	// the plaintext system or bound resolver.
+	ClientParameters *parameters.ClientParameters
+
 	// ResolvedIPCallback, when set, is called with the IP address that was
 	// dialed. This is either the specified IP address in the dial address,
 	// or the resolved IP address in the case where the dial address is a
 	// domain name.
 	// The callback may be invoked by a concurrent goroutine.
 	ResolvedIPCallback func(string)
+
+	// FirstFlightCallback, when set, is called with the FirstFlightFingerprint
+	// of each TCP connection dialed. For connections through an upstream
+	// proxy, the fingerprint excludes the proxy handshake.
+	// The callback may be invoked by a concurrent goroutine.
+	FirstFlightCallback func(FirstFlightFingerprint)
+
+	// TrafficShapingProfile, when set, specifies the packet size
+	// distribution and burst timing to apply to each TCP connection dialed.
+	TrafficShapingProfile *parameters.ShapingProfile
+
+	// TCPMaxSegmentSize, when not 0, specifies the TCP_MAXSEG socket option
+	// for each TCP connection dialed. TCPMaxSegmentSize is not supported on
+	// Windows.
+	TCPMaxSegmentSize int
+
+	// NetworkEmulator, when set, applies emulated network conditions to each
+	// TCP connection dialed. See Config.NetworkEmulator.
+	NetworkEmulator *netem.Emulator
+
+	// dialCapture, when set, records each TCP connection dialed in the
+	// client's dial capture file.
+	dialCapture *dialCapture
 }
 
 // NetworkConnectivityChecker defines the interface to the external
@@ -109,6 +144,58 @@ type DnsServerGetter interface {
 	GetSecondaryDnsServer() string
 }
 
+// FlowApplicationGetter defines the interface to the external
+// GetFlowApplication provider, which calls into the host application to
+// identify the local application that owns a packet tunnel flow. Protocol is
+// "TCP" or "UDP" and addresses are "<ip>:<port>". GetFlowApplication returns
+// "" when the application is unknown.
+type FlowApplicationGetter interface {
+	GetFlowApplication(protocol, localAddress, remoteAddress string) string
+}
+
+// PortForwardPolicy defines the interface to the external CheckPortForward
+// provider, which calls into the host application to allow, deny, or
+// redirect each port forward requested by a local proxy. ProxyType is
+// "SOCKS" or "HTTP" and remoteAddress is "<host>:<port>", where host may be
+// a domain name or an IP address.
+//
+// CheckPortForward returns the address to dial: remoteAddress, to allow the
+// port forward; another "<host>:<port>" address, to redirect the port
+// forward; or "", to deny the port forward. CheckPortForward is called
+// concurrently and should not block.
+type PortForwardPolicy interface {
+	CheckPortForward(proxyType, remoteAddress string) string
+}
+
+// checkPortForwardPolicy applies any configured PortForwardPolicy to a port
+// forward requested by a local proxy, returning the address to dial. An
+// error is returned when the port forward is denied.
+func checkPortForwardPolicy(
+	config *Config, proxyType, remoteAddress string) (string, error) {
+
+	if config.PortForwardPolicy == nil {
+		return remoteAddress, nil
+	}
+
+	policyAddress := config.PortForwardPolicy.CheckPortForward(proxyType, remoteAddress)
+
+	if policyAddress == "" {
+		return "", common.ContextError(errPortForwardDenied)
+	}
+
+	if policyAddress != remoteAddress {
+		_, _, err := net.SplitHostPort(policyAddress)
+		if err != nil {
+			return "", common.ContextError(
+				fmt.Errorf("invalid port forward policy redirect: %s", err))
+		}
+	}
+
+	return policyAddress, nil
+}
+
+var errPortForwardDenied = errors.New("port forward denied by policy")
+
 // IPv6Synthesizer defines the interface to the external IPv6Synthesize
 // provider which calls into the host application to synthesize IPv6 addresses
 // from IPv4 ones. This is used to correctly lookup IPs on DNS64/NAT64
@@ -139,6 +226,32 @@ type NetworkIDGetter interface {
 	GetNetworkID() string
 }
 
+// NetworkMetadataGetter defines the interface to the external
+// GetNetworkMetadata provider, which returns coarse metadata for the host's
+// current active network.
+//
+// The metadata is sent to the Psiphon server with tactics and handshake
+// requests, where it may be used to filter tactics. Tactics are stored per
+// combination of network ID and ASN, so that clients which roam between
+// providers under the same network ID don't apply tactics obtained for a
+// different provider.
+//
+// NetworkMetadataGetter.GetNetworkMetadata should return blank values for
+// any metadata that cannot be determined.
+type NetworkMetadataGetter interface {
+	GetNetworkMetadata() NetworkMetadata
+}
+
+// NetworkMetadata is coarse metadata for a network. MCC and MNC are the
+// mobile country code and mobile network code of a mobile network. ASN is
+// the autonomous system number, in decimal with no "AS" prefix, of the
+// network provider.
+type NetworkMetadata struct {
+	MCC string
+	MNC string
+	ASN string
+}
+
 // Dialer is a custom network dialer.
 type Dialer func(context.Context, string, string) (net.Conn, error)
 
@@ -170,18 +283,23 @@ func (d *NetDialer) DialContext(ctx context.Context, network, address string) (n
 
 // LocalProxyRelay sends to remoteConn bytes received from localConn,
 // and sends to localConn bytes received from remoteConn.
+//
+// Relay copies use pooled buffers, to avoid per-connection buffer
+// allocations. When both conns are TCP conns, as is the case for untunneled
+// port forwards, the copy uses net.TCPConn.ReadFrom, which splices on
+// Linux, and no buffer is used.
 func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
 	copyWaitGroup := new(sync.WaitGroup)
 	copyWaitGroup.Add(1)
 	go func() {
 		defer copyWaitGroup.Done()
-		_, err := io.Copy(localConn, remoteConn)
+		_, err := relayCopy(localConn, remoteConn)
 		if err != nil {
 			err = fmt.Errorf("Relay failed: %s", common.ContextError(err))
 			NoticeLocalProxyError(proxyType, err)
 		}
 	}()
-	_, err := io.Copy(remoteConn, localConn)
+	_, err := relayCopy(remoteConn, localConn)
 	if err != nil {
 		err = fmt.Errorf("Relay failed: %s", common.ContextError(err))
 		NoticeLocalProxyError(proxyType, err)
@@ -189,6 +307,50 @@ func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
 	copyWaitGroup.Wait()
 }
 
+const RELAY_BUFFER_SIZE = 32 * 1024
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, RELAY_BUFFER_SIZE)
+		return &buffer
+	},
+}
+
+// relayCopy copies from src to dst until EOF or an error.
+func relayCopy(dst, src net.Conn) (int64, error) {
+
+	dst = unwrapRelayConn(dst)
+	src = unwrapRelayConn(src)
+
+	// Skip taking a pooled buffer in the splice case, where io.CopyBuffer
+	// would use net.TCPConn.ReadFrom and ignore the buffer.
+
+	if dstTCPConn, ok := dst.(*net.TCPConn); ok {
+		if _, ok := src.(*net.TCPConn); ok {
+			return dstTCPConn.ReadFrom(src)
+		}
+	}
+
+	buffer := relayBufferPool.Get().(*[]byte)
+	defer relayBufferPool.Put(buffer)
+
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+// unwrapRelayConn returns the underlying *net.TCPConn for conn types which
+// add no Read or Write behavior, so that relayCopy may splice.
+func unwrapRelayConn(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case *socks.SocksConn:
+		return unwrapRelayConn(c.Conn)
+	case *TCPConn:
+		if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+			return tcpConn
+		}
+	}
+	return conn
+}
+
 // WaitForNetworkConnectivity uses a NetworkConnectivityChecker to
 // periodically check for network connectivity. It returns true if
 // no NetworkConnectivityChecker is provided (waiting is disabled)
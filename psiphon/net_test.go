@@ -0,0 +1,455 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/netem"
+	"github.com/elazarl/goproxy"
+)
+
+func TestLocalProxyRelay(t *testing.T) {
+
+	// Echo server, standing in for the remote end of a port forward.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	testRelay := func(t *testing.T, wrapRemote bool, pipeLocal bool) {
+
+		remoteConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		if wrapRemote {
+			remoteConn = &TCPConn{Conn: remoteConn}
+		}
+
+		var clientConn, localConn net.Conn
+		if pipeLocal {
+			clientConn, localConn = net.Pipe()
+		} else {
+			localListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %s", err)
+			}
+			clientConn, err = net.Dial("tcp", localListener.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial failed: %s", err)
+			}
+			localConn, err = localListener.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %s", err)
+			}
+			localListener.Close()
+		}
+
+		relayDone := make(chan struct{})
+		go func() {
+			LocalProxyRelay("test", localConn, remoteConn)
+			close(relayDone)
+		}()
+
+		data := bytes.Repeat([]byte("relay"), 3*RELAY_BUFFER_SIZE/5)
+
+		go clientConn.Write(data)
+
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(clientConn, received)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+		if !bytes.Equal(data, received) {
+			t.Fatalf("unexpected relayed data")
+		}
+
+		clientConn.Close()
+		localConn.Close()
+		remoteConn.Close()
+		<-relayDone
+	}
+
+	t.Run("TCP", func(t *testing.T) { testRelay(t, false, false) })
+	t.Run("wrapped TCP", func(t *testing.T) { testRelay(t, true, false) })
+	t.Run("non-TCP", func(t *testing.T) { testRelay(t, true, true) })
+}
+
+func TestUnwrapRelayConn(t *testing.T) {
+
+	conn, _ := net.Pipe()
+	if unwrapRelayConn(conn) != conn {
+		t.Fatalf("unexpected unwrapped conn")
+	}
+
+	tcpConn := new(net.TCPConn)
+	if unwrapRelayConn(&TCPConn{Conn: tcpConn}) != net.Conn(tcpConn) {
+		t.Fatalf("unexpected unwrapped conn")
+	}
+}
+
+func TestDialTCPConnectionRefused(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	addr := listener.Addr().String()
+
+	// Test: a successful connect is a successful dial
+
+	conn, err := DialTCP(context.Background(), addr, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	conn.Close()
+
+	// Test: a refused connect is a failed dial
+
+	listener.Close()
+
+	conn, err = DialTCP(context.Background(), addr, &DialConfig{})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("unexpected DialTCP success")
+	}
+}
+
+func TestDialTCPUpstreamProxyChain(t *testing.T) {
+
+	// Echo server, the destination.
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer echoListener.Close()
+
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// The second proxy in the chain is a goproxy HTTP CONNECT proxy.
+
+	var mutex sync.Mutex
+	var connectHosts []string
+
+	recordConnectHost := func(host string) {
+		mutex.Lock()
+		connectHosts = append(connectHosts, host)
+		mutex.Unlock()
+	}
+
+	secondProxy := goproxy.NewProxyHttpServer()
+	secondProxy.Logger = log.New(ioutil.Discard, "", 0)
+	secondProxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			recordConnectHost(host)
+			return goproxy.OkConnect, host
+		})
+
+	secondProxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer secondProxyListener.Close()
+
+	go http.Serve(secondProxyListener, secondProxy)
+
+	// The first proxy requires Negotiate authentication. It accepts the
+	// NTLM negotiate message in place of completing an NTLM exchange.
+
+	firstProxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer firstProxyListener.Close()
+
+	handleFirstProxyConn := func(conn net.Conn) error {
+
+		reader := bufio.NewReader(conn)
+
+		_, err := http.ReadRequest(reader)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Negotiate\r\n" +
+			"Content-Length: 0\r\n\r\n"))
+		if err != nil {
+			return err
+		}
+
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return err
+		}
+
+		authorization := strings.SplitN(request.Header.Get("Proxy-Authorization"), " ", 2)
+		if len(authorization) != 2 || authorization[0] != "Negotiate" {
+			return fmt.Errorf("unexpected authorization: %v", authorization)
+		}
+		token, err := base64.StdEncoding.DecodeString(authorization[1])
+		if err != nil || !bytes.HasPrefix(token, []byte("NTLMSSP\x00\x01\x00\x00\x00")) {
+			return fmt.Errorf("unexpected Negotiate token: %x", token)
+		}
+
+		recordConnectHost(request.Host)
+
+		targetConn, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			return err
+		}
+		defer targetConn.Close()
+
+		_, err = conn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+		if err != nil {
+			return err
+		}
+
+		go io.Copy(targetConn, reader)
+		io.Copy(conn, targetConn)
+
+		return nil
+	}
+
+	go func() {
+		for {
+			conn, err := firstProxyListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				err := handleFirstProxyConn(conn)
+				if err != nil {
+					fmt.Printf("first proxy failed: %s\n", err)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	conn, err := DialTCP(
+		context.Background(),
+		echoListener.Addr().String(),
+		&DialConfig{
+			UpstreamProxyURL: fmt.Sprintf(
+				"http://DOMAIN%%5Cuser:password@%s", firstProxyListener.Addr().String()),
+			UpstreamProxyChainURLs: []string{
+				fmt.Sprintf("http://%s", secondProxyListener.Addr().String()),
+			},
+		})
+	if err != nil {
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	defer conn.Close()
+
+	message := []byte("message")
+
+	_, err = conn.Write(message)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	response := make([]byte, len(message))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if !bytes.Equal(response, message) {
+		t.Fatalf("unexpected response: %s", response)
+	}
+
+	// The first proxy connects to the second proxy, which connects to the
+	// destination.
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(connectHosts) != 2 ||
+		connectHosts[0] != secondProxyListener.Addr().String() ||
+		connectHosts[1] != echoListener.Addr().String() {
+
+		t.Fatalf("unexpected CONNECT hosts: %v", connectHosts)
+	}
+}
+
+func TestDialTCPNetworkEmulator(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	emulator := netem.NewEmulator(netem.Conditions{Unreachable: true})
+	dialConfig := &DialConfig{NetworkEmulator: emulator}
+
+	_, err = DialTCP(context.Background(), listener.Addr().String(), dialConfig)
+	if err == nil {
+		t.Fatalf("unexpected DialTCP success")
+	}
+
+	latency := 50 * time.Millisecond
+	emulator.SetConditions(netem.Conditions{Latency: latency})
+
+	start := time.Now()
+	conn, err := DialTCP(context.Background(), listener.Addr().String(), dialConfig)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	defer conn.Close()
+	if time.Since(start) < 2*latency {
+		t.Fatalf("unexpected dial duration: %s", time.Since(start))
+	}
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	received := make([]byte, 4)
+	_, err = io.ReadFull(conn, received)
+	if err != nil || string(received) != "ping" {
+		t.Fatalf("unexpected echo: %s, %v", received, err)
+	}
+
+	// A reset tunnel connection is how mid-stream network failures surface.
+	emulator.ResetConns()
+	_, err = conn.Read(received)
+	if err != netem.ErrConnectionReset {
+		t.Fatalf("unexpected Read error: %v", err)
+	}
+}
+
+type testPortForwardPolicy struct {
+	proxyTypes []string
+}
+
+func (policy *testPortForwardPolicy) CheckPortForward(proxyType, remoteAddress string) string {
+	policy.proxyTypes = append(policy.proxyTypes, proxyType)
+	switch remoteAddress {
+	case "denied.example.org:443":
+		return ""
+	case "redirected.example.org:443":
+		return "192.0.2.1:443"
+	case "invalid.example.org:443":
+		return "192.0.2.1"
+	}
+	return remoteAddress
+}
+
+func TestCheckPortForwardPolicy(t *testing.T) {
+
+	address, err := checkPortForwardPolicy(
+		&Config{}, _SOCKS_PROXY_TYPE, "denied.example.org:443")
+	if err != nil || address != "denied.example.org:443" {
+		t.Fatalf("unexpected result without policy: %s, %v", address, err)
+	}
+
+	policy := &testPortForwardPolicy{}
+	config := &Config{PortForwardPolicy: policy}
+
+	testCases := []struct {
+		remoteAddress   string
+		expectedAddress string
+		expectError     bool
+	}{
+		{"allowed.example.org:443", "allowed.example.org:443", false},
+		{"denied.example.org:443", "", true},
+		{"redirected.example.org:443", "192.0.2.1:443", false},
+		{"invalid.example.org:443", "", true},
+	}
+
+	for _, testCase := range testCases {
+
+		address, err := checkPortForwardPolicy(
+			config, _HTTP_PROXY_TYPE, testCase.remoteAddress)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Fatalf("unexpected success for %+v", testCase)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("checkPortForwardPolicy failed for %+v: %s", testCase, err)
+		}
+		if address != testCase.expectedAddress {
+			t.Fatalf("unexpected address for %+v: %s", testCase, address)
+		}
+	}
+
+	for _, proxyType := range policy.proxyTypes {
+		if proxyType != _HTTP_PROXY_TYPE {
+			t.Fatalf("unexpected proxy type: %s", proxyType)
+		}
+	}
+}
@@ -21,7 +21,10 @@ package psiphon
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -32,25 +35,38 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 )
 
 type noticeLogger struct {
 	logDiagnostics             int32
+	logSinkEnabled             int32
+	redactionEnabled           int32
 	mutex                      sync.Mutex
 	writer                     io.Writer
 	homepageFilename           string
 	homepageFile               *os.File
 	rotatingFilename           string
-	rotatingOlderFilename      string
 	rotatingFile               *os.File
 	rotatingFileSize           int64
+	rotatingMaxFiles           int
+	rotatingMaxAge             time.Duration
+	rotatingCompress           bool
 	rotatingCurrentFileSize    int64
 	rotatingSyncFrequency      int
 	rotatingCurrentNoticeCount int
+	history                    *noticeHistory
+	subscribers                map[chan []byte]bool
+	logSink                    *logSink
+	redactor                   *noticeRedactor
 }
 
+const noticeSubscriberBufferSize = 256
+
 var singletonNoticeLogger = noticeLogger{
-	writer: os.Stderr,
+	writer:           os.Stderr,
+	rotatingMaxFiles: 1,
 }
 
 // SetEmitDiagnosticNotices toggles whether diagnostic notices
@@ -108,8 +124,9 @@ func SetNoticeWriter(writer io.Writer) {
 //
 // - When rotatingFilename is not "", all notices are are written to the specified
 //   file. Diagnostic notices are omitted from the writer. The file is rotated
-//   when its size exceeds rotatingFileSize. One rotated older file,
-//   <rotatingFilename>.1, is retained. The files may be read at any time; and
+//   when its size exceeds rotatingFileSize. By default, one rotated older file,
+//   <rotatingFilename>.1, is retained; see SetNoticeFileRotation for retaining
+//   and compressing more older files. The files may be read at any time; and
 //   should be opened read-only for reading. rotatingSyncFrequency specifies how
 //   many notices are written before syncing the file.
 //   If either rotatingFileSize or rotatingSyncFrequency are <= 0, default values
@@ -167,7 +184,6 @@ func SetNoticeFiles(
 		}
 
 		singletonNoticeLogger.rotatingFilename = rotatingFilename
-		singletonNoticeLogger.rotatingOlderFilename = rotatingFilename + ".1"
 		singletonNoticeLogger.rotatingFileSize = int64(rotatingFileSize)
 		singletonNoticeLogger.rotatingCurrentFileSize = fileInfo.Size()
 		singletonNoticeLogger.rotatingSyncFrequency = rotatingSyncFrequency
@@ -177,6 +193,36 @@ func SetNoticeFiles(
 	return nil
 }
 
+// SetNoticeFileRotation configures retention of the older files produced by
+// rotating the notices file configured with SetNoticeFiles.
+//
+// - maxFiles is the number of rotated older files to retain, named
+//   <rotatingFilename>.1 through <rotatingFilename>.<maxFiles>, where .1 is
+//   the most recent. When maxFiles is <= 0, the default of 1 is used.
+//
+// - When maxAge is > 0, rotated older files last modified more than maxAge
+//   ago are deleted, at the next rotation.
+//
+// - When compress is set, rotated older files are gzip compressed and have
+//   an additional ".gz" suffix, as in <rotatingFilename>.1.gz. The current
+//   notices file is never compressed.
+//
+// The configuration is applied at the next rotation, and may be set before
+// or after SetNoticeFiles.
+func SetNoticeFileRotation(maxFiles int, maxAge time.Duration, compress bool) {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if maxFiles <= 0 {
+		maxFiles = 1
+	}
+
+	singletonNoticeLogger.rotatingMaxFiles = maxFiles
+	singletonNoticeLogger.rotatingMaxAge = maxAge
+	singletonNoticeLogger.rotatingCompress = compress
+}
+
 const (
 	noticeShowUser       = 1
 	noticeIsDiagnostic   = 2
@@ -188,16 +234,24 @@ const (
 // outputNotice encodes a notice in JSON and writes it to the output writer.
 func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
 
-	if (noticeFlags&noticeIsDiagnostic != 0) && atomic.LoadInt32(&nl.logDiagnostics) != 1 {
+	// Diagnostic notices which aren't emitted may still be written to the
+	// structured log, which has its own log level; see SetLogFile.
+
+	emitNotice := (noticeFlags&noticeIsDiagnostic == 0) ||
+		atomic.LoadInt32(&nl.logDiagnostics) == 1
+
+	if !emitNotice && atomic.LoadInt32(&nl.logSinkEnabled) != 1 {
 		return
 	}
 
+	timestamp := time.Now().UTC().Format(common.RFC3339Milli)
+
 	obj := make(map[string]interface{})
 	noticeData := make(map[string]interface{})
 	obj["noticeType"] = noticeType
 	obj["showUser"] = (noticeFlags&noticeShowUser != 0)
 	obj["data"] = noticeData
-	obj["timestamp"] = time.Now().UTC().Format(common.RFC3339Milli)
+	obj["timestamp"] = timestamp
 	for i := 0; i < len(args)-1; i += 2 {
 		name, ok := args[i].(string)
 		value := args[i+1]
@@ -205,6 +259,12 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 			noticeData[name] = value
 		}
 	}
+	if noticeFlags&noticeIsHomepage == 0 {
+		redactor := nl.getRedactor()
+		if redactor != nil {
+			redactor.redactData(noticeData)
+		}
+	}
 	encodedJson, err := json.Marshal(obj)
 	var output []byte
 	if err == nil {
@@ -221,6 +281,25 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 	nl.mutex.Lock()
 	defer nl.mutex.Unlock()
 
+	if nl.logSink != nil {
+
+		level := getNoticeLogLevel(noticeType, noticeFlags)
+
+		ok, component := nl.logSink.accepts(level, getNoticeComponent)
+		if ok {
+			err := nl.logSink.write(timestamp, level, component, noticeType, noticeData)
+			if err != nil {
+				output := makeNoticeInternalError(
+					fmt.Sprintf("write log file failed: %s", err))
+				nl.writer.Write(output)
+			}
+		}
+	}
+
+	if !emitNotice {
+		return
+	}
+
 	skipWriter := false
 
 	if nl.homepageFile != nil &&
@@ -252,11 +331,61 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 		}
 	}
 
+	if nl.history != nil {
+
+		err := nl.history.write(output)
+
+		if err != nil {
+			output := makeNoticeInternalError(
+				fmt.Sprintf("write notice history failed: %s", err))
+			nl.writer.Write(output)
+		}
+	}
+
+	for subscriber := range nl.subscribers {
+		select {
+		case subscriber <- output:
+		default:
+		}
+	}
+
 	if !skipWriter {
 		_, _ = nl.writer.Write(output)
 	}
 }
 
+// SubscribeNotices returns a channel which receives each emitted notice, in
+// the same newline-terminated JSON encoding written to the notice writer,
+// and an unsubscribe function which must be called to release the
+// subscription. Subscribers receive diagnostic notices only when diagnostic
+// notices are enabled.
+//
+// The channel is buffered. When a subscriber doesn't keep up, notices are
+// dropped rather than blocking the notice writer.
+func SubscribeNotices() (<-chan []byte, func()) {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if singletonNoticeLogger.subscribers == nil {
+		singletonNoticeLogger.subscribers = make(map[chan []byte]bool)
+	}
+
+	subscriber := make(chan []byte, noticeSubscriberBufferSize)
+	singletonNoticeLogger.subscribers[subscriber] = true
+
+	unsubscribe := func() {
+		singletonNoticeLogger.mutex.Lock()
+		defer singletonNoticeLogger.mutex.Unlock()
+		if singletonNoticeLogger.subscribers[subscriber] {
+			delete(singletonNoticeLogger.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return subscriber, unsubscribe
+}
+
 // NoticeInteralError is an error formatting or writing notices.
 // A NoticeInteralError handler must not call a Notice function.
 func makeNoticeInternalError(errorMessage string) []byte {
@@ -303,42 +432,242 @@ func (nl *noticeLogger) outputNoticeToRotatingFile(output []byte) error {
 		// rotatingFileSize limit; e.g., no attempt is made to
 		// continue writing to the file if it can't be rotated.
 
-		err := nl.rotatingFile.Sync()
+		err := nl.rotateFile()
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
+
+	_, err := nl.rotatingFile.Write(output)
+	if err != nil {
+		return common.ContextError(err)
+	}
 
-		err = nl.rotatingFile.Close()
+	nl.rotatingCurrentNoticeCount += 1
+	if nl.rotatingCurrentNoticeCount >= nl.rotatingSyncFrequency {
+		nl.rotatingCurrentNoticeCount = 0
+		err = nl.rotatingFile.Sync()
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
+
+	return nil
+}
+
+// rotateFile moves the current rotating file to the most recent older file
+// name, shifting and pruning existing older files, and opens a new, empty
+// rotating file. The caller must hold nl.mutex.
+func (nl *noticeLogger) rotateFile() error {
+
+	err := nl.rotatingFile.Sync()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = nl.rotatingFile.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = nl.shiftOlderFiles()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	olderFilename := nl.olderFilename(1)
+
+	err = os.Rename(nl.rotatingFilename, olderFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
 
-		err = os.Rename(nl.rotatingFilename, nl.rotatingOlderFilename)
+	if nl.rotatingCompress {
+		err = compressFile(olderFilename)
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
+
+	err = nl.pruneOlderFiles()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	nl.rotatingFile, err = os.OpenFile(
+		nl.rotatingFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	nl.rotatingCurrentFileSize = 0
+	nl.rotatingCurrentNoticeCount = 0
+
+	return nil
+}
+
+// olderFilename returns the uncompressed name of the older rotating file with
+// the specified index.
+func (nl *noticeLogger) olderFilename(index int) string {
+	return fmt.Sprintf("%s.%d", nl.rotatingFilename, index)
+}
+
+// existingOlderFilename returns the name of the older rotating file with the
+// specified index, which may or may not be compressed, or "" when there is
+// no such file. Both names are checked as the compression configuration may
+// have changed since the file was rotated.
+func (nl *noticeLogger) existingOlderFilename(index int) string {
+	filename := nl.olderFilename(index)
+	for _, name := range []string{filename + ".gz", filename} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// shiftOlderFiles increments the index of each older rotating file, making
+// room for a new .1 file, and deletes the oldest file when the maximum
+// number of older files would be exceeded.
+func (nl *noticeLogger) shiftOlderFiles() error {
+
+	for index := nl.rotatingMaxFiles; index >= 1; index-- {
+
+		filename := nl.existingOlderFilename(index)
+		if filename == "" {
+			continue
+		}
+
+		if index == nl.rotatingMaxFiles {
+			err := os.Remove(filename)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			continue
+		}
 
-		nl.rotatingFile, err = os.OpenFile(
-			nl.rotatingFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		newFilename := nl.olderFilename(index + 1)
+		if strings.HasSuffix(filename, ".gz") {
+			newFilename += ".gz"
+		}
+
+		err := os.Rename(filename, newFilename)
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
+
+	return nil
+}
+
+// pruneOlderFiles deletes older rotating files which exceed the maximum age.
+// Files beyond the maximum number of older files, remaining after the
+// maximum is reduced, are also deleted.
+func (nl *noticeLogger) pruneOlderFiles() error {
+
+	for index := 1; ; index++ {
+
+		filename := nl.existingOlderFilename(index)
+		if filename == "" {
+			return nil
+		}
+
+		remove := index > nl.rotatingMaxFiles
+
+		if !remove && nl.rotatingMaxAge > 0 {
+			fileInfo, err := os.Stat(filename)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			remove = time.Since(fileInfo.ModTime()) > nl.rotatingMaxAge
+		}
 
-		nl.rotatingCurrentFileSize = 0
+		if remove {
+			err := os.Remove(filename)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
 	}
+}
 
-	_, err := nl.rotatingFile.Write(output)
+// compressFile replaces filename with a gzip compressed copy named
+// filename.gz. The modification time of the original file is retained, for
+// pruneOlderFiles.
+func compressFile(filename string) (retErr error) {
+
+	file, err := os.Open(filename)
 	if err != nil {
 		return common.ContextError(err)
 	}
+	defer file.Close()
 
-	nl.rotatingCurrentNoticeCount += 1
-	if nl.rotatingCurrentNoticeCount >= nl.rotatingSyncFrequency {
-		nl.rotatingCurrentNoticeCount = 0
-		err = nl.rotatingFile.Sync()
-		if err != nil {
-			return common.ContextError(err)
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	compressedFilename := filename + ".gz"
+
+	compressedFile, err := os.OpenFile(
+		compressedFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer func() {
+		if retErr != nil {
+			compressedFile.Close()
+			os.Remove(compressedFilename)
 		}
+	}()
+
+	writer := gzip.NewWriter(compressedFile)
+
+	_, err = io.Copy(writer, file)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = compressedFile.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = os.Chtimes(compressedFilename, fileInfo.ModTime(), fileInfo.ModTime())
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = os.Remove(filename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// RotateNoticeFiles immediately rotates the rotating notices file, as
+// configured by SetNoticeFiles, without waiting for it to reach its size
+// limit. This supports external triggers, such as a signal sent by a
+// service manager. RotateNoticeFiles is a noop when no rotating file is
+// configured.
+func RotateNoticeFiles() error {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if singletonNoticeLogger.rotatingFile == nil {
+		return nil
+	}
+
+	err := singletonNoticeLogger.rotateFile()
+	if err != nil {
+		return common.ContextError(err)
 	}
 
 	return nil
@@ -450,6 +779,8 @@ func noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialSta
 		args = append(args, "TLSProfile", dialStats.TLSProfile)
 	}
 
+	args = append(args, "isReplay", dialStats.IsReplay)
+
 	singletonNoticeLogger.outputNotice(
 		noticeType, noticeIsDiagnostic,
 		args...)
@@ -495,6 +826,49 @@ func NoticeSocksProxyPortInUse(port int) {
 		noticeShowUser, "port", port)
 }
 
+// NoticeDNSCacheMetrics reports tunneled DNS cache activity.
+func NoticeDNSCacheMetrics(metrics DNSCacheMetrics) {
+	singletonNoticeLogger.outputNotice(
+		"DNSCacheMetrics", noticeIsDiagnostic,
+		"entries", metrics.Entries,
+		"hits", metrics.Hits,
+		"negativeHits", metrics.NegativeHits,
+		"misses", metrics.Misses,
+		"evictions", metrics.Evictions)
+}
+
+// NoticeDNSPoisoningDetected indicates that a plaintext untunneled DNS
+// answer for the host appears to be poisoned. Repeats for the same host and
+// reason are suppressed.
+func NoticeDNSPoisoningDetected(host, reason string) {
+	outputRepetitiveNotice(
+		"DNSPoisoningDetected-"+host, reason, 0,
+		"DNSPoisoningDetected", 0,
+		"host", host,
+		"reason", reason)
+}
+
+// NoticeNATType reports the NAT type discovered for the current network,
+// in the form "<mapping>/<filtering>"; e.g., "EIM/APDF". See
+// inproxy.DiscoverNATType. Repeats of the same NAT type are suppressed.
+func NoticeNATType(natType string) {
+	outputRepetitiveNotice(
+		"NATType", natType, 0,
+		"NATType", 0,
+		"natType", natType)
+}
+
+// NoticeSocksLocalResolution indicates that a SOCKS client requested a
+// connection to an IP address, rather than to a hostname, when remote
+// resolution is configured. This suggests that the client application
+// resolved the hostname locally, leaking DNS requests outside of the tunnel.
+// The notice is emitted once per run.
+func NoticeSocksLocalResolution() {
+	outputRepetitiveNotice(
+		"SocksLocalResolution", "SocksLocalResolution", 0,
+		"SocksLocalResolution", 0)
+}
+
 // NoticeListeningSocksProxyPort is the selected port for the listening local SOCKS proxy
 func NoticeListeningSocksProxyPort(port int) {
 	singletonNoticeLogger.outputNotice(
@@ -601,6 +975,21 @@ func NoticeUpstreamProxyError(err error) {
 		"message", err.Error())
 }
 
+// NoticeBlockingEvent reports a tunnel dial failure which matches a blocking
+// pattern. The classification is one of the BLOCKING_EVENT constants, and
+// stage is the BLOCKING_EVENT_STAGE at which the dial failed. This notice
+// omits the server IP address and error, which are reported in diagnostic
+// notices, and is intended for informing the user why connecting is
+// failing.
+func NoticeBlockingEvent(region, protocol, stage, classification string) {
+	singletonNoticeLogger.outputNotice(
+		"BlockingEvent", noticeShowUser,
+		"region", region,
+		"protocol", protocol,
+		"stage", stage,
+		"classification", classification)
+}
+
 // NoticeClientUpgradeDownloadedBytes reports client upgrade download progress.
 func NoticeClientUpgradeDownloadedBytes(bytes int64) {
 	singletonNoticeLogger.outputNotice(
@@ -640,6 +1029,167 @@ func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
 		"received", received)
 }
 
+// NoticeDormancy reports that the tunnel to the server at ipAddress has
+// entered or exited dormancy mode.
+func NoticeDormancy(ipAddress string, isDormant bool) {
+	singletonNoticeLogger.outputNotice(
+		"Dormancy", noticeIsDiagnostic,
+		"ipAddress", ipAddress,
+		"isDormant", isDormant)
+}
+
+// NoticeCaptivePortal reports that a captive portal has been detected, and
+// tunnel establishment is paused, or that a previously detected captive
+// portal has been cleared, and establishment has resumed. portalURL is the
+// page the user may open to sign in to the network, and is set only when
+// isCaptivePortal is set.
+func NoticeCaptivePortal(isCaptivePortal bool, portalURL string) {
+	singletonNoticeLogger.outputNotice(
+		"CaptivePortal", noticeShowUser,
+		"isCaptivePortal", isCaptivePortal,
+		"portalURL", portalURL)
+}
+
+// NoticeRegionLatencies reports the median round trip time, in
+// milliseconds, to sampled servers in each region, as measured through the
+// active tunnel. Regions where no sampled server responded are omitted.
+func NoticeRegionLatencies(latencies map[string]int64) {
+	singletonNoticeLogger.outputNotice(
+		"RegionLatencies", 0,
+		"latencies", latencies)
+}
+
+// NoticeFlowStats reports packet tunnel flow stats for the most active
+// flows. As this reveals user browsing activity, it's emitted only when
+// flow tracking is explicitly enabled.
+func NoticeFlowStats(flows []map[string]interface{}) {
+	singletonNoticeLogger.outputNotice(
+		"FlowStats", 0,
+		"flows", flows)
+}
+
+// NoticeCrashReport reports a panic recovered in a Controller goroutine,
+// including the panic stack, a dump of all goroutine stacks, and a memory
+// stats snapshot. The controller shuts down after a crash report.
+func NoticeCrashReport(
+	component, panicValue, stack, goroutines string, memStats *feedbackMemStats) {
+
+	singletonNoticeLogger.outputNotice(
+		"CrashReport", 0,
+		"component", component,
+		"panic", panicValue,
+		"stack", stack,
+		"goroutines", goroutines,
+		"memStats", memStats)
+}
+
+// NoticeTunnelRecycled reports that the tunnel liveness watchdog terminated
+// an active tunnel after consecutive liveness probe failures. probeErrors
+// lists the errors from the failed probes.
+func NoticeTunnelRecycled(
+	ipAddress, protocol string, failures int, probeErrors []string) {
+
+	singletonNoticeLogger.outputNotice(
+		"TunnelRecycled", noticeIsDiagnostic,
+		"ipAddress", ipAddress,
+		"protocol", protocol,
+		"failures", failures,
+		"probeErrors", probeErrors)
+}
+
+// NoticeDailyBytesTransferred reports the persistent total bytes
+// transferred through tunnels to servers in the specified region on the
+// specified UTC day. Unlike NoticeTotalBytesTransferred, these totals
+// survive controller restarts.
+func NoticeDailyBytesTransferred(day, region string, sent, received int64) {
+	singletonNoticeLogger.outputNotice(
+		"DailyBytesTransferred", 0,
+		"day", day,
+		"region", region,
+		"sent", sent,
+		"received", received)
+}
+
+// NoticeDecoyStats reports cumulative decoy traffic statistics after each
+// decoy request.
+func NoticeDecoyStats(mode string, requests, failures int, bytes int64) {
+	singletonNoticeLogger.outputNotice(
+		"DecoyStats", 0,
+		"mode", mode,
+		"requests", requests,
+		"failures", failures,
+		"bytes", bytes)
+}
+
+// NoticeTunnelPoolSize reports a tunnel pool autoscaler resize along with
+// the measured load that triggered it.
+func NoticeTunnelPoolSize(size, previousSize int, bytesPerSecond int64, queueDepth int) {
+	singletonNoticeLogger.outputNotice(
+		"TunnelPoolSize", 0,
+		"size", size,
+		"previousSize", previousSize,
+		"bytesPerSecond", bytesPerSecond,
+		"queueDepth", queueDepth)
+}
+
+// NoticePortForwardLimit reports that a tunneled port forward to host hit
+// the "total" or "host" concurrent port forward limit, and whether the port
+// forward is queued or rejected per policy. Repetitive notices for the same
+// host and limit are suppressed.
+func NoticePortForwardLimit(host, limit, policy string) {
+	outputRepetitiveNotice(
+		"PortForwardLimit", host+limit, 1,
+		"PortForwardLimit", 0,
+		"host", host,
+		"limit", limit,
+		"policy", policy)
+}
+
+// NoticeSSHChannelStats reports aggregate SSH channel flow control stats for
+// the tunnel, including time spent with channel writes stalled on a full
+// window and the maximum bytes in flight on any channel.
+func NoticeSSHChannelStats(ipAddress string, stats ssh.ChannelStats) {
+	singletonNoticeLogger.outputNotice(
+		"SSHChannelStats", noticeIsDiagnostic,
+		"ipAddress", ipAddress,
+		"channels", stats.Channels,
+		"windowStalls", stats.WindowStalls,
+		"windowStallMilliseconds", int64(stats.WindowStallDuration/time.Millisecond),
+		"maxInFlightBytes", stats.MaxInFlightBytes)
+}
+
+// NoticeMeekBufferPoolStats reports cumulative meek relay buffer pool
+// statistics. It's emitted when a relay mode meek connection closes.
+func NoticeMeekBufferPoolStats(stats MeekBufferPoolStats) {
+	singletonNoticeLogger.outputNotice(
+		"MeekBufferPoolStats", noticeIsDiagnostic,
+		"gets", stats.Gets,
+		"allocations", stats.Allocations,
+		"puts", stats.Puts,
+		"discards", stats.Discards)
+}
+
+// NoticeControllerState reports a controller state transition. Hosts should
+// use this notice, rather than inferring state from Tunnels notices, to
+// track the controller lifecycle.
+func NoticeControllerState(from, to string, activeTunnels int) {
+	singletonNoticeLogger.outputNotice(
+		"ControllerState", 0,
+		"from", from,
+		"to", to,
+		"activeTunnels", activeTunnels)
+}
+
+// NoticeHostConditions reports the host conditions most recently set by the
+// host application.
+func NoticeHostConditions(onBattery, isMeteredNetwork, isDozeMode bool) {
+	singletonNoticeLogger.outputNotice(
+		"HostConditions", noticeIsDiagnostic,
+		"onBattery", onBattery,
+		"isMeteredNetwork", isMeteredNetwork,
+		"isDozeMode", isDozeMode)
+}
+
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
 // errors for a given proxy type are suppressed.
 func NoticeLocalProxyError(proxyType string, err error) {
@@ -661,6 +1211,18 @@ func NoticeLocalProxyError(proxyType string, err error) {
 		"message", err.Error())
 }
 
+// NoticeDataStoreRecovered reports that the datastore file was found to be
+// corrupt and was replaced with a fresh datastore, into which
+// salvagedServerEntries readable server entries were copied. Other
+// datastore records, such as tactics and remote server list ETags, are not
+// salvaged.
+func NoticeDataStoreRecovered(corruptErr error, salvagedServerEntries int) {
+	singletonNoticeLogger.outputNotice(
+		"DataStoreRecovered", 0,
+		"error", corruptErr.Error(),
+		"salvagedServerEntries", salvagedServerEntries)
+}
+
 // NoticeBuildInfo reports build version info.
 func NoticeBuildInfo() {
 	singletonNoticeLogger.outputNotice(
@@ -699,6 +1261,53 @@ func NoticeSLOKSeeded(slokID string, duplicate bool) {
 		"duplicate", duplicate)
 }
 
+// NoticeOSLProgress reports progress towards unlocking OSLs: the number of
+// unlocked OSLs and, for each OSL with partial progress, the number of SLOKs
+// required and the number still remaining. OSLs with no progress, of which
+// there may be many, are omitted.
+func NoticeOSLProgress(progressList []*osl.OSLProgress) {
+
+	unlocked := 0
+	inProgress := make([]map[string]interface{}, 0)
+
+	for _, progress := range progressList {
+		if progress.SLOKsRemaining == 0 {
+			unlocked += 1
+		} else if progress.SLOKsRemaining < progress.SLOKsRequired {
+			inProgress = append(inProgress, map[string]interface{}{
+				"oslID":          hex.EncodeToString(progress.ID),
+				"sloksRequired":  progress.SLOKsRequired,
+				"sloksRemaining": progress.SLOKsRemaining,
+			})
+		}
+	}
+
+	singletonNoticeLogger.outputNotice(
+		"OSLProgress", 0,
+		"unlocked", unlocked,
+		"inProgress", inProgress)
+}
+
+// NoticeFirstFlightFingerprint reports the FirstFlightFingerprint of a
+// tunnel connection. Durations are reported in milliseconds.
+func NoticeFirstFlightFingerprint(
+	tunnelProtocol string, fingerprint FirstFlightFingerprint) {
+
+	writeOffsets := make([]int64, len(fingerprint.WriteOffsets))
+	for i, offset := range fingerprint.WriteOffsets {
+		writeOffsets[i] = int64(offset / time.Millisecond)
+	}
+
+	singletonNoticeLogger.outputNotice(
+		"FirstFlightFingerprint", 0,
+		"protocol", tunnelProtocol,
+		"writeLengths", fingerprint.WriteLengths,
+		"writeOffsets", writeOffsets,
+		"firstReadOffset", int64(fingerprint.FirstReadOffset/time.Millisecond),
+		"totalBytes", fingerprint.TotalBytes,
+		"entropy", fmt.Sprintf("%.3f", fingerprint.Entropy))
+}
+
 // NoticeServerTimestamp reports server side timestamp as seen in the handshake.
 func NoticeServerTimestamp(timestamp string) {
 	singletonNoticeLogger.outputNotice(
@@ -808,7 +1417,11 @@ func GetNotice(notice []byte) (
 	if err != nil {
 		return "", nil, err
 	}
-	return object.NoticeType, objectPayload.(map[string]interface{}), nil
+	mapPayload, ok := objectPayload.(map[string]interface{})
+	if !ok {
+		return "", nil, common.ContextError(errors.New("invalid notice data"))
+	}
+	return object.NoticeType, mapPayload, nil
 }
 
 // NoticeReceiver consumes a notice input stream and invokes a callback function
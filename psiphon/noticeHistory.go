@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	NOTICE_HISTORY_FILENAME = "psiphon.notices.history"
+)
+
+// noticeHistory is a bounded, on-disk record of recent notices. The history
+// is stored in two files, a current file and an older file, which together
+// act as a ring buffer: when the current file reaches half of the maximum
+// size, it replaces the older file and a new current file is started. The
+// history persists across process restarts.
+type noticeHistory struct {
+	filename      string
+	olderFilename string
+	file          *os.File
+	maxFileSize   int64
+	fileSize      int64
+}
+
+// HistoricalNotice is a notice retrieved from the notice history.
+type HistoricalNotice struct {
+	NoticeType string
+	Data       map[string]interface{}
+	Timestamp  time.Time
+}
+
+// SetNoticeHistoryFile enables recording of all emitted notices, including
+// diagnostic notices when enabled, to a bounded on-disk history, which may
+// be queried with QueryNoticeHistory. The combined size of the history
+// files, filename and <filename>.1, does not exceed maxSize bytes. Any
+// existing history in filename is retained. If maxSize is <= 0, a default
+// value is used.
+//
+// As the history may include diagnostic notices, filename should be in a
+// private location such as the data store directory.
+func SetNoticeHistoryFile(filename string, maxSize int) error {
+
+	if maxSize <= 0 {
+		maxSize = 2 << 20
+	}
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if singletonNoticeLogger.history != nil {
+		singletonNoticeLogger.history.file.Close()
+		singletonNoticeLogger.history = nil
+	}
+
+	file, err := os.OpenFile(
+		filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return common.ContextError(err)
+	}
+
+	history := &noticeHistory{
+		filename:      filename,
+		olderFilename: filename + ".1",
+		file:          file,
+		maxFileSize:   int64(maxSize / 2),
+		fileSize:      fileInfo.Size(),
+	}
+
+	// If the process previously crashed mid-write, terminate the partial
+	// last line so that it doesn't corrupt the next notice.
+
+	if history.fileSize > 0 {
+		lastByte := make([]byte, 1)
+		readFile, err := os.Open(filename)
+		if err == nil {
+			_, err = readFile.ReadAt(lastByte, history.fileSize-1)
+			readFile.Close()
+		}
+		if err != nil {
+			file.Close()
+			return common.ContextError(err)
+		}
+		if lastByte[0] != '\n' {
+			err = history.write([]byte("\n"))
+			if err != nil {
+				file.Close()
+				return common.ContextError(err)
+			}
+		}
+	}
+
+	singletonNoticeLogger.history = history
+
+	return nil
+}
+
+func (history *noticeHistory) write(output []byte) error {
+
+	if history.fileSize+int64(len(output)) > history.maxFileSize {
+
+		// As with rotating notice files, all errors are fatal in order to
+		// preserve the size limit.
+
+		err := history.file.Close()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		err = os.Rename(history.filename, history.olderFilename)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		history.file, err = os.OpenFile(
+			history.filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		history.fileSize = 0
+	}
+
+	// Each notice is written with a single write call so that, after a
+	// process crash, at most the last notice line is incomplete.
+
+	n, err := history.file.Write(output)
+	history.fileSize += int64(n)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// QueryNotices returns notices from the notice history, which is enabled
+// with Config.NoticeHistoryMaxSize. See QueryNoticeHistory.
+func (controller *Controller) QueryNotices(
+	since time.Time, noticeTypes ...string) ([]HistoricalNotice, error) {
+
+	return QueryNoticeHistory(since, noticeTypes...)
+}
+
+// QueryNoticeHistory returns notices recorded in the notice history with a
+// timestamp at or after since, in the order emitted. When noticeTypes are
+// specified, only notices of those types are returned. Malformed history
+// lines, such as a line truncated by a crash, are skipped.
+//
+// QueryNoticeHistory returns nil when no notice history is configured.
+func QueryNoticeHistory(since time.Time, noticeTypes ...string) ([]HistoricalNotice, error) {
+
+	// The notice logger mutex is held while reading to ensure the history
+	// files aren't rotated mid-read.
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	history := singletonNoticeLogger.history
+	if history == nil {
+		return nil, nil
+	}
+
+	var notices []HistoricalNotice
+
+	for _, filename := range []string{history.olderFilename, history.filename} {
+
+		file, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, common.ContextError(err)
+		}
+
+		reader := bufio.NewReader(file)
+
+		for {
+
+			line, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				file.Close()
+				return nil, common.ContextError(err)
+			}
+			if len(line) == 0 && err == io.EOF {
+				break
+			}
+
+			var notice struct {
+				NoticeType string                 `json:"noticeType"`
+				Data       map[string]interface{} `json:"data"`
+				Timestamp  string                 `json:"timestamp"`
+			}
+
+			if json.Unmarshal(line, &notice) != nil {
+				continue
+			}
+
+			if len(noticeTypes) > 0 && !common.Contains(noticeTypes, notice.NoticeType) {
+				continue
+			}
+
+			timestamp, err := time.Parse(common.RFC3339Milli, notice.Timestamp)
+			if err != nil || timestamp.Before(since) {
+				continue
+			}
+
+			notices = append(notices, HistoricalNotice{
+				NoticeType: notice.NoticeType,
+				Data:       notice.Data,
+				Timestamp:  timestamp,
+			})
+		}
+
+		file.Close()
+	}
+
+	return notices, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNoticeHistory(t *testing.T) {
+
+	testDirectory, err := ioutil.TempDir("", "psiphon-notice-history-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	filename := filepath.Join(testDirectory, NOTICE_HISTORY_FILENAME)
+	maxSize := 16384
+
+	err = SetNoticeHistoryFile(filename, maxSize)
+	if err != nil {
+		t.Fatalf("SetNoticeHistoryFile failed: %s", err)
+	}
+	defer func() {
+		singletonNoticeLogger.mutex.Lock()
+		singletonNoticeLogger.history.file.Close()
+		singletonNoticeLogger.history = nil
+		singletonNoticeLogger.mutex.Unlock()
+	}()
+
+	start := time.Now().Add(-1 * time.Second)
+
+	noticeCount := 1000
+	for i := 0; i < noticeCount; i++ {
+		NoticeUntunneled("example.com")
+		NoticeSessionId("0123456789abcdef0123456789abcdef")
+	}
+
+	// Simulate a restart, and a notice truncated by a crash.
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %s", err)
+	}
+	file.Write([]byte("{\"noticeType\":\"Untunn"))
+	file.Close()
+
+	err = SetNoticeHistoryFile(filename, maxSize)
+	if err != nil {
+		t.Fatalf("SetNoticeHistoryFile failed: %s", err)
+	}
+
+	NoticeSessionId("fedcba9876543210fedcba9876543210")
+
+	size := 0
+	for _, name := range []string{filename, filename + ".1"} {
+		fileInfo, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat failed: %s", err)
+		}
+		size += int(fileInfo.Size())
+	}
+	if size > maxSize {
+		t.Fatalf("unexpected history size: %d", size)
+	}
+
+	notices, err := QueryNoticeHistory(start, "SessionId")
+	if err != nil {
+		t.Fatalf("QueryNoticeHistory failed: %s", err)
+	}
+	if len(notices) == 0 || len(notices) >= noticeCount {
+		t.Fatalf("unexpected notice count: %d", len(notices))
+	}
+	for _, notice := range notices {
+		if notice.NoticeType != "SessionId" {
+			t.Fatalf("unexpected notice type: %s", notice.NoticeType)
+		}
+	}
+	if notices[len(notices)-1].Data["sessionId"] != "fedcba9876543210fedcba9876543210" {
+		t.Fatalf("unexpected last notice: %+v", notices[len(notices)-1])
+	}
+
+	notices, err = QueryNoticeHistory(time.Now().Add(1 * time.Hour))
+	if err != nil {
+		t.Fatalf("QueryNoticeHistory failed: %s", err)
+	}
+	if len(notices) != 0 {
+		t.Fatalf("unexpected notice count: %d", len(notices))
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Notice redaction policies. See SetNoticeRedactionPolicy.
+const (
+	NOTICE_REDACTION_POLICY_NONE     = "none"
+	NOTICE_REDACTION_POLICY_STANDARD = "standard"
+	NOTICE_REDACTION_POLICY_STRICT   = "strict"
+)
+
+// noticeRedactor applies a redaction policy to notice data.
+type noticeRedactor struct {
+	strict    bool
+	domainKey []byte
+}
+
+var (
+	redactURLRegex    = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://[^\s"'<>]+`)
+	redactIPv4Regex   = regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}\b`)
+	redactIPv6Regex   = regexp.MustCompile(`[0-9A-Fa-f:]*:[0-9A-Fa-f:]*:[0-9A-Fa-f:]*`)
+	redactDomainRegex = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b`)
+
+	// redactGeolocationFields are notice data fields with geolocation finer
+	// than a region, which are omitted when any redaction policy is applied.
+	redactGeolocationFields = map[string]bool{
+		"city":         true,
+		"isp":          true,
+		"asn":          true,
+		"organization": true,
+		"latitude":     true,
+		"longitude":    true,
+	}
+)
+
+// SetNoticeRedactionPolicy sets a redaction policy which is applied to the
+// data of all notices, including diagnostic notices, before the notices are
+// written to any output: the notice writer, notice files, the notice
+// history, notice subscribers, and the structured log. Redaction applies to
+// all string values, including free text messages. The policies are:
+//
+//   - NOTICE_REDACTION_POLICY_NONE, the default: notices are not redacted.
+//
+//   - NOTICE_REDACTION_POLICY_STANDARD: IPv4 addresses are truncated to /24,
+//     as in "192.0.2.x", and IPv6 addresses are truncated to /48, as in
+//     "2001:db8:1:x". Domain names are replaced with a keyed hash, as in
+//     "[domain:1a2b3c4d]". Geolocation is reduced to region only: fields
+//     such as "city" and "isp" are omitted.
+//
+//   - NOTICE_REDACTION_POLICY_STRICT: as with the standard policy, but IP
+//     addresses are entirely replaced with "[IP]", and URLs, including their
+//     paths and query parameters, are entirely replaced with a keyed hash,
+//     as in "[URL:1a2b3c4d]".
+//
+// The hash key is randomly generated for each process, so the same domain
+// or URL may be correlated across notices emitted by a single process run,
+// but not across runs or clients.
+//
+// Homepage notices are not redacted, as host apps must open the homepage
+// URLs. Redaction is best effort for free text: some non-identifying values,
+// such as dotted names, may be over-redacted.
+//
+// To ensure no notice is emitted without redaction, call
+// SetNoticeRedactionPolicy before any other operation, or set
+// Config.NoticeRedactionPolicy, which is applied by Config.Commit.
+func SetNoticeRedactionPolicy(policy string) error {
+
+	var redactor *noticeRedactor
+
+	switch policy {
+	case "", NOTICE_REDACTION_POLICY_NONE:
+	case NOTICE_REDACTION_POLICY_STANDARD, NOTICE_REDACTION_POLICY_STRICT:
+		domainKey := make([]byte, 32)
+		_, err := rand.Read(domainKey)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		redactor = &noticeRedactor{
+			strict:    policy == NOTICE_REDACTION_POLICY_STRICT,
+			domainKey: domainKey,
+		}
+	default:
+		return common.ContextError(fmt.Errorf("invalid notice redaction policy: %s", policy))
+	}
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	singletonNoticeLogger.redactor = redactor
+	enabled := int32(0)
+	if redactor != nil {
+		enabled = 1
+	}
+	atomic.StoreInt32(&singletonNoticeLogger.redactionEnabled, enabled)
+
+	return nil
+}
+
+// getRedactor returns the current redactor, or nil when redaction is not
+// enabled.
+func (nl *noticeLogger) getRedactor() *noticeRedactor {
+	if atomic.LoadInt32(&nl.redactionEnabled) != 1 {
+		return nil
+	}
+	nl.mutex.Lock()
+	defer nl.mutex.Unlock()
+	return nl.redactor
+}
+
+// redactData redacts notice data in place.
+func (redactor *noticeRedactor) redactData(noticeData map[string]interface{}) {
+	for name, value := range noticeData {
+		if redactGeolocationFields[strings.ToLower(name)] {
+			delete(noticeData, name)
+			continue
+		}
+		noticeData[name] = redactor.redactValue(value)
+	}
+}
+
+func (redactor *noticeRedactor) redactValue(value interface{}) interface{} {
+
+	switch v := value.(type) {
+
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+
+	case string:
+		return redactor.redactString(v)
+
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = redactor.redactString(s)
+		}
+		return redacted
+
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, element := range v {
+			redacted[i] = redactor.redactValue(element)
+		}
+		return redacted
+
+	case map[string]interface{}:
+		redacted := make(map[string]interface{})
+		for name, element := range v {
+			if redactGeolocationFields[strings.ToLower(name)] {
+				continue
+			}
+			redacted[name] = redactor.redactValue(element)
+		}
+		return redacted
+	}
+
+	// Other types, including structs, maps, and json.RawMessage, are
+	// converted to their generic JSON form so that all nested strings are
+	// redacted.
+
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return "[unredactable]"
+	}
+	var genericValue interface{}
+	err = json.Unmarshal(encodedValue, &genericValue)
+	if err != nil {
+		return "[unredactable]"
+	}
+	return redactor.redactValue(genericValue)
+}
+
+func (redactor *noticeRedactor) redactString(s string) string {
+
+	if redactor.strict {
+		s = redactURLRegex.ReplaceAllStringFunc(s, func(URL string) string {
+			return "[URL:" + redactor.hash(URL) + "]"
+		})
+	}
+
+	s = redactIPv4Regex.ReplaceAllStringFunc(s, func(match string) string {
+		IP := net.ParseIP(match)
+		if IP == nil {
+			return match
+		}
+		if redactor.strict {
+			return "[IP]"
+		}
+		IP = IP.To4()
+		return fmt.Sprintf("%d.%d.%d.x", IP[0], IP[1], IP[2])
+	})
+
+	s = redactIPv6Regex.ReplaceAllStringFunc(s, func(match string) string {
+		IP := net.ParseIP(match)
+		if IP == nil || IP.To4() != nil {
+			return match
+		}
+		if redactor.strict {
+			return "[IP]"
+		}
+		IP = IP.To16()
+		return fmt.Sprintf("%x:%x:%x:x",
+			uint16(IP[0])<<8|uint16(IP[1]),
+			uint16(IP[2])<<8|uint16(IP[3]),
+			uint16(IP[4])<<8|uint16(IP[5]))
+	})
+
+	s = redactDomainRegex.ReplaceAllStringFunc(s, func(domain string) string {
+		return "[domain:" + redactor.hash(strings.ToLower(domain)) + "]"
+	})
+
+	return s
+}
+
+func (redactor *noticeRedactor) hash(value string) string {
+	mac := hmac.New(sha256.New, redactor.domainKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNoticeRedaction(t *testing.T) {
+
+	err := SetNoticeRedactionPolicy("partial")
+	if err == nil {
+		t.Fatalf("unexpected SetNoticeRedactionPolicy success")
+	}
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	var noticeOutput bytes.Buffer
+	SetNoticeWriter(&noticeOutput)
+	defer SetNoticeWriter(os.Stderr)
+
+	defer SetNoticeRedactionPolicy(NOTICE_REDACTION_POLICY_NONE)
+
+	emit := func() map[string]interface{} {
+		noticeOutput.Reset()
+		singletonNoticeLogger.outputNotice(
+			"Test", noticeIsDiagnostic,
+			"message", "dial 192.0.2.17:443 via Example.com failed",
+			"url", "https://www.example.org/path?id=1",
+			"ipv6", "2001:db8:1:2::1",
+			"region", "CA",
+			"city", "Toronto",
+			"count", 3)
+		var notice struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err := json.Unmarshal(noticeOutput.Bytes(), &notice)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		return notice.Data
+	}
+
+	err = SetNoticeRedactionPolicy(NOTICE_REDACTION_POLICY_NONE)
+	if err != nil {
+		t.Fatalf("SetNoticeRedactionPolicy failed: %s", err)
+	}
+
+	data := emit()
+	if data["message"] != "dial 192.0.2.17:443 via Example.com failed" ||
+		data["city"] != "Toronto" {
+		t.Fatalf("unexpected unredacted data: %+v", data)
+	}
+
+	err = SetNoticeRedactionPolicy(NOTICE_REDACTION_POLICY_STANDARD)
+	if err != nil {
+		t.Fatalf("SetNoticeRedactionPolicy failed: %s", err)
+	}
+
+	data = emit()
+	message, _ := data["message"].(string)
+	if !strings.HasPrefix(message, "dial 192.0.2.x:443 via [domain:") ||
+		strings.Contains(message, "Example") {
+		t.Fatalf("unexpected standard message: %s", message)
+	}
+	URL, _ := data["url"].(string)
+	if !strings.HasPrefix(URL, "https://[domain:") ||
+		!strings.HasSuffix(URL, "]/path?id=1") {
+		t.Fatalf("unexpected standard url: %s", URL)
+	}
+	if data["ipv6"] != "2001:db8:1:x" {
+		t.Fatalf("unexpected standard ipv6: %v", data["ipv6"])
+	}
+	if data["region"] != "CA" || data["count"] != float64(3) {
+		t.Fatalf("unexpected standard data: %+v", data)
+	}
+	if _, ok := data["city"]; ok {
+		t.Fatalf("unexpected city: %+v", data)
+	}
+
+	// The same domain, in any case, redacts to the same hash within a run.
+
+	if !strings.Contains(message, redactDomainHash(t, "example.com")) {
+		t.Fatalf("unexpected domain hash: %s", message)
+	}
+
+	err = SetNoticeRedactionPolicy(NOTICE_REDACTION_POLICY_STRICT)
+	if err != nil {
+		t.Fatalf("SetNoticeRedactionPolicy failed: %s", err)
+	}
+
+	data = emit()
+	message, _ = data["message"].(string)
+	if !strings.HasPrefix(message, "dial [IP]:443 via [domain:") {
+		t.Fatalf("unexpected strict message: %s", message)
+	}
+	URL, _ = data["url"].(string)
+	if !strings.HasPrefix(URL, "[URL:") || strings.Contains(URL, "path") {
+		t.Fatalf("unexpected strict url: %s", URL)
+	}
+	if data["ipv6"] != "[IP]" {
+		t.Fatalf("unexpected strict ipv6: %v", data["ipv6"])
+	}
+
+	// Homepage notices are not redacted.
+
+	noticeOutput.Reset()
+	NoticeHomepages([]string{"https://www.example.org/"})
+	if !strings.Contains(noticeOutput.String(), "https://www.example.org/") {
+		t.Fatalf("unexpected homepage notice: %s", noticeOutput.String())
+	}
+}
+
+func redactDomainHash(t *testing.T, domain string) string {
+	redactor := singletonNoticeLogger.getRedactor()
+	if redactor == nil {
+		t.Fatalf("missing redactor")
+	}
+	return redactor.hash(domain)
+}
@@ -0,0 +1,61 @@
+// +build go1.18
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzGetNotice exercises notice parsing, which host applications run on
+// the notice stream. Run with:
+//
+//	go test -run xxx -fuzz FuzzGetNotice
+func FuzzGetNotice(f *testing.F) {
+
+	f.Add([]byte(`{"noticeType":"Tunnels","data":{"count":1},"timestamp":"2019-01-01T00:00:00.000Z"}`))
+	f.Add([]byte(`{"noticeType":"Info","data":{"message":"\u0000"},"timestamp":""}`))
+	f.Add([]byte(`{"noticeType":"Info","data":1}`))
+	f.Add([]byte(`{"noticeType":"Info","data":null}`))
+	f.Add([]byte(`{"noticeType":"Info"}`))
+	f.Add([]byte("\n\n{"))
+
+	f.Fuzz(func(t *testing.T, notice []byte) {
+
+		noticeType, payload, err := GetNotice(notice)
+		if err == nil && payload == nil {
+			t.Fatalf("unexpected nil payload for notice type %s", noticeType)
+		}
+
+		// Notice streams are split on newlines before parsing.
+		NewNoticeReceiver(func(notice []byte) {
+			GetNotice(notice)
+		}).Write(notice)
+
+		var output bytes.Buffer
+		rewriter := NewNoticeConsoleRewriter(&output)
+		rewriter.Write(append(notice, '\n'))
+		if !bytes.HasSuffix(output.Bytes(), []byte("\n")) {
+			t.Fatalf("unexpected rewriter output")
+		}
+	})
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetNoticeInvalidData(t *testing.T) {
+
+	for _, notice := range []string{
+		`{"noticeType":"Info","data":1}`,
+		`{"noticeType":"Info","data":null}`,
+		`{"noticeType":"Info","data":[]}`,
+	} {
+		_, _, err := GetNotice([]byte(notice))
+		if err == nil {
+			t.Fatalf("unexpected GetNotice success: %s", notice)
+		}
+	}
+
+	_, _, err := GetNotice([]byte(`{"noticeType":"Info","data":{}}`))
+	if err != nil {
+		t.Fatalf("GetNotice failed: %s", err)
+	}
+}
+
+func TestRotateNoticeFiles(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-rotate-notice-files-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	rotatingFilename := filepath.Join(testDataDirName, "notices")
+
+	err = SetNoticeFiles("", rotatingFilename, 0, 0)
+	if err != nil {
+		t.Fatalf("SetNoticeFiles failed: %s", err)
+	}
+	defer func() {
+		singletonNoticeLogger.mutex.Lock()
+		singletonNoticeLogger.rotatingFile.Close()
+		singletonNoticeLogger.rotatingFile = nil
+		singletonNoticeLogger.mutex.Unlock()
+	}()
+
+	NoticeUserLog("before rotation")
+
+	err = RotateNoticeFiles()
+	if err != nil {
+		t.Fatalf("RotateNoticeFiles failed: %s", err)
+	}
+
+	NoticeUserLog("after rotation")
+
+	olderNotices, err := ioutil.ReadFile(rotatingFilename + ".1")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Contains(olderNotices, []byte("before rotation")) ||
+		bytes.Contains(olderNotices, []byte("after rotation")) {
+		t.Fatalf("unexpected older notices: %s", olderNotices)
+	}
+
+	notices, err := ioutil.ReadFile(rotatingFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if bytes.Contains(notices, []byte("before rotation")) ||
+		!bytes.Contains(notices, []byte("after rotation")) {
+		t.Fatalf("unexpected notices: %s", notices)
+	}
+}
+
+func TestNoticeFileRotation(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-notice-file-rotation-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	rotatingFilename := filepath.Join(testDataDirName, "notices")
+
+	err = SetNoticeFiles("", rotatingFilename, 0, 0)
+	if err != nil {
+		t.Fatalf("SetNoticeFiles failed: %s", err)
+	}
+	SetNoticeFileRotation(2, 0, true)
+	defer func() {
+		SetNoticeFileRotation(1, 0, false)
+		singletonNoticeLogger.mutex.Lock()
+		singletonNoticeLogger.rotatingFile.Close()
+		singletonNoticeLogger.rotatingFile = nil
+		singletonNoticeLogger.mutex.Unlock()
+	}()
+
+	readCompressed := func(filename string) []byte {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("NewReader failed: %s", err)
+		}
+		notices, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+		return notices
+	}
+
+	for i := 0; i < 3; i++ {
+		NoticeUserLog(fmt.Sprintf("rotation %d", i))
+		err = RotateNoticeFiles()
+		if err != nil {
+			t.Fatalf("RotateNoticeFiles failed: %s", err)
+		}
+	}
+
+	// Only maxFiles older files are retained, most recent first.
+
+	if !bytes.Contains(readCompressed(rotatingFilename+".1.gz"), []byte("rotation 2")) ||
+		!bytes.Contains(readCompressed(rotatingFilename+".2.gz"), []byte("rotation 1")) {
+		t.Fatalf("unexpected older notices")
+	}
+
+	for _, filename := range []string{
+		rotatingFilename + ".1", rotatingFilename + ".3", rotatingFilename + ".3.gz"} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("unexpected file: %s", filename)
+		}
+	}
+
+	// Older files exceeding the max age are deleted at the next rotation.
+
+	oldTime := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(rotatingFilename+".1.gz", oldTime, oldTime)
+	if err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+
+	SetNoticeFileRotation(2, time.Hour, false)
+
+	NoticeUserLog("rotation 3")
+	err = RotateNoticeFiles()
+	if err != nil {
+		t.Fatalf("RotateNoticeFiles failed: %s", err)
+	}
+
+	notices, err := ioutil.ReadFile(rotatingFilename + ".1")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Contains(notices, []byte("rotation 3")) {
+		t.Fatalf("unexpected older notices: %s", notices)
+	}
+
+	if _, err := os.Stat(rotatingFilename + ".2.gz"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected expired file")
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+)
+
+const (
+	PACKET_TUNNEL_DEFAULT_IPV4_ADDRESS_CIDR = "10.0.0.1/30"
+	PACKET_TUNNEL_DEFAULT_IPV6_ADDRESS_CIDR = "fd19:ca83:e6d5:1c44:0000:0000:0000:0001/64"
+	PACKET_TUNNEL_DEFAULT_PRIMARY_DNS       = "8.8.8.8"
+	PACKET_TUNNEL_DEFAULT_SECONDARY_DNS     = "8.8.4.4"
+)
+
+// isPacketTunnel indicates whether the config specifies running a packet
+// tunnel, using either a host supplied tun device file descriptor or a named
+// tun device.
+func (config *Config) isPacketTunnel() bool {
+	return config.PacketTunnelTunFileDescriptor > 0 ||
+		config.PacketTunnelTunDeviceName != ""
+}
+
+// newPacketTunnelClient creates a tun.Client for the tun device specified in
+// the config. When PacketTunnelConfigureTunDevice is set, the tun device is
+// configured with addresses and routes.
+func newPacketTunnelClient(
+	config *Config, transport *PacketTunnelTransport) (*tun.Client, error) {
+
+	clientConfig := &tun.ClientConfig{
+		Logger:    NoticeCommonLogger(),
+		Transport: transport,
+		TrackFlows: config.PacketTunnelTrackFlows ||
+			len(config.PacketTunnelExcludedApplications) > 0,
+		ExcludedApplications: config.PacketTunnelExcludedApplications,
+	}
+
+	if config.FlowApplicationGetter != nil {
+		clientConfig.FlowApplicationLookup = makeFlowApplicationLookup(
+			config.FlowApplicationGetter)
+	}
+
+	if config.PacketTunnelTunFileDescriptor > 0 {
+
+		clientConfig.TunFileDescriptor = config.PacketTunnelTunFileDescriptor
+
+	} else if config.PacketTunnelConfigureTunDevice {
+
+		// tun.NewClient opens and configures the device.
+
+		IPv4AddressCIDR := config.PacketTunnelIPv4AddressCIDR
+		if IPv4AddressCIDR == "" {
+			IPv4AddressCIDR = PACKET_TUNNEL_DEFAULT_IPV4_ADDRESS_CIDR
+		}
+
+		IPv6AddressCIDR := config.PacketTunnelIPv6AddressCIDR
+		if IPv6AddressCIDR == "" {
+			IPv6AddressCIDR = PACKET_TUNNEL_DEFAULT_IPV6_ADDRESS_CIDR
+		}
+
+		clientConfig.DeviceName = config.PacketTunnelTunDeviceName
+		clientConfig.SudoNetworkConfigCommands = config.PacketTunnelSudoNetworkConfigCommands
+		clientConfig.AllowNoIPv6NetworkConfiguration = true
+		clientConfig.IPv4AddressCIDR = IPv4AddressCIDR
+		clientConfig.IPv6AddressCIDR = IPv6AddressCIDR
+		clientConfig.RouteDestinations = config.PacketTunnelRouteDestinations
+		clientConfig.RouteIPv4Destinations = true
+
+	} else {
+
+		// The device is expected to be configured by the host. Open the
+		// device and pass its file descriptor, which tun.NewClient dups.
+
+		file, _, err := tun.OpenTunDevice(config.PacketTunnelTunDeviceName)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		defer file.Close()
+
+		clientConfig.TunFileDescriptor = int(file.Fd())
+	}
+
+	client, err := tun.NewClient(clientConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if config.PacketTunnelTunDeviceName != "" {
+		NoticeInfo(
+			"packet tunnel device '%s': transparent DNS resolvers %s, %s",
+			config.PacketTunnelTunDeviceName,
+			tun.GetTransparentDNSResolverIPv4Address(),
+			tun.GetTransparentDNSResolverIPv6Address())
+	}
+
+	return client, nil
+}
+
+// packetTunnelBypass is the Linux/Darwin HostNetworkProvider, binding
+// untunneled sockets to a physical network interface so that they bypass
+// packet tunnel tun device routing.
+type packetTunnelBypass struct {
+	interfaceName string
+	DNSServers    []string
+	networkID     string
+}
+
+func newPacketTunnelBypass(
+	interfaceName string, DNSServers []string, networkID string) *packetTunnelBypass {
+
+	bypass := &packetTunnelBypass{
+		interfaceName: interfaceName,
+		DNSServers: []string{
+			PACKET_TUNNEL_DEFAULT_PRIMARY_DNS,
+			PACKET_TUNNEL_DEFAULT_SECONDARY_DNS,
+		},
+		networkID: networkID,
+	}
+
+	if len(DNSServers) > 0 {
+		bypass.DNSServers = []string{DNSServers[0], DNSServers[0]}
+	}
+	if len(DNSServers) > 1 {
+		bypass.DNSServers[1] = DNSServers[1]
+	}
+
+	return bypass
+}
+
+// GetActiveInterface implements the HostNetworkProvider interface.
+func (bypass *packetTunnelBypass) GetActiveInterface() string {
+	return bypass.interfaceName
+}
+
+// BindsSockets implements the HostNetworkProvider interface.
+func (bypass *packetTunnelBypass) BindsSockets() bool {
+	return true
+}
+
+// BindToNetwork implements the HostNetworkProvider interface.
+func (bypass *packetTunnelBypass) BindToNetwork(fileDescriptor int) (string, error) {
+	return bypass.interfaceName, tun.BindToDevice(fileDescriptor, bypass.interfaceName)
+}
+
+// GetDNSServers implements the HostNetworkProvider interface.
+func (bypass *packetTunnelBypass) GetDNSServers() []string {
+	return bypass.DNSServers
+}
+
+// GetNetworkID implements the HostNetworkProvider interface. The network ID
+// is the static Config.NetworkID, as the bypass interface is fixed.
+func (bypass *packetTunnelBypass) GetNetworkID() string {
+	return bypass.networkID
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+)
+
+// GetPacketTunnelFlowStats returns a snapshot of the active packet tunnel
+// flows, sorted by bytes transferred, descending. GetPacketTunnelFlowStats
+// returns nil when not running a packet tunnel or when
+// Config.PacketTunnelTrackFlows is not set.
+func (controller *Controller) GetPacketTunnelFlowStats() []tun.FlowStats {
+	if controller.packetTunnelClient == nil {
+		return nil
+	}
+	return controller.packetTunnelClient.GetFlowStats()
+}
+
+// GetPacketTunnelApplicationStats returns the total packet tunnel activity
+// of each application, over the lifetime of the packet tunnel, for use in
+// data usage displays. GetPacketTunnelApplicationStats returns nil when not
+// running a packet tunnel or when flow tracking is not enabled.
+func (controller *Controller) GetPacketTunnelApplicationStats() []tun.ApplicationStats {
+	if controller.packetTunnelClient == nil {
+		return nil
+	}
+	return controller.packetTunnelClient.GetApplicationStats()
+}
+
+// SetPacketTunnelExcludedApplications replaces the list of applications
+// whose packet tunnel traffic is dropped; see
+// Config.PacketTunnelExcludedApplications. The new list applies to existing
+// flows. SetPacketTunnelExcludedApplications has no effect unless flow
+// tracking was enabled, with PacketTunnelTrackFlows or
+// PacketTunnelExcludedApplications, and FlowApplicationGetter is set.
+func (controller *Controller) SetPacketTunnelExcludedApplications(applications []string) {
+	if controller.packetTunnelClient == nil {
+		return
+	}
+	controller.packetTunnelClient.SetExcludedApplications(applications)
+}
+
+// flowStatsReporter periodically emits a FlowStats notice listing the most
+// active packet tunnel flows.
+func (controller *Controller) flowStatsReporter() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("flowStatsReporter")
+
+	for {
+		p := controller.config.clientParameters.Get()
+		period := p.Duration(parameters.PacketTunnelFlowStatsPeriod)
+		maxFlows := p.Int(parameters.PacketTunnelFlowStatsMaxFlows)
+		p = nil
+
+		// When disabled, recheck periodically in case tactics enable
+		// FlowStats notices.
+		if period == 0 {
+			period = 1 * time.Minute
+			maxFlows = 0
+		}
+
+		timer := time.NewTimer(period)
+		select {
+		case <-timer.C:
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			return
+		}
+
+		if maxFlows == 0 {
+			continue
+		}
+
+		flowStats := controller.GetPacketTunnelFlowStats()
+		if len(flowStats) == 0 {
+			continue
+		}
+		if len(flowStats) > maxFlows {
+			flowStats = flowStats[:maxFlows]
+		}
+
+		flows := make([]map[string]interface{}, len(flowStats))
+		for i, flow := range flowStats {
+			flows[i] = map[string]interface{}{
+				"protocol":      flow.Protocol,
+				"localAddress":  net.JoinHostPort(flow.LocalIPAddress.String(), strconv.Itoa(flow.LocalPort)),
+				"remoteAddress": net.JoinHostPort(flow.RemoteIPAddress.String(), strconv.Itoa(flow.RemotePort)),
+				"application":   flow.Application,
+				"bytesUp":       flow.BytesUp,
+				"bytesDown":     flow.BytesDown,
+				"ageSeconds":    int64(flow.Age / time.Second),
+			}
+		}
+
+		NoticeFlowStats(flows)
+	}
+}
+
+// makeFlowApplicationLookup adapts a host FlowApplicationGetter to the
+// tun.FlowApplicationLookup callback.
+func makeFlowApplicationLookup(getter FlowApplicationGetter) tun.FlowApplicationLookup {
+	return func(
+		protocol string,
+		localIPAddress net.IP,
+		localPort int,
+		remoteIPAddress net.IP,
+		remotePort int) string {
+
+		return getter.GetFlowApplication(
+			protocol,
+			net.JoinHostPort(localIPAddress.String(), strconv.Itoa(localPort)),
+			net.JoinHostPort(remoteIPAddress.String(), strconv.Itoa(remotePort)))
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PORT_FORWARD_LIMIT_POLICY_QUEUE  = "queue"
+	PORT_FORWARD_LIMIT_POLICY_REJECT = "reject"
+)
+
+// portForwardLimiter enforces the MaxConcurrentPortForwards and
+// MaxConcurrentPortForwardsPerHost limits. A slot is held from the start
+// of the port forward dial until the port forward conn is closed.
+type portForwardLimiter struct {
+	maxTotal   int
+	maxPerHost int
+	policy     string
+
+	mutex   sync.Mutex
+	total   int
+	perHost map[string]int
+	changed chan struct{}
+}
+
+func newPortForwardLimiter(maxTotal, maxPerHost int, policy string) *portForwardLimiter {
+	return &portForwardLimiter{
+		maxTotal:   maxTotal,
+		maxPerHost: maxPerHost,
+		policy:     policy,
+		perHost:    make(map[string]int),
+		changed:    make(chan struct{}),
+	}
+}
+
+// isEnabled indicates if any limit is configured.
+func (limiter *portForwardLimiter) isEnabled() bool {
+	return limiter.maxTotal > 0 || limiter.maxPerHost > 0
+}
+
+// acquire obtains a port forward slot for host. When a limit is reached and
+// the policy is PORT_FORWARD_LIMIT_POLICY_QUEUE, acquire waits for up to
+// timeout for a slot to be released; otherwise, acquire fails immediately.
+// The returned release function must be called exactly once when the port
+// forward is closed or fails to dial.
+func (limiter *portForwardLimiter) acquire(
+	ctx context.Context, host string, timeout time.Duration) (func(), error) {
+
+	var timer *time.Timer
+	notified := false
+
+	for {
+		limiter.mutex.Lock()
+
+		limit := ""
+		if limiter.maxTotal > 0 && limiter.total >= limiter.maxTotal {
+			limit = "total"
+		} else if limiter.maxPerHost > 0 && limiter.perHost[host] >= limiter.maxPerHost {
+			limit = "host"
+		}
+
+		if limit == "" {
+			limiter.total += 1
+			limiter.perHost[host] += 1
+			limiter.mutex.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return func() { limiter.release(host) }, nil
+		}
+
+		changed := limiter.changed
+		limiter.mutex.Unlock()
+
+		if !notified {
+			NoticePortForwardLimit(host, limit, limiter.policy)
+			notified = true
+		}
+
+		if limiter.policy != PORT_FORWARD_LIMIT_POLICY_QUEUE || timeout <= 0 {
+			return nil, common.ContextError(
+				fmt.Errorf("port forward %s limit reached", limit))
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, common.ContextError(
+				fmt.Errorf("port forward %s limit queue timeout", limit))
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, common.ContextError(errors.New("port forward limit queue interrupted"))
+		}
+	}
+}
+
+func (limiter *portForwardLimiter) release(host string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.total -= 1
+	limiter.perHost[host] -= 1
+	if limiter.perHost[host] <= 0 {
+		delete(limiter.perHost, host)
+	}
+
+	// Wake all queued acquires, which each recheck the limits.
+	close(limiter.changed)
+	limiter.changed = make(chan struct{})
+}
+
+// limitedConn releases its port forward slot when closed.
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (conn *limitedConn) Close() error {
+	conn.releaseOnce.Do(conn.release)
+	return conn.Conn.Close()
+}
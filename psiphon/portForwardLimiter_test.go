@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPortForwardLimiter(t *testing.T) {
+
+	ctx := context.Background()
+
+	// Reject policy fails immediately when the per-host limit is reached, but
+	// other hosts are not affected.
+
+	limiter := newPortForwardLimiter(3, 2, PORT_FORWARD_LIMIT_POLICY_REJECT)
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(ctx, "a.example.org", time.Second)
+		if err != nil {
+			t.Fatalf("acquire failed: %s", err)
+		}
+		releases = append(releases, release)
+	}
+
+	_, err := limiter.acquire(ctx, "a.example.org", time.Second)
+	if err == nil {
+		t.Fatalf("unexpected acquire success")
+	}
+
+	release, err := limiter.acquire(ctx, "b.example.org", time.Second)
+	if err != nil {
+		t.Fatalf("acquire failed: %s", err)
+	}
+	releases = append(releases, release)
+
+	// The total limit applies across hosts.
+
+	_, err = limiter.acquire(ctx, "c.example.org", time.Second)
+	if err == nil {
+		t.Fatalf("unexpected acquire success")
+	}
+
+	for _, release := range releases {
+		release()
+	}
+
+	if limiter.total != 0 || len(limiter.perHost) != 0 {
+		t.Fatalf("unexpected limiter state: %d %v", limiter.total, limiter.perHost)
+	}
+
+	// Queue policy waits for a slot to be released.
+
+	limiter = newPortForwardLimiter(1, 0, PORT_FORWARD_LIMIT_POLICY_QUEUE)
+
+	release, err = limiter.acquire(ctx, "a.example.org", time.Second)
+	if err != nil {
+		t.Fatalf("acquire failed: %s", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, release)
+
+	startTime := time.Now()
+	release, err = limiter.acquire(ctx, "b.example.org", 5*time.Second)
+	if err != nil {
+		t.Fatalf("acquire failed: %s", err)
+	}
+	if time.Since(startTime) < 50*time.Millisecond {
+		t.Fatalf("unexpected acquire duration: %s", time.Since(startTime))
+	}
+
+	// Queued acquires time out.
+
+	_, err = limiter.acquire(ctx, "c.example.org", 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("unexpected acquire success")
+	}
+
+	// Queued acquires are interrupted by the context.
+
+	cancelCtx, cancelFunc := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancelFunc)
+	_, err = limiter.acquire(cancelCtx, "c.example.org", 5*time.Second)
+	if err == nil {
+		t.Fatalf("unexpected acquire success")
+	}
+
+	release()
+}
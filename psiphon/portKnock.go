@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// knockIfRequired sends an authenticated knock to servers which hide behind
+// a default-drop firewall, which opens for the client's address only after
+// receiving a valid knock payload on the server entry KnockPort. Knocks are
+// not sent for fronted, tapdance, and in-proxy protocols, which don't dial
+// the server directly.
+//
+// Following the knock, knockIfRequired waits for KnockDelay to allow the
+// server firewall to open before the main dial.
+func knockIfRequired(
+	ctx context.Context,
+	config *Config,
+	dialConfig *DialConfig,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string) error {
+
+	if !serverEntry.RequiresKnock() ||
+		protocol.TunnelProtocolIsFronted(tunnelProtocol) ||
+		protocol.TunnelProtocolUsesTapdance(tunnelProtocol) ||
+		protocol.TunnelProtocolUsesInproxy(tunnelProtocol) {
+		return nil
+	}
+
+	err := serverEntry.ValidateKnock()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	payload, err := protocol.MakeKnockPayload(serverEntry.KnockKey, time.Now())
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	knockAddress := net.JoinHostPort(
+		serverEntry.IpAddress, strconv.Itoa(serverEntry.KnockPort))
+
+	switch serverEntry.KnockProtocol {
+
+	case protocol.KNOCK_PROTOCOL_UDP:
+
+		packetConn, remoteAddr, err := NewUDPConn(ctx, knockAddress, dialConfig)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		_, err = packetConn.WriteTo(payload, remoteAddr)
+		packetConn.Close()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+	case protocol.KNOCK_PROTOCOL_TCP:
+
+		conn, err := DialTCP(ctx, knockAddress, dialConfig)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		_, err = conn.Write(payload)
+		conn.Close()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+	default:
+		return common.ContextError(
+			fmt.Errorf("unexpected knock protocol: %s", serverEntry.KnockProtocol))
+	}
+
+	delay := config.clientParameters.Get().Duration(parameters.KnockDelay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return common.ContextError(ctx.Err())
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestKnockIfRequired(t *testing.T) {
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	key, err := common.MakeSecureRandomBytes(protocol.KNOCK_KEY_SIZE)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+	knockKey := base64.StdEncoding.EncodeToString(key)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer packetConn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	payloads := make(chan []byte, 2)
+
+	go func() {
+		buffer := make([]byte, 1024)
+		n, _, err := packetConn.ReadFrom(buffer)
+		if err == nil {
+			payloads <- buffer[:n]
+		}
+	}()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		payload, err := ioutil.ReadAll(conn)
+		if err == nil {
+			payloads <- payload
+		}
+	}()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	serverEntry := &protocol.ServerEntry{
+		IpAddress: "127.0.0.1",
+		KnockKey:  knockKey,
+	}
+
+	for _, knockProtocol := range []string{
+		protocol.KNOCK_PROTOCOL_UDP, protocol.KNOCK_PROTOCOL_TCP} {
+
+		serverEntry.KnockProtocol = knockProtocol
+		if knockProtocol == protocol.KNOCK_PROTOCOL_UDP {
+			serverEntry.KnockPort = packetConn.LocalAddr().(*net.UDPAddr).Port
+		} else {
+			serverEntry.KnockPort = listener.Addr().(*net.TCPAddr).Port
+		}
+
+		err = knockIfRequired(
+			ctx, clientConfig, &DialConfig{}, serverEntry,
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+		if err != nil {
+			t.Fatalf("knockIfRequired failed: %s", err)
+		}
+
+		select {
+		case payload := <-payloads:
+			_, err = protocol.VerifyKnockPayload(knockKey, payload, time.Now())
+			if err != nil {
+				t.Fatalf("VerifyKnockPayload failed: %s", err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("knock not received")
+		}
+
+		// No knock is sent for fronted protocols.
+		err = knockIfRequired(
+			ctx, clientConfig, &DialConfig{}, serverEntry,
+			protocol.TUNNEL_PROTOCOL_FRONTED_MEEK)
+		if err != nil {
+			t.Fatalf("knockIfRequired failed: %s", err)
+		}
+	}
+
+	select {
+	case <-payloads:
+		t.Fatalf("unexpected knock")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
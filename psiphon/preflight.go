@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	// PREFLIGHT_IPV6_ROUTE_CHECK_ADDRESS is a global IPv6 address used to
+	// check for an IPv6 route. No packets are sent to this address.
+	PREFLIGHT_IPV6_ROUTE_CHECK_ADDRESS = "[2001:4860:4860::8888]:53"
+)
+
+// PreflightCheckResult is the result of PreflightCheck.
+//
+// DNSResolved indicates that the hostnames of the captive portal probe URLs
+// were resolved, using the untunneled resolver. DNSPoisoning describes why
+// an answer appears to be poisoned, as in DNS answer validation.
+//
+// ClockSkew is the local clock time minus the server time reported by a
+// captive portal probe response, and is valid only when ClockSkewMeasured is
+// set. As server times have a resolution of one second, small skews are not
+// significant.
+//
+// IPv6Available indicates that the host has a global IPv6 address and route.
+//
+// CaptivePortalDetected indicates that at least one captive portal probe
+// was intercepted. CaptivePortalURL is the portal page URL, when known.
+//
+// UpstreamProxyReachable indicates that a TCP connection to the configured
+// upstream proxy succeeded. It's not set when no upstream proxy is
+// configured.
+//
+// Error fields are set when a check is inconclusive.
+type PreflightCheckResult struct {
+	Duration                time.Duration
+	DNSResolved             bool
+	DNSPoisoning            string
+	DNSError                string
+	ClockSkew               time.Duration
+	ClockSkewMeasured       bool
+	IPv6Available           bool
+	CaptivePortalDetected   bool
+	CaptivePortalURL        string
+	CaptivePortalError      string
+	UpstreamProxyConfigured bool
+	UpstreamProxyReachable  bool
+	UpstreamProxyError      string
+}
+
+// PreflightCheck quickly evaluates the host network environment before
+// starting a controller, for diagnostics and for presenting actionable
+// conditions to users, such as a captive portal or a skewed clock. The
+// checks are performed concurrently and are bounded by the
+// PreflightCheckTimeout parameter. All checks are made untunneled and use the
+// host network configuration in config, which must be committed.
+//
+// The checks do not start a controller and do not use the data store.
+func PreflightCheck(ctx context.Context, config *Config) (*PreflightCheckResult, error) {
+
+	if !config.IsCommitted() {
+		return nil, common.ContextError(errors.New("config not committed"))
+	}
+
+	p := config.clientParameters.Get()
+	timeout := p.Duration(parameters.PreflightCheckTimeout)
+	probeURLs := p.Strings(parameters.CaptivePortalProbeURLs)
+	blockIPs := p.Strings(parameters.DNSPoisoningBlockIPs)
+	p = nil
+
+	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	untunneledDialConfig := &DialConfig{
+		UpstreamProxyURL:              config.UpstreamProxyURL,
+		UpstreamProxyChainURLs:        config.UpstreamProxyChainURLs,
+		CustomHeaders:                 config.CustomHeaders,
+		DeviceBinder:                  config.deviceBinder,
+		DnsServerGetter:               config.dnsServerGetter,
+		IPv6Synthesizer:               config.IPv6Synthesizer,
+		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		ClientParameters:              config.clientParameters,
+		NetworkEmulator:               config.NetworkEmulator,
+	}
+
+	result := &PreflightCheckResult{}
+
+	startTime := time.Now()
+
+	// Each check sets only its own result fields.
+
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		preflightCheckDNS(ctx, untunneledDialConfig, probeURLs, blockIPs, result)
+	}()
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		preflightCheckIPv6(ctx, untunneledDialConfig, result)
+	}()
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		preflightCheckCaptivePortal(ctx, config, untunneledDialConfig, probeURLs, result)
+	}()
+
+	if config.UpstreamProxyURL != "" {
+		result.UpstreamProxyConfigured = true
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			preflightCheckUpstreamProxy(ctx, untunneledDialConfig, result)
+		}()
+	}
+
+	waitGroup.Wait()
+
+	result.Duration = time.Since(startTime)
+
+	return result, nil
+}
+
+func preflightCheckDNS(
+	ctx context.Context,
+	untunneledDialConfig *DialConfig,
+	probeURLs []string,
+	blockIPs []string,
+	result *PreflightCheckResult) {
+
+	var hostnames []string
+	for _, probeURL := range probeURLs {
+		parsedURL, err := url.Parse(probeURL)
+		if err != nil || net.ParseIP(parsedURL.Hostname()) != nil {
+			continue
+		}
+		if !common.Contains(hostnames, parsedURL.Hostname()) {
+			hostnames = append(hostnames, parsedURL.Hostname())
+		}
+	}
+
+	if len(hostnames) == 0 {
+		result.DNSError = "no hostnames to resolve"
+		return
+	}
+
+	var errs []string
+
+	for _, hostname := range hostnames {
+
+		// The plaintext lookup is used, rather than LookupIP, so that the
+		// host resolver is checked even when encrypted resolvers are
+		// configured.
+
+		IPs, TTLs, err := plaintextLookupIP(ctx, hostname, untunneledDialConfig)
+		if err == nil && len(IPs) == 0 {
+			err = errors.New("empty address list")
+		}
+		if err != nil {
+			errs = append(errs, common.ContextError(err).Error())
+			continue
+		}
+
+		result.DNSResolved = true
+
+		poisoning := validateDNSAnswer(IPs, TTLs, blockIPs)
+		if poisoning != "" && result.DNSPoisoning == "" {
+			result.DNSPoisoning = poisoning
+		}
+	}
+
+	if !result.DNSResolved {
+		result.DNSError = strings.Join(errs, "; ")
+	}
+}
+
+func preflightCheckIPv6(
+	ctx context.Context,
+	untunneledDialConfig *DialConfig,
+	result *PreflightCheckResult) {
+
+	// Connecting a UDP socket selects a route and local address without
+	// sending any packets. As with tunnel dials, the socket is bound using
+	// any DeviceBinder, so the route is selected for the bound interface.
+
+	conn, err := dialUDP(
+		ctx, "udp6", PREFLIGHT_IPV6_ROUTE_CHECK_ADDRESS, untunneledDialConfig)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	result.IPv6Available =
+		localAddr.IP.To4() == nil && localAddr.IP.IsGlobalUnicast()
+}
+
+func preflightCheckCaptivePortal(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	probeURLs []string,
+	result *PreflightCheckResult) {
+
+	if len(probeURLs) == 0 {
+		result.CaptivePortalError = "no probe URLs"
+		return
+	}
+
+	httpClient, err := makeCaptivePortalProbeClient(ctx, config, untunneledDialConfig)
+	if err != nil {
+		result.CaptivePortalError = common.ContextError(err).Error()
+		return
+	}
+
+	// Probes use a generic User-Agent, as the probes are plaintext.
+	userAgent := pickUserAgent()
+
+	var errs []string
+	conclusive := false
+
+	for _, probeURL := range probeURLs {
+
+		probeResult := probeCaptivePortal(ctx, httpClient, probeURL, userAgent)
+
+		if probeResult.err != nil {
+			errs = append(errs, probeResult.err.Error())
+			continue
+		}
+
+		conclusive = true
+
+		// Clock skew is measured only from genuine probe responses, as
+		// portal and error responses may be served by middleboxes.
+
+		if !probeResult.isCaptivePortal &&
+			!probeResult.date.IsZero() &&
+			!result.ClockSkewMeasured {
+
+			result.ClockSkew = time.Since(probeResult.date)
+			result.ClockSkewMeasured = true
+		}
+
+		if probeResult.isCaptivePortal {
+			result.CaptivePortalDetected = true
+			result.CaptivePortalURL = probeResult.portalURL
+			break
+		}
+	}
+
+	if !conclusive {
+		result.CaptivePortalError = strings.Join(errs, "; ")
+	}
+}
+
+func preflightCheckUpstreamProxy(
+	ctx context.Context,
+	untunneledDialConfig *DialConfig,
+	result *PreflightCheckResult) {
+
+	proxyURL, err := url.Parse(untunneledDialConfig.UpstreamProxyURL)
+	if err != nil {
+		result.UpstreamProxyError = common.ContextError(err).Error()
+		return
+	}
+
+	if proxyURL.Port() == "" {
+		result.UpstreamProxyError = "missing upstream proxy port"
+		return
+	}
+
+	// Dial the upstream proxy itself, with the same host network
+	// configuration, but not through the upstream proxy.
+
+	proxyDialConfig := *untunneledDialConfig
+	proxyDialConfig.UpstreamProxyURL = ""
+	proxyDialConfig.UpstreamProxyChainURLs = nil
+
+	conn, err := DialTCP(ctx, proxyURL.Host, &proxyDialConfig)
+	if err != nil {
+		result.UpstreamProxyError = common.ContextError(err).Error()
+		return
+	}
+	conn.Close()
+
+	result.UpstreamProxyReachable = true
+}
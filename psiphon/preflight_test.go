@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestPreflightCheck(t *testing.T) {
+
+	serverDate := time.Now().Add(-1 * time.Hour)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			switch request.URL.Path {
+			case "/generate_204":
+				responseWriter.Header().Set("Date", serverDate.UTC().Format(http.TimeFormat))
+				responseWriter.WriteHeader(http.StatusNoContent)
+			case "/redirect":
+				http.Redirect(responseWriter, request, "http://portal.example/login", http.StatusFound)
+			case "/page":
+				responseWriter.Write([]byte("login"))
+			default:
+				http.Error(responseWriter, "", http.StatusInternalServerError)
+			}
+		}))
+	defer server.Close()
+
+	// Get an address with no listener, for an unreachable upstream proxy.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	unreachableAddress := listener.Addr().String()
+	listener.Close()
+
+	check := func(probePaths []string, upstreamProxyURL string) *PreflightCheckResult {
+
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			t.Fatalf("NewClientParameters failed: %s", err)
+		}
+
+		var probeURLs []string
+		for _, path := range probePaths {
+			probeURLs = append(probeURLs, server.URL+path)
+		}
+
+		_, err = clientParameters.Set("", false, map[string]interface{}{
+			parameters.CaptivePortalProbeURLs: probeURLs,
+		})
+		if err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+
+		config := &Config{
+			UpstreamProxyURL: upstreamProxyURL,
+			clientParameters: clientParameters,
+			committed:        true,
+		}
+
+		result, err := PreflightCheck(context.Background(), config)
+		if err != nil {
+			t.Fatalf("PreflightCheck failed: %s", err)
+		}
+		return result
+	}
+
+	result := check([]string{"/error", "/generate_204"}, "")
+	if result.CaptivePortalDetected ||
+		result.CaptivePortalError != "" ||
+		!result.ClockSkewMeasured ||
+		result.ClockSkew < 59*time.Minute ||
+		result.ClockSkew > 61*time.Minute ||
+		result.UpstreamProxyConfigured {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// The probe URLs use an IP address, so there are no hostnames to resolve.
+	if result.DNSResolved || result.DNSError == "" {
+		t.Fatalf("unexpected DNS result: %+v", result)
+	}
+
+	result = check([]string{"/redirect"}, "")
+	if !result.CaptivePortalDetected ||
+		result.CaptivePortalURL != "http://portal.example/login" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	result = check([]string{"/page"}, "")
+	if !result.CaptivePortalDetected ||
+		result.CaptivePortalURL != server.URL+"/page" ||
+		result.ClockSkewMeasured {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	result = check([]string{"/error"}, "http://"+unreachableAddress)
+	if result.CaptivePortalDetected ||
+		result.CaptivePortalError == "" ||
+		!result.UpstreamProxyConfigured ||
+		result.UpstreamProxyReachable ||
+		result.UpstreamProxyError == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	_, err = PreflightCheck(context.Background(), &Config{})
+	if err == nil {
+		t.Fatalf("unexpected success with uncommitted config")
+	}
+}
+
+type testDeviceBinder struct {
+	bindCount int
+	bindErr   error
+}
+
+func (binder *testDeviceBinder) BindToDevice(_ int) (string, error) {
+	binder.bindCount += 1
+	return "", binder.bindErr
+}
+
+func TestPreflightCheckIPv6DeviceBinder(t *testing.T) {
+
+	result := &PreflightCheckResult{}
+	preflightCheckIPv6(context.Background(), &DialConfig{}, result)
+	if !result.IPv6Available {
+		t.Skip("IPv6 not available")
+	}
+
+	// Test: the IPv6 route check uses the DeviceBinder
+
+	binder := &testDeviceBinder{}
+
+	result = &PreflightCheckResult{}
+	preflightCheckIPv6(
+		context.Background(), &DialConfig{DeviceBinder: binder}, result)
+
+	if binder.bindCount != 1 || !result.IPv6Available {
+		t.Fatalf("unexpected result: %d, %+v", binder.bindCount, result)
+	}
+
+	// Test: IPv6 isn't available when binding fails
+
+	binder = &testDeviceBinder{bindErr: errors.New("bind failed")}
+
+	result = &PreflightCheckResult{}
+	preflightCheckIPv6(
+		context.Background(), &DialConfig{DeviceBinder: binder}, result)
+
+	if binder.bindCount != 1 || result.IPv6Available {
+		t.Fatalf("unexpected result: %d, %+v", binder.bindCount, result)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PROTOCOL_STATS_EWMA_WEIGHT          = 0.2
+	PROTOCOL_STATS_INITIAL_SUCCESS_RATE = 0.5
+	PROTOCOL_SCORE_MIN_WEIGHT           = 0.01
+)
+
+// protocolStats records the performance of a tunnel protocol on a network.
+// SuccessRate, DialLatency, and Throughput are exponentially weighted moving
+// averages, so that scores adapt as network conditions change. DialLatency
+// is the average of successful dials only, and Throughput is the average
+// tunneled bytes per second of traffic activity, recorded when tunnels
+// close.
+type protocolStats struct {
+	Attempts    int
+	SuccessRate float64
+	DialLatency time.Duration
+	Throughput  float64
+}
+
+// protocolStatsMutex serializes protocol stats record updates, which read,
+// modify, and write the per-network record from concurrent establishment
+// workers.
+var protocolStatsMutex sync.Mutex
+
+func getProtocolStats(networkID string) (map[string]*protocolStats, error) {
+	stats := make(map[string]*protocolStats)
+	record, err := GetProtocolStatsRecord(networkID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if record != nil {
+		err = json.Unmarshal(record, &stats)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+	return stats, nil
+}
+
+func updateProtocolStats(
+	networkID, tunnelProtocol string, update func(stats *protocolStats)) error {
+
+	protocolStatsMutex.Lock()
+	defer protocolStatsMutex.Unlock()
+
+	stats, err := getProtocolStats(networkID)
+	if err != nil {
+		// Start over when the record is corrupt.
+		NoticeAlert("invalid protocol stats record: %s", err)
+		stats = make(map[string]*protocolStats)
+	}
+
+	entry, ok := stats[tunnelProtocol]
+	if !ok {
+		entry = &protocolStats{SuccessRate: PROTOCOL_STATS_INITIAL_SUCCESS_RATE}
+		stats[tunnelProtocol] = entry
+	}
+
+	update(entry)
+
+	record, err := json.Marshal(stats)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = SetProtocolStatsRecord(networkID, record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func ewma(average, sample float64) float64 {
+	return (1-PROTOCOL_STATS_EWMA_WEIGHT)*average + PROTOCOL_STATS_EWMA_WEIGHT*sample
+}
+
+// recordProtocolDial records the outcome of a tunnel connection attempt.
+func recordProtocolDial(
+	networkID, tunnelProtocol string, dialLatency time.Duration, success bool) {
+
+	err := updateProtocolStats(networkID, tunnelProtocol, func(stats *protocolStats) {
+		stats.Attempts += 1
+		sample := 0.0
+		if success {
+			sample = 1.0
+			if stats.DialLatency == 0 {
+				stats.DialLatency = dialLatency
+			} else {
+				stats.DialLatency = time.Duration(
+					ewma(float64(stats.DialLatency), float64(dialLatency)))
+			}
+		}
+		stats.SuccessRate = ewma(stats.SuccessRate, sample)
+	})
+	if err != nil {
+		NoticeAlert("failed to record protocol dial: %s", err)
+	}
+}
+
+// recordProtocolThroughput records the throughput of a closed tunnel.
+func recordProtocolThroughput(
+	networkID, tunnelProtocol string, bytesPerSecond float64) {
+
+	err := updateProtocolStats(networkID, tunnelProtocol, func(stats *protocolStats) {
+		if stats.Throughput == 0 {
+			stats.Throughput = bytesPerSecond
+		} else {
+			stats.Throughput = ewma(stats.Throughput, bytesPerSecond)
+		}
+	})
+	if err != nil {
+		NoticeAlert("failed to record protocol throughput: %s", err)
+	}
+}
+
+// selectAdaptiveProtocol selects a tunnel protocol from candidateProtocols
+// at random, weighted by protocol score. With probability exploration, the
+// protocol is instead selected uniformly at random, so that the stats for
+// low scoring protocols continue to be updated.
+//
+// A protocol's score is the product of its success rate, a latency factor,
+// and a throughput factor. Protocols not yet tried on the network start with
+// a success rate of PROTOCOL_STATS_INITIAL_SUCCESS_RATE. The latency factor
+// is 1/(1+dial latency in seconds). The throughput factor ranges from 0.5 to
+// 1.0, relative to the highest throughput candidate protocol, and is 1.0
+// when throughput isn't known.
+//
+// Scores have a floor of PROTOCOL_SCORE_MIN_WEIGHT, so that no candidate
+// protocol is excluded entirely.
+func selectAdaptiveProtocol(
+	stats map[string]*protocolStats,
+	candidateProtocols []string,
+	exploration float64) string {
+
+	if rand.Float64() < exploration {
+		return candidateProtocols[rand.Intn(len(candidateProtocols))]
+	}
+
+	maxThroughput := 0.0
+	for _, tunnelProtocol := range candidateProtocols {
+		entry, ok := stats[tunnelProtocol]
+		if ok && entry.Throughput > maxThroughput {
+			maxThroughput = entry.Throughput
+		}
+	}
+
+	weights := make([]float64, len(candidateProtocols))
+	totalWeight := 0.0
+
+	for i, tunnelProtocol := range candidateProtocols {
+
+		weight := PROTOCOL_STATS_INITIAL_SUCCESS_RATE
+
+		entry, ok := stats[tunnelProtocol]
+		if ok {
+			weight = entry.SuccessRate
+			weight *= 1.0 / (1.0 + entry.DialLatency.Seconds())
+			if entry.Throughput > 0 && maxThroughput > 0 {
+				weight *= 0.5 + 0.5*(entry.Throughput/maxThroughput)
+			}
+		}
+
+		if weight < PROTOCOL_SCORE_MIN_WEIGHT {
+			weight = PROTOCOL_SCORE_MIN_WEIGHT
+		}
+
+		weights[i] = weight
+		totalWeight += weight
+	}
+
+	selection := rand.Float64() * totalWeight
+	for i, weight := range weights {
+		selection -= weight
+		if selection < 0 {
+			return candidateProtocols[i]
+		}
+	}
+
+	return candidateProtocols[len(candidateProtocols)-1]
+}
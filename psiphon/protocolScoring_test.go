@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProtocolScoring(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-protocol-scoring-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	err = OpenDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	networkID := "WIFI-TEST"
+
+	for i := 0; i < 20; i++ {
+		recordProtocolDial(networkID, "OSSH", 500*time.Millisecond, true)
+		recordProtocolDial(networkID, "SSH", 0, false)
+		recordProtocolDial(networkID, "UNFRONTED-MEEK-OSSH", 5*time.Second, true)
+	}
+	recordProtocolThroughput(networkID, "OSSH", 100000)
+	recordProtocolThroughput(networkID, "UNFRONTED-MEEK-OSSH", 10000)
+
+	stats, err := getProtocolStats(networkID)
+	if err != nil {
+		t.Fatalf("getProtocolStats failed: %s", err)
+	}
+
+	if stats["OSSH"].Attempts != 20 ||
+		stats["OSSH"].SuccessRate < 0.9 ||
+		stats["OSSH"].DialLatency != 500*time.Millisecond ||
+		stats["OSSH"].Throughput != 100000 {
+		t.Fatalf("unexpected OSSH stats: %+v", stats["OSSH"])
+	}
+
+	if stats["SSH"].SuccessRate > 0.1 || stats["SSH"].DialLatency != 0 {
+		t.Fatalf("unexpected SSH stats: %+v", stats["SSH"])
+	}
+
+	otherStats, err := getProtocolStats("OTHER-NETWORK")
+	if err != nil {
+		t.Fatalf("getProtocolStats failed: %s", err)
+	}
+	if len(otherStats) != 0 {
+		t.Fatalf("unexpected other network stats: %+v", otherStats)
+	}
+
+	candidateProtocols := []string{"OSSH", "SSH", "UNFRONTED-MEEK-OSSH", "QUIC-OSSH"}
+
+	selectCounts := func(exploration float64) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			counts[selectAdaptiveProtocol(stats, candidateProtocols, exploration)] += 1
+		}
+		return counts
+	}
+
+	// OSSH has the highest score, followed by the untried QUIC-OSSH, the
+	// slow and low throughput UNFRONTED-MEEK-OSSH, and the failing SSH.
+
+	counts := selectCounts(0.0)
+	if !(counts["OSSH"] > counts["QUIC-OSSH"] &&
+		counts["QUIC-OSSH"] > counts["UNFRONTED-MEEK-OSSH"] &&
+		counts["UNFRONTED-MEEK-OSSH"] > counts["SSH"]) {
+		t.Fatalf("unexpected selection counts: %+v", counts)
+	}
+
+	// With full exploration, selection is uniform.
+
+	counts = selectCounts(1.0)
+	for _, tunnelProtocol := range candidateProtocols {
+		if counts[tunnelProtocol] < 2000 || counts[tunnelProtocol] > 3000 {
+			t.Fatalf("unexpected exploration selection counts: %+v", counts)
+		}
+	}
+}
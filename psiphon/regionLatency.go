@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// RegionLatencies returns the most recent median round trip times to sampled
+// servers in each region, as measured by the region latency prober. The
+// result is empty when probing is disabled, via RegionLatencyProbePeriod, or
+// has not yet completed.
+func (controller *Controller) RegionLatencies() map[string]time.Duration {
+	controller.regionLatenciesMutex.Lock()
+	defer controller.regionLatenciesMutex.Unlock()
+
+	latencies := make(map[string]time.Duration)
+	for region, latency := range controller.regionLatencies {
+		latencies[region] = latency
+	}
+	return latencies
+}
+
+// regionLatencyProber periodically measures the round trip time to a sample
+// of servers in each region. Probes are TCP port forwards through an active
+// tunnel, so each measurement includes the active tunnel round trip time;
+// the relative values are what's useful for selecting a region. Probing is
+// triggered when a tunnel is established and then every
+// RegionLatencyProbePeriod.
+func (controller *Controller) regionLatencyProber() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("regionLatencyProber")
+
+	var timer *time.Timer
+	var timerChannel <-chan time.Time
+
+loop:
+	for {
+		select {
+		case <-controller.signalProbeRegionLatencies:
+		case <-timerChannel:
+		case <-controller.runCtx.Done():
+			break loop
+		}
+
+		p := controller.config.clientParameters.Get()
+		period := p.Duration(parameters.RegionLatencyProbePeriod)
+		sampleSize := p.Int(parameters.RegionLatencyProbeSampleSize)
+		timeout := p.Duration(parameters.RegionLatencyProbeTimeout)
+		p = nil
+
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+			timerChannel = nil
+		}
+
+		if period == 0 {
+			continue
+		}
+
+		tunnel := controller.getNextActiveTunnel()
+		if tunnel != nil {
+			latencies, err := probeRegionLatencies(tunnel, sampleSize, timeout)
+			if err != nil {
+				NoticeAlert("probe region latencies failed: %s", err)
+			} else {
+				controller.regionLatenciesMutex.Lock()
+				controller.regionLatencies = latencies
+				controller.regionLatenciesMutex.Unlock()
+
+				noticeLatencies := make(map[string]int64)
+				for region, latency := range latencies {
+					noticeLatencies[region] = int64(latency / time.Millisecond)
+				}
+				NoticeRegionLatencies(noticeLatencies)
+			}
+		}
+
+		timer = time.NewTimer(period)
+		timerChannel = timer.C
+	}
+
+	if timer != nil {
+		timer.Stop()
+	}
+
+	NoticeInfo("exiting region latency prober")
+}
+
+// probeRegionLatencies samples up to sampleSize stored server entries per
+// region and returns, for each region, the median time to establish a port
+// forward through the tunnel to a sampled server.
+func probeRegionLatencies(
+	tunnel *Tunnel,
+	sampleSize int,
+	timeout time.Duration) (map[string]time.Duration, error) {
+
+	return measureRegionLatencies(
+		tunnel.serverEntry.IpAddress,
+		sampleSize,
+		func(address string) (time.Duration, error) {
+			return probeLatency(tunnel, address, timeout)
+		})
+}
+
+// measureRegionLatencies performs probeRegionLatencies, using the specified
+// probe function to measure the latency to each sampled server address. The
+// server entry with excludeIPAddress is not sampled.
+func measureRegionLatencies(
+	excludeIPAddress string,
+	sampleSize int,
+	probe func(address string) (time.Duration, error)) (map[string]time.Duration, error) {
+
+	// Reservoir sample server entries in each region.
+
+	samples := make(map[string][]string)
+	counts := make(map[string]int)
+
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		if serverEntry.Region == "" ||
+			serverEntry.IpAddress == excludeIPAddress {
+			return
+		}
+
+		port := serverEntry.SshObfuscatedPort
+		if port == 0 {
+			port = serverEntry.SshPort
+		}
+		if port == 0 {
+			return
+		}
+		address := net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(port))
+
+		region := serverEntry.Region
+		counts[region] += 1
+
+		if len(samples[region]) < sampleSize {
+			samples[region] = append(samples[region], address)
+			return
+		}
+
+		index, err := common.MakeSecureRandomInt(counts[region])
+		if err == nil && index < sampleSize {
+			samples[region][index] = address
+		}
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	latencies := make(map[string]time.Duration)
+
+	// Regions are probed one at a time, with all samples in a region probed
+	// concurrently, to limit the number of concurrent port forwards.
+
+	for region, addresses := range samples {
+
+		var waitGroup sync.WaitGroup
+		results := make(chan time.Duration, len(addresses))
+
+		for _, address := range addresses {
+			waitGroup.Add(1)
+			go func(address string) {
+				defer waitGroup.Done()
+				rtt, err := probe(address)
+				if err == nil {
+					results <- rtt
+				}
+			}(address)
+		}
+
+		waitGroup.Wait()
+		close(results)
+
+		var rtts []time.Duration
+		for rtt := range results {
+			rtts = append(rtts, rtt)
+		}
+
+		if len(rtts) == 0 {
+			continue
+		}
+
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		latencies[region] = rtts[len(rtts)/2]
+	}
+
+	return latencies, nil
+}
+
+// probeLatency measures the time to establish a TCP port forward through the
+// tunnel to the specified address. Unlike Tunnel.Dial, a failed probe isn't
+// counted as a port forward failure, as probe targets are not expected to
+// always be reachable.
+func probeLatency(
+	tunnel *Tunnel, address string, timeout time.Duration) (time.Duration, error) {
+
+	if !tunnel.IsActivated() {
+		return 0, common.ContextError(fmt.Errorf("tunnel is not activated"))
+	}
+
+	// Note: as in Tunnel.Dial, SSH port forward dials can't be interrupted,
+	// so the dial goroutine may outlive the timeout until the tunnel is
+	// closed.
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	resultChannel := make(chan dialResult, 1)
+
+	start := monotime.Now()
+
+	go func() {
+		conn, err := tunnel.sshClient.Dial("tcp", address)
+		resultChannel <- dialResult{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultChannel:
+		if result.err != nil {
+			return 0, common.ContextError(result.err)
+		}
+		result.conn.Close()
+		return monotime.Since(start), nil
+	case <-timer.C:
+		go func() {
+			result := <-resultChannel
+			if result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return 0, common.ContextError(fmt.Errorf("probe timeout"))
+	}
+}
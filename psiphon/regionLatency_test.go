@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestMeasureRegionLatencies(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-region-latency-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// The probe latency for each server is derived from the last octet of
+	// its IP address. Servers in "FAILED" always fail to respond.
+
+	storeServerEntry := func(lastOctet int, region string, port int) {
+		err := StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            fmt.Sprintf("192.0.2.%d", lastOctet),
+				"region":               region,
+				"sshObfuscatedPort":    port,
+				"configurationVersion": 1,
+			},
+			false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	for i := 1; i <= 10; i++ {
+		storeServerEntry(i, "US", 22)
+	}
+	for i := 11; i <= 12; i++ {
+		storeServerEntry(i, "CA", 22)
+	}
+	storeServerEntry(13, "FAILED", 22)
+
+	// Excluded: the tunnel's own server, no region, and no SSH port.
+
+	excludeIPAddress := "192.0.2.14"
+	storeServerEntry(14, "CA", 22)
+	storeServerEntry(15, "", 22)
+	storeServerEntry(16, "CA", 0)
+
+	sampleSize := 3
+
+	var mutex sync.Mutex
+	probed := make(map[string][]time.Duration)
+
+	latencies, err := measureRegionLatencies(
+		excludeIPAddress,
+		sampleSize,
+		func(address string) (time.Duration, error) {
+			host, _, _ := net.SplitHostPort(address)
+			serverEntry, err := getServerEntry(host)
+			if err != nil || serverEntry == nil {
+				return 0, fmt.Errorf("unexpected address: %s", address)
+			}
+			var lastOctet int
+			fmt.Sscanf(host, "192.0.2.%d", &lastOctet)
+			rtt := time.Duration(lastOctet) * time.Millisecond
+			mutex.Lock()
+			probed[serverEntry.Region] = append(probed[serverEntry.Region], rtt)
+			mutex.Unlock()
+			if serverEntry.Region == "FAILED" {
+				return 0, fmt.Errorf("probe failed")
+			}
+			return rtt, nil
+		})
+	if err != nil {
+		t.Fatalf("measureRegionLatencies failed: %s", err)
+	}
+
+	if len(probed) != 3 ||
+		len(probed["US"]) != sampleSize ||
+		len(probed["CA"]) != 2 ||
+		len(probed["FAILED"]) != 1 {
+
+		t.Fatalf("unexpected probes: %+v", probed)
+	}
+
+	for _, rtt := range probed["CA"] {
+		if rtt != 11*time.Millisecond && rtt != 12*time.Millisecond {
+			t.Fatalf("unexpected CA probe: %s", rtt)
+		}
+	}
+
+	// Each latency is the median of the region's successful probes.
+
+	sort.Slice(probed["US"], func(i, j int) bool { return probed["US"][i] < probed["US"][j] })
+
+	if len(latencies) != 2 ||
+		latencies["US"] != probed["US"][1] ||
+		latencies["CA"] != 12*time.Millisecond {
+
+		t.Fatalf("unexpected latencies: %+v", latencies)
+	}
+}
@@ -24,7 +24,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -43,6 +46,13 @@ type RemoteServerListFetcher func(
 // config.RemoteServerListDownloadFilename is the location to store the
 // download. As the download is resumed after failure, this filename must
 // be unique and persistent.
+//
+// When RemoteServerListDeltaURLs is configured and a previous download has
+// been stored, a delta fetch is attempted first. The delta for a previous
+// download with ETag E is located at <delta URL>/<E>, with any ETag quotes
+// removed, and is an authenticated data package, signed with the same key,
+// containing only the server entries added or changed since E. When no
+// delta is available, the full remote server list is downloaded.
 func FetchCommonRemoteServerList(
 	ctx context.Context,
 	config *Config,
@@ -55,11 +65,33 @@ func FetchCommonRemoteServerList(
 	p := config.clientParameters.Get()
 	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
 	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
+	deltaURLs := p.DownloadURLs(parameters.RemoteServerListDeltaURLs)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
 	p = nil
 
 	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
 
+	if len(deltaURLs) > 0 {
+		fetched, err := fetchCommonRemoteServerListDelta(
+			ctx,
+			config,
+			attempt,
+			tunnel,
+			untunneledDialConfig,
+			downloadTimeout,
+			publicKey,
+			downloadURL,
+			canonicalURL,
+			skipVerify,
+			deltaURLs)
+		if err != nil {
+			NoticeAlert("failed to fetch common remote server list delta: %s", common.ContextError(err))
+			// Fall back to a full download
+		} else if fetched {
+			return nil
+		}
+	}
+
 	newETag, err := downloadRemoteServerListFile(
 		ctx,
 		config,
@@ -115,6 +147,150 @@ func FetchCommonRemoteServerList(
 	return nil
 }
 
+// fetchCommonRemoteServerListDelta attempts to update the stored server
+// entries using a remote server list delta, as described in
+// FetchCommonRemoteServerList. The return value is true when the stored
+// server entries are up-to-date with the current remote server list, and
+// false when a full download is required.
+func fetchCommonRemoteServerListDelta(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadTimeout time.Duration,
+	publicKey string,
+	downloadURL string,
+	canonicalURL string,
+	skipVerify bool,
+	deltaURLs parameters.DownloadURLs) (bool, error) {
+
+	lastETag, err := GetUrlETag(canonicalURL)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	// Without a previous download, there's no base for a delta. Deltas
+	// are only supported with the built-in HTTP transport, which is used
+	// to check the current ETag.
+	if lastETag == "" || !isHTTPRemoteServerListURL(downloadURL) {
+		return false, nil
+	}
+
+	var cancelFunc context.CancelFunc
+	ctx, cancelFunc = context.WithTimeout(ctx, downloadTimeout)
+	defer cancelFunc()
+
+	// Check the current ETag of the full remote server list. This is both
+	// the target of the delta and the ETag to store once the delta is
+	// applied.
+
+	httpClient, err := MakeDownloadHTTPClient(
+		ctx, config, tunnel, untunneledDialConfig, skipVerify)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	request, err := http.NewRequest("HEAD", downloadURL, nil)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", MakePsiphonUserAgent(config))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return false, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	currentETag := response.Header.Get("ETag")
+	if currentETag == "" {
+		return false, common.ContextError(errors.New("missing ETag"))
+	}
+
+	if currentETag == lastETag {
+		return true, nil
+	}
+
+	deltaBaseURL, _, deltaSkipVerify := deltaURLs.Select(attempt)
+	if !isHTTPRemoteServerListURL(deltaBaseURL) {
+		return false, nil
+	}
+	deltaURL := fmt.Sprintf(
+		"%s/%s",
+		strings.TrimSuffix(deltaBaseURL, "/"),
+		url.PathEscape(strings.Trim(lastETag, "\"")))
+
+	deltaHTTPClient, err := MakeDownloadHTTPClient(
+		ctx, config, tunnel, untunneledDialConfig, deltaSkipVerify)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	deltaFilename := config.RemoteServerListDownloadFilename + ".delta"
+
+	n, _, err := ResumeDownload(
+		ctx,
+		deltaHTTPClient,
+		deltaURL,
+		MakePsiphonUserAgent(config),
+		deltaFilename,
+		"")
+
+	NoticeRemoteServerListResourceDownloadedBytes(deltaURL, n)
+
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	defer os.Remove(deltaFilename)
+
+	NoticeRemoteServerListResourceDownloaded(deltaURL)
+
+	file, err := os.Open(deltaFilename)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	defer file.Close()
+
+	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReader(
+		file, publicKey)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			serverListPayloadReader,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+		true)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	// The full remote server list may have changed again after the HEAD
+	// request, in which case the delta is for a newer version than
+	// currentETag. Storing currentETag is still safe: the next fetch will
+	// apply a delta from currentETag, which re-stores some entries.
+
+	err = SetUrlETag(canonicalURL, currentETag)
+	if err != nil {
+		NoticeAlert("failed to set ETag for common remote server list: %s", common.ContextError(err))
+	}
+
+	RecordRemoteServerListStat(deltaURL, currentETag)
+
+	return true, nil
+}
+
 // FetchObfuscatedServerLists downloads the obfuscated remote server lists
 // from config.ObfuscatedServerListRootURLs.
 // It first downloads the OSL registry, and then downloads each seeded OSL
@@ -188,15 +364,6 @@ func FetchObfuscatedServerLists(
 		registryFilename = downloadFilename
 	}
 
-	lookupSLOKs := func(slokID []byte) []byte {
-		// Lookup SLOKs in local datastore
-		key, err := GetSLOK(slokID)
-		if err != nil {
-			NoticeAlert("GetSLOK failed: %s", err)
-		}
-		return key
-	}
-
 	registryFile, err := os.Open(registryFilename)
 	if err != nil {
 		return fmt.Errorf("failed to read obfuscated server list registry: %s", common.ContextError(err))
@@ -206,7 +373,7 @@ func FetchObfuscatedServerLists(
 	registryStreamer, err := osl.NewRegistryStreamer(
 		registryFile,
 		publicKey,
-		lookupSLOKs)
+		lookupSLOK)
 	if err != nil {
 		// TODO: delete file? redownload if corrupt?
 		return fmt.Errorf("failed to read obfuscated server list registry: %s", common.ContextError(err))
@@ -278,7 +445,7 @@ func FetchObfuscatedServerLists(
 		serverListPayloadReader, err := osl.NewOSLReader(
 			file,
 			oslFileSpec,
-			lookupSLOKs,
+			lookupSLOK,
 			publicKey)
 		if err != nil {
 			file.Close()
@@ -340,6 +507,15 @@ func FetchObfuscatedServerLists(
 		}
 	}
 
+	// Report progress towards unlocking OSLs, which may have changed due to
+	// newly seeded SLOKs or a new registry.
+	progress, err := GetOSLProgress(config)
+	if err != nil {
+		NoticeAlert("failed to get obfuscated server list progress: %s", common.ContextError(err))
+	} else {
+		NoticeOSLProgress(progress)
+	}
+
 	if failed {
 		return errors.New("one or more operations failed")
 	}
@@ -347,6 +523,67 @@ func FetchObfuscatedServerLists(
 	return nil
 }
 
+// lookupSLOK looks up SLOKs in the local datastore. lookupSLOK is an
+// osl.SLOKLookup.
+func lookupSLOK(slokID []byte) []byte {
+	key, err := GetSLOK(slokID)
+	if err != nil {
+		NoticeAlert("GetSLOK failed: %s", err)
+	}
+	return key
+}
+
+// GetOSLProgress reports the client's progress towards unlocking each OSL
+// in the locally cached OSL registry, based on the SLOKs stored in the local
+// datastore. Apps may use this to show users that sustained use unlocks
+// additional servers. When no registry has been fetched yet, GetOSLProgress
+// returns an empty list.
+//
+// The datastore must be open when GetOSLProgress is called.
+func GetOSLProgress(config *Config) ([]*osl.OSLProgress, error) {
+
+	publicKey := config.clientParameters.Get().String(
+		parameters.RemoteServerListSignaturePublicKey)
+
+	registryFilename := osl.GetOSLRegistryFilename(
+		config.ObfuscatedServerListDownloadDirectory) + ".cached"
+
+	registryFile, err := os.Open(registryFilename)
+	if os.IsNotExist(err) {
+		return []*osl.OSLProgress{}, nil
+	}
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer registryFile.Close()
+
+	registryStreamer, err := osl.NewRegistryStreamer(
+		registryFile,
+		publicKey,
+		lookupSLOK)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	progressList := make([]*osl.OSLProgress, 0)
+
+	for {
+
+		progress, err := registryStreamer.NextProgress()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		if progress == nil {
+			break
+		}
+
+		progressList = append(progressList, progress)
+	}
+
+	return progressList, nil
+}
+
 // downloadRemoteServerListFile downloads the source URL to
 // the destination file, performing a resumable download. When
 // the download completes and the file content has changed, the
@@ -385,24 +622,21 @@ func downloadRemoteServerListFile(
 	ctx, cancelFunc = context.WithTimeout(ctx, downloadTimeout)
 	defer cancelFunc()
 
-	// MakeDownloadHttpClient will select either a tunneled
-	// or untunneled configuration.
+	// The transport is selected by the source URL scheme. See
+	// RemoteServerListTransport.
 
-	httpClient, err := MakeDownloadHTTPClient(
-		ctx,
-		config,
-		tunnel,
-		untunneledDialConfig,
-		skipVerify)
+	transport, err := getRemoteServerListTransport(sourceURL)
 	if err != nil {
 		return "", common.ContextError(err)
 	}
 
-	n, responseETag, err := ResumeDownload(
+	n, responseETag, err := transport.Download(
 		ctx,
-		httpClient,
+		config,
+		tunnel,
+		untunneledDialConfig,
 		sourceURL,
-		MakePsiphonUserAgent(config),
+		skipVerify,
 		destinationFilename,
 		lastETag)
 
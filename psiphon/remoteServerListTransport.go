@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// RemoteServerListTransport downloads remote server list resources, including
+// the common remote server list, the OSL registry, and OSL files.
+//
+// Transports are selected by the URL scheme of the download URL, so
+// alternative transports -- for example, DNS TXT record chunks, IPFS
+// gateways, or other storage services -- are configured, including via
+// tactics, by specifying RemoteServerListURLs or ObfuscatedServerListRootURLs
+// with the transport's scheme. The built-in transport handles "http" and
+// "https".
+//
+// All resources are authenticated after download, so transports need not
+// provide integrity or authenticity.
+type RemoteServerListTransport interface {
+
+	// Download fetches the resource at downloadURL, storing the complete
+	// resource in destinationFilename. Download returns the number of bytes
+	// downloaded and the resource ETag, an opaque identifier which must
+	// change when the resource content changes. When ifNoneMatchETag is not
+	// blank and matches the current resource ETag, the transport should skip
+	// the download and return ifNoneMatchETag. Transports may use
+	// destinationFilename.part* files to store partial download state.
+	//
+	// When tunnel is not nil, the download should be made through the
+	// tunnel. Otherwise, untunneledDialConfig should be used. skipVerify is
+	// the DownloadURL.SkipVerify value.
+	Download(
+		ctx context.Context,
+		config *Config,
+		tunnel *Tunnel,
+		untunneledDialConfig *DialConfig,
+		downloadURL string,
+		skipVerify bool,
+		destinationFilename string,
+		ifNoneMatchETag string) (int64, string, error)
+}
+
+var (
+	remoteServerListTransportsMutex sync.Mutex
+	remoteServerListTransports      = map[string]RemoteServerListTransport{
+		"http":  new(httpRemoteServerListTransport),
+		"https": new(httpRemoteServerListTransport),
+	}
+)
+
+// RegisterRemoteServerListTransport registers a transport for download URLs
+// with the specified scheme, replacing any existing transport for that
+// scheme. RegisterRemoteServerListTransport should be called before starting
+// a Controller.
+func RegisterRemoteServerListTransport(
+	scheme string, transport RemoteServerListTransport) {
+
+	remoteServerListTransportsMutex.Lock()
+	defer remoteServerListTransportsMutex.Unlock()
+
+	remoteServerListTransports[strings.ToLower(scheme)] = transport
+}
+
+// getRemoteServerListTransport returns the registered transport for the
+// scheme of downloadURL.
+func getRemoteServerListTransport(
+	downloadURL string) (RemoteServerListTransport, error) {
+
+	parsedURL, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	remoteServerListTransportsMutex.Lock()
+	defer remoteServerListTransportsMutex.Unlock()
+
+	transport, ok := remoteServerListTransports[strings.ToLower(parsedURL.Scheme)]
+	if !ok {
+		return nil, common.ContextError(
+			fmt.Errorf("no transport for scheme: %s", parsedURL.Scheme))
+	}
+
+	return transport, nil
+}
+
+// isHTTPRemoteServerListURL indicates whether downloadURL uses the built-in
+// HTTP transport.
+func isHTTPRemoteServerListURL(downloadURL string) bool {
+	transport, err := getRemoteServerListTransport(downloadURL)
+	if err != nil {
+		return false
+	}
+	_, ok := transport.(*httpRemoteServerListTransport)
+	return ok
+}
+
+// httpRemoteServerListTransport is the built-in RemoteServerListTransport,
+// which performs resumable HTTP downloads.
+type httpRemoteServerListTransport struct {
+}
+
+func (transport *httpRemoteServerListTransport) Download(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadURL string,
+	skipVerify bool,
+	destinationFilename string,
+	ifNoneMatchETag string) (int64, string, error) {
+
+	// MakeDownloadHttpClient will select either a tunneled
+	// or untunneled configuration.
+
+	httpClient, err := MakeDownloadHTTPClient(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		skipVerify)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
+	n, responseETag, err := ResumeDownload(
+		ctx,
+		httpClient,
+		downloadURL,
+		MakePsiphonUserAgent(config),
+		destinationFilename,
+		ifNoneMatchETag)
+	if err != nil {
+		return n, "", common.ContextError(err)
+	}
+
+	return n, responseETag, nil
+}
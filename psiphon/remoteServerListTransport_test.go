@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// testRemoteServerListTransport serves resources from memory.
+type testRemoteServerListTransport struct {
+	mutex         sync.Mutex
+	resources     map[string][]byte
+	eTags         map[string]string
+	downloadCount int
+}
+
+func (transport *testRemoteServerListTransport) set(
+	downloadURL string, content []byte, eTag string) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.resources[downloadURL] = content
+	transport.eTags[downloadURL] = eTag
+}
+
+func (transport *testRemoteServerListTransport) getDownloadCount() int {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.downloadCount
+}
+
+func (transport *testRemoteServerListTransport) Download(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadURL string,
+	skipVerify bool,
+	destinationFilename string,
+	ifNoneMatchETag string) (int64, string, error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	content, ok := transport.resources[downloadURL]
+	if !ok {
+		return 0, "", common.ContextError(errors.New("not found"))
+	}
+
+	eTag := transport.eTags[downloadURL]
+	if ifNoneMatchETag != "" && ifNoneMatchETag == eTag {
+		return 0, eTag, nil
+	}
+
+	transport.downloadCount += 1
+
+	err := ioutil.WriteFile(destinationFilename, content, 0600)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
+	return int64(len(content)), eTag, nil
+}
+
+func TestRemoteServerListTransport(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-remote-server-list-transport-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	makeServerList := func(IPAddresses ...string) []byte {
+		var encodedServerEntries []string
+		for _, IPAddress := range IPAddresses {
+			encodedServerEntry, err := protocol.EncodeServerEntryFields(
+				protocol.ServerEntryFields{
+					"ipAddress":            IPAddress,
+					"configurationVersion": 1,
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntryFields failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		serverList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"), signingPublicKey, signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		return serverList
+	}
+
+	// Register a second transport, alongside the built-in HTTP transport.
+
+	transport := &testRemoteServerListTransport{
+		resources: make(map[string][]byte),
+		eTags:     make(map[string]string),
+	}
+
+	RegisterRemoteServerListTransport("TEST-TRANSPORT", transport)
+	defer func() {
+		remoteServerListTransportsMutex.Lock()
+		delete(remoteServerListTransports, "test-transport")
+		remoteServerListTransportsMutex.Unlock()
+	}()
+
+	serverListURL := "test-transport://server-list"
+
+	if isHTTPRemoteServerListURL(serverListURL) ||
+		!isHTTPRemoteServerListURL("https://example.org/server-list") {
+		t.Fatalf("unexpected isHTTPRemoteServerListURL result")
+	}
+
+	_, err = getRemoteServerListTransport("unregistered://server-list")
+	if err == nil {
+		t.Fatalf("unexpected getRemoteServerListTransport success")
+	}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	// Deltas aren't supported by the test transport, so a full download
+	// is always made.
+
+	config.DataStoreDirectory = testDataDirName
+	config.RemoteServerListSignaturePublicKey = signingPublicKey
+	config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: base64.StdEncoding.EncodeToString([]byte(serverListURL))},
+	}
+	config.RemoteServerListDeltaURLs = parameters.DownloadURLs{
+		{URL: base64.StdEncoding.EncodeToString([]byte("test-transport://delta"))},
+	}
+	config.RemoteServerListDownloadFilename = filepath.Join(testDataDirName, "server-list")
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	fetch := func() error {
+		return FetchCommonRemoteServerList(
+			context.Background(), config, 0, nil, &DialConfig{})
+	}
+
+	checkServerEntries := func(IPAddresses ...string) {
+		for _, IPAddress := range IPAddresses {
+			serverEntry, err := getServerEntry(IPAddress)
+			if err != nil || serverEntry == nil {
+				t.Fatalf("missing server entry: %s", IPAddress)
+			}
+		}
+		if CountServerEntries() != len(IPAddresses) {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	transport.set(serverListURL, makeServerList("192.0.2.1"), "1")
+
+	err = fetch()
+	if err != nil {
+		t.Fatalf("FetchCommonRemoteServerList failed: %s", err)
+	}
+	checkServerEntries("192.0.2.1")
+
+	// An unchanged resource isn't downloaded again.
+
+	err = fetch()
+	if err != nil {
+		t.Fatalf("FetchCommonRemoteServerList failed: %s", err)
+	}
+	if transport.getDownloadCount() != 1 {
+		t.Fatalf("unexpected download count: %d", transport.getDownloadCount())
+	}
+
+	transport.set(serverListURL, makeServerList("192.0.2.1", "192.0.2.2"), "2")
+
+	err = fetch()
+	if err != nil {
+		t.Fatalf("FetchCommonRemoteServerList failed: %s", err)
+	}
+	checkServerEntries("192.0.2.1", "192.0.2.2")
+	if transport.getDownloadCount() != 2 {
+		t.Fatalf("unexpected download count: %d", transport.getDownloadCount())
+	}
+
+	// Resources downloaded with any transport are authenticated.
+
+	transport.set(serverListURL, []byte("invalid"), "3")
+
+	err = fetch()
+	if err == nil {
+		t.Fatalf("unexpected FetchCommonRemoteServerList success")
+	}
+	checkServerEntries("192.0.2.1", "192.0.2.2")
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// Untunneled DNS resolution, used to resolve fronting domains and other
+// direct dial destinations before a tunnel is established, is a target for
+// DNS poisoning. When the UntunneledDNSResolvers parameter, which may be set
+// by tactics, lists DNS-over-HTTPS or DNS-over-TLS resolvers, LookupIP tries
+// each, in order, before the plaintext resolver. When the
+// UntunneledDNSPlaintextFallback parameter is false, the plaintext resolver
+// is not used at all once encrypted resolvers are configured.
+//
+// Encrypted resolvers must be specified by IP address, as resolving a
+// resolver domain would itself require an untunneled DNS request. Resolver
+// connections are made with DialTCP, and so are bound, when a DeviceBinder is
+// set, and proxied, when an upstream proxy is set.
+
+const (
+	SECURE_DNS_SCHEME_HTTPS = "https"
+	SECURE_DNS_SCHEME_TLS   = "tls"
+
+	secureDNSDefaultTLSPort  = "853"
+	secureDNSMaxResponseSize = 65535
+)
+
+// secureDNSResolver is a parsed UntunneledDNSResolvers entry.
+type secureDNSResolver struct {
+	scheme  string
+	address string
+	URL     string
+}
+
+// parseSecureDNSResolver parses an UntunneledDNSResolvers entry.
+func parseSecureDNSResolver(resolver string) (*secureDNSResolver, error) {
+
+	resolverURL, err := url.Parse(resolver)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if net.ParseIP(resolverURL.Hostname()) == nil {
+		return nil, common.ContextError(
+			fmt.Errorf("resolver host is not an IP address: %s", resolverURL.Hostname()))
+	}
+
+	port := resolverURL.Port()
+
+	switch resolverURL.Scheme {
+	case SECURE_DNS_SCHEME_HTTPS:
+		if port == "" {
+			port = "443"
+		}
+	case SECURE_DNS_SCHEME_TLS:
+		if port == "" {
+			port = secureDNSDefaultTLSPort
+		}
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported resolver scheme: %s", resolverURL.Scheme))
+	}
+
+	return &secureDNSResolver{
+		scheme:  resolverURL.Scheme,
+		address: net.JoinHostPort(resolverURL.Hostname(), port),
+		URL:     resolver,
+	}, nil
+}
+
+// secureLookupIP resolves host using the configured encrypted DNS resolvers.
+// attempted is false when no encrypted resolvers are configured, or when host
+// is an IP address, in which
+// case the caller should proceed with the plaintext resolver. When all
+// encrypted resolvers fail, fallback indicates whether the caller may
+// proceed with the plaintext resolver.
+func secureLookupIP(
+	ctx context.Context,
+	host string,
+	config *DialConfig) (IPs []net.IP, attempted, fallback bool, err error) {
+
+	if config.ClientParameters == nil || net.ParseIP(host) != nil {
+		return nil, false, true, nil
+	}
+
+	p := config.ClientParameters.Get()
+	resolvers := p.Strings(parameters.UntunneledDNSResolvers)
+	timeout := p.Duration(parameters.UntunneledDNSResolverTimeout)
+	fallback = p.Bool(parameters.UntunneledDNSPlaintextFallback)
+	p = nil
+
+	if len(resolvers) == 0 {
+		return nil, false, true, nil
+	}
+
+	for _, resolver := range resolvers {
+
+		var secureResolver *secureDNSResolver
+		secureResolver, err = parseSecureDNSResolver(resolver)
+		if err != nil {
+			NoticeAlert("invalid untunneled DNS resolver: %s", err)
+			continue
+		}
+
+		resolveCtx, cancelFunc := context.WithTimeout(ctx, timeout)
+		IPs, err = secureResolver.lookupIP(resolveCtx, host, config)
+		cancelFunc()
+
+		if err == nil && len(IPs) == 0 {
+			err = errors.New("empty address list")
+		}
+		if err == nil {
+			return IPs, true, fallback, nil
+		}
+
+		NoticeAlert("untunneled DNS resolver %s failed: %s", resolver, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = errors.New("no valid untunneled DNS resolvers")
+	}
+
+	return nil, true, fallback, common.ContextError(err)
+}
+
+func (resolver *secureDNSResolver) lookupIP(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
+
+	tlsConfig, err := resolver.makeTLSConfig(config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if resolver.scheme == SECURE_DNS_SCHEME_TLS {
+		return resolver.lookupIPOverTLS(ctx, host, config, tlsConfig)
+	}
+	return resolver.lookupIPOverHTTPS(ctx, host, config, tlsConfig)
+}
+
+func (resolver *secureDNSResolver) makeTLSConfig(config *DialConfig) (*tls.Config, error) {
+
+	serverName, _, _ := net.SplitHostPort(resolver.address)
+
+	tlsConfig := &tls.Config{ServerName: serverName}
+
+	if config.TrustedCACertificatesFilename != "" {
+		PEMBytes, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(PEMBytes) {
+			return nil, common.ContextError(errors.New("no trusted CA certificates"))
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	return tlsConfig, nil
+}
+
+// lookupIPOverTLS implements DNS-over-TLS, RFC 7858. ResolveIP uses the DNS
+// TCP message framing for any connection that's not a UDP socket.
+func (resolver *secureDNSResolver) lookupIPOverTLS(
+	ctx context.Context,
+	host string,
+	config *DialConfig,
+	tlsConfig *tls.Config) ([]net.IP, error) {
+
+	conn, err := DialTCP(ctx, resolver.address, config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	type resolveIPResult struct {
+		IPs []net.IP
+		err error
+	}
+
+	resultChannel := make(chan resolveIPResult, 1)
+
+	go func() {
+		err := tlsConn.Handshake()
+		if err != nil {
+			tlsConn.Close()
+			resultChannel <- resolveIPResult{err: err}
+			return
+		}
+		// ResolveIP closes tlsConn.
+		IPs, _, err := ResolveIP(host, tlsConn)
+		resultChannel <- resolveIPResult{IPs: IPs, err: err}
+	}()
+
+	var result resolveIPResult
+
+	select {
+	case result = <-resultChannel:
+	case <-ctx.Done():
+		result.err = ctx.Err()
+		// Interrupt the goroutine
+		conn.Close()
+		<-resultChannel
+	}
+
+	if result.err != nil {
+		return nil, common.ContextError(result.err)
+	}
+
+	return result.IPs, nil
+}
+
+// lookupIPOverHTTPS implements DNS-over-HTTPS, RFC 8484, using the POST
+// method.
+func (resolver *secureDNSResolver) lookupIPOverHTTPS(
+	ctx context.Context,
+	host string,
+	config *DialConfig,
+	tlsConfig *tls.Config) ([]net.IP, error) {
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	query.RecursionDesired = true
+
+	// RFC 8484 recommends a DNS ID of 0, to maximize HTTP cache friendliness.
+	query.Id = 0
+
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dialer := NewTCPDialer(config)
+
+	// Always dial the resolver IP address, regardless of how the URL is
+	// interpreted by the HTTP transport.
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer(ctx, network, resolver.address)
+		},
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	request, err := http.NewRequest(
+		"POST", resolver.URL, bytes.NewReader(packedQuery))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	responseBody, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, secureDNSMaxResponseSize))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	answer := new(dns.Msg)
+	err = answer.Unpack(responseBody)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if answer.Id != query.Id {
+		return nil, common.ContextError(errors.New("unexpected response ID"))
+	}
+
+	IPs := make([]net.IP, 0)
+	for _, record := range answer.Answer {
+		if a, ok := record.(*dns.A); ok {
+			IPs = append(IPs, a.A)
+		}
+	}
+
+	return IPs, nil
+}
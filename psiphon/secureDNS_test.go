@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestSecureDNS(t *testing.T) {
+
+	testIP := net.ParseIP("192.0.2.1")
+
+	dohResolver, dotResolver, CAFilename, stop := startTestSecureDNSServers(t, testIP)
+	defer stop()
+
+	// Unused port, for a resolver which fails
+
+	unusedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	unusedAddress := unusedListener.Addr().String()
+	unusedListener.Close()
+
+	failingResolver := "tls://" + unusedAddress
+
+	testCases := []struct {
+		description string
+		resolvers   []string
+		fallback    bool
+		attempted   bool
+		expectIP    bool
+	}{
+		{"no resolvers", []string{}, true, false, false},
+		{"DoH", []string{dohResolver}, true, true, true},
+		{"DoT", []string{dotResolver}, true, true, true},
+		{"fallback order", []string{"udp://192.0.2.2", failingResolver, dohResolver}, true, true, true},
+		{"all fail", []string{failingResolver}, false, true, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			clientParameters, err := parameters.NewClientParameters(nil)
+			if err != nil {
+				t.Fatalf("NewClientParameters failed: %s", err)
+			}
+
+			_, err = clientParameters.Set("", false, map[string]interface{}{
+				"UntunneledDNSResolvers":         testCase.resolvers,
+				"UntunneledDNSPlaintextFallback": testCase.fallback,
+			})
+			if err != nil {
+				t.Fatalf("Set failed: %s", err)
+			}
+
+			dialConfig := &DialConfig{
+				TrustedCACertificatesFilename: CAFilename,
+				ClientParameters:              clientParameters,
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancelFunc()
+
+			IPs, attempted, fallback, err := secureLookupIP(ctx, "example.org", dialConfig)
+
+			if attempted != testCase.attempted {
+				t.Fatalf("unexpected attempted: %v", attempted)
+			}
+			if fallback != testCase.fallback {
+				t.Fatalf("unexpected fallback: %v", fallback)
+			}
+
+			if testCase.expectIP {
+				if err != nil {
+					t.Fatalf("secureLookupIP failed: %s", err)
+				}
+				if len(IPs) != 1 || !IPs[0].Equal(testIP) {
+					t.Fatalf("unexpected IPs: %v", IPs)
+				}
+			} else if testCase.attempted && err == nil {
+				t.Fatalf("unexpected success")
+			}
+		})
+	}
+}
+
+// startTestSecureDNSServers starts local DNS-over-HTTPS and DNS-over-TLS
+// servers, which answer all A queries with answerIP, and writes a CA file
+// which trusts their certificate.
+func startTestSecureDNSServers(
+	t *testing.T,
+	answerIP net.IP) (dohResolver, dotResolver, CAFilename string, stop func()) {
+
+	makeAnswer := func(query *dns.Msg) *dns.Msg {
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		answer.Answer = append(answer.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   query.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: answerIP,
+		})
+		return answer
+	}
+
+	// DNS-over-HTTPS server
+
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" ||
+				r.Header.Get("Content-Type") != "application/dns-message" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			query := new(dns.Msg)
+			if query.Unpack(body) != nil || len(query.Question) != 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			packedAnswer, _ := makeAnswer(query).Pack()
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(packedAnswer)
+		}))
+
+	// DNS-over-TLS server, using the same certificate
+
+	dotListener, err := tls.Listen(
+		"tcp", "127.0.0.1:0", &tls.Config{Certificates: dohServer.TLS.Certificates})
+	if err != nil {
+		dohServer.Close()
+		t.Fatalf("tls.Listen failed: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := dotListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				dnsConn := &dns.Conn{Conn: conn}
+				defer dnsConn.Close()
+				query, err := dnsConn.ReadMsg()
+				if err != nil {
+					return
+				}
+				dnsConn.WriteMsg(makeAnswer(query))
+			}()
+		}
+	}()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-secure-dns-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+
+	CAFilename = filepath.Join(testDataDirName, "ca.pem")
+	err = ioutil.WriteFile(
+		CAFilename,
+		pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: dohServer.Certificate().Raw,
+		}),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	stop = func() {
+		dohServer.Close()
+		dotListener.Close()
+		os.RemoveAll(testDataDirName)
+	}
+
+	return dohServer.URL + "/dns-query",
+		"tls://" + dotListener.Addr().String(),
+		CAFilename,
+		stop
+}
@@ -29,6 +29,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -160,7 +161,11 @@ func dispatchAPIRequestHandler(
 
 	switch name {
 	case protocol.PSIPHON_API_HANDSHAKE_REQUEST_NAME:
-		return handshakeAPIRequestHandler(support, apiProtocol, geoIPData, params)
+		response, err := handshakeAPIRequestHandler(support, apiProtocol, geoIPData, params)
+		if err != nil {
+			metrics.apiHandshakeFailed()
+		}
+		return response, err
 	case protocol.PSIPHON_API_CONNECTED_REQUEST_NAME:
 		return connectedAPIRequestHandler(support, geoIPData, authorizedAccessTypes, params)
 	case protocol.PSIPHON_API_STATUS_REQUEST_NAME:
@@ -214,7 +219,34 @@ func handshakeAPIRequestHandler(
 	// Note: no guarantee that PsinetDatabase won't reload between database calls
 	db := support.PsinetDatabase
 
-	httpsRequestRegexes := db.GetHttpsRequestRegexes(sponsorID)
+	// A client reconnecting to this server may present a session resumption
+	// token issued in a previous handshake. When the token is valid and its
+	// sponsor, platform, and region match, the sponsor lookups and server
+	// discovery are skipped, and the client reuses its previous values.
+
+	var resumptionState *sessionResumptionState
+	token, _ := getStringRequestParam(
+		params, protocol.PSIPHON_API_HANDSHAKE_SESSION_RESUMPTION_TOKEN)
+	if token != "" && support.Config.sessionResumptionKey != nil {
+		state, err := verifySessionResumptionToken(
+			support.Config.sessionResumptionKey, token, time.Now())
+		if err == nil &&
+			state.SponsorID == sponsorID &&
+			state.ClientPlatform == clientPlatform &&
+			state.ClientRegion == geoIPData.Country {
+
+			resumptionState = state
+		}
+	}
+
+	var httpsRequestRegexes []map[string]string
+	var expectDomainBytes bool
+	if resumptionState != nil {
+		expectDomainBytes = resumptionState.ExpectDomainBytes
+	} else {
+		httpsRequestRegexes = db.GetHttpsRequestRegexes(sponsorID)
+		expectDomainBytes = len(httpsRequestRegexes) > 0
+	}
 
 	// Flag the SSH client as having completed its handshake. This
 	// may reselect traffic rules and starts allowing port forwards.
@@ -228,7 +260,7 @@ func handshakeAPIRequestHandler(
 			completed:         true,
 			apiProtocol:       apiProtocol,
 			apiParams:         copyBaseRequestParams(params),
-			expectDomainBytes: len(httpsRequestRegexes) > 0,
+			expectDomainBytes: expectDomainBytes,
 		},
 		authorizations)
 	if err != nil {
@@ -286,15 +318,44 @@ func handshakeAPIRequestHandler(
 
 	handshakeResponse := protocol.HandshakeResponse{
 		SSHSessionID:           sessionID,
-		Homepages:              db.GetRandomizedHomepages(sponsorID, geoIPData.Country, isMobile),
 		UpgradeClientVersion:   db.GetUpgradeClientVersion(clientVersion, normalizedPlatform),
 		PageViewRegexes:        make([]map[string]string, 0),
 		HttpsRequestRegexes:    httpsRequestRegexes,
-		EncodedServerList:      db.DiscoverServers(geoIPData.DiscoveryValue),
 		ClientRegion:           geoIPData.Country,
 		ServerTimestamp:        common.GetCurrentTimestamp(),
 		ActiveAuthorizationIDs: activeAuthorizationIDs,
 		TacticsPayload:         marshaledTacticsPayload,
+		ServerLoad:             support.TunnelServer.GetServerLoad(),
+		ClientParameters:       support.Config.HandshakeClientParameters,
+	}
+
+	if resumptionState != nil {
+
+		// The original token remains in use, so resumption is limited to the
+		// original token validity period.
+		handshakeResponse.SessionResumed = true
+
+	} else {
+
+		handshakeResponse.Homepages = db.GetRandomizedHomepages(
+			sponsorID, geoIPData.Country, isMobile)
+		handshakeResponse.EncodedServerList = db.DiscoverServers(
+			geoIPData.DiscoveryValue)
+
+		if support.Config.sessionResumptionKey != nil {
+			handshakeResponse.SessionResumptionToken, err = makeSessionResumptionToken(
+				support.Config.sessionResumptionKey,
+				&sessionResumptionState{
+					SponsorID:         sponsorID,
+					ClientPlatform:    clientPlatform,
+					ClientRegion:      geoIPData.Country,
+					ExpectDomainBytes: expectDomainBytes,
+					Expiry:            time.Now().Add(support.Config.GetSessionResumptionTTL()).Unix(),
+				})
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+		}
 	}
 
 	responsePayload, err := json.Marshal(handshakeResponse)
@@ -537,6 +598,9 @@ var baseRequestParams = []requestParamSpec{
 	{"relay_protocol", isRelayProtocol, 0},
 	{"tunnel_whole_device", isBooleanFlag, requestParamOptional},
 	{"device_region", isAnyString, requestParamOptional},
+	{"network_mcc", isDigits, requestParamOptional},
+	{"network_mnc", isDigits, requestParamOptional},
+	{"network_asn", isDigits, requestParamOptional},
 	{"ssh_client_version", isAnyString, requestParamOptional},
 	{"upstream_proxy_type", isUpstreamProxyType, requestParamOptional},
 	{"upstream_proxy_custom_header_names", isAnyString, requestParamOptional | requestParamArray},
@@ -547,6 +611,10 @@ var baseRequestParams = []requestParamSpec{
 	{"meek_transformed_host_name", isBooleanFlag, requestParamOptional},
 	{"user_agent", isAnyString, requestParamOptional},
 	{"tls_profile", isAnyString, requestParamOptional},
+	{"traffic_shaping_profile", isAnyString, requestParamOptional},
+	{"quic_wire_version", isAnyString, requestParamOptional},
+	{"tcp_max_segment_size", isIntString, requestParamOptional},
+	{"inproxy_connection_id", isAnyString, requestParamOptional},
 	{"server_entry_region", isRegionCode, requestParamOptional},
 	{"server_entry_source", isServerEntrySource, requestParamOptional},
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
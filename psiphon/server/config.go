@@ -31,12 +31,14 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 )
@@ -161,6 +163,13 @@ type Config struct {
 	// run by this server instance, which use Obfuscated SSH.
 	ObfuscatedSSHKey string
 
+	// PreviousServerKeys specifies keys from previous server entries which
+	// remain valid during a key rotation window. Clients holding server
+	// entries with previous keys may continue to connect while server
+	// entries with the current keys are distributed. Once the rotation
+	// window has passed, previous keys should be removed.
+	PreviousServerKeys []*ServerKeys
+
 	// MeekCookieEncryptionPrivateKey is the NaCl private key used
 	// to decrypt meek cookie payload sent from clients. The same
 	// key is used for all meek protocols run by this server instance.
@@ -244,6 +253,14 @@ type Config struct {
 	// The default, 0, disables load logging.
 	LoadMonitorPeriodSeconds int
 
+	// MetricsListenAddress is the host:port address of an HTTP listener
+	// which exports server metrics, including accepted and established
+	// tunnels, handshake failures, active port forwards, udpgw sessions, and
+	// GeoIP lookup timings, in the Prometheus text exposition format at
+	// "/metrics". The listener has no authentication and should be bound to
+	// a private interface. When blank, the default, no metrics are exported.
+	MetricsListenAddress string
+
 	// ProcessProfileOutputDirectory is the path of a directory to which
 	// process profiles will be written when signaled with SIGUSR2. The
 	// files are overwritten on each invocation. When set to the default
@@ -295,6 +312,14 @@ type Config struct {
 	// The default, 0 is no limit.
 	MaxConcurrentSSHHandshakes int
 
+	// ServerLoadEstablishedClientsCapacity is the number of established
+	// clients at which the server is considered fully loaded. When set, the
+	// handshake response includes the current server load, as a percentage
+	// of this capacity, and clients deprioritize loaded servers in
+	// subsequent establishments.
+	// The default, 0, omits the load hint.
+	ServerLoadEstablishedClientsCapacity int
+
 	// PeriodicGarbageCollectionSeconds turns on periodic calls to runtime.GC,
 	// every specified number of seconds, to force garbage collection.
 	// The default, 0 is off.
@@ -311,10 +336,80 @@ type Config struct {
 	// tactics server configuration.
 	TacticsConfigFilename string
 
+	// HandshakeClientParameters are client parameters, such as
+	// LimitTunnelProtocols, which are pushed to clients in the handshake
+	// response and applied by clients on top of any tactics. Handshake
+	// parameters take effect without a separate tactics request, but, unlike
+	// tactics, are not filtered by client properties.
+	HandshakeClientParameters map[string]interface{}
+
+	// SessionResumptionKey is a base64-encoded, 32 byte secret key used to
+	// authenticate session resumption tokens, which are issued in handshake
+	// responses and allow a client reconnecting to this server to skip
+	// redundant handshake work, such as sponsor home page and stats regex
+	// lookups and server discovery. When blank, no tokens are issued.
+	SessionResumptionKey string
+
+	// SessionResumptionTTLSeconds specifies the validity period of session
+	// resumption tokens. The default, 0, is DEFAULT_SESSION_RESUMPTION_TTL.
+	SessionResumptionTTLSeconds int
+
+	// DrainGracePeriodSeconds specifies how long a draining server, signaled
+	// with SIGQUIT, waits for established clients to disconnect before
+	// shutting down. The default, 0, is DEFAULT_DRAIN_GRACE_PERIOD.
+	DrainGracePeriodSeconds int
+
 	// MarionetteFormat specifies a Marionette format to use with the
 	// MARIONETTE-OSSH tunnel protocol. The format specifies the network
 	// protocol port to listen on.
 	MarionetteFormat string
+
+	sessionResumptionKey []byte
+}
+
+// ServerKeys specifies a set of SSH and obfuscation keys, as distributed to
+// clients in server entries. Blank fields are the same as the current
+// value.
+//
+// The SSH host key presented to a client is selected by the Obfuscated SSH
+// key the client uses, so an SSHPrivateKey that differs from the current
+// key requires an ObfuscatedSSHKey that also differs; and host key rotation
+// is not supported for the unobfuscated SSH protocol.
+type ServerKeys struct {
+	SSHPrivateKey     string
+	SSHUserName       string
+	SSHPassword       string
+	ObfuscatedSSHKey  string
+	MeekObfuscatedKey string
+}
+
+// GetPreviousObfuscatedSSHKeys returns the distinct previous Obfuscated SSH
+// keys which differ from the current key.
+func (config *Config) GetPreviousObfuscatedSSHKeys() []string {
+	return config.getPreviousKeys(
+		config.ObfuscatedSSHKey,
+		func(keys *ServerKeys) string { return keys.ObfuscatedSSHKey })
+}
+
+// GetPreviousMeekObfuscatedKeys returns the distinct previous meek
+// obfuscated keys which differ from the current key.
+func (config *Config) GetPreviousMeekObfuscatedKeys() []string {
+	return config.getPreviousKeys(
+		config.MeekObfuscatedKey,
+		func(keys *ServerKeys) string { return keys.MeekObfuscatedKey })
+}
+
+func (config *Config) getPreviousKeys(
+	currentKey string, getKey func(*ServerKeys) string) []string {
+
+	var previousKeys []string
+	for _, keys := range config.PreviousServerKeys {
+		key := getKey(keys)
+		if key != "" && key != currentKey && !common.Contains(previousKeys, key) {
+			previousKeys = append(previousKeys, key)
+		}
+	}
+	return previousKeys
 }
 
 // RunWebServer indicates whether to run a web server component.
@@ -322,11 +417,33 @@ func (config *Config) RunWebServer() bool {
 	return config.WebServerPort > 0
 }
 
+// RunMetricsServer indicates whether to run a metrics server component.
+func (config *Config) RunMetricsServer() bool {
+	return config.MetricsListenAddress != ""
+}
+
 // RunLoadMonitor indicates whether to monitor and log server load.
 func (config *Config) RunLoadMonitor() bool {
 	return config.LoadMonitorPeriodSeconds > 0
 }
 
+// GetSessionResumptionTTL returns the validity period of session resumption
+// tokens.
+func (config *Config) GetSessionResumptionTTL() time.Duration {
+	if config.SessionResumptionTTLSeconds <= 0 {
+		return DEFAULT_SESSION_RESUMPTION_TTL
+	}
+	return time.Duration(config.SessionResumptionTTLSeconds) * time.Second
+}
+
+// GetDrainGracePeriod returns the drain grace period.
+func (config *Config) GetDrainGracePeriod() time.Duration {
+	if config.DrainGracePeriodSeconds <= 0 {
+		return DEFAULT_DRAIN_GRACE_PERIOD
+	}
+	return time.Duration(config.DrainGracePeriodSeconds) * time.Second
+}
+
 // RunPeriodicGarbageCollection indicates whether to run periodic garbage collection.
 func (config *Config) RunPeriodicGarbageCollection() bool {
 	return config.PeriodicGarbageCollectionSeconds > 0
@@ -370,10 +487,31 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	if config.MetricsListenAddress != "" {
+		if err := validateNetworkAddress(config.MetricsListenAddress, false); err != nil {
+			return nil, errors.New("MetricsListenAddress is invalid")
+		}
+	}
+
+	if config.HandshakeClientParameters != nil {
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err == nil {
+			_, err = clientParameters.Set("", false, config.HandshakeClientParameters)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("HandshakeClientParameters are invalid: %s", err)
+		}
+	}
+
 	for tunnelProtocol, port := range config.TunnelProtocolPorts {
 		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
 			return nil, fmt.Errorf("Unsupported tunnel protocol: %s", tunnelProtocol)
 		}
+		// In-proxy clients are relayed to the OSSH listener; there is no
+		// distinct in-proxy listener.
+		if protocol.TunnelProtocolUsesInproxy(tunnelProtocol) {
+			return nil, fmt.Errorf("Tunnel protocol %s has no listener", tunnelProtocol)
+		}
 		if protocol.TunnelProtocolUsesSSH(tunnelProtocol) ||
 			protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
 			if config.SSHPrivateKey == "" || config.SSHServerVersion == "" ||
@@ -407,6 +545,17 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	for _, keys := range config.PreviousServerKeys {
+		if keys == nil {
+			return nil, errors.New("PreviousServerKeys entry is invalid")
+		}
+		if keys.SSHPrivateKey != "" && keys.SSHPrivateKey != config.SSHPrivateKey &&
+			(keys.ObfuscatedSSHKey == "" || keys.ObfuscatedSSHKey == config.ObfuscatedSSHKey) {
+			return nil, errors.New(
+				"PreviousServerKeys SSHPrivateKey requires a distinct ObfuscatedSSHKey")
+		}
+	}
+
 	if config.UDPInterceptUdpgwServerAddress != "" {
 		if err := validateNetworkAddress(config.UDPInterceptUdpgwServerAddress, true); err != nil {
 			return nil, fmt.Errorf("UDPInterceptUdpgwServerAddress is invalid: %s", err)
@@ -425,6 +574,14 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 			"AccessControlVerificationKeyRing is invalid: %s", err)
 	}
 
+	if config.SessionResumptionKey != "" {
+		config.sessionResumptionKey, err = base64.StdEncoding.DecodeString(
+			config.SessionResumptionKey)
+		if err != nil || len(config.sessionResumptionKey) != SESSION_RESUMPTION_KEY_SIZE {
+			return nil, errors.New("SessionResumptionKey is invalid")
+		}
+	}
+
 	return &config, nil
 }
 
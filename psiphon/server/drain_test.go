@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+
+	shutdownBroadcast := make(chan struct{})
+
+	server := &TunnelServer{
+		runWaitGroup:      new(sync.WaitGroup),
+		shutdownBroadcast: shutdownBroadcast,
+		sshServer: &sshServer{
+			establishTunnels:  1,
+			shutdownBroadcast: shutdownBroadcast,
+			clients:           make(map[string]*sshClient),
+		},
+	}
+
+	// With no established clients, drain completes immediately.
+
+	if !server.Drain(1 * time.Minute) {
+		t.Fatalf("unexpected drain failure")
+	}
+
+	if server.GetEstablishTunnels() {
+		t.Fatalf("unexpected establishing tunnels after drain")
+	}
+
+	// An established client that doesn't disconnect causes the grace period
+	// to expire.
+
+	server.sshServer.clients["SESSION"] = &sshClient{}
+
+	if server.Drain(100 * time.Millisecond) {
+		t.Fatalf("unexpected drain success")
+	}
+
+	// A client that disconnects during the grace period allows the drain to
+	// complete.
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.sshServer.clientsMutex.Lock()
+		delete(server.sshServer.clients, "SESSION")
+		server.sshServer.clientsMutex.Unlock()
+	}()
+
+	if !server.Drain(1 * time.Minute) {
+		t.Fatalf("unexpected drain failure")
+	}
+
+	// Shutdown interrupts a drain.
+
+	server.sshServer.clients["SESSION"] = &sshClient{}
+
+	close(shutdownBroadcast)
+
+	if server.Drain(1 * time.Minute) {
+		t.Fatalf("unexpected drain success")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	maxminddb "github.com/oschwald/maxminddb-golang"
 	cache "github.com/patrickmn/go-cache"
@@ -147,6 +148,7 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 	// Each database will populate geoIPFields with the values it contains. In the
 	// current MaxMind deployment, the City database populates Country and City and
 	// the separate ISP database populates ISP.
+	startTime := monotime.Now()
 	for _, database := range geoIP.databases {
 		database.ReloadableFile.RLock()
 		err := database.maxMindReader.Lookup(ip, &geoIPFields)
@@ -155,6 +157,7 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 			log.WithContextFields(LogFields{"error": err}).Warning("GeoIP lookup failed")
 		}
 	}
+	metrics.observeGeoIPLookup(monotime.Since(startTime))
 
 	if geoIPFields.Country.ISOCode != "" {
 		result.Country = geoIPFields.Country.ISOCode
@@ -1024,7 +1024,10 @@ func getMeekCookiePayload(support *SupportServices, cookieValue string) ([]byte,
 
 	obfuscator, err := obfuscator.NewServerObfuscator(
 		reader,
-		&obfuscator.ObfuscatorConfig{Keyword: support.Config.MeekObfuscatedKey})
+		&obfuscator.ObfuscatorConfig{
+			Keyword:          support.Config.MeekObfuscatedKey,
+			PreviousKeywords: support.Config.GetPreviousMeekObfuscatedKeys(),
+		})
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -0,0 +1,97 @@
+// +build go1.18
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
+)
+
+func FuzzMeekCookiePayload(f *testing.F) {
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		f.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		f.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+	}
+
+	// Seed with a valid cookie, constructed as in psiphon.makeMeekCookie.
+
+	var nonce [24]byte
+	ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		f.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	sealed := box.Seal(
+		nil,
+		[]byte(`{"v":3,"t":"UNFRONTED-MEEK-OSSH"}`),
+		&nonce,
+		rawMeekCookieEncryptionPublicKey,
+		ephemeralPrivateKey)
+
+	maxPadding := 32
+	clientObfuscator, err := obfuscator.NewClientObfuscator(
+		&obfuscator.ObfuscatorConfig{
+			Keyword:    meekObfuscatedKey,
+			MaxPadding: &maxPadding})
+	if err != nil {
+		f.Fatalf("obfuscator.NewClientObfuscator failed: %s", err)
+	}
+	cookie := clientObfuscator.SendSeedMessage()
+	seedLen := len(cookie)
+	cookie = append(cookie, ephemeralPublicKey[:]...)
+	cookie = append(cookie, sealed...)
+	clientObfuscator.ObfuscateClientToServer(cookie[seedLen:])
+
+	_, err = getMeekCookiePayload(mockSupport, base64.StdEncoding.EncodeToString(cookie))
+	if err != nil {
+		f.Fatalf("getMeekCookiePayload failed: %s", err)
+	}
+
+	f.Add(cookie)
+	f.Add(cookie[:seedLen])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		// The fuzz input is the decoded cookie value; base64 encoding is
+		// applied here so that inputs aren't mostly rejected by the decoder.
+
+		_, _ = getMeekCookiePayload(mockSupport, base64.StdEncoding.EncodeToString(data))
+	})
+}
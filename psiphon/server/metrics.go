@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	golanglog "log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	METRICS_SERVER_IO_TIMEOUT = 10 * time.Second
+)
+
+// geoIPLookupDurationBuckets are the upper bounds, in seconds, of the GeoIP
+// lookup duration histogram buckets.
+var geoIPLookupDurationBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01}
+
+// serverMetrics records counters and timings that are exported by the
+// metrics server. Gauges, such as established tunnels and active port
+// forwards, are read directly from the tunnel server when metrics are
+// exported.
+//
+// As with log, serverMetrics is a singleton, which allows metrics to be
+// recorded by components, such as GeoIPService, that don't reference the
+// tunnel server.
+type serverMetrics struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	apiHandshakeFailures    int64
+	udpgwSessions           int64
+	mutex                   sync.Mutex
+	acceptedTunnels         map[string]int64
+	sshHandshakeFailures    map[string]int64
+	geoIPLookupBucketCounts []int64
+	geoIPLookupCount        int64
+	geoIPLookupSum          float64
+}
+
+var metrics = &serverMetrics{
+	acceptedTunnels:         make(map[string]int64),
+	sshHandshakeFailures:    make(map[string]int64),
+	geoIPLookupBucketCounts: make([]int64, len(geoIPLookupDurationBuckets)),
+}
+
+func (m *serverMetrics) acceptedTunnel(tunnelProtocol string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.acceptedTunnels[tunnelProtocol] += 1
+}
+
+func (m *serverMetrics) sshHandshakeFailed(tunnelProtocol string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sshHandshakeFailures[tunnelProtocol] += 1
+}
+
+func (m *serverMetrics) apiHandshakeFailed() {
+	atomic.AddInt64(&m.apiHandshakeFailures, 1)
+}
+
+func (m *serverMetrics) startedUDPGWSession() {
+	atomic.AddInt64(&m.udpgwSessions, 1)
+}
+
+func (m *serverMetrics) stoppedUDPGWSession() {
+	atomic.AddInt64(&m.udpgwSessions, -1)
+}
+
+func (m *serverMetrics) observeGeoIPLookup(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	seconds := duration.Seconds()
+	for i, bound := range geoIPLookupDurationBuckets {
+		if seconds <= bound {
+			m.geoIPLookupBucketCounts[i] += 1
+			break
+		}
+	}
+	m.geoIPLookupCount += 1
+	m.geoIPLookupSum += seconds
+}
+
+// RunMetricsServer runs an HTTP server which exports psiphond metrics, at
+// "/metrics", in the Prometheus text exposition format. The server listens
+// on Config.MetricsListenAddress and has no authentication, so it should be
+// bound to a private interface.
+func RunMetricsServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) error {
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writer := bufio.NewWriter(w)
+		writeMetrics(writer, support.TunnelServer)
+		writer.Flush()
+	})
+
+	logWriter := NewLogWriter()
+	defer logWriter.Close()
+
+	server := &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  METRICS_SERVER_IO_TIMEOUT,
+		WriteTimeout: METRICS_SERVER_IO_TIMEOUT,
+		ErrorLog:     golanglog.New(logWriter, "", 0),
+	}
+
+	localAddress := support.Config.MetricsListenAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("starting")
+
+	err = nil
+	errors := make(chan error)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.Serve(listener)
+
+		// See comment in RunWebServer.
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				select {
+				case errors <- common.ContextError(err):
+				default:
+				}
+			}
+		}
+
+		log.WithContextFields(
+			LogFields{"localAddress": localAddress}).Info("stopped")
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errors:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("exiting")
+
+	return err
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format.
+func writeMetrics(writer *bufio.Writer, tunnelServer *TunnelServer) {
+
+	metrics.mutex.Lock()
+	acceptedTunnels := copyMetricsMap(metrics.acceptedTunnels)
+	sshHandshakeFailures := copyMetricsMap(metrics.sshHandshakeFailures)
+	geoIPLookupBucketCounts := append([]int64(nil), metrics.geoIPLookupBucketCounts...)
+	geoIPLookupCount := metrics.geoIPLookupCount
+	geoIPLookupSum := metrics.geoIPLookupSum
+	metrics.mutex.Unlock()
+
+	writeMetricsFamily(
+		writer, "psiphond_accepted_tunnels_total", "counter",
+		"Accepted client connections, by tunnel protocol.")
+	writeMetricsValues(writer, "psiphond_accepted_tunnels_total", "protocol", acceptedTunnels)
+
+	writeMetricsFamily(
+		writer, "psiphond_ssh_handshake_failures_total", "counter",
+		"Failed SSH handshakes, by tunnel protocol.")
+	writeMetricsValues(writer, "psiphond_ssh_handshake_failures_total", "protocol", sshHandshakeFailures)
+
+	writeMetricsFamily(
+		writer, "psiphond_api_handshake_failures_total", "counter",
+		"Failed Psiphon API handshake requests.")
+	fmt.Fprintf(writer, "psiphond_api_handshake_failures_total %d\n",
+		atomic.LoadInt64(&metrics.apiHandshakeFailures))
+
+	if tunnelServer != nil {
+
+		establishedTunnels, portForwards := tunnelServer.sshServer.getMetricsStats()
+
+		writeMetricsFamily(
+			writer, "psiphond_established_tunnels", "gauge",
+			"Established tunnels, by tunnel protocol.")
+		writeMetricsValues(writer, "psiphond_established_tunnels", "protocol", establishedTunnels)
+
+		writeMetricsFamily(
+			writer, "psiphond_port_forwards", "gauge",
+			"Active port forwards, by type.")
+		writeMetricsValues(writer, "psiphond_port_forwards", "type", portForwards)
+	}
+
+	writeMetricsFamily(
+		writer, "psiphond_udpgw_sessions", "gauge",
+		"Active udpgw sessions and UDP channels, each multiplexing UDP port forwards for one client.")
+	fmt.Fprintf(writer, "psiphond_udpgw_sessions %d\n",
+		atomic.LoadInt64(&metrics.udpgwSessions))
+
+	writeMetricsFamily(
+		writer, "psiphond_geoip_lookup_duration_seconds", "histogram",
+		"GeoIP lookup durations.")
+	cumulativeCount := int64(0)
+	for i, bound := range geoIPLookupDurationBuckets {
+		cumulativeCount += geoIPLookupBucketCounts[i]
+		fmt.Fprintf(writer, "psiphond_geoip_lookup_duration_seconds_bucket{le=\"%g\"} %d\n",
+			bound, cumulativeCount)
+	}
+	fmt.Fprintf(writer, "psiphond_geoip_lookup_duration_seconds_bucket{le=\"+Inf\"} %d\n",
+		geoIPLookupCount)
+	fmt.Fprintf(writer, "psiphond_geoip_lookup_duration_seconds_sum %g\n", geoIPLookupSum)
+	fmt.Fprintf(writer, "psiphond_geoip_lookup_duration_seconds_count %d\n", geoIPLookupCount)
+}
+
+func copyMetricsMap(m map[string]int64) map[string]int64 {
+	c := make(map[string]int64)
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+func writeMetricsFamily(writer *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(writer, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeMetricsValues(
+	writer *bufio.Writer, name, labelName string, values map[string]int64) {
+
+	// Sort for stable output.
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(writer, "%s{%s=\"%s\"} %d\n",
+			name, labelName, escapeMetricsLabelValue(labelValue), values[labelValue])
+	}
+}
+
+var metricsLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricsLabelValue(value string) string {
+	return metricsLabelValueEscaper.Replace(value)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+
+	metrics.acceptedTunnel("OSSH")
+	metrics.sshHandshakeFailed("OSSH")
+	metrics.apiHandshakeFailed()
+	metrics.startedUDPGWSession()
+	metrics.observeGeoIPLookup(2 * time.Millisecond)
+
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	writeMetrics(writer, nil)
+	writer.Flush()
+
+	metrics.stoppedUDPGWSession()
+
+	output := buffer.String()
+
+	for _, expected := range []string{
+		"# TYPE psiphond_accepted_tunnels_total counter\n",
+		"psiphond_accepted_tunnels_total{protocol=\"OSSH\"} ",
+		"psiphond_ssh_handshake_failures_total{protocol=\"OSSH\"} ",
+		"psiphond_api_handshake_failures_total ",
+		"psiphond_udpgw_sessions ",
+		"# TYPE psiphond_geoip_lookup_duration_seconds histogram\n",
+		"psiphond_geoip_lookup_duration_seconds_bucket{le=\"+Inf\"} ",
+		"psiphond_geoip_lookup_duration_seconds_count ",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("missing %q in metrics output:\n%s", expected, output)
+		}
+	}
+
+	if escapeMetricsLabelValue("a\"b\\c\n") != `a\"b\\c\n` {
+		t.Fatalf("unexpected label value escaping")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestPreviousServerKeys(t *testing.T) {
+
+	generateConfig := func() *Config {
+		configJSON, _, _, _, _, err := GenerateConfig(
+			&GenerateConfigParams{
+				ServerIPAddress:     "127.0.0.1",
+				TunnelProtocolPorts: map[string]int{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 4000},
+			})
+		if err != nil {
+			t.Fatalf("GenerateConfig failed: %s", err)
+		}
+		config, err := LoadConfig(configJSON)
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		return config
+	}
+
+	config := generateConfig()
+	previousConfig := generateConfig()
+
+	previousKeys := &ServerKeys{
+		SSHPrivateKey:    previousConfig.SSHPrivateKey,
+		SSHUserName:      previousConfig.SSHUserName,
+		SSHPassword:      previousConfig.SSHPassword,
+		ObfuscatedSSHKey: previousConfig.ObfuscatedSSHKey,
+	}
+
+	config.PreviousServerKeys = []*ServerKeys{
+		previousKeys,
+		// Duplicate and blank keys are ignored.
+		previousKeys,
+		{},
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+
+	config, err = LoadConfig(configJSON)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	previousObfuscatedSSHKeys := config.GetPreviousObfuscatedSSHKeys()
+	if len(previousObfuscatedSSHKeys) != 1 ||
+		previousObfuscatedSSHKeys[0] != previousConfig.ObfuscatedSSHKey {
+
+		t.Fatalf("unexpected previous Obfuscated SSH keys: %+v", previousObfuscatedSSHKeys)
+	}
+
+	sshServer, err := newSSHServer(&SupportServices{Config: config}, nil)
+	if err != nil {
+		t.Fatalf("newSSHServer failed: %s", err)
+	}
+
+	currentHostKey := sshServer.getSSHHostKey(config.ObfuscatedSSHKey).PublicKey().Marshal()
+	previousHostKey := sshServer.getSSHHostKey(previousConfig.ObfuscatedSSHKey).PublicKey().Marshal()
+	unobfuscatedHostKey := sshServer.getSSHHostKey("").PublicKey().Marshal()
+
+	if bytes.Equal(currentHostKey, previousHostKey) ||
+		!bytes.Equal(currentHostKey, unobfuscatedHostKey) {
+
+		t.Fatalf("unexpected SSH host keys")
+	}
+
+	// A previous SSH host key that can't be selected by a distinct
+	// Obfuscated SSH key is rejected.
+
+	config.PreviousServerKeys = []*ServerKeys{
+		{SSHPrivateKey: previousConfig.SSHPrivateKey},
+	}
+
+	configJSON, err = json.Marshal(config)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+
+	_, err = LoadConfig(configJSON)
+	if err == nil {
+		t.Fatalf("unexpected LoadConfig success")
+	}
+}
@@ -20,6 +20,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -44,12 +45,14 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpchannel"
 	"golang.org/x/net/proxy"
 )
 
 var serverIPAddress, testDataDirName string
 var mockWebServerURL, mockWebServerExpectedResponse string
 var mockWebServerPort = 8080
+var mockUDPServerPort = 8123
 
 func TestMain(m *testing.M) {
 	flag.Parse()
@@ -81,7 +84,12 @@ func TestMain(m *testing.M) {
 
 	psiphon.SetEmitDiagnosticNotices(true)
 
-	mockWebServerURL, mockWebServerExpectedResponse = runMockWebServer()
+	// Fuzz worker processes only run fuzz targets, and must not contend with
+	// the coordinating process for the fixed mock web server port.
+	fuzzWorker := flag.Lookup("test.fuzzworker")
+	if fuzzWorker == nil || fuzzWorker.Value.String() != "true" {
+		mockWebServerURL, mockWebServerExpectedResponse = runMockWebServer()
+	}
 
 	os.Exit(m.Run())
 }
@@ -364,6 +372,22 @@ func TestUnusedAuthorization(t *testing.T) {
 		})
 }
 
+func TestTrafficGroup(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          true,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: true,
+			doTrafficGroup:       true,
+		})
+}
+
 func TestTCPOnlySLOK(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -379,6 +403,22 @@ func TestTCPOnlySLOK(t *testing.T) {
 		})
 }
 
+func TestUDPChannel(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			doUDPChannel:         true,
+		})
+}
+
 func TestUDPOnlySLOK(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -405,6 +445,8 @@ type runServerConfig struct {
 	omitAuthorization    bool
 	doTunneledWebRequest bool
 	doTunneledNTPRequest bool
+	doTrafficGroup       bool
+	doUDPChannel         bool
 }
 
 func runServer(t *testing.T, runConfig *runServerConfig) {
@@ -493,9 +535,14 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	// must handshake with specified sponsor ID in order to allow ports for tunneled
 	// requests.
 	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+	trafficGroupSponsorID := ""
+	if runConfig.doTrafficGroup {
+		trafficGroupSponsorID = sponsorID
+	}
 	paveTrafficRulesFile(
 		t, trafficRulesFilename, propagationChannelID, accessType,
-		runConfig.requireAuthorization, runConfig.denyTrafficRules)
+		runConfig.requireAuthorization, runConfig.denyTrafficRules,
+		trafficGroupSponsorID)
 
 	var tacticsConfigFilename string
 
@@ -519,7 +566,9 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	if doTactics {
 		serverConfig["TacticsConfigFilename"] = tacticsConfigFilename
 	}
-	serverConfig["LogFilename"] = filepath.Join(testDataDirName, "psiphond.log")
+	logFilename := filepath.Join(testDataDirName, "psiphond.log")
+	os.Remove(logFilename)
+	serverConfig["LogFilename"] = logFilename
 	serverConfig["LogLevel"] = "debug"
 
 	serverConfig["AccessControlVerificationKeyRing"] = accessControlVerificationKeyRing
@@ -580,9 +629,13 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 		propagationChannelID = paveOSLConfigFile(t, oslConfigFilename)
 
+		if runConfig.doTrafficGroup {
+			trafficGroupSponsorID = sponsorID
+		}
 		paveTrafficRulesFile(
 			t, trafficRulesFilename, propagationChannelID, accessType,
-			runConfig.requireAuthorization, runConfig.denyTrafficRules)
+			runConfig.requireAuthorization, runConfig.denyTrafficRules,
+			trafficGroupSponsorID)
 
 		p, _ := os.FindProcess(os.Getpid())
 		p.Signal(syscall.SIGUSR1)
@@ -674,6 +727,25 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}
 
+	// The UDP channel udpgw server address is not intercepted by the server,
+	// so UDP is relayed only when the client relays udpgw using a UDP channel.
+	// Note: this case doesn't combine with tactics, which would replace these
+	// parameters.
+
+	udpChannelUdpgwServerAddress := "127.0.0.1:7400"
+
+	if runConfig.doUDPChannel {
+
+		applyParameters := make(map[string]interface{})
+
+		applyParameters[parameters.UDPChannelUdpgwServerAddress] = udpChannelUdpgwServerAddress
+
+		err = clientConfig.SetClientParameters("", false, applyParameters)
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+	}
+
 	err = psiphon.OpenDataStore(clientConfig)
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
@@ -799,6 +871,31 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}
 
+	if runConfig.doUDPChannel {
+
+		// Test: tunneled udpgw UDP packets relayed using a UDP channel
+
+		err = makeTunneledUDPChannelRequest(
+			t, localSOCKSProxyPort, udpChannelUdpgwServerAddress)
+		if err != nil {
+			t.Fatalf("tunneled UDP channel request failed: %s", err)
+		}
+	}
+
+	// Test: client traffic is relayed, and counted, while the client is a
+	// member of a traffic group.
+
+	if runConfig.doTrafficGroup && !expectTrafficFailure {
+
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(syscall.SIGUSR2)
+
+		// TODO: monitor logs for more robust wait-until-logged
+		time.Sleep(1 * time.Second)
+
+		checkTrafficGroupServerLoad(t, logFilename, trafficGroupSponsorID)
+	}
+
 	// Test: await SLOK payload
 
 	if !expectTrafficFailure {
@@ -866,6 +963,84 @@ func makeTunneledNTPRequest(t *testing.T, localSOCKSProxyPort int, udpgwServerAd
 	return err
 }
 
+func makeTunneledUDPChannelRequest(
+	t *testing.T, localSOCKSProxyPort int, udpgwServerAddress string) error {
+
+	// Run a UDP echo server at the same address as the mock web server.
+
+	serverUDPConn, err := net.ListenUDP(
+		"udp", &net.UDPAddr{IP: net.ParseIP(serverIPAddress), Port: mockUDPServerPort})
+	if err != nil {
+		return fmt.Errorf("ListenUDP failed: %s", err)
+	}
+	defer serverUDPConn.Close()
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := serverUDPConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			serverUDPConn.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+
+	dialer, err := proxy.SOCKS5(
+		"tcp", fmt.Sprintf("127.0.0.1:%d", localSOCKSProxyPort), nil, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("proxy.SOCKS5 failed: %s", err)
+	}
+
+	socksTCPConn, err := dialer.Dial("tcp", udpgwServerAddress)
+	if err != nil {
+		return fmt.Errorf("dialer.Dial failed: %s", err)
+	}
+	defer socksTCPConn.Close()
+
+	socksTCPConn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	destinationIP := net.ParseIP(serverIPAddress)
+	flags := uint8(udpchannel.UDPGW_FLAG_IPV6)
+	if destinationIP.To4() != nil {
+		destinationIP = destinationIP.To4()
+		flags = 0
+	}
+
+	udpgwPreambleSize := 7 + len(destinationIP)
+	buffer := make([]byte, udpchannel.UDPGW_MAX_MESSAGE_SIZE)
+	packet := []byte("udp channel test packet")
+	copy(buffer[udpgwPreambleSize:], packet)
+
+	err = udpchannel.WriteUdpgwPreamble(
+		udpgwPreambleSize,
+		flags,
+		0,
+		destinationIP,
+		uint16(mockUDPServerPort),
+		uint16(len(packet)),
+		buffer)
+	if err != nil {
+		return fmt.Errorf("WriteUdpgwPreamble failed: %s", err)
+	}
+
+	_, err = socksTCPConn.Write(buffer[0 : udpgwPreambleSize+len(packet)])
+	if err != nil {
+		return fmt.Errorf("socksTCPConn.Write failed: %s", err)
+	}
+
+	udpgwProtocolMessage, err := udpchannel.ReadUdpgwMessage(socksTCPConn, buffer)
+	if err != nil {
+		return fmt.Errorf("ReadUdpgwMessage failed: %s", err)
+	}
+
+	if !bytes.Equal(udpgwProtocolMessage.Packet, packet) {
+		return fmt.Errorf("unexpected echoed packet")
+	}
+
+	return nil
+}
+
 var nextUDPProxyPort = 7300
 
 func makeTunneledNTPRequestAttempt(
@@ -895,8 +1070,8 @@ func makeTunneledNTPRequestAttempt(
 		}
 		defer serverUDPConn.Close()
 
-		udpgwPreambleSize := 11 // see writeUdpgwPreamble
-		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		udpgwPreambleSize := 11 // see WriteUdpgwPreamble
+		buffer := make([]byte, udpchannel.UDPGW_MAX_MESSAGE_SIZE)
 		packetSize, clientAddr, err := serverUDPConn.ReadFromUDP(
 			buffer[udpgwPreambleSize:])
 		if err != nil {
@@ -921,10 +1096,10 @@ func makeTunneledNTPRequestAttempt(
 
 		flags := uint8(0)
 		if destinationPort == 53 {
-			flags = udpgwProtocolFlagDNS
+			flags = udpchannel.UDPGW_FLAG_DNS
 		}
 
-		err = writeUdpgwPreamble(
+		err = udpchannel.WriteUdpgwPreamble(
 			udpgwPreambleSize,
 			flags,
 			0,
@@ -933,7 +1108,7 @@ func makeTunneledNTPRequestAttempt(
 			uint16(packetSize),
 			buffer)
 		if err != nil {
-			t.Logf("writeUdpgwPreamble for %s failed: %s", destination, err)
+			t.Logf("WriteUdpgwPreamble for %s failed: %s", destination, err)
 			return
 		}
 
@@ -943,13 +1118,13 @@ func makeTunneledNTPRequestAttempt(
 			return
 		}
 
-		udpgwProtocolMessage, err := readUdpgwMessage(socksTCPConn, buffer)
+		udpgwProtocolMessage, err := udpchannel.ReadUdpgwMessage(socksTCPConn, buffer)
 		if err != nil {
-			t.Logf("readUdpgwMessage for %s failed: %s", destination, err)
+			t.Logf("ReadUdpgwMessage for %s failed: %s", destination, err)
 			return
 		}
 
-		_, err = serverUDPConn.WriteToUDP(udpgwProtocolMessage.packet, clientAddr)
+		_, err = serverUDPConn.WriteToUDP(udpgwProtocolMessage.Packet, clientAddr)
 		if err != nil {
 			t.Logf("serverUDPConn.Write for %s failed: %s", destination, err)
 			return
@@ -1096,10 +1271,10 @@ func pavePsinetDatabaseFile(
 
 func paveTrafficRulesFile(
 	t *testing.T, trafficRulesFilename, propagationChannelID, accessType string,
-	requireAuthorization, deny bool) {
+	requireAuthorization, deny bool, trafficGroupSponsorID string) {
 
 	allowTCPPorts := fmt.Sprintf("%d", mockWebServerPort)
-	allowUDPPorts := "53, 123"
+	allowUDPPorts := fmt.Sprintf("53, 123, %d", mockUDPServerPort)
 
 	if deny {
 		allowTCPPorts = "0"
@@ -1146,12 +1321,30 @@ func paveTrafficRulesFile(
                     "AllowUDPPorts" : [%s]
                 }
             }
-        ]
+        ]%s
     }
     `
 
+	trafficGroupFormat := `,
+        "TrafficGroupLimits" : [
+            {
+                "SponsorIDs" : ["%s"],
+                "MaxTCPPortForwardCount" : 100,
+                "MaxUDPPortForwardCount" : 100,
+                "ReadBytesPerSecond" : 1048576,
+                "WriteBytesPerSecond" : 1048576
+            }
+        ]
+	`
+
+	trafficGroup := ""
+	if trafficGroupSponsorID != "" {
+		trafficGroup = fmt.Sprintf(trafficGroupFormat, trafficGroupSponsorID)
+	}
+
 	trafficRulesJSON := fmt.Sprintf(
-		trafficRulesJSONFormat, propagationChannelID, authorizationFilter, allowTCPPorts, allowUDPPorts)
+		trafficRulesJSONFormat, propagationChannelID, authorizationFilter,
+		allowTCPPorts, allowUDPPorts, trafficGroup)
 
 	err := ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
 	if err != nil {
@@ -1159,6 +1352,41 @@ func paveTrafficRulesFile(
 	}
 }
 
+// checkTrafficGroupServerLoad checks that the most recent server_load log
+// for the traffic group, which is keyed by sponsor ID, records client data
+// transfer.
+func checkTrafficGroupServerLoad(
+	t *testing.T, logFilename, trafficGroupSponsorID string) {
+
+	logFileContents, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		t.Fatalf("error reading log file: %s", err)
+	}
+
+	var serverLoad map[string]interface{}
+
+	for _, line := range bytes.Split(logFileContents, []byte("\n")) {
+		var logFields map[string]interface{}
+		if json.Unmarshal(line, &logFields) != nil {
+			continue
+		}
+		if logFields["event_name"] == "server_load" &&
+			logFields["traffic_group"] != nil {
+			serverLoad = logFields
+		}
+	}
+
+	if serverLoad == nil {
+		t.Fatalf("missing traffic group server_load for %s", trafficGroupSponsorID)
+	}
+
+	bytesRead, _ := serverLoad["bytes_read"].(float64)
+	bytesWritten, _ := serverLoad["bytes_written"].(float64)
+	if bytesRead <= 0 || bytesWritten <= 0 {
+		t.Fatalf("unexpected traffic group server_load: %+v", serverLoad)
+	}
+}
+
 var expectedNumSLOKs = 3
 
 func paveOSLConfigFile(t *testing.T, oslConfigFilename string) string {
@@ -159,6 +159,18 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunMetricsServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := RunMetricsServer(supportServices, shutdownBroadcast)
+			select {
+			case errors <- err:
+			default:
+			}
+		}()
+	}
+
 	// The tunnel server is always run; it launches multiple
 	// listeners, depending on which tunnel protocols are enabled.
 	waitGroup.Add(1)
@@ -196,9 +208,11 @@ func RunServices(configJSON []byte) error {
 	systemStopSignal := make(chan os.Signal, 1)
 	signal.Notify(systemStopSignal, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	// SIGUSR1 triggers a reload of support services
+	// SIGUSR1 or SIGHUP triggers a reload of support services. SIGHUP is the
+	// conventional daemon reload signal, as used by service managers.
+	// Established tunnels are not dropped by a reload.
 	reloadSupportServicesSignal := make(chan os.Signal, 1)
-	signal.Notify(reloadSupportServicesSignal, syscall.SIGUSR1)
+	signal.Notify(reloadSupportServicesSignal, syscall.SIGUSR1, syscall.SIGHUP)
 
 	// SIGUSR2 triggers an immediate load log and optional process profile output
 	logServerLoadSignal := make(chan os.Signal, 1)
@@ -212,6 +226,14 @@ func RunServices(configJSON []byte) error {
 	resumeEstablishingTunnelsSignal := make(chan os.Signal, 1)
 	signal.Notify(resumeEstablishingTunnelsSignal, syscall.SIGCONT)
 
+	// SIGQUIT triggers a graceful drain: tunnelServer stops establishing new
+	// tunnels and, once all established clients have disconnected or the
+	// drain grace period has expired, an orderly shutdown follows.
+	drainSignal := make(chan os.Signal, 1)
+	signal.Notify(drainSignal, syscall.SIGQUIT)
+	drained := make(chan struct{})
+	draining := false
+
 	err = nil
 
 loop:
@@ -226,6 +248,22 @@ loop:
 		case <-reloadSupportServicesSignal:
 			supportServices.Reload()
 
+		case <-drainSignal:
+			if draining {
+				break
+			}
+			draining = true
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				tunnelServer.Drain(config.GetDrainGracePeriod())
+				close(drained)
+			}()
+
+		case <-drained:
+			log.WithContext().Info("shutdown after drain")
+			break loop
+
 		case <-logServerLoadSignal:
 			// Signal profiles writes first to ensure some diagnostics are
 			// available in case logServerLoad hangs (which has happened
@@ -390,6 +428,20 @@ func logServerLoad(server *TunnelServer) {
 
 		log.LogRawFieldsWithTimestamp(serverLoad)
 	}
+
+	for group, stats := range server.GetTrafficGroupStats() {
+
+		serverLoad := LogFields{
+			"event_name":    "server_load",
+			"traffic_group": group,
+		}
+
+		for name, value := range stats {
+			serverLoad[name] = value
+		}
+
+		log.LogRawFieldsWithTimestamp(serverLoad)
+	}
 }
 
 // SupportServices carries common and shared data components
@@ -458,9 +510,9 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 	}, nil
 }
 
-// Reload reinitializes traffic rules, psinet database, and geo IP database
-// components. If any component fails to reload, an error is logged and
-// Reload proceeds, using the previous state of the component.
+// Reload reinitializes traffic rules, OSL config, psinet database, tactics,
+// and geo IP database components. If any component fails to reload, an error
+// is logged and Reload proceeds, using the previous state of the component.
 func (support *SupportServices) Reload() {
 
 	reloaders := append(
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	SESSION_RESUMPTION_KEY_SIZE    = 32
+	DEFAULT_SESSION_RESUMPTION_TTL = 1 * time.Hour
+)
+
+// sessionResumptionState is the handshake state recorded in a session
+// resumption token. A client that presents a valid token in a subsequent
+// handshake with the same server, with the same sponsor, platform, and
+// region, receives a resumed handshake response, which omits the sponsor
+// home pages, stats regexes, and discovered server entries; the client
+// reuses the values it received in the original handshake.
+type sessionResumptionState struct {
+	SponsorID         string `json:"s"`
+	ClientPlatform    string `json:"p"`
+	ClientRegion      string `json:"r"`
+	ExpectDomainBytes bool   `json:"d"`
+	Expiry            int64  `json:"e"`
+}
+
+// makeSessionResumptionToken creates a token, authenticated with key, which
+// encodes the specified state.
+func makeSessionResumptionToken(
+	key []byte, state *sessionResumptionState) (string, error) {
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySessionResumptionToken authenticates the token and returns its
+// state. An error is returned when the token is invalid or expired.
+func verifySessionResumptionToken(
+	key []byte, token string, now time.Time) (*sessionResumptionState, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, common.ContextError(errors.New("invalid token"))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	tag, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, common.ContextError(errors.New("invalid token MAC"))
+	}
+
+	var state *sessionResumptionState
+	err = json.Unmarshal(payload, &state)
+	if err != nil || state == nil {
+		return nil, common.ContextError(errors.New("invalid token payload"))
+	}
+
+	if now.Unix() >= state.Expiry {
+		return nil, common.ContextError(errors.New("expired token"))
+	}
+
+	return state, nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestSessionResumptionToken(t *testing.T) {
+
+	key, err := common.MakeSecureRandomBytes(SESSION_RESUMPTION_KEY_SIZE)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	otherKey, err := common.MakeSecureRandomBytes(SESSION_RESUMPTION_KEY_SIZE)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	now := time.Now()
+
+	state := &sessionResumptionState{
+		SponsorID:         "SPONSOR",
+		ClientPlatform:    "Windows",
+		ClientRegion:      "US",
+		ExpectDomainBytes: true,
+		Expiry:            now.Add(DEFAULT_SESSION_RESUMPTION_TTL).Unix(),
+	}
+
+	token, err := makeSessionResumptionToken(key, state)
+	if err != nil {
+		t.Fatalf("makeSessionResumptionToken failed: %s", err)
+	}
+
+	verifiedState, err := verifySessionResumptionToken(key, token, now)
+	if err != nil {
+		t.Fatalf("verifySessionResumptionToken failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(state, verifiedState) {
+		t.Fatalf("unexpected state: %+v", verifiedState)
+	}
+
+	_, err = verifySessionResumptionToken(otherKey, token, now)
+	if err == nil {
+		t.Fatalf("unexpected success with other key")
+	}
+
+	_, err = verifySessionResumptionToken(
+		key, token, now.Add(DEFAULT_SESSION_RESUMPTION_TTL))
+	if err == nil {
+		t.Fatalf("unexpected success with expired token")
+	}
+
+	// A modified payload fails authentication.
+
+	otherState := *state
+	otherState.SponsorID = "OTHER"
+	otherToken, err := makeSessionResumptionToken(otherKey, &otherState)
+	if err != nil {
+		t.Fatalf("makeSessionResumptionToken failed: %s", err)
+	}
+
+	tamperedToken := strings.Split(otherToken, ".")[0] + "." + strings.Split(token, ".")[1]
+
+	_, err = verifySessionResumptionToken(key, tamperedToken, now)
+	if err == nil {
+		t.Fatalf("unexpected success with tampered token")
+	}
+
+	for _, malformedToken := range []string{"", ".", token + ".", "!." + strings.Split(token, ".")[1]} {
+		_, err = verifySessionResumptionToken(key, malformedToken, now)
+		if err == nil {
+			t.Fatalf("unexpected success with malformed token: %s", malformedToken)
+		}
+	}
+}
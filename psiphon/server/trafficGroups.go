@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/ratelimit"
+)
+
+// trafficGroups tracks the aggregate state of traffic groups, sets of
+// clients that share the limits specified in TrafficGroupLimits. Groups are
+// created when the first client joins and discarded when the last client
+// leaves and all of the group's port forwards have closed.
+type trafficGroups struct {
+	mutex  sync.Mutex
+	groups map[string]*trafficGroup
+}
+
+type trafficGroupBuckets struct {
+	read  *ratelimit.Bucket
+	write *ratelimit.Bucket
+}
+
+type trafficGroup struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesRead                     int64
+	bytesWritten                  int64
+	key                           string
+	limits                        TrafficGroupLimits
+	buckets                       atomic.Value
+	clientCount                   int64
+	concurrentTCPPortForwardCount int64
+	concurrentUDPPortForwardCount int64
+	rejectedTCPPortForwardCount   int64
+	rejectedUDPPortForwardCount   int64
+}
+
+func newTrafficGroups() *trafficGroups {
+	return &trafficGroups{
+		groups: make(map[string]*trafficGroup),
+	}
+}
+
+// join adds a client to the specified group, creating the group as
+// required. When the group limits have changed, the new limits are applied.
+func (groups *trafficGroups) join(
+	key string, limits *TrafficGroupLimits) *trafficGroup {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	group, ok := groups.groups[key]
+	if !ok {
+		group = &trafficGroup{key: key}
+		group.setLimits(limits)
+		groups.groups[key] = group
+	} else {
+		group.updateLimits(limits)
+	}
+
+	group.clientCount += 1
+
+	return group
+}
+
+// update applies the specified limits to an existing group when the limits
+// have changed, due to a traffic rules hot reload.
+func (groups *trafficGroups) update(
+	group *trafficGroup, limits *TrafficGroupLimits) {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	group.updateLimits(limits)
+}
+
+// leave removes a client from the group.
+func (groups *trafficGroups) leave(group *trafficGroup) {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	group.clientCount -= 1
+	groups.discardIfUnused(group)
+}
+
+// allocatePortForward reserves a port forward slot in the group. When the
+// group is at its port forward limit, the slot is not reserved and
+// allocatePortForward returns false. releasePortForward must be called for
+// each successful allocatePortForward call.
+func (groups *trafficGroups) allocatePortForward(
+	group *trafficGroup, portForwardType int) bool {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	max := group.limits.MaxTCPPortForwardCount
+	count := &group.concurrentTCPPortForwardCount
+	rejectedCount := &group.rejectedTCPPortForwardCount
+	if portForwardType == portForwardTypeUDP {
+		max = group.limits.MaxUDPPortForwardCount
+		count = &group.concurrentUDPPortForwardCount
+		rejectedCount = &group.rejectedUDPPortForwardCount
+	}
+
+	if max > 0 && *count >= int64(max) {
+		*rejectedCount += 1
+		return false
+	}
+
+	*count += 1
+
+	return true
+}
+
+// releasePortForward releases a port forward slot reserved by
+// allocatePortForward.
+func (groups *trafficGroups) releasePortForward(
+	group *trafficGroup, portForwardType int) {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	if portForwardType == portForwardTypeTCP {
+		group.concurrentTCPPortForwardCount -= 1
+	} else {
+		group.concurrentUDPPortForwardCount -= 1
+	}
+	groups.discardIfUnused(group)
+}
+
+func (groups *trafficGroups) discardIfUnused(group *trafficGroup) {
+
+	// Port forwards may outlive the client's group membership, as clients may
+	// move to another group after a handshake or a traffic rules hot reload.
+	// The group is only discarded when no port forwards remain. A new group
+	// with the same key may have been created in the meantime.
+
+	if group.clientCount == 0 &&
+		group.concurrentTCPPortForwardCount == 0 &&
+		group.concurrentUDPPortForwardCount == 0 &&
+		groups.groups[group.key] == group {
+
+		delete(groups.groups, group.key)
+	}
+}
+
+// getStats returns a snapshot of the current state of each group, keyed by
+// group key, for server load logging.
+func (groups *trafficGroups) getStats() map[string]map[string]int64 {
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+
+	stats := make(map[string]map[string]int64)
+
+	for key, group := range groups.groups {
+		stats[key] = map[string]int64{
+			"clients":                    group.clientCount,
+			"tcp_port_forwards":          group.concurrentTCPPortForwardCount,
+			"udp_port_forwards":          group.concurrentUDPPortForwardCount,
+			"rejected_tcp_port_forwards": group.rejectedTCPPortForwardCount,
+			"rejected_udp_port_forwards": group.rejectedUDPPortForwardCount,
+			"bytes_read":                 atomic.LoadInt64(&group.bytesRead),
+			"bytes_written":              atomic.LoadInt64(&group.bytesWritten),
+			"max_tcp_port_forwards":      int64(group.limits.MaxTCPPortForwardCount),
+			"max_udp_port_forwards":      int64(group.limits.MaxUDPPortForwardCount),
+			"read_bytes_per_second":      group.limits.ReadBytesPerSecond,
+			"write_bytes_per_second":     group.limits.WriteBytesPerSecond,
+		}
+	}
+
+	return stats
+}
+
+func (group *trafficGroup) setLimits(limits *TrafficGroupLimits) {
+
+	// Callers must hold the trafficGroups mutex. The rate limit buckets are
+	// read by trafficGroupConn without the mutex, so they're replaced
+	// atomically.
+
+	group.limits = *limits
+
+	buckets := &trafficGroupBuckets{}
+	if limits.ReadBytesPerSecond > 0 {
+		buckets.read = ratelimit.NewBucketWithRate(
+			float64(limits.ReadBytesPerSecond), limits.ReadBytesPerSecond)
+	}
+	if limits.WriteBytesPerSecond > 0 {
+		buckets.write = ratelimit.NewBucketWithRate(
+			float64(limits.WriteBytesPerSecond), limits.WriteBytesPerSecond)
+	}
+	group.buckets.Store(buckets)
+}
+
+func (group *trafficGroup) updateLimits(limits *TrafficGroupLimits) {
+
+	// Any rate limit state is reset only when the limits have changed.
+
+	if group.limits.ReadBytesPerSecond != limits.ReadBytesPerSecond ||
+		group.limits.WriteBytesPerSecond != limits.WriteBytesPerSecond ||
+		group.limits.MaxTCPPortForwardCount != limits.MaxTCPPortForwardCount ||
+		group.limits.MaxUDPPortForwardCount != limits.MaxUDPPortForwardCount {
+
+		group.setLimits(limits)
+	}
+}
+
+func (group *trafficGroup) getBuckets() *trafficGroupBuckets {
+	return group.buckets.Load().(*trafficGroupBuckets)
+}
+
+// trafficGroupConn wraps a client net.Conn, applying the aggregate rate
+// limits of the client's current traffic group, if any, and recording
+// group data transfer metrics. As the client's group may change during the
+// lifetime of the connection, the group is looked up for each Read and
+// Write.
+type trafficGroupConn struct {
+	net.Conn
+	sshClient *sshClient
+}
+
+func (conn *trafficGroupConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		group := conn.sshClient.getTrafficGroup()
+		if group != nil {
+			atomic.AddInt64(&group.bytesRead, int64(n))
+			bucket := group.getBuckets().read
+			if bucket != nil {
+				bucket.Wait(int64(n))
+			}
+		}
+	}
+	return n, err
+}
+
+func (conn *trafficGroupConn) Write(buffer []byte) (int, error) {
+	group := conn.sshClient.getTrafficGroup()
+	if group != nil {
+		bucket := group.getBuckets().write
+		if bucket != nil {
+			bucket.Wait(int64(len(buffer)))
+		}
+	}
+	n, err := conn.Conn.Write(buffer)
+	if group != nil {
+		atomic.AddInt64(&group.bytesWritten, int64(n))
+	}
+	return n, err
+}
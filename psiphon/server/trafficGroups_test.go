@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestTrafficGroups(t *testing.T) {
+
+	testDirectory, err := ioutil.TempDir("", "psiphon-traffic-groups-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	trafficRulesFilename := filepath.Join(testDirectory, "traffic_rules.json")
+
+	trafficRulesJSON := `
+    {
+        "TrafficGroupLimits" : [
+            {
+                "SponsorIDs" : ["SPONSOR"],
+                "GroupByRegion" : true,
+                "MaxTCPPortForwardCount" : 1
+            },
+            {
+                "Regions" : ["US", "CA"],
+                "MaxUDPPortForwardCount" : 2,
+                "ReadBytesPerSecond" : 1000
+            }
+        ]
+    }
+    `
+
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	handshaked := handshakeState{
+		completed:   true,
+		apiParams:   common.APIParameters{"sponsor_id": "SPONSOR"},
+		apiProtocol: "ssh",
+	}
+
+	testCases := []struct {
+		region      string
+		state       handshakeState
+		expectedKey string
+	}{
+		{"US", handshakeState{}, "1"},
+		{"CA", handshakeState{}, "1"},
+		{"GB", handshakeState{}, ""},
+		{"US", handshaked, "0-US"},
+		{"GB", handshaked, "0-GB"},
+	}
+
+	for _, testCase := range testCases {
+		key, limits := trafficRulesSet.GetTrafficGroup(
+			GeoIPData{Country: testCase.region}, testCase.state)
+		if key != testCase.expectedKey || (key == "") != (limits == nil) {
+			t.Fatalf("unexpected traffic group for %+v: %s", testCase, key)
+		}
+	}
+
+	// Port forward limits are shared by all group members.
+
+	groups := newTrafficGroups()
+
+	key, limits := trafficRulesSet.GetTrafficGroup(
+		GeoIPData{Country: "US"}, handshaked)
+
+	group1 := groups.join(key, limits)
+	group2 := groups.join(key, limits)
+	if group1 != group2 {
+		t.Fatalf("unexpected distinct groups")
+	}
+
+	if !groups.allocatePortForward(group1, portForwardTypeTCP) {
+		t.Fatalf("unexpected port forward limit exceeded")
+	}
+
+	if groups.allocatePortForward(group2, portForwardTypeTCP) {
+		t.Fatalf("unexpected port forward limit not exceeded")
+	}
+
+	if !groups.allocatePortForward(group2, portForwardTypeUDP) {
+		t.Fatalf("unexpected port forward limit exceeded")
+	}
+
+	stats := groups.getStats()[key]
+	if stats["clients"] != 2 ||
+		stats["tcp_port_forwards"] != 1 ||
+		stats["udp_port_forwards"] != 1 ||
+		stats["rejected_tcp_port_forwards"] != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// The group is retained until all clients have left and all port forwards
+	// have closed.
+
+	groups.leave(group1)
+	groups.leave(group2)
+	groups.releasePortForward(group1, portForwardTypeTCP)
+
+	if len(groups.getStats()) != 1 {
+		t.Fatalf("unexpected discarded group")
+	}
+
+	groups.releasePortForward(group2, portForwardTypeUDP)
+
+	if len(groups.getStats()) != 0 {
+		t.Fatalf("unexpected retained group")
+	}
+
+	// Rate limits are applied and updated.
+
+	key, limits = trafficRulesSet.GetTrafficGroup(
+		GeoIPData{Country: "CA"}, handshakeState{})
+
+	group := groups.join(key, limits)
+
+	if group.getBuckets().read == nil || group.getBuckets().write != nil {
+		t.Fatalf("unexpected rate limits")
+	}
+
+	limits.ReadBytesPerSecond = 0
+	groups.update(group, limits)
+
+	if group.getBuckets().read != nil {
+		t.Fatalf("unexpected rate limits")
+	}
+}
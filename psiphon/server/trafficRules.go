@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -100,6 +101,62 @@ type TrafficRulesSet struct {
 	// A default of 600 is used when
 	// MeekRateLimiterReapHistoryFrequencySeconds is 0.
 	MeekRateLimiterReapHistoryFrequencySeconds int
+
+	// TrafficGroupLimits is an ordered list of aggregate limits which are
+	// shared by groups of clients, keyed by sponsor ID and/or client
+	// region. Unlike TrafficRules, which limit each client individually,
+	// traffic group limits protect server capacity in cases such as regional
+	// surges. Each client is a member of the group defined by the first
+	// matching TrafficGroupLimits, if any.
+	TrafficGroupLimits []TrafficGroupLimits
+}
+
+// TrafficGroupLimits specifies a traffic group and the aggregate limits
+// applied to all clients in the group.
+//
+// Port forward limits are enforced when new port forwards are established:
+// when at the limit, new port forwards are rejected, and existing port
+// forwards are not closed. Rate limits throttle the combined data transfer
+// of all clients in the group.
+type TrafficGroupLimits struct {
+
+	// SponsorIDs is a list of client sponsor IDs that the client must
+	// report in its handshake to be a member of this group. When omitted or
+	// empty, any sponsor ID matches.
+	SponsorIDs []string
+
+	// Regions is a list of client GeoIP countries that the client must
+	// resolve to to be a member of this group. When omitted or empty, any
+	// client region matches.
+	Regions []string
+
+	// GroupBySponsorID specifies that each distinct sponsor ID forms a
+	// separate group, each with its own limits. When false, all matching
+	// sponsor IDs share the same group.
+	GroupBySponsorID bool
+
+	// GroupByRegion specifies that each distinct client region forms a
+	// separate group, each with its own limits. When false, all matching
+	// regions share the same group.
+	GroupByRegion bool
+
+	// ReadBytesPerSecond and WriteBytesPerSecond specify aggregate data
+	// transfer rate limits for all clients in the group. The default, 0, is
+	// no limit.
+	ReadBytesPerSecond  int64
+	WriteBytesPerSecond int64
+
+	// MaxTCPPortForwardCount and MaxUDPPortForwardCount are the maximum
+	// number of port forwards all clients in the group may have open
+	// concurrently. The default, 0, is no limit.
+	MaxTCPPortForwardCount int
+	MaxUDPPortForwardCount int
+}
+
+// requiresHandshake indicates whether group membership depends on the
+// client sponsor ID, which is known only after the handshake.
+func (limits *TrafficGroupLimits) requiresHandshake() bool {
+	return len(limits.SponsorIDs) > 0 || limits.GroupBySponsorID
 }
 
 // TrafficRulesFilter defines a filter to match against client attributes.
@@ -266,6 +323,7 @@ func NewTrafficRulesSet(filename string) (*TrafficRulesSet, error) {
 			set.MeekRateLimiterReapHistoryFrequencySeconds = newSet.MeekRateLimiterReapHistoryFrequencySeconds
 			set.DefaultRules = newSet.DefaultRules
 			set.FilteredRules = newSet.FilteredRules
+			set.TrafficGroupLimits = newSet.TrafficGroupLimits
 
 			return nil
 		})
@@ -328,6 +386,16 @@ func (set *TrafficRulesSet) Validate() error {
 		return common.ContextError(err)
 	}
 
+	for _, limits := range set.TrafficGroupLimits {
+		if limits.ReadBytesPerSecond < 0 ||
+			limits.WriteBytesPerSecond < 0 ||
+			limits.MaxTCPPortForwardCount < 0 ||
+			limits.MaxUDPPortForwardCount < 0 {
+			return common.ContextError(
+				errors.New("TrafficGroupLimits values must be >= 0"))
+		}
+	}
+
 	for _, filteredRule := range set.FilteredRules {
 
 		for paramName := range filteredRule.Filter.HandshakeParameters {
@@ -597,6 +665,59 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	return trafficRules
 }
 
+// GetTrafficGroup determines the traffic group for a client based on its
+// attributes. The returned key identifies the group and the returned limits
+// are a copy of the group's TrafficGroupLimits. When the client is not a
+// member of any group, GetTrafficGroup returns "" and nil.
+//
+// Groups are keyed by the index of the matching TrafficGroupLimits, so a hot
+// reload which reorders TrafficGroupLimits reassigns clients to new groups.
+func (set *TrafficRulesSet) GetTrafficGroup(
+	geoIPData GeoIPData,
+	state handshakeState) (string, *TrafficGroupLimits) {
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	sponsorID := ""
+	if state.completed {
+		sponsorID, _ = getStringRequestParam(state.apiParams, "sponsor_id")
+	}
+
+	for index, limits := range set.TrafficGroupLimits {
+
+		if limits.requiresHandshake() && !state.completed {
+			continue
+		}
+
+		if len(limits.SponsorIDs) > 0 {
+			if !common.Contains(limits.SponsorIDs, sponsorID) {
+				continue
+			}
+		}
+
+		if len(limits.Regions) > 0 {
+			if !common.Contains(limits.Regions, geoIPData.Country) {
+				continue
+			}
+		}
+
+		key := strconv.Itoa(index)
+		if limits.GroupBySponsorID {
+			key += "-" + sponsorID
+		}
+		if limits.GroupByRegion {
+			key += "-" + geoIPData.Country
+		}
+
+		limitsCopy := limits
+
+		return key, &limitsCopy
+	}
+
+	return "", nil
+}
+
 // GetMeekRateLimiterConfig gets a snapshot of the meek rate limiter
 // configuration values.
 func (set *TrafficRulesSet) GetMeekRateLimiterConfig() (int, int, []string, int, int) {
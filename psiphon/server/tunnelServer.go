@@ -63,6 +63,9 @@ const (
 	SSH_SEND_OSL_RETRY_FACTOR             = 2
 	OSL_SESSION_CACHE_TTL                 = 5 * time.Minute
 	MAX_AUTHORIZATIONS                    = 16
+	DEFAULT_DRAIN_GRACE_PERIOD            = 10 * time.Minute
+	DRAIN_CHECK_PERIOD                    = 1 * time.Second
+	DRAIN_PROGRESS_LOG_PERIOD             = 30 * time.Second
 )
 
 // TunnelServer is the main server that accepts Psiphon client
@@ -241,6 +244,12 @@ func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats) {
 	return server.sshServer.getLoadStats()
 }
 
+// GetTrafficGroupStats returns the current state of each traffic group,
+// keyed by group, including client and port forward counts.
+func (server *TunnelServer) GetTrafficGroupStats() map[string]map[string]int64 {
+	return server.sshServer.trafficGroups.getStats()
+}
+
 // ResetAllClientTrafficRules resets all established client traffic rules
 // to use the latest config and client properties. Any existing traffic
 // rule state is lost, including throttling state.
@@ -290,6 +299,13 @@ func (server *TunnelServer) ExpectClientDomainBytes(
 	return server.sshServer.expectClientDomainBytes(sessionID)
 }
 
+// GetServerLoad returns the current server load, as a percentage of
+// Config.ServerLoadEstablishedClientsCapacity, or 0 when no capacity is
+// configured.
+func (server *TunnelServer) GetServerLoad() int {
+	return server.sshServer.getServerLoad()
+}
+
 // SetEstablishTunnels sets whether new tunnels may be established or not.
 // When not establishing, incoming connections are immediately closed.
 func (server *TunnelServer) SetEstablishTunnels(establish bool) {
@@ -301,6 +317,69 @@ func (server *TunnelServer) GetEstablishTunnels() bool {
 	return server.sshServer.getEstablishTunnels()
 }
 
+// Drain stops establishing new tunnels and waits, up to gracePeriod, for
+// established clients to disconnect, logging progress periodically. Drain
+// returns true when all clients disconnected within the grace period, and
+// false when the grace period expired or the server was shutdown. Remaining
+// clients are not stopped by Drain; they are stopped when the tunnel server
+// is shutdown.
+//
+// Drain is intended to be followed by shutdown, allowing operators to take
+// a server out of rotation without abruptly disconnecting all clients.
+func (server *TunnelServer) Drain(gracePeriod time.Duration) bool {
+
+	server.sshServer.setEstablishTunnels(false)
+
+	startTime := monotime.Now()
+	lastProgressLog := startTime
+
+	deadline := time.NewTimer(gracePeriod)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(DRAIN_CHECK_PERIOD)
+	defer ticker.Stop()
+
+	log.WithContextFields(
+		LogFields{
+			"establishedClients": server.sshServer.getEstablishedClientCount(),
+			"gracePeriod":        gracePeriod.String(),
+		}).Info("draining")
+
+	for {
+
+		establishedClients := server.sshServer.getEstablishedClientCount()
+
+		if establishedClients == 0 {
+			log.WithContextFields(
+				LogFields{
+					"elapsedTime": monotime.Since(startTime).String(),
+				}).Info("drained")
+			return true
+		}
+
+		if monotime.Since(lastProgressLog) >= DRAIN_PROGRESS_LOG_PERIOD {
+			log.WithContextFields(
+				LogFields{
+					"establishedClients": establishedClients,
+					"elapsedTime":        monotime.Since(startTime).String(),
+				}).Info("draining")
+			lastProgressLog = monotime.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.WithContextFields(
+				LogFields{
+					"establishedClients": server.sshServer.getEstablishedClientCount(),
+				}).Warning("drain grace period expired")
+			return false
+		case <-server.shutdownBroadcast:
+			return false
+		}
+	}
+}
+
 type sshServer struct {
 	// Note: 64-bit ints used with atomic operations are placed
 	// at the start of struct to ensure 64-bit alignment.
@@ -311,7 +390,7 @@ type sshServer struct {
 	establishTunnels             int32
 	concurrentSSHHandshakes      semaphore.Semaphore
 	shutdownBroadcast            <-chan struct{}
-	sshHostKey                   ssh.Signer
+	serverKeys                   []*sshServerKeys
 	clientsMutex                 sync.Mutex
 	stoppingClients              bool
 	acceptedClientCounts         map[string]map[string]int64
@@ -320,23 +399,76 @@ type sshServer struct {
 	oslSessionCache              *cache.Cache
 	authorizationSessionIDsMutex sync.Mutex
 	authorizationSessionIDs      map[string]string
+	trafficGroups                *trafficGroups
 }
 
-func newSSHServer(
-	support *SupportServices,
-	shutdownBroadcast <-chan struct{}) (*sshServer, error) {
+// sshServerKeys is a set of SSH and obfuscation keys which clients may use.
+// The first set of keys in sshServer.serverKeys is the current set; any
+// additional sets are the previous keys configured for key rotation.
+type sshServerKeys struct {
+	obfuscatedSSHKey string
+	sshHostKey       ssh.Signer
+	sshUserName      string
+	sshPassword      string
+}
+
+func newSSHServerKeys(
+	config *Config, keys *ServerKeys) (*sshServerKeys, error) {
 
-	privateKey, err := ssh.ParseRawPrivateKey([]byte(support.Config.SSHPrivateKey))
+	serverKeys := &sshServerKeys{
+		obfuscatedSSHKey: config.ObfuscatedSSHKey,
+		sshUserName:      config.SSHUserName,
+		sshPassword:      config.SSHPassword,
+	}
+
+	sshPrivateKey := config.SSHPrivateKey
+
+	if keys.ObfuscatedSSHKey != "" {
+		serverKeys.obfuscatedSSHKey = keys.ObfuscatedSSHKey
+	}
+	if keys.SSHUserName != "" {
+		serverKeys.sshUserName = keys.SSHUserName
+	}
+	if keys.SSHPassword != "" {
+		serverKeys.sshPassword = keys.SSHPassword
+	}
+	if keys.SSHPrivateKey != "" {
+		sshPrivateKey = keys.SSHPrivateKey
+	}
+
+	privateKey, err := ssh.ParseRawPrivateKey([]byte(sshPrivateKey))
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
 	// TODO: use cert (ssh.NewCertSigner) for anti-fingerprint?
-	signer, err := ssh.NewSignerFromKey(privateKey)
+	serverKeys.sshHostKey, err = ssh.NewSignerFromKey(privateKey)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
+	return serverKeys, nil
+}
+
+func newSSHServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) (*sshServer, error) {
+
+	currentKeys, err := newSSHServerKeys(support.Config, &ServerKeys{})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	serverKeys := []*sshServerKeys{currentKeys}
+
+	for _, keys := range support.Config.PreviousServerKeys {
+		previousKeys, err := newSSHServerKeys(support.Config, keys)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		serverKeys = append(serverKeys, previousKeys)
+	}
+
 	var concurrentSSHHandshakes semaphore.Semaphore
 	if support.Config.MaxConcurrentSSHHandshakes > 0 {
 		concurrentSSHHandshakes = semaphore.New(support.Config.MaxConcurrentSSHHandshakes)
@@ -360,11 +492,12 @@ func newSSHServer(
 		establishTunnels:        1,
 		concurrentSSHHandshakes: concurrentSSHHandshakes,
 		shutdownBroadcast:       shutdownBroadcast,
-		sshHostKey:              signer,
+		serverKeys:              serverKeys,
 		acceptedClientCounts:    make(map[string]map[string]int64),
 		clients:                 make(map[string]*sshClient),
 		oslSessionCache:         oslSessionCache,
 		authorizationSessionIDs: make(map[string]string),
+		trafficGroups:           newTrafficGroups(),
 	}, nil
 }
 
@@ -507,6 +640,8 @@ func (sshServer *sshServer) registerAcceptedClient(tunnelProtocol, region string
 	}
 
 	sshServer.acceptedClientCounts[tunnelProtocol][region] += 1
+
+	metrics.acceptedTunnel(tunnelProtocol)
 }
 
 func (sshServer *sshServer) unregisterAcceptedClient(tunnelProtocol, region string) {
@@ -580,6 +715,75 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 	client.stop()
 }
 
+func (sshServer *sshServer) getServerLoad() int {
+
+	capacity := sshServer.support.Config.ServerLoadEstablishedClientsCapacity
+	if capacity <= 0 {
+		return 0
+	}
+
+	sshServer.clientsMutex.Lock()
+	establishedClientCount := len(sshServer.clients)
+	sshServer.clientsMutex.Unlock()
+
+	return 100 * establishedClientCount / capacity
+}
+
+// getSSHHostKey returns the SSH host key to present to a client that used
+// the specified Obfuscated SSH key. The current host key is returned for
+// the current key, and for unobfuscated clients, which pass a blank key.
+func (sshServer *sshServer) getSSHHostKey(obfuscatedSSHKey string) ssh.Signer {
+	for _, keys := range sshServer.serverKeys {
+		if keys.obfuscatedSSHKey == obfuscatedSSHKey {
+			return keys.sshHostKey
+		}
+	}
+	return sshServer.serverKeys[0].sshHostKey
+}
+
+func (sshServer *sshServer) getEstablishedClientCount() int {
+
+	sshServer.clientsMutex.Lock()
+	defer sshServer.clientsMutex.Unlock()
+
+	return len(sshServer.clients)
+}
+
+// getMetricsStats returns the current number of established tunnels, by
+// tunnel protocol, and the current number of port forwards, by type, for
+// the metrics server. Unlike getLoadStats, no stats are reset.
+func (sshServer *sshServer) getMetricsStats() (map[string]int64, map[string]int64) {
+
+	sshServer.clientsMutex.Lock()
+	defer sshServer.clientsMutex.Unlock()
+
+	establishedTunnels := make(map[string]int64)
+	for tunnelProtocol := range sshServer.support.Config.TunnelProtocolPorts {
+		establishedTunnels[tunnelProtocol] = 0
+	}
+
+	portForwards := map[string]int64{
+		"dialing_tcp": 0,
+		"tcp":         0,
+		"udp":         0,
+	}
+
+	for _, client := range sshServer.clients {
+
+		client.Lock()
+
+		establishedTunnels[client.tunnelProtocol] += 1
+
+		portForwards["dialing_tcp"] += client.tcpTrafficState.concurrentDialingPortForwardCount
+		portForwards["tcp"] += client.tcpTrafficState.concurrentPortForwardCount
+		portForwards["udp"] += client.udpTrafficState.concurrentPortForwardCount
+
+		client.Unlock()
+	}
+
+	return establishedTunnels, portForwards
+}
+
 type ProtocolStats map[string]map[string]int64
 type RegionStats map[string]map[string]map[string]int64
 
@@ -934,6 +1138,8 @@ type sshClient struct {
 	tcpPortForwardDialingAvailableSignal context.CancelFunc
 	releaseAuthorizations                func()
 	stopTimer                            *time.Timer
+	trafficGroup                         atomic.Value
+	leftTrafficGroup                     bool
 }
 
 type trafficState struct {
@@ -1011,6 +1217,10 @@ func (sshClient *sshClient) run(
 	// Set initial traffic rules, pre-handshake, based on currently known info.
 	sshClient.setTrafficRules()
 
+	// setTrafficRules also joins any traffic group, which must be left when
+	// the client exits.
+	defer sshClient.leaveTrafficGroup()
+
 	// Wrap the base client connection with an ActivityMonitoredConn which will
 	// terminate the connection if no data is received before the deadline. This
 	// timeout is in effect for the entire duration of the SSH connection. Clients
@@ -1036,6 +1246,11 @@ func (sshClient *sshClient) run(
 	throttledConn := common.NewThrottledConn(clientConn, sshClient.rateLimits())
 	clientConn = throttledConn
 
+	// Apply any aggregate traffic group rate limits after the client's own
+	// rate limits.
+
+	clientConn = &trafficGroupConn{Conn: clientConn, sshClient: sshClient}
+
 	// Run the initial [obfuscated] SSH handshake in a goroutine so we can both
 	// respect shutdownBroadcast and implement a specific handshake timeout.
 	// The timeout is to reclaim network resources in case the handshake takes
@@ -1064,7 +1279,6 @@ func (sshClient *sshClient) run(
 			AuthLogCallback:  sshClient.authLogCallback,
 			ServerVersion:    sshClient.sshServer.support.Config.SSHServerVersion,
 		}
-		sshServerConfig.AddHostKey(sshClient.sshServer.sshHostKey)
 
 		if protocol.TunnelProtocolUsesObfuscatedSSH(sshClient.tunnelProtocol) {
 			// This is the list of supported non-Encrypt-then-MAC algorithms from
@@ -1083,21 +1297,31 @@ func (sshClient *sshClient) run(
 		result := &sshNewServerConnResult{}
 
 		// Wrap the connection in an SSH deobfuscator when required.
+		//
+		// The client may use the current or a previous Obfuscated SSH key;
+		// the key used selects the corresponding SSH host key, as specified
+		// in the client's server entry.
+
+		obfuscatedSSHKey := ""
 
 		if protocol.TunnelProtocolUsesObfuscatedSSH(sshClient.tunnelProtocol) {
-			// Note: NewObfuscatedSshConn blocks on network I/O
+			// Note: NewServerObfuscatedSshConn blocks on network I/O
 			// TODO: ensure this won't block shutdown
-			conn, result.err = obfuscator.NewObfuscatedSshConn(
-				obfuscator.OBFUSCATION_CONN_MODE_SERVER,
+			var obfuscatedSSHConn *obfuscator.ObfuscatedSshConn
+			obfuscatedSSHConn, result.err = obfuscator.NewServerObfuscatedSshConn(
 				conn,
 				sshClient.sshServer.support.Config.ObfuscatedSSHKey,
-				nil,
-				nil)
+				sshClient.sshServer.support.Config.GetPreviousObfuscatedSSHKeys())
 			if result.err != nil {
 				result.err = common.ContextError(result.err)
+			} else {
+				conn = obfuscatedSSHConn
+				obfuscatedSSHKey = obfuscatedSSHConn.GetKeyword()
 			}
 		}
 
+		sshServerConfig.AddHostKey(sshClient.sshServer.getSSHHostKey(obfuscatedSSHKey))
+
 		if result.err == nil {
 			result.sshConn, result.channels, result.requests, result.err =
 				ssh.NewServerConn(conn, sshServerConfig)
@@ -1127,6 +1351,7 @@ func (sshClient *sshClient) run(
 		// errors as clients frequently interrupt connections in progress when
 		// client-side load balancing completes a connection to a different server.
 		log.WithContextFields(LogFields{"error": result.err}).Debug("handshake failed")
+		metrics.sshHandshakeFailed(sshClient.tunnelProtocol)
 		return
 	}
 
@@ -1210,13 +1435,23 @@ func (sshClient *sshClient) passwordCallback(conn ssh.ConnMetadata, password []b
 		return nil, common.ContextError(fmt.Errorf("invalid session ID for %q", conn.User()))
 	}
 
-	userOk := (subtle.ConstantTimeCompare(
-		[]byte(conn.User()), []byte(sshClient.sshServer.support.Config.SSHUserName)) == 1)
+	// Credentials from the current or any previous server keys are accepted.
+
+	credentialsOk := false
+	for _, keys := range sshClient.sshServer.serverKeys {
 
-	passwordOk := (subtle.ConstantTimeCompare(
-		[]byte(sshPasswordPayload.SshPassword), []byte(sshClient.sshServer.support.Config.SSHPassword)) == 1)
+		userOk := (subtle.ConstantTimeCompare(
+			[]byte(conn.User()), []byte(keys.sshUserName)) == 1)
 
-	if !userOk || !passwordOk {
+		passwordOk := (subtle.ConstantTimeCompare(
+			[]byte(sshPasswordPayload.SshPassword), []byte(keys.sshPassword)) == 1)
+
+		if userOk && passwordOk {
+			credentialsOk = true
+		}
+	}
+
+	if !credentialsOk {
 		return nil, common.ContextError(fmt.Errorf("invalid password for %q", conn.User()))
 	}
 
@@ -1339,6 +1574,11 @@ func (sshClient *sshClient) runTunnel(
 				responsePayload, err = tactics.MakeSpeedTestResponse(
 					SSH_KEEP_ALIVE_PAYLOAD_MIN_BYTES, SSH_KEEP_ALIVE_PAYLOAD_MAX_BYTES)
 
+			} else if request.Type == protocol.PSIPHON_API_PADDING_REQUEST_NAME {
+
+				// Traffic shaping padding is discarded. Padding requests don't
+				// want a reply, so the following Reply is a no-op.
+
 			} else {
 
 				// All other requests are assumed to be API requests.
@@ -1531,9 +1771,9 @@ func (sshClient *sshClient) runTunnel(
 	// packet tunnel channels are handled by the packet tunnel server
 	// component. Each client may have at most one packet tunnel channel.
 	//
-	// udpgw client connections are dispatched immediately (clients use this for
-	// DNS, so it's essential to not block; and only one udpgw connection is
-	// retained at a time).
+	// udpgw client connections and UDP channels are dispatched immediately
+	// (clients use these for DNS, so it's essential to not block; and only one
+	// udpgw connection or UDP channel is retained at a time).
 	//
 	// All other TCP port forwards are dispatched via the TCP port forward
 	// manager queue.
@@ -1608,6 +1848,20 @@ func (sshClient *sshClient) runTunnel(
 			continue
 		}
 
+		if newChannel.ChannelType() == protocol.UDP_CHANNEL_TYPE {
+
+			// Dispatch immediately. handleUDPChannel runs the UDP channel
+			// protocol in its own worker goroutine.
+
+			waitGroup.Add(1)
+			go func(channel ssh.NewChannel) {
+				defer waitGroup.Done()
+				sshClient.handleUDPChannel(channel, &udpChannelProtocolCodec{})
+			}(newChannel)
+
+			continue
+		}
+
 		if newChannel.ChannelType() != "direct-tcpip" {
 			sshClient.rejectNewChannel(newChannel, "unknown or unsupported channel type")
 			continue
@@ -1641,7 +1895,7 @@ func (sshClient *sshClient) runTunnel(
 			waitGroup.Add(1)
 			go func(channel ssh.NewChannel) {
 				defer waitGroup.Done()
-				sshClient.handleUDPChannel(channel)
+				sshClient.handleUDPChannel(channel, &udpgwCodec{})
 			}(newChannel)
 
 		} else {
@@ -2085,6 +2339,100 @@ func (sshClient *sshClient) setTrafficRules() {
 		sshClient.throttledConn.SetLimits(
 			sshClient.trafficRules.RateLimits.CommonRateLimits())
 	}
+
+	// Traffic group membership may change after the handshake, when the
+	// sponsor ID is known, or after a traffic rules hot reload.
+
+	if sshClient.leftTrafficGroup {
+		return
+	}
+
+	groupKey, groupLimits := sshClient.sshServer.support.TrafficRulesSet.GetTrafficGroup(
+		sshClient.geoIPData,
+		sshClient.handshakeState)
+
+	trafficGroups := sshClient.sshServer.trafficGroups
+
+	group := sshClient.getTrafficGroup()
+
+	if group != nil &&
+		(groupLimits == nil || group.key != groupKey) {
+		trafficGroups.leave(group)
+		group = nil
+	}
+
+	if groupLimits != nil {
+		if group == nil {
+			group = trafficGroups.join(groupKey, groupLimits)
+		} else {
+			// Apply any new limits after a hot reload.
+			trafficGroups.update(group, groupLimits)
+		}
+	}
+
+	sshClient.trafficGroup.Store(group)
+}
+
+// getTrafficGroup returns the client's current traffic group, or nil when
+// the client is not a member of any group.
+//
+// getTrafficGroup doesn't lock the sshClient, as it's called for every
+// client conn Read and Write, including writes made by SSH channel
+// operations, such as Close, that are invoked while holding the lock.
+// Changes to the group are made while holding the lock and published with
+// an atomic store.
+func (sshClient *sshClient) getTrafficGroup() *trafficGroup {
+	group, _ := sshClient.trafficGroup.Load().(*trafficGroup)
+	return group
+}
+
+// leaveTrafficGroup removes the client from its traffic group, if any.
+// Subsequent setTrafficRules calls will not rejoin a group.
+func (sshClient *sshClient) leaveTrafficGroup() {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	group := sshClient.getTrafficGroup()
+	if group != nil {
+		sshClient.sshServer.trafficGroups.leave(group)
+		sshClient.trafficGroup.Store((*trafficGroup)(nil))
+	}
+	sshClient.leftTrafficGroup = true
+}
+
+// allocateTrafficGroupPortForward reserves a port forward slot in the
+// client's traffic group. When the group is at its port forward limit,
+// allocateTrafficGroupPortForward returns false. Otherwise, the caller must
+// call releaseTrafficGroupPortForward with the returned group, which may be
+// nil, when the port forward is closed.
+func (sshClient *sshClient) allocateTrafficGroupPortForward(
+	portForwardType int) (*trafficGroup, bool) {
+
+	group := sshClient.getTrafficGroup()
+	if group == nil {
+		return nil, true
+	}
+
+	if !sshClient.sshServer.trafficGroups.allocatePortForward(group, portForwardType) {
+		log.WithContextFields(
+			LogFields{
+				"type":          portForwardType,
+				"traffic_group": group.key,
+			}).Debug("port forward denied by traffic group limit")
+		return nil, false
+	}
+
+	return group, true
+}
+
+func (sshClient *sshClient) releaseTrafficGroupPortForward(
+	group *trafficGroup, portForwardType int) {
+
+	if group == nil {
+		return
+	}
+
+	sshClient.sshServer.trafficGroups.releasePortForward(group, portForwardType)
 }
 
 // setOSLConfig resets the client's OSL seed state based on the latest OSL config
@@ -2571,6 +2919,16 @@ func (sshClient *sshClient) handleTCPChannel(
 		return
 	}
 
+	// Enforce any traffic group port forward limit. Unlike the client's own
+	// port forward limit, no LRU port forward is closed to make way.
+
+	group, ok := sshClient.allocateTrafficGroupPortForward(portForwardTypeTCP)
+	if !ok {
+		sshClient.rejectNewChannel(newChannel, "traffic group port forward limit exceeded")
+		return
+	}
+	defer sshClient.releaseTrafficGroupPortForward(group, portForwardTypeTCP)
+
 	// TCP dial.
 
 	remoteAddr := net.JoinHostPort(IP.String(), strconv.Itoa(portToConnect))
@@ -21,8 +21,6 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -32,17 +30,22 @@ import (
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpchannel"
 )
 
 // handleUDPChannel implements UDP port forwarding. A single UDP
-// SSH channel follows the udpgw protocol, which multiplexes many
-// UDP port forwards.
+// SSH channel multiplexes many UDP port forwards, following either
+// the legacy udpgw protocol, for TCP port forwards to the udpgw
+// server address, or the native UDP channel protocol, for
+// protocol.UDP_CHANNEL_TYPE channels. The codec implements the
+// specific protocol.
 //
 // The udpgw protocol and original server implementation:
 // Copyright (c) 2009, Ambroz Bizjak <ambrop7@gmail.com>
 // https://github.com/ambrop72/badvpn
 //
-func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
+func (sshClient *sshClient) handleUDPChannel(
+	newChannel ssh.NewChannel, codec udpChannelCodec) {
 
 	// Accept this channel immediately. This channel will replace any
 	// previously existing UDP channel for this client.
@@ -57,10 +60,14 @@ func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
 
 	sshClient.setUDPChannel(sshChannel)
 
+	metrics.startedUDPGWSession()
+	defer metrics.stoppedUDPGWSession()
+
 	multiplexer := &udpPortForwardMultiplexer{
 		sshClient:      sshClient,
 		sshChannel:     sshChannel,
-		portForwards:   make(map[uint16]*udpPortForward),
+		codec:          codec,
+		portForwards:   make(map[uint32]*udpPortForward),
 		portForwardLRU: common.NewLRUConns(),
 		relayWaitGroup: new(sync.WaitGroup),
 	}
@@ -71,23 +78,25 @@ type udpPortForwardMultiplexer struct {
 	sshClient            *sshClient
 	sshChannelWriteMutex sync.Mutex
 	sshChannel           ssh.Channel
+	codec                udpChannelCodec
 	portForwardsMutex    sync.Mutex
-	portForwards         map[uint16]*udpPortForward
+	portForwards         map[uint32]*udpPortForward
 	portForwardLRU       *common.LRUConns
 	relayWaitGroup       *sync.WaitGroup
 }
 
 func (mux *udpPortForwardMultiplexer) run() {
 
-	// In a loop, read udpgw messages from the client to this channel. Each message is
+	// In a loop, read messages from the client to this channel. Each message is
 	// a UDP packet to send upstream either via a new port forward, or on an existing
 	// port forward.
 	//
 	// A goroutine is run to read downstream packets for each UDP port forward. All read
-	// packets are encapsulated in udpgw protocol and sent down the channel to the client.
+	// packets are encapsulated in the channel protocol and sent down the channel to the
+	// client.
 	//
 	// When the client disconnects or the server shuts down, the channel will close and
-	// readUdpgwMessage will exit with EOF.
+	// readMessage will exit with EOF.
 
 	// Recover from and log any unexpected panics caused by udpgw input handling bugs.
 	// Note: this covers the run() goroutine only and not relayDownstream() goroutines.
@@ -100,15 +109,15 @@ func (mux *udpPortForwardMultiplexer) run() {
 		}
 	}()
 
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	buffer := make([]byte, mux.codec.getMaxMessageSize())
 	for {
 		// Note: message.packet points to the reusable memory in "buffer".
-		// Each readUdpgwMessage call will overwrite the last message.packet.
-		message, err := readUdpgwMessage(mux.sshChannel, buffer)
+		// Each readMessage call will overwrite the last message.packet.
+		message, err := mux.codec.readMessage(mux.sshChannel, buffer)
 		if err != nil {
 			if err != io.EOF {
 				// Debug since I/O errors occur during normal operation
-				log.WithContextFields(LogFields{"error": err}).Debug("readUdpgwMessage failed")
+				log.WithContextFields(LogFields{"error": err}).Debug("readMessage failed")
 			}
 			break
 		}
@@ -117,26 +126,44 @@ func (mux *udpPortForwardMultiplexer) run() {
 		portForward := mux.portForwards[message.connID]
 		mux.portForwardsMutex.Unlock()
 
-		if portForward != nil && message.discardExistingConn {
+		if portForward != nil && (message.discardExistingConn || message.closeConn) {
 			// The port forward's goroutine will complete cleanup, including
 			// tallying stats and calling sshClient.closedPortForward.
-			// portForward.conn.Close() will signal this shutdown.
+			// portForward.conn.Close() will signal this shutdown. The port
+			// forward is removed first so that the client isn't notified of
+			// a closure it requested, and so that a replacement port forward
+			// with the same connID isn't removed by the exiting goroutine.
 			// TODO: wait for goroutine to exit before proceeding?
+			mux.removePortForward(portForward)
 			portForward.conn.Close()
 			portForward = nil
 		}
 
+		if message.closeConn {
+			continue
+		}
+
 		if portForward != nil {
 
 			// Verify that portForward remote address matches latest message
 
-			if 0 != bytes.Compare(portForward.remoteIP, message.remoteIP) ||
-				portForward.remotePort != message.remotePort {
+			if message.remoteIP != nil &&
+				(0 != bytes.Compare(portForward.remoteIP, message.remoteIP) ||
+					portForward.remotePort != message.remotePort) {
 
 				log.WithContext().Warning("UDP port forward remote address mismatch")
 				continue
 			}
 
+		} else if message.remoteIP == nil {
+
+			// The message is for a port forward that no longer exists, and
+			// there's no address with which to create a new port forward.
+			// Notify the client, when supported, so it stops sending.
+
+			mux.writeClosedMessage(message.connID)
+			continue
+
 		} else {
 
 			// Create a new port forward
@@ -157,6 +184,14 @@ func (mux *udpPortForwardMultiplexer) run() {
 				continue
 			}
 
+			// Enforce any traffic group port forward limit. Unlike the client's
+			// own port forward limit, no LRU port forward is closed to make way.
+
+			group, ok := mux.sshClient.allocateTrafficGroupPortForward(portForwardTypeUDP)
+			if !ok {
+				continue
+			}
+
 			// Note: UDP port forward counting has no dialing phase
 
 			// establishedPortForward increments the concurrent UDP port
@@ -176,6 +211,7 @@ func (mux *udpPortForwardMultiplexer) run() {
 				"udp", nil, &net.UDPAddr{IP: dialIP, Port: dialPort})
 			if err != nil {
 				mux.sshClient.closedPortForward(portForwardTypeUDP, 0, 0)
+				mux.sshClient.releaseTrafficGroupPortForward(group, portForwardTypeUDP)
 
 				// Monitor for low resource error conditions
 				mux.sshClient.sshServer.monitorPortForwardDialError(err)
@@ -210,17 +246,18 @@ func (mux *udpPortForwardMultiplexer) run() {
 			if err != nil {
 				lruEntry.Remove()
 				mux.sshClient.closedPortForward(portForwardTypeUDP, 0, 0)
+				mux.sshClient.releaseTrafficGroupPortForward(group, portForwardTypeUDP)
 				log.WithContextFields(LogFields{"error": err}).Error("NewActivityMonitoredConn failed")
 				continue
 			}
 
 			portForward = &udpPortForward{
 				connID:       message.connID,
-				preambleSize: message.preambleSize,
 				remoteIP:     message.remoteIP,
 				remotePort:   message.remotePort,
 				conn:         conn,
 				lruEntry:     lruEntry,
+				trafficGroup: group,
 				bytesUp:      0,
 				bytesDown:    0,
 				mux:          mux,
@@ -247,22 +284,51 @@ func (mux *udpPortForwardMultiplexer) run() {
 		atomic.AddInt64(&portForward.bytesUp, int64(len(message.packet)))
 	}
 
-	// Cleanup all UDP port forward workers when exiting
+	// Cleanup all UDP port forward workers when exiting. The port forwards
+	// are removed first, as there's no need to notify the client of each
+	// closure.
 
 	mux.portForwardsMutex.Lock()
-	for _, portForward := range mux.portForwards {
+	portForwards := mux.portForwards
+	mux.portForwards = make(map[uint32]*udpPortForward)
+	mux.portForwardsMutex.Unlock()
+
+	for _, portForward := range portForwards {
 		// The port forward's goroutine will complete cleanup
 		portForward.conn.Close()
 	}
-	mux.portForwardsMutex.Unlock()
 
 	mux.relayWaitGroup.Wait()
 }
 
-func (mux *udpPortForwardMultiplexer) removePortForward(connID uint16) {
+// removePortForward removes the port forward, returning false when the
+// port forward was already removed or replaced.
+func (mux *udpPortForwardMultiplexer) removePortForward(portForward *udpPortForward) bool {
 	mux.portForwardsMutex.Lock()
-	delete(mux.portForwards, connID)
-	mux.portForwardsMutex.Unlock()
+	defer mux.portForwardsMutex.Unlock()
+	if mux.portForwards[portForward.connID] != portForward {
+		return false
+	}
+	delete(mux.portForwards, portForward.connID)
+	return true
+}
+
+// writeClosedMessage notifies the client that a port forward is closed,
+// when the channel protocol supports such notifications.
+func (mux *udpPortForwardMultiplexer) writeClosedMessage(connID uint32) {
+
+	message := mux.codec.makeClosedMessage(connID)
+	if message == nil {
+		return
+	}
+
+	mux.sshChannelWriteMutex.Lock()
+	_, err := mux.sshChannel.Write(message)
+	mux.sshChannelWriteMutex.Unlock()
+
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Debug("write closed message failed")
+	}
 }
 
 type udpPortForward struct {
@@ -271,12 +337,12 @@ type udpPortForward struct {
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	bytesUp      int64
 	bytesDown    int64
-	connID       uint16
-	preambleSize int
+	connID       uint32
 	remoteIP     []byte
 	remotePort   uint16
 	conn         net.Conn
 	lruEntry     *common.LRUConnsEntry
+	trafficGroup *trafficGroup
 	mux          *udpPortForwardMultiplexer
 }
 
@@ -284,20 +350,22 @@ func (portForward *udpPortForward) relayDownstream() {
 	defer portForward.mux.relayWaitGroup.Done()
 
 	// Downstream UDP packets are read into the reusable memory
-	// in "buffer" starting at the offset past the udpgw message
-	// header and address, leaving enough space to write the udpgw
+	// in "buffer" starting at the offset past the message
+	// preamble, leaving enough space to write the preamble
 	// values into the same buffer and use for writing to the ssh
 	// channel.
 	//
 	// Note: there is one downstream buffer per UDP port forward,
 	// while for upstream there is one buffer per client.
 	// TODO: is the buffer size larger than necessary?
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
-	packetBuffer := buffer[portForward.preambleSize:udpgwProtocolMaxMessageSize]
+	codec := portForward.mux.codec
+	preambleSize := codec.getDownstreamPreambleSize(portForward)
+	buffer := make([]byte, codec.getMaxMessageSize())
+	packetBuffer := buffer[preambleSize:]
 	for {
 		// TODO: if read buffer is too small, excess bytes are discarded?
 		packetSize, err := portForward.conn.Read(packetBuffer)
-		if packetSize > udpgwProtocolMaxPayloadSize {
+		if packetSize > codec.getMaxDownstreamPacketSize(portForward) {
 			err = fmt.Errorf("unexpected packet size: %d", packetSize)
 		}
 		if err != nil {
@@ -308,20 +376,13 @@ func (portForward *udpPortForward) relayDownstream() {
 			break
 		}
 
-		err = writeUdpgwPreamble(
-			portForward.preambleSize,
-			0,
-			portForward.connID,
-			portForward.remoteIP,
-			portForward.remotePort,
-			uint16(packetSize),
-			buffer)
+		err = codec.writeDownstreamPreamble(portForward, packetSize, buffer)
 		if err == nil {
 			// ssh.Channel.Write cannot be called concurrently.
 			// See: https://github.com/Psiphon-Inc/crypto/blob/82d98b4c7c05e81f92545f6fddb45d4541e6da00/ssh/channel.go#L272,
 			// https://codereview.appspot.com/136420043/diff/80002/ssh/channel.go
 			portForward.mux.sshChannelWriteMutex.Lock()
-			_, err = portForward.mux.sshChannel.Write(buffer[0 : portForward.preambleSize+packetSize])
+			_, err = portForward.mux.sshChannel.Write(buffer[0 : preambleSize+packetSize])
 			portForward.mux.sshChannelWriteMutex.Unlock()
 		}
 
@@ -337,7 +398,11 @@ func (portForward *udpPortForward) relayDownstream() {
 		atomic.AddInt64(&portForward.bytesDown, int64(packetSize))
 	}
 
-	portForward.mux.removePortForward(portForward.connID)
+	// When the port forward is closed by the server, such as due to an idle
+	// timeout, and not by the client, notify the client.
+	if portForward.mux.removePortForward(portForward) {
+		portForward.mux.writeClosedMessage(portForward.connID)
+	}
 
 	portForward.lruEntry.Remove()
 
@@ -346,6 +411,8 @@ func (portForward *udpPortForward) relayDownstream() {
 	bytesUp := atomic.LoadInt64(&portForward.bytesUp)
 	bytesDown := atomic.LoadInt64(&portForward.bytesDown)
 	portForward.mux.sshClient.closedPortForward(portForwardTypeUDP, bytesUp, bytesDown)
+	portForward.mux.sshClient.releaseTrafficGroupPortForward(
+		portForward.trafficGroup, portForwardTypeUDP)
 
 	log.WithContextFields(
 		LogFields{
@@ -356,145 +423,163 @@ func (portForward *udpPortForward) relayDownstream() {
 			"connID":    portForward.connID}).Debug("exiting")
 }
 
-// TODO: express and/or calculate udpgwProtocolMaxPayloadSize as function of MTU?
-const (
-	udpgwProtocolFlagKeepalive = 1 << 0
-	udpgwProtocolFlagRebind    = 1 << 1
-	udpgwProtocolFlagDNS       = 1 << 2
-	udpgwProtocolFlagIPv6      = 1 << 3
+// udpChannelCodec implements the message encoding of a UDP channel
+// protocol. Upstream messages are decoded into udpChannelMessages, and
+// downstream packets are encoded in place, following a preamble, in a
+// reusable buffer.
+type udpChannelCodec interface {
 
-	udpgwProtocolMaxPreambleSize = 23
-	udpgwProtocolMaxPayloadSize  = 32768
-	udpgwProtocolMaxMessageSize  = udpgwProtocolMaxPreambleSize + udpgwProtocolMaxPayloadSize
-)
+	// getMaxMessageSize returns the size of buffers used to read and write
+	// messages.
+	getMaxMessageSize() int
+
+	// readMessage reads the next upstream message. message.packet
+	// references memory in buffer.
+	readMessage(reader io.Reader, buffer []byte) (*udpChannelMessage, error)
+
+	// getDownstreamPreambleSize returns the size of the preamble preceding
+	// downstream packets for the port forward.
+	getDownstreamPreambleSize(portForward *udpPortForward) int
+
+	// getMaxDownstreamPacketSize returns the maximum downstream packet size
+	// for the port forward.
+	getMaxDownstreamPacketSize(portForward *udpPortForward) int
 
-type udpgwProtocolMessage struct {
-	connID              uint16
-	preambleSize        int
+	// writeDownstreamPreamble writes the preamble for a downstream packet of
+	// packetSize bytes into the start of buffer.
+	writeDownstreamPreamble(
+		portForward *udpPortForward, packetSize int, buffer []byte) error
+
+	// makeClosedMessage returns a message notifying the client that the
+	// port forward is closed, or nil when the protocol has no such message.
+	makeClosedMessage(connID uint32) []byte
+}
+
+// udpChannelMessage is a decoded upstream message.
+//
+// When remoteIP is nil, the message doesn't specify a remote address and
+// can't create a new port forward. discardExistingConn closes any existing
+// port forward with the same connID before relaying the packet via a new
+// port forward. closeConn closes any existing port forward and relays no
+// packet.
+type udpChannelMessage struct {
+	connID              uint32
 	remoteIP            []byte
 	remotePort          uint16
 	discardExistingConn bool
+	closeConn           bool
 	forwardDNS          bool
 	packet              []byte
 }
 
-func readUdpgwMessage(
-	reader io.Reader, buffer []byte) (*udpgwProtocolMessage, error) {
-
-	// udpgw message layout:
-	//
-	// | 2 byte size | 3 byte header | 6 or 18 byte address | variable length packet |
-
-	for {
-		// Read message
-
-		_, err := io.ReadFull(reader, buffer[0:2])
-		if err != nil {
-			if err != io.EOF {
-				err = common.ContextError(err)
-			}
-			return nil, err
-		}
-
-		size := binary.LittleEndian.Uint16(buffer[0:2])
+// udpgwCodec implements the udpgw protocol.
+type udpgwCodec struct {
+}
 
-		if size < 3 || int(size) > len(buffer)-2 {
-			return nil, common.ContextError(errors.New("invalid udpgw message size"))
-		}
+func (codec *udpgwCodec) getMaxMessageSize() int {
+	return udpchannel.UDPGW_MAX_MESSAGE_SIZE
+}
 
-		_, err = io.ReadFull(reader, buffer[2:2+size])
-		if err != nil {
-			if err != io.EOF {
-				err = common.ContextError(err)
-			}
-			return nil, err
-		}
+func (codec *udpgwCodec) readMessage(
+	reader io.Reader, buffer []byte) (*udpChannelMessage, error) {
 
-		flags := buffer[2]
+	message, err := udpchannel.ReadUdpgwMessage(reader, buffer)
+	if err != nil {
+		return nil, err
+	}
 
-		connID := binary.LittleEndian.Uint16(buffer[3:5])
+	return &udpChannelMessage{
+		connID:              uint32(message.ConnID),
+		remoteIP:            message.RemoteIP,
+		remotePort:          message.RemotePort,
+		discardExistingConn: message.DiscardExistingConn,
+		forwardDNS:          message.ForwardDNS,
+		packet:              message.Packet,
+	}, nil
+}
 
-		// Ignore udpgw keep-alive messages -- read another message
+func (codec *udpgwCodec) getDownstreamPreambleSize(portForward *udpPortForward) int {
+	return 7 + len(portForward.remoteIP)
+}
 
-		if flags&udpgwProtocolFlagKeepalive == udpgwProtocolFlagKeepalive {
-			continue
-		}
+func (codec *udpgwCodec) getMaxDownstreamPacketSize(portForward *udpPortForward) int {
+	return udpchannel.UDPGW_MAX_PAYLOAD_SIZE
+}
 
-		// Read address
+func (codec *udpgwCodec) writeDownstreamPreamble(
+	portForward *udpPortForward, packetSize int, buffer []byte) error {
+
+	return udpchannel.WriteUdpgwPreamble(
+		codec.getDownstreamPreambleSize(portForward),
+		0,
+		uint16(portForward.connID),
+		portForward.remoteIP,
+		portForward.remotePort,
+		uint16(packetSize),
+		buffer)
+}
 
-		var remoteIP []byte
-		var remotePort uint16
-		var packetStart, packetEnd int
+func (codec *udpgwCodec) makeClosedMessage(_ uint32) []byte {
+	return nil
+}
 
-		if flags&udpgwProtocolFlagIPv6 == udpgwProtocolFlagIPv6 {
+// udpChannelProtocolCodec implements the native UDP channel protocol. See
+// the udpchannel package for the protocol specification.
+type udpChannelProtocolCodec struct {
+}
 
-			if size < 21 {
-				return nil, common.ContextError(errors.New("invalid udpgw message size"))
-			}
+func (codec *udpChannelProtocolCodec) getMaxMessageSize() int {
+	return udpchannel.MAX_FRAME_SIZE
+}
 
-			remoteIP = make([]byte, 16)
-			copy(remoteIP, buffer[5:21])
-			remotePort = binary.BigEndian.Uint16(buffer[21:23])
-			packetStart = 23
-			packetEnd = 23 + int(size) - 21
+func (codec *udpChannelProtocolCodec) readMessage(
+	reader io.Reader, buffer []byte) (*udpChannelMessage, error) {
 
-		} else {
+	frame, err := udpchannel.ReadFrame(reader, buffer)
+	if err != nil {
+		return nil, err
+	}
 
-			if size < 9 {
-				return nil, common.ContextError(errors.New("invalid udpgw message size"))
-			}
+	message := &udpChannelMessage{
+		connID:              frame.FlowID,
+		discardExistingConn: frame.IsOpen(),
+		closeConn:           frame.IsClose(),
+		forwardDNS:          frame.IsDNS(),
+		packet:              frame.Payload,
+	}
 
-			remoteIP = make([]byte, 4)
-			copy(remoteIP, buffer[5:9])
-			remotePort = binary.BigEndian.Uint16(buffer[9:11])
-			packetStart = 11
-			packetEnd = 11 + int(size) - 9
-		}
+	if frame.IsOpen() {
+		message.remoteIP = frame.RemoteIP
+		message.remotePort = frame.RemotePort
+	}
 
-		// Assemble message
-		// Note: udpgwProtocolMessage.packet references memory in the input buffer
-
-		message := &udpgwProtocolMessage{
-			connID:              connID,
-			preambleSize:        packetStart,
-			remoteIP:            remoteIP,
-			remotePort:          remotePort,
-			discardExistingConn: flags&udpgwProtocolFlagRebind == udpgwProtocolFlagRebind,
-			forwardDNS:          flags&udpgwProtocolFlagDNS == udpgwProtocolFlagDNS,
-			packet:              buffer[packetStart:packetEnd],
-		}
+	return message, nil
+}
 
-		return message, nil
-	}
+func (codec *udpChannelProtocolCodec) getDownstreamPreambleSize(_ *udpPortForward) int {
+	return udpchannel.FRAME_HEADER_SIZE
 }
 
-func writeUdpgwPreamble(
-	preambleSize int,
-	flags uint8,
-	connID uint16,
-	remoteIP []byte,
-	remotePort uint16,
-	packetSize uint16,
-	buffer []byte) error {
-
-	if preambleSize != 7+len(remoteIP) {
-		return common.ContextError(errors.New("invalid udpgw preamble size"))
-	}
+func (codec *udpChannelProtocolCodec) getMaxDownstreamPacketSize(_ *udpPortForward) int {
+	return udpchannel.MAX_FRAME_SIZE - udpchannel.FRAME_HEADER_SIZE
+}
 
-	size := uint16(preambleSize-2) + packetSize
+func (codec *udpChannelProtocolCodec) writeDownstreamPreamble(
+	portForward *udpPortForward, packetSize int, buffer []byte) error {
 
-	// size
-	binary.LittleEndian.PutUint16(buffer[0:2], size)
+	return udpchannel.WriteFrameHeader(
+		&udpchannel.Frame{FlowID: portForward.connID}, packetSize, buffer)
+}
 
-	// flags
-	buffer[2] = flags
+func (codec *udpChannelProtocolCodec) makeClosedMessage(connID uint32) []byte {
 
-	// connID
-	binary.LittleEndian.PutUint16(buffer[3:5], connID)
+	message := make([]byte, udpchannel.FRAME_HEADER_SIZE)
 
-	// addr
-	copy(buffer[5:5+len(remoteIP)], remoteIP)
-	binary.BigEndian.PutUint16(buffer[5+len(remoteIP):7+len(remoteIP)], remotePort)
+	err := udpchannel.WriteFrameHeader(
+		&udpchannel.Frame{Flags: udpchannel.FLAG_CLOSE, FlowID: connID}, 0, message)
+	if err != nil {
+		return nil
+	}
 
-	return nil
+	return message
 }
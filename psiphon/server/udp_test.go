@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpchannel"
+)
+
+func TestUDPChannelCodecs(t *testing.T) {
+
+	remoteIP := net.ParseIP("192.168.0.1").To4()
+	remotePort := uint16(53)
+	packet := []byte("packet")
+
+	// udpgw
+
+	codec := udpChannelCodec(&udpgwCodec{})
+
+	portForward := &udpPortForward{
+		connID:     1,
+		remoteIP:   remoteIP,
+		remotePort: remotePort,
+	}
+
+	buffer := make([]byte, codec.getMaxMessageSize())
+	preambleSize := codec.getDownstreamPreambleSize(portForward)
+	copy(buffer[preambleSize:], packet)
+
+	err := codec.writeDownstreamPreamble(portForward, len(packet), buffer)
+	if err != nil {
+		t.Fatalf("writeDownstreamPreamble failed: %s", err)
+	}
+
+	message, err := codec.readMessage(
+		bytes.NewReader(buffer[:preambleSize+len(packet)]),
+		make([]byte, codec.getMaxMessageSize()))
+	if err != nil {
+		t.Fatalf("readMessage failed: %s", err)
+	}
+
+	if message.connID != 1 ||
+		!bytes.Equal(message.remoteIP, remoteIP) ||
+		message.remotePort != remotePort ||
+		!bytes.Equal(message.packet, packet) {
+
+		t.Fatalf("unexpected udpgw message: %+v", message)
+	}
+
+	if codec.makeClosedMessage(1) != nil {
+		t.Fatalf("unexpected udpgw closed message")
+	}
+
+	// UDP channel protocol
+
+	codec = &udpChannelProtocolCodec{}
+
+	portForward.connID = 0x10000
+
+	var upstream bytes.Buffer
+
+	for _, frame := range []*udpchannel.Frame{
+		{
+			Flags:      udpchannel.FLAG_OPEN | udpchannel.FLAG_DNS,
+			FlowID:     portForward.connID,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			Payload:    packet,
+		},
+		{
+			FlowID:  portForward.connID,
+			Payload: packet,
+		},
+		{
+			Flags:  udpchannel.FLAG_CLOSE,
+			FlowID: portForward.connID,
+		},
+	} {
+		err := udpchannel.WriteFrame(&upstream, frame)
+		if err != nil {
+			t.Fatalf("WriteFrame failed: %s", err)
+		}
+	}
+
+	buffer = make([]byte, codec.getMaxMessageSize())
+
+	message, err = codec.readMessage(&upstream, buffer)
+	if err != nil {
+		t.Fatalf("readMessage failed: %s", err)
+	}
+
+	if message.connID != portForward.connID ||
+		!bytes.Equal(message.remoteIP, remoteIP) ||
+		message.remotePort != remotePort ||
+		!message.discardExistingConn ||
+		!message.forwardDNS ||
+		message.closeConn ||
+		!bytes.Equal(message.packet, packet) {
+
+		t.Fatalf("unexpected open message: %+v", message)
+	}
+
+	message, err = codec.readMessage(&upstream, buffer)
+	if err != nil {
+		t.Fatalf("readMessage failed: %s", err)
+	}
+
+	if message.connID != portForward.connID ||
+		message.remoteIP != nil ||
+		message.discardExistingConn ||
+		message.closeConn ||
+		!bytes.Equal(message.packet, packet) {
+
+		t.Fatalf("unexpected message: %+v", message)
+	}
+
+	message, err = codec.readMessage(&upstream, buffer)
+	if err != nil {
+		t.Fatalf("readMessage failed: %s", err)
+	}
+
+	if message.connID != portForward.connID || !message.closeConn {
+		t.Fatalf("unexpected close message: %+v", message)
+	}
+
+	preambleSize = codec.getDownstreamPreambleSize(portForward)
+	copy(buffer[preambleSize:], packet)
+
+	err = codec.writeDownstreamPreamble(portForward, len(packet), buffer)
+	if err != nil {
+		t.Fatalf("writeDownstreamPreamble failed: %s", err)
+	}
+
+	var downstream bytes.Buffer
+	downstream.Write(buffer[:preambleSize+len(packet)])
+	downstream.Write(codec.makeClosedMessage(portForward.connID))
+
+	frameBuffer := make([]byte, udpchannel.MAX_FRAME_SIZE)
+
+	frame, err := udpchannel.ReadFrame(&downstream, frameBuffer)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %s", err)
+	}
+
+	if frame.FlowID != portForward.connID || frame.Flags != 0 ||
+		!bytes.Equal(frame.Payload, packet) {
+
+		t.Fatalf("unexpected downstream frame: %+v", frame)
+	}
+
+	frame, err = udpchannel.ReadFrame(&downstream, frameBuffer)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %s", err)
+	}
+
+	if frame.FlowID != portForward.connID || !frame.IsClose() {
+		t.Fatalf("unexpected downstream frame: %+v", frame)
+	}
+}
@@ -142,7 +142,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		// doesn't detect all cases of changing networks, it reduces the already
 		// narrow window.
 
-		networkID = serverContext.tunnel.config.networkIDGetter.GetNetworkID()
+		networkID = serverContext.tunnel.config.getTacticsNetworkID()
 
 		err := tactics.SetTacticsAPIParameters(
 			serverContext.tunnel.config.clientParameters, GetTacticsStorer(), networkID, params)
@@ -151,6 +151,25 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		}
 	}
 
+	// When this server issued a session resumption token in a previous
+	// handshake, present the token. In a resumed session, the server omits
+	// home pages, stats regexps, and discovered server entries, and the
+	// values received in the original handshake are used instead.
+
+	serverIPAddress := serverContext.tunnel.serverEntry.IpAddress
+
+	sessionResumption := serverContext.tunnel.config.clientParameters.Get().Bool(
+		parameters.HandshakeSessionResumption)
+
+	var resumptionRecord *sessionResumptionRecord
+	if sessionResumption {
+		resumptionRecord = getSessionResumptionRecord(serverIPAddress)
+		if resumptionRecord != nil {
+			params[protocol.PSIPHON_API_HANDSHAKE_SESSION_RESUMPTION_TOKEN] =
+				resumptionRecord.Token
+		}
+	}
+
 	var response []byte
 	if serverContext.psiphonHttpsClient == nil {
 
@@ -200,6 +219,41 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
+	if handshakeResponse.SessionResumed {
+
+		if resumptionRecord == nil {
+			return common.ContextError(errors.New("unexpected session resumption"))
+		}
+
+		NoticeInfo("handshake session resumed: %s", serverIPAddress)
+
+		handshakeResponse.Homepages = resumptionRecord.Homepages
+		handshakeResponse.PageViewRegexes = resumptionRecord.PageViewRegexes
+		handshakeResponse.HttpsRequestRegexes = resumptionRecord.HttpsRequestRegexes
+
+	} else if sessionResumption {
+
+		// Replace any previous record, which the server has not accepted,
+		// with the newly issued token, if any.
+
+		var err error
+		if handshakeResponse.SessionResumptionToken != "" {
+			err = setSessionResumptionRecord(
+				serverIPAddress,
+				&sessionResumptionRecord{
+					Token:               handshakeResponse.SessionResumptionToken,
+					Homepages:           handshakeResponse.Homepages,
+					PageViewRegexes:     handshakeResponse.PageViewRegexes,
+					HttpsRequestRegexes: handshakeResponse.HttpsRequestRegexes,
+				})
+		} else if resumptionRecord != nil {
+			err = DeleteSessionResumptionRecord(serverIPAddress)
+		}
+		if err != nil {
+			NoticeAlert("store session resumption record failed: %s", err)
+		}
+	}
+
 	serverContext.clientRegion = handshakeResponse.ClientRegion
 	NoticeClientRegion(serverContext.clientRegion)
 
@@ -239,6 +293,28 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
+	// Record a high server load, so that this server is deprioritized in
+	// subsequent establishments. The current tunnel is not affected.
+
+	p := serverContext.tunnel.config.clientParameters.Get()
+	serverLoadAvoidanceThreshold := p.Int(parameters.ServerLoadAvoidanceThreshold)
+	serverLoadAvoidancePeriod := p.Duration(parameters.ServerLoadAvoidancePeriod)
+	p = nil
+
+	if serverLoadAvoidancePeriod > 0 &&
+		handshakeResponse.ServerLoad > 0 &&
+		handshakeResponse.ServerLoad >= serverLoadAvoidanceThreshold {
+
+		NoticeInfo("server load: %s: %d%%",
+			serverContext.tunnel.serverEntry.IpAddress, handshakeResponse.ServerLoad)
+
+		err = SetServerLoad(
+			serverContext.tunnel.serverEntry.IpAddress, handshakeResponse.ServerLoad)
+		if err != nil {
+			NoticeAlert("SetServerLoad failed: %s", err)
+		}
+	}
+
 	NoticeHomepages(handshakeResponse.Homepages)
 
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
@@ -265,8 +341,20 @@ func (serverContext *ServerContext) doHandshakeRequest(
 
 	NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
 
+	// Apply any client parameters pushed by the server. A handshake response
+	// with no pushed parameters leaves any previously pushed parameters in
+	// place.
+
+	if handshakeResponse.ClientParameters != nil {
+		err := serverContext.tunnel.config.SetHandshakeClientParameters(
+			handshakeResponse.ClientParameters)
+		if err != nil {
+			NoticeAlert("apply handshake parameters failed: %s", err)
+		}
+	}
+
 	if doTactics && handshakeResponse.TacticsPayload != nil &&
-		networkID == serverContext.tunnel.config.networkIDGetter.GetNetworkID() {
+		networkID == serverContext.tunnel.config.getTacticsNetworkID() {
 
 		var payload *tactics.Payload
 		err := json.Unmarshal(handshakeResponse.TacticsPayload, &payload)
@@ -282,6 +370,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 			tacticsRecord, err := tactics.HandleTacticsPayload(
 				GetTacticsStorer(),
 				networkID,
+				serverContext.tunnel.config.TacticsVerificationKeyRing,
 				payload)
 			if err != nil {
 				return common.ContextError(err)
@@ -305,6 +394,50 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	return nil
 }
 
+// sessionResumptionRecord is a handshake session resumption token, along
+// with the handshake values that are omitted from a resumed session
+// handshake response.
+type sessionResumptionRecord struct {
+	Token               string
+	Homepages           []string
+	PageViewRegexes     []map[string]string
+	HttpsRequestRegexes []map[string]string
+}
+
+// getSessionResumptionRecord returns the stored session resumption record
+// for the specified server, or nil when there is no valid record.
+func getSessionResumptionRecord(ipAddress string) *sessionResumptionRecord {
+
+	value, err := GetSessionResumptionRecord(ipAddress)
+	if err != nil {
+		NoticeAlert("GetSessionResumptionRecord failed: %s", err)
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+
+	var record *sessionResumptionRecord
+	err = json.Unmarshal(value, &record)
+	if err != nil || record == nil || record.Token == "" {
+		NoticeAlert("invalid session resumption record")
+		return nil
+	}
+
+	return record
+}
+
+func setSessionResumptionRecord(
+	ipAddress string, record *sessionResumptionRecord) error {
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return SetSessionResumptionRecord(ipAddress, value)
+}
+
 // DoConnectedRequest performs the "connected" API request. This request is
 // used for statistics. The server returns a last_connected token for
 // the client to store and send next time it connects. This token is
@@ -706,6 +839,20 @@ func getBaseAPIParameters(
 		params["device_region"] = config.DeviceRegion
 	}
 
+	networkMetadata := config.getNetworkMetadata()
+
+	if networkMetadata.MCC != "" {
+		params["network_mcc"] = networkMetadata.MCC
+	}
+
+	if networkMetadata.MNC != "" {
+		params["network_mnc"] = networkMetadata.MNC
+	}
+
+	if networkMetadata.ASN != "" {
+		params["network_asn"] = networkMetadata.ASN
+	}
+
 	if dialStats.SelectedSSHClientVersion {
 		params["ssh_client_version"] = dialStats.SSHClientVersion
 	}
@@ -752,6 +899,22 @@ func getBaseAPIParameters(
 		params["tls_profile"] = dialStats.TLSProfile
 	}
 
+	if dialStats.TrafficShapingProfile != "" {
+		params["traffic_shaping_profile"] = dialStats.TrafficShapingProfile
+	}
+
+	if dialStats.QUICWireVersion != "" {
+		params["quic_wire_version"] = dialStats.QUICWireVersion
+	}
+
+	if dialStats.TCPMaxSegmentSize != 0 {
+		params["tcp_max_segment_size"] = strconv.Itoa(dialStats.TCPMaxSegmentSize)
+	}
+
+	if dialStats.InproxyConnectionID != "" {
+		params["inproxy_connection_id"] = dialStats.InproxyConnectionID
+	}
+
 	if serverEntry.Region != "" {
 		params["server_entry_region"] = serverEntry.Region
 	}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestServerEntryAvailabilityWindowRanking(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-availability-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	now := time.Now().UTC()
+	makeWindow := func(start, end time.Duration) string {
+		return fmt.Sprintf(
+			"%s-%s", now.Add(start).Format("15:04"), now.Add(end).Format("15:04"))
+	}
+	availableWindow := makeWindow(-1*time.Hour, 1*time.Hour)
+	unavailableWindow := makeWindow(6*time.Hour, 8*time.Hour)
+
+	serverEntryCount := 20
+	unavailable := make(map[string]bool)
+
+	for i := 0; i < serverEntryCount; i++ {
+		ipAddress := fmt.Sprintf("192.0.2.%d", i)
+		fields := protocol.ServerEntryFields{
+			"ipAddress":            ipAddress,
+			"configurationVersion": 1,
+		}
+		switch i % 3 {
+		case 0:
+			fields["availabilityWindows"] = []string{unavailableWindow}
+			unavailable[ipAddress] = true
+		case 1:
+			fields["availabilityWindows"] = []string{availableWindow}
+		}
+		err = StoreServerEntry(fields, false)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	pinnedServerEntry := "192.0.2.0"
+
+	err = StoreServerEntryPolicy(
+		&ServerEntryPolicy{PinnedServerEntries: []string{pinnedServerEntry}})
+	if err != nil {
+		t.Fatalf("StoreServerEntryPolicy failed: %s", err)
+	}
+
+	iterate := func() []string {
+		_, iterator, err := NewServerEntryIterator(clientConfig)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+
+		if len(ipAddresses) != serverEntryCount {
+			t.Fatalf("unexpected server entry count: %d", len(ipAddresses))
+		}
+
+		return ipAddresses
+	}
+
+	// The pinned server entry is not deferred, and all other unavailable
+	// server entries follow all available server entries.
+
+	ipAddresses := iterate()
+
+	if ipAddresses[0] != pinnedServerEntry {
+		t.Fatalf("unexpected first server entry: %s", ipAddresses[0])
+	}
+
+	deferredCount := len(unavailable) - 1
+	for i, ipAddress := range ipAddresses[1:] {
+		isDeferred := i >= len(ipAddresses)-1-deferredCount
+		if unavailable[ipAddress] != isDeferred {
+			t.Fatalf("unexpected server entry order: %v", ipAddresses)
+		}
+	}
+
+	// Tactics may disable ranking or change the clock skew tolerance.
+
+	_, err = clientConfig.clientParameters.Set("", false, map[string]interface{}{
+		parameters.ServerEntryAvailabilityWindowRanking:   false,
+		parameters.ServerEntryAvailabilityWindowClockSkew: "12h",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	_, iterator, err := NewServerEntryIterator(clientConfig)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	iterator.Close()
+
+	if iterator.availabilityWindowRanking ||
+		iterator.availabilityWindowClockSkew != 12*time.Hour {
+		t.Fatalf("unexpected iterator parameters")
+	}
+
+	iterate()
+}
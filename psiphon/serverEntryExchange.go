@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ExportServerEntries creates a signed package containing the stored server
+// entries selected by filter. When filter is nil, all stored server entries
+// are exported. The package is an AuthenticatedDataPackage, signed with the
+// given keys (see common.GenerateAuthenticatedDataPackageKeys), with a data
+// payload in the same newline-delimited encoding used by remote server lists.
+//
+// The datastore must be open.
+func ExportServerEntries(
+	filter func(*protocol.ServerEntry) bool,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	var encodedServerEntries []string
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		cursor := bucket.cursor()
+		defer cursor.close()
+
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+			// Unmarshal to ServerEntry for filtering, and to ServerEntryFields
+			// for encoding, so that unrecognized fields are retained.
+
+			var serverEntry *protocol.ServerEntry
+			err := json.Unmarshal(value, &serverEntry)
+			if err != nil {
+				NoticeAlert("ExportServerEntries: %s", common.ContextError(err))
+				continue
+			}
+
+			if filter != nil && !filter(serverEntry) {
+				continue
+			}
+
+			var serverEntryFields protocol.ServerEntryFields
+			err = json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				NoticeAlert("ExportServerEntries: %s", common.ContextError(err))
+				continue
+			}
+
+			encodedServerEntry, err := protocol.EncodeServerEntryFields(serverEntryFields)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dataPackage, err := common.WriteAuthenticatedDataPackage(
+		strings.Join(encodedServerEntries, "\n"),
+		signingPublicKey,
+		signingPrivateKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return dataPackage, nil
+}
+
+// ImportServerEntries verifies the signature of a package created by
+// ExportServerEntries and then stores the server entries it contains. The
+// package must be signed with the key corresponding to signingPublicKey;
+// when verification fails, no server entries are stored. Imported server
+// entries don't replace existing entries unless they have a newer
+// configuration version. ImportServerEntries returns the number of valid
+// server entries in the package.
+//
+// The datastore must be open.
+func ImportServerEntries(
+	config *Config, dataPackage []byte, signingPublicKey string) (int, error) {
+
+	encodedServerEntryList, err := common.ReadAuthenticatedDataPackage(
+		dataPackage, true, signingPublicKey)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	serverEntries, err := protocol.DecodeServerEntryList(
+		encodedServerEntryList,
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_IMPORTED)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	err = StoreServerEntries(config, serverEntries, false)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	NoticeInfo("imported %d server entries", len(serverEntries))
+
+	return len(serverEntries), nil
+}
+
+// DecodeShareCode verifies and stores the server entries contained in a
+// share code, as created by protocol.EncodeShareCode. Share codes allow users
+// to bootstrap one another with server entries, out-of-band, when remote
+// server list endpoints are blocked. The share code must be signed with the
+// key corresponding to config.ShareCodeSignaturePublicKey. DecodeShareCode
+// returns the number of valid server entries in the share code.
+//
+// The datastore must be open.
+func DecodeShareCode(config *Config, shareCode string) (int, error) {
+
+	if config.ShareCodeSignaturePublicKey == "" {
+		return 0, common.ContextError(errors.New("missing ShareCodeSignaturePublicKey"))
+	}
+
+	serverEntries, err := protocol.DecodeShareCode(
+		shareCode,
+		config.ShareCodeSignaturePublicKey,
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_IMPORTED)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	err = StoreServerEntries(config, serverEntries, false)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	NoticeInfo("imported %d server entries from share code", len(serverEntries))
+
+	return len(serverEntries), nil
+}
+
+// ImportBridgeLines converts and stores the server entries described by
+// Tor-style bridge lines, as parsed by protocol.DecodeBridgeLines. This
+// allows operators running both Tor bridges and Psiphon servers to provide
+// one bridge configuration to both systems. Bridge lines which can't be
+// converted are skipped and reported in alert notices. ImportBridgeLines
+// returns the number of server entries stored.
+//
+// Bridge lines are not signed; only bridge lines from a trusted source,
+// such as an operator provided file, should be imported.
+//
+// The datastore must be open.
+func ImportBridgeLines(config *Config, bridgeLines string) (int, error) {
+
+	serverEntries, lineErrors := protocol.DecodeBridgeLines(
+		bridgeLines,
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_IMPORTED)
+
+	for _, err := range lineErrors {
+		NoticeAlert("ImportBridgeLines: skipped %s", err)
+	}
+
+	err := StoreServerEntries(config, serverEntries, false)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	NoticeInfo(
+		"imported %d server entries from bridge lines, skipped %d",
+		len(serverEntries), len(lineErrors))
+
+	return len(serverEntries), nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestExportImportServerEntries(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-exchange-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	otherPublicKey, _, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	// Each datastore is in a distinct directory, and only one datastore is
+	// open at a time.
+
+	openDataStore := func(name string) *Config {
+		config, err := LoadConfig([]byte(`
+        {
+            "ClientPlatform" : "Windows",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0"
+        }`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		config.DataStoreDirectory = filepath.Join(testDataDirName, name)
+		err = os.Mkdir(config.DataStoreDirectory, 0700)
+		if err != nil {
+			t.Fatalf("Mkdir failed: %s", err)
+		}
+		err = config.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+		err = OpenDataStore(config)
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+		return config
+	}
+
+	exportConfig := openDataStore("export")
+
+	var serverEntries []protocol.ServerEntryFields
+	for _, region := range []string{"CA", "CA", "US"} {
+		serverEntryFields := protocol.ServerEntryFields{
+			"ipAddress":            fmt.Sprintf("192.0.2.%d", len(serverEntries)+1),
+			"region":               region,
+			"configurationVersion": 1,
+			"unrecognizedField":    "value",
+		}
+		serverEntryFields.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		serverEntryFields.SetLocalTimestamp(common.GetCurrentTimestamp())
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+
+	err = StoreServerEntries(exportConfig, serverEntries, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	dataPackage, err := ExportServerEntries(
+		func(serverEntry *protocol.ServerEntry) bool {
+			return serverEntry.Region == "CA"
+		},
+		signingPublicKey,
+		signingPrivateKey)
+	if err != nil {
+		t.Fatalf("ExportServerEntries failed: %s", err)
+	}
+
+	CloseDataStore()
+
+	importConfig := openDataStore("import")
+	defer CloseDataStore()
+
+	// Tampered, truncated, and incorrectly signed packages are rejected,
+	// and no server entries are stored.
+
+	tamperedDataPackage := append([]byte(nil), dataPackage...)
+	tamperedDataPackage[len(tamperedDataPackage)/2] ^= 1
+
+	for _, testCase := range []struct {
+		description      string
+		dataPackage      []byte
+		signingPublicKey string
+	}{
+		{"tampered", tamperedDataPackage, signingPublicKey},
+		{"truncated", dataPackage[:len(dataPackage)/2], signingPublicKey},
+		{"wrong key", dataPackage, otherPublicKey},
+	} {
+		_, err := ImportServerEntries(
+			importConfig, testCase.dataPackage, testCase.signingPublicKey)
+		if err == nil {
+			t.Fatalf("unexpected ImportServerEntries success with %s package", testCase.description)
+		}
+		if CountServerEntries() != 0 {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	count, err := ImportServerEntries(importConfig, dataPackage, signingPublicKey)
+	if err != nil {
+		t.Fatalf("ImportServerEntries failed: %s", err)
+	}
+
+	if count != 2 || CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d, %d", count, CountServerEntries())
+	}
+
+	for _, serverEntryFields := range serverEntries[:2] {
+
+		serverEntry, err := getServerEntry(serverEntryFields.GetIPAddress())
+		if err != nil || serverEntry == nil {
+			t.Fatalf("missing server entry: %s", serverEntryFields.GetIPAddress())
+		}
+
+		if serverEntry.Region != "CA" ||
+			serverEntry.LocalSource != protocol.SERVER_ENTRY_SOURCE_IMPORTED {
+			t.Fatalf("unexpected server entry: %+v", serverEntry)
+		}
+	}
+
+	// Unrecognized fields are retained.
+
+	var exported []protocol.ServerEntryFields
+	err = datastoreView(func(tx *datastoreTx) error {
+		cursor := tx.bucket(datastoreServerEntriesBucket).cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				return err
+			}
+			exported = append(exported, serverEntryFields)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	for _, serverEntryFields := range exported {
+		if serverEntryFields["unrecognizedField"] != "value" {
+			t.Fatalf("missing unrecognized field: %+v", serverEntryFields)
+		}
+	}
+}
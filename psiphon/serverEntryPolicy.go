@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// ServerEntryPolicy specifies server entries, by IP address, which are to be
+// tried first or never dialed.
+//
+// PinnedServerEntries are candidates ahead of all other server entries,
+// including the server affinity candidate, in the listed order. Pinned
+// server entries must still be stored in the datastore and pass the egress
+// region and tunnel protocol filters. When the first candidate is pinned,
+// other candidates wait for EstablishTunnelPinnedServerGracePeriod, in place
+// of EstablishTunnelServerAffinityGracePeriod.
+//
+// ExcludedServerEntries are never candidates for tunnel establishment or
+// tactics requests.
+//
+// The policy doesn't apply when Config.TargetServerEntry is set.
+type ServerEntryPolicy struct {
+	PinnedServerEntries   []string
+	ExcludedServerEntries []string
+}
+
+// Validate checks that all entries are IP addresses and that no IP address
+// is both pinned and excluded.
+func (policy *ServerEntryPolicy) Validate() error {
+	for _, list := range [][]string{policy.PinnedServerEntries, policy.ExcludedServerEntries} {
+		for _, ipAddress := range list {
+			if net.ParseIP(ipAddress) == nil {
+				return common.ContextError(fmt.Errorf("invalid server entry IP address: '%s'", ipAddress))
+			}
+		}
+	}
+	for _, ipAddress := range policy.PinnedServerEntries {
+		if common.Contains(policy.ExcludedServerEntries, ipAddress) {
+			return common.ContextError(fmt.Errorf("server entry both pinned and excluded: '%s'", ipAddress))
+		}
+	}
+	return nil
+}
+
+// IsEmpty returns true when no server entries are pinned or excluded.
+func (policy *ServerEntryPolicy) IsEmpty() bool {
+	return policy == nil ||
+		(len(policy.PinnedServerEntries) == 0 && len(policy.ExcludedServerEntries) == 0)
+}
+
+// isExcluded indicates whether the server entry with the specified IP
+// address is not to be dialed.
+func (policy *ServerEntryPolicy) isExcluded(ipAddress string) bool {
+	return policy != nil && common.Contains(policy.ExcludedServerEntries, ipAddress)
+}
+
+// isPinned indicates whether the server entry with the specified IP address
+// is to be tried first.
+func (policy *ServerEntryPolicy) isPinned(ipAddress string) bool {
+	return policy != nil && common.Contains(policy.PinnedServerEntries, ipAddress)
+}
+
+// getHeadCandidateGracePeriod returns the time to wait for the first
+// candidate, with the specified IP address, to complete before starting
+// other candidates.
+func (policy *ServerEntryPolicy) getHeadCandidateGracePeriod(
+	p *parameters.ClientParametersSnapshot, ipAddress string) time.Duration {
+
+	if policy.isPinned(ipAddress) {
+		return p.Duration(parameters.EstablishTunnelPinnedServerGracePeriod)
+	}
+	return p.Duration(parameters.EstablishTunnelServerAffinityGracePeriod)
+}
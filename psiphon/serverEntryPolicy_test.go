@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestServerEntryPolicy(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-policy-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverEntryCount := 50
+
+	for i := 0; i < serverEntryCount; i++ {
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            fmt.Sprintf("192.0.2.%d", i),
+				"configurationVersion": 1,
+			},
+			false)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	affinityServerEntry := "192.0.2.10"
+
+	err = PromoteServerEntry(clientConfig, affinityServerEntry)
+	if err != nil {
+		t.Fatalf("error promoting server entry: %s", err)
+	}
+
+	testCases := []struct {
+		description     string
+		policy          *ServerEntryPolicy
+		expectedHead    []string
+		expectedExclude []string
+	}{
+		{
+			"no policy",
+			nil,
+			[]string{affinityServerEntry},
+			nil,
+		},
+		{
+			"pinned",
+			&ServerEntryPolicy{
+				// 192.0.2.200 is not stored and is skipped.
+				PinnedServerEntries: []string{"192.0.2.5", "192.0.2.200", "192.0.2.3"},
+			},
+			[]string{"192.0.2.5", "192.0.2.3", affinityServerEntry},
+			nil,
+		},
+		{
+			"pinned affinity",
+			&ServerEntryPolicy{
+				PinnedServerEntries: []string{"192.0.2.5", affinityServerEntry},
+			},
+			[]string{"192.0.2.5", affinityServerEntry},
+			nil,
+		},
+		{
+			"excluded",
+			&ServerEntryPolicy{
+				PinnedServerEntries:   []string{"192.0.2.5"},
+				ExcludedServerEntries: []string{affinityServerEntry, "192.0.2.20", "192.0.2.30"},
+			},
+			[]string{"192.0.2.5"},
+			[]string{affinityServerEntry, "192.0.2.20", "192.0.2.30"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			err := StoreServerEntryPolicy(testCase.policy)
+			if err != nil {
+				t.Fatalf("StoreServerEntryPolicy failed: %s", err)
+			}
+
+			_, iterator, err := NewServerEntryIterator(clientConfig)
+			if err != nil {
+				t.Fatalf("NewServerEntryIterator failed: %s", err)
+			}
+			defer iterator.Close()
+
+			var ipAddresses []string
+			for {
+				serverEntry, err := iterator.Next()
+				if err != nil {
+					t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+				}
+				if serverEntry == nil {
+					break
+				}
+				ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+			}
+
+			if len(ipAddresses) != serverEntryCount-len(testCase.expectedExclude) {
+				t.Fatalf("unexpected server entry count: %d", len(ipAddresses))
+			}
+
+			for i, ipAddress := range testCase.expectedHead {
+				if ipAddresses[i] != ipAddress {
+					t.Fatalf("unexpected server entry %d: %s", i, ipAddresses[i])
+				}
+			}
+
+			for _, ipAddress := range ipAddresses {
+				if testCase.policy.isExcluded(ipAddress) {
+					t.Fatalf("unexpected excluded server entry: %s", ipAddress)
+				}
+			}
+		})
+	}
+
+	err = StoreServerEntryPolicy(
+		&ServerEntryPolicy{
+			PinnedServerEntries:   []string{"192.0.2.1"},
+			ExcludedServerEntries: []string{"192.0.2.1"},
+		})
+	if err == nil {
+		t.Fatalf("unexpected StoreServerEntryPolicy success")
+	}
+
+	err = StoreServerEntryPolicy(
+		&ServerEntryPolicy{
+			PinnedServerEntries: []string{"not-an-ip-address"},
+		})
+	if err == nil {
+		t.Fatalf("unexpected StoreServerEntryPolicy success")
+	}
+}
+
+func TestServerEntryPolicyGracePeriod(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.EstablishTunnelServerAffinityGracePeriod: "1s",
+		parameters.EstablishTunnelPinnedServerGracePeriod:   "5s",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	p := clientParameters.Get()
+
+	policy := &ServerEntryPolicy{
+		PinnedServerEntries: []string{"192.0.2.1"},
+	}
+
+	for _, testCase := range []struct {
+		policy              *ServerEntryPolicy
+		ipAddress           string
+		expectedGracePeriod time.Duration
+	}{
+		{policy, "192.0.2.1", 5 * time.Second},
+		{policy, "192.0.2.2", 1 * time.Second},
+		{nil, "192.0.2.1", 1 * time.Second},
+	} {
+		gracePeriod := testCase.policy.getHeadCandidateGracePeriod(p, testCase.ipAddress)
+		if gracePeriod != testCase.expectedGracePeriod {
+			t.Fatalf("unexpected grace period for %s: %s", testCase.ipAddress, gracePeriod)
+		}
+	}
+}
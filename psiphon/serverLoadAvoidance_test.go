@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestServerLoadAvoidance(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-load-avoidance-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverEntryCount := 20
+	loaded := make(map[string]bool)
+
+	for i := 0; i < serverEntryCount; i++ {
+		ipAddress := fmt.Sprintf("192.0.2.%d", i)
+		err = StoreServerEntry(
+			protocol.ServerEntryFields{
+				"ipAddress":            ipAddress,
+				"configurationVersion": 1,
+			},
+			false)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+
+		switch i % 4 {
+		case 0:
+			err = SetServerLoad(ipAddress, 95)
+			loaded[ipAddress] = true
+		case 1:
+			// An expired server load record is ignored.
+			var record []byte
+			record, err = json.Marshal(
+				&serverLoadRecord{Load: 95, RecordTime: time.Now().Add(-1 * time.Hour)})
+			if err == nil {
+				err = setBucketValue(datastoreServerLoadBucket, []byte(ipAddress), record)
+			}
+		}
+		if err != nil {
+			t.Fatalf("error storing server load: %s", err)
+		}
+	}
+
+	pinnedServerEntry := "192.0.2.0"
+
+	err = StoreServerEntryPolicy(
+		&ServerEntryPolicy{PinnedServerEntries: []string{pinnedServerEntry}})
+	if err != nil {
+		t.Fatalf("StoreServerEntryPolicy failed: %s", err)
+	}
+
+	iterate := func() []string {
+		_, iterator, err := NewServerEntryIterator(clientConfig)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+
+		if len(ipAddresses) != serverEntryCount {
+			t.Fatalf("unexpected server entry count: %d", len(ipAddresses))
+		}
+
+		return ipAddresses
+	}
+
+	// Recently loaded server entries, other than the pinned server entry,
+	// follow all other server entries. Immediately after the load is
+	// recorded, the probability of deferral is effectively 1.
+
+	ipAddresses := iterate()
+
+	if ipAddresses[0] != pinnedServerEntry {
+		t.Fatalf("unexpected first server entry: %s", ipAddresses[0])
+	}
+
+	deferredCount := len(loaded) - 1
+	for i, ipAddress := range ipAddresses[1:] {
+		isDeferred := i >= len(ipAddresses)-1-deferredCount
+		if loaded[ipAddress] != isDeferred {
+			t.Fatalf("unexpected server entry order: %v", ipAddresses)
+		}
+	}
+
+	// Tactics may disable load avoidance.
+
+	_, err = clientConfig.clientParameters.Set("", false, map[string]interface{}{
+		parameters.ServerLoadAvoidancePeriod: "0s",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	deferred := true
+	for i := 0; i < 10 && deferred; i++ {
+		ipAddresses = iterate()
+		deferred = true
+		for _, ipAddress := range ipAddresses[len(ipAddresses)-deferredCount:] {
+			if !loaded[ipAddress] {
+				deferred = false
+			}
+		}
+	}
+	if deferred {
+		t.Fatalf("unexpected server entry order: %v", ipAddresses)
+	}
+}
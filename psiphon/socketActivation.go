@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	// SOCKET_ACTIVATION_SOCKS_PROXY_NAME and SOCKET_ACTIVATION_HTTP_PROXY_NAME
+	// are the socket names which identify local proxy listeners passed in
+	// through socket activation: the systemd FileDescriptorName, or the
+	// launchd Sockets dictionary key.
+	SOCKET_ACTIVATION_SOCKS_PROXY_NAME = "socks"
+	SOCKET_ACTIVATION_HTTP_PROXY_NAME  = "http"
+
+	// systemdListenFDsStart is SD_LISTEN_FDS_START, the first file descriptor
+	// passed in by systemd.
+	systemdListenFDsStart = 3
+)
+
+// GetActivatedListeners returns listeners passed in to the process through
+// socket activation, keyed by socket name. Socket activation allows a
+// service manager to bind the local proxy ports, including privileged
+// ports, and to start the client on demand when the first connection
+// arrives.
+//
+// With systemd, the listeners are the file descriptors indicated by the
+// LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES environment variables; the
+// variables are unset so they're not inherited by child processes. Sockets
+// without a FileDescriptorName are named "unknown", as in sd_listen_fds.
+// With launchd, only the SOCKET_ACTIVATION_SOCKS_PROXY_NAME and
+// SOCKET_ACTIVATION_HTTP_PROXY_NAME sockets are checked.
+//
+// When more than one socket has the same name, for example the IPv4 and IPv6
+// sockets for a single launchd entry, only the first is used and the others
+// are closed.
+//
+// GetActivatedListeners returns an empty map when the process wasn't socket
+// activated. Typically, the listeners are then used to set
+// Config.LocalSocksProxyListener and Config.LocalHttpProxyListener.
+func GetActivatedListeners() (map[string]net.Listener, error) {
+
+	files, err := getSystemdActivatedFiles()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if len(files) == 0 {
+		files, err = getLaunchdActivatedFiles(
+			[]string{SOCKET_ACTIVATION_SOCKS_PROXY_NAME, SOCKET_ACTIVATION_HTTP_PROXY_NAME})
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	return makeActivatedListeners(files)
+}
+
+func getSystemdActivatedFiles() (map[string][]*os.File, error) {
+
+	listenPID := os.Getenv("LISTEN_PID")
+	listenFDs := os.Getenv("LISTEN_FDS")
+	listenFDNames := os.Getenv("LISTEN_FDNAMES")
+
+	if listenPID == "" || listenFDs == "" {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The variables are intended for another process when LISTEN_PID
+	// doesn't match.
+
+	pid, err := strconv.Atoi(listenPID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return getActivatedFiles(systemdListenFDsStart, count, listenFDNames)
+}
+
+// getActivatedFiles wraps the count file descriptors starting at firstFD,
+// named by the colon-separated fdNames.
+func getActivatedFiles(
+	firstFD, count int, fdNames string) (map[string][]*os.File, error) {
+
+	if count < 0 {
+		return nil, common.ContextError(fmt.Errorf("invalid file descriptor count: %d", count))
+	}
+
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	files := make(map[string][]*os.File)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		fd := firstFD + i
+		files[name] = append(
+			files[name], os.NewFile(uintptr(fd), fmt.Sprintf("%s-%d", name, fd)))
+	}
+
+	return files, nil
+}
+
+// makeActivatedListeners converts activated files to listeners. The files
+// are always closed, as net.FileListener duplicates the file descriptor.
+func makeActivatedListeners(
+	files map[string][]*os.File) (map[string]net.Listener, error) {
+
+	defer func() {
+		for _, namedFiles := range files {
+			for _, file := range namedFiles {
+				file.Close()
+			}
+		}
+	}()
+
+	listeners := make(map[string]net.Listener)
+	for name, namedFiles := range files {
+		listener, err := net.FileListener(namedFiles[0])
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, common.ContextError(
+				fmt.Errorf("invalid activated socket %s: %s", name, err))
+		}
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+// duplicateListener returns a new listener for the same socket as the input
+// TCP listener. Closing the duplicate stops accepting on the duplicate
+// without closing the input listener.
+func duplicateListener(listener net.Listener) (net.Listener, error) {
+
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported listener type: %T", listener))
+	}
+
+	file, err := tcpListener.File()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer file.Close()
+
+	duplicate, err := net.FileListener(file)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return duplicate, nil
+}
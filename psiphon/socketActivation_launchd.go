@@ -0,0 +1,75 @@
+// +build darwin,cgo
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// getLaunchdActivatedFiles checks in the named sockets with launchd.
+func getLaunchdActivatedFiles(names []string) (map[string][]*os.File, error) {
+
+	files := make(map[string][]*os.File)
+
+	for _, name := range names {
+
+		cName := C.CString(name)
+		var fds *C.int
+		var count C.size_t
+		result := C.launch_activate_socket(cName, &fds, &count)
+		C.free(unsafe.Pointer(cName))
+
+		// ENOENT indicates that the socket isn't in the launchd job, and ESRCH
+		// indicates that the process isn't managed by launchd.
+		if syscall.Errno(result) == syscall.ENOENT || syscall.Errno(result) == syscall.ESRCH {
+			continue
+		}
+		if result != 0 {
+			for _, namedFiles := range files {
+				for _, file := range namedFiles {
+					file.Close()
+				}
+			}
+			return nil, common.ContextError(
+				fmt.Errorf("launch_activate_socket %s failed: %s", name, syscall.Errno(result)))
+		}
+
+		for _, fd := range (*[1 << 16]C.int)(unsafe.Pointer(fds))[:count:count] {
+			files[name] = append(
+				files[name], os.NewFile(uintptr(fd), fmt.Sprintf("%s-%d", name, fd)))
+		}
+		C.free(unsafe.Pointer(fds))
+	}
+
+	return files, nil
+}
@@ -0,0 +1,147 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSocketActivation(t *testing.T) {
+
+	// Activation variables for another process are ignored and unset.
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", SOCKET_ACTIVATION_SOCKS_PROXY_NAME)
+
+	listeners, err := GetActivatedListeners()
+	if err != nil {
+		t.Fatalf("GetActivatedListeners failed: %s", err)
+	}
+	if len(listeners) != 0 || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("unexpected activated listeners")
+	}
+
+	// Simulate activated sockets, named and unnamed, using descriptors
+	// duplicated from local listeners.
+
+	makeActivatedFD := func() (int, string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer listener.Close()
+		file, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File failed: %s", err)
+		}
+		defer file.Close()
+		fd, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatalf("Dup failed: %s", err)
+		}
+		return fd, listener.Addr().String()
+	}
+
+	socksFD, socksAddress := makeActivatedFD()
+	files, err := getActivatedFiles(socksFD, 1, SOCKET_ACTIVATION_SOCKS_PROXY_NAME)
+	if err != nil {
+		t.Fatalf("getActivatedFiles failed: %s", err)
+	}
+
+	unnamedFD, _ := makeActivatedFD()
+	unnamedFiles, err := getActivatedFiles(unnamedFD, 1, "")
+	if err != nil {
+		t.Fatalf("getActivatedFiles failed: %s", err)
+	}
+	files["unknown"] = unnamedFiles["unknown"]
+
+	listeners, err = makeActivatedListeners(files)
+	if err != nil {
+		t.Fatalf("makeActivatedListeners failed: %s", err)
+	}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	if len(listeners) != 2 || listeners["unknown"] == nil {
+		t.Fatalf("unexpected activated listeners: %+v", listeners)
+	}
+
+	socksListener := listeners[SOCKET_ACTIVATION_SOCKS_PROXY_NAME]
+	if socksListener == nil || socksListener.Addr().String() != socksAddress {
+		t.Fatalf("unexpected SOCKS listener")
+	}
+
+	// Run and close a local proxy using the activated listener; the
+	// activated listener must continue to accept connections.
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "Linux",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.LocalSocksProxyListener = socksListener
+	config.LocalHttpProxyListener = listeners["unknown"]
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+
+		socksProxy, err := NewSocksProxy(config, nil, "")
+		if err != nil {
+			t.Fatalf("NewSocksProxy failed: %s", err)
+		}
+		socksProxy.Close()
+
+		httpProxy, err := NewHttpProxy(config, nil, "")
+		if err != nil {
+			t.Fatalf("NewHttpProxy failed: %s", err)
+		}
+		httpProxy.Close()
+	}
+
+	conn, err := net.Dial("tcp", socksAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	acceptedConn, err := socksListener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	acceptedConn.Close()
+}
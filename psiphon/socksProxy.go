@@ -20,13 +20,16 @@
 package psiphon
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	socks "github.com/Psiphon-Labs/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 // SocksProxy is a SOCKS server that accepts local host connections
@@ -34,6 +37,7 @@ import (
 // the tunnel SSH client and relays traffic through the port
 // forward.
 type SocksProxy struct {
+	config                 *Config
 	tunneler               Tunneler
 	listener               *socks.SocksListener
 	serveWaitGroup         *sync.WaitGroup
@@ -43,6 +47,17 @@ type SocksProxy struct {
 
 var _SOCKS_PROXY_TYPE = "SOCKS"
 
+const (
+	SOCKS_RESOLUTION_REMOTE = "remote"
+	SOCKS_RESOLUTION_LOCAL  = "local"
+
+	// SOCKS_RESOLUTION_ARG is the SOCKS username argument, as in
+	// "resolve=local", used to select the resolution per request.
+	SOCKS_RESOLUTION_ARG = "resolve"
+
+	socksLocalResolutionTimeout = 10 * time.Second
+)
+
 // NewSocksProxy initializes a new SOCKS server. It begins listening for
 // connections, starts a goroutine that runs an accept loop, and returns
 // leaving the accept loop running.
@@ -51,15 +66,25 @@ func NewSocksProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
-	listener, err := socks.ListenSocks(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
-	if err != nil {
-		if IsAddressInUseError(err) {
-			NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+	var listener *socks.SocksListener
+	if config.LocalSocksProxyListener != nil {
+		activatedListener, err := duplicateListener(config.LocalSocksProxyListener)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		listener = socks.NewSocksListener(activatedListener)
+	} else {
+		listener, err = socks.ListenSocks(
+			"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
+		if err != nil {
+			if IsAddressInUseError(err) {
+				NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+			}
+			return nil, common.ContextError(err)
 		}
-		return nil, common.ContextError(err)
 	}
 	proxy = &SocksProxy{
+		config:                 config,
 		tunneler:               tunneler,
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
@@ -87,10 +112,22 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 
 	proxy.openConns.Add(localConn)
 
+	target, err := proxy.resolveTarget(localConn.Req)
+	if err != nil {
+		_ = localConn.RejectReason(byte(socks.SocksRepHostUnreachable))
+		return common.ContextError(err)
+	}
+
+	target, err = checkPortForwardPolicy(proxy.config, _SOCKS_PROXY_TYPE, target)
+	if err != nil {
+		_ = localConn.RejectReason(byte(socks.SocksRepConnectionNotAllowed))
+		return common.ContextError(err)
+	}
+
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(localConn.Req.Target, false, localConn)
+	remoteConn, err := proxy.tunneler.Dial(target, false, localConn)
 
 	if err != nil {
 		reason := byte(socks.SocksRepGeneralFailure)
@@ -112,7 +149,17 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 		return common.ContextError(err)
 	}
 
-	LocalProxyRelay(_SOCKS_PROXY_TYPE, localConn, remoteConn)
+	// When an idle timeout is configured, the relay is torn down, and the
+	// SSH channel released, after the connection is idle in both directions.
+	var relayConn net.Conn = localConn
+	idleTimeout := proxy.config.clientParameters.Get().Duration(
+		parameters.SOCKSProxyIdleTimeout)
+	if idleTimeout > 0 {
+		relayConn = common.NewIdleTimeoutConn(
+			localConn, idleTimeout, func() { remoteConn.Close() })
+	}
+
+	LocalProxyRelay(_SOCKS_PROXY_TYPE, relayConn, remoteConn)
 
 	return nil
 }
@@ -151,3 +198,59 @@ loop:
 	}
 	NoticeInfo("SOCKS proxy stopped")
 }
+
+// resolveTarget returns the address to dial through the tunnel for the
+// SOCKS request. With remote resolution, the default, the target is
+// unchanged and a hostname is resolved at the tunnel egress. With local
+// resolution, a hostname target is resolved here.
+//
+// A request with an IP address target indicates that the SOCKS client
+// resolved the hostname itself, outside of the tunnel, which is a DNS leak
+// when remote resolution is expected; this is reported in a notice.
+func (proxy *SocksProxy) resolveTarget(req socks.SocksRequest) (string, error) {
+
+	resolution := proxy.config.LocalSocksProxyResolution
+	if value, ok := req.Args.Get(SOCKS_RESOLUTION_ARG); ok {
+		if value != SOCKS_RESOLUTION_REMOTE && value != SOCKS_RESOLUTION_LOCAL {
+			return "", common.ContextError(
+				fmt.Errorf("invalid SOCKS resolution argument: %s", value))
+		}
+		resolution = value
+	}
+
+	host, port, err := net.SplitHostPort(req.Target)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	if net.ParseIP(host) != nil {
+		if resolution != SOCKS_RESOLUTION_LOCAL {
+			NoticeSocksLocalResolution()
+		}
+		return req.Target, nil
+	}
+
+	if resolution != SOCKS_RESOLUTION_LOCAL {
+		return req.Target, nil
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), socksLocalResolutionTimeout)
+	defer cancelFunc()
+
+	IPs, err := LookupIP(
+		ctx,
+		host,
+		&DialConfig{
+			DeviceBinder:    proxy.config.deviceBinder,
+			DnsServerGetter: proxy.config.dnsServerGetter,
+		})
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	if len(IPs) == 0 {
+		return "", common.ContextError(fmt.Errorf("no IP address for %s", host))
+	}
+
+	return net.JoinHostPort(IPs[0].String(), port), nil
+}
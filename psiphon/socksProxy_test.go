@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	socks "github.com/Psiphon-Labs/goptlib"
+)
+
+func TestSocksProxyResolution(t *testing.T) {
+
+	var notices bytes.Buffer
+	SetNoticeWriter(&notices)
+	defer SetNoticeWriter(os.Stderr)
+
+	ResetRepetitiveNotices()
+
+	testCases := []struct {
+		resolution     string
+		target         string
+		args           socks.Args
+		expectedTarget string
+		expectLocal    bool
+		expectError    bool
+	}{
+		{"", "example.org:443", nil, "example.org:443", false, false},
+		{SOCKS_RESOLUTION_REMOTE, "192.0.2.1:443", nil, "192.0.2.1:443", false, false},
+		{SOCKS_RESOLUTION_LOCAL, "localhost:443", nil, "", true, false},
+		{"", "localhost:443", socks.Args{"resolve": {"local"}}, "", true, false},
+		{SOCKS_RESOLUTION_LOCAL, "example.org:443", socks.Args{"resolve": {"remote"}}, "example.org:443", false, false},
+		{"", "example.org:443", socks.Args{"resolve": {"other"}}, "", false, true},
+	}
+
+	for _, testCase := range testCases {
+
+		proxy := &SocksProxy{
+			config: &Config{LocalSocksProxyResolution: testCase.resolution},
+		}
+
+		target, err := proxy.resolveTarget(
+			socks.SocksRequest{Target: testCase.target, Args: testCase.args})
+
+		if testCase.expectError {
+			if err == nil {
+				t.Fatalf("unexpected success for %+v", testCase)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("resolveTarget failed for %+v: %s", testCase, err)
+		}
+
+		if testCase.expectLocal {
+			if target != "127.0.0.1:443" && target != "[::1]:443" {
+				t.Fatalf("unexpected locally resolved target: %s", target)
+			}
+		} else if target != testCase.expectedTarget {
+			t.Fatalf("unexpected target: %s", target)
+		}
+	}
+
+	if strings.Count(notices.String(), `"SocksLocalResolution"`) != 1 {
+		t.Fatalf("unexpected SocksLocalResolution notices: %s", notices.String())
+	}
+}
@@ -67,6 +67,14 @@ import (
 // Routes data is fetched asynchronously after Start() is called. Routes
 // data is cached in the data store so it need not be downloaded in full
 // when fresh data is in the cache.
+//
+// Optionally, destinations may also be classified on the client using a
+// local GeoIP database and configured lists of untunneled and tunneled
+// countries. GeoIP classification doesn't depend on the user's region
+// and takes precedence over the routes data.
+//
+// Domain rules, SplitTunnelRules, take precedence over both and are applied
+// without resolving the destination.
 type SplitTunnelClassifier struct {
 	mutex                sync.RWMutex
 	clientParameters     *parameters.ClientParameters
@@ -75,7 +83,18 @@ type SplitTunnelClassifier struct {
 	fetchRoutesWaitGroup *sync.WaitGroup
 	isRoutesSet          bool
 	cache                map[string]*classification
+	dnsCache             *dnsCache
 	routes               common.SubnetLookup
+	geoIPDatabase        *splitTunnelGeoIPDatabase
+	untunneledCountries  []string
+	tunneledCountries    []string
+	rules                *SplitTunnelRules
+}
+
+// splitTunnelGeoIPDatabase is a reloadable MaxMind GeoIP database.
+type splitTunnelGeoIPDatabase struct {
+	common.ReloadableFile
+	reader *geoIPReader
 }
 
 type classification struct {
@@ -84,14 +103,48 @@ type classification struct {
 }
 
 func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelClassifier {
-	return &SplitTunnelClassifier{
+
+	classifier := &SplitTunnelClassifier{
 		clientParameters:     config.clientParameters,
 		userAgent:            MakePsiphonUserAgent(config),
 		dnsTunneler:          tunneler,
 		fetchRoutesWaitGroup: new(sync.WaitGroup),
 		isRoutesSet:          false,
 		cache:                make(map[string]*classification),
+		dnsCache:             newDNSCache(config.clientParameters),
+		untunneledCountries:  config.SplitTunnelUntunneledCountries,
+		tunneledCountries:    config.SplitTunnelTunneledCountries,
+		rules: &SplitTunnelRules{
+			UntunneledDomains: config.SplitTunnelUntunneledDomains,
+			TunneledDomains:   config.SplitTunnelTunneledDomains,
+		},
+	}
+
+	if config.SplitTunnelGeoIPDatabaseFilename != "" {
+
+		database := &splitTunnelGeoIPDatabase{}
+		database.ReloadableFile = common.NewReloadableFile(
+			config.SplitTunnelGeoIPDatabaseFilename,
+			func(fileContent []byte) error {
+				reader, err := newGeoIPReader(fileContent)
+				if err != nil {
+					// On error, database state remains the same
+					return common.ContextError(err)
+				}
+				database.reader = reader
+				return nil
+			})
+
+		_, err := database.Reload()
+		if err != nil {
+			// Proceed without GeoIP classification. Start will retry the load.
+			NoticeAlert("failed to load split tunnel GeoIP database: %s", err)
+		}
+
+		classifier.geoIPDatabase = database
 	}
+
+	return classifier
 }
 
 // Start resets the state of the classifier. In the default state,
@@ -105,6 +158,16 @@ func (classifier *SplitTunnelClassifier) Start(fetchRoutesTunnel *Tunnel) {
 
 	classifier.isRoutesSet = false
 
+	if classifier.geoIPDatabase != nil {
+		reloaded, err := classifier.geoIPDatabase.Reload()
+		if err != nil {
+			NoticeAlert("failed to reload split tunnel GeoIP database: %s", err)
+		} else if reloaded {
+			// Discard classifications made with the previous database.
+			classifier.cache = make(map[string]*classification)
+		}
+	}
+
 	p := classifier.clientParameters.Get()
 	dnsServerAddress := p.String(parameters.SplitTunnelDNSServer)
 	routesSignaturePublicKey := p.String(parameters.SplitTunnelRoutesSignaturePublicKey)
@@ -146,6 +209,11 @@ func (classifier *SplitTunnelClassifier) Shutdown() {
 		classifier.fetchRoutesWaitGroup = nil
 		classifier.isRoutesSet = false
 	}
+
+	metrics := classifier.dnsCache.getMetrics()
+	if metrics.Hits+metrics.Misses > 0 {
+		NoticeDNSCacheMetrics(metrics)
+	}
 }
 
 // IsUntunneled takes a destination hostname or IP address and determines
@@ -156,7 +224,19 @@ func (classifier *SplitTunnelClassifier) Shutdown() {
 // held during network access.
 func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool {
 
-	if !classifier.hasRoutes() {
+	classifier.mutex.RLock()
+	rules := classifier.rules
+	classifier.mutex.RUnlock()
+
+	isUntunneled, ok := rules.Classify(targetAddress)
+	if ok {
+		if isUntunneled {
+			NoticeUntunneled(targetAddress)
+		}
+		return isUntunneled
+	}
+
+	if !classifier.hasRoutes() && !classifier.hasGeoIP() {
 		return false
 	}
 
@@ -174,15 +254,21 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 		return cachedClassification.isUntunneled
 	}
 
-	ipAddr, ttl, err := tunneledLookupIP(
-		dnsServerAddress, classifier.dnsTunneler, targetAddress)
+	ipAddr, ttl, err := classifier.lookupIP(dnsServerAddress, targetAddress)
 	if err != nil {
 		NoticeAlert("failed to resolve address for split tunnel classification: %s", err)
 		return false
 	}
+	if ipAddr == nil {
+		// Cached negative resolution.
+		return false
+	}
 	expiry := monotime.Now().Add(ttl)
 
-	isUntunneled := classifier.ipAddressInRoutes(ipAddr)
+	isUntunneled, ok = classifier.ipAddressInGeoIPCountries(ipAddr)
+	if !ok {
+		isUntunneled = classifier.hasRoutes() && classifier.ipAddressInRoutes(ipAddr)
+	}
 
 	// TODO: garbage collect expired items from cache?
 
@@ -197,6 +283,15 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 	return isUntunneled
 }
 
+// SetRules replaces the domain rules. The new rules apply to all subsequent
+// IsUntunneled calls.
+func (classifier *SplitTunnelClassifier) SetRules(rules *SplitTunnelRules) {
+	classifier.mutex.Lock()
+	defer classifier.mutex.Unlock()
+
+	classifier.rules = rules
+}
+
 // setRoutes is a background routine that fetches routes data and installs it,
 // which sets the isRoutesSet flag, indicating that IP addresses may now be classified.
 func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel) {
@@ -349,6 +444,14 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	return routesData, nil
 }
 
+// hasRules checks if the classifier has domain rules set.
+func (classifier *SplitTunnelClassifier) hasRules() bool {
+	classifier.mutex.RLock()
+	defer classifier.mutex.RUnlock()
+
+	return !classifier.rules.IsEmpty()
+}
+
 // hasRoutes checks if the classifier has routes installed.
 func (classifier *SplitTunnelClassifier) hasRoutes() bool {
 	classifier.mutex.RLock()
@@ -357,6 +460,51 @@ func (classifier *SplitTunnelClassifier) hasRoutes() bool {
 	return classifier.isRoutesSet
 }
 
+// hasGeoIP checks if the classifier has a GeoIP database loaded.
+func (classifier *SplitTunnelClassifier) hasGeoIP() bool {
+	if classifier.geoIPDatabase == nil {
+		return false
+	}
+
+	classifier.geoIPDatabase.RLock()
+	defer classifier.geoIPDatabase.RUnlock()
+
+	return classifier.geoIPDatabase.reader != nil
+}
+
+// ipAddressInGeoIPCountries classifies a split tunnel candidate IP address
+// by its GeoIP country. The first return value indicates whether the address
+// is untunneled. The second return value is false when the address can't be
+// classified by country, in which case the routes data should be used.
+func (classifier *SplitTunnelClassifier) ipAddressInGeoIPCountries(ipAddr net.IP) (bool, bool) {
+
+	if !classifier.hasGeoIP() {
+		return false, false
+	}
+
+	classifier.geoIPDatabase.RLock()
+	country, err := classifier.geoIPDatabase.reader.lookupCountry(ipAddr)
+	classifier.geoIPDatabase.RUnlock()
+	if err != nil {
+		NoticeAlert("split tunnel GeoIP lookup failed: %s", err)
+		return false, false
+	}
+
+	if country == "" {
+		return false, false
+	}
+
+	if common.Contains(classifier.tunneledCountries, country) {
+		return false, true
+	}
+
+	if common.Contains(classifier.untunneledCountries, country) {
+		return true, true
+	}
+
+	return false, false
+}
+
 // installRoutes parses the raw routes data and creates data structures
 // for fast in-memory classification.
 func (classifier *SplitTunnelClassifier) installRoutes(routesData []byte) (err error) {
@@ -381,21 +529,54 @@ func (classifier *SplitTunnelClassifier) ipAddressInRoutes(ipAddr net.IP) bool {
 	return classifier.routes.ContainsIPAddress(ipAddr)
 }
 
+// lookupIP resolves a split tunnel candidate hostname, using the DNS cache
+// when possible. A nil IP address with no error is returned for a cached
+// negative resolution.
+func (classifier *SplitTunnelClassifier) lookupIP(
+	dnsServerAddress string, host string) (net.IP, time.Duration, error) {
+
+	if net.ParseIP(host) == nil {
+		IPs, TTL, ok := classifier.dnsCache.get(host)
+		if ok {
+			if len(IPs) == 0 {
+				return nil, 0, nil
+			}
+			return IPs[0], TTL, nil
+		}
+	}
+
+	IPs, TTLs, err := tunneledLookupIP(dnsServerAddress, classifier.dnsTunneler, host)
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+
+	if len(IPs) < 1 {
+		classifier.dnsCache.put(host, nil, 0)
+		return nil, 0, common.ContextError(errors.New("no IP address"))
+	}
+
+	if net.ParseIP(host) == nil {
+		classifier.dnsCache.put(host, IPs, TTLs[0])
+	}
+
+	return IPs[0], TTLs[0], nil
+}
+
 // tunneledLookupIP resolves a split tunnel candidate hostname with a tunneled
 // DNS request.
 func tunneledLookupIP(
-	dnsServerAddress string, dnsTunneler Tunneler, host string) (addr net.IP, ttl time.Duration, err error) {
+	dnsServerAddress string, dnsTunneler Tunneler, host string) ([]net.IP, []time.Duration, error) {
 
 	ipAddr := net.ParseIP(host)
 	if ipAddr != nil {
 		// maxDuration from golang.org/src/time/time.go
-		return ipAddr, time.Duration(1<<63 - 1), nil
+		return []net.IP{ipAddr}, []time.Duration{time.Duration(1<<63 - 1)}, nil
 	}
 
 	// dnsServerAddress must be an IP address
 	ipAddr = net.ParseIP(dnsServerAddress)
 	if ipAddr == nil {
-		return nil, 0, common.ContextError(errors.New("invalid IP address"))
+		return nil, nil, common.ContextError(errors.New("invalid IP address"))
 	}
 
 	// Dial's alwaysTunnel is set to true to ensure this connection
@@ -405,16 +586,13 @@ func tunneledLookupIP(
 	conn, err := dnsTunneler.Dial(fmt.Sprintf(
 		"%s:%d", dnsServerAddress, DNS_PORT), true, nil)
 	if err != nil {
-		return nil, 0, common.ContextError(err)
+		return nil, nil, common.ContextError(err)
 	}
 
 	ipAddrs, ttls, err := ResolveIP(host, conn)
 	if err != nil {
-		return nil, 0, common.ContextError(err)
-	}
-	if len(ipAddrs) < 1 {
-		return nil, 0, common.ContextError(errors.New("no IP address"))
+		return nil, nil, common.ContextError(err)
 	}
 
-	return ipAddrs[0], ttls[0], nil
+	return ipAddrs, ttls, nil
 }
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// SplitTunnelRules specifies domains that are to be dialed directly or
+// through the tunnel, regardless of the routes data and GeoIP split tunnel
+// classifications. The rules are applied to the destination hostname
+// received by the local proxies: the SOCKS target or the HTTP Host/CONNECT
+// target, which, for HTTPS, is expected to match the SNI.
+//
+// Each domain rule is one of:
+// - an exact domain, "example.com", which matches only that domain;
+// - a wildcard pattern, "*.example.com", which matches using '*' wildcards;
+// - a suffix, ".example.com", which matches example.com and all subdomains.
+//
+// Matching is case insensitive. When a domain matches both lists,
+// TunneledDomains takes precedence.
+type SplitTunnelRules struct {
+	UntunneledDomains []string
+	TunneledDomains   []string
+}
+
+// Validate checks that all domain rules are well-formed.
+func (rules *SplitTunnelRules) Validate() error {
+	for _, list := range [][]string{rules.UntunneledDomains, rules.TunneledDomains} {
+		for _, rule := range list {
+			if rule == "" || strings.TrimLeft(rule, ".*") == "" {
+				return common.ContextError(fmt.Errorf("invalid domain rule: '%s'", rule))
+			}
+			if strings.ContainsAny(rule, " /:") {
+				return common.ContextError(fmt.Errorf("invalid domain rule: '%s'", rule))
+			}
+		}
+	}
+	return nil
+}
+
+// IsEmpty returns true when there are no rules.
+func (rules *SplitTunnelRules) IsEmpty() bool {
+	return rules == nil ||
+		(len(rules.UntunneledDomains) == 0 && len(rules.TunneledDomains) == 0)
+}
+
+// Classify applies the rules to the specified host. The first return value
+// indicates whether the host is untunneled. The second return value is false
+// when no rule matches the host, in which case other split tunnel
+// classification should be used. IP address hosts never match.
+func (rules *SplitTunnelRules) Classify(host string) (bool, bool) {
+
+	if rules.IsEmpty() || net.ParseIP(host) != nil {
+		return false, false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if matchDomainRules(rules.TunneledDomains, host) {
+		return false, true
+	}
+
+	if matchDomainRules(rules.UntunneledDomains, host) {
+		return true, true
+	}
+
+	return false, false
+}
+
+func matchDomainRules(rules []string, host string) bool {
+	for _, rule := range rules {
+		rule = strings.ToLower(rule)
+		if strings.HasPrefix(rule, ".") {
+			if host == rule[1:] || strings.HasSuffix(host, rule) {
+				return true
+			}
+		} else if strings.Contains(rule, "*") {
+			if common.ContainsWildcard([]string{rule}, host) {
+				return true
+			}
+		} else if host == rule {
+			return true
+		}
+	}
+	return false
+}
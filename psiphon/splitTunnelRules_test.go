@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+func TestSplitTunnelRules(t *testing.T) {
+
+	rules := &SplitTunnelRules{
+		UntunneledDomains: []string{"example.com", "*.example.org", ".example.net"},
+		TunneledDomains:   []string{"tunneled.example.net"},
+	}
+
+	err := rules.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	testCases := []struct {
+		host               string
+		expectedUntunneled bool
+		expectedClassified bool
+	}{
+		{"example.com", true, true},
+		{"EXAMPLE.COM.", true, true},
+		{"www.example.com", false, false},
+		{"www.example.org", true, true},
+		{"example.org", false, false},
+		{"example.net", true, true},
+		{"a.b.example.net", true, true},
+		{"tunneled.example.net", false, true},
+		{"badexample.net", false, false},
+		{"192.0.2.1", false, false},
+	}
+
+	for _, testCase := range testCases {
+		isUntunneled, ok := rules.Classify(testCase.host)
+		if isUntunneled != testCase.expectedUntunneled || ok != testCase.expectedClassified {
+			t.Fatalf("unexpected classification for %s: %v, %v",
+				testCase.host, isUntunneled, ok)
+		}
+	}
+
+	for _, invalid := range []string{"", ".", "*", "example.com:443", "http://example.com"} {
+		rules := &SplitTunnelRules{UntunneledDomains: []string{invalid}}
+		if rules.Validate() == nil {
+			t.Fatalf("Validate unexpectedly succeeded for '%s'", invalid)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// +build !js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPReader looks up IP address countries in a MaxMind GeoIP database.
+type geoIPReader struct {
+	maxMindReader *maxminddb.Reader
+}
+
+func newGeoIPReader(fileContent []byte) (*geoIPReader, error) {
+	maxMindReader, err := maxminddb.FromBytes(fileContent)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return &geoIPReader{maxMindReader: maxMindReader}, nil
+}
+
+// lookupCountry returns the ISO country code for ipAddr, or "" when the
+// database has no country for ipAddr.
+func (reader *geoIPReader) lookupCountry(ipAddr net.IP) (string, error) {
+
+	var geoIPFields struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	err := reader.maxMindReader.Lookup(ipAddr, &geoIPFields)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return geoIPFields.Country.ISOCode, nil
+}
@@ -0,0 +1,45 @@
+// +build js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// The MaxMind reader package doesn't build for js/wasm, so split tunnel
+// GeoIP classification isn't supported.
+
+type geoIPReader struct {
+}
+
+func newGeoIPReader(_ []byte) (*geoIPReader, error) {
+	return nil, common.ContextError(
+		errors.New("split tunnel GeoIP not supported on js/wasm"))
+}
+
+func (reader *geoIPReader) lookupCountry(_ net.IP) (string, error) {
+	return "", common.ContextError(
+		errors.New("split tunnel GeoIP not supported on js/wasm"))
+}
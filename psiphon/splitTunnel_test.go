@@ -0,0 +1,179 @@
+// +build !js
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitTunnelGeoIPClassification(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-split-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	geoIPDatabaseFilename := filepath.Join(testDataDirName, "geoip.mmdb")
+
+	err = ioutil.WriteFile(geoIPDatabaseFilename, makeTestGeoIPDatabase(), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	newClassifier := func(geoIPDatabaseFilename string) *SplitTunnelClassifier {
+
+		config, err := LoadConfig([]byte(`
+        {
+            "ClientPlatform" : "Windows",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0",
+            "SplitTunnelDNSServer" : "192.0.2.1",
+            "SplitTunnelUntunneledCountries" : ["CA"],
+            "SplitTunnelTunneledCountries" : ["US"]
+        }`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		config.SplitTunnelGeoIPDatabaseFilename = geoIPDatabaseFilename
+		err = config.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+
+		return NewSplitTunnelClassifier(config, nil)
+	}
+
+	classifier := newClassifier(geoIPDatabaseFilename)
+
+	if !classifier.hasGeoIP() {
+		t.Fatalf("GeoIP database not loaded")
+	}
+
+	testCases := []struct {
+		address            string
+		expectedUntunneled bool
+		expectedClassified bool
+	}{
+		{"1.2.3.4", true, true},
+		{"130.0.0.1", false, true},
+		{"200.0.0.1", false, false},
+		{"240.0.0.1", false, false},
+	}
+
+	for _, testCase := range testCases {
+
+		isUntunneled, ok := classifier.ipAddressInGeoIPCountries(
+			net.ParseIP(testCase.address))
+		if isUntunneled != testCase.expectedUntunneled ||
+			ok != testCase.expectedClassified {
+			t.Fatalf("unexpected classification for %s: %v, %v",
+				testCase.address, isUntunneled, ok)
+		}
+
+		// With no routes data, addresses not classified by country are
+		// tunneled.
+
+		if classifier.IsUntunneled(testCase.address) != testCase.expectedUntunneled {
+			t.Fatalf("unexpected IsUntunneled result for %s", testCase.address)
+		}
+	}
+
+	// A database that can't be loaded disables GeoIP classification.
+
+	invalidDatabaseFilename := filepath.Join(testDataDirName, "invalid.mmdb")
+	err = ioutil.WriteFile(invalidDatabaseFilename, []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	classifier = newClassifier(invalidDatabaseFilename)
+
+	if classifier.hasGeoIP() || classifier.IsUntunneled("1.2.3.4") {
+		t.Fatalf("unexpected GeoIP classification")
+	}
+}
+
+// makeTestGeoIPDatabase creates a minimal IPv4 MaxMind DB with the
+// following countries: CA for 0.0.0.0/1, US for 128.0.0.0/2, DE for
+// 192.0.0.0/3, and no data for 224.0.0.0/3.
+func makeTestGeoIPDatabase() []byte {
+
+	const nodeCount = 3
+
+	writeString := func(buffer *bytes.Buffer, value string) {
+		buffer.WriteByte(2<<5 | byte(len(value)))
+		buffer.WriteString(value)
+	}
+
+	var data bytes.Buffer
+	var offsets []int
+	for _, country := range []string{"CA", "US", "DE"} {
+		offsets = append(offsets, data.Len())
+		data.WriteByte(7<<5 | 1)
+		writeString(&data, "country")
+		data.WriteByte(7<<5 | 1)
+		writeString(&data, "iso_code")
+		writeString(&data, country)
+	}
+
+	dataRecord := func(index int) uint32 {
+		return uint32(nodeCount + 16 + offsets[index])
+	}
+
+	// Each node has a left (0 bit) and right (1 bit) 24-bit record.
+
+	nodes := [nodeCount][2]uint32{
+		{dataRecord(0), 1},
+		{dataRecord(1), 2},
+		{dataRecord(2), nodeCount},
+	}
+
+	var database bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			var value [4]byte
+			binary.BigEndian.PutUint32(value[:], record)
+			database.Write(value[1:])
+		}
+	}
+	database.Write(make([]byte, 16))
+	database.Write(data.Bytes())
+
+	database.WriteString("\xAB\xCD\xEFMaxMind.com")
+	database.WriteByte(7<<5 | 3)
+	writeString(&database, "node_count")
+	database.Write([]byte{6<<5 | 1, nodeCount})
+	writeString(&database, "record_size")
+	database.Write([]byte{5<<5 | 1, 24})
+	writeString(&database, "ip_version")
+	database.Write([]byte{5<<5 | 1, 4})
+
+	return database.Bytes()
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// StatusFileRecord is the JSON content of the status file enabled by
+// Config.StatusFilename. See ControllerStatus for field descriptions.
+type StatusFileRecord struct {
+	State           string   `json:"state"`
+	EgressRegion    string   `json:"egressRegion"`
+	ActiveTunnels   int      `json:"activeTunnels"`
+	TunnelProtocols []string `json:"tunnelProtocols"`
+	TunnelRegions   []string `json:"tunnelRegions"`
+	BytesSent       int64    `json:"bytesSent"`
+	BytesReceived   int64    `json:"bytesReceived"`
+	LastError       string   `json:"lastError"`
+	LastErrorTime   string   `json:"lastErrorTime"`
+	UptimeSeconds   int64    `json:"uptimeSeconds"`
+	Timestamp       string   `json:"timestamp"`
+}
+
+// statusFileWriter periodically rewrites the status file while the
+// controller is running. The final status is written by Run after the
+// controller stops.
+func (controller *Controller) statusFileWriter() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("statusFileWriter")
+
+	for {
+		controller.writeStatusFile()
+
+		period := controller.config.clientParameters.Get().Duration(
+			parameters.StatusFileUpdatePeriod)
+
+		timer := controller.config.clock.NewTimer(period)
+
+		select {
+		case <-timer.C():
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (controller *Controller) writeStatusFile() {
+
+	status := controller.Status()
+
+	record := &StatusFileRecord{
+		State:           status.State,
+		EgressRegion:    status.EgressRegion,
+		ActiveTunnels:   status.ActiveTunnels,
+		TunnelProtocols: status.TunnelProtocols,
+		TunnelRegions:   status.TunnelRegions,
+		BytesSent:       status.BytesSent,
+		BytesReceived:   status.BytesReceived,
+		LastError:       status.LastError,
+		UptimeSeconds:   int64(status.Uptime / time.Second),
+		Timestamp:       time.Now().UTC().Format(common.RFC3339Milli),
+	}
+
+	// Empty lists are written as [] rather than null, for simpler consumers.
+	if record.TunnelProtocols == nil {
+		record.TunnelProtocols = []string{}
+	}
+	if record.TunnelRegions == nil {
+		record.TunnelRegions = []string{}
+	}
+
+	if !status.LastErrorTime.IsZero() {
+		record.LastErrorTime = status.LastErrorTime.UTC().Format(common.RFC3339Milli)
+	}
+
+	err := writeStatusFile(controller.config.StatusFilename, record)
+	if err != nil {
+		NoticeAlert("write status file failed: %s", err)
+	}
+}
+
+// writeStatusFile replaces the status file with the new record. The record
+// is written to a temporary file which is then renamed, so readers never
+// observe a partially written file.
+func writeStatusFile(filename string, record *StatusFileRecord) error {
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// As LastError may contain network details, the file is readable only
+	// by the current user, as with notice files.
+
+	tempFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tempFilename, append(value, '\n'), 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = os.Rename(tempFilename, filename)
+	if err != nil {
+		os.Remove(tempFilename)
+		return common.ContextError(err)
+	}
+
+	return nil
+}
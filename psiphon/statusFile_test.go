@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatusFile(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-status-file-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	statusFilename := filepath.Join(testDataDirName, "status.json")
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableLocalHTTPProxy" : true,
+        "DisableTactics" : true,
+        "EgressRegion" : "CA",
+        "StatusFileUpdatePeriodSeconds" : 1
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+	clientConfig.StatusFilename = statusFilename
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	readStatusFile := func() *StatusFileRecord {
+		value, err := ioutil.ReadFile(statusFilename)
+		if err != nil {
+			return nil
+		}
+		var record *StatusFileRecord
+		err = json.Unmarshal(value, &record)
+		if err != nil {
+			t.Fatalf("invalid status file: %s", err)
+		}
+		return record
+	}
+
+	waitForStatusFile := func(check func(*StatusFileRecord) bool) *StatusFileRecord {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			record := readStatusFile()
+			if record != nil && check(record) {
+				return record
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("unexpected status file: %+v", readStatusFile())
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		controller.Run(ctx)
+		close(runDone)
+	}()
+
+	record := waitForStatusFile(func(record *StatusFileRecord) bool {
+		return record.State == CONTROLLER_STATE_ESTABLISHING
+	})
+	if record.EgressRegion != "CA" ||
+		record.TunnelProtocols == nil ||
+		record.Timestamp == "" {
+		t.Fatalf("unexpected status file: %+v", record)
+	}
+
+	// The file is periodically updated.
+
+	controller.ReportBytesTransferred(10, 20)
+
+	waitForStatusFile(func(record *StatusFileRecord) bool {
+		return record.BytesSent == 10 && record.BytesReceived == 20
+	})
+
+	// The final status is written when the controller stops.
+
+	cancel()
+	<-runDone
+
+	record = readStatusFile()
+	if record == nil || record.State != CONTROLLER_STATE_STOPPED {
+		t.Fatalf("unexpected final status file: %+v", record)
+	}
+
+	_, err = os.Stat(statusFilename + ".tmp")
+	if !os.IsNotExist(err) {
+		t.Fatalf("unexpected temporary status file")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/stego"
+)
+
+// FetchStegoServerLists downloads a stego server list from
+// config.StegoServerListURLs. A stego server list is a small authenticated
+// data package of server entries, signed with the remote server list key and
+// embedded in innocuous looking content, such as an image or a social media
+// post, hosted on a service that remains reachable during severe blocking
+// events when the standard remote server list and OSL hosts are blocked. See
+// the stego package for the supported cover formats.
+//
+// Content is downloaded with the RemoteServerListTransport for the URL
+// scheme, so the built-in HTTP transport handles images and web pages, and
+// other channels, such as DNS TXT records, are supported by registering a
+// transport that stores the record content.
+//
+// config.StegoServerListDownloadFilename is the location to store the
+// download.
+func FetchStegoServerLists(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	NoticeInfo("fetching stego server lists")
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	urls := p.DownloadURLs(parameters.StegoServerListURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+
+	newETag, err := downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		"",
+		config.StegoServerListDownloadFilename)
+	if err != nil {
+		return fmt.Errorf("failed to download stego server list: %s", common.ContextError(err))
+	}
+
+	// When the resource is unchanged, skip.
+	if newETag == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(config.StegoServerListDownloadFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read stego server list: %s", common.ContextError(err))
+	}
+
+	payload, err := stego.Extract(content)
+	if err != nil {
+		return fmt.Errorf("failed to extract stego server list: %s", common.ContextError(err))
+	}
+
+	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReader(
+		bytes.NewReader(payload), publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to read stego server list: %s", common.ContextError(err))
+	}
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			serverListPayloadReader,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_STEGO),
+		true)
+	if err != nil {
+		return fmt.Errorf("failed to store stego server list: %s", common.ContextError(err))
+	}
+
+	err = SetUrlETag(canonicalURL, newETag)
+	if err != nil {
+		NoticeAlert("failed to set ETag for stego server list: %s", common.ContextError(err))
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/stego"
+)
+
+func TestFetchStegoServerLists(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-stego-server-list-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	otherPublicKey, otherPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	makeServerList := func(IPAddresses []string, publicKey, privateKey string) []byte {
+		var encodedServerEntries []string
+		for _, IPAddress := range IPAddresses {
+			encodedServerEntry, err := protocol.EncodeServerEntryFields(
+				protocol.ServerEntryFields{
+					"ipAddress":            IPAddress,
+					"configurationVersion": 1,
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntryFields failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		serverList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"), publicKey, privateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		return serverList
+	}
+
+	var imageContent bytes.Buffer
+	img, err := stego.EmbedInImage(
+		image.NewRGBA(image.Rect(0, 0, 256, 256)),
+		makeServerList(
+			[]string{"192.0.2.1", "192.0.2.2"}, signingPublicKey, signingPrivateKey))
+	if err != nil {
+		t.Fatalf("EmbedInImage failed: %s", err)
+	}
+	err = png.Encode(&imageContent, img)
+	if err != nil {
+		t.Fatalf("png.Encode failed: %s", err)
+	}
+
+	textContent, err := stego.EmbedInText(
+		"Looking forward to the weekend!",
+		makeServerList(
+			[]string{"192.0.2.3"}, signingPublicKey, signingPrivateKey))
+	if err != nil {
+		t.Fatalf("EmbedInText failed: %s", err)
+	}
+
+	otherTextContent, err := stego.EmbedInText(
+		"Looking forward to the weekend!",
+		makeServerList(
+			[]string{"192.0.2.4"}, otherPublicKey, otherPrivateKey))
+	if err != nil {
+		t.Fatalf("EmbedInText failed: %s", err)
+	}
+
+	// The server serves the current content, with a new ETag for each
+	// content change.
+
+	var content []byte
+	contentVersion := 0
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/stego" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, contentVersion))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	defer server.Close()
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+	clientConfig.RemoteServerListSignaturePublicKey = signingPublicKey
+	clientConfig.StegoServerListURLs = parameters.DownloadURLs{
+		{URL: base64.StdEncoding.EncodeToString([]byte(server.URL + "/stego"))},
+	}
+	clientConfig.StegoServerListDownloadFilename = filepath.Join(testDataDirName, "stego")
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	fetch := func(newContent []byte) error {
+		content = newContent
+		contentVersion += 1
+		return FetchStegoServerLists(
+			context.Background(), clientConfig, 0, nil, &DialConfig{})
+	}
+
+	checkServerEntries := func(IPAddresses ...string) {
+		for _, IPAddress := range IPAddresses {
+			serverEntry, err := getServerEntry(IPAddress)
+			if err != nil || serverEntry == nil {
+				t.Fatalf("missing server entry: %s", IPAddress)
+			}
+			if serverEntry.LocalSource != protocol.SERVER_ENTRY_SOURCE_STEGO {
+				t.Fatalf("unexpected server entry source: %s", serverEntry.LocalSource)
+			}
+		}
+	}
+
+	err = fetch(imageContent.Bytes())
+	if err != nil {
+		t.Fatalf("FetchStegoServerLists failed: %s", err)
+	}
+	checkServerEntries("192.0.2.1", "192.0.2.2")
+
+	err = fetch([]byte("<html><body>" + textContent + "</body></html>"))
+	if err != nil {
+		t.Fatalf("FetchStegoServerLists failed: %s", err)
+	}
+	checkServerEntries("192.0.2.3")
+
+	// Server lists which aren't signed with the remote server list key are
+	// rejected.
+
+	err = fetch([]byte(otherTextContent))
+	if err == nil {
+		t.Fatalf("unexpected FetchStegoServerLists success")
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Log levels for the structured log. See SetLogFile.
+const (
+	LOG_LEVEL_DEBUG = "debug"
+	LOG_LEVEL_INFO  = "info"
+	LOG_LEVEL_WARN  = "warn"
+	LOG_LEVEL_ERROR = "error"
+)
+
+var logLevelSeverities = map[string]int{
+	LOG_LEVEL_DEBUG: 0,
+	LOG_LEVEL_INFO:  1,
+	LOG_LEVEL_WARN:  2,
+	LOG_LEVEL_ERROR: 3,
+}
+
+// logSink is a structured log file. Access is synchronized by the notice
+// logger mutex.
+type logSink struct {
+	file                *os.File
+	severity            int
+	componentSeverities map[string]int
+	minSeverity         int
+}
+
+// logRecord is one line of the structured log.
+type logRecord struct {
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Component  string                 `json:"component"`
+	NoticeType string                 `json:"noticeType"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// SetLogFile configures a structured JSON log, written to filename, which
+// is distinct from the notice writer and notice files. Each line is a JSON
+// object with "timestamp", "level", "component", "noticeType", and "data"
+// fields.
+//
+// Every notice is assigned a level: Error notices are "error"; Alert
+// notices are "warn"; other notices which aren't diagnostic notices, such
+// as Tunnels, are "info"; and diagnostic notices, including Info notices,
+// are "debug". Notices below level are omitted. The log level is
+// independent of EmitDiagnosticNotices, so diagnostic notices may be logged
+// without being emitted to the notice writer.
+//
+// The component is the name of the source file which emitted the notice,
+// without the extension; for example, "controller", "tunnel", or
+// "meekConn". componentLevels optionally overrides level for specific
+// components, so that a single subsystem may be logged verbosely.
+//
+// As with diagnostic notices, debug level logs may contain sensitive
+// network information and should be stored securely.
+//
+// Call SetLogFile with filename "" to stop logging.
+func SetLogFile(filename, level string, componentLevels map[string]string) error {
+
+	var sink *logSink
+
+	if filename != "" {
+
+		severity, ok := logLevelSeverities[level]
+		if !ok {
+			return common.ContextError(fmt.Errorf("invalid log level: %s", level))
+		}
+
+		sink = &logSink{
+			severity:            severity,
+			componentSeverities: make(map[string]int),
+			minSeverity:         severity,
+		}
+
+		for component, componentLevel := range componentLevels {
+			componentSeverity, ok := logLevelSeverities[componentLevel]
+			if !ok {
+				return common.ContextError(
+					fmt.Errorf("invalid log level for %s: %s", component, componentLevel))
+			}
+			sink.componentSeverities[component] = componentSeverity
+			if componentSeverity < sink.minSeverity {
+				sink.minSeverity = componentSeverity
+			}
+		}
+
+		var err error
+		sink.file, err = os.OpenFile(
+			filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if singletonNoticeLogger.logSink != nil {
+		singletonNoticeLogger.logSink.file.Close()
+	}
+
+	singletonNoticeLogger.logSink = sink
+
+	enabled := int32(0)
+	if sink != nil {
+		enabled = 1
+	}
+	atomic.StoreInt32(&singletonNoticeLogger.logSinkEnabled, enabled)
+
+	return nil
+}
+
+// getNoticeLogLevel returns the structured log level for a notice.
+func getNoticeLogLevel(noticeType string, noticeFlags uint32) string {
+	switch noticeType {
+	case "Error":
+		return LOG_LEVEL_ERROR
+	case "Alert":
+		return LOG_LEVEL_WARN
+	}
+	if noticeFlags&noticeIsDiagnostic != 0 {
+		return LOG_LEVEL_DEBUG
+	}
+	return LOG_LEVEL_INFO
+}
+
+// getNoticeComponent returns the name of the source file which called into
+// the notice functions.
+func getNoticeComponent() string {
+
+	programCounters := make([]uintptr, 16)
+	count := runtime.Callers(3, programCounters)
+	frames := runtime.CallersFrames(programCounters[:count])
+
+	for {
+		frame, more := frames.Next()
+		filename := filepath.Base(frame.File)
+		if filename != "notice.go" && filename != "structuredLog.go" {
+			return strings.TrimSuffix(filename, ".go")
+		}
+		if !more {
+			break
+		}
+	}
+
+	return "unknown"
+}
+
+// accepts indicates whether a notice with the specified level and
+// component is to be logged. component is only computed when a level
+// could be accepted for some component.
+func (sink *logSink) accepts(level string, component func() string) (bool, string) {
+
+	severity := logLevelSeverities[level]
+	if severity < sink.minSeverity {
+		return false, ""
+	}
+
+	name := component()
+
+	componentSeverity, ok := sink.componentSeverities[name]
+	if !ok {
+		componentSeverity = sink.severity
+	}
+
+	return severity >= componentSeverity, name
+}
+
+func (sink *logSink) write(
+	timestamp, level, component, noticeType string,
+	data map[string]interface{}) error {
+
+	encodedRecord, err := json.Marshal(&logRecord{
+		Timestamp:  timestamp,
+		Level:      level,
+		Component:  component,
+		NoticeType: noticeType,
+		Data:       data,
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = sink.file.Write(append(encodedRecord, '\n'))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStructuredLog(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-structured-log-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	logFilename := filepath.Join(testDataDirName, "log")
+
+	err = SetLogFile(logFilename, "verbose", nil)
+	if err == nil {
+		t.Fatalf("unexpected SetLogFile success")
+	}
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(false)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	var noticeOutput bytes.Buffer
+	SetNoticeWriter(&noticeOutput)
+	defer SetNoticeWriter(os.Stderr)
+
+	readLog := func() []*logRecord {
+		value, err := ioutil.ReadFile(logFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		var records []*logRecord
+		for _, line := range bytes.Split(bytes.TrimSpace(value), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var record *logRecord
+			err := json.Unmarshal(line, &record)
+			if err != nil {
+				t.Fatalf("invalid log record: %s", err)
+			}
+			records = append(records, record)
+		}
+		os.Truncate(logFilename, 0)
+		return records
+	}
+
+	// At warn level, only alerts and errors are logged.
+
+	err = SetLogFile(logFilename, LOG_LEVEL_WARN, nil)
+	if err != nil {
+		t.Fatalf("SetLogFile failed: %s", err)
+	}
+	defer SetLogFile("", "", nil)
+
+	NoticeInfo("info message")
+	NoticeAlert("alert message")
+	NoticeClientRegion("CA")
+
+	records := readLog()
+	if len(records) != 1 ||
+		records[0].Level != LOG_LEVEL_WARN ||
+		records[0].NoticeType != "Alert" ||
+		records[0].Component != "structuredLog_test" ||
+		records[0].Data["message"] != "alert message" {
+		t.Fatalf("unexpected log records: %+v", records)
+	}
+
+	// A component override logs debug notices for the component only, and
+	// diagnostic notices are logged without being emitted as notices.
+
+	err = SetLogFile(
+		logFilename, LOG_LEVEL_INFO, map[string]string{"structuredLog_test": LOG_LEVEL_DEBUG})
+	if err != nil {
+		t.Fatalf("SetLogFile failed: %s", err)
+	}
+
+	noticeOutput.Reset()
+
+	NoticeInfo("info message")
+	NoticeClientRegion("CA")
+
+	records = readLog()
+	if len(records) != 2 ||
+		records[0].Level != LOG_LEVEL_DEBUG ||
+		records[0].NoticeType != "Info" ||
+		records[1].Level != LOG_LEVEL_INFO ||
+		records[1].NoticeType != "ClientRegion" {
+		t.Fatalf("unexpected log records: %+v", records)
+	}
+
+	if bytes.Contains(noticeOutput.Bytes(), []byte("info message")) ||
+		!bytes.Contains(noticeOutput.Bytes(), []byte("ClientRegion")) {
+		t.Fatalf("unexpected notice output: %s", noticeOutput.String())
+	}
+
+	// Logging stops when the log file is cleared.
+
+	err = SetLogFile("", "", nil)
+	if err != nil {
+		t.Fatalf("SetLogFile failed: %s", err)
+	}
+
+	NoticeAlert("alert message")
+
+	records = readLog()
+	if len(records) != 0 {
+		t.Fatalf("unexpected log records: %+v", records)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+// AppliedTactics describes the stored tactics for a network and the
+// parameters currently in effect, for debugging why a client behaves
+// differently on different networks.
+type AppliedTactics struct {
+
+	// NetworkID is the network ID of the stored tactics.
+	NetworkID string
+
+	// Tag, Expiry, Probability and TacticsParameters are from the stored
+	// tactics record for NetworkID. Tag is blank when there is no stored
+	// tactics record. The record may be expired.
+	Tag               string
+	Expiry            time.Time
+	Probability       float64
+	TacticsParameters map[string]interface{}
+
+	// ParametersTag is the tag of the parameters currently in effect. This
+	// is the tactics tag when tactics have been applied; otherwise it's the
+	// config tag. Note that the parameters in effect may be from tactics for
+	// a different network ID.
+	ParametersTag string
+
+	// Parameters are all parameter values currently in effect, merging
+	// defaults, config values, and any applied tactics.
+	Parameters map[string]interface{}
+}
+
+// GetAppliedTactics returns the stored tactics for the given network ID,
+// along with the merged parameters currently in effect.
+//
+// The datastore must be open.
+func GetAppliedTactics(config *Config, networkID string) (*AppliedTactics, error) {
+
+	record, err := tactics.GetStoredTactics(GetTacticsStorer(), networkID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	p := config.clientParameters.Get()
+
+	return &AppliedTactics{
+		NetworkID:         networkID,
+		Tag:               record.Tag,
+		Expiry:            record.Expiry,
+		Probability:       record.Tactics.Probability,
+		TacticsParameters: record.Tactics.Parameters,
+		ParametersTag:     p.Tag(),
+		Parameters:        p.GetValues(),
+	}, nil
+}
+
+// DryRunTactics reports the parameter changes that would result from
+// applying the candidate tactics, a JSON-encoded tactics.Tactics, in place of
+// any currently applied tactics. The candidate tactics are applied in the
+// same manner as tactics received from a server, but the parameters
+// currently in effect are not modified.
+func DryRunTactics(
+	config *Config, candidateTactics []byte) (map[string]parameters.ParameterChange, error) {
+
+	var candidate tactics.Tactics
+	err := json.Unmarshal(candidateTactics, &candidate)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	changes, err := config.clientParameters.DryRun(
+		true, config.makeConfigParameters(), candidate.Parameters)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// shapedConn is a net.Conn that applies the packet size distribution and
+// burst timing of a traffic shaping profile to all writes. Unlike the
+// fragmentor, which only shapes the initial bytes of a flow, shaping
+// applies for the lifetime of the conn.
+//
+// shapedConn wraps the TCP conn underlying OSSH and meek, so written bytes
+// are unchanged and no server support is required. Padding, which must be
+// discarded by the server, is sent separately through the SSH layer; see
+// sendTrafficShapingPadding.
+type shapedConn struct {
+	net.Conn
+	profile       *parameters.ShapingProfile
+	writeMutex    sync.Mutex
+	nextBurstTime monotime.Time
+	closeOnce     sync.Once
+	closedSignal  chan struct{}
+}
+
+func newShapedConn(
+	conn net.Conn, profile *parameters.ShapingProfile) *shapedConn {
+
+	return &shapedConn{
+		Conn:         conn,
+		profile:      profile,
+		closedSignal: make(chan struct{}),
+	}
+}
+
+func (conn *shapedConn) Write(buffer []byte) (int, error) {
+
+	// Concurrent writes are serialized so that each write is one burst.
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	if conn.profile.MaxBurstIntervalMilliseconds > 0 {
+		delay := conn.nextBurstTime.Sub(monotime.Now())
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-conn.closedSignal:
+				timer.Stop()
+				return 0, common.ContextError(errors.New("conn closed"))
+			}
+		}
+		interval := makeRandomPeriod(
+			time.Duration(conn.profile.MinBurstIntervalMilliseconds)*time.Millisecond,
+			time.Duration(conn.profile.MaxBurstIntervalMilliseconds)*time.Millisecond)
+		conn.nextBurstTime = monotime.Now().Add(interval)
+	}
+
+	if len(conn.profile.WriteSizes) == 0 {
+		return conn.Conn.Write(buffer)
+	}
+
+	written := 0
+	for written < len(buffer) {
+		index, err := common.MakeSecureRandomInt(len(conn.profile.WriteSizes))
+		if err != nil {
+			index = 0
+		}
+		end := written + conn.profile.WriteSizes[index]
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		n, err := conn.Conn.Write(buffer[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+func (conn *shapedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closedSignal)
+	})
+	return conn.Conn.Close()
+}
+
+// IsClosed implements the Closer interface, when the underlying conn does.
+func (conn *shapedConn) IsClosed() bool {
+	closer, ok := conn.Conn.(common.Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
+
+// selectTrafficShapingProfile selects a traffic shaping profile for the
+// tunnel protocol from the TrafficShapingProfiles parameter, which is
+// typically set via tactics for the current network. Returns nil when no
+// profile applies.
+func selectTrafficShapingProfile(
+	clientParameters *parameters.ClientParameters,
+	tunnelProtocol string) *parameters.ShapingProfile {
+
+	return clientParameters.Get().ShapingProfiles(
+		parameters.TrafficShapingProfiles).Select(tunnelProtocol)
+}
+
+// sendTrafficShapingPadding sends padding messages, as specified by the
+// tunnel's traffic shaping profile, until stopPadding is closed. Padding
+// messages are SSH requests which don't want a reply, so sending doesn't
+// block on a server round trip.
+func (tunnel *Tunnel) sendTrafficShapingPadding(stopPadding <-chan struct{}) {
+
+	profile := tunnel.trafficShapingProfile
+
+	for {
+		interval := makeRandomPeriod(
+			time.Duration(profile.MinPaddingIntervalMilliseconds)*time.Millisecond,
+			time.Duration(profile.MaxPaddingIntervalMilliseconds)*time.Millisecond)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-stopPadding:
+			timer.Stop()
+			return
+		}
+
+		padding, err := common.MakeSecureRandomPadding(
+			profile.MinPaddingBytes, profile.MaxPaddingBytes)
+		if err != nil {
+			NoticeAlert("MakeSecureRandomPadding failed: %s", common.ContextError(err))
+			continue
+		}
+
+		_, _, err = tunnel.sshClient.SendRequest(
+			protocol.PSIPHON_API_PADDING_REQUEST_NAME, false, padding)
+		if err != nil {
+			// A failed send indicates the SSH connection is closed, which is
+			// handled by the tunnel monitor.
+			return
+		}
+	}
+}
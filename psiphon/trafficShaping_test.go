@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestShapedConn(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+
+	profile := &parameters.ShapingProfile{
+		Name:                         "test",
+		WriteSizes:                   []int{100, 200},
+		MinBurstIntervalMilliseconds: 50,
+		MaxBurstIntervalMilliseconds: 50,
+	}
+
+	conn := newShapedConn(clientConn, profile)
+	defer conn.Close()
+
+	readSizes := make(chan int, 1024)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := serverConn.Read(buffer)
+			if err != nil {
+				close(readSizes)
+				return
+			}
+			readSizes <- n
+		}
+	}()
+
+	startTime := monotime.Now()
+
+	for i := 0; i < 3; i++ {
+		n, err := conn.Write(make([]byte, 1000))
+		if err != nil || n != 1000 {
+			t.Fatalf("Write failed: %d, %v", n, err)
+		}
+	}
+
+	// The first burst isn't delayed; each subsequent burst is delayed by
+	// the burst interval.
+	if monotime.Since(startTime) < 100*time.Millisecond {
+		t.Fatalf("unexpected burst timing: %s", monotime.Since(startTime))
+	}
+
+	serverConn.Close()
+
+	total := 0
+	for n := range readSizes {
+		// The final chunk of each write may be smaller than the sampled size.
+		if n > 200 {
+			t.Fatalf("unexpected write size: %d", n)
+		}
+		total += n
+	}
+
+	if total != 3000 {
+		t.Fatalf("unexpected total: %d", total)
+	}
+}
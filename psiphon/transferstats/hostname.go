@@ -40,6 +40,13 @@ func getHostname(buffer []byte) (hostname string, ok bool) {
 	return
 }
 
+// GetTLSHostname attempts to interpret the buffer as a TLS client hello and
+// extract the SNI hostname from it. The buffer must contain the complete
+// first TLS record.
+func GetTLSHostname(buffer []byte) (hostname string, ok bool) {
+	return getTLSHostname(buffer)
+}
+
 /*
 TLS Record Protocol:
 Record layer content type (1B): handshake is 22: 22
@@ -43,6 +43,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpchannel"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 	regen "github.com/zach-klippenstein/goregen"
 )
@@ -76,12 +77,17 @@ type Tunneler interface {
 type TunnelOwner interface {
 	SignalSeededNewSLOK()
 	SignalTunnelFailure(tunnel *Tunnel)
+	ReportBytesTransferred(sent, received int64)
 }
 
 // Tunnel is a connection to a Psiphon server. An established
 // tunnel includes a network connection to the specified server
 // and an SSH session built on top of that transport.
 type Tunnel struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	recentBytesTransferred     int64
 	mutex                      *sync.Mutex
 	config                     *Config
 	isActivated                bool
@@ -92,6 +98,7 @@ type Tunnel struct {
 	serverContext              *ServerContext
 	protocol                   string
 	conn                       *common.ActivityMonitoredConn
+	meekConn                   *MeekConn
 	sshClient                  *ssh.Client
 	sshServerRequests          <-chan *ssh.Request
 	operateWaitGroup           *sync.WaitGroup
@@ -103,6 +110,7 @@ type Tunnel struct {
 	establishDuration          time.Duration
 	establishedTime            monotime.Time
 	dialStats                  *DialStats
+	trafficShapingProfile      *parameters.ShapingProfile
 }
 
 // DialStats records additional dial config that is sent to the server for
@@ -117,6 +125,9 @@ type Tunnel struct {
 // dial process has begun. The atomic.Value will contain a string, initialized
 // to "", and set to the resolved IP address once that part of the dial
 // process has completed.
+//
+// IsReplay indicates that the dial parameters were replayed from a fast
+// reconnect record rather than freshly selected.
 type DialStats struct {
 	SelectedSSHClientVersion       bool
 	SSHClientVersion               string
@@ -131,6 +142,11 @@ type DialStats struct {
 	UserAgent                      string
 	SelectedTLSProfile             bool
 	TLSProfile                     string
+	TrafficShapingProfile          string
+	QUICWireVersion                string
+	TCPMaxSegmentSize              int
+	InproxyConnectionID            string
+	IsReplay                       bool
 }
 
 // ConnectTunnel first makes a network transport connection to the
@@ -143,9 +159,15 @@ type DialStats struct {
 // When requiredProtocol is not blank, that protocol is used. Otherwise,
 // the a random supported protocol is used.
 //
+// When replayParameters is not nil, the recorded dial parameters of a
+// previous successful tunnel are used in place of newly selected values.
+//
 // Call Activate on a connected tunnel to complete its establishment
 // before using.
 //
+// When establishBudget is not nil, connection traffic up to the completion
+// of the SSH handshake is limited by the shared budget.
+//
 // Tunnel establishment is split into two phases: connection, and
 // activation. The Controller will run many ConnectTunnel calls
 // concurrently and then, to avoid unnecessary overhead from making
@@ -159,7 +181,9 @@ func ConnectTunnel(
 	sessionId string,
 	serverEntry *protocol.ServerEntry,
 	selectedProtocol string,
-	adjustedEstablishStartTime monotime.Time) (*Tunnel, error) {
+	replayParameters *replayDialParameters,
+	adjustedEstablishStartTime monotime.Time,
+	establishBudget *establishBudget) (*Tunnel, error) {
 
 	if !serverEntry.SupportsProtocol(selectedProtocol) {
 		return nil, common.ContextError(
@@ -169,11 +193,15 @@ func ConnectTunnel(
 	// Build transport layers and establish SSH connection. Note that
 	// dialConn and monitoredConn are the same network connection.
 	dialResult, err := dialSsh(
-		ctx, config, serverEntry, selectedProtocol, sessionId)
+		ctx, config, serverEntry, selectedProtocol, replayParameters, sessionId, establishBudget)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
+	// meekConn is retained for releasing buffers in dormancy mode. The
+	// monitored conn may wrap the dial conn, so the dial conn is checked.
+	meekConn, _ := dialResult.dialConn.(*MeekConn)
+
 	// The tunnel is now connected
 	return &Tunnel{
 		mutex:             new(sync.Mutex),
@@ -182,6 +210,7 @@ func ConnectTunnel(
 		serverEntry:       serverEntry,
 		protocol:          selectedProtocol,
 		conn:              dialResult.monitoredConn,
+		meekConn:          meekConn,
 		sshClient:         dialResult.sshClient,
 		sshServerRequests: dialResult.sshRequests,
 		// A buffer allows at least one signal to be sent even when the receiver is
@@ -189,6 +218,7 @@ func ConnectTunnel(
 		signalPortForwardFailure:   make(chan struct{}, 1),
 		adjustedEstablishStartTime: adjustedEstablishStartTime,
 		dialStats:                  dialResult.dialStats,
+		trafficShapingProfile:      dialResult.trafficShapingProfile,
 	}, nil
 }
 
@@ -280,7 +310,7 @@ func (tunnel *Tunnel) Activate(
 	//
 	// This time period may include time spent unsuccessfully connecting to other
 	// servers. Time spent waiting for network connectivity is excluded.
-	tunnel.establishDuration = monotime.Since(tunnel.adjustedEstablishStartTime)
+	tunnel.establishDuration = tunnel.config.clock.Now().Sub(tunnel.adjustedEstablishStartTime)
 	tunnel.establishedTime = monotime.Now()
 
 	// Use the Background context instead of the controller run context, as tunnels
@@ -385,6 +415,18 @@ func (tunnel *Tunnel) Dial(
 		return nil, common.ContextError(errors.New("tunnel is not activated"))
 	}
 
+	udpgwServerAddress := tunnel.config.clientParameters.Get().String(
+		parameters.UDPChannelUdpgwServerAddress)
+	if udpgwServerAddress != "" && remoteAddr == udpgwServerAddress {
+		conn, err := tunnel.dialUdpgwUDPChannel()
+		if err == nil {
+			return conn, nil
+		}
+		// Fall back to the server's udpgw, which may be supported when UDP
+		// channels are not.
+		NoticeInfo("UDP channel for udpgw failed: %s", err)
+	}
+
 	type tunnelDialResult struct {
 		sshPortForwardConn net.Conn
 		err                error
@@ -430,7 +472,18 @@ func (tunnel *Tunnel) Dial(
 		tunnel:         tunnel,
 		downstreamConn: downstreamConn}
 
-	return tunnel.wrapWithTransferStats(conn), nil
+	conn = tunnel.wrapWithTransferStats(conn)
+
+	// When an idle timeout is configured, idle port forwards are closed to
+	// release the SSH channel. Closing the TunneledConn also closes any
+	// downstreamConn.
+	idleTimeout := tunnel.config.clientParameters.Get().Duration(
+		parameters.TunneledPortForwardIdleTimeout)
+	if idleTimeout > 0 {
+		conn = common.NewIdleTimeoutConn(conn, idleTimeout, nil)
+	}
+
+	return conn, nil
 }
 
 func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
@@ -465,6 +518,54 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 	return tunnel.wrapWithTransferStats(conn), nil
 }
 
+// DialUDPChannel opens a UDP channel, which relays UDP flows using the
+// native UDP channel protocol, and returns a udpchannel.Client for opening
+// flows. Servers which don't support UDP channels reject the channel open,
+// and callers may fall back to udpgw.
+func (tunnel *Tunnel) DialUDPChannel() (*udpchannel.Client, error) {
+
+	if !tunnel.IsActivated() {
+		return nil, common.ContextError(errors.New("tunnel is not activated"))
+	}
+	channel, requests, err := tunnel.sshClient.OpenChannel(
+		protocol.UDP_CHANNEL_TYPE, nil)
+	if err != nil {
+		// A rejected channel open indicates that the server doesn't support
+		// UDP channels, not a port forward failure.
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			select {
+			case tunnel.signalPortForwardFailure <- *new(struct{}):
+			default:
+			}
+		}
+		return nil, common.ContextError(err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	// As with DialPacketTunnelChannel, wrapWithTransferStats tracks bytes
+	// transferred, including frame overhead, and recent activity.
+
+	conn := tunnel.wrapWithTransferStats(newChannelConn(channel))
+
+	return udpchannel.NewClient(conn), nil
+}
+
+// dialUdpgwUDPChannel returns a port forward conn which terminates the
+// udpgw protocol and relays the udpgw UDP flows using a UDP channel.
+func (tunnel *Tunnel) dialUdpgwUDPChannel() (net.Conn, error) {
+
+	client, err := tunnel.DialUDPChannel()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	conn, relayConn := net.Pipe()
+
+	go udpchannel.RelayUdpgw(relayConn, client)
+
+	return conn, nil
+}
+
 func (tunnel *Tunnel) wrapWithTransferStats(conn net.Conn) net.Conn {
 
 	// Tunnel does not have a serverContext when DisableApi is set. We still use
@@ -572,12 +673,14 @@ func selectFrontingParameters(
 }
 
 // initMeekConfig is a helper that creates a MeekConfig suitable for the
-// selected meek tunnel protocol.
+// selected meek tunnel protocol. When replayParameters is not nil, the
+// recorded meek dial address, SNI, Host header, and TLS profile are used.
 func initMeekConfig(
 	config *Config,
 	serverEntry *protocol.ServerEntry,
 	selectedProtocol,
-	sessionId string) (*MeekConfig, error) {
+	sessionId string,
+	replayParameters *replayDialParameters) (*MeekConfig, error) {
 
 	doMeekTransformHostName := func() bool {
 		return config.clientParameters.Get().WeightedCoinFlip(
@@ -655,6 +758,13 @@ func initMeekConfig(
 			fmt.Errorf("unknown tunnel protocol: %s", selectedProtocol))
 	}
 
+	if replayParameters != nil && replayParameters.MeekDialAddress != "" {
+		dialAddress = replayParameters.MeekDialAddress
+		SNIServerName = replayParameters.MeekSNIServerName
+		hostHeader = replayParameters.MeekHostHeader
+		transformedHostName = replayParameters.MeekTransformedHostName
+	}
+
 	if config.clientParameters.Get().Bool(parameters.MeekDialDomainsOnly) {
 		host, _, _ := net.SplitHostPort(dialAddress)
 		if net.ParseIP(host) != nil {
@@ -669,9 +779,21 @@ func initMeekConfig(
 	}
 
 	// Pin the TLS profile for the entire meek connection.
+	// A replayed TLS profile is used only when it's still permitted by
+	// LimitTLSProfiles.
 	selectedTLSProfile := ""
 	if protocol.TunnelProtocolUsesMeekHTTPS(selectedProtocol) {
-		selectedTLSProfile = SelectTLSProfile(config.clientParameters)
+		limitTLSProfiles := config.clientParameters.Get().TLSProfiles(
+			parameters.LimitTLSProfiles)
+		if replayParameters != nil &&
+			common.Contains(protocol.SupportedTLSProfiles, replayParameters.TLSProfile) &&
+			(len(limitTLSProfiles) == 0 ||
+				common.Contains(limitTLSProfiles, replayParameters.TLSProfile)) {
+
+			selectedTLSProfile = replayParameters.TLSProfile
+		} else {
+			selectedTLSProfile = SelectTLSProfile(config.clientParameters)
+		}
 	}
 
 	return &MeekConfig{
@@ -695,9 +817,13 @@ func initDialConfig(
 
 	var upstreamProxyType string
 
+	// When configured, the V2Ray outbound adapter replaces UpstreamProxyURL
+	// for tunnel dials.
+	upstreamProxyURL := config.getTunnelUpstreamProxyURL()
+
 	if config.UseUpstreamProxy() {
 		// Note: UpstreamProxyURL will be validated in the dial
-		proxyURL, err := url.Parse(config.UpstreamProxyURL)
+		proxyURL, err := url.Parse(upstreamProxyURL)
 		if err == nil {
 			upstreamProxyType = proxyURL.Scheme
 		}
@@ -729,12 +855,16 @@ func initDialConfig(
 	}
 
 	dialConfig := &DialConfig{
-		UpstreamProxyURL:              config.UpstreamProxyURL,
+		UpstreamProxyURL:              upstreamProxyURL,
+		UpstreamProxyChainURLs:        config.UpstreamProxyChainURLs,
 		CustomHeaders:                 dialCustomHeaders,
 		DeviceBinder:                  config.deviceBinder,
-		DnsServerGetter:               config.DnsServerGetter,
+		DnsServerGetter:               config.dnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		ClientParameters:              config.clientParameters,
+		dialCapture:                   config.dialCapture,
+		NetworkEmulator:               config.NetworkEmulator,
 	}
 
 	dialStats := &DialStats{}
@@ -785,11 +915,12 @@ func initDialConfig(
 }
 
 type dialResult struct {
-	dialConn      net.Conn
-	monitoredConn *common.ActivityMonitoredConn
-	sshClient     *ssh.Client
-	sshRequests   <-chan *ssh.Request
-	dialStats     *DialStats
+	dialConn              net.Conn
+	monitoredConn         *common.ActivityMonitoredConn
+	sshClient             *ssh.Client
+	sshRequests           <-chan *ssh.Request
+	dialStats             *DialStats
+	trafficShapingProfile *parameters.ShapingProfile
 }
 
 // dialSsh is a helper that builds the transport layers and establishes the SSH connection.
@@ -803,14 +934,18 @@ func dialSsh(
 	ctx context.Context,
 	config *Config,
 	serverEntry *protocol.ServerEntry,
-	selectedProtocol,
-	sessionId string) (*dialResult, error) {
+	selectedProtocol string,
+	replayParameters *replayDialParameters,
+	sessionId string,
+	establishBudget *establishBudget) (*dialResult, error) {
 
 	p := config.clientParameters.Get()
 	timeout := p.Duration(parameters.TunnelConnectTimeout)
 	rateLimits := p.RateLimits(parameters.TunnelRateLimits)
 	obfuscatedSSHMinPadding := p.Int(parameters.ObfuscatedSSHMinPadding)
 	obfuscatedSSHMaxPadding := p.Int(parameters.ObfuscatedSSHMaxPadding)
+	channelWindowSize := p.Int(parameters.SSHChannelWindowSize)
+	packetTunnelChannelWindowSize := p.Int(parameters.SSHPacketTunnelChannelWindowSize)
 	p = nil
 
 	var cancelFunc context.CancelFunc
@@ -844,14 +979,25 @@ func dialSsh(
 		useObfuscatedSsh = true
 		directDialAddress = serverEntry.IpAddress
 
+	case protocol.TUNNEL_PROTOCOL_INPROXY_WEBRTC_OBFUSCATED_SSH:
+		// The in-proxy relays to the OSSH port; directDialAddress is the
+		// proxy destination and is not dialed by the client.
+		useObfuscatedSsh = true
+		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
+
 	case protocol.TUNNEL_PROTOCOL_SSH:
 		selectedSSHClientVersion = true
-		SSHClientVersion = pickSSHClientVersion()
+		if replayParameters != nil && replayParameters.SelectedSSHClientVersion {
+			SSHClientVersion = replayParameters.SSHClientVersion
+		} else {
+			SSHClientVersion = pickSSHClientVersion()
+		}
 		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshPort)
 
 	default:
 		useObfuscatedSsh = true
-		meekConfig, err = initMeekConfig(config, serverEntry, selectedProtocol, sessionId)
+		meekConfig, err = initMeekConfig(
+			config, serverEntry, selectedProtocol, sessionId, replayParameters)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -859,6 +1005,14 @@ func dialSsh(
 
 	dialConfig, dialStats := initDialConfig(config, meekConfig)
 
+	if replayParameters != nil {
+		dialStats.IsReplay = true
+		if dialStats.SelectedUserAgent && replayParameters.SelectedUserAgent {
+			dialConfig.CustomHeaders.Set("User-Agent", replayParameters.UserAgent)
+			dialStats.UserAgent = replayParameters.UserAgent
+		}
+	}
+
 	// Add dial stats specific to SSH dialing
 
 	if selectedSSHClientVersion {
@@ -866,6 +1020,33 @@ func dialSsh(
 		dialStats.SSHClientVersion = SSHClientVersion
 	}
 
+	// Traffic shaping applies to the TCP conns underlying OSSH and meek.
+	trafficShapingProfile := selectTrafficShapingProfile(
+		config.clientParameters, selectedProtocol)
+	if trafficShapingProfile != nil {
+		dialConfig.TrafficShapingProfile = trafficShapingProfile
+		dialStats.TrafficShapingProfile = trafficShapingProfile.Name
+	}
+
+	// The TCP MSS applies to TCP conns dialed directly, not through an
+	// upstream proxy.
+	if dialConfig.UpstreamProxyURL == "" &&
+		!protocol.TunnelProtocolUsesQUIC(selectedProtocol) &&
+		!protocol.TunnelProtocolUsesInproxy(selectedProtocol) {
+
+		MSS := selectTCPMaxSegmentSize(config.clientParameters, selectedProtocol)
+		if MSS > 0 {
+			dialConfig.TCPMaxSegmentSize = MSS
+			dialStats.TCPMaxSegmentSize = MSS
+		}
+	}
+
+	if config.EmitFirstFlightFingerprints {
+		dialConfig.FirstFlightCallback = func(fingerprint FirstFlightFingerprint) {
+			NoticeFirstFlightFingerprint(selectedProtocol, fingerprint)
+		}
+	}
+
 	// Note: dialStats.MeekResolvedIPAddress isn't set until the dial begins,
 	// so it will always be blank in NoticeConnectingServer.
 
@@ -875,6 +1056,14 @@ func dialSsh(
 		selectedProtocol,
 		dialStats)
 
+	err = knockIfRequired(ctx, config, dialConfig, serverEntry, selectedProtocol)
+	if err != nil {
+		reportDialFailure(
+			config, serverEntry, selectedProtocol,
+			BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
+		return nil, common.ContextError(err)
+	}
+
 	// Create the base transport: meek or direct connection
 
 	var dialConn net.Conn
@@ -885,6 +1074,9 @@ func dialSsh(
 			meekConfig,
 			dialConfig)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 
@@ -895,16 +1087,26 @@ func dialSsh(
 			directDialAddress,
 			dialConfig)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 
+		wireImage, wireVersion := selectQUICWireImage(config.clientParameters)
+		dialStats.QUICWireVersion = wireVersion
+
 		dialConn, err = quic.Dial(
 			ctx,
 			packetConn,
 			remoteAddr,
 			quicDialSNIAddress,
-			selectQUICVersion(config.clientParameters))
+			selectQUICVersion(config.clientParameters),
+			wireImage)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 
@@ -916,6 +1118,25 @@ func dialSsh(
 			serverEntry.MarionetteFormat,
 			directDialAddress)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
+			return nil, common.ContextError(err)
+		}
+
+	} else if protocol.TunnelProtocolUsesInproxy(selectedProtocol) {
+
+		dialConn, err = dialInproxy(
+			ctx,
+			config,
+			serverEntry,
+			directDialAddress,
+			sessionId,
+			dialStats)
+		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 
@@ -927,6 +1148,9 @@ func dialSsh(
 			NewNetDialer(dialConfig),
 			directDialAddress)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 
@@ -940,6 +1164,9 @@ func dialSsh(
 			config.clientParameters,
 			nil)
 		if err != nil {
+			reportDialFailure(
+				config, serverEntry, selectedProtocol,
+				BLOCKING_EVENT_STAGE_CONNECT, dialStats, err)
 			return nil, common.ContextError(err)
 		}
 	}
@@ -958,8 +1185,17 @@ func dialSsh(
 		}
 	}()
 
+	// Apply the establishment budget, if any, which is released once the SSH
+	// handshake completes
+	budgetedDialConn := dialConn
+	var budgetedConn *budgetedConn
+	if establishBudget != nil {
+		budgetedConn = establishBudget.wrapConn(dialConn)
+		budgetedDialConn = budgetedConn
+	}
+
 	// Activity monitoring is used to measure tunnel duration
-	monitoredConn, err := common.NewActivityMonitoredConn(dialConn, 0, false, nil, nil)
+	monitoredConn, err := common.NewActivityMonitoredConn(budgetedDialConn, 0, false, nil, nil)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -1017,6 +1253,9 @@ func dialSsh(
 		ClientVersion:   SSHClientVersion,
 	}
 
+	sshClientConfig.ChannelWindowSize = channelWindowSize
+	sshClientConfig.PacketTunnelChannelWindowSize = packetTunnelChannelWindowSize
+
 	if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) {
 		if config.ObfuscatedSSHAlgorithms != nil {
 			sshClientConfig.KeyExchanges = []string{config.ObfuscatedSSHAlgorithms[0]}
@@ -1094,9 +1333,14 @@ func dialSsh(
 	}
 
 	if result.err != nil {
+		reportDialFailure(
+			config, serverEntry, selectedProtocol,
+			BLOCKING_EVENT_STAGE_HANDSHAKE, dialStats, result.err)
 		return nil, common.ContextError(result.err)
 	}
 
+	budgetedConn.release()
+
 	NoticeConnectedServer(
 		serverEntry.IpAddress,
 		serverEntry.Region,
@@ -1110,11 +1354,12 @@ func dialSsh(
 	// (and also bypasses throttling).
 
 	return &dialResult{
-			dialConn:      dialConn,
-			monitoredConn: monitoredConn,
-			sshClient:     result.sshClient,
-			sshRequests:   result.sshRequests,
-			dialStats:     dialStats},
+			dialConn:              dialConn,
+			monitoredConn:         monitoredConn,
+			sshClient:             result.sshClient,
+			sshRequests:           result.sshRequests,
+			dialStats:             dialStats,
+			trafficShapingProfile: trafficShapingProfile},
 		nil
 }
 
@@ -1144,6 +1389,42 @@ func selectQUICVersion(
 	return quicVersions[choice]
 }
 
+// selectQUICWireImage selects the QUIC wire image options, returning nil when
+// no wire image transformation is configured. The returned wire version is
+// the selected QUICWireVersions value, for dial stats.
+func selectQUICWireImage(
+	clientParameters *parameters.ClientParameters) (*quic.WireImage, string) {
+
+	p := clientParameters.Get()
+	wireVersions := p.QUICWireVersions(parameters.QUICWireVersions)
+	paddingMin := p.Int(parameters.QUICInitialPacketPaddingMinBytes)
+	paddingMax := p.Int(parameters.QUICInitialPacketPaddingMaxBytes)
+	p = nil
+
+	if len(wireVersions) == 0 && paddingMax == 0 {
+		return nil, ""
+	}
+
+	wireImage := &quic.WireImage{}
+
+	wireVersion := ""
+	if len(wireVersions) > 0 {
+		choice, _ := common.MakeSecureRandomInt(len(wireVersions))
+		wireVersion = wireVersions[choice]
+		version, err := protocol.ParseQUICWireVersion(wireVersion)
+		if err != nil {
+			NoticeAlert("ParseQUICWireVersion failed: %s", err)
+			wireVersion = ""
+		} else {
+			wireImage.Version = version
+		}
+	}
+
+	wireImage.PaddingBytes, _ = common.MakeSecureRandomRange(paddingMin, paddingMax)
+
+	return wireImage, wireVersion
+}
+
 func makeRandomPeriod(min, max time.Duration) time.Duration {
 	period, err := common.MakeSecureRandomPeriod(min, max)
 	if err != nil {
@@ -1207,10 +1488,22 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 	lastBytesReceivedTime := monotime.Now()
 
+	dormancy := newTunnelDormancy(monotime.Now())
+
 	lastTotalBytesTransferedTime := monotime.Now()
 	totalSent := int64(0)
 	totalReceived := int64(0)
 
+	// unpersistedSent and unpersistedReceived are the bytes transferred not
+	// yet added to the persistent totals, which are updated with each
+	// TotalBytesTransferred notice and when the tunnel shuts down.
+	unpersistedSent := int64(0)
+	unpersistedReceived := int64(0)
+
+	// activeSeconds counts the noticeBytesTransferredTicker periods with
+	// tunneled traffic, for recording throughput.
+	activeSeconds := 0
+
 	noticeBytesTransferredTicker := time.NewTicker(1 * time.Second)
 	defer noticeBytesTransferredTicker.Stop()
 
@@ -1241,6 +1534,11 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 	nextSshKeepAlivePeriod := func() time.Duration {
 		p := clientParameters.Get()
+		if dormancy.isDormant {
+			return makeRandomPeriod(
+				p.Duration(parameters.DormancySSHKeepAlivePeriodMin),
+				p.Duration(parameters.DormancySSHKeepAlivePeriodMax))
+		}
 		return makeRandomPeriod(
 			p.Duration(parameters.SSHKeepAlivePeriodMin),
 			p.Duration(parameters.SSHKeepAlivePeriodMax))
@@ -1258,6 +1556,18 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// other operations.
 	requestsWaitGroup := new(sync.WaitGroup)
 
+	paddingWaitGroup := new(sync.WaitGroup)
+	stopPadding := make(chan struct{})
+	if tunnel.trafficShapingProfile != nil &&
+		tunnel.trafficShapingProfile.MaxPaddingBytes > 0 {
+
+		paddingWaitGroup.Add(1)
+		go func() {
+			defer paddingWaitGroup.Done()
+			tunnel.sendTrafficShapingPadding(stopPadding)
+		}()
+	}
+
 	requestsWaitGroup.Add(1)
 	signalStatusRequest := make(chan struct{})
 	go func() {
@@ -1297,14 +1607,51 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 				lastBytesReceivedTime = monotime.Now()
 			}
 
+			// Enter dormancy mode after DormancyIdlePeriod with no tunneled
+			// traffic, and exit dormancy mode as soon as there's new traffic.
+			// The SSH keep alive timer is rescheduled on each transition to
+			// apply the new keep alive cadence.
+
+			enteredDormancy, exitedDormancy := dormancy.update(
+				monotime.Now(),
+				clientParameters.Get().Duration(parameters.DormancyIdlePeriod),
+				sent,
+				received)
+
+			if enteredDormancy {
+				tunnel.enterDormancy()
+			} else if exitedDormancy {
+				NoticeDormancy(tunnel.serverEntry.IpAddress, false)
+			}
+
+			if (enteredDormancy || exitedDormancy) &&
+				!tunnel.config.DisablePeriodicSshKeepAlive {
+
+				sshKeepAliveTimer.Reset(nextSshKeepAlivePeriod())
+			}
+
 			totalSent += sent
 			totalReceived += received
+			atomic.AddInt64(&tunnel.recentBytesTransferred, sent+received)
+			tunnelOwner.ReportBytesTransferred(sent, received)
+			unpersistedSent += sent
+			unpersistedReceived += received
+
+			if sent > 0 || received > 0 {
+				activeSeconds += 1
+			}
 
 			noticePeriod := clientParameters.Get().Duration(parameters.TotalBytesTransferredNoticePeriod)
 
 			if lastTotalBytesTransferedTime.Add(noticePeriod).Before(monotime.Now()) {
 				NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+				NoticeSSHChannelStats(tunnel.serverEntry.IpAddress, tunnel.sshClient.ChannelStats())
 				lastTotalBytesTransferedTime = monotime.Now()
+
+				persistBytesTransferred(
+					tunnel.serverEntry.Region, unpersistedSent, unpersistedReceived)
+				unpersistedSent = 0
+				unpersistedReceived = 0
 			}
 
 			// Only emit the frequent BytesTransferred notice when tunnel is not idle.
@@ -1380,13 +1727,32 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	close(signalStatusRequest)
 	requestsWaitGroup.Wait()
 
+	close(stopPadding)
+	paddingWaitGroup.Wait()
+
 	// Capture bytes transferred since the last noticeBytesTransferredTicker tick
 	sent, received := transferstats.ReportRecentBytesTransferredForServer(tunnel.serverEntry.IpAddress)
 	totalSent += sent
 	totalReceived += received
+	tunnelOwner.ReportBytesTransferred(sent, received)
 
 	// Always emit a final NoticeTotalBytesTransferred
 	NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+	NoticeSSHChannelStats(tunnel.serverEntry.IpAddress, tunnel.sshClient.ChannelStats())
+
+	persistBytesTransferred(
+		tunnel.serverEntry.Region,
+		unpersistedSent+sent,
+		unpersistedReceived+received)
+
+	if activeSeconds > 0 &&
+		clientParameters.Get().Bool(parameters.AdaptiveProtocolSelection) {
+
+		recordProtocolThroughput(
+			getNetworkIDKey(tunnel.config),
+			tunnel.protocol,
+			float64(totalSent+totalReceived)/float64(activeSeconds))
+	}
 
 	if err == nil {
 		NoticeInfo("shutdown operate tunnel")
@@ -1404,6 +1770,42 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	}
 }
 
+// persistBytesTransferred adds the bytes transferred to the persistent
+// totals for the current UTC day and the server region, and emits a
+// DailyBytesTransferred notice with the updated totals.
+func persistBytesTransferred(region string, sent, received int64) {
+
+	if sent == 0 && received == 0 {
+		return
+	}
+
+	day := time.Now().UTC().Format("2006-01-02")
+
+	total, err := AddBytesTransferred(day, region, sent, received)
+	if err != nil {
+		NoticeAlert("AddBytesTransferred failed: %s", err)
+		return
+	}
+
+	NoticeDailyBytesTransferred(total.Day, total.Region, total.Sent, total.Received)
+}
+
+// enterDormancy releases idle resources held by the tunnel: meek relay
+// buffers and SSH channel write buffers. Buffers are reallocated on demand
+// when traffic resumes, so no corresponding exit action is required.
+func (tunnel *Tunnel) enterDormancy() {
+
+	NoticeDormancy(tunnel.serverEntry.IpAddress, true)
+
+	if tunnel.meekConn != nil {
+		tunnel.meekConn.ReleaseBuffers()
+	}
+
+	tunnel.sshClient.ReleaseBuffers()
+
+	DoGarbageCollection()
+}
+
 // sendSshKeepAlive is a helper which sends a keepalive@openssh.com request
 // on the specified SSH connections and returns true of the request succeeds
 // within a specified timeout. If the request fails, the associated conn is
@@ -1463,7 +1865,7 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 			err = tactics.AddSpeedTestSample(
 				tunnel.config.clientParameters,
 				GetTacticsStorer(),
-				tunnel.config.networkIDGetter.GetNetworkID(),
+				tunnel.config.getTacticsNetworkID(),
 				tunnel.serverEntry.Region,
 				tunnel.protocol,
 				elapsedTime,
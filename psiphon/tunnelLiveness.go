@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// tunnelLivenessWatchdog periodically probes each active tunnel and
+// replaces tunnels whose probes fail TunnelLivenessProbeMaxFailures
+// consecutive times.
+//
+// The watchdog complements the SSH keep alives sent by operateTunnel, which
+// are sent only when the tunnel is idle and which fail the tunnel on the
+// first timeout. Liveness probes are sent regardless of tunnel activity, so
+// a tunnel that continues to receive some bytes but which no longer relays
+// new port forwards is detected; and several consecutive failures are
+// required, so a single slow probe doesn't discard a working tunnel.
+func (controller *Controller) tunnelLivenessWatchdog() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("tunnelLivenessWatchdog")
+
+	// Consecutive probe failures are tracked per tunnel. Entries for tunnels
+	// which are no longer active are removed after each round of probes.
+	probeFailures := make(map[*Tunnel][]string)
+
+	for {
+		p := controller.config.clientParameters.Get()
+		period := p.Duration(parameters.TunnelLivenessProbePeriod)
+		timeout := p.Duration(parameters.TunnelLivenessProbeTimeout)
+		maxFailures := p.Int(parameters.TunnelLivenessProbeMaxFailures)
+		address := p.String(parameters.TunnelLivenessProbeAddress)
+		p = nil
+
+		// When disabled, recheck periodically in case tactics enable the
+		// watchdog.
+		enabled := period > 0
+		if !enabled {
+			period = 1 * time.Minute
+		}
+
+		timer := time.NewTimer(period)
+		select {
+		case <-timer.C:
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			NoticeInfo("exiting tunnel liveness watchdog")
+			return
+		}
+
+		if !enabled {
+			probeFailures = make(map[*Tunnel][]string)
+			continue
+		}
+
+		controller.tunnelMutex.Lock()
+		tunnels := append([]*Tunnel(nil), controller.tunnels...)
+		controller.tunnelMutex.Unlock()
+
+		probeErrors := make([]error, len(tunnels))
+
+		var waitGroup sync.WaitGroup
+		for i, tunnel := range tunnels {
+			waitGroup.Add(1)
+			go func(i int, tunnel *Tunnel) {
+				defer waitGroup.Done()
+				probeErrors[i] = probeLiveness(tunnel, address, timeout)
+			}(i, tunnel)
+		}
+		waitGroup.Wait()
+
+		activeTunnels := make(map[*Tunnel][]string)
+
+		for i, tunnel := range tunnels {
+
+			if probeErrors[i] == nil {
+				activeTunnels[tunnel] = nil
+				continue
+			}
+
+			failures := append(probeFailures[tunnel], probeErrors[i].Error())
+
+			if len(failures) < maxFailures {
+				activeTunnels[tunnel] = failures
+				continue
+			}
+
+			NoticeTunnelRecycled(
+				tunnel.serverEntry.IpAddress,
+				tunnel.protocol,
+				len(failures),
+				failures)
+
+			// SignalTunnelFailure results in the tunnel being terminated and
+			// replaced by runTunnels.
+			controller.SignalTunnelFailure(tunnel)
+		}
+
+		probeFailures = activeTunnels
+	}
+}
+
+// probeLiveness tests that the tunnel is relaying traffic. When address is
+// specified, the probe is a TCP port forward to that address, which tests
+// the full path through the server; otherwise, the probe is an SSH request.
+//
+// Unlike sendSshKeepAlive, a failed probe doesn't close the tunnel.
+func probeLiveness(tunnel *Tunnel, address string, timeout time.Duration) error {
+
+	if address != "" {
+		_, err := probeLatency(tunnel, address, timeout)
+		return err
+	}
+
+	if !tunnel.IsActivated() {
+		return common.ContextError(errors.New("tunnel is not activated"))
+	}
+
+	// Note: as in sendSshKeepAlive, SSH requests can't be interrupted, so the
+	// request goroutine may outlive the timeout until the tunnel is closed.
+
+	errChannel := make(chan error, 1)
+
+	go func() {
+		_, _, err := tunnel.sshClient.SendRequest(
+			"keepalive@openssh.com", true, nil)
+		errChannel <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errChannel:
+		if err != nil {
+			return common.ContextError(err)
+		}
+		return nil
+	case <-timer.C:
+		return common.ContextError(errors.New("probe timeout"))
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// tunnelPoolLoad is the aggregate load measured across all active tunnels
+// over one autoscale period.
+type tunnelPoolLoad struct {
+	activeTunnels  int
+	bytesPerSecond int64
+	queueDepth     int
+}
+
+// tunnelPoolAutoscaler periodically measures tunneled throughput and the
+// number of pending port forwards and adjusts the target tunnel pool size,
+// within TunnelPoolMinSize and TunnelPoolMaxSize, one tunnel at a time.
+//
+// The autoscaler only sets the target size; runTunnels, which owns
+// establishment, applies the new size by starting establishment or by
+// terminating excess tunnels.
+func (controller *Controller) tunnelPoolAutoscaler() {
+	defer controller.runWaitGroup.Done()
+	defer controller.recoverPanic("tunnelPoolAutoscaler")
+
+	lastSampleTime := monotime.Now()
+
+	for {
+		p := controller.config.clientParameters.Get()
+		period := p.Duration(parameters.TunnelPoolAutoscalePeriod)
+		growBytesPerSecond := int64(p.Int(parameters.TunnelPoolGrowBytesPerSecond))
+		shrinkBytesPerSecond := int64(p.Int(parameters.TunnelPoolShrinkBytesPerSecond))
+		growQueueDepth := p.Int(parameters.TunnelPoolGrowPortForwardQueueDepth)
+		p = nil
+
+		timer := time.NewTimer(period)
+		select {
+		case <-timer.C:
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			NoticeInfo("exiting tunnel pool autoscaler")
+			return
+		}
+
+		controller.tunnelMutex.Lock()
+		tunnels := append([]*Tunnel(nil), controller.tunnels...)
+		poolSize := controller.tunnelPoolSize
+		controller.tunnelMutex.Unlock()
+
+		var bytesTransferred int64
+		for _, tunnel := range tunnels {
+			bytesTransferred += atomic.SwapInt64(&tunnel.recentBytesTransferred, 0)
+		}
+
+		elapsed := monotime.Since(lastSampleTime)
+		lastSampleTime = monotime.Now()
+
+		load := tunnelPoolLoad{
+			activeTunnels:  len(tunnels),
+			bytesPerSecond: int64(float64(bytesTransferred) / elapsed.Seconds()),
+			queueDepth:     int(atomic.LoadInt32(&controller.pendingPortForwards)),
+		}
+
+		newPoolSize := nextTunnelPoolSize(
+			poolSize,
+			controller.config.TunnelPoolMinSize,
+			controller.config.TunnelPoolMaxSize,
+			load,
+			growBytesPerSecond,
+			shrinkBytesPerSecond,
+			growQueueDepth)
+
+		if newPoolSize == poolSize {
+			continue
+		}
+
+		controller.tunnelMutex.Lock()
+		controller.tunnelPoolSize = newPoolSize
+		controller.updateTunnelPoolState()
+		controller.tunnelMutex.Unlock()
+
+		NoticeTunnelPoolSize(newPoolSize, poolSize, load.bytesPerSecond, load.queueDepth)
+
+		select {
+		case controller.signalTunnelPoolResize <- *new(struct{}):
+		default:
+		}
+	}
+}
+
+// nextTunnelPoolSize returns the pool size for the measured load. The pool
+// grows when it's full and either the per-tunnel throughput reaches
+// growBytesPerSecond or at least growQueueDepth port forwards are pending.
+// The pool shrinks when there are no pending port forwards and per-tunnel
+// throughput is below shrinkBytesPerSecond, provided the throughput spread
+// over the smaller pool would not immediately trigger regrowth.
+func nextTunnelPoolSize(
+	poolSize, minSize, maxSize int,
+	load tunnelPoolLoad,
+	growBytesPerSecond, shrinkBytesPerSecond int64,
+	growQueueDepth int) int {
+
+	newPoolSize := poolSize
+
+	if load.activeTunnels > 0 {
+
+		perTunnelBytesPerSecond := load.bytesPerSecond / int64(load.activeTunnels)
+
+		if load.activeTunnels >= poolSize &&
+			(perTunnelBytesPerSecond >= growBytesPerSecond ||
+				load.queueDepth >= growQueueDepth) {
+
+			newPoolSize = poolSize + 1
+
+		} else if poolSize > 1 &&
+			load.queueDepth == 0 &&
+			perTunnelBytesPerSecond < shrinkBytesPerSecond &&
+			load.bytesPerSecond/int64(poolSize-1) < growBytesPerSecond {
+
+			newPoolSize = poolSize - 1
+		}
+	}
+
+	if newPoolSize < minSize {
+		newPoolSize = minSize
+	}
+	if newPoolSize > maxSize {
+		newPoolSize = maxSize
+	}
+
+	return newPoolSize
+}
+
+// resizeTunnelPool applies a new target pool size set by the autoscaler.
+// Excess tunnels are terminated, most recently registered first, and
+// establishment is started or stopped as required. resizeTunnelPool must
+// only be called by runTunnels, which owns startEstablishing and
+// stopEstablishing.
+func (controller *Controller) resizeTunnelPool() {
+
+	controller.tunnelMutex.Lock()
+	var excessTunnels []*Tunnel
+	if len(controller.tunnels) > controller.tunnelPoolSize {
+		excessTunnels = append(
+			excessTunnels, controller.tunnels[controller.tunnelPoolSize:]...)
+	}
+	controller.tunnelMutex.Unlock()
+
+	for _, tunnel := range excessTunnels {
+		NoticeInfo("shrink tunnel pool: %s", tunnel.serverEntry.IpAddress)
+		controller.terminateTunnel(tunnel)
+	}
+
+	_, outstanding := controller.numTunnels()
+	if outstanding > 0 {
+		controller.startEstablishing()
+	} else {
+		controller.stopEstablishing()
+	}
+}
+
+// maxTunnelPoolSize returns the largest pool size the controller may run,
+// which is TunnelPoolMaxSize when autoscaling is enabled.
+func maxTunnelPoolSize(config *Config) int {
+	if config.TunnelPoolMaxSize > config.TunnelPoolSize {
+		return config.TunnelPoolMaxSize
+	}
+	return config.TunnelPoolSize
+}
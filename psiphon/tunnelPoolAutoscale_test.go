@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+func TestNextTunnelPoolSize(t *testing.T) {
+
+	const (
+		grow       = 100000
+		shrink     = 10000
+		queueDepth = 4
+	)
+
+	testCases := []struct {
+		description string
+		poolSize    int
+		load        tunnelPoolLoad
+		expected    int
+	}{
+		{"no tunnels", 2, tunnelPoolLoad{0, 0, 0}, 2},
+		{"steady", 2, tunnelPoolLoad{2, 2 * 50000, 1}, 2},
+		{"grow on throughput", 2, tunnelPoolLoad{2, 2 * grow, 0}, 3},
+		{"grow on queue depth", 2, tunnelPoolLoad{2, 0, queueDepth}, 3},
+		{"no grow while establishing", 2, tunnelPoolLoad{1, 2 * grow, queueDepth}, 2},
+		{"no grow above max", 4, tunnelPoolLoad{4, 4 * grow, 0}, 4},
+		{"shrink when idle", 3, tunnelPoolLoad{3, 0, 0}, 2},
+		{"no shrink with pending port forwards", 3, tunnelPoolLoad{3, 0, 1}, 3},
+		{"no shrink below min", 1, tunnelPoolLoad{1, 0, 0}, 1},
+		{"clamp to min", 0, tunnelPoolLoad{0, 0, 0}, 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			poolSize := nextTunnelPoolSize(
+				testCase.poolSize, 1, 4, testCase.load, grow, shrink, queueDepth)
+			if poolSize != testCase.expected {
+				t.Fatalf("unexpected pool size: %d", poolSize)
+			}
+		})
+	}
+
+	// Don't shrink when the remaining tunnels would immediately regrow.
+
+	poolSize := nextTunnelPoolSize(
+		2, 1, 4, tunnelPoolLoad{2, 2 * (shrink - 1), 0}, 2*(shrink-1), shrink, queueDepth)
+	if poolSize != 2 {
+		t.Fatalf("unexpected pool size: %d", poolSize)
+	}
+}
@@ -20,13 +20,22 @@
 package psiphon
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/binpatch"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
@@ -43,6 +52,17 @@ import (
 // remote entity's UpgradeDownloadClientVersionHeader. A HEAD request is made to check the
 // version before proceeding with a full download.
 //
+// When UpgradeDownloadChunkSize is > 0, the upgrade is downloaded in a
+// series of Range requests of that size, with each chunk synced to disk
+// before the next is requested, so that progress is retained over tunnels
+// which are interrupted more often than a full download would complete.
+//
+// When config.UpgradeDownloadSignaturePublicKey is set, a signed manifest is
+// first downloaded and the upgrade is verified, chunk by chunk, as it is
+// downloaded; and, when config.UpgradeDownloadPatchBaseFilename matches a
+// patch base listed in the manifest, a binary patch is downloaded in place
+// of the full upgrade. See upgradeManifest.
+//
 // NOTE: This code does not check that any existing file at config.UpgradeDownloadFilename
 // is actually the version specified in handshakeVersion.
 //
@@ -77,6 +97,7 @@ func DownloadUpgrade(
 	urls := p.DownloadURLs(parameters.UpgradeDownloadURLs)
 	clientVersionHeader := p.String(parameters.UpgradeDownloadClientVersionHeader)
 	downloadTimeout := p.Duration(parameters.FetchUpgradeTimeout)
+	chunkSize := p.Int(parameters.UpgradeDownloadChunkSize)
 	p = nil
 
 	var cancelFunc context.CancelFunc
@@ -154,26 +175,597 @@ func DownloadUpgrade(
 	downloadFilename := fmt.Sprintf(
 		"%s.%s", config.UpgradeDownloadFilename, availableClientVersion)
 
-	n, _, err := ResumeDownload(
+	userAgent := MakePsiphonUserAgent(config)
+
+	var n int64
+
+	if config.UpgradeDownloadSignaturePublicKey != "" {
+
+		n, err = downloadVerifiedUpgrade(
+			ctx,
+			httpClient,
+			downloadURL,
+			userAgent,
+			config.UpgradeDownloadSignaturePublicKey,
+			config.UpgradeDownloadPatchBaseFilename,
+			downloadFilename)
+
+	} else if chunkSize > 0 {
+
+		n, err = resumeChunkedDownload(
+			ctx,
+			httpClient,
+			downloadURL,
+			userAgent,
+			downloadFilename,
+			int64(chunkSize),
+			nil,
+			0)
+
+	} else {
+
+		n, _, err = ResumeDownload(
+			ctx,
+			httpClient,
+			downloadURL,
+			userAgent,
+			downloadFilename,
+			"")
+	}
+
+	NoticeClientUpgradeDownloadedBytes(n)
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = os.Rename(downloadFilename, config.UpgradeDownloadFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+
+	return nil
+}
+
+// upgradeManifest describes a client upgrade. The manifest is an
+// AuthenticatedDataPackage, signed with the key corresponding to
+// config.UpgradeDownloadSignaturePublicKey, located at the upgrade download
+// URL with ".manifest" appended to its path.
+//
+// The upgrade is divided into ChunkSize chunks, the last of which may be
+// shorter, and ChunkDigests lists the SHA256 digest of each chunk. Patches
+// lists binary patches, in the binpatch format, which produce the upgrade
+// from a base file with the SHA256 digest BaseSHA256. A patch URL may be
+// relative to the upgrade download URL.
+type upgradeManifest struct {
+	Size         int64
+	SHA256       []byte
+	ChunkSize    int64
+	ChunkDigests [][]byte
+	Patches      []*upgradeManifestPatch
+}
+
+type upgradeManifestPatch struct {
+	BaseSHA256   []byte
+	URL          string
+	Size         int64
+	ChunkDigests [][]byte
+}
+
+const upgradeManifestMaxSize = 1 << 20
+
+// downloadVerifiedUpgrade downloads and verifies the upgrade manifest and
+// then downloads either a patch, which is applied to patchBaseFilename, or
+// the full upgrade, verifying each chunk against the manifest.
+func downloadVerifiedUpgrade(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	signaturePublicKey string,
+	patchBaseFilename string,
+	downloadFilename string) (int64, error) {
+
+	manifestURL, err := url.Parse(downloadURL)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	manifestURL.Path += ".manifest"
+	manifestURL.RawPath = ""
+
+	manifest, err := fetchUpgradeManifest(
+		ctx, httpClient, manifestURL.String(), userAgent, signaturePublicKey)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	var patch *upgradeManifestPatch
+	if patchBaseFilename != "" {
+		baseDigest, err := fileSHA256(patchBaseFilename)
+		if err != nil {
+			NoticeAlert("upgrade patch base unavailable: %s", common.ContextError(err))
+		} else {
+			for _, manifestPatch := range manifest.Patches {
+				if bytes.Equal(manifestPatch.BaseSHA256, baseDigest) {
+					patch = manifestPatch
+					break
+				}
+			}
+		}
+	}
+
+	if patch != nil {
+
+		patchURL, err := manifestURL.Parse(patch.URL)
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+
+		patchFilename := downloadFilename + ".patch"
+
+		n, err := resumeChunkedDownload(
+			ctx,
+			httpClient,
+			patchURL.String(),
+			userAgent,
+			patchFilename,
+			manifest.ChunkSize,
+			patch.ChunkDigests,
+			patch.Size)
+		if err != nil {
+			return n, common.ContextError(err)
+		}
+
+		err = applyUpgradePatch(
+			patchBaseFilename, patchFilename, downloadFilename, manifest.SHA256)
+
+		// The patch is authenticated, so a failure to apply it indicates that
+		// the base file has changed. Fall back to the full upgrade, which is
+		// typically downloaded in a later attempt.
+
+		os.Remove(patchFilename)
+
+		if err == nil {
+			return n, nil
+		}
+
+		NoticeAlert("apply upgrade patch failed: %s", common.ContextError(err))
+	}
+
+	n, err := resumeChunkedDownload(
 		ctx,
 		httpClient,
 		downloadURL,
-		MakePsiphonUserAgent(config),
+		userAgent,
 		downloadFilename,
-		"")
+		manifest.ChunkSize,
+		manifest.ChunkDigests,
+		manifest.Size)
+	if err != nil {
+		return n, common.ContextError(err)
+	}
 
-	NoticeClientUpgradeDownloadedBytes(n)
+	return n, nil
+}
+
+func fetchUpgradeManifest(
+	ctx context.Context,
+	httpClient *http.Client,
+	manifestURL string,
+	userAgent string,
+	signaturePublicKey string) (*upgradeManifest, error) {
+
+	request, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request = request.WithContext(ctx)
+
+	request.Header.Set("User-Agent", userAgent)
+
+	response, err := httpClient.Do(request)
+	if err == nil && response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	}
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	dataPackage, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, upgradeManifestMaxSize))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	manifestJSON, err := common.ReadAuthenticatedDataPackage(
+		dataPackage, true, signaturePublicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var manifest *upgradeManifest
+	err = json.Unmarshal([]byte(manifestJSON), &manifest)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if manifest == nil || manifest.ChunkSize <= 0 {
+		return nil, common.ContextError(errors.New("invalid upgrade manifest"))
+	}
+
+	chunkCount := func(size int64) int64 {
+		return (size + manifest.ChunkSize - 1) / manifest.ChunkSize
+	}
+
+	if int64(len(manifest.ChunkDigests)) != chunkCount(manifest.Size) {
+		return nil, common.ContextError(errors.New("invalid upgrade manifest chunks"))
+	}
+
+	for _, patch := range manifest.Patches {
+		if int64(len(patch.ChunkDigests)) != chunkCount(patch.Size) {
+			return nil, common.ContextError(errors.New("invalid upgrade manifest patch chunks"))
+		}
+	}
+
+	return manifest, nil
+}
+
+// resumeChunkedDownload is a variant of ResumeDownload which downloads
+// downloadURL in a series of chunkSize Range requests. Each chunk is synced
+// to disk before the next chunk is requested. The partial download state
+// files are the same as ResumeDownload.
+//
+// When chunkDigests is not nil, each chunk is verified against its SHA256
+// digest before it is written, and any existing partial download is
+// verified, and truncated at the first invalid chunk, before resuming.
+// size, when > 0, is the expected size of the complete download.
+//
+// The return value is the number of bytes downloaded in this call.
+func resumeChunkedDownload(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	downloadFilename string,
+	chunkSize int64,
+	chunkDigests [][]byte,
+	size int64) (int64, error) {
+
+	partialFilename := fmt.Sprintf("%s.part", downloadFilename)
+
+	partialETagFilename := fmt.Sprintf("%s.part.etag", downloadFilename)
+
+	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	defer file.Close()
+
+	resetPartialDownload := func() {
+		file.Truncate(0)
+		os.Remove(partialETagFilename)
+	}
+
+	offset, err := verifyPartialDownload(file, chunkSize, chunkDigests)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	var partialETag string
+	if offset > 0 {
+		value, err := ioutil.ReadFile(partialETagFilename)
+		if err != nil {
+			resetPartialDownload()
+			return 0, common.ContextError(
+				fmt.Errorf("failed to load partial download ETag: %s", err))
+		}
+		partialETag = string(value)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	chunk := make([]byte, chunkSize)
+	var n int64
 
+	for size <= 0 || offset < size {
+
+		request, err := http.NewRequest("GET", downloadURL, nil)
+		if err != nil {
+			return n, common.ContextError(err)
+		}
+
+		request = request.WithContext(ctx)
+
+		request.Header.Set("User-Agent", userAgent)
+
+		request.Header.Add(
+			"Range", fmt.Sprintf("bytes=%d-%d", offset, offset+chunkSize-1))
+
+		if partialETag != "" {
+			request.Header.Add("If-Match", partialETag)
+		}
+
+		response, err := httpClient.Do(request)
+
+		if err == nil &&
+			(response.StatusCode != http.StatusPartialContent &&
+				response.StatusCode != http.StatusOK &&
+				response.StatusCode != http.StatusRequestedRangeNotSatisfiable &&
+				response.StatusCode != http.StatusPreconditionFailed) {
+			response.Body.Close()
+			err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+		}
+		if err != nil {
+			return n, common.ContextError(err)
+		}
+
+		switch response.StatusCode {
+
+		case http.StatusPreconditionFailed:
+			response.Body.Close()
+			resetPartialDownload()
+			return n, common.ContextError(errors.New("partial download ETag mismatch"))
+
+		case http.StatusRequestedRangeNotSatisfiable:
+			response.Body.Close()
+			if size > 0 {
+				return n, common.ContextError(errors.New("download is shorter than expected"))
+			}
+
+			// Without an expected size, the download is complete when the
+			// requested offset is past the end of the resource.
+			size = offset
+			continue
+
+		case http.StatusOK:
+
+			// The server has ignored the Range header and is sending the entire
+			// resource, which is only usable when starting from the beginning.
+			if offset > 0 {
+				response.Body.Close()
+				resetPartialDownload()
+				return n, common.ContextError(errors.New("range requests not supported"))
+			}
+		}
+
+		if partialETag == "" {
+			partialETag = response.Header.Get("ETag")
+			// Not making failure to write ETag file fatal, in case the entire
+			// download succeeds in this one call.
+			ioutil.WriteFile(partialETagFilename, []byte(partialETag), 0600)
+		}
+
+		if size <= 0 && response.StatusCode == http.StatusPartialContent {
+			size = contentRangeSize(response.Header.Get("Content-Range"))
+		}
+
+		// A 206 response body contains at most one chunk, while a 200 response
+		// body contains all chunks. Each chunk is read, verified and synced
+		// before the next is read.
+
+		for {
+			chunkLength, err := io.ReadFull(response.Body, chunk)
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				err = nil
+			}
+			if err != nil {
+				response.Body.Close()
+				return n, common.ContextError(err)
+			}
+
+			if chunkLength == 0 {
+				break
+			}
+
+			if chunkDigests != nil {
+				index := offset / chunkSize
+				digest := sha256.Sum256(chunk[:chunkLength])
+				if index >= int64(len(chunkDigests)) ||
+					!bytes.Equal(digest[:], chunkDigests[index]) {
+					response.Body.Close()
+					return n, common.ContextError(
+						fmt.Errorf("invalid download chunk: %d", index))
+				}
+			}
+
+			_, err = file.Write(chunk[:chunkLength])
+			if err == nil {
+				err = file.Sync()
+			}
+			if err != nil {
+				response.Body.Close()
+				return n, common.ContextError(err)
+			}
+
+			offset += int64(chunkLength)
+			n += int64(chunkLength)
+
+			if int64(chunkLength) < chunkSize {
+				if size <= 0 {
+					size = offset
+				}
+				break
+			}
+		}
+
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusOK {
+			if size > 0 && offset != size {
+				resetPartialDownload()
+				return n, common.ContextError(errors.New("download size mismatch"))
+			}
+			size = offset
+		}
+	}
+
+	if offset != size {
+		return n, common.ContextError(errors.New("download size mismatch"))
+	}
+
+	// Ensure the file is flushed to disk. The deferred close
+	// will be a noop when this succeeds.
+	err = file.Close()
+	if err != nil {
+		return n, common.ContextError(err)
+	}
+
+	// Remove if exists, to enable rename
+	os.Remove(downloadFilename)
+
+	err = os.Rename(partialFilename, downloadFilename)
+	if err != nil {
+		return n, common.ContextError(err)
+	}
+
+	os.Remove(partialETagFilename)
+
+	return n, nil
+}
+
+// verifyPartialDownload returns the offset at which to resume a partial
+// download. When chunkDigests is not nil, existing chunks are verified and
+// the partial download is truncated at the first invalid or incomplete
+// chunk.
+func verifyPartialDownload(
+	file *os.File, chunkSize int64, chunkDigests [][]byte) (int64, error) {
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	if chunkDigests == nil {
+		return fileInfo.Size(), nil
+	}
+
+	var offset int64
+	chunk := make([]byte, chunkSize)
+
+	for index := 0; index < len(chunkDigests); index++ {
+
+		chunkLength, err := io.ReadFull(file, chunk)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+
+		digest := sha256.Sum256(chunk[:chunkLength])
+		if chunkLength == 0 || !bytes.Equal(digest[:], chunkDigests[index]) {
+			break
+		}
+
+		offset += int64(chunkLength)
+	}
+
+	if offset != fileInfo.Size() {
+		err = file.Truncate(offset)
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+	}
+
+	return offset, nil
+}
+
+// contentRangeSize returns the complete length from a Content-Range header
+// value, or 0 when the length is unknown.
+func contentRangeSize(contentRange string) int64 {
+	index := strings.LastIndex(contentRange, "/")
+	if index == -1 {
+		return 0
+	}
+	size, err := strconv.ParseInt(contentRange[index+1:], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// applyUpgradePatch applies patchFilename to baseFilename, writing the
+// output to outputFilename only when its digest matches expectedDigest.
+func applyUpgradePatch(
+	baseFilename, patchFilename, outputFilename string,
+	expectedDigest []byte) error {
+
+	baseFile, err := os.Open(baseFilename)
 	if err != nil {
 		return common.ContextError(err)
 	}
+	defer baseFile.Close()
 
-	err = os.Rename(downloadFilename, config.UpgradeDownloadFilename)
+	patchFile, err := os.Open(patchFilename)
 	if err != nil {
 		return common.ContextError(err)
 	}
+	defer patchFile.Close()
 
-	NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+	patchedFilename := outputFilename + ".patched"
+
+	patchedFile, err := os.OpenFile(
+		patchedFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer func() {
+		patchedFile.Close()
+		os.Remove(patchedFilename)
+	}()
+
+	hash := sha256.New()
+
+	err = binpatch.Apply(baseFile, patchFile, io.MultiWriter(patchedFile, hash))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if !bytes.Equal(hash.Sum(nil), expectedDigest) {
+		return common.ContextError(errors.New("patched upgrade digest mismatch"))
+	}
+
+	err = patchedFile.Sync()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = patchedFile.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	os.Remove(outputFilename)
+
+	err = os.Rename(patchedFilename, outputFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
 
 	return nil
 }
+
+func fileSHA256(filename string) ([]byte, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return hash.Sum(nil), nil
+}
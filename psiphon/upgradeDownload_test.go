@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/binpatch"
+)
+
+func TestUpgradeDownload(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	chunkSize := int64(4096)
+
+	base := make([]byte, 100000)
+	rand.Read(base)
+	upgrade := append(append([]byte(nil), base[:50000]...), []byte("upgrade")...)
+	upgrade = append(upgrade, base[50000:]...)
+	patch := binpatch.Generate(base, upgrade, 0)
+
+	chunkDigests := func(data []byte) [][]byte {
+		var digests [][]byte
+		for offset := 0; offset < len(data); offset += int(chunkSize) {
+			end := offset + int(chunkSize)
+			if end > len(data) {
+				end = len(data)
+			}
+			digest := sha256.Sum256(data[offset:end])
+			digests = append(digests, digest[:])
+		}
+		return digests
+	}
+
+	upgradeDigest := sha256.Sum256(upgrade)
+	manifest := &upgradeManifest{
+		Size:         int64(len(upgrade)),
+		SHA256:       upgradeDigest[:],
+		ChunkSize:    chunkSize,
+		ChunkDigests: chunkDigests(upgrade),
+	}
+
+	baseDigest := sha256.Sum256(base)
+	manifest.Patches = []*upgradeManifestPatch{
+		{
+			BaseSHA256:   baseDigest[:],
+			URL:          "patches/upgrade.patch",
+			Size:         int64(len(patch)),
+			ChunkDigests: chunkDigests(patch),
+		},
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	signedManifest, err := common.WriteAuthenticatedDataPackage(
+		string(manifestJSON), signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	// The server fails every third request, simulating a flaky tunnel, and
+	// may corrupt responses.
+
+	var requestCount, corrupt int32
+	var upgradeRequestCount, patchRequestCount int32
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if atomic.AddInt32(&requestCount, 1)%3 == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			var content []byte
+			switch r.URL.Path {
+			case "/upgrade":
+				atomic.AddInt32(&upgradeRequestCount, 1)
+				content = upgrade
+			case "/upgrade.manifest":
+				content = signedManifest
+			case "/patches/upgrade.patch":
+				atomic.AddInt32(&patchRequestCount, 1)
+				content = patch
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if atomic.LoadInt32(&corrupt) == 1 {
+				content = append([]byte(nil), content...)
+				content[len(content)-1] ^= 1
+			}
+
+			w.Header().Set("ETag", `"etag"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	defer server.Close()
+
+	downloadURL := server.URL + "/upgrade"
+
+	downloadWithRetries := func(download func() error) error {
+		for i := 0; i < 100; i++ {
+			err = download()
+			if err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+
+	checkDownload := func(filename string, expected []byte) {
+		downloaded, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(downloaded, expected) {
+			t.Fatalf("unexpected download")
+		}
+	}
+
+	// Chunked download without a manifest.
+
+	downloadFilename := filepath.Join(testDataDirName, "chunked")
+
+	err = downloadWithRetries(func() error {
+		_, err := resumeChunkedDownload(
+			context.Background(), http.DefaultClient, downloadURL, "",
+			downloadFilename, chunkSize, nil, 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("resumeChunkedDownload failed: %s", err)
+	}
+
+	checkDownload(downloadFilename, upgrade)
+
+	// Verified download rejects the corrupt last chunk, retaining the verified
+	// partial download.
+
+	downloadFilename = filepath.Join(testDataDirName, "verified")
+
+	atomic.StoreInt32(&corrupt, 1)
+
+	err = downloadWithRetries(func() error {
+		_, err := resumeChunkedDownload(
+			context.Background(), http.DefaultClient, downloadURL, "",
+			downloadFilename, chunkSize, manifest.ChunkDigests, manifest.Size)
+		if err == nil {
+			t.Fatalf("unexpected resumeChunkedDownload success")
+		}
+		fileInfo, statErr := os.Stat(downloadFilename + ".part")
+		if statErr == nil && fileInfo.Size() == manifest.Size-manifest.Size%chunkSize {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected partial download: %s", err)
+	}
+
+	atomic.StoreInt32(&corrupt, 0)
+
+	err = downloadWithRetries(func() error {
+		_, err := downloadVerifiedUpgrade(
+			context.Background(), http.DefaultClient, downloadURL, "",
+			signingPublicKey, "", downloadFilename)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("downloadVerifiedUpgrade failed: %s", err)
+	}
+
+	checkDownload(downloadFilename, upgrade)
+
+	// Patched download.
+
+	baseFilename := filepath.Join(testDataDirName, "base")
+	err = ioutil.WriteFile(baseFilename, base, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	downloadFilename = filepath.Join(testDataDirName, "patched")
+
+	atomic.StoreInt32(&upgradeRequestCount, 0)
+
+	err = downloadWithRetries(func() error {
+		_, err := downloadVerifiedUpgrade(
+			context.Background(), http.DefaultClient, downloadURL, "",
+			signingPublicKey, baseFilename, downloadFilename)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("downloadVerifiedUpgrade failed: %s", err)
+	}
+
+	checkDownload(downloadFilename, upgrade)
+
+	if atomic.LoadInt32(&upgradeRequestCount) != 0 ||
+		atomic.LoadInt32(&patchRequestCount) == 0 {
+		t.Fatalf("unexpected requests")
+	}
+
+	// A manifest signed with another key is rejected.
+
+	otherPublicKey, _, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = downloadVerifiedUpgrade(
+			context.Background(), http.DefaultClient, downloadURL, "",
+			otherPublicKey, "", filepath.Join(testDataDirName, "rejected"))
+		if err == nil {
+			t.Fatalf("unexpected downloadVerifiedUpgrade success")
+		}
+	}
+}
@@ -37,6 +37,7 @@ const (
 
 type NTLMHttpAuthenticator struct {
 	state    NTLMHttpAuthState
+	scheme   string
 	username string
 	password string
 }
@@ -44,6 +45,20 @@ type NTLMHttpAuthenticator struct {
 func newNTLMAuthenticator(username, password string) *NTLMHttpAuthenticator {
 	return &NTLMHttpAuthenticator{
 		state:    NTLM_HTTP_AUTH_STATE_CHALLENGE_RECEIVED,
+		scheme:   "NTLM",
+		username: username,
+		password: password,
+	}
+}
+
+// newNegotiateAuthenticator creates an authenticator for the "Negotiate"
+// scheme. Kerberos is not supported; raw NTLMSSP tokens, which SPNEGO
+// acceptors such as Windows proxies accept in place of a SPNEGO token, are
+// sent in the Negotiate exchange.
+func newNegotiateAuthenticator(username, password string) *NTLMHttpAuthenticator {
+	return &NTLMHttpAuthenticator{
+		state:    NTLM_HTTP_AUTH_STATE_CHALLENGE_RECEIVED,
+		scheme:   "Negotiate",
 		username: username,
 		password: password,
 	}
@@ -55,14 +70,14 @@ func (a *NTLMHttpAuthenticator) Authenticate(req *http.Request, resp *http.Respo
 	}
 	challenges, err := parseAuthChallenge(resp)
 
-	challenge, ok := challenges["NTLM"]
+	challenge, ok := challenges[a.scheme]
 	if challenge == "" {
 		a.state = NTLM_HTTP_AUTH_STATE_CHALLENGE_RECEIVED
 	} else {
 		a.state = NTLM_HTTP_AUTH_STATE_RESPONSE_TYPE1_GENERATED
 	}
 	if !ok {
-		return proxyError(fmt.Errorf("Bad proxy response, no NTLM challenge for NTLMHttpAuthenticator"))
+		return proxyError(fmt.Errorf("Bad proxy response, no %s challenge for NTLMHttpAuthenticator", a.scheme))
 	}
 
 	var ntlmMsg []byte
@@ -79,7 +94,7 @@ func (a *NTLMHttpAuthenticator) Authenticate(req *http.Request, resp *http.Respo
 		}
 		ntlmMsg = negotiate.Bytes()
 		a.state = NTLM_HTTP_AUTH_STATE_RESPONSE_TYPE1_GENERATED
-		req.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(ntlmMsg))
+		req.Header.Set("Proxy-Authorization", a.scheme+" "+base64.StdEncoding.EncodeToString(ntlmMsg))
 		return nil
 	} else if a.state == NTLM_HTTP_AUTH_STATE_RESPONSE_TYPE1_GENERATED {
 		// Parse username for domain in form DOMAIN\username
@@ -108,7 +123,7 @@ func (a *NTLMHttpAuthenticator) Authenticate(req *http.Request, resp *http.Respo
 		}
 		ntlmMsg = authenticate.Bytes()
 		a.state = NTLM_HTTP_AUTH_STATE_RESPONSE_TYPE3_GENERATED
-		req.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(ntlmMsg))
+		req.Header.Set("Proxy-Authorization", a.scheme+" "+base64.StdEncoding.EncodeToString(ntlmMsg))
 		return nil
 	}
 
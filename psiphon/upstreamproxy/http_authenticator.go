@@ -69,9 +69,11 @@ func NewHttpAuthenticator(resp *http.Response, username, password string) (HttpA
 		return nil, err
 	}
 
-	// NTLM > Digest > Basic
+	// NTLM > Negotiate > Digest > Basic
 	if _, ok := challenges["NTLM"]; ok {
 		return newNTLMAuthenticator(username, password), nil
+	} else if _, ok := challenges["Negotiate"]; ok {
+		return newNegotiateAuthenticator(username, password), nil
 	} else if _, ok := challenges["Digest"]; ok {
 		return newDigestAuthenticator(username, password), nil
 	} else if _, ok := challenges["Basic"]; ok {
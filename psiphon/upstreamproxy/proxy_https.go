@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// newHTTPS creates a HTTP CONNECT proxy dialer which connects to the proxy
+// using TLS. The proxy certificate is verified using the system root CAs and
+// the proxy hostname.
+func newHTTPS(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+
+	dialer, err := newHTTP(uri, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	hp := dialer.(*httpProxy)
+	hp.forward = &tlsDialer{
+		forward:    forward,
+		serverName: uri.Hostname(),
+	}
+
+	return hp, nil
+}
+
+// tlsDialer establishes a TLS session over connections made with its
+// forward dialer.
+type tlsDialer struct {
+	forward    proxy.Dialer
+	serverName string
+}
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+
+	conn, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: d.serverName})
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, proxyError(fmt.Errorf("TLS handshake with proxy: %v", err))
+	}
+
+	return tlsConn, nil
+}
+
+func init() {
+	proxy.RegisterDialerType("https", newHTTPS)
+}
@@ -42,10 +42,17 @@ func proxyError(err error) error {
 	return &Error{error: fmt.Errorf("upstreamproxy error: %s", err)}
 }
 
+// UpstreamProxyConfig specifies an upstream proxy, or a chain of upstream
+// proxies. When ChainedProxyURIStrings is set, the proxy specified by
+// ProxyURIString is used to reach the first chained proxy, which is used to
+// reach the next chained proxy, and so on; the last proxy in the chain dials
+// the destination. CustomHeaders are sent only to an HTTP proxy specified by
+// ProxyURIString.
 type UpstreamProxyConfig struct {
-	ForwardDialFunc DialFunc
-	ProxyURIString  string
-	CustomHeaders   http.Header
+	ForwardDialFunc        DialFunc
+	ProxyURIString         string
+	ChainedProxyURIStrings []string
+	CustomHeaders          http.Header
 }
 
 // Dial implements the proxy.Dialer interface, allowing a UpstreamProxyConfig
@@ -58,18 +65,28 @@ func NewProxyDialFunc(config *UpstreamProxyConfig) DialFunc {
 	if config.ProxyURIString == "" {
 		return config.ForwardDialFunc
 	}
-	proxyURI, err := url.Parse(config.ProxyURIString)
-	if err != nil {
-		return func(network, addr string) (net.Conn, error) {
-			return nil, proxyError(fmt.Errorf("proxyURI url.Parse: %v", err))
+
+	proxyURIStrings := append(
+		[]string{config.ProxyURIString}, config.ChainedProxyURIStrings...)
+
+	var dialer proxy.Dialer = config
+
+	for _, proxyURIString := range proxyURIStrings {
+
+		proxyURI, err := url.Parse(proxyURIString)
+		if err != nil {
+			return func(network, addr string) (net.Conn, error) {
+				return nil, proxyError(fmt.Errorf("proxyURI url.Parse: %v", err))
+			}
 		}
-	}
 
-	dialer, err := proxy.FromURL(proxyURI, config)
-	if err != nil {
-		return func(network, addr string) (net.Conn, error) {
-			return nil, proxyError(fmt.Errorf("proxy.FromURL: %v", err))
+		dialer, err = proxy.FromURL(proxyURI, dialer)
+		if err != nil {
+			return func(network, addr string) (net.Conn, error) {
+				return nil, proxyError(fmt.Errorf("proxy.FromURL: %v", err))
+			}
 		}
 	}
+
 	return dialer.Dial
 }
@@ -29,6 +29,7 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -214,7 +215,48 @@ func emitMemoryMetrics() {
 		common.FormatByteCount(memStats.NextGC))
 }
 
+const (
+	DEFAULT_GC_PERCENT      = 5
+	MEMORY_LIMIT_GC_PERCENT = 100
+)
+
+// gcPercent is the GC target percentage set by DoGarbageCollection.
+var gcPercent int32 = DEFAULT_GC_PERCENT
+
 func DoGarbageCollection() {
-	debug.SetGCPercent(5)
+	debug.SetGCPercent(int(atomic.LoadInt32(&gcPercent)))
 	debug.FreeOSMemory()
 }
+
+// applyMemoryLimit sets a soft memory limit for the Go runtime. With a
+// memory limit, the limit rather than an aggressive GC percent bounds memory
+// use, so the GC percent set by DoGarbageCollection is relaxed to
+// limitGCPercent, or MEMORY_LIMIT_GC_PERCENT when limitGCPercent is 0, to
+// reduce GC CPU overhead while memory use is well below the limit.
+//
+// The memory limit and GC percent are process-wide. The returned function
+// restores the previous memory limit and GC percent. When limitBytes is 0,
+// or when the Go runtime doesn't support a memory limit, the runtime
+// settings are unchanged.
+func applyMemoryLimit(limitBytes int64, limitGCPercent int) func() {
+	if limitBytes <= 0 {
+		return func() {}
+	}
+	if limitGCPercent == 0 {
+		limitGCPercent = MEMORY_LIMIT_GC_PERCENT
+	}
+	previousLimitBytes, ok := setMemoryLimit(limitBytes)
+	if !ok {
+		NoticeAlert("memory limit not supported by this Go runtime")
+		return func() {}
+	}
+	previousGCPercent := atomic.SwapInt32(&gcPercent, int32(limitGCPercent))
+	previousRuntimeGCPercent := debug.SetGCPercent(limitGCPercent)
+	NoticeInfo("memory limit: %s, GC percent: %d",
+		common.FormatByteCount(uint64(limitBytes)), limitGCPercent)
+	return func() {
+		setMemoryLimit(previousLimitBytes)
+		atomic.StoreInt32(&gcPercent, previousGCPercent)
+		debug.SetGCPercent(previousRuntimeGCPercent)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// The V2Ray outbound adapter dials tunnel connections through a locally
+// running V2Ray or Xray instance, whose outbound, typically VLESS or VMess,
+// is the first hop before the Psiphon handshake. This is for networks where
+// only those protocols currently pass.
+//
+// V2Ray and Xray expose outbounds to local applications via a "socks" or
+// "http" inbound; the adapter dials the inbound using the upstream proxy
+// dialer. Unlike UpstreamProxyURL, the adapter applies only to tunnel
+// dials: untunneled requests, such as remote server list fetches, are not
+// sent through the V2Ray outbound. As with an upstream proxy, only TCP tunnel
+// protocols are used.
+//
+// V2Ray or Xray must be configured and run separately; the adapter doesn't
+// manage the V2Ray process or its outbound configuration.
+
+const (
+	V2RAY_OUTBOUND_PROTOCOL_VLESS = "vless"
+	V2RAY_OUTBOUND_PROTOCOL_VMESS = "vmess"
+
+	v2rayOutboundCheckTimeout = 5 * time.Second
+)
+
+// validateV2RayOutbound checks the V2Ray outbound config fields.
+func (config *Config) validateV2RayOutbound() error {
+
+	if config.V2RayOutboundProxyURL == "" {
+		if config.V2RayOutboundProtocol != "" {
+			return common.ContextError(errors.New("missing V2RayOutboundProxyURL"))
+		}
+		return nil
+	}
+
+	if config.UpstreamProxyURL != "" {
+		return common.ContextError(
+			errors.New("V2RayOutboundProxyURL and UpstreamProxyURL are mutually exclusive"))
+	}
+
+	proxyURL, err := url.Parse(config.V2RayOutboundProxyURL)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "http" {
+		return common.ContextError(
+			fmt.Errorf("unsupported V2RayOutboundProxyURL scheme: %s", proxyURL.Scheme))
+	}
+
+	// The V2Ray instance must be local, as the connection to its inbound is
+	// not obfuscated.
+	IP := net.ParseIP(proxyURL.Hostname())
+	if proxyURL.Hostname() != "localhost" && (IP == nil || !IP.IsLoopback()) {
+		return common.ContextError(errors.New("V2RayOutboundProxyURL host is not local"))
+	}
+
+	switch config.V2RayOutboundProtocol {
+	case "", V2RAY_OUTBOUND_PROTOCOL_VLESS, V2RAY_OUTBOUND_PROTOCOL_VMESS:
+	default:
+		return common.ContextError(
+			fmt.Errorf("unsupported V2RayOutboundProtocol: %s", config.V2RayOutboundProtocol))
+	}
+
+	return nil
+}
+
+// useV2RayOutbound indicates whether tunnel dials use the V2Ray outbound.
+func (config *Config) useV2RayOutbound() bool {
+	return config.V2RayOutboundProxyURL != ""
+}
+
+// getTunnelUpstreamProxyURL returns the upstream proxy URL for tunnel
+// dials, which is the V2Ray inbound when the V2Ray outbound is configured.
+func (config *Config) getTunnelUpstreamProxyURL() string {
+	if config.useV2RayOutbound() {
+		return config.V2RayOutboundProxyURL
+	}
+	return config.UpstreamProxyURL
+}
+
+// checkV2RayOutbound emits an alert notice when the V2Ray inbound isn't
+// accepting connections, which otherwise appears only as tunnel dial
+// failures.
+func checkV2RayOutbound(ctx context.Context, config *Config) {
+
+	proxyURL, err := url.Parse(config.V2RayOutboundProxyURL)
+	if err != nil {
+		return
+	}
+
+	address := proxyURL.Host
+	if proxyURL.Port() == "" {
+		address = net.JoinHostPort(proxyURL.Hostname(), "1080")
+		if proxyURL.Scheme == "http" {
+			address = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	ctx, cancelFunc := context.WithTimeout(ctx, v2rayOutboundCheckTimeout)
+	defer cancelFunc()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		NoticeAlert("V2Ray inbound unavailable: %s", common.ContextError(err))
+		return
+	}
+	conn.Close()
+
+	NoticeInfo("using V2Ray outbound: %s", config.V2RayOutboundProtocol)
+}
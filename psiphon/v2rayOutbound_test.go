@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+func TestV2RayOutboundConfig(t *testing.T) {
+
+	testCases := []struct {
+		proxyURL         string
+		protocol         string
+		upstreamProxyURL string
+		expectValid      bool
+	}{
+		{"socks5://127.0.0.1:10808", "vless", "", true},
+		{"http://localhost:10809", "vmess", "", true},
+		{"socks5://user:password@[::1]:10808", "", "", true},
+		{"socks5://192.0.2.1:10808", "vless", "", false},
+		{"socks4a://127.0.0.1:10808", "vless", "", false},
+		{"socks5://127.0.0.1:10808", "trojan", "", false},
+		{"socks5://127.0.0.1:10808", "vless", "http://127.0.0.1:8080", false},
+		{"", "vless", "", false},
+	}
+
+	for _, testCase := range testCases {
+
+		config, err := LoadConfig([]byte(`{"PropagationChannelId" : "0", "SponsorId" : "0"}`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		config.V2RayOutboundProxyURL = testCase.proxyURL
+		config.V2RayOutboundProtocol = testCase.protocol
+		config.UpstreamProxyURL = testCase.upstreamProxyURL
+
+		err = config.Commit()
+		if (err == nil) != testCase.expectValid {
+			t.Fatalf("unexpected Commit result for %+v: %v", testCase, err)
+		}
+
+		if !testCase.expectValid {
+			continue
+		}
+
+		if !config.UseUpstreamProxy() ||
+			config.getTunnelUpstreamProxyURL() != testCase.proxyURL {
+			t.Fatalf("unexpected tunnel upstream proxy for %+v", testCase)
+		}
+
+		dialConfig, dialStats := initDialConfig(config, nil)
+		if dialConfig.UpstreamProxyURL != testCase.proxyURL {
+			t.Fatalf("unexpected dial config upstream proxy: %s", dialConfig.UpstreamProxyURL)
+		}
+		if dialStats.UpstreamProxyType == "" {
+			t.Fatalf("missing upstream proxy type")
+		}
+	}
+}